@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const annotationsCollection = "annotations"
+
+// Annotation marks a range of dates as known bad for some or all tables of a network. Files covered by an annotation
+// are not exported and are reported as intentional gaps rather than missing.
+type Annotation struct {
+	ID      int       `json:"id"`
+	Network string    `json:"network"`
+	Tables  []string  `json:"tables,omitempty"` // empty means all tables
+	From    Date      `json:"from"`
+	To      Date      `json:"to"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// Covers reports whether the annotation applies to the table on the given date.
+func (a *Annotation) Covers(network string, table string, d Date) bool {
+	if a.Network != network {
+		return false
+	}
+	if a.From.After(d) || d.After(a.To) {
+		return false
+	}
+	if len(a.Tables) == 0 {
+		return true
+	}
+	for _, t := range a.Tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Annotations is a list of annotations.
+type Annotations []*Annotation
+
+// Find returns the first annotation that covers the table on the given date, or nil if there is none.
+func (as Annotations) Find(network string, table string, d Date) *Annotation {
+	for _, a := range as {
+		if a.Covers(network, table, d) {
+			return a
+		}
+	}
+	return nil
+}
+
+// Annotations returns all annotations held in the state store.
+func (s *StateStore) Annotations() (Annotations, error) {
+	var as Annotations
+	if err := s.load(annotationsCollection, &as); err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+// AddAnnotation records a new annotation, assigning it an id.
+func (s *StateStore) AddAnnotation(a *Annotation) error {
+	if a.From.IsZero() || a.To.IsZero() {
+		return fmt.Errorf("annotation must have a date range")
+	}
+	if a.From.After(a.To) {
+		return fmt.Errorf("annotation start date %s is after end date %s", a.From.String(), a.To.String())
+	}
+	if a.Reason == "" {
+		return fmt.Errorf("annotation must have a reason")
+	}
+
+	var as Annotations
+	return s.update(annotationsCollection, &as, func() error {
+		for _, existing := range as {
+			if existing.ID >= a.ID {
+				a.ID = existing.ID + 1
+			}
+		}
+		if a.ID == 0 {
+			a.ID = 1
+		}
+		as = append(as, a)
+		sort.Slice(as, func(i, j int) bool { return as[i].ID < as[j].ID })
+		return nil
+	})
+}
+
+// RemoveAnnotation removes the annotation with the given id.
+func (s *StateStore) RemoveAnnotation(id int) error {
+	var as Annotations
+	return s.update(annotationsCollection, &as, func() error {
+		for i := range as {
+			if as[i].ID == id {
+				as = append(as[:i], as[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("annotation %d not found", id)
+	})
+}
+
+// loadAnnotations returns the annotations from the configured state store, if any.
+func loadAnnotations() (Annotations, error) {
+	if stateStore == nil {
+		return nil, nil
+	}
+	return stateStore.Annotations()
+}
+
+var annotateCommand = &cli.Command{
+	Name:  "annotate",
+	Usage: "Manage annotations marking periods or tables as known bad.",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "add",
+			Usage:  "Mark a range of dates as known bad so that files are not exported.",
+			Before: configure,
+			Flags: flagSet(
+				loggingFlags,
+				networkFlags,
+				tableRegistryFlags,
+				requiredStateFlags,
+				[]cli.Flag{
+					&cli.StringFlag{
+						Name:     "from-date",
+						Usage:    "First date covered by the annotation.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "to-date",
+						Usage: "Last date covered by the annotation. Defaults to the from date.",
+					},
+					&cli.StringFlag{
+						Name:  "tables",
+						Usage: "Tables covered by the annotation, comma separated. Default is all tables.",
+					},
+					&cli.StringFlag{
+						Name:     "reason",
+						Usage:    "Reason the period is known to be bad.",
+						Required: true,
+					},
+				},
+			),
+			Action: func(cc *cli.Context) error {
+				from, err := DateFromString(cc.String("from-date"))
+				if err != nil {
+					return fmt.Errorf("invalid from date: %w", err)
+				}
+
+				to := from
+				if cc.IsSet("to-date") {
+					to, err = DateFromString(cc.String("to-date"))
+					if err != nil {
+						return fmt.Errorf("invalid to date: %w", err)
+					}
+				}
+
+				var tables []string
+				if cc.IsSet("tables") {
+					tables, err = parseTableList(cc.String("tables"))
+					if err != nil {
+						return fmt.Errorf("invalid tables: %w", err)
+					}
+				}
+
+				a := &Annotation{
+					Network: networkConfig.name,
+					Tables:  tables,
+					From:    from,
+					To:      to,
+					Reason:  cc.String("reason"),
+					Created: time.Now().UTC(),
+				}
+				if err := stateStore.AddAnnotation(a); err != nil {
+					return fmt.Errorf("add annotation: %w", err)
+				}
+
+				fmt.Printf("added annotation %d\n", a.ID)
+				return nil
+			},
+		},
+		{
+			Name:   "list",
+			Usage:  "List annotations.",
+			Before: configure,
+			Flags: flagSet(
+				loggingFlags,
+				networkFlags,
+				tableRegistryFlags,
+				requiredStateFlags,
+			),
+			Action: func(cc *cli.Context) error {
+				as, err := stateStore.Annotations()
+				if err != nil {
+					return fmt.Errorf("read annotations: %w", err)
+				}
+
+				for _, a := range as {
+					tables := "all"
+					if len(a.Tables) > 0 {
+						tables = strings.Join(a.Tables, ",")
+					}
+					fmt.Printf("%d %s %s..%s %s (%s)\n", a.ID, a.Network, a.From.String(), a.To.String(), tables, a.Reason)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove an annotation.",
+			ArgsUsage: "<id>",
+			Before:    configure,
+			Flags: flagSet(
+				loggingFlags,
+				networkFlags,
+				tableRegistryFlags,
+				requiredStateFlags,
+			),
+			Action: func(cc *cli.Context) error {
+				if cc.NArg() != 1 {
+					return fmt.Errorf("expected a single annotation id")
+				}
+				id, err := strconv.Atoi(cc.Args().First())
+				if err != nil {
+					return fmt.Errorf("invalid annotation id: %w", err)
+				}
+
+				if err := stateStore.RemoveAnnotation(id); err != nil {
+					return fmt.Errorf("remove annotation: %w", err)
+				}
+				return nil
+			},
+		},
+	},
+}
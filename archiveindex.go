@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ArchiveIndexFilename is the name of the archive index written to the root of the ship path.
+	ArchiveIndexFilename = "index.json"
+
+	// ArchiveIndexHTMLFilename is the name of the human readable archive index written to the root of the ship path.
+	ArchiveIndexHTMLFilename = "index.html"
+)
+
+// ArchiveIndex lists every network, table, format and schema held in the ship path along with the dates available
+// for each, giving mirrors and download tooling a single point from which to discover the contents of the archive.
+type ArchiveIndex struct {
+	Generated time.Time              `json:"generated"`
+	Networks  []*ArchiveIndexNetwork `json:"networks"` // sorted by network name
+}
+
+// ArchiveIndexNetwork describes the shipped files of a single network.
+type ArchiveIndexNetwork struct {
+	Network           string               `json:"network"`
+	GenesisTs         int64                `json:"genesis_ts"`
+	HeightIndex       string               `json:"height_index"` // path relative to the ship path
+	HeightIndexSHA256 string               `json:"height_index_sha256"`
+	TotalSize         int64                `json:"total_size"`
+	Tables            []*ArchiveIndexTable `json:"tables"` // sorted by table, format, schema and period
+}
+
+// ArchiveIndexTable describes the shipped files of a table in a single format, schema version and period length.
+type ArchiveIndexTable struct {
+	Table       string      `json:"table"`
+	Period      string      `json:"period"` // length of the periods covered by the files
+	Format      string      `json:"format"`
+	Schema      int         `json:"schema"`
+	Index       string      `json:"index"` // path of the table index relative to the ship path
+	IndexSHA256 string      `json:"index_sha256"`
+	Files       int         `json:"files"`
+	TotalSize   int64       `json:"total_size"`
+	StartHeight int64       `json:"start_height"`
+	EndHeight   int64       `json:"end_height"`
+	Dates       []DateRange `json:"dates"` // contiguous runs of dates with shipped files, in order
+}
+
+// DateRange is an inclusive range of dates.
+type DateRange struct {
+	From Date `json:"from"`
+	To   Date `json:"to"`
+}
+
+func (r DateRange) String() string {
+	if r.From == r.To {
+		return r.From.String()
+	}
+	return r.From.String() + " to " + r.To.String()
+}
+
+// archiveIndexNetwork summarises the files of a height index by table. Checksums of the indexes are not set.
+func archiveIndexNetwork(hi *HeightIndex) *ArchiveIndexNetwork {
+	an := &ArchiveIndexNetwork{
+		Network:     hi.Network,
+		GenesisTs:   hi.GenesisTs,
+		HeightIndex: heightIndexPath(hi.Network),
+	}
+
+	tables := map[string]*ArchiveIndexTable{}
+	dates := map[string]map[Date]bool{}
+	for path, ref := range hi.Files {
+		// Files are written to <network>/<format>/<schema>/<table>/<year>/<file>, with hourly and weekly files in an
+		// hourly or weekly directory above the year, unless they were shipped with a layout
+		tableDir := filepath.Dir(filepath.Dir(path))
+		parts := strings.Split(filepath.ToSlash(path), "/")
+		period := PeriodDay
+		if ref.TableDir != "" {
+			tableDir = ref.TableDir
+			parts = strings.Split(filepath.ToSlash(ref.TableDir), "/")
+			if len(parts) != 4 {
+				continue
+			}
+			if ref.Period != "" {
+				period = ref.Period
+			}
+		} else if len(parts) == 7 {
+			switch parts[4] {
+			case "hourly":
+				period = PeriodHour
+			case "weekly":
+				period = PeriodWeek
+			default:
+				continue
+			}
+		} else if len(parts) != 6 {
+			continue
+		}
+		schema, err := strconv.Atoi(parts[2])
+		if err != nil {
+			continue
+		}
+
+		index := filepath.ToSlash(tableIndexPath(tableDir, ref.Table))
+		at, ok := tables[index]
+		if !ok {
+			at = &ArchiveIndexTable{
+				Table:       ref.Table,
+				Period:      period,
+				Format:      parts[1],
+				Schema:      schema,
+				Index:       index,
+				StartHeight: ref.StartHeight,
+				EndHeight:   ref.EndHeight,
+			}
+			tables[index] = at
+			dates[index] = map[Date]bool{}
+		}
+		at.Files++
+		at.TotalSize += ref.Size
+		if ref.StartHeight < at.StartHeight {
+			at.StartHeight = ref.StartHeight
+		}
+		if ref.EndHeight > at.EndHeight {
+			at.EndHeight = ref.EndHeight
+		}
+		dates[index][ref.Date] = true
+		an.TotalSize += ref.Size
+	}
+
+	for index, at := range tables {
+		at.Dates = dateRanges(dates[index])
+		an.Tables = append(an.Tables, at)
+	}
+	sort.Slice(an.Tables, func(a, b int) bool {
+		ta, tb := an.Tables[a], an.Tables[b]
+		if ta.Table != tb.Table {
+			return ta.Table < tb.Table
+		}
+		if ta.Format != tb.Format {
+			return ta.Format < tb.Format
+		}
+		if ta.Schema != tb.Schema {
+			return ta.Schema < tb.Schema
+		}
+		return ta.Period < tb.Period
+	})
+	return an
+}
+
+// dateRanges collapses a set of dates into contiguous ranges, in order.
+func dateRanges(dates map[Date]bool) []DateRange {
+	sorted := make([]Date, 0, len(dates))
+	for d := range dates {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(a, b int) bool { return sorted[b].After(sorted[a]) })
+
+	var ranges []DateRange
+	for _, d := range sorted {
+		if n := len(ranges); n > 0 && ranges[n-1].To.Next() == d {
+			ranges[n-1].To = d
+			continue
+		}
+		ranges = append(ranges, DateRange{From: d, To: d})
+	}
+	return ranges
+}
+
+// buildArchiveIndex reads the height index of each network and the checksums of the indexes it refers to. The networks
+// are those listed by the existing archive index, which lists networks shipped by other archivers sharing the ship
+// path, along with the network whose height index has just been written.
+func buildArchiveIndex(ctx context.Context, sh Shipper, network string) (*ArchiveIndex, error) {
+	networks := map[string]bool{network: true}
+	data, err := sh.Read(ctx, ArchiveIndexFilename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read %s: %w", ArchiveIndexFilename, err)
+	}
+	if err == nil {
+		var existing ArchiveIndex
+		if err := json.Unmarshal(data, &existing); err != nil {
+			logger.Warnw("ignoring invalid archive index", "error", err)
+		}
+		for _, an := range existing.Networks {
+			networks[an.Network] = true
+		}
+	}
+
+	ai := &ArchiveIndex{Networks: []*ArchiveIndexNetwork{}}
+	for name := range networks {
+		hi, err := readHeightIndex(ctx, sh, name)
+		if err != nil {
+			return nil, fmt.Errorf("read height index for %s: %w", name, err)
+		}
+		if hi == nil {
+			continue
+		}
+
+		an := archiveIndexNetwork(hi)
+		an.HeightIndexSHA256, err = sha256Index(ctx, sh, an.HeightIndex)
+		if err != nil {
+			return nil, fmt.Errorf("checksum height index for %s: %w", hi.Network, err)
+		}
+		for _, at := range an.Tables {
+			at.IndexSHA256, err = sha256Index(ctx, sh, at.Index)
+			if err != nil {
+				return nil, fmt.Errorf("checksum table index for %s: %w", at.Table, err)
+			}
+		}
+		ai.Networks = append(ai.Networks, an)
+	}
+	sort.Slice(ai.Networks, func(a, b int) bool { return ai.Networks[a].Network < ai.Networks[b].Network })
+	return ai, nil
+}
+
+// sha256Index returns the hex encoded SHA-256 checksum of a shipped index.
+func sha256Index(ctx context.Context, sh Shipper, path string) (string, error) {
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+var archiveIndexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sentinel Archive</title>
+</head>
+<body>
+<h1>Sentinel Archive</h1>
+<p>Generated {{ .Generated.Format "2006-01-02 15:04:05 MST" }}. A machine readable version of this index is available as <a href="index.json">index.json</a>.</p>
+{{ range .Networks }}
+<h2>{{ .Network }}</h2>
+<p>{{ size .TotalSize }} in total. Files are listed by height in <a href="{{ .HeightIndex }}">{{ .HeightIndex }}</a>.</p>
+<table>
+<tr><th>Table</th><th>Period</th><th>Format</th><th>Schema</th><th>Dates</th><th>Heights</th><th>Files</th><th>Size</th><th>Index</th></tr>
+{{ range .Tables }}<tr><td>{{ .Table }}</td><td>{{ .Period }}</td><td>{{ .Format }}</td><td>{{ .Schema }}</td><td>{{ range $i, $r := .Dates }}{{ if $i }}, {{ end }}{{ $r.String }}{{ end }}</td><td>{{ .StartHeight }} to {{ .EndHeight }}</td><td>{{ .Files }}</td><td>{{ size .TotalSize }}</td><td><a href="{{ .Index }}">{{ .Index }}</a></td></tr>
+{{ end }}</table>
+{{ end }}
+</body>
+</html>
+`))
+
+// formatSize formats a number of bytes using binary units.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// writeArchiveIndex regenerates the archive index at the root of the ship path, as json and as html, after the height
+// index of the network has been written. Each file is replaced atomically so consumers never read a partially written
+// index.
+func writeArchiveIndex(ctx context.Context, sh Shipper, network string) error {
+	ai, err := buildArchiveIndex(ctx, sh, network)
+	if err != nil {
+		return err
+	}
+	ai.Generated = time.Now().UTC()
+
+	data, err := json.MarshalIndent(ai, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if err := sh.Write(ctx, ArchiveIndexFilename, data); err != nil {
+		return fmt.Errorf("write %s: %w", ArchiveIndexFilename, err)
+	}
+
+	var html bytes.Buffer
+	if err := archiveIndexTemplate.Execute(&html, ai); err != nil {
+		return fmt.Errorf("render %s: %w", ArchiveIndexHTMLFilename, err)
+	}
+	if err := sh.Write(ctx, ArchiveIndexHTMLFilename, html.Bytes()); err != nil {
+		return fmt.Errorf("write %s: %w", ArchiveIndexHTMLFilename, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteArchiveIndex(t *testing.T) {
+	ctx := context.Background()
+	shipPath := t.TempDir()
+	// The indexes are written and read through the shipper, as they are for an object store
+	sh := &opaqueShipper{Shipper: &fileShipper{root: shipPath}}
+	hi := &HeightIndex{
+		Network: "mainnet",
+		Files: map[string]*HeightIndexFileRef{
+			"mainnet/csv/1/messages/2021/messages-2021-12-30.csv.gz":      {Date: Date{2021, 12, 30}, Table: "messages", StartHeight: 1434240, EndHeight: 1437119, Size: 10},
+			"mainnet/csv/1/messages/2021/messages-2021-12-31.csv.gz":      {Date: Date{2021, 12, 31}, Table: "messages", StartHeight: 1437120, EndHeight: 1439999, Size: 20},
+			"mainnet/csv/1/messages/2022/messages-2022-01-02.csv.gz":      {Date: Date{2022, 1, 2}, Table: "messages", StartHeight: 1442880, EndHeight: 1445759, Size: 30},
+			"mainnet/parquet/1/messages/2022/messages-2022-01-02.parquet": {Date: Date{2022, 1, 2}, Table: "messages", StartHeight: 1442880, EndHeight: 1445759, Size: 5},
+		},
+	}
+	if err := writeHeightIndex(ctx, sh, hi); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeTableIndexes(ctx, sh, hi); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeArchiveIndex(ctx, sh, "mainnet"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(shipPath, ArchiveIndexFilename))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ai ArchiveIndex
+	if err := json.Unmarshal(data, &ai); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ai.Networks) != 1 || ai.Networks[0].Network != "mainnet" || ai.Networks[0].TotalSize != 65 {
+		t.Fatalf("got networks %+v, wanted mainnet with total size 65", ai.Networks)
+	}
+
+	tables := ai.Networks[0].Tables
+	if len(tables) != 2 {
+		t.Fatalf("got %d tables, wanted 2", len(tables))
+	}
+	csv := tables[0]
+	if csv.Format != "csv" || csv.Schema != 1 || csv.Files != 3 || csv.TotalSize != 60 || csv.StartHeight != 1434240 || csv.EndHeight != 1445759 {
+		t.Errorf("got csv table %+v", csv)
+	}
+	if csv.Index != "mainnet/csv/1/messages/messages.index.json" || csv.IndexSHA256 == "" {
+		t.Errorf("got index %q with checksum %q", csv.Index, csv.IndexSHA256)
+	}
+	wantDates := []DateRange{{From: Date{2021, 12, 30}, To: Date{2021, 12, 31}}, {From: Date{2022, 1, 2}, To: Date{2022, 1, 2}}}
+	if len(csv.Dates) != len(wantDates) {
+		t.Fatalf("got dates %v, wanted %v", csv.Dates, wantDates)
+	}
+	for i := range wantDates {
+		if csv.Dates[i] != wantDates[i] {
+			t.Errorf("got date range %s, wanted %s", csv.Dates[i].String(), wantDates[i].String())
+		}
+	}
+	if tables[1].Format != "parquet" {
+		t.Errorf("got format %q, wanted parquet", tables[1].Format)
+	}
+
+	if _, err := os.Stat(filepath.Join(shipPath, ArchiveIndexHTMLFilename)); err != nil {
+		t.Errorf("html index not written: %v", err)
+	}
+
+	// Networks listed by the existing archive index are kept when another network is indexed
+	calibnet := &HeightIndex{
+		Network: "calibnet",
+		Files: map[string]*HeightIndexFileRef{
+			"calibnet/csv/1/messages/2022/messages-2022-01-02.csv.gz": {Date: Date{2022, 1, 2}, Table: "messages", StartHeight: 100, EndHeight: 200, Size: 7},
+		},
+	}
+	if err := writeHeightIndex(ctx, sh, calibnet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeTableIndexes(ctx, sh, calibnet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writeArchiveIndex(ctx, sh, "calibnet"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, err = os.ReadFile(filepath.Join(shipPath, ArchiveIndexFilename)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ai = ArchiveIndex{}
+	if err := json.Unmarshal(data, &ai); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ai.Networks) != 2 || ai.Networks[0].Network != "calibnet" || ai.Networks[1].Network != "mainnet" {
+		t.Errorf("got networks %+v, wanted calibnet and mainnet", ai.Networks)
+	}
+}
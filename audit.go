@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lily/schedule"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditWalkStarted  = "walk_started" // a lily walk was started, or a running walk adopted, for a period
+	AuditWalkFailed   = "walk_failed"  // a walk ended with an error and its output was discarded
+	AuditVerification = "verification" // the walk output of a table was verified before shipping
+	AuditFileShipped  = "file_shipped" // a file was shipped, possibly replacing an earlier version
+	AuditFileRemoved  = "file_removed" // a shipped file was removed by the retention policy
+	AuditReexport     = "reexport"     // the shipped files of a period were marked for replacement
+	AuditReorg        = "reorg"        // a reorg changed tipsets of a shipped period, whose files were marked stale
+	AuditQuarantine   = "quarantine"   // the walk output of a table held an invalid row and was moved to the quarantine path
+)
+
+// Default rotation limits of the audit log.
+const (
+	DefaultAuditLogMaxSize  = 100 << 20
+	DefaultAuditLogMaxFiles = 10
+)
+
+// AuditRecord is a single line of the audit log. Only the fields relevant to the action are set.
+type AuditRecord struct {
+	Time           time.Time      `json:"time"`
+	Action         string         `json:"action"`
+	Version        string         `json:"version,omitempty"` // version of the archiver that took the action
+	Network        string         `json:"network,omitempty"`
+	Period         string         `json:"period,omitempty"`
+	StartHeight    int64          `json:"start_height,omitempty"`
+	EndHeight      int64          `json:"end_height,omitempty"`
+	Table          string         `json:"table,omitempty"`
+	Path           string         `json:"path,omitempty"`
+	Walk           string         `json:"walk,omitempty"`
+	JobID          schedule.JobID `json:"job_id,omitempty"`
+	Lily           string         `json:"lily,omitempty"` // address of the lily node running the walk
+	Tasks          []string       `json:"tasks,omitempty"`
+	Result         string         `json:"result,omitempty"` // passed, or the strictness applied to failed verification checks
+	Checks         []string       `json:"checks,omitempty"` // verification checks that failed
+	Rows           int64          `json:"rows,omitempty"`
+	Size           int64          `json:"size,omitempty"`
+	SHA256         string         `json:"sha256,omitempty"`
+	PreviousSHA256 string         `json:"previous_sha256,omitempty"` // checksum of the file that was replaced
+	Tables         []string       `json:"tables,omitempty"`
+	Reason         string         `json:"reason,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// newAuditRecord creates a record of an action affecting a period.
+func newAuditRecord(action string, network string, p ExportPeriod) *AuditRecord {
+	return &AuditRecord{
+		Action:      action,
+		Network:     network,
+		Period:      p.String(),
+		StartHeight: p.StartHeight,
+		EndHeight:   p.EndHeight,
+	}
+}
+
+// auditRecordForFile creates a record of an action affecting a file of a manifest.
+func auditRecordForFile(action string, em *ExportManifest, ef *ExportFile) *AuditRecord {
+	r := newAuditRecord(action, em.Network, em.Period)
+	r.Table = ef.TableName
+	r.Path = filepath.ToSlash(ef.Path())
+	return r
+}
+
+// AuditLog appends a json line for each significant action taken against the archive to a file, so that it can later
+// be established when and why a shipped file changed. The file is rotated once it exceeds a maximum size, keeping a
+// limited number of rotated files named with a numeric suffix, the most recent being .1.
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64 // size beyond which the log is rotated, 0 to never rotate
+	maxFiles int   // number of rotated files kept
+	f        *os.File
+	size     int64
+}
+
+// auditLog is the audit log of the running command, nil if none is configured.
+var auditLog *AuditLog
+
+func openAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), DefaultDirPerms); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", filepath.Dir(path), err)
+	}
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, DefaultFilePerms)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat: %w", err)
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// rotatedPath returns the name of the nth most recent rotated file.
+func (a *AuditLog) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", a.path, n)
+}
+
+// rotate renames the current file to the most recent rotated file and starts a new one, removing the oldest rotated
+// file if there are already as many as are kept.
+func (a *AuditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	a.f = nil
+	if err := os.Remove(a.rotatedPath(a.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove: %w", err)
+	}
+	for n := a.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(a.rotatedPath(n), a.rotatedPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rename: %w", err)
+		}
+	}
+	if err := os.Rename(a.path, a.rotatedPath(1)); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return a.open()
+}
+
+// Record appends a record to the log, setting its time and the archiver version. Each record is flushed to disk before
+// Record returns. Failures are logged rather than returned since auditing must never cause an export to fail.
+func (a *AuditLog) Record(r *AuditRecord) {
+	if a == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	r.Version = version
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		logger.Errorw("failed to encode audit record", "error", err, "action", r.Action)
+		return
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		// A previous rotation failed part way through
+		if err := a.open(); err != nil {
+			logger.Errorw("failed to reopen audit log", "error", err, "path", a.path)
+			return
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			logger.Errorw("failed to rotate audit log", "error", err, "path", a.path)
+			if a.f == nil {
+				return
+			}
+		}
+	}
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+	if err == nil {
+		err = a.f.Sync()
+	}
+	if err != nil {
+		logger.Errorw("failed to write audit record", "error", err, "action", r.Action, "path", a.path)
+	}
+}
+
+// Close closes the log.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// shippedChecksum returns the checksum recorded when a file was last shipped, or an empty string if the file has not
+// been shipped or its checksum cannot be read. It is only read when an audit log is configured.
+func shippedChecksum(ctx context.Context, sh Shipper, path string) string {
+	if auditLog == nil {
+		return ""
+	}
+	data, err := sh.Read(ctx, path+ChecksumSuffix)
+	if err != nil {
+		return ""
+	}
+	sum, _, err := parseChecksumFile(data)
+	if err != nil {
+		return ""
+	}
+	return sum
+}
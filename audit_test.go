@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAuditRecords(t *testing.T, path string) []*AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []*AuditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("decode audit record %q: %v", sc.Text(), err)
+		}
+		records = append(records, &r)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	a, err := openAuditLog(path, 400, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	for i := 0; i < 10; i++ {
+		r := newAuditRecord(AuditFileShipped, "mainnet", p)
+		r.Table, r.Size, r.SHA256 = "messages", int64(i+1), "abc"
+		a.Record(r)
+	}
+
+	var total int
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 400 {
+			t.Errorf("%s is %d bytes, larger than the maximum size", name, info.Size())
+		}
+		total += len(readAuditRecords(t, name))
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only two rotated files should be kept")
+	}
+
+	// The latest record is in the current file and the oldest kept records have been discarded
+	records := readAuditRecords(t, path)
+	last := records[len(records)-1]
+	if last.Size != 10 || last.Action != AuditFileShipped || last.Period != "2021-08-02" || last.Time.IsZero() {
+		t.Errorf("unexpected latest record %+v", last)
+	}
+	if total >= 10 {
+		t.Errorf("got %d records in kept files, expected the oldest to have been discarded", total)
+	}
+
+	// Reopening the log appends to the current file
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	a, err = openAuditLog(path, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(&AuditRecord{Action: AuditReexport, Tables: []string{"messages"}})
+	if got := readAuditRecords(t, path); len(got) != len(records)+1 || got[len(got)-1].Action != AuditReexport {
+		t.Errorf("record was not appended to the existing file")
+	}
+
+	// Recording without an audit log configured does nothing
+	var none *AuditLog
+	none.Record(&AuditRecord{Action: AuditWalkStarted})
+}
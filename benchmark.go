@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultBenchmarkSampleSize is the number of uncompressed bytes of the input compressed by each benchmark run.
+const DefaultBenchmarkSampleSize = 256 << 20
+
+// CompressionBenchmark is the result of compressing a sample with one compression tuning.
+type CompressionBenchmark struct {
+	Compression Compression
+	Tuning      CompressionTuning
+	Size        int64 // uncompressed size of the sample
+	Compressed  int64
+	Duration    time.Duration
+}
+
+// Ratio returns the ratio of uncompressed to compressed size.
+func (b *CompressionBenchmark) Ratio() float64 {
+	if b.Compressed == 0 {
+		return 0
+	}
+	return float64(b.Size) / float64(b.Compressed)
+}
+
+// Throughput returns the number of uncompressed bytes compressed per second.
+func (b *CompressionBenchmark) Throughput() float64 {
+	if b.Duration <= 0 {
+		return 0
+	}
+	return float64(b.Size) / b.Duration.Seconds()
+}
+
+func (b *CompressionBenchmark) String() string {
+	return fmt.Sprintf("%s level %d workers %d: %.1f MB/s, ratio %.2f, %d bytes in %s", b.Compression.Names[0], b.Tuning.Level, b.Tuning.Workers, b.Throughput()/1e6, b.Ratio(), b.Compressed, b.Duration.Truncate(time.Millisecond))
+}
+
+// countWriter discards what is written to it, counting the bytes.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// benchmarkCompression compresses the sample with the tuning, as if it were the walk output of a file of an unknown table
+// shipped with the tuning set by flags.
+func benchmarkCompression(sample []byte, c Compression, ct CompressionTuning) (*CompressionBenchmark, error) {
+	defer func(level, workers int) {
+		shippingConfig.compressionLevel, shippingConfig.compressionWorkers = level, workers
+	}(shippingConfig.compressionLevel, shippingConfig.compressionWorkers)
+	shippingConfig.compressionLevel, shippingConfig.compressionWorkers = ct.Level, ct.Workers
+
+	var cw countWriter
+	start := time.Now()
+	if _, err := c.Compress(&ExportFile{}, bytes.NewReader(sample), &cw); err != nil {
+		return nil, err
+	}
+	return &CompressionBenchmark{
+		Compression: c,
+		Tuning:      ct,
+		Size:        int64(len(sample)),
+		Compressed:  cw.n,
+		Duration:    time.Since(start),
+	}, nil
+}
+
+// readBenchmarkSample reads up to size bytes of uncompressed data from the file, decompressing it if its name ends in
+// the extension of a compression.
+func readBenchmarkSample(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	for _, c := range CompressionList {
+		if c.Extension != "" && strings.HasSuffix(path, "."+c.Extension) {
+			rc, err := c.Decompress(f)
+			if err != nil {
+				return nil, fmt.Errorf("decompress: %w", err)
+			}
+			defer rc.Close()
+			r = rc
+			break
+		}
+	}
+	return io.ReadAll(io.LimitReader(r, size))
+}
+
+func parseIntList(s string) ([]int, error) {
+	var out []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+var benchmarkCompressionCommand = &cli.Command{
+	Name:   "benchmark-compression",
+	Usage:  "Measure the speed and ratio of compressing a file with each compression, level and number of workers.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "input",
+				Usage:    "Path to a walk output or shipped file of the table to benchmark. Shipped files are decompressed first.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "compressions",
+				Usage: "Comma separated list of compressions to benchmark.",
+				Value: "gz,zstd,lz4",
+			},
+			&cli.StringFlag{
+				Name:  "levels",
+				Usage: "Comma separated list of compression levels to benchmark. Levels a compression does not accept are skipped for it, and 0 is the default level.",
+				Value: "0",
+			},
+			&cli.StringFlag{
+				Name:  "workers",
+				Usage: "Comma separated list of numbers of compression workers to benchmark. Zero is the default of each compression.",
+				Value: "0",
+			},
+			&cli.Int64Flag{
+				Name:  "sample-size",
+				Usage: "Maximum number of uncompressed bytes of the input to compress in each run.",
+				Value: DefaultBenchmarkSampleSize,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		var compressions []Compression
+		for _, name := range strings.Split(cc.String("compressions"), ",") {
+			c, ok := CompressionByName[strings.TrimSpace(name)]
+			if !ok {
+				return fmt.Errorf("unknown compression %q", name)
+			}
+			compressions = append(compressions, c)
+		}
+		levels, err := parseIntList(cc.String("levels"))
+		if err != nil {
+			return fmt.Errorf("invalid levels: %w", err)
+		}
+		workers, err := parseIntList(cc.String("workers"))
+		if err != nil {
+			return fmt.Errorf("invalid workers: %w", err)
+		}
+		for _, n := range workers {
+			if n < 0 {
+				return fmt.Errorf("workers must not be negative")
+			}
+		}
+		if cc.Int64("sample-size") <= 0 {
+			return fmt.Errorf("sample size must be positive")
+		}
+
+		sample, err := readBenchmarkSample(cc.String("input"), cc.Int64("sample-size"))
+		if err != nil {
+			return fmt.Errorf("read input: %w", err)
+		}
+		fmt.Printf("sample: %d bytes\n", len(sample))
+
+		for _, c := range compressions {
+			for _, level := range levels {
+				if !c.AcceptsLevel(level) {
+					continue
+				}
+				for _, n := range workers {
+					if cc.Context.Err() != nil {
+						return cc.Context.Err()
+					}
+					b, err := benchmarkCompression(sample, c, CompressionTuning{Level: level, Workers: n})
+					if err != nil {
+						return fmt.Errorf("benchmark %s: %w", c.Names[0], err)
+					}
+					fmt.Println(b.String())
+				}
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// bigQueryWarehouse loads files into BigQuery with load jobs. Files in a Google Cloud Storage ship path are loaded
+// from their location, others are uploaded with the job. Each job is given an id derived from the file and its
+// checksum, so a job that is submitted again after an uncertain failure is rejected as a duplicate and the original
+// is waited on instead.
+type bigQueryWarehouse struct {
+	project  string
+	dataset  string
+	location string
+	client   *bigquery.Client
+}
+
+var _ Warehouse = (*bigQueryWarehouse)(nil)
+
+func newBigQueryWarehouse(ws *WarehouseSpec) (*bigQueryWarehouse, error) {
+	ctx := context.Background()
+	creds, err := bigQueryCredentials(ctx, ws.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("credentials: %w", err)
+	}
+	client, err := bigquery.NewClient(ctx, ws.Project, option.WithCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("new bigquery client: %w", err)
+	}
+	return &bigQueryWarehouse{
+		project:  ws.Project,
+		dataset:  ws.Dataset,
+		location: ws.Location,
+		client:   client,
+	}, nil
+}
+
+// bigQueryCredentials reads the service account key at path, or finds the application default credentials, such as
+// those of the instance's service account, if no path is given.
+func bigQueryCredentials(ctx context.Context, path string) (*google.Credentials, error) {
+	if path == "" {
+		return google.FindDefaultCredentials(ctx, bigquery.Scope)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return google.CredentialsFromJSON(ctx, data, bigquery.Scope)
+}
+
+func (b *bigQueryWarehouse) String() string {
+	return fmt.Sprintf("bigquery://%s/%s", b.project, b.dataset)
+}
+
+// bigQueryFormats maps ship formats to BigQuery source formats.
+var bigQueryFormats = map[string]bigquery.DataFormat{
+	FormatCSV:     bigquery.CSV,
+	FormatJSONL:   bigquery.JSON,
+	FormatParquet: bigquery.Parquet,
+}
+
+// bigQueryJobID returns the id of the job that loads a version of a file into a table.
+func bigQueryJobID(dataset, table, path, key string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{dataset, table, path, key}, "\n")))
+	return "sentinel_archiver_" + hex.EncodeToString(sum[:16])
+}
+
+// Load runs a load job that appends the rows of the file to the table and waits for it to finish.
+func (b *bigQueryWarehouse) Load(ctx context.Context, src *WarehouseSource, table string, key string) (string, error) {
+	format, ok := bigQueryFormats[src.File.Format]
+	if !ok {
+		return "", fmt.Errorf("unsupported format %q", src.File.Format)
+	}
+	// BigQuery reads gzip compressed csv and json, parquet files are compressed internally
+	switch {
+	case src.File.Compression == "none":
+	case src.File.Compression == "gzip" && src.File.Format != FormatParquet:
+	default:
+		return "", fmt.Errorf("unsupported compression %q for %s files", src.File.Compression, src.File.Format)
+	}
+
+	fc := bigquery.FileConfig{SourceFormat: format}
+	if src.File.Format == FormatCSV {
+		fc.AllowQuotedNewlines = true
+	}
+	if src.File.Provenance {
+		fc.SkipLeadingRows = 1
+	}
+
+	var ls bigquery.LoadSource
+	switch {
+	case src.URI != "":
+		ref := bigquery.NewGCSReference(src.URI)
+		ref.FileConfig = fc
+		ls = ref
+	case src.Local != "":
+		f, err := os.Open(src.Local)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		rs := bigquery.NewReaderSource(f)
+		rs.FileConfig = fc
+		ls = rs
+	default:
+		return "", fmt.Errorf("bigquery loads require a filesystem or gs:// ship path")
+	}
+
+	loader := b.client.Dataset(b.dataset).Table(table).LoaderFrom(ls)
+	loader.WriteDisposition = bigquery.WriteAppend
+	loader.JobID = bigQueryJobID(b.dataset, table, src.File.Path, key)
+	loader.Location = b.location
+
+	// A job that already exists was submitted by an earlier attempt to load the same file, so is not an error
+	job, err := loader.Run(ctx)
+	if err != nil {
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) || gerr.Code != http.StatusConflict {
+			return "", fmt.Errorf("submit job: %w", err)
+		}
+		if job, err = b.client.JobFromIDLocation(ctx, loader.JobID, b.location); err != nil {
+			return "", fmt.Errorf("get job: %w", err)
+		}
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return "", fmt.Errorf("wait for job: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return "", fmt.Errorf("job %s failed: %w", job.ID(), err)
+	}
+	return job.ID(), nil
+}
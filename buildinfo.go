@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/urfave/cli/v2"
+)
+
+// gitCommit is the commit the binary was built from, set at build time using -ldflags "-X main.gitCommit=<commit>"
+var gitCommit string
+
+// redacted replaces the value of secret configuration when it is reported
+const redacted = "<redacted>"
+
+// BuildInfo describes the build of the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuildInfo() BuildInfo {
+	commit := gitCommit
+	if commit == "" {
+		commit = "unknown"
+	}
+	return BuildInfo{
+		Version:   version,
+		GitCommit: commit,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// secretFlags are the flags whose values are redacted when reported: api tokens, credentials, webhook urls that embed
+// a token and database urls that embed a password. Paths to key files are not secret and are reported.
+var secretFlags = map[string]bool{
+	"anchor-lotus-token":         true,
+	"control-token":              true,
+	"deal-lotus-token":           true,
+	"lily-db":                    true,
+	"lily-token":                 true,
+	"notify-discord-webhook":     true,
+	"notify-slack-webhook":       true,
+	"notify-webhooks":            true,
+	"object-store-access-key":    true,
+	"object-store-secret-key":    true,
+	"object-store-session-token": true,
+	"sign-lotus-token":           true,
+	"snapshot-lotus-token":       true,
+}
+
+// isSecretFlag reports whether the value of the named flag should be redacted when reported.
+func isSecretFlag(name string) bool {
+	return secretFlags[name]
+}
+
+// effectiveConfig returns the resolved value of every flag of the command being run, with secrets redacted.
+func effectiveConfig(cc *cli.Context) map[string]string {
+	cfg := map[string]string{}
+	if cc.Command == nil {
+		return cfg
+	}
+
+	for _, f := range cc.Command.Flags {
+		if f == cli.HelpFlag {
+			continue
+		}
+		name := f.Names()[0]
+		v := cc.Value(name)
+		if v == nil {
+			continue
+		}
+		value := fmt.Sprint(v)
+		if value != "" && isSecretFlag(name) {
+			value = redacted
+		}
+		cfg[name] = value
+	}
+	return cfg
+}
+
+// environmentConfig returns the value each flag would take when resolved from the environment alone, with secrets
+// redacted. It is used to report the configuration of a deployment from outside the running process.
+func environmentConfig(flags []cli.Flag) map[string]string {
+	cfg := map[string]string{}
+	for _, f := range flags {
+		df, ok := f.(cli.DocGenerationFlag)
+		if !ok {
+			continue
+		}
+		name := f.Names()[0]
+
+		value := df.GetValue()
+		for _, env := range df.GetEnvVars() {
+			if v, ok := os.LookupEnv(env); ok {
+				value = v
+				break
+			}
+		}
+		if value != "" && isSecretFlag(name) {
+			value = redacted
+		}
+		cfg[name] = value
+	}
+	return cfg
+}
+
+func printConfig(cfg map[string]string) {
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("  %s=%s\n", name, cfg[name])
+	}
+}
+
+var versionCommand = &cli.Command{
+	Name:  "version",
+	Usage: "Print the version of the archiver.",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "Also print build details and the configuration the run command would use in the current environment.",
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		bi := currentBuildInfo()
+		fmt.Println(bi.Version)
+		if !cc.Bool("verbose") {
+			return nil
+		}
+
+		fmt.Printf("commit: %s\n", bi.GitCommit)
+		fmt.Printf("go: %s\n", bi.GoVersion)
+		fmt.Printf("platform: %s\n", bi.Platform)
+
+		if run := cc.App.Command("run"); run != nil {
+			fmt.Println("configuration:")
+			printConfig(environmentConfig(run.Flags))
+		}
+		return nil
+	},
+}
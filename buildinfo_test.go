@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestCurrentBuildInfo(t *testing.T) {
+	defer func(v, c string) { version, gitCommit = v, c }(version, gitCommit)
+
+	version, gitCommit = "v0.1.0", ""
+	bi := currentBuildInfo()
+	want := BuildInfo{Version: "v0.1.0", GitCommit: "unknown", GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if bi != want {
+		t.Errorf("got build info %+v, wanted %+v", bi, want)
+	}
+
+	gitCommit = "b455ef3"
+	if bi := currentBuildInfo(); bi.GitCommit != "b455ef3" {
+		t.Errorf("got commit %q, wanted the commit set at build time", bi.GitCommit)
+	}
+}
+
+func TestIsSecretFlag(t *testing.T) {
+	testCases := map[string]bool{
+		"lily-token":              true,
+		"control-token":           true,
+		"object-store-secret-key": true,
+		"notify-slack-webhook":    true,
+		"notify-webhooks":         true,
+		"lily-db":                 true,  // database urls embed a password
+		"sign-key":                false, // path to the key file
+		"encrypt-recipient":       false,
+		"lily-addr":               false,
+		"ship-path":               false,
+		"table-registry":          false,
+	}
+	for name, want := range testCases {
+		if got := isSecretFlag(name); got != want {
+			t.Errorf("%s: got secret %v, wanted %v", name, got, want)
+		}
+	}
+
+	// Every listed secret must be a flag of the archiver, so that a renamed flag isn't silently reported
+	names := map[string]bool{}
+	var collect func(cmds []*cli.Command)
+	collect = func(cmds []*cli.Command) {
+		for _, cmd := range cmds {
+			for _, f := range cmd.Flags {
+				for _, n := range f.Names() {
+					names[n] = true
+				}
+			}
+			collect(cmd.Subcommands)
+		}
+	}
+	collect(app.Commands)
+	for name := range secretFlags {
+		if !names[name] {
+			t.Errorf("secret flag %s is not a flag of any command", name)
+		}
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "lily-token"},
+		&cli.StringFlag{Name: "lily-db"},
+		&cli.StringFlag{Name: "sign-key"},
+		&cli.StringFlag{Name: "ship-path", Value: "/data/ship"},
+		&cli.IntFlag{Name: "workers", Value: 2},
+	}
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	for _, f := range flags {
+		if err := f.Apply(fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Parse([]string{"--lily-token=abc", "--sign-key=/keys/sign.pem", "--workers=4"}); err != nil {
+		t.Fatal(err)
+	}
+	cc := cli.NewContext(cli.NewApp(), fs, nil)
+	cc.Command = &cli.Command{Name: "run", Flags: append(flags, cli.HelpFlag)}
+
+	want := map[string]string{
+		"lily-token": redacted,
+		"lily-db":    "", // unset secrets are reported as empty rather than redacted
+		"sign-key":   "/keys/sign.pem",
+		"ship-path":  "/data/ship",
+		"workers":    "4",
+	}
+	if got := effectiveConfig(cc); !reflect.DeepEqual(got, want) {
+		t.Errorf("got config %v, wanted %v", got, want)
+	}
+}
+
+func TestEnvironmentConfig(t *testing.T) {
+	t.Setenv("ARCHIVER_LILY_TOKEN", "abc")
+	t.Setenv("ARCHIVER_SHIP_PATH", "/env/ship")
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "lily-token", EnvVars: []string{"ARCHIVER_LILY_TOKEN"}},
+		&cli.StringFlag{Name: "ship-path", EnvVars: []string{"ARCHIVER_SHIP_PATH"}, Value: "/data/ship"},
+		&cli.StringFlag{Name: "storage-path", EnvVars: []string{"ARCHIVER_STORAGE_PATH"}, Value: "/data/storage"},
+	}
+
+	want := map[string]string{
+		"lily-token":   redacted,
+		"ship-path":    "/env/ship",
+		"storage-path": "/data/storage",
+	}
+	if got := environmentConfig(flags); !reflect.DeepEqual(got, want) {
+		t.Errorf("got config %v, wanted %v", got, want)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultOfflineLilyPort is the port of the api of a lily node launched by the export-car command.
+const DefaultOfflineLilyPort = 1239
+
+// OfflineLily is a lily node launched by the archiver against a chain snapshot imported from a CAR file. The node does
+// not connect to the network, so its chain is exactly that of the snapshot.
+type OfflineLily struct {
+	Binary   string // lily executable
+	Repo     string // lily repository, initialised from the snapshot if it does not exist
+	Config   string // lily config file defining the storage that walks write to
+	Snapshot string // CAR file imported into a new repository
+	Port     int    // port the node's api listens on
+	LogPath  string // file that the node's output is written to
+
+	cmd    *exec.Cmd
+	exited chan struct{} // closed once the daemon has exited
+	err    error         // error the daemon exited with
+}
+
+// Addr returns the multiaddress of the node's api.
+func (l *OfflineLily) Addr() string {
+	return fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", l.Port)
+}
+
+func (l *OfflineLily) initArgs() []string {
+	return []string{"init", "--repo", l.Repo, "--config", l.Config, "--import-snapshot", l.Snapshot}
+}
+
+func (l *OfflineLily) daemonArgs() []string {
+	return []string{"daemon", "--repo", l.Repo, "--config", l.Config, "--api", strconv.Itoa(l.Port), "--bootstrap=false"}
+}
+
+// Start initialises the node's repository, importing the snapshot, if it does not already exist and then starts the
+// daemon. A repository left by an earlier run is reused so the snapshot is only imported once.
+func (l *OfflineLily) Start(ctx context.Context) error {
+	out, err := os.OpenFile(l.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, DefaultFilePerms)
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+
+	if _, err := os.Stat(l.Repo); errors.Is(err, os.ErrNotExist) {
+		logger.Infow("importing chain snapshot into lily repository", "snapshot", l.Snapshot, "repo", l.Repo)
+		cmd := exec.CommandContext(ctx, l.Binary, l.initArgs()...)
+		cmd.Stdout, cmd.Stderr = out, out
+		if err := cmd.Run(); err != nil {
+			out.Close()
+			return fmt.Errorf("import snapshot: %w, see %s", err, l.LogPath)
+		}
+	} else if err != nil {
+		out.Close()
+		return fmt.Errorf("stat repo: %w", err)
+	}
+
+	l.cmd = exec.Command(l.Binary, l.daemonArgs()...)
+	l.cmd.Stdout, l.cmd.Stderr = out, out
+	if err := l.cmd.Start(); err != nil {
+		out.Close()
+		return fmt.Errorf("start daemon: %w", err)
+	}
+
+	l.exited = make(chan struct{})
+	go func() {
+		l.err = l.cmd.Wait()
+		out.Close()
+		close(l.exited)
+	}()
+	return nil
+}
+
+// Token returns the api token written to the node's repository.
+func (l *OfflineLily) Token() (string, error) {
+	data, err := os.ReadFile(filepath.Join(l.Repo, "token"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// WaitReady waits until the node's api responds with its chain height, returning the api token. An error is returned
+// if the daemon exits or is not ready before the timeout.
+func (l *OfflineLily) WaitReady(ctx context.Context, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		if token, err := l.Token(); err == nil {
+			if err := checkLilyNode(ctx, l.Addr(), token); err == nil {
+				return token, nil
+			}
+		}
+
+		select {
+		case <-l.exited:
+			return "", fmt.Errorf("lily exited: %v, see %s", l.err, l.LogPath)
+		case <-ctx.Done():
+			return "", fmt.Errorf("lily was not ready: %w, see %s", ctx.Err(), l.LogPath)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Stop interrupts the daemon and waits for it to exit, killing it if it has not exited within a minute.
+func (l *OfflineLily) Stop() {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return
+	}
+	_ = l.cmd.Process.Signal(syscall.SIGINT)
+	select {
+	case <-l.exited:
+	case <-time.After(time.Minute):
+		logger.Warnw("lily did not exit, killing it", "pid", l.cmd.Process.Pid)
+		_ = l.cmd.Process.Kill()
+		<-l.exited
+	}
+}
+
+var exportCarCommand = &cli.Command{
+	Name:   "export-car",
+	Usage:  "Export historical periods from a CAR snapshot using a lily node launched without connecting to the network.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		jobFlags,
+		storageFlags,
+		stateFlags,
+		auditFlags,
+		verificationFlags,
+		shippingFlags,
+		destinationsFlags,
+		hooksFlags,
+		objectStoreFlags,
+		tableConfigFlags,
+		queueFlags,
+		signingFlags,
+		anchorFlags,
+		sqliteFlags,
+		exportFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "car",
+				Usage:    "Path to the CAR snapshot to import. The snapshot must hold the state of every height that is exported.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "from-date",
+				Usage:    "First date to export, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "to-date",
+				Usage:    "Last date to export, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "lily-config",
+				EnvVars:  []string{"ARCHIVER_LILY_CONFIG"},
+				Usage:    "Path to the lily config file used by the launched node. It must define the storage named by --storage-name, writing to --storage-path.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "lily-binary",
+				EnvVars: []string{"ARCHIVER_LILY_BINARY"},
+				Usage:   "Lily executable used to import the snapshot and run the node.",
+				Value:   "lily",
+			},
+			&cli.StringFlag{
+				Name:    "lily-repo",
+				EnvVars: []string{"ARCHIVER_LILY_REPO"},
+				Usage:   "Path of the launched node's repository. An existing repository is reused rather than importing the snapshot again. A temporary repository that is removed afterwards is used if this is not set.",
+				Value:   "",
+			},
+			&cli.IntFlag{
+				Name:    "lily-api-port",
+				EnvVars: []string{"ARCHIVER_LILY_API_PORT"},
+				Usage:   "Port the launched node's api listens on.",
+				Value:   DefaultOfflineLilyPort,
+			},
+			&cli.DurationFlag{
+				Name:    "lily-start-timeout",
+				EnvVars: []string{"ARCHIVER_LILY_START_TIMEOUT"},
+				Usage:   "Time to wait for the launched node's api to become ready once the snapshot has been imported.",
+				Value:   30 * time.Minute,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		if jobConfig.jobType == JobTypeNotify || jobConfig.jobType == JobTypeDatabase {
+			return fmt.Errorf("job type %s cannot be run against a launched lily node", jobConfig.jobType)
+		}
+
+		fromDate, err := DateFromString(cc.String("from-date"))
+		if err != nil {
+			return fmt.Errorf("invalid from date: %w", err)
+		}
+		toDate, err := DateFromString(cc.String("to-date"))
+		if err != nil {
+			return fmt.Errorf("invalid to date: %w", err)
+		}
+		if fromDate.After(toDate) {
+			return fmt.Errorf("from date must not be after to date")
+		}
+		p, err := exportPeriodForDate(fromDate, networkConfig.genesisTs)
+		if err != nil {
+			return fmt.Errorf("invalid from date: %w", err)
+		}
+
+		allowedTables, err := allowedTablesFromFlags(cc)
+		if err != nil {
+			return err
+		}
+		allowedTables = currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to ship files: %w", err)
+		}
+		sh = withShipDestinations(sh)
+
+		if err := loadZstdDictionaries(ctx, sh); err != nil {
+			return err
+		}
+
+		if shippingConfig.stagingPath != "" {
+			if err := verifyShipPath(shippingConfig.stagingPath); err != nil {
+				return fmt.Errorf("unable to write to staging path: %w", err)
+			}
+		}
+
+		if err := ensureAncillaryFiles(ctx, sh, allowedTables); err != nil {
+			return fmt.Errorf("unable to ensure ancillary files exist: %w", err)
+		}
+
+		if _, err := os.Stat(cc.String("car")); err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+
+		l := &OfflineLily{
+			Binary:   cc.String("lily-binary"),
+			Repo:     cc.String("lily-repo"),
+			Config:   cc.String("lily-config"),
+			Snapshot: cc.String("car"),
+			Port:     cc.Int("lily-api-port"),
+		}
+		if l.Repo == "" {
+			dir, err := os.MkdirTemp("", "archiver-lily-")
+			if err != nil {
+				return fmt.Errorf("create lily repo: %w", err)
+			}
+			defer os.RemoveAll(dir)
+			l.Repo = filepath.Join(dir, "repo")
+			l.LogPath = filepath.Join(dir, "lily.log")
+		} else {
+			l.LogPath = l.Repo + ".log"
+		}
+
+		if err := l.Start(ctx); err != nil {
+			return fmt.Errorf("launch lily: %w", err)
+		}
+		defer l.Stop()
+
+		token, err := l.WaitReady(ctx, cc.Duration("lily-start-timeout"))
+		if err != nil {
+			return fmt.Errorf("launch lily: %w", err)
+		}
+		lilyConfig.apiAddr, lilyConfig.apiToken = l.Addr(), token
+		if lilyNodes, err = newLilyPool(l.Addr(), token); err != nil {
+			return fmt.Errorf("launch lily: %w", err)
+		}
+
+		api, closer, err := getLilyAPI(ctx, l.Addr(), token)
+		if err != nil {
+			return fmt.Errorf("connect to lily: %w", err)
+		}
+		head, err := getLilyChainHeight(ctx, api)
+		closer()
+		if err != nil {
+			return fmt.Errorf("read snapshot head: %w", err)
+		}
+		logger.Infow("lily node ready", "addr", l.Addr(), "head", head, "log", l.LogPath)
+
+		for ; !p.Date.After(toDate); p = p.Next() {
+			// A period is only exported once it is as final in the snapshot as it would be on a synced node
+			if p.EndHeight+ExportDelay > head {
+				logger.Warnw("snapshot does not extend far enough past the end of the period to export it", "date", p.Date.String(), "head", head)
+				break
+			}
+
+			tables := currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+			if err := runExportJob(ctx, p, tables, JobPriorityBackfill, func(ctx context.Context) error {
+				_, err := processPeriod(ctx, p, tables, targets, sh)
+				return err
+			}); err != nil {
+				if ctx.Err() != nil {
+					logger.Info("shutting down")
+					return nil
+				}
+				return fmt.Errorf("fatal error processing export: %w", err)
+			}
+
+			if err := updateHeightIndex(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, targets); err != nil {
+				logger.Errorw("failed to update height index", "error", err, "date", p.Date.String())
+			}
+		}
+
+		logger.Infow("snapshot export complete", "from_date", fromDate.String(), "to_date", toDate.String())
+		return nil
+	},
+}
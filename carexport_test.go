@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLily writes a lily executable that records its arguments, creates the repository when initialising and runs
+// the daemon until it is interrupted, exiting at once if exit is set.
+func fakeLily(t *testing.T, dir string, exit bool) (string, string) {
+	calls := filepath.Join(dir, "calls")
+	daemon := "exec sleep 30"
+	if exit {
+		daemon = "exit 3"
+	}
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\ncase \"$1\" in\ninit) mkdir -p \"$3\" ;;\ndaemon) " + daemon + " ;;\nesac\n"
+	bin := filepath.Join(dir, "lily")
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return bin, calls
+}
+
+// waitForLines waits until the file has at least n lines.
+func waitForLines(t *testing.T, path string, n int) {
+	for i := 0; i < 500; i++ {
+		if data, err := os.ReadFile(path); err == nil && strings.Count(string(data), "\n") >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not have %d lines", path, n)
+}
+
+func TestOfflineLily(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bin, calls := fakeLily(t, dir, false)
+
+	l := &OfflineLily{
+		Binary:   bin,
+		Repo:     filepath.Join(dir, "repo"),
+		Config:   filepath.Join(dir, "config.toml"),
+		Snapshot: filepath.Join(dir, "snapshot.car"),
+		Port:     DefaultOfflineLilyPort,
+		LogPath:  filepath.Join(dir, "lily.log"),
+	}
+	if err := l.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForLines(t, calls, 2)
+	l.Stop()
+	select {
+	case <-l.exited:
+	default:
+		t.Fatalf("daemon was still running after it was stopped")
+	}
+
+	// The repository is reused by a later run
+	if err := l.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForLines(t, calls, 3)
+	l.Stop()
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		strings.Join(l.initArgs(), " "),
+		strings.Join(l.daemonArgs(), " "),
+		strings.Join(l.daemonArgs(), " "),
+	}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("got lily invocations %q, wanted %q", data, want)
+	}
+	if !strings.Contains(want, "--import-snapshot "+l.Snapshot) || !strings.Contains(want, "--bootstrap=false") {
+		t.Errorf("lily was not launched offline from the snapshot: %q", want)
+	}
+}
+
+func TestOfflineLilyExits(t *testing.T) {
+	dir := t.TempDir()
+	bin, _ := fakeLily(t, dir, true)
+
+	l := &OfflineLily{Binary: bin, Repo: filepath.Join(dir, "repo"), Port: DefaultOfflineLilyPort, LogPath: filepath.Join(dir, "lily.log")}
+	if err := l.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Stop()
+
+	if _, err := l.WaitReady(context.Background(), time.Minute); err == nil || !strings.Contains(err.Error(), "lily exited") {
+		t.Errorf("got error %v, wanted the daemon's exit to be reported", err)
+	}
+}
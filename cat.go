@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+// openShippedFile opens a shipped file for reading, decompressing it as it is read. Encrypted files are decrypted with
+// the identities, which are nil for files that are not encrypted.
+func openShippedFile(path string, c Compression, identities []age.Identity) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if identities != nil {
+		r, err = newDecryptingReader(f, identities)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+	}
+
+	zr, err := c.Decompress(r)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", c.Names[0], err)
+	}
+	return &decompressingReader{Reader: skipCSVProvenance(zr), closers: []io.Closer{zr, f}}, nil
+}
+
+type decompressingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressingReader) Close() error {
+	var firstErr error
+	for _, c := range d.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openShippedRange opens a shipped file for reading. When filtering by height, seekable files are read starting from
+// the frames that hold the requested heights.
+func openShippedRange(shipFile string, c Compression, identities []age.Identity, filter bool, minHeight, maxHeight int64) (io.ReadCloser, error) {
+	if filter {
+		if idx, err := readSeekIndex(shipFile + SeekIndexSuffix); err == nil {
+			rc, err := newSeekableRangeReader(shipFile, idx, minHeight, maxHeight)
+			if err != nil {
+				return nil, err
+			}
+			return &decompressingReader{Reader: skipCSVProvenance(rc), closers: []io.Closer{rc}}, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read seek index: %w", err)
+		}
+	}
+	return openShippedFile(shipFile, c, identities)
+}
+
+// openShardedFile opens the parts of a sharded file for reading in height order. When filtering by height, parts that
+// hold none of the requested heights are skipped.
+func openShardedFile(shipPath string, sl *ShardList, c Compression, identities []age.Identity, filter bool, minHeight, maxHeight int64) (io.ReadCloser, error) {
+	dr := &decompressingReader{}
+	var readers []io.Reader
+	for _, part := range sl.Parts {
+		if filter && ((minHeight >= 0 && part.EndHeight < minHeight) || (maxHeight >= 0 && part.StartHeight > maxHeight)) {
+			continue
+		}
+		rc, err := openShippedRange(filepath.Join(shipPath, filepath.FromSlash(part.Path)), c, identities, filter, minHeight, maxHeight)
+		if err != nil {
+			dr.Close()
+			return nil, fmt.Errorf("open %s: %w", part.Path, err)
+		}
+		readers = append(readers, rc)
+		dr.closers = append(dr.closers, rc)
+	}
+	dr.Reader = io.MultiReader(readers...)
+	return dr, nil
+}
+
+// readTableHeader reads the column names of a table from its header file in the ship path.
+func readTableHeader(shipPath string, ef *ExportFile) ([]string, error) {
+	t := TablesByName[ef.TableName]
+	data, err := os.ReadFile(filepath.Join(shipPath, t.ShipDir(ef.Network, ef.Format, ef.Schema), ef.TableName+".header"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(data)), ","), nil
+}
+
+// filterRowsByHeight copies csv rows from r to w, keeping only rows whose value in the height column falls within the
+// range, inclusive. A negative bound is ignored.
+func filterRowsByHeight(r io.Reader, w io.Writer, column int, min, max int64) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	cw := csv.NewWriter(w)
+
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if column >= len(row) {
+			return fmt.Errorf("row has too few columns")
+		}
+
+		height, err := strconv.ParseInt(row[column], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed height %q: %w", row[column], err)
+		}
+		if (min >= 0 && height < min) || (max >= 0 && height > max) {
+			continue
+		}
+
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+var catCommand = &cli.Command{
+	Name:   "cat",
+	Usage:  "Decompress a shipped table for a single date and write it to stdout.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path used to write verified exports from lily.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "table",
+				Usage:    "Name of the table to write.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "date",
+				Usage:    "Date of the export to write, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.Int64Flag{
+				Name:  "min-height",
+				Usage: "Only write rows with a height greater than or equal to this height.",
+				Value: -1,
+			},
+			&cli.Int64Flag{
+				Name:  "max-height",
+				Usage: "Only write rows with a height less than or equal to this height.",
+				Value: -1,
+			},
+			&cli.BoolFlag{
+				Name:  "header",
+				Usage: "Write the column names of the table as the first line.",
+			},
+			&cli.StringFlag{
+				Name:  "compression",
+				Usage: "Type of compression used by the shipped file.",
+				Value: "gz",
+			},
+			&cli.StringFlag{
+				Name:  "decrypt-identity",
+				Usage: "Path to an age identity file holding the private key that the shipped file was encrypted to, for reading encrypted files.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		if _, ok := TablesByName[cc.String("table")]; !ok {
+			return fmt.Errorf("unknown table: %q", cc.String("table"))
+		}
+
+		d, err := DateFromString(cc.String("date"))
+		if err != nil {
+			return fmt.Errorf("invalid date: %w", err)
+		}
+
+		c, ok := CompressionByName[cc.String("compression")]
+		if !ok {
+			return fmt.Errorf("unknown compression %q", cc.String("compression"))
+		}
+
+		var identities []age.Identity
+		if cc.String("decrypt-identity") != "" {
+			identities, err = loadAgeIdentities(cc.String("decrypt-identity"))
+			if err != nil {
+				return fmt.Errorf("decrypt identity: %w", err)
+			}
+		} else if shipEncryptionRecipients != nil {
+			return fmt.Errorf("reading encrypted files requires a decrypt identity")
+		}
+
+		shipPath := cc.String("ship-path")
+		if err := loadZstdDictionaries(cc.Context, &fileShipper{root: shipPath}); err != nil {
+			return err
+		}
+		ef := &ExportFile{
+			Date:        d,
+			Schema:      storageConfig.schemaVersion,
+			Network:     networkConfig.name,
+			TableName:   cc.String("table"),
+			Format:      "csv",
+			Compression: c,
+			Cid:         cid.Undef,
+		}
+		if identities != nil {
+			ef.Encryption = EncryptionAge
+		}
+		if err := applyFileNaming(ef, networkConfig.genesisTs); err != nil {
+			return fmt.Errorf("file naming: %w", err)
+		}
+
+		minHeight, maxHeight := cc.Int64("min-height"), cc.Int64("max-height")
+		filter := minHeight >= 0 || maxHeight >= 0
+
+		var header []string
+		if filter || cc.Bool("header") {
+			header, err = readTableHeader(shipPath, ef)
+			if err != nil {
+				return fmt.Errorf("read table header: %w", err)
+			}
+		}
+
+		var rc io.ReadCloser
+		if sl, err := readLocalShardList(shipPath, ef); err == nil {
+			rc, err = openShardedFile(shipPath, sl, c, identities, filter, minHeight, maxHeight)
+			if err != nil {
+				return err
+			}
+		} else if errors.Is(err, os.ErrNotExist) {
+			rc, err = openShippedRange(filepath.Join(shipPath, ef.Path()), c, identities, filter, minHeight, maxHeight)
+			if err != nil {
+				return fmt.Errorf("open %s: %w", ef.Path(), err)
+			}
+		} else {
+			return fmt.Errorf("read shard list: %w", err)
+		}
+		defer rc.Close()
+
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+
+		if cc.Bool("header") {
+			if _, err := fmt.Fprintln(w, strings.Join(header, ",")); err != nil {
+				return err
+			}
+		}
+
+		if !filter {
+			_, err := io.Copy(w, rc)
+			return err
+		}
+
+		column := -1
+		for i, name := range header {
+			if name == "height" {
+				column = i
+				break
+			}
+		}
+		if column < 0 {
+			return fmt.Errorf("table %s has no height column", ef.TableName)
+		}
+
+		return filterRowsByHeight(rc, w, column, minHeight, maxHeight)
+	},
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// writeShippedTestFile writes data to path as a shipped file would be written, compressed and, if recipient is not nil,
+// encrypted to the recipient.
+func writeShippedTestFile(t *testing.T, path string, c Compression, data string, recipient age.Recipient) {
+	t.Helper()
+	var compressed bytes.Buffer
+	if _, err := c.Compress(&ExportFile{TableName: "messages"}, strings.NewReader(data), &compressed); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if recipient == nil {
+		out = compressed
+	} else {
+		ew, err := age.Encrypt(&out, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ew.Write(compressed.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := ew.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAllAndClose(t *testing.T, rc io.ReadCloser) string {
+	t.Helper()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestOpenShippedFile(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := "1005360,bafy1\n1005361,bafy2\n"
+	provenance := FileProvenance{Network: "mainnet", Table: "messages", Schema: 1}.csvLine()
+	dir := t.TempDir()
+
+	for _, name := range []string{"gz", "zstd", "none"} {
+		c := CompressionByName[name]
+		for _, encrypted := range []bool{false, true} {
+			var key age.Recipient
+			var id []age.Identity
+			if encrypted {
+				key, id = identity.Recipient(), []age.Identity{identity}
+			}
+			path := filepath.Join(dir, name, "messages.csv"+c.Extension)
+			writeShippedTestFile(t, path, c, provenance+rows, key)
+
+			rc, err := openShippedFile(path, c, id)
+			if err != nil {
+				t.Fatalf("%s encrypted=%v: %v", name, encrypted, err)
+			}
+			if got := readAllAndClose(t, rc); got != rows {
+				t.Errorf("%s encrypted=%v: got %q, wanted the rows without the provenance line", name, encrypted, got)
+			}
+		}
+	}
+
+	path := filepath.Join(dir, "gz", "messages.csv.gz")
+	if _, err := openShippedFile(path, CompressionByName["zstd"], nil); err == nil {
+		t.Errorf("expected an error opening a file with the wrong compression")
+	}
+	if _, err := openShippedFile(path, CompressionByName["gz"], []age.Identity{identity}); err == nil {
+		t.Errorf("expected an error decrypting a file that is not encrypted")
+	}
+	if _, err := openShippedFile(filepath.Join(dir, "missing.csv.gz"), CompressionByName["gz"], nil); !os.IsNotExist(err) {
+		t.Errorf("got error %v opening a missing file, wanted not exist", err)
+	}
+}
+
+func TestOpenShardedFile(t *testing.T) {
+	shipPath := t.TempDir()
+	c := CompressionByName["gz"]
+	parts := []struct {
+		start, end int64
+		rows       string
+	}{
+		{start: 0, end: 9, rows: "1,a\n9,b\n"},
+		{start: 10, end: 19, rows: "10,c\n15,d\n"},
+		{start: 20, end: 29, rows: "25,e\n"},
+	}
+	sl := &ShardList{Table: "messages"}
+	for i, p := range parts {
+		rel := filepath.Join("messages", "part", strings.Repeat("x", i+1)+".csv.gz")
+		writeShippedTestFile(t, filepath.Join(shipPath, rel), c, p.rows, nil)
+		sl.Parts = append(sl.Parts, &ShardListPart{ShardRange: ShardRange{Part: i, StartHeight: p.start, EndHeight: p.end}, Path: filepath.ToSlash(rel)})
+	}
+
+	rc, err := openShardedFile(shipPath, sl, c, nil, false, -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readAllAndClose(t, rc), parts[0].rows+parts[1].rows+parts[2].rows; got != want {
+		t.Errorf("got %q, wanted every part in order %q", got, want)
+	}
+
+	// Parts outside the height range are not opened, so a missing part outside it is not an error
+	if err := os.Remove(filepath.Join(shipPath, filepath.FromSlash(sl.Parts[0].Path))); err != nil {
+		t.Fatal(err)
+	}
+	rc, err = openShardedFile(shipPath, sl, c, nil, true, 12, 19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllAndClose(t, rc); got != parts[1].rows {
+		t.Errorf("got %q, wanted only the second part %q", got, parts[1].rows)
+	}
+
+	if _, err := openShardedFile(shipPath, sl, c, nil, true, 5, -1); err == nil {
+		t.Errorf("expected an error when a part in the height range is missing")
+	}
+}
+
+func TestReadTableHeader(t *testing.T) {
+	shipPath := t.TempDir()
+	ef := &ExportFile{Network: "mainnet", TableName: "messages", Format: "csv", Schema: 1}
+	dir := filepath.Join(shipPath, TablesByName["messages"].ShipDir("mainnet", "csv", 1))
+	if err := os.MkdirAll(dir, DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "messages.header"), []byte("height,cid,from\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := readTableHeader(shipPath, ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(header, "|") != "height|cid|from" {
+		t.Errorf("got header %q", header)
+	}
+
+	ef.TableName = "receipts"
+	if _, err := readTableHeader(shipPath, ef); !os.IsNotExist(err) {
+		t.Errorf("got error %v reading a missing header, wanted not exist", err)
+	}
+}
+
+func TestFilterRowsByHeight(t *testing.T) {
+	input := "1005359,a\n1005360,\"b,c\"\n1005361,d\n1005362,e\n"
+	testCases := []struct {
+		name     string
+		input    string
+		column   int
+		min, max int64
+		want     string
+		wantErr  bool
+	}{
+		{name: "range", input: input, min: 1005360, max: 1005361, want: "1005360,\"b,c\"\n1005361,d\n"},
+		{name: "min only", input: input, min: 1005362, max: -1, want: "1005362,e\n"},
+		{name: "max only", input: input, min: -1, max: 1005359, want: "1005359,a\n"},
+		{name: "unbounded", input: input, min: -1, max: -1, want: input},
+		{name: "empty range", input: input, min: 1005400, max: -1, want: ""},
+		{name: "malformed height", input: "abc,a\n", min: 0, max: -1, wantErr: true},
+		{name: "short row", input: "1005360\n", column: 1, min: 0, max: -1, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := filterRowsByHeight(strings.NewReader(tc.input), &out, tc.column, tc.min, tc.max)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.want {
+				t.Errorf("got %q, wanted %q", out.String(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const catalogCollection = "catalog"
+
+// Sources of catalog entries
+const (
+	CatalogSourceShip   = "ship"   // file was shipped by the archiver
+	CatalogSourceImport = "import" // file was imported from an existing archive
+)
+
+// CatalogEntry describes a file that is present in the ship path.
+type CatalogEntry struct {
+	Path        string    `json:"path"` // path relative to the ship path
+	Network     string    `json:"network"`
+	Format      string    `json:"format"`
+	Schema      int       `json:"schema"`
+	Table       string    `json:"table"`
+	Date        Date      `json:"date"`
+	From        int64     `json:"from,omitempty"`       // first height of a file named by height range
+	To          int64     `json:"to,omitempty"`         // last height of a file named by height range
+	Compression string    `json:"compression"`          // extension of the compression scheme
+	Encryption  string    `json:"encryption,omitempty"` // name of the encryption scheme, if the file is encrypted
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"` // checksum computed while shipping, not set for imported files
+	CID         string    `json:"cid,omitempty"`
+	IPFSCID     string    `json:"ipfs_cid,omitempty"` // root of the file as added to IPFS, if it was
+	ModTime     time.Time `json:"mod_time"`
+	Source      string    `json:"source"`
+}
+
+// Catalog maps the path of a file relative to the ship path to its catalog entry.
+type Catalog map[string]*CatalogEntry
+
+// Catalog returns the catalog of files held in the state store.
+func (s *StateStore) Catalog() (Catalog, error) {
+	c := Catalog{}
+	if err := s.load(catalogCollection, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AddCatalogEntries adds or replaces entries in the catalog.
+func (s *StateStore) AddCatalogEntries(entries ...*CatalogEntry) error {
+	c := Catalog{}
+	return s.update(catalogCollection, &c, func() error {
+		for _, e := range entries {
+			c[e.Path] = e
+		}
+		return nil
+	})
+}
+
+// RemoveCatalogEntries removes entries from the catalog by path.
+func (s *StateStore) RemoveCatalogEntries(paths ...string) error {
+	c := Catalog{}
+	return s.update(catalogCollection, &c, func() error {
+		for _, p := range paths {
+			delete(c, p)
+		}
+		return nil
+	})
+}
+
+// catalogEntryForFile creates a catalog entry for an export file that has been shipped.
+func catalogEntryForFile(ctx context.Context, ef *ExportFile, sh Shipper, source string) (*CatalogEntry, error) {
+	info, err := sh.Stat(ctx, ef.Path())
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	ce := &CatalogEntry{
+		Path:        ef.Path(),
+		Network:     ef.Network,
+		Format:      ef.Format,
+		Schema:      ef.Schema,
+		Table:       ef.TableName,
+		Date:        ef.Date,
+		Compression: ef.Compression.Extension,
+		Encryption:  ef.Encryption,
+		Size:        info.Size,
+		ModTime:     info.ModTime.UTC(),
+		Source:      source,
+	}
+	if ef.Ranged || ef.Length != "" {
+		ce.From, ce.To = ef.StartHeight, ef.EndHeight
+	}
+	if ef.SHA256 != "" && ef.Size == info.Size {
+		ce.SHA256 = ef.SHA256
+		ce.CID = ef.Cid.String()
+		if ef.IPFSCid.Defined() {
+			ce.IPFSCID = ef.IPFSCid.String()
+		}
+	}
+	return ce, nil
+}
+
+// recordShippedFile adds a shipped file to the catalog of the configured state store, if any.
+func recordShippedFile(ctx context.Context, ef *ExportFile, sh Shipper) error {
+	if stateStore == nil {
+		return nil
+	}
+
+	var entries []*CatalogEntry
+	for _, f := range ef.ShippedFiles() {
+		ce, err := catalogEntryForFile(ctx, f, sh, CatalogSourceShip)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ce)
+	}
+	return stateStore.AddCatalogEntries(entries...)
+}
@@ -14,22 +14,93 @@ import (
 )
 
 const (
-	MainnetGenesisTs = 1598306400 // unix timestamp of genesis epoch
-	Finality         = int64(miner.ChainFinality)
-	EpochsInDay      = builtin.EpochsInDay
+	MainnetGenesisTs  = 1598306400 // unix timestamp of genesis epoch
+	MainnetBlockDelay = int64(builtin.EpochDurationSeconds)
+	MainnetFinality   = int64(miner.ChainFinality)
+
+	secondsInDay = 24 * 60 * 60
+)
+
+// Network parameters used to convert between heights and times. These default to mainnet values and are replaced
+// by setNetworkParams when the archiver is configured for another network.
+var (
+	BlockDelay  = MainnetBlockDelay                // duration of an epoch in seconds
+	Finality    = MainnetFinality                  // number of epochs after which the chain is considered final
+	ExportDelay = MainnetFinality                  // number of epochs after the end of a period before it is exported
+	EpochsInDay = secondsInDay / MainnetBlockDelay // number of epochs in a day
 )
 
+// NetworkPreset holds the parameters of a well known network, used for any parameter not given explicitly when
+// --network names it.
+type NetworkPreset struct {
+	GenesisTs       int64  // unix timestamp of the genesis epoch, 0 if the network is reset too often for it to be known
+	BlockDelay      int64  // duration of an epoch in seconds
+	Finality        int64  // number of epochs after which the chain is considered final
+	UpgradeSchedule string // upgrades that affect lily model versions, in the format of --upgrade-schedule
+}
+
+// NetworkPresets are the parameters of well known networks by name.
+var NetworkPresets = map[string]NetworkPreset{
+	"mainnet": {
+		GenesisTs:       MainnetGenesisTs,
+		BlockDelay:      MainnetBlockDelay,
+		Finality:        MainnetFinality,
+		UpgradeSchedule: "14:1231620,15:1594680",
+	},
+	"calibnet": {
+		GenesisTs:       1667326380,
+		BlockDelay:      30,
+		Finality:        900,
+		UpgradeSchedule: "14:0,15:0,16:0,17:16800,18:322354,19:489094,20:492214",
+	},
+	"butterflynet": {
+		BlockDelay: 30,
+		Finality:   900,
+	},
+}
+
+// networkPresetForGenesis returns the name of the preset network with the given genesis timestamp, or an empty string
+// if there is none.
+func networkPresetForGenesis(genesisTs int64) string {
+	for name, np := range NetworkPresets {
+		if np.GenesisTs != 0 && np.GenesisTs == genesisTs {
+			return name
+		}
+	}
+	return ""
+}
+
+// setNetworkParams sets the network parameters from the block delay in seconds and the chain finality in epochs.
+func setNetworkParams(blockDelay, finality int64) error {
+	if blockDelay <= 0 {
+		return fmt.Errorf("block delay must be positive")
+	}
+	// Export periods cover whole days so every day must start on an epoch boundary
+	if secondsInDay%blockDelay != 0 {
+		return fmt.Errorf("block delay of %ds does not divide a day into a whole number of epochs", blockDelay)
+	}
+	if finality < 0 {
+		return fmt.Errorf("finality must not be negative")
+	}
+
+	BlockDelay = blockDelay
+	Finality = finality
+	ExportDelay = finality
+	EpochsInDay = secondsInDay / blockDelay
+	return nil
+}
+
 // HeightToUnix converts a chain height to a unix timestamp given the unix timestamp of the genesis epoch.
 func HeightToUnix(height int64, genesisTs int64) int64 {
-	return height*builtin.EpochDurationSeconds + genesisTs
+	return height*BlockDelay + genesisTs
 }
 
 // UnixToHeight converts a unix timestamp a chain height given the unix timestamp of the genesis epoch.
 func UnixToHeight(ts int64, genesisTs int64) int64 {
-	return (ts - genesisTs) / builtin.EpochDurationSeconds
+	return (ts - genesisTs) / BlockDelay
 }
 
-// CurrentHeight calculates the current height of the filecoin mainnet.
+// CurrentHeight calculates the current height of the network.
 func CurrentHeight(genesisTs int64) int64 {
 	return UnixToHeight(time.Now().Unix(), genesisTs)
 }
@@ -43,6 +114,10 @@ type NetworkHeight struct {
 var UpgradeSchedule = []NetworkHeight{}
 
 func setUpgradeSchedule(s string) error {
+	UpgradeSchedule = []NetworkHeight{}
+	if s == "" {
+		return nil
+	}
 	entries := strings.Split(s, ",")
 
 	for _, entry := range entries {
@@ -113,3 +188,15 @@ func NetworkVersionsBetweenHeights(from, to abi.ChainEpoch) []network.Version {
 
 	return versions
 }
+
+// NetworkVersionAtHeight returns the network version in use at the given height
+func NetworkVersionAtHeight(height abi.ChainEpoch) network.Version {
+	version := network.Version0
+	for _, nh := range UpgradeSchedule {
+		if nh.Height > height {
+			break
+		}
+		version = nh.Version
+	}
+	return version
+}
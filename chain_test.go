@@ -6,6 +6,7 @@ import (
 
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/network"
+	"github.com/urfave/cli/v2"
 )
 
 func TestNetworkVersionsBetweenHeights(t *testing.T) {
@@ -82,3 +83,168 @@ func TestNetworkVersionsBetweenHeights(t *testing.T) {
 		})
 	}
 }
+
+func TestSetNetworkParams(t *testing.T) {
+	defer func() {
+		if err := setNetworkParams(MainnetBlockDelay, MainnetFinality); err != nil {
+			t.Fatalf("failed to restore mainnet parameters: %v", err)
+		}
+	}()
+
+	testCases := []struct {
+		blockDelay      int64
+		finality        int64
+		wantErr         bool
+		wantEpochsInDay int64
+	}{
+		{blockDelay: 30, finality: 900, wantEpochsInDay: 2880},
+		{blockDelay: 4, finality: 900, wantEpochsInDay: 21600},
+		{blockDelay: 0, finality: 900, wantErr: true},
+		{blockDelay: 7, finality: 900, wantErr: true},
+		{blockDelay: 30, finality: -1, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d:%d", tc.blockDelay, tc.finality), func(t *testing.T) {
+			err := setNetworkParams(tc.blockDelay, tc.finality)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if EpochsInDay != tc.wantEpochsInDay {
+				t.Errorf("got %d epochs in day, wanted %d", EpochsInDay, tc.wantEpochsInDay)
+			}
+			if got := UnixToHeight(HeightToUnix(100, MainnetGenesisTs), MainnetGenesisTs); got != 100 {
+				t.Errorf("got height %d after round trip, wanted 100", got)
+			}
+		})
+	}
+}
+
+func TestConfigureNetwork(t *testing.T) {
+	saved, schedule, duration, delay := networkConfig, UpgradeSchedule, dealsConfig.duration, reorgConfig.delay
+	defer func() {
+		networkConfig, UpgradeSchedule, dealsConfig.duration, reorgConfig.delay = saved, schedule, duration, delay
+		if err := setNetworkParams(MainnetBlockDelay, MainnetFinality); err != nil {
+			t.Fatalf("failed to restore mainnet parameters: %v", err)
+		}
+	}()
+
+	testCases := []struct {
+		name       string
+		args       []string
+		wantErr    bool
+		genesisTs  int64
+		blockDelay int64
+		finality   int64
+		versions   int // number of upgrades in the schedule
+	}{
+		{name: "mainnet", args: nil, genesisTs: MainnetGenesisTs, blockDelay: 30, finality: 900, versions: 2},
+		{name: "calibnet", args: []string{"--network", "calibnet"}, genesisTs: 1667326380, blockDelay: 30, finality: 900, versions: 7},
+		{name: "calibnet with finality", args: []string{"--network", "calibnet", "--finality", "60"}, genesisTs: 1667326380, blockDelay: 30, finality: 60, versions: 7},
+		{name: "butterflynet without genesis", args: []string{"--network", "butterflynet"}, wantErr: true},
+		{name: "butterflynet", args: []string{"--network", "butterflynet", "--genesis-ts", "1700000000"}, genesisTs: 1700000000, blockDelay: 30, finality: 900, versions: 0},
+		{name: "devnet", args: []string{"--network", "devnet", "--genesis-ts", "1700000000", "--block-delay", "4", "--upgrade-schedule", "20:0"}, genesisTs: 1700000000, blockDelay: 4, finality: 900, versions: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &cli.App{
+				Flags:  append(append([]cli.Flag{}, networkFlags...), dealFlags...),
+				Action: configureNetwork,
+			}
+			err := app.Run(append([]string{"archiver"}, tc.args...))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if networkConfig.genesisTs != tc.genesisTs || BlockDelay != tc.blockDelay || Finality != tc.finality || len(UpgradeSchedule) != tc.versions {
+				t.Errorf("got genesis %d, block delay %d, finality %d and %d upgrades", networkConfig.genesisTs, BlockDelay, Finality, len(UpgradeSchedule))
+			}
+			if want := DefaultDealDays * secondsInDay / tc.blockDelay; dealsConfig.duration != want {
+				t.Errorf("got deal duration %d, wanted %d", dealsConfig.duration, want)
+			}
+			if reorgConfig.delay != tc.finality {
+				t.Errorf("got reconcile delay %d, wanted %d", reorgConfig.delay, tc.finality)
+			}
+		})
+	}
+}
+
+func TestExportPeriodForRange(t *testing.T) {
+	p := exportPeriodForRange(1005360, 1008239, MainnetGenesisTs)
+	if p.Date != (Date{Year: 2021, Month: 8, Day: 9}) {
+		t.Errorf("got date %s, wanted 2021-08-09", p.Date.String())
+	}
+
+	ef := ExportFile{
+		Date:        p.Date,
+		StartHeight: p.StartHeight,
+		EndHeight:   p.EndHeight,
+		Ranged:      p.Ranged,
+		TableName:   "messages",
+		Format:      "csv",
+		Compression: CompressionByName["gz"],
+	}
+	if got, want := ef.Filename(), "messages-1005360__1008239.csv.gz"; got != want {
+		t.Errorf("got file name %s, wanted %s", got, want)
+	}
+}
+
+func TestApplyFileNaming(t *testing.T) {
+	defer func(naming string) { storageConfig.fileNaming = naming }(storageConfig.fileNaming)
+
+	d := Date{Year: 2021, Month: 8, Day: 2}
+	p, err := exportPeriodForDate(d, MainnetGenesisTs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		naming string
+		want   string
+	}{
+		{naming: FileNamingDate, want: "messages-2021-08-02.csv.gz"},
+		{naming: FileNamingHeightRange, want: fmt.Sprintf("messages-%d__%d.csv.gz", p.StartHeight, p.EndHeight)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.naming, func(t *testing.T) {
+			storageConfig.fileNaming = tc.naming
+			ef := &ExportFile{
+				Date:        d,
+				TableName:   "messages",
+				Format:      "csv",
+				Compression: CompressionByName["gz"],
+			}
+			if err := applyFileNaming(ef, MainnetGenesisTs); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := ef.Filename(); got != tc.want {
+				t.Errorf("got file name %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChainSnapshotFile(t *testing.T) {
+	p, err := exportPeriodForDate(Date{Year: 2021, Month: 8, Day: 2}, MainnetGenesisTs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ef := chainSnapshotFile(p, "mainnet", 1, CompressionByName["zstd"])
+	if got, want := ef.Path(), "mainnet/car/1/chain_snapshot/2021/chain_snapshot-2021-08-02.car.zst"; got != want {
+		t.Errorf("got path %s, wanted %s", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ChecksumSuffix is appended to the path of a shipped file to give the path of its checksum file. Checksum files use
+// the format written by sha256sum so shipped files can also be checked using standard tools.
+const ChecksumSuffix = ".sha256"
+
+// checksumFileContents returns the contents of the checksum file for a shipped file with the given name.
+func checksumFileContents(sum string, name string) []byte {
+	return []byte(sum + "  " + name + "\n")
+}
+
+// parseChecksumFile returns the hex encoded checksum and file name held in a checksum file.
+func parseChecksumFile(data []byte) (string, string, error) {
+	line := strings.TrimSpace(string(data))
+	if idx := strings.IndexByte(line, '\n'); idx > -1 {
+		return "", "", fmt.Errorf("expected a single checksum")
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("expected checksum and file name")
+	}
+	sum, name := strings.ToLower(fields[0]), strings.TrimPrefix(fields[1], "*") // binary mode marker
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", "", fmt.Errorf("invalid sha256 checksum %q", fields[0])
+	}
+	return sum, name, nil
+}
+
+// sha256File returns the hex encoded SHA-256 checksum and size of a file.
+func sha256File(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("read: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// rawCidFromSHA256 returns the CIDv1 of a file's raw bytes given its hex encoded SHA-256 checksum.
+func rawCidFromSHA256(sum string) (cid.Cid, error) {
+	digest, err := hex.DecodeString(sum)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("decode checksum: %w", err)
+	}
+	m, err := mh.Encode(digest, mh.SHA2_256)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("encode multihash: %w", err)
+	}
+	return cid.NewCidV1(cid.Raw, m), nil
+}
+
+// ChecksumWriter wraps a writer, hashing and counting the bytes written to it so that a file's checksum can be
+// computed as it is written rather than by reading it back afterwards.
+type ChecksumWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func NewChecksumWriter(w io.Writer) *ChecksumWriter {
+	return &ChecksumWriter{w: w, h: sha256.New()}
+}
+
+func (cw *ChecksumWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.h.Write(p[:n])
+	cw.n += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written.
+func (cw *ChecksumWriter) Size() int64 {
+	return cw.n
+}
+
+// SHA256 returns the hex encoded SHA-256 checksum of the bytes written.
+func (cw *ChecksumWriter) SHA256() string {
+	return hex.EncodeToString(cw.h.Sum(nil))
+}
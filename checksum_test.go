@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	testCases := []struct {
+		name     string
+		data     string
+		wantName string
+		wantErr  bool
+	}{
+		{name: "written", data: string(checksumFileContents(sum, "messages-2021-08-02.csv.gz")), wantName: "messages-2021-08-02.csv.gz"},
+		{name: "binary marker", data: sum + " *messages-2021-08-02.csv.gz\n", wantName: "messages-2021-08-02.csv.gz"},
+		{name: "no name", data: sum + "\n", wantErr: true},
+		{name: "short sum", data: "2cf24dba  messages-2021-08-02.csv.gz\n", wantErr: true},
+		{name: "several sums", data: sum + "  a.csv.gz\n" + sum + "  b.csv.gz\n", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotSum, gotName, err := parseChecksumFile([]byte(tc.data))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotSum != sum || gotName != tc.wantName {
+				t.Errorf("got %s %s, wanted %s %s", gotSum, gotName, sum, tc.wantName)
+			}
+		})
+	}
+}
+
+func TestIsShippedDataFile(t *testing.T) {
+	testCases := []struct {
+		path string
+		want bool
+	}{
+		{path: "mainnet/csv/1/messages/2021/messages-2021-08-02.csv.gz", want: true},
+		{path: "mainnet/parquet/1/messages/2021/messages-2021-08-02.parquet", want: true},
+		{path: "mainnet/csv/1/messages/2021/messages-2021-08-02.csv.gz.sha256", want: false},
+		{path: "mainnet/csv/1/messages/2021/messages-2021-08-02.csv.zst.seek.json", want: false},
+		{path: "mainnet/csv/1/messages/2021/.messages-2021-08-02.csv.gz.123.tmp", want: false},
+		{path: "mainnet/csv/1/messages/messages.header", want: false},
+		{path: "mainnet/heights.json", want: false},
+	}
+
+	for _, tc := range testCases {
+		if got := isShippedDataFile(tc.path); got != tc.want {
+			t.Errorf("isShippedDataFile(%q): got %v, wanted %v", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrPeriodClaimed is returned when a period cannot be claimed because another archiver instance holds its claim.
+var ErrPeriodClaimed = errors.New("period is claimed by another archiver instance")
+
+// ClaimStore claims periods on behalf of archiver instances that share a ship path, so that only one instance exports
+// each period at a time. Each claim is an exclusive lock on a file in the claim directory, held for as long as the
+// period is being exported. The operating system releases the lock if the instance exits, so claims never need to
+// expire. The directory must be on a filesystem that supports locks between hosts, such as a local disk or NFSv4.
+type ClaimStore struct {
+	path string
+}
+
+// claimStore is the claim store in use by the process, nil if periods are not claimed.
+var claimStore *ClaimStore
+
+func openClaimStore(path string) (*ClaimStore, error) {
+	if err := os.MkdirAll(path, DefaultDirPerms); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", path, err)
+	}
+	return &ClaimStore{path: path}, nil
+}
+
+// ClaimHolder describes the instance holding a claim. It is written to the claim's lock file to help operators find
+// the instance exporting a period.
+type ClaimHolder struct {
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+}
+
+func (h ClaimHolder) String() string {
+	return fmt.Sprintf("%s (pid %d) since %s", h.Host, h.PID, h.Acquired.Format(time.RFC3339))
+}
+
+// PeriodClaim is a claim held on a period. It must be released once the period has been exported.
+type PeriodClaim struct {
+	Key string
+	f   *os.File
+}
+
+func (s *ClaimStore) lockPath(key string) string {
+	return filepath.Join(s.path, strings.ReplaceAll(key, "/", "-")+".lock")
+}
+
+// Claim claims the key without waiting, returning an error wrapping ErrPeriodClaimed if another instance holds it.
+func (s *ClaimStore) Claim(key string) (*PeriodClaim, error) {
+	f, err := os.OpenFile(s.lockPath(key), os.O_RDWR|os.O_CREATE, DefaultFilePerms)
+	if err != nil {
+		return nil, fmt.Errorf("open lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if h, err := s.Holder(key); err == nil && h != nil {
+				return nil, fmt.Errorf("%w: held by %s", ErrPeriodClaimed, h)
+			}
+			return nil, ErrPeriodClaimed
+		}
+		return nil, fmt.Errorf("lock %s: %w", key, err)
+	}
+
+	host, _ := os.Hostname()
+	data, err := json.Marshal(ClaimHolder{Host: host, PID: os.Getpid(), Acquired: time.Now().UTC()})
+	if err == nil {
+		if err := f.Truncate(0); err == nil {
+			_, _ = f.WriteAt(data, 0)
+		}
+	}
+
+	return &PeriodClaim{Key: key, f: f}, nil
+}
+
+// Holder returns the instance that last held the claim on the key, or nil if it has never been claimed. The holder is
+// not removed when a claim is released, so it may no longer hold the claim.
+func (s *ClaimStore) Holder(key string) (*ClaimHolder, error) {
+	data, err := os.ReadFile(s.lockPath(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var h ClaimHolder
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("decode holder: %w", err)
+	}
+	return &h, nil
+}
+
+// Release releases the claim. It is safe to call on a nil claim.
+func (c *PeriodClaim) Release() {
+	if c == nil || c.f == nil {
+		return
+	}
+	_ = syscall.Flock(int(c.f.Fd()), syscall.LOCK_UN)
+	c.f.Close()
+	c.f = nil
+}
+
+// claimPeriod claims a period of the network for export by this instance. Provisional exports of a period are claimed
+// separately from its final export. A nil claim is returned if periods are not claimed.
+func claimPeriod(network string, p ExportPeriod, provisional bool) (*PeriodClaim, error) {
+	if claimStore == nil {
+		return nil, nil
+	}
+	key := completedWalkKey(network, p, "")
+	if provisional {
+		key += "/provisional"
+	}
+	return claimStore.Claim(key)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestClaimStore(t *testing.T) {
+	defer func(cs *ClaimStore) { claimStore = cs }(claimStore)
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+
+	claimStore = nil
+	if c, err := claimPeriod("mainnet", p, false); err != nil || c != nil {
+		t.Fatalf("expected no claim without a claim store, got %v, %v", c, err)
+	}
+
+	var err error
+	claimStore, err = openClaimStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("open claim store: %v", err)
+	}
+
+	c, err := claimPeriod("mainnet", p, false)
+	if err != nil {
+		t.Fatalf("claim period: %v", err)
+	}
+
+	// Each claim opens its own lock file so a second claim from the same process contends like another instance
+	if _, err := claimPeriod("mainnet", p, false); !errors.Is(err, ErrPeriodClaimed) {
+		t.Errorf("expected period to be claimed, got %v", err)
+	}
+	if h, err := claimStore.Holder(completedWalkKey("mainnet", p, "")); err != nil || h == nil || h.PID != os.Getpid() {
+		t.Errorf("unexpected holder %v, %v", h, err)
+	}
+
+	// Other periods, networks and the provisional export of the period are claimed separately
+	others := []func() (*PeriodClaim, error){
+		func() (*PeriodClaim, error) { return claimPeriod("mainnet", p.Next(), false) },
+		func() (*PeriodClaim, error) { return claimPeriod("calibnet", p, false) },
+		func() (*PeriodClaim, error) { return claimPeriod("mainnet", p, true) },
+	}
+	for i, claim := range others {
+		oc, err := claim()
+		if err != nil {
+			t.Errorf("claim %d: %v", i, err)
+		}
+		oc.Release()
+	}
+
+	c.Release()
+	c.Release()
+	c, err = claimPeriod("mainnet", p, false)
+	if err != nil {
+		t.Fatalf("claim released period: %v", err)
+	}
+	c.Release()
+}
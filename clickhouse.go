@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// clickHouseWarehouse loads files into ClickHouse by streaming them to an INSERT over its HTTP interface. Files are
+// sent compressed, which ClickHouse decompresses according to the Content-Encoding of the request. Rows of csv files
+// are matched to columns by position and those of jsonl and parquet files by name.
+type clickHouseWarehouse struct {
+	endpoint *url.URL
+	database string
+	user     string
+	password string
+	client   *http.Client
+}
+
+var _ Warehouse = (*clickHouseWarehouse)(nil)
+
+func newClickHouseWarehouse(ws *WarehouseSpec) (*clickHouseWarehouse, error) {
+	u, err := url.Parse(ws.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return &clickHouseWarehouse{
+		endpoint: u,
+		database: ws.Database,
+		user:     ws.User,
+		password: ws.Password,
+		client:   &http.Client{},
+	}, nil
+}
+
+func (c *clickHouseWarehouse) String() string {
+	return c.endpoint.Redacted()
+}
+
+// clickHouseFormats maps ship formats to ClickHouse input formats.
+var clickHouseFormats = map[string]string{
+	FormatCSV:     "CSV",
+	FormatJSONL:   "JSONEachRow",
+	FormatParquet: "Parquet",
+}
+
+// clickHouseEncodings maps compression schemes to the Content-Encoding ClickHouse decompresses them with.
+var clickHouseEncodings = map[string]string{
+	"none":          "",
+	"gzip":          "gzip",
+	"zstd":          "zstd",
+	"zstd-seekable": "zstd",
+	"lz4":           "lz4",
+}
+
+// clickHouseIdentifier quotes a database or table name for use in a query.
+func clickHouseIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
+
+// Load inserts the rows of the file into the table. The key is used as the insert's deduplication token, so a retried
+// insert is ignored by tables that deduplicate inserts, such as replicated MergeTree tables.
+func (c *clickHouseWarehouse) Load(ctx context.Context, src *WarehouseSource, table string, key string) (string, error) {
+	if src.Local == "" {
+		return "", fmt.Errorf("clickhouse loads require a filesystem ship path")
+	}
+	format, ok := clickHouseFormats[src.File.Format]
+	if !ok {
+		return "", fmt.Errorf("unsupported format %q", src.File.Format)
+	}
+	encoding, ok := clickHouseEncodings[src.File.Compression]
+	if !ok {
+		return "", fmt.Errorf("unsupported compression %q", src.File.Compression)
+	}
+
+	name := clickHouseIdentifier(table)
+	if c.database != "" {
+		name = clickHouseIdentifier(c.database) + "." + name
+	}
+
+	f, err := os.Open(src.Local)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	u := *c.endpoint
+	q := u.Query()
+	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT %s", name, format))
+	q.Set("insert_deduplication_token", key)
+	if src.File.Provenance {
+		q.Set("input_format_csv_skip_first_lines", "1")
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), f)
+	if err != nil {
+		return "", fmt.Errorf("new request: %w", err)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if c.user != "" {
+		req.Header.Set("X-ClickHouse-User", c.user)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("insert: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("insert: unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Header.Get("X-ClickHouse-Query-Id"), nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+type Compression struct {
+	Names     []string
+	Extension string
+
+	// MinLevel and MaxLevel are the range of compression levels accepted by the scheme, both zero if the scheme has no
+	// levels. Level 0 always selects the scheme's default level.
+	MinLevel int
+	MaxLevel int
+
+	// Compress writes the compressed contents of r to w. Seekable schemes return an index of the frames written,
+	// which is shipped alongside the compressed file.
+	Compress func(ef *ExportFile, r io.Reader, w io.Writer) (*SeekIndex, error)
+
+	// Decompress returns a reader of the decompressed contents of r.
+	Decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var CompressionList = []Compression{
+	{
+		Names:      []string{"none"},
+		Extension:  "", // files are named without a compression extension
+		Compress:   compressNone,
+		Decompress: decompressNone,
+	},
+	{
+		Names:      []string{"gzip", "gz"},
+		Extension:  "gz",
+		MinLevel:   gzip.BestSpeed,
+		MaxLevel:   gzip.BestCompression,
+		Compress:   compressGzip,
+		Decompress: decompressGzip,
+	},
+	{
+		Names:      []string{"zstd", "zst"},
+		Extension:  "zst",
+		MinLevel:   1,
+		MaxLevel:   22,
+		Compress:   compressZstd,
+		Decompress: decompressZstd,
+	},
+	{
+		Names:      []string{"lz4"},
+		Extension:  "lz4",
+		Compress:   compressLZ4,
+		Decompress: decompressLZ4,
+	},
+	{
+		Names:      []string{"zstd-seekable"},
+		Extension:  "zst",
+		MinLevel:   1,
+		MaxLevel:   22,
+		Compress:   compressSeekableZstd,
+		Decompress: decompressZstd,
+	},
+}
+
+// CompressionByName maps a compression name to the compression scheme.
+var CompressionByName = map[string]Compression{}
+
+func init() {
+	for _, c := range CompressionList {
+		for _, name := range c.Names {
+			CompressionByName[name] = c
+		}
+	}
+}
+
+// AcceptsLevel reports whether the level is the default level or within the range of levels of the scheme.
+func (c Compression) AcceptsLevel(level int) bool {
+	return level == 0 || (level >= c.MinLevel && level <= c.MaxLevel && c.MaxLevel != 0)
+}
+
+// acceptedCompressionLevel reports whether any compression scheme accepts the level.
+func acceptedCompressionLevel(level int) bool {
+	for _, c := range CompressionList {
+		if c.AcceptsLevel(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompressionTuning is the level and number of workers used to compress a file.
+type CompressionTuning struct {
+	Level   int // compression level, 0 for the default level of the scheme
+	Workers int // number of blocks compressed in parallel, 0 for the default of the scheme
+}
+
+// compressionTuningFor returns the tuning for a file, which is that of the file's table in the table configuration
+// falling back to the --compression-level and --compression-workers flags. A nil file uses the flags.
+func compressionTuningFor(ef *ExportFile) CompressionTuning {
+	ct := CompressionTuning{Level: shippingConfig.compressionLevel, Workers: shippingConfig.compressionWorkers}
+	if ef == nil {
+		return ct
+	}
+	if nc := currentTableConfig(ef.Network); nc != nil {
+		if level, ok := nc.CompressionLevel[ef.TableName]; ok {
+			ct.Level = level
+		}
+		if workers, ok := nc.CompressionWorkers[ef.TableName]; ok {
+			ct.Workers = workers
+		}
+	}
+	return ct
+}
+
+// LevelFor returns the tuned level if the scheme accepts it, otherwise 0 so that the scheme's default is used. A level
+// given for all tables may not suit every scheme that they are shipped in.
+func (ct CompressionTuning) LevelFor(c Compression) int {
+	if !c.AcceptsLevel(ct.Level) {
+		return 0
+	}
+	return ct.Level
+}
+
+func compressNone(ef *ExportFile, r io.Reader, w io.Writer) (*SeekIndex, error) {
+	_, err := io.Copy(w, r)
+	return nil, err
+}
+
+func decompressNone(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func compressGzip(ef *ExportFile, r io.Reader, w io.Writer) (*SeekIndex, error) {
+	ct := compressionTuningFor(ef)
+	level := ct.LevelFor(CompressionByName["gz"])
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if shippingConfig.gzipRsyncable {
+		return nil, writeRsyncableGzip(r, w, level)
+	}
+	if ct.Workers > 1 {
+		return nil, writeParallelGzip(r, w, level, ct.Workers)
+	}
+
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, fmt.Errorf("new writer: %w", err)
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	return nil, nil
+}
+
+// parallelGzipBlockSize is the number of uncompressed bytes held in each gzip member written by parallel gzip
+// compression. Larger blocks compress better but hold more memory per worker.
+const parallelGzipBlockSize = 4 << 20
+
+// writeParallelGzip compresses r into w as a series of gzip members, each holding a block of the input, compressing
+// up to workers blocks at once. Gzip readers decompress concatenated members as a single stream, so the result is
+// read in the same way as a file compressed in one pass, at the cost of a slightly lower compression ratio.
+func writeParallelGzip(r io.Reader, w io.Writer, level int, workers int) error {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	// Results are queued in the order the blocks were read. The block awaited by the writer and those queued behind it
+	// are the ones being compressed, so the queue bounds the number of workers.
+	queue := make(chan chan result, workers-1)
+	done := make(chan struct{})
+	defer close(done)
+
+	var readErr error
+	go func() {
+		defer close(queue)
+		for first := true; ; first = false {
+			block := make([]byte, parallelGzipBlockSize)
+			n, err := io.ReadFull(r, block)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				readErr = err
+				return
+			}
+			// An empty input is still written as a single empty member
+			if n == 0 && !first {
+				return
+			}
+
+			res := make(chan result, 1)
+			select {
+			case queue <- res:
+			case <-done:
+				return
+			}
+			go func(block []byte) {
+				var buf bytes.Buffer
+				zw, err := gzip.NewWriterLevel(&buf, level)
+				if err == nil {
+					_, err = zw.Write(block)
+				}
+				if err == nil {
+					err = zw.Close()
+				}
+				res <- result{data: buf.Bytes(), err: err}
+			}(block[:n])
+
+			if n < len(block) {
+				return
+			}
+		}
+	}()
+
+	for res := range queue {
+		out := <-res
+		if out.err != nil {
+			return fmt.Errorf("compress block: %w", out.err)
+		}
+		if _, err := w.Write(out.data); err != nil {
+			return err
+		}
+	}
+	// The queue is only closed early by the reader after a read error
+	return readErr
+}
+
+const (
+	// rsyncableGzipBits is the number of bits of the rolling hash that must be zero to end a member of an rsyncable
+	// gzip file, giving members of around 64KiB of uncompressed data beyond the minimum.
+	rsyncableGzipBits = 16
+
+	// rsyncableGzipMinMember is the minimum number of uncompressed bytes held in a member of an rsyncable gzip file, so
+	// that repetitive data does not produce many tiny members.
+	rsyncableGzipMinMember = 16 << 10
+)
+
+// gearTable holds the random value mixed into the rolling hash for each byte of the input of rsyncable gzip files.
+// It is generated from a fixed seed since the member boundaries of shipped files depend on it.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x5e471e1)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// writeRsyncableGzip compresses r into w as a series of gzip members that end where a rolling hash of the last 64 bytes
+// of input matches, in the manner of gzip --rsyncable. Since member boundaries depend only on nearby content, a change
+// to part of the input only changes the members around it and rsync can reuse the rest of a previously shipped file.
+func writeRsyncableGzip(r io.Reader, w io.Writer, level int) error {
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return fmt.Errorf("new writer: %w", err)
+	}
+
+	var hash uint64
+	member := 0 // uncompressed bytes written to the current member
+	buf := make([]byte, 32<<10)
+	for {
+		n, readErr := r.Read(buf)
+		start := 0
+		for i, b := range buf[:n] {
+			hash = hash<<1 + gearTable[b]
+			member++
+			if member < rsyncableGzipMinMember || hash>>(64-rsyncableGzipBits) != 0 {
+				continue
+			}
+			if _, err := zw.Write(buf[start : i+1]); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return fmt.Errorf("close member: %w", err)
+			}
+			zw.Reset(w)
+			start, member = i+1, 0
+		}
+		if _, err := zw.Write(buf[start:n]); err != nil {
+			return err
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return nil
+}
+
+func decompressGzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdEncoderOptions returns the encoder options for a level and number of workers tuned for zstd.
+func zstdEncoderOptions(ct CompressionTuning) []zstd.EOption {
+	var opts []zstd.EOption
+	if level := ct.LevelFor(CompressionByName["zstd"]); level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if ct.Workers > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(ct.Workers))
+	}
+	return opts
+}
+
+func compressZstd(ef *ExportFile, r io.Reader, w io.Writer) (*SeekIndex, error) {
+	opts := zstdEncoderOptions(compressionTuningFor(ef))
+	dict := zstdDictionaryFor(ef)
+	if dict != nil {
+		opts = zstdDictionaryOptions(compressionTuningFor(ef), dict.Data)
+	}
+	zw, err := zstd.NewWriter(w, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("new encoder: %w", err)
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	if dict != nil {
+		ef.Dictionary = dict.Entry.ID
+	}
+	return nil, nil
+}
+
+// compressSeekableZstd compresses an export file using the zstd seekable format, recording the height range of each
+// frame when the table has a height column.
+func compressSeekableZstd(ef *ExportFile, r io.Reader, w io.Writer) (*SeekIndex, error) {
+	heightColumn := -1
+	if t, ok := TablesByName[ef.TableName]; ok {
+		headers, err := TableHeaders(t.Model)
+		if err != nil {
+			return nil, fmt.Errorf("table headers: %w", err)
+		}
+		for i, h := range headers {
+			if h == "height" {
+				heightColumn = i
+				break
+			}
+		}
+	}
+
+	frameSize := shippingConfig.seekFrameSize
+	if frameSize == 0 {
+		frameSize = DefaultSeekFrameSize
+	}
+
+	// Frames are compressed one at a time, so only the level applies
+	ct := compressionTuningFor(ef)
+	ct.Workers = 0
+	return writeSeekableZstd(r, w, frameSize, heightColumn, zstdEncoderOptions(ct)...)
+}
+
+func decompressZstd(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r, zstd.WithDecoderDicts(zstdDictionaries.Data()...))
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// compressLZ4 writes a single LZ4 frame of independent 4MiB blocks with a content checksum.
+func compressLZ4(ef *ExportFile, r io.Reader, w io.Writer) (*SeekIndex, error) {
+	zw := lz4.NewWriter(w)
+	if err := zw.Apply(lz4.BlockSizeOption(lz4.Block4Mb), lz4.ChecksumOption(true)); err != nil {
+		return nil, fmt.Errorf("new writer: %w", err)
+	}
+	// The frame header is written by the first write, so an empty input still produces a valid frame
+	if _, err := zw.Write(nil); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	return nil, nil
+}
+
+func decompressLZ4(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
+
+// contextReader stops reading once its context is cancelled, so that compression of a large file can be abandoned.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
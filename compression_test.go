@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	stdgzip "compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	input := strings.Repeat("1000,bafy2bzacea,f01234,\"quoted, value\"\n", 1000)
+
+	for _, c := range CompressionList {
+		t.Run(c.Names[0], func(t *testing.T) {
+			var compressed bytes.Buffer
+			if _, err := c.Compress(&ExportFile{TableName: "messages"}, strings.NewReader(input), &compressed); err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if c.Extension != "" && compressed.Len() >= len(input) {
+				t.Errorf("compressed size %d is not smaller than input size %d", compressed.Len(), len(input))
+			}
+
+			r, err := c.Decompress(&compressed)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			defer r.Close()
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(got) != input {
+				t.Errorf("decompressed data does not match input")
+			}
+		})
+	}
+}
+
+func TestCompressionTuning(t *testing.T) {
+	defer setTableConfig(nil)
+	defer func(level, workers int) {
+		shippingConfig.compressionLevel, shippingConfig.compressionWorkers = level, workers
+	}(shippingConfig.compressionLevel, shippingConfig.compressionWorkers)
+	shippingConfig.compressionLevel, shippingConfig.compressionWorkers = 3, 0
+
+	setTableConfig(&TableConfig{Networks: map[string]*NetworkTableConfig{
+		"mainnet": {
+			CompressionLevel:   map[string]int{"messages": 19},
+			CompressionWorkers: map[string]int{"messages": 4},
+		},
+	}})
+
+	messages := &ExportFile{Network: "mainnet", TableName: "messages"}
+	if ct := compressionTuningFor(messages); ct.Level != 19 || ct.Workers != 4 {
+		t.Errorf("got tuning %+v for configured table, wanted level 19 and 4 workers", ct)
+	}
+	if ct := compressionTuningFor(&ExportFile{Network: "mainnet", TableName: "blocks"}); ct.Level != 3 || ct.Workers != 0 {
+		t.Errorf("got tuning %+v for table without config, wanted the flags", ct)
+	}
+
+	// Level 19 is only accepted by zstd, so gzip falls back to its default
+	ct := compressionTuningFor(messages)
+	if got := ct.LevelFor(CompressionByName["gz"]); got != 0 {
+		t.Errorf("got gzip level %d, wanted the default", got)
+	}
+	if got := ct.LevelFor(CompressionByName["zstd"]); got != 19 {
+		t.Errorf("got zstd level %d, wanted 19", got)
+	}
+
+	input := strings.Repeat("1000,bafy2bzacea,f01234,\"quoted, value\"\n", 1000)
+	for _, name := range []string{"gz", "zstd", "zstd-seekable"} {
+		var compressed bytes.Buffer
+		c := CompressionByName[name]
+		if _, err := c.Compress(messages, strings.NewReader(input), &compressed); err != nil {
+			t.Fatalf("compress %s: %v", name, err)
+		}
+		r, err := c.Decompress(&compressed)
+		if err != nil {
+			t.Fatalf("decompress %s: %v", name, err)
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != input {
+			t.Errorf("tuned %s compression did not round trip: %v", name, err)
+		}
+	}
+
+	tc := &TableConfig{Networks: map[string]*NetworkTableConfig{
+		"mainnet": {Compression: map[string]string{"messages": "gz"}, CompressionLevel: map[string]int{"messages": 19}},
+	}}
+	if err := tc.Validate(); err == nil {
+		t.Errorf("expected a level not accepted by the table's compression to be rejected")
+	}
+}
+
+func TestParallelGzip(t *testing.T) {
+	for _, size := range []int{0, 100, parallelGzipBlockSize, 3*parallelGzipBlockSize + 17} {
+		input := bytes.Repeat([]byte("1000,bafy2bzacea,f01234\n"), size/24+1)[:size]
+
+		var compressed bytes.Buffer
+		if err := writeParallelGzip(bytes.NewReader(input), &compressed, 6, 3); err != nil {
+			t.Fatalf("compress %d bytes: %v", size, err)
+		}
+		r, err := CompressionByName["gz"].Decompress(&compressed)
+		if err != nil {
+			t.Fatalf("decompress %d bytes: %v", size, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Errorf("got %d bytes decompressing %d bytes compressed in parallel", len(got), size)
+		}
+	}
+}
+
+func TestRsyncableGzip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var input bytes.Buffer
+	for input.Len() < 1<<20 {
+		fmt.Fprintf(&input, "%d,bafy2bzace%x,f0%d,%d\n", 1005360+rng.Intn(2880), rng.Uint64(), rng.Intn(100000), rng.Int63())
+	}
+	// A re-export with a changed row near the start of the file
+	changed := append([]byte("1005360,bafy2bzacechanged,f01234,0\n"), input.Bytes()...)
+
+	compress := func(data []byte) []byte {
+		var out bytes.Buffer
+		if err := writeRsyncableGzip(bytes.NewReader(data), &out, gzip.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+		// Any gzip reader decompresses the members as a single stream
+		zr, err := stdgzip.NewReader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("decompressed data does not match input")
+		}
+		return out.Bytes()
+	}
+	a, b := compress(input.Bytes()), compress(changed)
+
+	common := 0
+	for common < len(a) && common < len(b) && a[len(a)-1-common] == b[len(b)-1-common] {
+		common++
+	}
+	if common < len(a)*9/10 {
+		t.Errorf("compressed files share %d of %d trailing bytes, wanted all but the members near the change", common, len(a))
+	}
+
+	var empty bytes.Buffer
+	if err := writeRsyncableGzip(strings.NewReader(""), &empty, gzip.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+	if zr, err := stdgzip.NewReader(&empty); err != nil {
+		t.Errorf("empty input was not written as a gzip member: %v", err)
+	} else if data, _ := io.ReadAll(zr); len(data) != 0 {
+		t.Errorf("got %q from empty input", data)
+	}
+}
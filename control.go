@@ -0,0 +1,747 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+// States of an export request submitted to the control API.
+const (
+	ExportRequestQueued    = "queued"    // waiting for a control worker
+	ExportRequestRunning   = "running"   // being exported, one period at a time
+	ExportRequestSucceeded = "succeeded" // every file of the request has been shipped
+	ExportRequestFailed    = "failed"    // the export of a period was dead-lettered or could not be started
+	ExportRequestCancelled = "cancelled" // the request was cancelled by a caller or the archiver shut down
+)
+
+// Classes of export request submitted to the control API.
+const (
+	ExportClassStandard = "standard" // run as a job of the export queue alongside the archive's own exports
+	ExportClassAdhoc    = "adhoc"    // run by separate workers, only while none of the archive's own exports are running
+)
+
+const (
+	// maxQueuedExportRequests is the number of export requests that may wait for a control worker before further
+	// requests are rejected.
+	maxQueuedExportRequests = 1000
+
+	// maxExportRequests is the number of export requests whose status is kept. The oldest finished requests are
+	// forgotten once it is exceeded.
+	maxExportRequests = 1000
+
+	// maxExportRequestPeriods is the number of periods a single export request may cover, a year of daily periods.
+	maxExportRequestPeriods = 366
+)
+
+// The messages of the control API, ExportRequest, ExportRequestID, ListExportRequests, ExportRequestStatus and
+// ExportRequestList, are generated from control.proto.
+
+// Finished reports whether the request has reached a state it will not leave.
+func (st *ExportRequestStatus) Finished() bool {
+	return st.State == ExportRequestSucceeded || st.State == ExportRequestFailed || st.State == ExportRequestCancelled
+}
+
+// exportRequest is an export request held by the control service.
+type exportRequest struct {
+	status  *ExportRequestStatus
+	periods []ExportPeriod
+	tables  []Table
+	sh      Shipper
+	ctx     context.Context
+	cancel  context.CancelFunc
+	updated chan struct{} // closed and replaced each time the status changes
+}
+
+// snapshot returns a copy of the status of the request, which callers may keep after it changes. It must be called
+// with the lock of the control service held.
+func (r *exportRequest) snapshot() *ExportRequestStatus {
+	return proto.Clone(r.status).(*ExportRequestStatus)
+}
+
+// exportFunc exports the tables of a period to a shipper for a class of request, reporting whether any files were
+// shipped. It calls attempted with the outcome of each attempt.
+type exportFunc func(ctx context.Context, p ExportPeriod, tables []Table, sh Shipper, class string, attempted func(error)) (bool, error)
+
+// ControlService accepts export requests from the control API. Standard requests run as jobs of the export queue,
+// alongside any export loop of the command, while ad-hoc requests wait for the command's own exports.
+type ControlService struct {
+	mu         sync.Mutex
+	requests   map[string]*exportRequest
+	seq        int
+	queue      chan *exportRequest
+	adhocQueue chan *exportRequest
+
+	sh      Shipper // default destination
+	tables  []Table // tables the command is allowed to export, before the table config is applied
+	targets []ShipTarget
+	export  exportFunc
+}
+
+// newControlService creates a control service that ships to sh by default and exports the allowed tables, or a
+// subset of them, in each of the targets.
+func newControlService(sh Shipper, allowedTables []Table, targets []ShipTarget) *ControlService {
+	cs := &ControlService{
+		requests:   map[string]*exportRequest{},
+		queue:      make(chan *exportRequest, maxQueuedExportRequests),
+		adhocQueue: make(chan *exportRequest, maxQueuedExportRequests),
+		sh:         sh,
+		tables:     allowedTables,
+		targets:    targets,
+	}
+	cs.export = cs.exportPeriod
+	return cs
+}
+
+// exportPeriod exports a period for an export request, retrying until it succeeds, fails too many times or the request
+// is cancelled. Standard requests run as jobs of the export queue while ad-hoc requests are retried outside it, so
+// that they cannot dead-letter or remove the jobs of the archive's own exports.
+func (cs *ControlService) exportPeriod(ctx context.Context, p ExportPeriod, tables []Table, sh Shipper, class string, attempted func(error)) (bool, error) {
+	var shipped bool
+	attempt := func(ctx context.Context) (err error) {
+		shipped, err = processPeriod(ctx, p, tables, cs.targets, sh)
+		attempted(err)
+		return err
+	}
+	var err error
+	if class == ExportClassAdhoc {
+		err = runAdhocExport(ctx, p, attempt)
+	} else {
+		err = runExportJob(ctx, p, tables, JobPriorityHead, attempt)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Ranged exports are not added to the height index, which only covers daily files
+	if shipped && !p.Ranged {
+		if err := updateHeightIndex(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, cs.targets); err != nil {
+			logger.Errorw("failed to update height index", "error", err, "date", p.Date.String())
+		}
+	}
+	return shipped, nil
+}
+
+// runAdhocExport attempts the export of a period for an ad-hoc request, waiting before each attempt until none of the
+// export jobs of this process are running. Failed attempts are retried with the backoff of the export queue until
+// the maximum number of attempts is reached.
+func runAdhocExport(ctx context.Context, p ExportPeriod, attempt func(context.Context) error) error {
+	ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight)
+	attempts := 0
+	for {
+		if err := activeExportJobs.WaitIdle(ctx); err != nil {
+			return err
+		}
+		err := attempt(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		wait := retryBackoff(0)
+		if !errors.Is(err, ErrPeriodClaimed) {
+			attempts++
+			if queueConfig.maxAttempts > 0 && attempts >= queueConfig.maxAttempts {
+				return fmt.Errorf("ad-hoc export failed after %d attempts: %w", attempts, err)
+			}
+			wait = retryBackoff(attempts)
+		}
+		ll.Infow("waiting to retry ad-hoc export", "attempts", attempts, "error", err, "wait", wait.String())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run starts the workers that export queued standard and ad-hoc requests and waits until the context is cancelled,
+// cancelling any requests that have not finished.
+func (cs *ControlService) Run(ctx context.Context, workers int, adhocWorkers int) {
+	var wg sync.WaitGroup
+	startWorkers := func(n int, queue chan *exportRequest) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case r := <-queue:
+						cs.process(ctx, r)
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+	startWorkers(workers, cs.queue)
+	startWorkers(adhocWorkers, cs.adhocQueue)
+	wg.Wait()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, r := range cs.requests {
+		if !r.status.Finished() {
+			r.cancel()
+			cs.setState(r, ExportRequestCancelled, "archiver shut down")
+		}
+	}
+}
+
+func (cs *ControlService) process(ctx context.Context, r *exportRequest) {
+	cs.mu.Lock()
+	if r.status.Finished() {
+		cs.mu.Unlock()
+		return
+	}
+	cs.setState(r, ExportRequestRunning, "")
+	cs.mu.Unlock()
+
+	ll := logger.With("request", r.status.Id, "period", r.status.Period, "class", r.status.Class)
+	ll.Infow("starting export request", "tables", strings.Join(r.status.Tables, ","))
+
+	// The request is cancelled either by a caller or when the archiver shuts down
+	rctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-rctx.Done():
+		}
+	}()
+
+	if r.sh != cs.sh {
+		if err := ensureAncillaryFiles(rctx, r.sh, r.tables); err != nil {
+			ll.Errorw("export request failed", "error", err)
+			cs.finish(r, false, fmt.Errorf("ensure ancillary files: %w", err))
+			return
+		}
+	}
+
+	var shipped bool
+	for _, p := range r.periods {
+		periodShipped, err := cs.export(rctx, p, r.tables, r.sh, r.status.Class, func(err error) { cs.attempted(r, err) })
+		if err != nil {
+			if len(r.periods) > 1 {
+				err = fmt.Errorf("period %s: %w", p.String(), err)
+			}
+			ll.Errorw("export request failed", "error", err)
+			cs.finish(r, shipped, err)
+			return
+		}
+		shipped = shipped || periodShipped
+		cs.periodDone(r)
+	}
+	ll.Infow("export request complete", "shipped", shipped)
+	cs.finish(r, shipped, nil)
+}
+
+// attempted records an attempt to export a request, so that callers watching it see the errors of attempts that will
+// be retried.
+func (cs *ControlService) attempted(r *exportRequest, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	r.status.Attempts++
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	cs.notify(r)
+}
+
+// periodDone records that a period of a request has been exported.
+func (cs *ControlService) periodDone(r *exportRequest) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	r.status.PeriodsDone++
+	cs.notify(r)
+}
+
+func (cs *ControlService) finish(r *exportRequest, shipped bool, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	r.status.Shipped = shipped
+	switch {
+	case err == nil:
+		cs.setState(r, ExportRequestSucceeded, "")
+	case r.ctx.Err() != nil || errors.Is(err, context.Canceled):
+		cs.setState(r, ExportRequestCancelled, err.Error())
+	default:
+		cs.setState(r, ExportRequestFailed, err.Error())
+	}
+	r.cancel()
+}
+
+// setState changes the state of a request and wakes any callers watching it. It must be called with the lock held.
+func (cs *ControlService) setState(r *exportRequest, state string, msg string) {
+	r.status.State = state
+	if msg != "" {
+		r.status.Error = msg
+	}
+	cs.notify(r)
+}
+
+// notify records that the status of a request has changed. It must be called with the lock held.
+func (cs *ControlService) notify(r *exportRequest) {
+	r.status.Updated = timestamppb.New(time.Now().UTC())
+	close(r.updated)
+	r.updated = make(chan struct{})
+}
+
+// Submit validates an export request and queues it for a control worker.
+func (cs *ControlService) Submit(req *ExportRequest) (*ExportRequestStatus, error) {
+	periods, err := exportRequestPeriods(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	class := req.Class
+	queue := cs.queue
+	switch class {
+	case "", ExportClassStandard:
+		class = ExportClassStandard
+	case ExportClassAdhoc:
+		queue = cs.adhocQueue
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown class %q, must be %s or %s", req.Class, ExportClassStandard, ExportClassAdhoc)
+	}
+
+	tables, err := exportRequestTables(req, currentTableConfig(networkConfig.name).FilterTables(cs.tables))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sh := cs.sh
+	if req.ShipPath != "" {
+		if !isControlShipPath(req.ShipPath) {
+			return nil, status.Errorf(codes.PermissionDenied, "ship path %q is not one of the allowed control ship paths", req.ShipPath)
+		}
+		sh, err = newShipper(req.ShipPath)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid ship path: %v", err)
+		}
+	}
+
+	first, last := periods[0], periods[len(periods)-1]
+	period := first.String()
+	if len(periods) > 1 {
+		period += ".." + last.String()
+	}
+
+	now := time.Now().UTC()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &exportRequest{
+		status: &ExportRequestStatus{
+			Request:     req,
+			State:       ExportRequestQueued,
+			Class:       class,
+			Period:      period,
+			StartHeight: first.StartHeight,
+			EndHeight:   last.EndHeight,
+			Periods:     int32(len(periods)),
+			Created:     timestamppb.New(now),
+			Updated:     timestamppb.New(now),
+		},
+		periods: periods,
+		tables:  tables,
+		sh:      sh,
+		ctx:     ctx,
+		cancel:  cancel,
+		updated: make(chan struct{}),
+	}
+	for _, t := range tables {
+		r.status.Tables = append(r.status.Tables, t.Name)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.seq++
+	r.status.Id = strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.Itoa(cs.seq)
+
+	select {
+	case queue <- r:
+	default:
+		cancel()
+		return nil, status.Error(codes.ResourceExhausted, "too many export requests are queued")
+	}
+	cs.requests[r.status.Id] = r
+	cs.forgetFinished()
+
+	logger.Infow("queued export request", "request", r.status.Id, "period", period, "class", class, "tables", strings.Join(r.status.Tables, ","))
+	return r.snapshot(), nil
+}
+
+// isControlShipPath reports whether an export request may ship to a path other than the archiver's ship path. Only
+// the paths listed by --control-ship-paths are allowed, so that callers cannot write wherever the archiver's
+// credentials reach.
+func isControlShipPath(path string) bool {
+	for _, p := range controlConfig.shipPaths {
+		if strings.TrimSuffix(p, "/") == strings.TrimSuffix(path, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetFinished removes the oldest finished requests once more than the maximum number are kept. It must be called
+// with the lock held.
+func (cs *ControlService) forgetFinished() {
+	if len(cs.requests) <= maxExportRequests {
+		return
+	}
+	var finished []*exportRequest
+	for _, r := range cs.requests {
+		if r.status.Finished() {
+			finished = append(finished, r)
+		}
+	}
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].status.Created.AsTime().Before(finished[b].status.Created.AsTime())
+	})
+	for _, r := range finished {
+		if len(cs.requests) <= maxExportRequests {
+			return
+		}
+		delete(cs.requests, r.status.Id)
+	}
+}
+
+// Status returns the status of a request, along with a channel that is closed when it next changes.
+func (cs *ControlService) Status(id string) (*ExportRequestStatus, <-chan struct{}, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	r, ok := cs.requests[id]
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "no export request %q", id)
+	}
+	return r.snapshot(), r.updated, nil
+}
+
+// List returns the status of every request that is kept, most recently submitted first.
+func (cs *ControlService) List() *ExportRequestList {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	l := &ExportRequestList{Requests: make([]*ExportRequestStatus, 0, len(cs.requests))}
+	for _, r := range cs.requests {
+		l.Requests = append(l.Requests, r.snapshot())
+	}
+	sort.Slice(l.Requests, func(a, b int) bool { return l.Requests[a].Created.AsTime().After(l.Requests[b].Created.AsTime()) })
+	return l
+}
+
+// Cancel cancels a request that has not finished. A running export stops at its next opportunity.
+func (cs *ControlService) Cancel(id string) (*ExportRequestStatus, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	r, ok := cs.requests[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no export request %q", id)
+	}
+	if !r.status.Finished() {
+		r.cancel()
+		if r.status.State == ExportRequestQueued {
+			cs.setState(r, ExportRequestCancelled, "cancelled before it started")
+		}
+	}
+	return r.snapshot(), nil
+}
+
+// exportRequestPeriods returns the periods to export for a request, in height order. A date selects the periods
+// covering it and a range of dates those covering any of its dates, while a height range is exported as a single
+// ranged period.
+func exportRequestPeriods(req *ExportRequest) ([]ExportPeriod, error) {
+	ranged := req.FromHeight != nil || req.ToHeight != nil
+	switch {
+	case req.Date != "" && ranged:
+		return nil, fmt.Errorf("only one of a date or a height range may be given")
+	case req.ToDate != "" && req.Date == "":
+		return nil, fmt.Errorf("a to date may only be given with a date")
+	case req.Date != "":
+		from, err := DateFromString(req.Date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date: %w", err)
+		}
+		to := from
+		if req.ToDate != "" {
+			to, err = DateFromString(req.ToDate)
+			if err != nil {
+				return nil, fmt.Errorf("invalid to date: %w", err)
+			}
+			if from.After(to) {
+				return nil, fmt.Errorf("to date must not be before date")
+			}
+		}
+		p, err := exportPeriodForDate(from, networkConfig.genesisTs)
+		if err != nil {
+			return nil, err
+		}
+		end := UnixToHeight(to.Next().Time().Unix(), networkConfig.genesisTs) - 1
+		var periods []ExportPeriod
+		for ; p.StartHeight <= end; p = p.Next() {
+			if len(periods) == maxExportRequestPeriods {
+				return nil, fmt.Errorf("a request may not cover more than %d periods", maxExportRequestPeriods)
+			}
+			periods = append(periods, p)
+		}
+		return periods, nil
+	case req.FromHeight == nil || req.ToHeight == nil:
+		return nil, fmt.Errorf("a date or both heights of a range must be given")
+	case *req.FromHeight < 0:
+		return nil, fmt.Errorf("from height must not be negative")
+	case *req.ToHeight < *req.FromHeight:
+		return nil, fmt.Errorf("to height must not be less than from height")
+	}
+	return []ExportPeriod{exportPeriodForRange(*req.FromHeight, *req.ToHeight, networkConfig.genesisTs)}, nil
+}
+
+// exportRequestTables returns the tables a request selects from those the archiver is allowed to export. A family
+// name selects each of its variants that is allowed.
+func exportRequestTables(req *ExportRequest, allowed []Table) ([]Table, error) {
+	if len(req.Tables) == 0 {
+		return allowed, nil
+	}
+	names, err := parseTableList(strings.Join(req.Tables, ","))
+	if err != nil {
+		return nil, err
+	}
+	isAllowed := map[string]bool{}
+	for _, t := range allowed {
+		isAllowed[t.Name] = true
+	}
+	var tables []Table
+	for _, name := range names {
+		if isAllowed[name] {
+			tables = append(tables, TablesByName[name])
+		}
+	}
+	for _, name := range req.Tables {
+		found := false
+		for _, t := range tables {
+			if t.Name == name || t.FamilyName() == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("table %q is not exported by this archiver", name)
+		}
+	}
+	return tables, nil
+}
+
+// controlServer serves the control service through the Control service generated from control.proto.
+type controlServer struct {
+	UnimplementedControlServer
+	cs *ControlService
+}
+
+func (s *controlServer) SubmitExport(ctx context.Context, req *ExportRequest) (*ExportRequestStatus, error) {
+	return s.cs.Submit(req)
+}
+
+func (s *controlServer) GetExport(ctx context.Context, req *ExportRequestID) (*ExportRequestStatus, error) {
+	st, _, err := s.cs.Status(req.Id)
+	return st, err
+}
+
+func (s *controlServer) ListExports(ctx context.Context, req *ListExportRequests) (*ExportRequestList, error) {
+	return s.cs.List(), nil
+}
+
+func (s *controlServer) CancelExport(ctx context.Context, req *ExportRequestID) (*ExportRequestStatus, error) {
+	return s.cs.Cancel(req.Id)
+}
+
+// WatchExport streams the status of a request each time it changes, ending once the request has finished.
+func (s *controlServer) WatchExport(req *ExportRequestID, stream Control_WatchExportServer) error {
+	for {
+		st, updated, err := s.cs.Status(req.Id)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(st); err != nil {
+			return err
+		}
+		if st.Finished() {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// checkControlToken rejects calls that do not present the bearer token, if one is configured. The token is compared in
+// constant time so that it cannot be guessed from how long a rejection takes.
+func checkControlToken(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if strings.HasPrefix(v, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(v, "Bearer ")), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+// newControlServer creates a gRPC server for the control service. An empty token leaves it unauthenticated.
+func newControlServer(cs *ControlService, token string) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := checkControlToken(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkControlToken(ss.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	RegisterControlServer(srv, &controlServer{cs: cs})
+	return srv
+}
+
+// startControlServer serves the control API on the configured address and runs its workers until the context is
+// cancelled.
+func startControlServer(ctx context.Context, cs *ControlService) error {
+	l, err := net.Listen("tcp", controlConfig.addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	if controlConfig.token == "" {
+		logger.Warnw("control api is unauthenticated", "addr", controlConfig.addr)
+	}
+	srv := newControlServer(cs, controlConfig.token)
+
+	go cs.Run(ctx, controlConfig.workers, controlConfig.adhocWorkers)
+	go func() {
+		<-ctx.Done()
+		srv.Stop()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			logger.Errorw("control server failed", "error", err)
+		}
+	}()
+	logger.Infow("control api listening", "addr", l.Addr().String())
+	return nil
+}
+
+var serveCommand = &cli.Command{
+	Name:   "serve",
+	Usage:  "Run a long-lived export service that exports the dates and height ranges requested through the control API.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		lilyFlags,
+		jobFlags,
+		storageFlags,
+		stateFlags,
+		auditFlags,
+		claimFlags,
+		warehouseFlags,
+		verificationFlags,
+		shippingFlags,
+		destinationsFlags,
+		hooksFlags,
+		objectStoreFlags,
+		publishedFlags,
+		ipfsFlags,
+		tableConfigFlags,
+		notifyFlags,
+		queueFlags,
+		snapshotFlags,
+		signingFlags,
+		anchorFlags,
+		sqliteFlags,
+		controlFlags,
+		diagnosticsFlags,
+		exportFlags,
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		if controlConfig.addr == "" {
+			return fmt.Errorf("the serve command requires a control api address")
+		}
+
+		if lilyNodes.Len() > 1 {
+			go lilyNodes.Run(ctx, lilyConfig.healthInterval)
+		}
+
+		allowedTables, err := allowedTablesFromFlags(cc)
+		if err != nil {
+			return err
+		}
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to ship files: %w", err)
+		}
+		sh = withShipDestinations(sh)
+
+		if err := loadZstdDictionaries(ctx, sh); err != nil {
+			return err
+		}
+
+		if shippingConfig.stagingPath != "" {
+			if err := verifyShipPath(shippingConfig.stagingPath); err != nil {
+				return fmt.Errorf("unable to write to staging path: %w", err)
+			}
+		}
+
+		if err := ensureAncillaryFiles(ctx, sh, currentTableConfig(networkConfig.name).FilterTables(allowedTables)); err != nil {
+			return fmt.Errorf("unable to ensure ancillary files exist: %w", err)
+		}
+
+		if path := cc.String("table-config"); path != "" {
+			go reloadTableConfigOnHangup(ctx, path, func(nc *NetworkTableConfig) error {
+				return ensureAncillaryFiles(ctx, sh, nc.FilterTables(allowedTables))
+			})
+		}
+
+		if err := startControlServer(ctx, newControlService(sh, allowedTables, targets)); err != nil {
+			return fmt.Errorf("start control server: %w", err)
+		}
+
+		<-ctx.Done()
+		logger.Info("shutting down")
+		return nil
+	},
+}
@@ -0,0 +1,287 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: control.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	// SubmitExport queues a request to export a date, a range of dates or a range of heights.
+	SubmitExport(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (*ExportRequestStatus, error)
+	// GetExport returns the status of a request.
+	GetExport(ctx context.Context, in *ExportRequestID, opts ...grpc.CallOption) (*ExportRequestStatus, error)
+	// ListExports returns the status of every request that is kept, most recently submitted first.
+	ListExports(ctx context.Context, in *ListExportRequests, opts ...grpc.CallOption) (*ExportRequestList, error)
+	// CancelExport cancels a request that has not finished.
+	CancelExport(ctx context.Context, in *ExportRequestID, opts ...grpc.CallOption) (*ExportRequestStatus, error)
+	// WatchExport streams the status of a request each time it changes, ending once the request has finished.
+	WatchExport(ctx context.Context, in *ExportRequestID, opts ...grpc.CallOption) (Control_WatchExportClient, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) SubmitExport(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (*ExportRequestStatus, error) {
+	out := new(ExportRequestStatus)
+	err := c.cc.Invoke(ctx, "/archiver.v1.Control/SubmitExport", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) GetExport(ctx context.Context, in *ExportRequestID, opts ...grpc.CallOption) (*ExportRequestStatus, error) {
+	out := new(ExportRequestStatus)
+	err := c.cc.Invoke(ctx, "/archiver.v1.Control/GetExport", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ListExports(ctx context.Context, in *ListExportRequests, opts ...grpc.CallOption) (*ExportRequestList, error) {
+	out := new(ExportRequestList)
+	err := c.cc.Invoke(ctx, "/archiver.v1.Control/ListExports", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) CancelExport(ctx context.Context, in *ExportRequestID, opts ...grpc.CallOption) (*ExportRequestStatus, error) {
+	out := new(ExportRequestStatus)
+	err := c.cc.Invoke(ctx, "/archiver.v1.Control/CancelExport", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) WatchExport(ctx context.Context, in *ExportRequestID, opts ...grpc.CallOption) (Control_WatchExportClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[0], "/archiver.v1.Control/WatchExport", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlWatchExportClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Control_WatchExportClient interface {
+	Recv() (*ExportRequestStatus, error)
+	grpc.ClientStream
+}
+
+type controlWatchExportClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlWatchExportClient) Recv() (*ExportRequestStatus, error) {
+	m := new(ExportRequestStatus)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility
+type ControlServer interface {
+	// SubmitExport queues a request to export a date, a range of dates or a range of heights.
+	SubmitExport(context.Context, *ExportRequest) (*ExportRequestStatus, error)
+	// GetExport returns the status of a request.
+	GetExport(context.Context, *ExportRequestID) (*ExportRequestStatus, error)
+	// ListExports returns the status of every request that is kept, most recently submitted first.
+	ListExports(context.Context, *ListExportRequests) (*ExportRequestList, error)
+	// CancelExport cancels a request that has not finished.
+	CancelExport(context.Context, *ExportRequestID) (*ExportRequestStatus, error)
+	// WatchExport streams the status of a request each time it changes, ending once the request has finished.
+	WatchExport(*ExportRequestID, Control_WatchExportServer) error
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (UnimplementedControlServer) SubmitExport(context.Context, *ExportRequest) (*ExportRequestStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitExport not implemented")
+}
+func (UnimplementedControlServer) GetExport(context.Context, *ExportRequestID) (*ExportRequestStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetExport not implemented")
+}
+func (UnimplementedControlServer) ListExports(context.Context, *ListExportRequests) (*ExportRequestList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListExports not implemented")
+}
+func (UnimplementedControlServer) CancelExport(context.Context, *ExportRequestID) (*ExportRequestStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelExport not implemented")
+}
+func (UnimplementedControlServer) WatchExport(*ExportRequestID, Control_WatchExportServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchExport not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_SubmitExport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).SubmitExport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/archiver.v1.Control/SubmitExport",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).SubmitExport(ctx, req.(*ExportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_GetExport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportRequestID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetExport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/archiver.v1.Control/GetExport",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetExport(ctx, req.(*ExportRequestID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ListExports_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListExportRequests)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ListExports(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/archiver.v1.Control/ListExports",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ListExports(ctx, req.(*ListExportRequests))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_CancelExport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportRequestID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).CancelExport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/archiver.v1.Control/CancelExport",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).CancelExport(ctx, req.(*ExportRequestID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_WatchExport_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRequestID)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).WatchExport(m, &controlWatchExportServer{stream})
+}
+
+type Control_WatchExportServer interface {
+	Send(*ExportRequestStatus) error
+	grpc.ServerStream
+}
+
+type controlWatchExportServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlWatchExportServer) Send(m *ExportRequestStatus) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "archiver.v1.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitExport",
+			Handler:    _Control_SubmitExport_Handler,
+		},
+		{
+			MethodName: "GetExport",
+			Handler:    _Control_GetExport_Handler,
+		},
+		{
+			MethodName: "ListExports",
+			Handler:    _Control_ListExports_Handler,
+		},
+		{
+			MethodName: "CancelExport",
+			Handler:    _Control_CancelExport_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchExport",
+			Handler:       _Control_WatchExport_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
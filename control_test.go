@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestControlAPI(t *testing.T) {
+	defer func(n string, v int, g int64) {
+		networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs = n, v, g
+	}(networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs)
+	networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs = "mainnet", 1, MainnetGenesisTs
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	exported := make(chan ExportPeriod, 1)
+	cs := newControlService(&fileShipper{root: t.TempDir()}, StableTables, []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}})
+	cs.export = func(ctx context.Context, p ExportPeriod, tables []Table, sh Shipper, class string, attempted func(error)) (bool, error) {
+		attempted(errors.New("lily unavailable"))
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		attempted(nil)
+		exported <- p
+		return true, nil
+	}
+	go cs.Run(ctx, 1, 1)
+
+	l := bufconn.Listen(1 << 20)
+	srv := newControlServer(cs, "secret")
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewControlClient(conn)
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+
+	_, err = client.SubmitExport(ctx, &ExportRequest{Date: "2021-08-09"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v without a token, wanted unauthenticated", err)
+	}
+	for _, auth := range []string{"Bearer secre", "Bearer secret2", "secret"} {
+		wrong := metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+		_, err = client.SubmitExport(wrong, &ExportRequest{Date: "2021-08-09"})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("got %v with authorization %q, wanted unauthenticated", err, auth)
+		}
+	}
+
+	from, to := int64(10), int64(5)
+	_, err = client.SubmitExport(authed, &ExportRequest{FromHeight: &from, ToHeight: &to})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v for a reversed height range, wanted invalid argument", err)
+	}
+
+	req := &ExportRequest{Date: "2021-08-09", Tables: []string{"messages", "miner_sector_infos"}}
+	st, err := client.SubmitExport(authed, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != ExportRequestQueued || st.StartHeight != 1005360 || st.EndHeight != 1008239 || len(st.Tables) != 3 {
+		t.Fatalf("unexpected status of submitted request %+v", st)
+	}
+
+	stream, err := client.WatchExport(authed, &ExportRequestID{Id: st.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var states []string
+	for {
+		update, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, update.State)
+		if update.State == ExportRequestRunning && update.Error == "lily unavailable" {
+			close(release)
+		}
+		if update.Finished() {
+			if update.State != ExportRequestSucceeded || !update.Shipped || update.Attempts != 2 {
+				t.Errorf("unexpected final status %+v", update)
+			}
+		}
+	}
+	if len(states) < 2 || states[len(states)-1] != ExportRequestSucceeded {
+		t.Errorf("got states %v, wanted the request to be watched until it succeeded", states)
+	}
+
+	select {
+	case p := <-exported:
+		if p.Date.String() != "2021-08-09" || p.Ranged {
+			t.Errorf("exported period %s, wanted the requested date", p.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not exported")
+	}
+
+	list, err := client.ListExports(authed, &ListExportRequests{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Requests) != 1 || list.Requests[0].Id != st.Id {
+		t.Errorf("unexpected list of requests %+v", list.Requests)
+	}
+
+	_, err = client.GetExport(authed, &ExportRequestID{Id: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for an unknown request, wanted not found", err)
+	}
+}
+
+func TestExportRequestTables(t *testing.T) {
+	allowed := []Table{TablesByName["messages"], TablesByName["miner_sector_infos_v7"]}
+
+	tables, err := exportRequestTables(&ExportRequest{Tables: []string{"miner_sector_infos"}}, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].Name != "miner_sector_infos_v7" {
+		t.Errorf("got tables %v, wanted only the allowed variant of the family", tables)
+	}
+
+	if _, err := exportRequestTables(&ExportRequest{Tables: []string{"receipts"}}, allowed); err == nil {
+		t.Errorf("expected an error for a table the archiver does not export")
+	}
+
+	if tables, err := exportRequestTables(&ExportRequest{}, allowed); err != nil || len(tables) != len(allowed) {
+		t.Errorf("got tables %v, wanted every allowed table: %v", tables, err)
+	}
+}
+
+func TestExportRequestShipPath(t *testing.T) {
+	defer func(n string, g int64, paths []string) {
+		networkConfig.name, networkConfig.genesisTs, controlConfig.shipPaths = n, g, paths
+	}(networkConfig.name, networkConfig.genesisTs, controlConfig.shipPaths)
+	networkConfig.name, networkConfig.genesisTs = "mainnet", MainnetGenesisTs
+	adhoc := t.TempDir()
+	controlConfig.shipPaths = []string{adhoc + "/"}
+
+	cs := newControlService(&fileShipper{root: t.TempDir()}, StableTables, []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}})
+	for _, path := range []string{t.TempDir(), adhoc + "/../etc", "s3://bucket/adhoc/"} {
+		if _, err := cs.Submit(&ExportRequest{Date: "2021-03-01", ShipPath: path}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("got %v shipping to %s, wanted permission denied", err, path)
+		}
+	}
+	if _, err := cs.Submit(&ExportRequest{Date: "2021-03-01", ShipPath: adhoc}); err != nil {
+		t.Errorf("got %v shipping to an allowed path", err)
+	}
+}
+
+func TestExportRequestPeriods(t *testing.T) {
+	defer func(g int64) { networkConfig.genesisTs = g }(networkConfig.genesisTs)
+	networkConfig.genesisTs = MainnetGenesisTs
+
+	periods, err := exportRequestPeriods(&ExportRequest{Date: "2021-03-01", ToDate: "2021-03-31"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 31 || periods[0].Date.String() != "2021-03-01" || periods[30].Date.String() != "2021-03-31" {
+		t.Fatalf("got %d periods, wanted each day of march", len(periods))
+	}
+	for i := 1; i < len(periods); i++ {
+		if periods[i].StartHeight != periods[i-1].EndHeight+1 {
+			t.Errorf("period %s does not follow %s", periods[i].String(), periods[i-1].String())
+		}
+	}
+
+	from, to := int64(100), int64(200)
+	if periods, err := exportRequestPeriods(&ExportRequest{FromHeight: &from, ToHeight: &to}); err != nil || len(periods) != 1 || !periods[0].Ranged {
+		t.Errorf("got periods %v for a height range, wanted a single ranged period: %v", periods, err)
+	}
+
+	for _, req := range []*ExportRequest{
+		{Date: "2021-03-31", ToDate: "2021-03-01"},
+		{ToDate: "2021-03-01"},
+		{Date: "2020-01-01", ToDate: "2021-12-31"},
+	} {
+		if _, err := exportRequestPeriods(req); err == nil {
+			t.Errorf("expected an error for request %+v", req)
+		}
+	}
+}
+
+func TestAdhocExportRequest(t *testing.T) {
+	defer func(n string, g int64) { networkConfig.name, networkConfig.genesisTs = n, g }(networkConfig.name, networkConfig.genesisTs)
+	networkConfig.name, networkConfig.genesisTs = "mainnet", MainnetGenesisTs
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var classes []string
+	exported := make(chan ExportPeriod, 2)
+	cs := newControlService(&fileShipper{root: t.TempDir()}, StableTables, []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}})
+	cs.export = func(ctx context.Context, p ExportPeriod, tables []Table, sh Shipper, class string, attempted func(error)) (bool, error) {
+		classes = append(classes, class)
+		attempted(nil)
+		exported <- p
+		return true, nil
+	}
+	// Only an ad-hoc worker runs, so the request must not be queued for the standard workers
+	go cs.Run(ctx, 0, 1)
+
+	if _, err := cs.Submit(&ExportRequest{Date: "2021-03-01", Class: "urgent"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown class, wanted invalid argument", err)
+	}
+
+	st, err := cs.Submit(&ExportRequest{Date: "2021-03-01", ToDate: "2021-03-02", Tables: []string{"market_deal_proposals", "market_deal_states"}, Class: ExportClassAdhoc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Class != ExportClassAdhoc || st.Periods != 2 || st.Period != "2021-03-01..2021-03-02" || len(st.Tables) != 2 {
+		t.Fatalf("unexpected status of submitted request %+v", st)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-exported:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request was not exported")
+		}
+	}
+	for {
+		st, updated, err := cs.Status(st.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Finished() {
+			if st.State != ExportRequestSucceeded || st.PeriodsDone != 2 || len(classes) != 2 || classes[0] != ExportClassAdhoc {
+				t.Errorf("unexpected final status %+v exporting as %v", st, classes)
+			}
+			break
+		}
+		<-updated
+	}
+}
+
+func TestRunAdhocExportWaitsForExportJobs(t *testing.T) {
+	done := activeExportJobs.Start()
+
+	started := make(chan struct{})
+	go runAdhocExport(context.Background(), ExportPeriod{}, func(ctx context.Context) error {
+		close(started)
+		return nil
+	})
+
+	select {
+	case <-started:
+		t.Fatal("ad-hoc export started while an export job was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ad-hoc export did not start once export jobs finished")
+	}
+}
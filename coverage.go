@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Coverage states of the heights of a period.
+const (
+	CoverageShipped     = "shipped"      // the table has been shipped in every format
+	CoveragePartial     = "partial"      // the table has been shipped in some formats but not others
+	CoverageMissing     = "missing"      // the table is expected but has not been shipped
+	CoverageKnownBad    = "known_bad"    // the table is annotated as known bad and will not be exported
+	CoverageNotExpected = "not_expected" // the table is not produced at the network versions of the period
+	CoveragePending     = "pending"      // the period is not yet due to be exported
+)
+
+// PeriodCoverage describes how the heights of a requested range that fall within one export period are covered.
+type PeriodCoverage struct {
+	Period      string   `json:"period"`
+	Date        Date     `json:"date"`
+	StartHeight int64    `json:"start_height"` // first height of the requested range within the period
+	EndHeight   int64    `json:"end_height"`   // last height of the requested range within the period
+	Status      string   `json:"status"`
+	Files       []string `json:"files,omitempty"` // shipped files holding the heights
+}
+
+// Covered reports whether the heights are held by at least one shipped file.
+func (pc *PeriodCoverage) Covered() bool {
+	return pc.Status == CoverageShipped || pc.Status == CoveragePartial
+}
+
+// CoverageRange is a run of consecutive heights that share a coverage status.
+type CoverageRange struct {
+	StartHeight int64  `json:"start_height"`
+	EndHeight   int64  `json:"end_height"`
+	Status      string `json:"status"`
+}
+
+// TableCoverage reports which heights of a range are covered by the shipped files of a table.
+type TableCoverage struct {
+	Table      string            `json:"table"`
+	FromHeight int64             `json:"from_height"`
+	ToHeight   int64             `json:"to_height"`
+	Periods    []*PeriodCoverage `json:"periods"`
+	Covered    int64             `json:"covered"`   // number of heights held by shipped files
+	Uncovered  []*CoverageRange  `json:"uncovered"` // heights not held by shipped files, merged into ranges
+}
+
+// tableCoverage maps each height of the range to the export period that covers it, using the genesis timestamp, and
+// reports whether the period's files of the table have been shipped. The variants of a table family are reported
+// together under the family name, each period being covered by the variant active at its heights.
+func tableCoverage(ctx context.Context, name string, tables []Table, from, to int64, network string, genesisTs int64, sh Shipper, schemaVersion int, targets []ShipTarget) (*TableCoverage, error) {
+	tc := &TableCoverage{
+		Table:      name,
+		FromHeight: from,
+		ToHeight:   to,
+		Periods:    []*PeriodCoverage{},
+		Uncovered:  []*CoverageRange{},
+	}
+
+	current := CurrentHeight(genesisTs)
+	for p := exportPeriodForHeight(from, genesisTs); p.StartHeight <= to; p = p.Next() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		pc := &PeriodCoverage{
+			Period:      p.String(),
+			Date:        p.Date,
+			StartHeight: p.StartHeight,
+			EndHeight:   p.EndHeight,
+		}
+		if pc.StartHeight < from {
+			pc.StartHeight = from
+		}
+		if pc.EndHeight > to {
+			pc.EndHeight = to
+		}
+
+		em, err := manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, tables, targets)
+		if err != nil {
+			return nil, fmt.Errorf("build manifest for period %s: %w", p.String(), err)
+		}
+		pc.Status, pc.Files = periodCoverageStatus(ctx, em, sh)
+		if pc.Status == CoverageMissing && current <= p.EndHeight+ExportDelay {
+			pc.Status = CoveragePending
+		}
+		tc.Periods = append(tc.Periods, pc)
+
+		if pc.Covered() {
+			tc.Covered += pc.EndHeight - pc.StartHeight + 1
+			continue
+		}
+		if n := len(tc.Uncovered); n > 0 && tc.Uncovered[n-1].Status == pc.Status && tc.Uncovered[n-1].EndHeight+1 == pc.StartHeight {
+			tc.Uncovered[n-1].EndHeight = pc.EndHeight
+			continue
+		}
+		tc.Uncovered = append(tc.Uncovered, &CoverageRange{StartHeight: pc.StartHeight, EndHeight: pc.EndHeight, Status: pc.Status})
+	}
+	return tc, nil
+}
+
+// periodCoverageStatus returns the coverage status of the files of a manifest built for a single table or table
+// family, along with the paths of those that have been shipped. Sharded files are listed by the path of their shard
+// list.
+func periodCoverageStatus(ctx context.Context, em *ExportManifest, sh Shipper) (string, []string) {
+	if len(em.Files) == 0 {
+		return CoverageNotExpected, nil
+	}
+
+	var files []string
+	for _, ef := range em.Files {
+		if ef.Annotation != nil {
+			return CoverageKnownBad, nil
+		}
+		if !ef.Shipped {
+			continue
+		}
+		path := ef.Path()
+		if _, err := sh.Stat(ctx, path); err != nil {
+			path = ef.ShardListPath()
+		}
+		files = append(files, path)
+	}
+
+	switch len(files) {
+	case 0:
+		return CoverageMissing, nil
+	case len(em.Files):
+		return CoverageShipped, files
+	default:
+		return CoveragePartial, files
+	}
+}
+
+var coverageCommand = &cli.Command{
+	Name:   "coverage",
+	Usage:  "Report which heights of a range are covered by the shipped files of a table, and the files that hold them.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		stateFlags,
+		objectStoreFlags,
+		tableConfigFlags,
+		shipFormatFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path or s3://bucket/prefix or gs://bucket/prefix object store location that files were shipped to.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "table",
+				Usage:    "Name of the table, or family of table variants, to report on.",
+				Required: true,
+			},
+			&cli.Int64Flag{
+				Name:     "from-height",
+				Usage:    "First height of the range to report on.",
+				Required: true,
+			},
+			&cli.Int64Flag{
+				Name:  "to-height",
+				Usage: "Last height of the range to report on, inclusive. Defaults to the from height.",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Write the coverage as JSON.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := cc.Context
+
+		name := cc.String("table")
+		tables, ok := TableVariants(name)
+		if !ok {
+			return fmt.Errorf("unknown table %q", cc.String("table"))
+		}
+		from, to := cc.Int64("from-height"), cc.Int64("from-height")
+		if cc.IsSet("to-height") {
+			to = cc.Int64("to-height")
+		}
+		if from < 0 {
+			return fmt.Errorf("from height must not be negative")
+		}
+		if to < from {
+			return fmt.Errorf("to height must not be less than the from height")
+		}
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+
+		tc, err := tableCoverage(ctx, name, tables, from, to, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, targets)
+		if err != nil {
+			return err
+		}
+
+		if cc.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(tc)
+		}
+
+		for _, pc := range tc.Periods {
+			line := fmt.Sprintf("%s %d-%d %s", pc.Period, pc.StartHeight, pc.EndHeight, pc.Status)
+			if len(pc.Files) > 0 {
+				line += " " + strings.Join(pc.Files, ",")
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d of %d heights of %s between %d and %d are covered by shipped files\n", tc.Covered, to-from+1, name, from, to)
+		return nil
+	},
+}
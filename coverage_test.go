@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTableCoverage(t *testing.T) {
+	defer func(n string, v int, g int64) {
+		networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs = n, v, g
+	}(networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs)
+	networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs = "mainnet", 1, MainnetGenesisTs
+
+	if p := exportPeriodForHeight(1008239, networkConfig.genesisTs); p.Date.String() != "2021-08-09" || p.StartHeight != 1005360 {
+		t.Fatalf("height 1008239 mapped to period %s starting at %d, wanted 2021-08-09 starting at 1005360", p.Date.String(), p.StartHeight)
+	}
+
+	shipPath := t.TempDir()
+	sh := &fileShipper{root: shipPath}
+	table := TablesByName["messages"]
+	targets := []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}}
+
+	shipped := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 9}, StartHeight: 1005360, EndHeight: 1008239}
+	em, err := manifestForPeriod(context.Background(), shipped, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, []Table{table}, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := em.Files[0].Path()
+	if err := os.MkdirAll(filepath.Join(shipPath, filepath.Dir(path)), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shipPath, path), []byte("data"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	tc, err := tableCoverage(context.Background(), table.Name, []Table{table}, 1008000, 1008500, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tc.Periods) != 2 {
+		t.Fatalf("got %d periods, wanted 2", len(tc.Periods))
+	}
+	first, second := tc.Periods[0], tc.Periods[1]
+	if first.Status != CoverageShipped || first.StartHeight != 1008000 || first.EndHeight != 1008239 || len(first.Files) != 1 || first.Files[0] != path {
+		t.Errorf("unexpected coverage of shipped period %+v", first)
+	}
+	if second.Status != CoverageMissing || second.Date.String() != "2021-08-10" || second.StartHeight != 1008240 || second.EndHeight != 1008500 {
+		t.Errorf("unexpected coverage of missing period %+v", second)
+	}
+	if tc.Covered != 240 {
+		t.Errorf("got %d covered heights, wanted 240", tc.Covered)
+	}
+	if len(tc.Uncovered) != 1 || tc.Uncovered[0].StartHeight != 1008240 || tc.Uncovered[0].EndHeight != 1008500 {
+		t.Errorf("unexpected uncovered ranges %+v", tc.Uncovered)
+	}
+}
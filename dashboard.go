@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of the status dashboard.
+const (
+	DefaultDashboardPeriods = 30          // number of periods shown in the coverage heatmap
+	MaxDashboardPeriods     = 366         // largest number of periods that may be requested
+	DefaultDashboardRefresh = time.Minute // time the coverage heatmap is cached for
+	DefaultRecentErrors     = 50          // number of export errors kept for the dashboard
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// RecentError is a failed attempt to export a period.
+type RecentError struct {
+	Time   time.Time `json:"time"`
+	Period string    `json:"period"`
+	Error  string    `json:"error"`
+}
+
+// errorHistory keeps the most recent export errors in memory.
+type errorHistory struct {
+	mu     sync.Mutex
+	max    int
+	errors []RecentError
+}
+
+// recentErrors holds the export errors of this process for the status API.
+var recentErrors = &errorHistory{max: DefaultRecentErrors}
+
+// Record adds an error, discarding the oldest once the history is full.
+func (h *errorHistory) Record(p ExportPeriod, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errors = append(h.errors, RecentError{Time: time.Now().UTC(), Period: p.String(), Error: err.Error()})
+	if len(h.errors) > h.max {
+		h.errors = h.errors[len(h.errors)-h.max:]
+	}
+}
+
+// List returns the errors, most recent first.
+func (h *errorHistory) List() []RecentError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]RecentError, len(h.errors))
+	for i, e := range h.errors {
+		list[len(h.errors)-1-i] = e
+	}
+	return list
+}
+
+// DashboardCoverage is the coverage heatmap of the dashboard, giving the coverage status of each table in each of the
+// most recent periods.
+type DashboardCoverage struct {
+	Network   string                    `json:"network"`
+	Generated time.Time                 `json:"generated"`
+	Periods   []string                  `json:"periods"` // oldest first
+	Tables    map[string][]string       `json:"tables"`  // coverage status of each period, by table
+	Summary   map[string]map[string]int `json:"summary"` // number of tables with each coverage status, by period
+}
+
+// dashboardArchive is the archive whose coverage the dashboard shows. It is only set by commands that export, and
+// caches the coverage since building it reads the ship path.
+type dashboardArchiveView struct {
+	mu       sync.Mutex
+	sh       Shipper
+	tables   []Table
+	targets  []ShipTarget
+	cached   *DashboardCoverage
+	cachedAt time.Time
+	periods  int // number of periods of the cached coverage
+}
+
+var dashboardArchive = &dashboardArchiveView{}
+
+// Set records the archive shown by the dashboard.
+func (v *dashboardArchiveView) Set(sh Shipper, tables []Table, targets []ShipTarget) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sh, v.tables, v.targets = sh, tables, targets
+	v.cached = nil
+}
+
+// Coverage returns the coverage of the most recent periods, or nil if no archive has been set.
+func (v *dashboardArchiveView) Coverage(ctx context.Context, periods int) (*DashboardCoverage, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sh == nil {
+		return nil, nil
+	}
+	if v.cached != nil && v.periods == periods && time.Since(v.cachedAt) < DefaultDashboardRefresh {
+		return v.cached, nil
+	}
+
+	tables := currentTableConfig(networkConfig.name).FilterTables(v.tables)
+	dc, err := dashboardCoverage(ctx, exportPeriodForHeight(CurrentHeight(networkConfig.genesisTs), networkConfig.genesisTs), periods, networkConfig.name, networkConfig.genesisTs, v.sh, storageConfig.schemaVersion, tables, v.targets)
+	if err != nil {
+		return nil, err
+	}
+	v.cached, v.cachedAt, v.periods = dc, time.Now(), periods
+	return dc, nil
+}
+
+// dashboardCoverage builds the coverage of each table for the given number of periods ending with last.
+func dashboardCoverage(ctx context.Context, last ExportPeriod, periods int, network string, genesisTs int64, sh Shipper, schemaVersion int, tables []Table, targets []ShipTarget) (*DashboardCoverage, error) {
+	var ps []ExportPeriod
+	for p := last; len(ps) < periods; p = exportPeriodForHeight(p.StartHeight-1, genesisTs) {
+		ps = append(ps, p)
+		if p.StartHeight == 0 {
+			break
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].StartHeight < ps[j].StartHeight })
+
+	dc := &DashboardCoverage{
+		Network:   network,
+		Generated: time.Now().UTC(),
+		Tables:    map[string][]string{},
+		Summary:   map[string]map[string]int{},
+	}
+	for _, t := range tables {
+		dc.Tables[t.Name] = make([]string, len(ps))
+	}
+
+	current := CurrentHeight(genesisTs)
+	for i, p := range ps {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		dc.Periods = append(dc.Periods, p.String())
+		dc.Summary[p.String()] = map[string]int{}
+
+		em, err := manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, tables, targets)
+		if err != nil {
+			return nil, err
+		}
+		files := map[string][]*ExportFile{}
+		for _, ef := range em.Files {
+			files[ef.TableName] = append(files[ef.TableName], ef)
+		}
+		for _, t := range tables {
+			status := tableFilesCoverage(files[t.Name])
+			if status == CoverageMissing && current <= p.EndHeight+ExportDelay {
+				status = CoveragePending
+			}
+			dc.Tables[t.Name][i] = status
+			dc.Summary[p.String()][status]++
+		}
+	}
+	return dc, nil
+}
+
+// tableFilesCoverage returns the coverage status of the files of a table for a period.
+func tableFilesCoverage(files []*ExportFile) string {
+	if len(files) == 0 {
+		return CoverageNotExpected
+	}
+	shipped := 0
+	for _, ef := range files {
+		if ef.Annotation != nil {
+			return CoverageKnownBad
+		}
+		if ef.Shipped {
+			shipped++
+		}
+	}
+	switch shipped {
+	case 0:
+		return CoverageMissing
+	case len(files):
+		return CoverageShipped
+	default:
+		return CoveragePartial
+	}
+}
+
+// handleDashboard serves the dashboard page.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// handleCoverage serves the coverage heatmap of the dashboard. The number of periods may be given by the periods query
+// parameter.
+func handleCoverage(w http.ResponseWriter, r *http.Request) {
+	periods := DefaultDashboardPeriods
+	if s := r.URL.Query().Get("periods"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > MaxDashboardPeriods {
+			http.Error(w, "periods must be a number from 1 to "+strconv.Itoa(MaxDashboardPeriods), http.StatusBadRequest)
+			return
+		}
+		periods = n
+	}
+
+	dc, err := dashboardArchive.Coverage(r.Context(), periods)
+	if err != nil {
+		logger.Errorw("failed to build dashboard coverage", "error", err)
+		http.Error(w, "failed to build coverage", http.StatusInternalServerError)
+		return
+	}
+	if dc == nil {
+		http.Error(w, "coverage is only available while exporting", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dc); err != nil {
+		logger.Errorw("failed to write dashboard coverage", "error", err)
+	}
+}
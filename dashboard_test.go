@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestErrorHistory(t *testing.T) {
+	h := &errorHistory{max: 2}
+	for _, day := range []int{1, 2, 3} {
+		h.Record(ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: day}}, errors.New("failed"))
+	}
+
+	var periods []string
+	for _, e := range h.List() {
+		periods = append(periods, e.Period)
+	}
+	if want := []string{"2021-08-03", "2021-08-02"}; !reflect.DeepEqual(periods, want) {
+		t.Errorf("got errors for %v, wanted %v", periods, want)
+	}
+}
+
+func TestDashboardCoverage(t *testing.T) {
+	defer func(name string, s int) { networkConfig.name, storageConfig.schemaVersion = name, s }(networkConfig.name, storageConfig.schemaVersion)
+	networkConfig.name, storageConfig.schemaVersion = "mainnet", 1
+
+	ctx := context.Background()
+	sh := &fileShipper{root: t.TempDir()}
+	tables := []Table{TablesByName["chain_consensus"], TablesByName["block_headers"]}
+	targets := []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}}
+
+	last := exportPeriodForHeight(1005360, MainnetGenesisTs)
+	shipped := exportPeriodForHeight(last.StartHeight-1, MainnetGenesisTs)
+	em, err := manifestForPeriod(ctx, shipped, "mainnet", MainnetGenesisTs, sh, 1, tables[:1], targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.Write(ctx, em.Files[0].Path(), []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := dashboardCoverage(ctx, last, 3, "mainnet", MainnetGenesisTs, sh, 1, tables, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2021-08-07", "2021-08-08", "2021-08-09"}; !reflect.DeepEqual(dc.Periods, want) {
+		t.Errorf("got periods %v, wanted %v", dc.Periods, want)
+	}
+	want := map[string][]string{
+		"chain_consensus": {CoverageMissing, CoverageShipped, CoverageMissing},
+		"block_headers":   {CoverageMissing, CoverageMissing, CoverageMissing},
+	}
+	if !reflect.DeepEqual(dc.Tables, want) {
+		t.Errorf("got coverage %v, wanted %v", dc.Tables, want)
+	}
+	if got := dc.Summary["2021-08-08"]; got[CoverageShipped] != 1 || got[CoverageMissing] != 1 {
+		t.Errorf("got summary %v for 2021-08-08", got)
+	}
+}
+
+func TestDashboardHandlers(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleDashboard(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<html") {
+		t.Errorf("got status %d serving the dashboard", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleDashboard(rec, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown path, wanted %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec = httptest.NewRecorder()
+	handleCoverage(rec, httptest.NewRequest(http.MethodGet, "/coverage?periods=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid number of periods, wanted %d", rec.Code, http.StatusBadRequest)
+	}
+}
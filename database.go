@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/filecoin-project/lily/model/visor"
+	"github.com/go-pg/pg/v10"
+)
+
+// ProcessingReportsTable is the name of the table lily uses to record the outcome of processing each height
+const ProcessingReportsTable = "visor_processing_reports"
+
+// databaseExportIsCompleted copies the rows for the period from an existing lily database into files named and
+// formatted like the output of a walk, so that they can be verified and shipped in the same way. The processing
+// reports are copied along with the tables, keeping only the latest report for each height and task so that heights
+// that were reprocessed after an error are verified using their final outcome.
+// note: walkInfo is an out parameter
+func databaseExportIsCompleted(em *ExportManifest, walkInfo *WalkInfo, ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		walkName, err := unusedWalkName(storageConfig.path, em.Period.String())
+		if err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorf("failed to create walk name: %v", err)
+			return false, nil
+		}
+
+		opt, err := pg.ParseURL(jobConfig.databaseURL)
+		if err != nil {
+			return false, fmt.Errorf("parse database url: %w", err)
+		}
+		db := pg.Connect(opt).WithContext(ctx)
+		defer db.Close()
+
+		wi := WalkInfo{
+			Name:   walkName,
+			Path:   storageConfig.path,
+			Format: "csv",
+		}
+
+		// The consensus table is always needed for verification, even when it is not being shipped
+		tables := []string{"chain_consensus"}
+		seen := map[string]bool{"chain_consensus": true}
+		for _, ef := range em.Files {
+			if !ef.NeedsShipping() || seen[ef.TableName] {
+				continue
+			}
+			seen[ef.TableName] = true
+			tables = append(tables, ef.TableName)
+		}
+
+		ll.Infow("copying tables from database", "walk", walkName, "tables", len(tables))
+		if err := copyTableFromDatabase(ctx, db, ProcessingReportsTable, em.Period.StartHeight, em.Period.EndHeight, wi.WalkFile(ProcessingReportsTable)); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw("failed to copy processing reports from database", "error", err, "walk", walkName)
+			return false, nil
+		}
+		for _, table := range tables {
+			if err := copyTableFromDatabase(ctx, db, table, em.Period.StartHeight, em.Period.EndHeight, wi.WalkFile(table)); err != nil {
+				walkErrorsCounter.Inc()
+				ll.Errorw("failed to copy table from database", "error", err, "table", table, "walk", walkName)
+				return false, nil
+			}
+		}
+		ll.Infow("database copy complete", "walk", walkName)
+
+		if err := touchExportFiles(ctx, em, wi); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed to touch export files: %v", err), "walk", walkName)
+			return false, nil
+		}
+
+		*walkInfo = wi
+		return true, nil
+	}
+}
+
+// copyTableFromDatabase writes the rows of a table between the heights, inclusive, to outFile as csv.
+func copyTableFromDatabase(ctx context.Context, db *pg.DB, table string, from, to int64, outFile string) error {
+	query, err := databaseCopyQuery(jobConfig.databaseSchema, table, from, to)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(outFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DefaultFilePerms)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	if _, err := db.CopyTo(f, query); err != nil {
+		f.Close()
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return nil
+}
+
+// databaseCopyQuery returns a COPY statement that writes the rows of a table between the heights as csv in the same
+// column order and format as lily's csv storage.
+func databaseCopyQuery(schema, table string, from, to int64) (string, error) {
+	var model interface{}
+	if table == ProcessingReportsTable {
+		model = &visor.ProcessingReport{}
+	} else {
+		t, ok := TablesByName[table]
+		if !ok {
+			return "", fmt.Errorf("unknown table %q", table)
+		}
+		model = t.Model
+	}
+
+	td, err := TableDescriptorFor(Table{Name: table, Model: model}, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var columns []string
+	hasHeight := false
+	for _, c := range td.Columns {
+		if c.Name == "height" {
+			hasHeight = true
+		}
+		columns = append(columns, databaseColumnExpr(c.Name, c.Type))
+	}
+	if !hasHeight {
+		return "", fmt.Errorf("table %q has no height column", table)
+	}
+
+	name := pgIdent(schema) + "." + pgIdent(table)
+	sel := fmt.Sprintf("SELECT %s FROM %s WHERE height BETWEEN %d AND %d ORDER BY height", strings.Join(columns, ", "), name, from, to)
+	if table == ProcessingReportsTable {
+		sel = fmt.Sprintf("SELECT DISTINCT ON (height, task) %s FROM %s WHERE height BETWEEN %d AND %d ORDER BY height, task, completed_at DESC", strings.Join(columns, ", "), name, from, to)
+	}
+	return fmt.Sprintf("COPY (%s) TO STDOUT WITH (FORMAT csv, NULL 'NULL')", sel), nil
+}
+
+// databaseColumnExpr returns the expression used to select a column so that its text matches lily's csv storage.
+// Booleans are written as true or false and timestamps in UTC with millisecond precision and trailing zeros removed.
+func databaseColumnExpr(name, sqlType string) string {
+	col := pgIdent(name)
+	switch strings.ToLower(sqlType) {
+	case "boolean", "bool":
+		return col + "::text"
+	case "timestamptz", "timestamp with time zone":
+		return fmt.Sprintf(`rtrim(rtrim(to_char(%s AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS'), '0'), '.') || 'Z'`, col)
+	default:
+		return col
+	}
+}
+
+// pgIdent quotes a Postgres identifier.
+func pgIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDatabaseColumnExpr(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sqlType string
+		want    string
+	}{
+		{name: "height", sqlType: "bigint", want: `"height"`},
+		{name: "is_string", sqlType: "boolean", want: `"is_string"::text`},
+		{name: "started_at", sqlType: "timestamptz", want: `rtrim(rtrim(to_char("started_at" AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS'), '0'), '.') || 'Z'`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := databaseColumnExpr(tc.name, tc.sqlType); got != tc.want {
+				t.Errorf("got %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDatabaseCopyQuery(t *testing.T) {
+	q, err := databaseCopyQuery("lily", "chain_consensus", 100, 199)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `COPY (SELECT "height", "parent_state_root", "parent_tip_set", "tip_set" FROM "lily"."chain_consensus" WHERE height BETWEEN 100 AND 199 ORDER BY height) TO STDOUT WITH (FORMAT csv, NULL 'NULL')`
+	if q != want {
+		t.Errorf("got %s, wanted %s", q, want)
+	}
+
+	q, err = databaseCopyQuery("lily", ProcessingReportsTable, 100, 199)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(q, "SELECT DISTINCT ON (height, task)") || !strings.Contains(q, "ORDER BY height, task, completed_at DESC") {
+		t.Errorf("processing reports query does not keep the latest report for each height and task: %s", q)
+	}
+
+	if _, err := databaseCopyQuery("lily", "no_such_table", 100, 199); err == nil {
+		t.Errorf("expected error for unknown table")
+	}
+}
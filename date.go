@@ -66,3 +66,25 @@ func DateFromString(s string) (Date, error) {
 func Today() Date {
 	return DateFromTime(time.Now())
 }
+
+// MarshalText implements encoding.TextMarshaler using the YYYY-MM-DD format.
+func (d Date) MarshalText() ([]byte, error) {
+	if d.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using the YYYY-MM-DD format.
+func (d *Date) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Date{}
+		return nil
+	}
+	v, err := DateFromString(string(text))
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/v5/actors/builtin"
+	blockservice "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipld/go-car"
+)
+
+// DefaultDealDays is the default duration of storage deals in days, the minimum allowed by the network.
+const DefaultDealDays = 180
+
+// DefaultDealDuration is the default duration of storage deals in mainnet epochs.
+const DefaultDealDuration = int64(DefaultDealDays * builtin.EpochsInDay)
+
+// PeriodArchive describes the CAR file that a period's shipped files were packaged into for storage deals.
+type PeriodArchive struct {
+	Root      string    `json:"root"` // root of the unixfs directory holding the files, laid out as in the ship path
+	Size      int64     `json:"size"` // size of the CAR file
+	Files     int       `json:"files"`
+	PieceCID  string    `json:"piece_cid"`
+	PieceSize uint64    `json:"piece_size"` // padded size of the piece
+	Created   time.Time `json:"created"`
+}
+
+// PeriodManifestDeal describes a storage deal proposed for a period's archive.
+type PeriodManifestDeal struct {
+	Provider    string    `json:"provider"`
+	ProposalCID string    `json:"proposal_cid"`
+	DealID      uint64    `json:"deal_id,omitempty"` // set once the deal has been published on chain
+	State       string    `json:"state"`
+	Message     string    `json:"message,omitempty"`
+	Proposed    time.Time `json:"proposed"`
+}
+
+// dealFailed reports whether a deal in the named state will never hold the archive, so another should be proposed.
+func dealFailed(state string) bool {
+	switch state {
+	case storagemarket.DealStates[storagemarket.StorageDealError],
+		storagemarket.DealStates[storagemarket.StorageDealSlashed],
+		storagemarket.DealStates[storagemarket.StorageDealExpired]:
+		return true
+	}
+	return false
+}
+
+// settled reports whether a deal no longer needs to be tracked, either because it is active on chain or because
+// it has failed.
+func (d *PeriodManifestDeal) settled() bool {
+	if dealFailed(d.State) {
+		return true
+	}
+	return d.State == storagemarket.DealStates[storagemarket.StorageDealActive] && d.DealID != 0
+}
+
+// providersNeedingDeals returns the providers that have no deal for the archive in the manifest other than failed ones.
+func providersNeedingDeals(pm *PeriodManifest, providers []string) []string {
+	covered := map[string]bool{}
+	for _, d := range pm.Deals {
+		if !dealFailed(d.State) {
+			covered[d.Provider] = true
+		}
+	}
+
+	var needed []string
+	for _, p := range providers {
+		if !covered[p] {
+			needed = append(needed, p)
+		}
+	}
+	return needed
+}
+
+// configureDeals parses the storage deal flags.
+func configureDeals() error {
+	dealsConfig.providers = nil
+	for _, provider := range strings.Split(dealsConfig.providerList, ",") {
+		if provider = strings.TrimSpace(provider); provider == "" {
+			continue
+		}
+		if _, err := address.NewFromString(provider); err != nil {
+			return fmt.Errorf("invalid provider address %q: %w", provider, err)
+		}
+		dealsConfig.providers = append(dealsConfig.providers, provider)
+	}
+	if len(dealsConfig.providers) == 0 {
+		return nil
+	}
+
+	if dealsConfig.lotusAddr == "" {
+		return fmt.Errorf("storage deals require a lotus api address")
+	}
+	if dealsConfig.carPath == "" {
+		return fmt.Errorf("storage deals require a car path")
+	}
+
+	dealsConfig.wallet = address.Undef
+	if dealsConfig.walletAddr != "" {
+		var err error
+		dealsConfig.wallet, err = address.NewFromString(dealsConfig.walletAddr)
+		if err != nil {
+			return fmt.Errorf("invalid wallet address: %w", err)
+		}
+	}
+
+	price, err := types.ParseFIL(dealsConfig.priceFIL)
+	if err != nil {
+		return fmt.Errorf("invalid deal price: %w", err)
+	}
+	dealsConfig.price = types.BigInt(price)
+
+	if dealsConfig.duration <= 0 {
+		return fmt.Errorf("deal duration must be positive")
+	}
+	return nil
+}
+
+// periodArchivePath returns the path that the CAR file of a period's archive is written to.
+func periodArchivePath(network string, p ExportPeriod) string {
+	return filepath.Join(dealsConfig.carPath, network, p.String()+".car")
+}
+
+// makePeriodDeals packages the files shipped for a period into a CAR file, imports it into lotus and proposes a
+// storage deal with each configured provider that does not yet hold one. The archive and the proposed deals are
+// recorded in the period manifest. Periods with no manifest have shipped nothing and are skipped.
+func makePeriodDeals(ctx context.Context, p ExportPeriod, network string, sh Shipper) error {
+	shipRoot, ok := localShipPath(sh)
+	if !ok {
+		return fmt.Errorf("storage deals require a filesystem ship path")
+	}
+	ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight)
+
+	path := periodManifestPath(network, p)
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		return fmt.Errorf("decode manifest: %w", err)
+	}
+
+	providers := providersNeedingDeals(pm, dealsConfig.providers)
+	if len(providers) == 0 || len(pm.Files) == 0 {
+		return nil
+	}
+
+	api, closer, err := getLotusAPI(ctx, dealsConfig.lotusAddr, dealsConfig.lotusToken)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	// The archive is packaged again if its CAR file has been removed since it was first made. Packaging is
+	// deterministic, so the root only changes if more files have been shipped for the period since.
+	archive := pm.Archive
+	carFile := periodArchivePath(network, p)
+	if _, err := os.Stat(carFile); archive == nil || err != nil {
+		var files []string
+		for _, f := range pm.Files {
+			files = append(files, filepath.FromSlash(f.Path))
+		}
+
+		ll.Infow("packaging period into car file", "files", len(files), "car", carFile)
+		root, size, err := packageFilesAsCAR(ctx, shipRoot, files, carFile)
+		if err != nil {
+			return fmt.Errorf("package car: %w", err)
+		}
+
+		res, err := api.ClientImport(ctx, lotusapi.FileRef{Path: carFile, IsCAR: true})
+		if err != nil {
+			return fmt.Errorf("import car: %w", err)
+		}
+		if !res.Root.Equals(root) {
+			return fmt.Errorf("lotus imported car with root %s, expected %s", res.Root, root)
+		}
+
+		piece, err := api.ClientDealPieceCID(ctx, root)
+		if err != nil {
+			return fmt.Errorf("compute piece cid: %w", err)
+		}
+
+		archive = &PeriodArchive{
+			Root:      root.String(),
+			Size:      size,
+			Files:     len(files),
+			PieceCID:  piece.PieceCID.String(),
+			PieceSize: uint64(piece.PieceSize),
+			Created:   time.Now().UTC(),
+		}
+	}
+
+	root, err := cid.Decode(archive.Root)
+	if err != nil {
+		return fmt.Errorf("archive root: %w", err)
+	}
+
+	wallet := dealsConfig.wallet
+	if wallet == address.Undef {
+		wallet, err = api.WalletDefaultAddress(ctx)
+		if err != nil {
+			return fmt.Errorf("default wallet address: %w", err)
+		}
+	}
+
+	// The price is given per GiB so the price of each epoch depends on the size of the piece
+	epochPrice := types.BigDiv(types.BigMul(dealsConfig.price, types.NewInt(archive.PieceSize)), types.NewInt(1<<30))
+
+	var deals []*PeriodManifestDeal
+	var proposeErr error
+	for _, provider := range providers {
+		miner, err := address.NewFromString(provider)
+		if err != nil {
+			return fmt.Errorf("provider address %q: %w", provider, err)
+		}
+
+		proposal, err := api.ClientStartDeal(ctx, &lotusapi.StartDealParams{
+			Data: &storagemarket.DataRef{
+				TransferType: storagemarket.TTGraphsync,
+				Root:         root,
+			},
+			Wallet:            wallet,
+			Miner:             miner,
+			EpochPrice:        epochPrice,
+			MinBlocksDuration: uint64(dealsConfig.duration),
+			DealStartEpoch:    -1,
+			FastRetrieval:     dealsConfig.fastRetrieval,
+			VerifiedDeal:      dealsConfig.verified,
+		})
+		if err != nil {
+			ll.Errorw("failed to propose storage deal", "error", err, "provider", provider)
+			proposeErr = fmt.Errorf("propose deal to %s: %w", provider, err)
+			continue
+		}
+		storageDealsCounter.Inc()
+		ll.Infow("proposed storage deal", "provider", provider, "proposal", proposal.String(), "root", archive.Root)
+
+		deals = append(deals, &PeriodManifestDeal{
+			Provider:    provider,
+			ProposalCID: proposal.String(),
+			State:       storagemarket.DealStates[storagemarket.StorageDealUnknown],
+			Proposed:    time.Now().UTC(),
+		})
+	}
+
+	if err := updatePeriodManifest(ctx, path, sh, func(pm *PeriodManifest) error {
+		pm.Archive = archive
+		pm.Deals = append(pm.Deals, deals...)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	return proposeErr
+}
+
+// dagDir is a directory being assembled from the nodes of the files and directories within it.
+type dagDir struct {
+	files map[string]ipld.Node
+	dirs  map[string]*dagDir
+}
+
+func newDAGDir() *dagDir {
+	return &dagDir{files: map[string]ipld.Node{}, dirs: map[string]*dagDir{}}
+}
+
+// add places a file node at a slash separated path below the directory.
+func (d *dagDir) add(path string, nd ipld.Node) {
+	parts := strings.Split(path, "/")
+	for _, name := range parts[:len(parts)-1] {
+		sub, ok := d.dirs[name]
+		if !ok {
+			sub = newDAGDir()
+			d.dirs[name] = sub
+		}
+		d = sub
+	}
+	d.files[parts[len(parts)-1]] = nd
+}
+
+// node builds the unixfs directory node, adding it and the nodes of its subdirectories to the dag service.
+func (d *dagDir) node(ctx context.Context, dag ipld.DAGService) (ipld.Node, error) {
+	dir := uio.NewDirectory(dag)
+	dir.SetCidBuilder(merkledag.V1CidPrefix())
+
+	names := make([]string, 0, len(d.dirs))
+	for name := range d.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nd, err := d.dirs[name].node(ctx, dag)
+		if err != nil {
+			return nil, err
+		}
+		if err := dir.AddChild(ctx, name, nd); err != nil {
+			return nil, err
+		}
+	}
+
+	names = names[:0]
+	for name := range d.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := dir.AddChild(ctx, name, d.files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	if err := dag.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// packageFilesAsCAR builds a unixfs directory holding the named files, laid out by their paths relative to root, and
+// writes it to carFile as a CARv1. Files are added as CIDv1 with raw leaves, as when shipping to IPFS, so each file's
+// root matches the one it was given on IPFS. Blocks are held in a temporary datastore next to the CAR file while it is
+// written. It returns the root of the directory and the size of the CAR file.
+func packageFilesAsCAR(ctx context.Context, root string, files []string, carFile string) (cid.Cid, int64, error) {
+	dir := filepath.Dir(carFile)
+	if err := os.MkdirAll(dir, DefaultDirPerms); err != nil {
+		return cid.Undef, 0, fmt.Errorf("mkdir %q: %w", dir, err)
+	}
+
+	blocksDir, err := os.MkdirTemp(dir, "."+filepath.Base(carFile)+".blocks.*")
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("create block directory: %w", err)
+	}
+	defer os.RemoveAll(blocksDir)
+
+	ds, err := leveldb.NewDatastore(blocksDir, nil)
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("open block datastore: %w", err)
+	}
+	defer ds.Close()
+
+	bs := blockstore.NewBlockstore(ds)
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	top := newDAGDir()
+	for _, rel := range files {
+		nd, err := addFileToDAG(ctx, dag, filepath.Join(root, rel))
+		if err != nil {
+			return cid.Undef, 0, fmt.Errorf("add %s: %w", rel, err)
+		}
+		top.add(filepath.ToSlash(rel), nd)
+	}
+	rootNode, err := top.node(ctx, dag)
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("build directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(carFile)+".*.tmp")
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	cw := NewChecksumWriter(tmp)
+	if err := car.WriteCar(ctx, dag, []cid.Cid{rootNode.Cid()}, cw); err != nil {
+		tmp.Close()
+		return cid.Undef, 0, fmt.Errorf("write car: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return cid.Undef, 0, fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		return cid.Undef, 0, fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), carFile); err != nil {
+		return cid.Undef, 0, fmt.Errorf("rename: %w", err)
+	}
+	return rootNode.Cid(), cw.Size(), nil
+}
+
+// addFileToDAG adds a file to the dag service as a balanced unixfs file.
+func addFileToDAG(ctx context.Context, dag ipld.DAGService, path string) (ipld.Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	params := helpers.DagBuilderParams{
+		Dagserv:    dag,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		RawLeaves:  true,
+		CidBuilder: merkledag.V1CidPrefix(),
+	}
+	db, err := params.New(chunker.NewSizeSplitter(&contextReader{ctx: ctx, r: f}, chunker.DefaultBlockSize))
+	if err != nil {
+		return nil, err
+	}
+	return balanced.Layout(db)
+}
+
+// DealTracker follows the storage deals recorded in the period manifests of a ship path, recording their state and
+// deal ID as they are published and activated on chain.
+type DealTracker struct {
+	ShipPath string
+	Network  string
+}
+
+// Update queries lotus for the state of every deal that has not yet settled and records any changes in the period
+// manifests. It returns the number of deals whose state changed.
+func (t *DealTracker) Update(ctx context.Context) (int, error) {
+	manifests, err := filepath.Glob(filepath.Join(t.ShipPath, t.Network, ManifestDir, "*", "*.json"))
+	if err != nil {
+		return 0, fmt.Errorf("list manifests: %w", err)
+	}
+
+	var api lotusapi.FullNode
+	sh := &fileShipper{root: t.ShipPath}
+	changed := 0
+	for _, path := range manifests {
+		if ctx.Err() != nil {
+			return changed, ctx.Err()
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return changed, fmt.Errorf("read manifest: %w", err)
+		}
+		pm := &PeriodManifest{}
+		if err := json.Unmarshal(data, pm); err != nil {
+			logger.Errorw("failed to decode manifest", "error", err, "manifest", path)
+			continue
+		}
+
+		updates := map[string]*lotusapi.DealInfo{}
+		for _, d := range pm.Deals {
+			if d.settled() {
+				continue
+			}
+			if api == nil {
+				var closer closerFunc
+				api, closer, err = getLotusAPI(ctx, dealsConfig.lotusAddr, dealsConfig.lotusToken)
+				if err != nil {
+					return changed, err
+				}
+				defer closer()
+			}
+
+			proposal, err := cid.Decode(d.ProposalCID)
+			if err != nil {
+				logger.Errorw("invalid deal proposal cid", "error", err, "manifest", path, "proposal", d.ProposalCID)
+				continue
+			}
+			info, err := api.ClientGetDealInfo(ctx, proposal)
+			if err != nil {
+				logger.Errorw("failed to get deal info", "error", err, "proposal", d.ProposalCID)
+				continue
+			}
+			if storagemarket.DealStates[info.State] != d.State || uint64(info.DealID) != d.DealID {
+				updates[d.ProposalCID] = info
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+
+		rel, err := filepath.Rel(t.ShipPath, path)
+		if err != nil {
+			return changed, err
+		}
+		if err := updatePeriodManifest(ctx, rel, sh, func(pm *PeriodManifest) error {
+			for _, d := range pm.Deals {
+				info, ok := updates[d.ProposalCID]
+				if !ok {
+					continue
+				}
+				d.State = storagemarket.DealStates[info.State]
+				d.DealID = uint64(info.DealID)
+				d.Message = info.Message
+				logger.Infow("storage deal updated", "provider", d.Provider, "proposal", d.ProposalCID, "state", d.State, "deal_id", d.DealID)
+			}
+			return nil
+		}); err != nil {
+			return changed, fmt.Errorf("write manifest: %w", err)
+		}
+		changed += len(updates)
+	}
+	return changed, nil
+}
+
+// Repropose proposes new deals for archives whose deals with any of the configured providers have failed.
+func (t *DealTracker) Repropose(ctx context.Context) error {
+	manifests, err := filepath.Glob(filepath.Join(t.ShipPath, t.Network, ManifestDir, "*", "*.json"))
+	if err != nil {
+		return fmt.Errorf("list manifests: %w", err)
+	}
+
+	sh := &fileShipper{root: t.ShipPath}
+	for _, path := range manifests {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+		pm := &PeriodManifest{}
+		if err := json.Unmarshal(data, pm); err != nil {
+			continue
+		}
+		// Periods without an archive have not yet been processed for deals by the export loop
+		if pm.Archive == nil || len(providersNeedingDeals(pm, dealsConfig.providers)) == 0 {
+			continue
+		}
+
+		p := ExportPeriod{Date: pm.Date, Hour: pm.Hour, StartHeight: pm.StartHeight, EndHeight: pm.EndHeight, Ranged: pm.Ranged}
+		if err := makePeriodDeals(ctx, p, t.Network, sh); err != nil {
+			logger.Errorw("failed to repropose storage deals", "error", err, "date", p.Date.String())
+		}
+	}
+	return nil
+}
+
+// Run updates the state of tracked deals every interval, proposing new deals in place of failed ones, until the
+// context is cancelled.
+func (t *DealTracker) Run(ctx context.Context, interval time.Duration) {
+	update := func(ctx context.Context) (bool, error) {
+		changed, err := t.Update(ctx)
+		if err != nil {
+			logger.Errorw("failed to update storage deals", "error", err)
+			return false, nil
+		}
+		logger.Debugw("storage deals updated", "changed", changed)
+
+		if err := t.Repropose(ctx); err != nil {
+			logger.Errorw("failed to repropose storage deals", "error", err)
+		}
+		return false, nil
+	}
+
+	if err := WaitUntil(ctx, update, 0, interval); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Errorw("deal tracker stopped", "error", err)
+	}
+}
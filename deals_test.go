@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/ipld/go-car"
+)
+
+func TestProvidersNeedingDeals(t *testing.T) {
+	pm := &PeriodManifest{
+		Deals: []*PeriodManifestDeal{
+			{Provider: "f01000", State: storagemarket.DealStates[storagemarket.StorageDealActive]},
+			{Provider: "f02000", State: storagemarket.DealStates[storagemarket.StorageDealError]},
+			{Provider: "f03000", State: storagemarket.DealStates[storagemarket.StorageDealError]},
+			{Provider: "f03000", State: storagemarket.DealStates[storagemarket.StorageDealUnknown]},
+		},
+	}
+
+	got := providersNeedingDeals(pm, []string{"f01000", "f02000", "f03000", "f04000"})
+	if want := []string{"f02000", "f04000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestPackageFilesAsCAR(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		filepath.Join("mainnet", "csv", "1", "messages", "2022", "messages-2022-06-01.csv.gz"),
+		filepath.Join("mainnet", "csv", "1", "receipts", "2022", "receipts-2022-06-01.csv.gz"),
+	}
+	for i, rel := range files {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.WriteFile(path, []byte{byte(i), 1, 2, 3}, 0o644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	out := t.TempDir()
+	first, size, err := packageFilesAsCAR(ctx, root, files, filepath.Join(out, "a.car"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, _, err := packageFilesAsCAR(ctx, root, files, filepath.Join(out, "b.car"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !first.Equals(second) {
+		t.Errorf("got root %s on second packaging, wanted %s", second, first)
+	}
+
+	f, err := os.Open(filepath.Join(out, "a.car"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("got size %d, wanted %d", size, info.Size())
+	}
+
+	h, err := car.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(h.Roots) != 1 || !h.Roots[0].Equals(first) {
+		t.Errorf("got roots %v, wanted [%s]", h.Roots, first)
+	}
+}
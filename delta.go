@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// DeltaSuffix is appended to the name of a table to give the name that its delta files are shipped under.
+const DeltaSuffix = "_delta"
+
+// configureDeltas parses the list of tables that delta files are shipped for and checks that the rows of each can be
+// compared between periods.
+func configureDeltas() error {
+	shippingConfig.deltaTableSet = map[string]bool{}
+	for _, name := range strings.Split(shippingConfig.deltaTables, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := TablesByName[name]; !ok {
+			return fmt.Errorf("unknown table %q", name)
+		}
+		if isShardedTable(name) {
+			return fmt.Errorf("table %s is sharded, delta files cannot be shipped for it", name)
+		}
+		layout, err := deltaLayoutForTable(name)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+		if layout.heightColumn < 0 || len(layout.keyColumns) == 0 {
+			return fmt.Errorf("table %s has no height column or no key columns other than its height", name)
+		}
+		shippingConfig.deltaTableSet[name] = true
+	}
+	return nil
+}
+
+// isDeltaTable reports whether delta files are shipped for a table.
+func isDeltaTable(name string) bool {
+	return shippingConfig.deltaTableSet[name]
+}
+
+// deltaBaseTable returns the table that a delta table's rows are taken from, or the name itself if it is not a delta
+// table.
+func deltaBaseTable(name string) string {
+	if base := strings.TrimSuffix(name, DeltaSuffix); base != name {
+		if _, ok := TablesByName[base]; ok {
+			return base
+		}
+	}
+	return name
+}
+
+// deltaLayout locates the columns of a table used to compare its rows between periods. A row's key is its primary key
+// without the height and state root, and its state is every other column except the height and state root, which
+// change from one tipset to the next even when the actor's state does not.
+type deltaLayout struct {
+	heightColumn int
+	keyColumns   []int
+	skipColumns  map[int]bool // columns left out of the row's state
+}
+
+func deltaLayoutForTable(name string) (deltaLayout, error) {
+	layout := deltaLayout{heightColumn: -1, skipColumns: map[int]bool{}}
+
+	headers, err := TableHeaders(TablesByName[name].Model)
+	if err != nil {
+		return layout, fmt.Errorf("table headers: %w", err)
+	}
+	rl, err := rowLayoutForTable(name)
+	if err != nil {
+		return layout, err
+	}
+
+	layout.heightColumn = rl.heightColumn
+	for i, h := range headers {
+		if h == "height" || h == "state_root" {
+			layout.skipColumns[i] = true
+		}
+	}
+	for _, i := range rl.keyColumns {
+		if !layout.skipColumns[i] {
+			layout.keyColumns = append(layout.keyColumns, i)
+		}
+	}
+	return layout, nil
+}
+
+// key returns the key of a row.
+func (l deltaLayout) key(rec []string) string {
+	parts := make([]string, 0, len(l.keyColumns))
+	for _, i := range l.keyColumns {
+		if i < len(rec) {
+			parts = append(parts, rec[i])
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// state returns a digest of the state held by a row.
+func (l deltaLayout) state(rec []string) [sha256.Size]byte {
+	h := sha256.New()
+	for i, v := range rec {
+		if l.skipColumns[i] {
+			continue
+		}
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// deltaBase is the state of a key at the last height it appears at in a period.
+type deltaBase struct {
+	height int64
+	state  [sha256.Size]byte
+}
+
+// readDeltaBase reads the latest state of each key in the csv rows of a period.
+func readDeltaBase(r io.Reader, layout deltaLayout) (map[string]deltaBase, error) {
+	base := map[string]deltaBase{}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return base, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		if layout.heightColumn >= len(rec) {
+			return nil, fmt.Errorf("row has too few columns")
+		}
+		height, err := strconv.ParseInt(rec[layout.heightColumn], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed height: %w", err)
+		}
+		key := layout.key(rec)
+		if b, ok := base[key]; ok && b.height > height {
+			continue
+		}
+		base[key] = deltaBase{height: height, state: layout.state(rec)}
+	}
+}
+
+// writeDeltaRows writes the csv rows read from r whose state differs from the latest state of their key in the base,
+// including rows of keys that are not in the base. It returns the number of rows written.
+func writeDeltaRows(r io.Reader, w io.Writer, layout deltaLayout, base map[string]deltaBase) (int64, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cw := csv.NewWriter(w)
+	var rows int64
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rows, fmt.Errorf("read: %w", err)
+		}
+		if b, ok := base[layout.key(rec)]; ok && b.state == layout.state(rec) {
+			continue
+		}
+		if err := cw.Write(rec); err != nil {
+			return rows, fmt.Errorf("write: %w", err)
+		}
+		rows++
+	}
+	cw.Flush()
+	return rows, cw.Error()
+}
+
+// deltaExportFile returns the delta file shipped alongside a table's file.
+func deltaExportFile(ef *ExportFile) *ExportFile {
+	return &ExportFile{
+		Date:        ef.Date,
+		Hour:        ef.Hour,
+		Length:      ef.Length,
+		StartHeight: ef.StartHeight,
+		EndHeight:   ef.EndHeight,
+		Ranged:      ef.Ranged,
+		Schema:      ef.Schema,
+		Network:     ef.Network,
+		TableName:   ef.TableName + DeltaSuffix,
+		Format:      ef.Format,
+		Compression: ef.Compression,
+		Cid:         cid.Undef,
+		IPFSCid:     cid.Undef,
+	}
+}
+
+// previousPeriodFile returns the file of the same table, format and compression for the period before the file's.
+func previousPeriodFile(ef *ExportFile, genesisTs int64) *ExportFile {
+	p := exportPeriodForHeight(ef.StartHeight-1, genesisTs)
+	return &ExportFile{
+		Date:        p.Date,
+		Hour:        p.Hour,
+		Length:      p.Length(),
+		StartHeight: p.StartHeight,
+		EndHeight:   p.EndHeight,
+		Ranged:      ef.Ranged,
+		Schema:      ef.Schema,
+		Network:     ef.Network,
+		TableName:   ef.TableName,
+		Format:      ef.Format,
+		Compression: ef.Compression,
+		Cid:         cid.Undef,
+		IPFSCid:     cid.Undef,
+	}
+}
+
+// shipDeltaFiles ships a delta file for each shipped file of a delta table, holding the rows whose state changed since
+// the previous period. Deltas are computed from the shipped files of both periods, so no delta is shipped when the
+// previous period's file has not been shipped. Only unencrypted csv files of final daily, hourly or weekly periods have
+// deltas. Failures are logged since the table's own file has already been shipped. The delta files shipped are
+// returned.
+func shipDeltaFiles(ctx context.Context, em *ExportManifest, shipped []*ExportFile, sh Shipper) []*ExportFile {
+	var deltas []*ExportFile
+	for _, ef := range shipped {
+		if !isDeltaTable(ef.TableName) || ef.Format != FormatCSV || ef.Encryption != "" || ef.Provisional || len(ef.Parts) > 0 || em.Period.Ranged || ef.StartHeight == 0 {
+			continue
+		}
+		ll := logger.With("table", ef.TableName, "date", ef.Date.String(), "compression", ef.Compression.Names[0])
+
+		def, err := shipDeltaFile(ctx, ef, sh)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				ll.Infow("previous period has not been shipped, not shipping delta file")
+				continue
+			}
+			ll.Errorw("failed to ship delta file", "error", err)
+			continue
+		}
+		ll.Infow("shipped delta file", "file", def.Path(), "rows", def.Rows)
+		recordShippedFileMetrics(ctx, def)
+		deltas = append(deltas, def)
+	}
+	return deltas
+}
+
+func shipDeltaFile(ctx context.Context, ef *ExportFile, sh Shipper) (*ExportFile, error) {
+	layout, err := deltaLayoutForTable(ef.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	prev, err := openShippedCSV(ctx, previousPeriodFile(ef, networkConfig.genesisTs), sh)
+	if err != nil {
+		return nil, err
+	}
+	base, err := readDeltaBase(prev, layout)
+	prev.Close()
+	if err != nil {
+		return nil, fmt.Errorf("previous period: %w", err)
+	}
+
+	cur, err := openShippedCSV(ctx, ef, sh)
+	if err != nil {
+		return nil, fmt.Errorf("shipped file: %w", err)
+	}
+	defer cur.Close()
+
+	stagingPath := shippingConfig.stagingPath
+	if stagingPath == "" {
+		if root, ok := localShipPath(sh); ok {
+			stagingPath = root
+		} else {
+			stagingPath = os.TempDir()
+		}
+	}
+	def := deltaExportFile(ef)
+	outFile := filepath.Join(stagingPath, def.Path())
+	if err := os.MkdirAll(filepath.Dir(outFile), DefaultDirPerms); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	// The changed rows are written out uncompressed so that they are compressed in the same way as any table file
+	rows, err := os.CreateTemp(filepath.Dir(outFile), "."+filepath.Base(outFile)+".*.csv")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(rows.Name())
+	_, err = writeDeltaRows(cur, rows, layout, base)
+	if cerr := rows.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write delta rows: %w", err)
+	}
+
+	seekIndex, err := compressExportFile(ctx, def, rows.Name(), outFile)
+	if err != nil {
+		return nil, err
+	}
+	def.Cid, err = rawCidFromSHA256(def.SHA256)
+	if err != nil {
+		os.Remove(outFile)
+		return nil, fmt.Errorf("cid: %w", err)
+	}
+	if err := retryUpload(ctx, outFile, func(ctx context.Context) error { return sh.Put(ctx, def.Path(), outFile) }); err != nil {
+		os.Remove(outFile)
+		return nil, fmt.Errorf("ship to %s: %w", sh, err)
+	}
+	if seekIndex != nil {
+		data, err := json.MarshalIndent(seekIndex, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("marshal seek index: %w", err)
+		}
+		if err := sh.Write(ctx, def.Path()+SeekIndexSuffix, data); err != nil {
+			return nil, fmt.Errorf("write seek index: %w", err)
+		}
+	}
+	if err := writeChecksumFile(ctx, sh, def.Path(), def.SHA256, def.Filename()); err != nil {
+		return nil, err
+	}
+	def.Shipped = true
+	return def, nil
+}
+
+// openShippedCSV returns a reader of the csv rows of a shipped file, without its provenance line.
+func openShippedCSV(ctx context.Context, ef *ExportFile, sh Shipper) (io.ReadCloser, error) {
+	data, err := sh.Read(ctx, ef.Path())
+	if err != nil {
+		return nil, err
+	}
+	zr, err := ef.Compression.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ef.Compression.Names[0], err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{skipCSVProvenance(zr), zr}, nil
+}
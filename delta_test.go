@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDeltaRows(t *testing.T) {
+	layout, err := deltaLayoutForTable("power_actor_claims")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := strings.Join([]string{
+		"100,f01000,s1,10,10",
+		"105,f01000,s2,20,20", // latest state of f01000
+		"101,f02000,s3,5,5",
+		"102,f03000,s4,7,7",
+	}, "\n") + "\n"
+	base, err := readDeltaBase(strings.NewReader(previous), layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := strings.Join([]string{
+		"200,f01000,s5,20,20", // unchanged apart from height and state root
+		"201,f02000,s6,6,6",   // changed
+		"202,f04000,s7,1,1",   // new miner
+		"203,f03000,s8,7,7",   // unchanged
+	}, "\n") + "\n"
+	var out bytes.Buffer
+	rows, err := writeDeltaRows(strings.NewReader(current), &out, layout, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "201,f02000,s6,6,6\n202,f04000,s7,1,1\n"; rows != 2 || out.String() != want {
+		t.Errorf("got %d delta rows %q, wanted %q", rows, out.String(), want)
+	}
+}
+
+func TestShipDeltaFiles(t *testing.T) {
+	defer func(name string, s int, ts int64) {
+		networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs = name, s, ts
+	}(networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs)
+	defer func(tables map[string]bool) { shippingConfig.deltaTableSet = tables }(shippingConfig.deltaTableSet)
+	networkConfig.name, storageConfig.schemaVersion, networkConfig.genesisTs = "mainnet", 1, MainnetGenesisTs
+	shippingConfig.deltaTableSet = map[string]bool{"power_actor_claims": true}
+
+	ctx := context.Background()
+	sh := &fileShipper{root: t.TempDir()}
+	gz := CompressionByName["gz"]
+
+	ship := func(ef *ExportFile, rows string) {
+		var buf bytes.Buffer
+		if _, err := gz.Compress(ef, strings.NewReader(rows), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := sh.Write(ctx, ef.Path(), buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		ef.Shipped = true
+	}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 9}, StartHeight: 1005360, EndHeight: 1008239}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	ef := &ExportFile{Date: p.Date, StartHeight: p.StartHeight, EndHeight: p.EndHeight, Schema: 1, Network: "mainnet", TableName: "power_actor_claims", Format: FormatCSV, Compression: gz}
+	ship(ef, "1005400,f01000,s5,20,20\n1005401,f02000,s6,6,6\n")
+
+	// No delta is shipped until the previous period has been shipped
+	if deltas := shipDeltaFiles(ctx, em, []*ExportFile{ef}, sh); len(deltas) != 0 {
+		t.Fatalf("got %d delta files without a previous period", len(deltas))
+	}
+
+	prev := previousPeriodFile(ef, networkConfig.genesisTs)
+	if prev.Date != (Date{Year: 2021, Month: 8, Day: 8}) || prev.EndHeight != p.StartHeight-1 {
+		t.Fatalf("unexpected previous period file %s", prev.Path())
+	}
+	ship(prev, "1005300,f01000,s1,20,20\n1005301,f02000,s3,5,5\n")
+
+	deltas := shipDeltaFiles(ctx, em, []*ExportFile{ef}, sh)
+	if len(deltas) != 1 {
+		t.Fatalf("got %d delta files, wanted 1", len(deltas))
+	}
+	def := deltas[0]
+	if def.TableName != "power_actor_claims_delta" || def.Rows != 1 || !def.Shipped {
+		t.Errorf("unexpected delta file %+v", def)
+	}
+
+	r, err := openShippedCSV(ctx, def, sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1005401,f02000,s6,6,6\n"; string(data) != want {
+		t.Errorf("got delta rows %q, wanted %q", data, want)
+	}
+	if _, err := sh.Stat(ctx, def.Path()+ChecksumSuffix); err != nil {
+		t.Errorf("checksum file was not written: %v", err)
+	}
+}
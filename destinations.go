@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults of the retry policy of an additional ship destination.
+const (
+	DefaultDestinationRetries      = 3
+	DefaultDestinationRetryBackoff = 10 * time.Second
+)
+
+// DestinationsConfig is read from the file given by --destinations-config. It names the destinations that every file
+// is shipped to in addition to the ship path.
+type DestinationsConfig struct {
+	Destinations map[string]*DestinationSpec `yaml:"destinations" toml:"destinations"`
+}
+
+// DestinationSpec describes a single additional destination.
+type DestinationSpec struct {
+	Path         string `yaml:"path" toml:"path"`                   // local path, or s3://bucket/prefix or gs://bucket/prefix object store location
+	Retries      *int   `yaml:"retries" toml:"retries"`             // attempts made after a failure to ship a file, 3 if not set
+	RetryBackoff string `yaml:"retry_backoff" toml:"retry_backoff"` // time waited before the first retry, doubling for each later one, 10s if not set
+	Required     bool   `yaml:"required" toml:"required"`           // files are not considered shipped until they reach the destination
+}
+
+// loadDestinationsConfig reads a destinations configuration file, decoding it as toml if its name ends in .toml and
+// yaml otherwise.
+func loadDestinationsConfig(path string) (*DestinationsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var dc DestinationsConfig
+	switch filepath.Ext(path) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &dc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	default:
+		if err := yaml.Unmarshal(data, &dc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if err := dc.Validate(); err != nil {
+		return nil, err
+	}
+	return &dc, nil
+}
+
+// Validate checks that every destination has a path and a valid retry policy.
+func (dc *DestinationsConfig) Validate() error {
+	for name, ds := range dc.Destinations {
+		if ds == nil || ds.Path == "" {
+			return fmt.Errorf("destination %s: missing path", name)
+		}
+		if ds.Retries != nil && *ds.Retries < 0 {
+			return fmt.Errorf("destination %s: retries must not be negative", name)
+		}
+		if ds.RetryBackoff != "" {
+			d, err := time.ParseDuration(ds.RetryBackoff)
+			if err != nil {
+				return fmt.Errorf("destination %s: invalid retry backoff: %w", name, err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("destination %s: retry backoff must be positive", name)
+			}
+		}
+	}
+	return nil
+}
+
+// shipDestination is an additional destination that files are shipped to, with its own retry policy.
+type shipDestination struct {
+	name     string
+	sh       Shipper
+	retries  int
+	backoff  time.Duration
+	required bool
+}
+
+// newShipDestinations creates the destinations described by the config, ordered by name.
+func newShipDestinations(dc *DestinationsConfig) ([]*shipDestination, error) {
+	var dests []*shipDestination
+	for name, ds := range dc.Destinations {
+		sh, err := newShipper(ds.Path)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", name, err)
+		}
+		d := &shipDestination{
+			name:     name,
+			sh:       sh,
+			retries:  DefaultDestinationRetries,
+			backoff:  DefaultDestinationRetryBackoff,
+			required: ds.Required,
+		}
+		if ds.Retries != nil {
+			d.retries = *ds.Retries
+		}
+		if ds.RetryBackoff != "" {
+			d.backoff, _ = time.ParseDuration(ds.RetryBackoff)
+		}
+		dests = append(dests, d)
+	}
+	sort.Slice(dests, func(a, b int) bool { return dests[a].name < dests[b].name })
+	return dests, nil
+}
+
+// try calls fn until it succeeds or the destination's retries are exhausted, waiting for the backoff between attempts.
+func (d *shipDestination) try(ctx context.Context, op string, path string, fn func() error) error {
+	backoff := d.backoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= d.retries || ctx.Err() != nil {
+			return err
+		}
+		logger.Infow("retrying shipping to destination", "destination", d.name, "op", op, "path", path, "error", err, "attempt", attempt+1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// shipDestinations are the additional destinations of the running command, empty if none are configured.
+var shipDestinations []*shipDestination
+
+// withShipDestinations wraps the shipper for the ship path so that files are also shipped to the configured
+// additional destinations. The shipper is returned unchanged if there are none.
+func withShipDestinations(sh Shipper) Shipper {
+	if len(shipDestinations) == 0 {
+		return sh
+	}
+	return &multiShipper{Shipper: sh, destinations: shipDestinations}
+}
+
+// multiShipper ships every file to the ship path and to each additional destination at the same time. Files are
+// read from the ship path alone, which remains the record of what has been shipped. A failure to ship to a
+// destination is retried according to its policy. Once its retries are exhausted the failure is only returned for a
+// required destination, other destinations are caught up later by syncDestinations.
+type multiShipper struct {
+	Shipper
+	destinations []*shipDestination
+}
+
+var _ Shipper = (*multiShipper)(nil)
+
+// Put ships the file to each destination from its own copy, since shipping consumes the file, and then to the ship
+// path.
+func (s *multiShipper) Put(ctx context.Context, path string, src string) error {
+	if err := s.each(ctx, "put", path, func(d *shipDestination) error {
+		tmp, err := tempNameFor(src)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+		if err := copyFile(src, tmp); err != nil {
+			return fmt.Errorf("copy: %w", err)
+		}
+		return d.sh.Put(ctx, path, tmp)
+	}); err != nil {
+		return err
+	}
+	return s.Shipper.Put(ctx, path, src)
+}
+
+// Write ships a small file to each destination and then to the ship path.
+func (s *multiShipper) Write(ctx context.Context, path string, data []byte) error {
+	if err := s.each(ctx, "write", path, func(d *shipDestination) error {
+		return d.sh.Write(ctx, path, data)
+	}); err != nil {
+		return err
+	}
+	return s.Shipper.Write(ctx, path, data)
+}
+
+// each calls fn for every destination concurrently, retrying each according to its policy, and returns the errors of
+// the required destinations that failed.
+func (s *multiShipper) each(ctx context.Context, op string, path string, fn func(d *shipDestination) error) error {
+	errs := make([]error, len(s.destinations))
+	var wg sync.WaitGroup
+	for i, d := range s.destinations {
+		wg.Add(1)
+		go func(i int, d *shipDestination) {
+			defer wg.Done()
+			errs[i] = d.try(ctx, op, path, func() error { return fn(d) })
+		}(i, d)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, d := range s.destinations {
+		if errs[i] == nil {
+			continue
+		}
+		recordDestinationFailure(ctx, d.name)
+		if !d.required {
+			logger.Errorw("failed to ship to destination, it will be caught up later", "destination", d.name, "path", path, "error", errs[i])
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", d.name, errs[i]))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("ship to required destinations: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Holding returns the names of the destinations that hold the file at path.
+func (s *multiShipper) Holding(ctx context.Context, path string) []string {
+	var names []string
+	for _, d := range s.destinations {
+		if _, err := d.sh.Stat(ctx, path); err == nil {
+			names = append(names, d.name)
+		}
+	}
+	return names
+}
+
+// shipDestinationsHolding returns the names of the additional destinations that hold the file at path, or nil if the
+// shipper has none.
+func shipDestinationsHolding(ctx context.Context, sh Shipper, path string) []string {
+	ms, ok := sh.(*multiShipper)
+	if !ok {
+		return nil
+	}
+	return ms.Holding(ctx, path)
+}
+
+// syncDestinations ships the files of a period that are listed in its manifest to any destination that does not yet
+// hold them, along with their checksum and seek index files, and records the destinations holding each file in the
+// manifest. Files are copied from the ship path, so destinations can only be caught up when it is a filesystem.
+func syncDestinations(ctx context.Context, network string, p ExportPeriod, sh Shipper) error {
+	ms, ok := sh.(*multiShipper)
+	if !ok {
+		return nil
+	}
+	root, isLocal := localShipPath(ms.Shipper)
+
+	path := periodManifestPath(network, p)
+	data, err := ms.Read(ctx, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	var pm PeriodManifest
+	if err := json.Unmarshal(data, &pm); err != nil {
+		return fmt.Errorf("decode manifest: %w", err)
+	}
+
+	changed := false
+	holding := map[string][]string{}
+	for _, f := range pm.Files {
+		has := map[string]bool{}
+		for _, name := range f.Destinations {
+			has[name] = true
+		}
+		for _, d := range ms.destinations {
+			if has[d.name] {
+				continue
+			}
+			if _, err := d.sh.Stat(ctx, f.Path); err == nil {
+				has[d.name] = true
+				changed = true
+				continue
+			}
+			if !isLocal {
+				logger.Infow("destination is missing a file but can only be caught up from a filesystem ship path", "destination", d.name, "path", f.Path)
+				continue
+			}
+			if err := d.try(ctx, "catch up", f.Path, func() error { return catchUpFile(ctx, root, f.Path, d.sh) }); err != nil {
+				recordDestinationFailure(ctx, d.name)
+				logger.Errorw("failed to catch up destination", "destination", d.name, "path", f.Path, "error", err)
+				continue
+			}
+			logger.Infow("caught up destination", "destination", d.name, "path", f.Path)
+			has[d.name] = true
+			changed = true
+		}
+		for _, d := range ms.destinations {
+			if has[d.name] {
+				holding[f.Path] = append(holding[f.Path], d.name)
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return updatePeriodManifest(ctx, path, sh, func(pm *PeriodManifest) error {
+		for _, f := range pm.Files {
+			if names, ok := holding[f.Path]; ok {
+				f.Destinations = names
+			}
+		}
+		return nil
+	})
+}
+
+// catchUpFile copies a shipped file from the ship path to a destination, followed by its seek index and checksum.
+func catchUpFile(ctx context.Context, root string, path string, dst Shipper) error {
+	src := filepath.Join(root, filepath.FromSlash(path))
+	tmp, err := tempNameFor(src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := copyFile(src, tmp); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := dst.Put(ctx, path, tmp); err != nil {
+		return err
+	}
+
+	// The checksum is shipped last so that its presence implies the file is complete
+	for _, suffix := range []string{SeekIndexSuffix, ChecksumSuffix} {
+		data, err := os.ReadFile(src + suffix)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("read %s: %w", suffix, err)
+		}
+		if err := dst.Write(ctx, path+suffix, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
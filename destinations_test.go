@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unavailableShipper fails to ship any file, as a destination that cannot be reached does.
+type unavailableShipper struct {
+	fileShipper
+	attempts int
+}
+
+func (s *unavailableShipper) Put(ctx context.Context, path string, src string) error {
+	s.attempts++
+	return errors.New("unavailable")
+}
+
+func (s *unavailableShipper) Write(ctx context.Context, path string, data []byte) error {
+	s.attempts++
+	return errors.New("unavailable")
+}
+
+func TestMultiShipper(t *testing.T) {
+	ctx := context.Background()
+	primary := &fileShipper{root: t.TempDir()}
+	backup := &fileShipper{root: t.TempDir()}
+	down := &unavailableShipper{fileShipper: fileShipper{root: t.TempDir()}}
+
+	ms := &multiShipper{Shipper: primary, destinations: []*shipDestination{
+		{name: "backup", sh: backup, required: true},
+		{name: "down", sh: down, retries: 2, backoff: time.Millisecond},
+	}}
+
+	src := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(src, []byte("data"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Put(ctx, "mainnet/csv/1/messages/2021/messages-2021-08-09.csv.gz", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Write(ctx, "mainnet/csv/1/messages/2021/messages-2021-08-09.csv.gz.sha256", []byte("sum")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range []*fileShipper{primary, backup} {
+		data, err := sh.Read(ctx, "mainnet/csv/1/messages/2021/messages-2021-08-09.csv.gz")
+		if err != nil || string(data) != "data" {
+			t.Errorf("got %q from %s, wanted the shipped file: %v", data, sh.root, err)
+		}
+		if _, err := sh.Stat(ctx, "mainnet/csv/1/messages/2021/messages-2021-08-09.csv.gz.sha256"); err != nil {
+			t.Errorf("checksum not written to %s: %v", sh.root, err)
+		}
+	}
+	if down.attempts != 6 {
+		t.Errorf("got %d attempts to ship to the unavailable destination, wanted 6", down.attempts)
+	}
+	if names := ms.Holding(ctx, "mainnet/csv/1/messages/2021/messages-2021-08-09.csv.gz"); len(names) != 1 || names[0] != "backup" {
+		t.Errorf("got destinations %v holding the file, wanted only backup", names)
+	}
+
+	ms.destinations[1].required = true
+	if err := ms.Write(ctx, "mainnet/other.json", []byte("{}")); err == nil {
+		t.Errorf("expected an error when a required destination is unavailable")
+	}
+	if _, err := primary.Stat(ctx, "mainnet/other.json"); err == nil {
+		t.Errorf("file was shipped to the ship path although a required destination failed")
+	}
+}
+
+func TestSyncDestinations(t *testing.T) {
+	ctx := context.Background()
+	primary := &fileShipper{root: t.TempDir()}
+	backup := &fileShipper{root: t.TempDir()}
+	ms := &multiShipper{Shipper: primary, destinations: []*shipDestination{{name: "backup", sh: backup}}}
+
+	path := "mainnet/csv/1/messages/2021/messages-2021-08-09.csv.gz"
+	if err := primary.Write(ctx, path, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Write(ctx, path+ChecksumSuffix, []byte("sum")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 9}, StartHeight: 1005360, EndHeight: 1008239}
+	pm := &PeriodManifest{Network: "mainnet", Date: p.Date, StartHeight: p.StartHeight, EndHeight: p.EndHeight, Files: []*PeriodManifestFile{{Path: path, Table: "messages"}}}
+	data, err := json.Marshal(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Write(ctx, periodManifestPath("mainnet", p), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncDestinations(ctx, "mainnet", p, ms); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{"", ChecksumSuffix} {
+		if _, err := backup.Stat(ctx, path+suffix); err != nil {
+			t.Errorf("destination was not caught up with %s: %v", path+suffix, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(primary.root, filepath.FromSlash(path))); err != nil {
+		t.Errorf("file was removed from the ship path while catching up: %v", err)
+	}
+
+	data, err = primary.Read(ctx, periodManifestPath("mainnet", p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updated PeriodManifest
+	if err := json.Unmarshal(data, &updated); err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Files) != 1 || len(updated.Files[0].Destinations) != 1 || updated.Files[0].Destinations[0] != "backup" {
+		t.Errorf("manifest does not record the destination holding the file: %+v", updated.Files)
+	}
+}
+
+func TestDestinationsConfigValidate(t *testing.T) {
+	negative := -1
+	testCases := []struct {
+		name string
+		dc   DestinationsConfig
+		ok   bool
+	}{
+		{name: "valid", dc: DestinationsConfig{Destinations: map[string]*DestinationSpec{"s3": {Path: "s3://bucket/prefix", RetryBackoff: "1m"}}}, ok: true},
+		{name: "missing path", dc: DestinationsConfig{Destinations: map[string]*DestinationSpec{"s3": {}}}},
+		{name: "negative retries", dc: DestinationsConfig{Destinations: map[string]*DestinationSpec{"s3": {Path: "/backup", Retries: &negative}}}},
+		{name: "invalid backoff", dc: DestinationsConfig{Destinations: map[string]*DestinationSpec{"s3": {Path: "/backup", RetryBackoff: "soon"}}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.dc.Validate()
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
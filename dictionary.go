@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/huff0"
+	"github.com/klauspost/compress/zstd"
+	"github.com/urfave/cli/v2"
+)
+
+// DictionaryDir is the directory within each network's directory in the ship path that zstd dictionaries are
+// published to.
+const DictionaryDir = "dictionaries"
+
+// Defaults of zstd dictionary training.
+const (
+	DefaultDictionarySize        = 112640  // size of a trained dictionary, the default of the zstd cli
+	DefaultDictionaryPeriods     = 30      // number of recent periods whose files are sampled
+	DefaultDictionaryMaxFileSize = 4 << 20 // largest average uncompressed file a table may have to be given a dictionary
+	DefaultDictionaryMinSaving   = 5       // percentage of the samples' compressed size a dictionary must save
+)
+
+// dictionaryDmerSize is the length of the substrings counted across samples when choosing dictionary content.
+const dictionaryDmerSize = 8
+
+// DictionaryIndex lists the zstd dictionaries published for a network, written to <network>/dictionaries/index.json.
+// Files compressed with a dictionary name its id in their zstd frame headers, so every dictionary is kept.
+type DictionaryIndex struct {
+	Network string                        `json:"network"`
+	Tables  map[string][]*DictionaryEntry `json:"tables"` // dictionaries of each table, oldest first
+}
+
+// DictionaryEntry describes a dictionary trained for a table.
+type DictionaryEntry struct {
+	ID          uint32    `json:"id"`
+	Path        string    `json:"path"` // path relative to the ship path
+	Size        int       `json:"size"`
+	Trained     time.Time `json:"trained"`
+	Samples     int       `json:"samples"`      // number of files the dictionary was trained on
+	SampleBytes int64     `json:"sample_bytes"` // uncompressed size of the samples
+	Ratio       float64   `json:"ratio"`        // compressed size of the samples with the dictionary relative to without it
+}
+
+// dictionaryIndexPath returns the path of the dictionary index of a network, relative to the ship path.
+func dictionaryIndexPath(network string) string {
+	return filepath.Join(network, DictionaryDir, "index.json")
+}
+
+// dictionaryPath returns the path of a table's dictionary, relative to the ship path.
+func dictionaryPath(network string, table string, id uint32) string {
+	return filepath.Join(network, DictionaryDir, table, strconv.FormatUint(uint64(id), 10)+".zdict")
+}
+
+// readDictionaryIndex reads the dictionary index of a network, returning an empty index if none has been published.
+func readDictionaryIndex(ctx context.Context, sh Shipper, network string) (*DictionaryIndex, error) {
+	di := &DictionaryIndex{Network: network, Tables: map[string][]*DictionaryEntry{}}
+	data, err := sh.Read(ctx, dictionaryIndexPath(network))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return di, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, di); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if di.Tables == nil {
+		di.Tables = map[string][]*DictionaryEntry{}
+	}
+	return di, nil
+}
+
+// writeDictionaryIndex writes the dictionary index of a network.
+func writeDictionaryIndex(ctx context.Context, sh Shipper, di *DictionaryIndex) error {
+	data, err := json.MarshalIndent(di, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return sh.Write(ctx, dictionaryIndexPath(di.Network), data)
+}
+
+// zstdDictionary is a dictionary loaded from the ship path.
+type zstdDictionary struct {
+	Table string
+	Entry *DictionaryEntry
+	Data  []byte
+}
+
+// dictionaryRegistry holds the dictionaries that zstd files are compressed and decompressed with.
+type dictionaryRegistry struct {
+	mu      sync.RWMutex
+	byID    map[uint32]*zstdDictionary
+	current map[string]*zstdDictionary // most recent dictionary of each table
+}
+
+// zstdDictionaries holds the dictionaries loaded from the ship path by this process.
+var zstdDictionaries = &dictionaryRegistry{}
+
+// Add registers a dictionary for decompression, and for compressing new files of its table if it is current.
+func (r *dictionaryRegistry) Add(d *zstdDictionary, current bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.byID == nil {
+		r.byID, r.current = map[uint32]*zstdDictionary{}, map[string]*zstdDictionary{}
+	}
+	r.byID[d.Entry.ID] = d
+	if current {
+		r.current[d.Table] = d
+	}
+}
+
+// Current returns the dictionary that new files of a table are compressed with, or nil if it has none.
+func (r *dictionaryRegistry) Current(table string) *zstdDictionary {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current[table]
+}
+
+// Tables returns the current dictionary of each table, by table.
+func (r *dictionaryRegistry) Tables() map[string]*zstdDictionary {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tables := make(map[string]*zstdDictionary, len(r.current))
+	for table, d := range r.current {
+		tables[table] = d
+	}
+	return tables
+}
+
+// Data returns the contents of every registered dictionary.
+func (r *dictionaryRegistry) Data() [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var dicts [][]byte
+	for _, d := range r.byID {
+		dicts = append(dicts, d.Data)
+	}
+	return dicts
+}
+
+// loadZstdDictionaries registers the dictionaries published in the ship path, so that files compressed with them can
+// be read and, with --zstd-dictionaries, new files of their tables are compressed with the most recent of them.
+func loadZstdDictionaries(ctx context.Context, sh Shipper) error {
+	di, err := readDictionaryIndex(ctx, sh, networkConfig.name)
+	if err != nil {
+		return fmt.Errorf("read dictionary index: %w", err)
+	}
+	loaded := 0
+	for table, entries := range di.Tables {
+		for i, e := range entries {
+			data, err := sh.Read(ctx, e.Path)
+			if err != nil {
+				return fmt.Errorf("read dictionary %d of %s: %w", e.ID, table, err)
+			}
+			zstdDictionaries.Add(&zstdDictionary{Table: table, Entry: e, Data: data}, i == len(entries)-1)
+			loaded++
+		}
+	}
+	if loaded > 0 {
+		logger.Infow("loaded zstd dictionaries", "dictionaries", loaded, "tables", len(di.Tables))
+	}
+	return nil
+}
+
+// zstdDictionaryFor returns the dictionary a file should be compressed with, or nil if it should be compressed
+// without one.
+func zstdDictionaryFor(ef *ExportFile) *zstdDictionary {
+	if !shippingConfig.zstdDictionaries || ef == nil {
+		return nil
+	}
+	return zstdDictionaries.Current(deltaBaseTable(ef.TableName))
+}
+
+// ensureDictionaryFiles publishes the current dictionaries of the tables being exported to a ship path that does not
+// hold them yet, so that every destination holds the dictionaries its files were compressed with.
+func ensureDictionaryFiles(ctx context.Context, sh Shipper, tables []Table) error {
+	if !shippingConfig.zstdDictionaries {
+		return nil
+	}
+	current := zstdDictionaries.Tables()
+
+	var missing []*zstdDictionary
+	for _, t := range tables {
+		d, ok := current[t.Name]
+		if !ok {
+			continue
+		}
+		if _, err := sh.Stat(ctx, d.Entry.Path); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("stat dictionary path (%q): %w", d.Entry.Path, err)
+		}
+		if err := sh.Write(ctx, d.Entry.Path, d.Data); err != nil {
+			return fmt.Errorf("write dictionary for %s: %w", t.Name, err)
+		}
+		missing = append(missing, d)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	di, err := readDictionaryIndex(ctx, sh, networkConfig.name)
+	if err != nil {
+		return fmt.Errorf("read dictionary index: %w", err)
+	}
+	for _, d := range missing {
+		di.Tables[d.Table] = append(di.Tables[d.Table], d.Entry)
+	}
+	return writeDictionaryIndex(ctx, sh, di)
+}
+
+// trainZstdDictionary chooses the content of a dictionary of at most size bytes from samples of a table's files. Rows
+// are chosen greedily by how many substrings they share with rows of other samples that are not already held by the
+// dictionary, so that the dictionary holds what recurs from file to file rather than what is repeated within a file.
+func trainZstdDictionary(samples [][]byte, size int) ([]byte, error) {
+	// Each substring is counted once per sample in which it occurs
+	freq := map[uint64]int{}
+	lineSet := map[string]bool{}
+	for _, sample := range samples {
+		seen := map[uint64]bool{}
+		for _, line := range bytes.SplitAfter(sample, []byte("\n")) {
+			if len(line) < dictionaryDmerSize {
+				continue
+			}
+			lineSet[string(line)] = true
+			for i := 0; i+dictionaryDmerSize <= len(line); i++ {
+				seen[binary.LittleEndian.Uint64(line[i:])] = true
+			}
+		}
+		for dmer := range seen {
+			freq[dmer]++
+		}
+	}
+
+	used := map[uint64]bool{}
+	score := func(line string) int {
+		s := 0
+		counted := map[uint64]bool{}
+		for i := 0; i+dictionaryDmerSize <= len(line); i++ {
+			dmer := binary.LittleEndian.Uint64([]byte(line[i : i+dictionaryDmerSize]))
+			if used[dmer] || counted[dmer] || freq[dmer] < 2 {
+				continue
+			}
+			counted[dmer] = true
+			s += freq[dmer]
+		}
+		return s
+	}
+
+	h := &dictionaryLineHeap{}
+	for line := range lineSet {
+		if s := score(line); s > 0 {
+			h.lines = append(h.lines, dictionaryLine{line: line, score: s})
+		}
+	}
+	heap.Init(h)
+
+	var chosen []string
+	total := 0
+	for h.Len() > 0 && total < size {
+		l := heap.Pop(h).(dictionaryLine)
+		if len(l.line) > size-total {
+			continue
+		}
+		// Scores fall as content is chosen, so a line is only taken once its current score is still the best
+		if s := score(l.line); s != l.score {
+			if s > 0 {
+				heap.Push(h, dictionaryLine{line: l.line, score: s})
+			}
+			continue
+		}
+		chosen = append(chosen, l.line)
+		total += len(l.line)
+		for i := 0; i+dictionaryDmerSize <= len(l.line); i++ {
+			used[binary.LittleEndian.Uint64([]byte(l.line[i:i+dictionaryDmerSize]))] = true
+		}
+	}
+	if total < dictionaryDmerSize {
+		return nil, fmt.Errorf("samples share too little content to train a dictionary")
+	}
+
+	// Zstd finds matches closest to the data first, so the most useful content is placed last
+	var content bytes.Buffer
+	for i := len(chosen) - 1; i >= 0; i-- {
+		content.WriteString(chosen[i])
+	}
+	return content.Bytes(), nil
+}
+
+// dictionaryLine is a candidate row of dictionary content, scored by the density of the substrings it would add.
+type dictionaryLine struct {
+	line  string
+	score int
+}
+
+type dictionaryLineHeap struct {
+	lines []dictionaryLine
+}
+
+func (h *dictionaryLineHeap) Len() int { return len(h.lines) }
+func (h *dictionaryLineHeap) Less(i, j int) bool {
+	a, b := h.lines[i], h.lines[j]
+	return a.score*len(b.line) > b.score*len(a.line)
+}
+func (h *dictionaryLineHeap) Swap(i, j int)      { h.lines[i], h.lines[j] = h.lines[j], h.lines[i] }
+func (h *dictionaryLineHeap) Push(x interface{}) { h.lines = append(h.lines, x.(dictionaryLine)) }
+func (h *dictionaryLineHeap) Pop() interface{} {
+	l := h.lines[len(h.lines)-1]
+	h.lines = h.lines[:len(h.lines)-1]
+	return l
+}
+
+// Predefined distributions of the zstd format, used as the entropy tables of trained dictionaries. The encoder does
+// not use the tables of a dictionary, so they only need to be valid.
+var (
+	zstdLiteralLengthsNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMatchLengthsNorm   = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOffsetsNorm        = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+)
+
+// zstdDictionaryMagic begins every zstd dictionary.
+var zstdDictionaryMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// zstdDictionaryID derives the id of a dictionary from its content, outside the range reserved for registered
+// dictionaries.
+func zstdDictionaryID(content []byte) uint32 {
+	return 32768 + crc32.ChecksumIEEE(content)%(1<<31-32768)
+}
+
+// buildZstdDictionary encodes dictionary content in the zstd dictionary format. The literals table is built from the
+// byte frequencies of the content, with every byte given a frequency so that any literal can be encoded with it.
+func buildZstdDictionary(id uint32, content []byte) ([]byte, error) {
+	if len(content) < 8 {
+		return nil, fmt.Errorf("dictionary content must hold at least 8 bytes")
+	}
+
+	var counts [256]int
+	for _, b := range content {
+		counts[b]++
+	}
+	// Huffman tables are built from a sample of at most 64KiB with the same byte frequencies
+	const sampleSize = 64 << 10
+	var lits []byte
+	for b, c := range counts {
+		n := 1 + c*(sampleSize-256)/len(content)
+		lits = append(lits, bytes.Repeat([]byte{byte(b)}, n)...)
+	}
+	var s huff0.Scratch
+	if _, _, err := huff0.Compress1X(lits, &s); err != nil {
+		return nil, fmt.Errorf("build literals table: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(zstdDictionaryMagic)
+	binary.Write(&buf, binary.LittleEndian, id)
+	buf.Write(s.OutTable)
+	for _, t := range []struct {
+		norm     []int16
+		tableLog uint
+	}{{zstdOffsetsNorm, 5}, {zstdMatchLengthsNorm, 6}, {zstdLiteralLengthsNorm, 6}} {
+		ncount, err := writeFSENormalizedCounts(t.norm, t.tableLog)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(ncount)
+	}
+	// The initial repeat offsets of the format
+	for _, offset := range []uint32{1, 4, 8} {
+		binary.Write(&buf, binary.LittleEndian, offset)
+	}
+	buf.Write(content)
+	return buf.Bytes(), nil
+}
+
+// writeFSENormalizedCounts encodes the normalized counts of an FSE table as described by the zstd format, where a
+// count of -1 marks a symbol with a probability of less than one.
+func writeFSENormalizedCounts(norm []int16, tableLog uint) ([]byte, error) {
+	var out []byte
+	var bitStream uint32
+	var bitCount uint
+	flush := func() {
+		out = append(out, byte(bitStream), byte(bitStream>>8))
+		bitStream >>= 16
+		bitCount -= 16
+	}
+
+	tableSize := int32(1) << tableLog
+	remaining := tableSize + 1
+	threshold := tableSize
+	nbBits := tableLog + 1
+
+	bitStream = uint32(tableLog - 5)
+	bitCount = 4
+
+	previousIs0 := false
+	for symbol := 0; symbol < len(norm) && remaining > 1; {
+		if previousIs0 {
+			start := symbol
+			for symbol < len(norm) && norm[symbol] == 0 {
+				symbol++
+			}
+			if symbol == len(norm) {
+				break
+			}
+			for symbol >= start+24 {
+				start += 24
+				bitStream |= 0xffff << bitCount
+				out = append(out, byte(bitStream), byte(bitStream>>8))
+				bitStream >>= 16
+			}
+			for symbol >= start+3 {
+				start += 3
+				bitStream |= 3 << bitCount
+				bitCount += 2
+			}
+			bitStream |= uint32(symbol-start) << bitCount
+			bitCount += 2
+			if bitCount > 16 {
+				flush()
+			}
+		}
+
+		count := int32(norm[symbol])
+		symbol++
+		max := (2*threshold - 1) - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++ // -1 is encoded as 0
+		if count >= threshold {
+			count += max
+		}
+		bitStream |= uint32(count) << bitCount
+		bitCount += nbBits
+		if count < max {
+			bitCount--
+		}
+		previousIs0 = count == 1
+		if remaining < 1 {
+			return nil, fmt.Errorf("normalized counts exceed the table size")
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+		if bitCount > 16 {
+			flush()
+		}
+	}
+	if remaining != 1 {
+		return nil, fmt.Errorf("normalized counts do not fill the table")
+	}
+	for bitCount > 0 {
+		out = append(out, byte(bitStream))
+		bitStream >>= 8
+		if bitCount < 8 {
+			break
+		}
+		bitCount -= 8
+	}
+	return out, nil
+}
+
+// zstdDictionaryOptions returns the encoder options for compressing with a dictionary. The default level of the zstd
+// encoder does not find matches in the content of a dictionary, so the next level is used in its place.
+func zstdDictionaryOptions(ct CompressionTuning, dict []byte) []zstd.EOption {
+	opts := zstdEncoderOptions(ct)
+	level := zstd.SpeedDefault
+	if l := ct.LevelFor(CompressionByName["zstd"]); l != 0 {
+		level = zstd.EncoderLevelFromZstd(l)
+	}
+	if level == zstd.SpeedDefault {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	}
+	return append(opts, zstd.WithEncoderDict(dict))
+}
+
+// zstdCompressedSize returns the total size of the samples compressed separately, with dictionary dict if it is not
+// nil. Samples are compressed at the level used with dictionaries either way, so that only the dictionary differs.
+func zstdCompressedSize(samples [][]byte, dict []byte) (int64, error) {
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedBetterCompression)}
+	if dict != nil {
+		opts = zstdDictionaryOptions(CompressionTuning{Workers: 1}, dict)
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer enc.Close()
+	var size int64
+	for _, sample := range samples {
+		size += int64(len(enc.EncodeAll(sample, nil)))
+	}
+	return size, nil
+}
+
+// dictionarySamples reads the uncompressed contents of the csv files of each table shipped in up to periods periods
+// ending with last, as listed by their period manifests. Encrypted, sharded and provisional files are not sampled.
+func dictionarySamples(ctx context.Context, sh Shipper, network string, last ExportPeriod, periods int, tables map[string]bool) (map[string][][]byte, error) {
+	samples := map[string][][]byte{}
+	for p, n := last, 0; n < periods; p, n = exportPeriodForHeight(p.StartHeight-1, networkConfig.genesisTs), n+1 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		data, err := sh.Read(ctx, periodManifestPath(network, p))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read manifest for %s: %w", p.String(), err)
+		}
+		if err == nil {
+			var pm PeriodManifest
+			if err := json.Unmarshal(data, &pm); err != nil {
+				return nil, fmt.Errorf("decode manifest for %s: %w", p.String(), err)
+			}
+			for _, f := range pm.Files {
+				c, ok := CompressionByName[f.Compression]
+				if !tables[f.Table] || f.Format != FormatCSV || f.Encryption != "" || f.Shard != nil || f.Provisional || !ok {
+					continue
+				}
+				sample, err := readShippedFile(ctx, sh, f.Path, c)
+				if err != nil {
+					return nil, fmt.Errorf("read %s: %w", f.Path, err)
+				}
+				samples[f.Table] = append(samples[f.Table], sample)
+			}
+		}
+		if p.StartHeight == 0 {
+			break
+		}
+	}
+	return samples, nil
+}
+
+// readShippedFile reads the uncompressed contents of a shipped file.
+func readShippedFile(ctx context.Context, sh Shipper, path string, c Compression) ([]byte, error) {
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+var trainDictionariesCommand = &cli.Command{
+	Name:   "train-dictionaries",
+	Usage:  "Train zstd dictionaries for tables with small files from their recently shipped files, and publish them in the ship path.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		stateFlags,
+		objectStoreFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path or s3://bucket/prefix or gs://bucket/prefix object store location that files were shipped to and dictionaries are published to.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "tables",
+				Usage: "Comma separated list of tables or table families to train dictionaries for. Default is every table whose files are small enough.",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "periods",
+				Usage: "Number of the most recent final periods whose files are sampled.",
+				Value: DefaultDictionaryPeriods,
+			},
+			&cli.IntFlag{
+				Name:  "dictionary-size",
+				Usage: "Largest size of each dictionary, in bytes.",
+				Value: DefaultDictionarySize,
+			},
+			&cli.Int64Flag{
+				Name:  "max-file-size",
+				Usage: "Largest average uncompressed size of a table's sampled files, in bytes, for the table to be given a dictionary. Dictionaries make little difference to larger files.",
+				Value: DefaultDictionaryMaxFileSize,
+			},
+			&cli.Float64Flag{
+				Name:  "min-saving",
+				Usage: "Percentage of the compressed size of a table's samples that its dictionary must save for it to be published.",
+				Value: DefaultDictionaryMinSaving,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the dictionaries that would be published without publishing them.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := cc.Context
+
+		if cc.Int("periods") < 1 {
+			return fmt.Errorf("periods must be at least 1")
+		}
+		if cc.Int("dictionary-size") < 256 {
+			return fmt.Errorf("dictionary size must be at least 256 bytes")
+		}
+
+		tables := map[string]bool{}
+		if cc.String("tables") != "" {
+			names, err := parseTableList(cc.String("tables"))
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				tables[name] = true
+			}
+		} else {
+			for _, t := range TableList {
+				tables[t.Name] = true
+			}
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+		// Files already compressed with a dictionary are read with it
+		if err := loadZstdDictionaries(ctx, sh); err != nil {
+			return err
+		}
+
+		samples, err := dictionarySamples(ctx, sh, networkConfig.name, latestFinalPeriod(networkConfig.genesisTs), cc.Int("periods"), tables)
+		if err != nil {
+			return err
+		}
+
+		di, err := readDictionaryIndex(ctx, sh, networkConfig.name)
+		if err != nil {
+			return fmt.Errorf("read dictionary index: %w", err)
+		}
+
+		names := make([]string, 0, len(samples))
+		for name := range samples {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var published []string
+		for _, name := range names {
+			ts := samples[name]
+			var sampleBytes int64
+			for _, s := range ts {
+				sampleBytes += int64(len(s))
+			}
+			ll := logger.With("table", name, "samples", len(ts), "sample_bytes", sampleBytes)
+			if len(ts) < 2 {
+				ll.Infow("skipping table with too few samples")
+				continue
+			}
+			if sampleBytes/int64(len(ts)) > cc.Int64("max-file-size") {
+				ll.Infow("skipping table with large files")
+				continue
+			}
+
+			content, err := trainZstdDictionary(ts, cc.Int("dictionary-size"))
+			if err != nil {
+				ll.Infow("skipping table", "reason", err.Error())
+				continue
+			}
+			id := zstdDictionaryID(content)
+			dict, err := buildZstdDictionary(id, content)
+			if err != nil {
+				return fmt.Errorf("build dictionary for %s: %w", name, err)
+			}
+
+			without, err := zstdCompressedSize(ts, nil)
+			if err != nil {
+				return fmt.Errorf("compress samples of %s: %w", name, err)
+			}
+			with, err := zstdCompressedSize(ts, dict)
+			if err != nil {
+				return fmt.Errorf("compress samples of %s with dictionary: %w", name, err)
+			}
+			// The dictionary is shipped once but must pay for itself across the samples
+			ratio := float64(with) / float64(without)
+			saving := 100 * (1 - float64(with+int64(len(dict)))/float64(without))
+			ll = ll.With("id", id, "without", without, "with", with, "saving", fmt.Sprintf("%.1f%%", saving))
+			if saving < cc.Float64("min-saving") {
+				ll.Infow("dictionary does not save enough to publish")
+				continue
+			}
+			if entries := di.Tables[name]; len(entries) > 0 && entries[len(entries)-1].ID == id {
+				ll.Infow("dictionary is unchanged")
+				continue
+			}
+			if cc.Bool("dry-run") {
+				ll.Infow("would publish dictionary")
+				continue
+			}
+
+			e := &DictionaryEntry{
+				ID:          id,
+				Path:        filepath.ToSlash(dictionaryPath(networkConfig.name, name, id)),
+				Size:        len(dict),
+				Trained:     time.Now().UTC(),
+				Samples:     len(ts),
+				SampleBytes: sampleBytes,
+				Ratio:       ratio,
+			}
+			if err := sh.Write(ctx, e.Path, dict); err != nil {
+				return fmt.Errorf("write dictionary for %s: %w", name, err)
+			}
+			di.Tables[name] = append(di.Tables[name], e)
+			published = append(published, name)
+			ll.Infow("published dictionary", "path", e.Path)
+		}
+
+		if len(published) == 0 {
+			logger.Infow("no dictionaries were published")
+			return nil
+		}
+		if err := writeDictionaryIndex(ctx, sh, di); err != nil {
+			return fmt.Errorf("write dictionary index: %w", err)
+		}
+		logger.Infow("published dictionaries", "tables", strings.Join(published, ","))
+		return nil
+	},
+}
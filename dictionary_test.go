@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// economicsSamples returns small daily files resembling chain_economics, whose rows differ in their heights and
+// amounts but share most of their content from day to day.
+func economicsSamples(days int) [][]byte {
+	var samples [][]byte
+	for d := 0; d < days; d++ {
+		var buf bytes.Buffer
+		for h := 0; h < 20; h++ {
+			fmt.Fprintf(&buf, "%d,bafy2bzacedrgw2kwjzqkutfjsv3eme6wxeg7wtqnvwcoj3eu3hgsnyvpqt%d,195840886284345218%06d,0,3329685737164709%07d,58734112548124%07d,0\n", 1005360+d*2880+h*144, (d+h)%5, d*31+h*7, h*17+d, d*13+h)
+		}
+		samples = append(samples, buf.Bytes())
+	}
+	return samples
+}
+
+func TestZstdDictionary(t *testing.T) {
+	defer func(r *dictionaryRegistry, enabled bool) {
+		zstdDictionaries, shippingConfig.zstdDictionaries = r, enabled
+	}(zstdDictionaries, shippingConfig.zstdDictionaries)
+	zstdDictionaries, shippingConfig.zstdDictionaries = &dictionaryRegistry{}, true
+
+	samples := economicsSamples(10)
+	content, err := trainZstdDictionary(samples[:9], 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) > 4096 {
+		t.Errorf("got %d bytes of content, wanted at most 4096", len(content))
+	}
+	id := zstdDictionaryID(content)
+	dict, err := buildZstdDictionary(id, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdDictionaries.Add(&zstdDictionary{Table: "chain_economics", Entry: &DictionaryEntry{ID: id}, Data: dict}, true)
+
+	// The file held out of training is compressed with the dictionary and read back
+	ef := &ExportFile{TableName: "chain_economics", Compression: CompressionByName["zstd"]}
+	var with bytes.Buffer
+	if _, err := compressZstd(ef, bytes.NewReader(samples[9]), &with); err != nil {
+		t.Fatal(err)
+	}
+	if ef.Dictionary != id {
+		t.Errorf("got dictionary %d recorded for the file, wanted %d", ef.Dictionary, id)
+	}
+	without, err := zstdCompressedSize(samples[9:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(with.Len()) >= without {
+		t.Errorf("compressed to %d bytes with the dictionary and %d without it", with.Len(), without)
+	}
+
+	r, err := decompressZstd(&with)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, samples[9]) {
+		t.Errorf("file was not read back unchanged")
+	}
+
+	// Tables without a dictionary are compressed as before
+	other := &ExportFile{TableName: "chain_rewards", Compression: CompressionByName["zstd"]}
+	if _, err := compressZstd(other, bytes.NewReader(samples[9]), io.Discard); err != nil || other.Dictionary != 0 {
+		t.Errorf("got dictionary %d for a table without one: %v", other.Dictionary, err)
+	}
+}
+
+func TestWriteFSENormalizedCounts(t *testing.T) {
+	for _, tc := range []struct {
+		norm     []int16
+		tableLog uint
+	}{{zstdOffsetsNorm, 5}, {zstdMatchLengthsNorm, 6}, {zstdLiteralLengthsNorm, 6}} {
+		if got, err := writeFSENormalizedCounts(tc.norm, tc.tableLog); err != nil || len(got) == 0 {
+			t.Errorf("failed to write predefined counts of %d symbols: %v", len(tc.norm), err)
+		}
+	}
+	if _, err := writeFSENormalizedCounts([]int16{4, 4}, 6); err == nil {
+		t.Errorf("expected an error for counts that do not fill the table")
+	}
+	if _, err := writeFSENormalizedCounts([]int16{60, 8}, 6); err == nil {
+		t.Errorf("expected an error for counts that exceed the table")
+	}
+}
+
+func TestEnsureDictionaryFiles(t *testing.T) {
+	defer func(r *dictionaryRegistry, enabled bool, n string) {
+		zstdDictionaries, shippingConfig.zstdDictionaries, networkConfig.name = r, enabled, n
+	}(zstdDictionaries, shippingConfig.zstdDictionaries, networkConfig.name)
+	zstdDictionaries, shippingConfig.zstdDictionaries, networkConfig.name = &dictionaryRegistry{}, true, "mainnet"
+
+	ctx := context.Background()
+	src := &fileShipper{root: t.TempDir()}
+	e := &DictionaryEntry{ID: 40000, Path: dictionaryPath("mainnet", "chain_economics", 40000)}
+	if err := src.Write(ctx, e.Path, []byte("dictionary")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDictionaryIndex(ctx, src, &DictionaryIndex{Network: "mainnet", Tables: map[string][]*DictionaryEntry{"chain_economics": {e}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadZstdDictionaries(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &fileShipper{root: t.TempDir()}
+	if err := ensureDictionaryFiles(ctx, dst, []Table{TablesByName["chain_economics"], TablesByName["chain_rewards"]}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := dst.Read(ctx, e.Path); err != nil || string(data) != "dictionary" {
+		t.Errorf("dictionary was not published to the destination: %v", err)
+	}
+	di, err := readDictionaryIndex(ctx, dst, "mainnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := di.Tables["chain_economics"]; len(entries) != 1 || entries[0].ID != e.ID {
+		t.Errorf("got index %+v, wanted the published dictionary", di.Tables)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+)
+
+// diffSource reads files from one version of an archive.
+type diffSource interface {
+	// Open returns the contents of a file given its path relative to the root of the archive. It returns
+	// errNotFoundAtSource if there is no such file.
+	Open(ctx context.Context, rel string) (io.ReadCloser, error)
+}
+
+// newDiffSource returns the source for an archive given as a local directory or as a location accepted by the mirror
+// command.
+func newDiffSource(location string, ipfsGateway string) (diffSource, error) {
+	return newMirrorSource(location, ipfsGateway)
+}
+
+// TableDiff summarises the differences between two versions of a table's file for a period. Rows are matched by the
+// primary key of the table, or by their entire contents for tables without one.
+type TableDiff struct {
+	Table      string   `json:"table"`
+	Missing    string   `json:"missing,omitempty"` // left or right when the file is missing from that version
+	LeftRows   int      `json:"left_rows"`
+	RightRows  int      `json:"right_rows"`
+	Added      int      `json:"added"`   // rows only in the right version
+	Removed    int      `json:"removed"` // rows only in the left version
+	Changed    int      `json:"changed"` // rows in both versions with different values
+	Duplicates int      `json:"duplicates,omitempty"`
+	Samples    []string `json:"samples,omitempty"` // differing rows, prefixed with + or - in the manner of a unified diff
+}
+
+// Differs reports whether the two versions of the table differ.
+func (d *TableDiff) Differs() bool {
+	return d.Missing != "" || d.Added > 0 || d.Removed > 0 || d.Changed > 0
+}
+
+// readDiffRows reads the csv rows of an export file from a source, normalized as they would be by --normalize-rows and
+// keyed by the primary key of the table. Files shipped as parts are read in full. It returns errNotFoundAtSource if
+// the source has no file for the table.
+func readDiffRows(ctx context.Context, src diffSource, ef *ExportFile, identities []age.Identity) (map[string][]byte, int, error) {
+	paths := []string{ef.Path()}
+	if r, err := src.Open(ctx, ef.ShardListPath()); err == nil {
+		var sl ShardList
+		err := json.NewDecoder(r).Decode(&sl)
+		r.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("decode shard list: %w", err)
+		}
+		paths = paths[:0]
+		for _, part := range sl.Parts {
+			paths = append(paths, part.Path)
+		}
+	} else if !errors.Is(err, errNotFoundAtSource) {
+		return nil, 0, fmt.Errorf("open shard list: %w", err)
+	}
+
+	layout, err := rowLayoutForTable(ef.TableName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("row layout: %w", err)
+	}
+
+	rows := map[string][]byte{}
+	duplicates := 0
+	for _, path := range paths {
+		if err := func() error {
+			f, err := src.Open(ctx, path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			var r io.Reader = f
+			if identities != nil {
+				r, err = newDecryptingReader(f, identities)
+				if err != nil {
+					return fmt.Errorf("decrypt: %w", err)
+				}
+			}
+			zr, err := ef.Compression.Decompress(r)
+			if err != nil {
+				return fmt.Errorf("%s: %w", ef.Compression.Names[0], err)
+			}
+			defer zr.Close()
+
+			sc := bufio.NewScanner(skipCSVProvenance(zr))
+			sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+			sc.Split(scanCSVRecords)
+			for sc.Scan() {
+				row, err := parseCSVRow(sc.Bytes(), layout)
+				if err != nil {
+					return err
+				}
+				if _, ok := rows[row.key]; ok {
+					duplicates++
+				}
+				rows[row.key] = row.raw
+			}
+			return sc.Err()
+		}(); err != nil {
+			if errors.Is(err, errNotFoundAtSource) && path == ef.Path() {
+				return nil, 0, err
+			}
+			return nil, 0, fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+	return rows, duplicates, nil
+}
+
+// diffExportFile compares the rows of an export file in two versions of an archive, keeping up to maxSamples of the
+// differing rows. Both versions of the file are held in memory while they are compared.
+func diffExportFile(ctx context.Context, left, right diffSource, ef *ExportFile, identities []age.Identity, maxSamples int) (*TableDiff, error) {
+	d := &TableDiff{Table: ef.TableName}
+
+	lrows, ldup, err := readDiffRows(ctx, left, ef, identities)
+	if errors.Is(err, errNotFoundAtSource) {
+		d.Missing = "left"
+	} else if err != nil {
+		return nil, fmt.Errorf("left: %w", err)
+	}
+	rrows, rdup, err := readDiffRows(ctx, right, ef, identities)
+	if errors.Is(err, errNotFoundAtSource) {
+		if d.Missing != "" {
+			return nil, nil // in neither version
+		}
+		d.Missing = "right"
+	} else if err != nil {
+		return nil, fmt.Errorf("right: %w", err)
+	}
+	d.LeftRows, d.RightRows, d.Duplicates = len(lrows), len(rrows), ldup+rdup
+
+	var samples []string
+	for key, lraw := range lrows {
+		rraw, ok := rrows[key]
+		switch {
+		case !ok:
+			d.Removed++
+			samples = append(samples, "-"+string(lraw))
+		case string(rraw) != string(lraw):
+			d.Changed++
+			samples = append(samples, "-"+string(lraw), "+"+string(rraw))
+		}
+	}
+	for key, rraw := range rrows {
+		if _, ok := lrows[key]; !ok {
+			d.Added++
+			samples = append(samples, "+"+string(rraw))
+		}
+	}
+
+	// Samples are ordered by row rather than by the order of the maps
+	sort.SliceStable(samples, func(a, b int) bool { return samples[a][1:] < samples[b][1:] })
+	if len(samples) > maxSamples {
+		samples = samples[:maxSamples]
+	}
+	for _, s := range samples {
+		d.Samples = append(d.Samples, strings.TrimSuffix(s, "\n"))
+	}
+	return d, nil
+}
+
+var diffCommand = &cli.Command{
+	Name:   "diff",
+	Usage:  "Compare the rows of two versions of a period's table files, such as two mirrors or the files before and after a re-export.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "left",
+				Usage:    "Location of the first version of the archive. This may be a local directory, an http:// or https:// URL, a public S3 bucket as s3://bucket/prefix or an IPFS path as ipfs://cid/prefix.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "right",
+				Usage:    "Location of the second version of the archive, in the same forms as --left.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "date",
+				Usage:    "Date of the export to compare, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "tables",
+				Usage: "Comma separated list of tables to compare. Default is every table found in either version.",
+			},
+			&cli.StringFlag{
+				Name:  "compression",
+				Usage: "Type of compression used by the shipped files.",
+				Value: "gz",
+			},
+			&cli.StringFlag{
+				Name:  "decrypt-identity",
+				Usage: "Path to an age identity file holding the private key that the shipped files were encrypted to, for comparing encrypted files.",
+			},
+			&cli.StringFlag{
+				Name:  "ipfs-gateway",
+				Usage: "IPFS gateway used to fetch files from ipfs:// locations.",
+				Value: "https://ipfs.io",
+			},
+			&cli.IntFlag{
+				Name:  "rows",
+				Usage: "Maximum number of differing rows to show for each table.",
+				Value: 10,
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Write the differences as JSON.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := cc.Context
+
+		d, err := DateFromString(cc.String("date"))
+		if err != nil {
+			return fmt.Errorf("invalid date: %w", err)
+		}
+		c, ok := CompressionByName[cc.String("compression")]
+		if !ok {
+			return fmt.Errorf("unknown compression %q", cc.String("compression"))
+		}
+
+		var identities []age.Identity
+		if cc.String("decrypt-identity") != "" {
+			identities, err = loadAgeIdentities(cc.String("decrypt-identity"))
+			if err != nil {
+				return fmt.Errorf("decrypt identity: %w", err)
+			}
+		}
+
+		left, err := newDiffSource(cc.String("left"), cc.String("ipfs-gateway"))
+		if err != nil {
+			return fmt.Errorf("invalid left location: %w", err)
+		}
+		right, err := newDiffSource(cc.String("right"), cc.String("ipfs-gateway"))
+		if err != nil {
+			return fmt.Errorf("invalid right location: %w", err)
+		}
+
+		var names []string
+		if cc.String("tables") != "" {
+			names, err = parseTableList(cc.String("tables"))
+			if err != nil {
+				return fmt.Errorf("invalid tables: %w", err)
+			}
+		} else {
+			for _, t := range TableList {
+				names = append(names, t.Name)
+			}
+		}
+
+		var diffs []*TableDiff
+		for _, name := range names {
+			ef := &ExportFile{
+				Date:        d,
+				Schema:      storageConfig.schemaVersion,
+				Network:     networkConfig.name,
+				TableName:   name,
+				Format:      FormatCSV,
+				Compression: c,
+			}
+			if identities != nil {
+				ef.Encryption = EncryptionAge
+			}
+			if err := applyFileNaming(ef, networkConfig.genesisTs); err != nil {
+				return fmt.Errorf("file naming: %w", err)
+			}
+
+			td, err := diffExportFile(ctx, left, right, ef, identities, cc.Int("rows"))
+			if err != nil {
+				return fmt.Errorf("table %s: %w", name, err)
+			}
+			if td != nil {
+				diffs = append(diffs, td)
+			}
+		}
+
+		if cc.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(diffs)
+		}
+
+		differing := 0
+		for _, td := range diffs {
+			switch {
+			case td.Missing != "":
+				fmt.Printf("%s: missing from %s\n", td.Table, td.Missing)
+			case td.Differs():
+				fmt.Printf("%s: %d rows added, %d removed, %d changed (%d rows left, %d right)\n", td.Table, td.Added, td.Removed, td.Changed, td.LeftRows, td.RightRows)
+			default:
+				fmt.Printf("%s: identical (%d rows)\n", td.Table, td.LeftRows)
+			}
+			for _, s := range td.Samples {
+				fmt.Printf("  %s\n", s)
+			}
+			if td.Differs() {
+				differing++
+			}
+		}
+		if differing > 0 {
+			return fmt.Errorf("%d of %d tables differ", differing, len(diffs))
+		}
+		fmt.Printf("no differences in %d tables\n", len(diffs))
+		return nil
+	},
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiffExportFile(t *testing.T) {
+	headers, err := TableHeaders(TablesByName["block_headers"].Model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := rowLayoutForTable("block_headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	isKey := map[int]bool{}
+	for _, c := range layout.keyColumns {
+		isKey[c] = true
+	}
+
+	// row returns a block_headers row whose key columns hold id and whose other columns hold value
+	row := func(id int, value string) string {
+		fields := make([]string, len(headers))
+		for i := range fields {
+			switch {
+			case i == layout.heightColumn:
+				fields[i] = strconv.Itoa(1005360 + id)
+			case isKey[i]:
+				fields[i] = "key" + strconv.Itoa(id)
+			default:
+				fields[i] = value
+			}
+		}
+		return strings.Join(fields, ",") + "\n"
+	}
+
+	ef := &ExportFile{
+		Date:        Date{Year: 2021, Month: 8, Day: 2},
+		Schema:      1,
+		Network:     "mainnet",
+		TableName:   "block_headers",
+		Format:      FormatCSV,
+		Compression: CompressionByName["gz"],
+	}
+	write := func(root string, rows ...string) {
+		path := filepath.Join(root, ef.Path())
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zw := gzip.NewWriter(f)
+		for _, r := range rows {
+			if _, err := zw.Write([]byte(r)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leftRoot, rightRoot := t.TempDir(), t.TempDir()
+	left, right := &localMirrorSource{root: leftRoot}, &localMirrorSource{root: rightRoot}
+
+	if d, err := diffExportFile(context.Background(), left, right, ef, nil, 10); err != nil || d != nil {
+		t.Fatalf("expected no diff for a table in neither version, got %v, %v", d, err)
+	}
+
+	// Rows are matched by key regardless of their order
+	write(leftRoot, row(1, "1"), row(2, "a"), row(3, "1"))
+	write(rightRoot, row(4, "1"), row(2, "b"), row(1, "1"))
+
+	d, err := diffExportFile(context.Background(), left, right, ef, nil, 10)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if d.Added != 1 || d.Removed != 1 || d.Changed != 1 || d.LeftRows != 3 || d.RightRows != 3 {
+		t.Errorf("unexpected diff: %+v", d)
+	}
+	if len(d.Samples) != 4 {
+		t.Errorf("expected a sample for each added and removed row and two for the changed row, got %v", d.Samples)
+	}
+
+	d, err = diffExportFile(context.Background(), left, right, ef, nil, 1)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if len(d.Samples) != 1 {
+		t.Errorf("expected samples to be limited, got %v", d.Samples)
+	}
+
+	write(rightRoot, row(3, "1"), row(1, "1"), row(2, "a"))
+	d, err = diffExportFile(context.Background(), left, right, ef, nil, 10)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if d.Differs() {
+		t.Errorf("expected reordered rows not to differ, got %+v", d)
+	}
+
+	if err := os.RemoveAll(rightRoot); err != nil {
+		t.Fatal(err)
+	}
+	d, err = diffExportFile(context.Background(), left, right, ef, nil, 10)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if d.Missing != "right" || d.Removed != 3 {
+		t.Errorf("expected the file to be missing from the right, got %+v", d)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+)
+
+// Encryption schemes that shipped files may be encrypted with
+const (
+	// EncryptionAge encrypts each file in the age format (https://age-encryption.org/v1) to one or more X25519
+	// recipients, so only the holder of a recipient's identity can decrypt it. Files can be decrypted with the age
+	// command line tool as well as by the archiver.
+	EncryptionAge = "age"
+)
+
+// EncryptedExtension is appended to the name of an encrypted file, after the extension of its compression.
+const EncryptedExtension = "age"
+
+// shipEncryptionRecipients are the recipients that shipped files are encrypted to, nil if they are not encrypted.
+var shipEncryptionRecipients []age.Recipient
+
+// configureEncryption loads the recipients named by the storage flags.
+func configureEncryption() error {
+	shipEncryptionRecipients = nil
+	if storageConfig.encryptRecipient == "" {
+		return nil
+	}
+	recipients, err := loadAgeRecipients(storageConfig.encryptRecipient)
+	if err != nil {
+		return fmt.Errorf("recipient: %w", err)
+	}
+	shipEncryptionRecipients = recipients
+	return nil
+}
+
+// shipEncryption returns the name of the scheme that shipped files are encrypted with, or an empty string if they are
+// not encrypted.
+func shipEncryption() string {
+	if shipEncryptionRecipients == nil {
+		return ""
+	}
+	return EncryptionAge
+}
+
+// loadAgeRecipients reads a recipients file, holding one age X25519 public key per line as written by age-keygen or the
+// encryption-keygen command. Blank lines and lines starting with # are ignored.
+func loadAgeRecipients(path string) ([]age.Recipient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	recipients, err := age.ParseRecipients(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	return recipients, nil
+}
+
+// loadAgeIdentities reads an identity file, holding one or more age X25519 private keys as written by age-keygen or
+// the encryption-keygen command.
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	return identities, nil
+}
+
+// newDecryptingReader reads the header of an age encrypted file from r and returns a reader of its plaintext,
+// decrypted with whichever of the identities the file was encrypted to. The reader returns an error rather than io.EOF
+// if the file was truncated.
+func newDecryptingReader(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	return age.Decrypt(r, identities...)
+}
+
+// encryptFile returns a writer that encrypts to w if the export file is encrypted, or that writes to w unchanged if it
+// is not. The writer must be closed once the file has been written, which does not close w.
+func encryptFile(ef *ExportFile, w io.Writer) (io.WriteCloser, error) {
+	if ef.Encryption == "" {
+		return nopWriteCloser{w}, nil
+	}
+	if ef.Encryption != EncryptionAge {
+		return nil, fmt.Errorf("unsupported encryption %q", ef.Encryption)
+	}
+	if shipEncryptionRecipients == nil {
+		return nil, fmt.Errorf("no recipients configured for %s encryption", ef.Encryption)
+	}
+	return age.Encrypt(w, shipEncryptionRecipients...)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+var encryptionKeygenCommand = &cli.Command{
+	Name:  "encryption-keygen",
+	Usage: "Generate an age X25519 identity for encrypting shipped files.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "identity",
+			Usage:    "Path to write the identity to. It is needed to read encrypted files and should not be kept on the archiver's host.",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "recipient",
+			Usage:    "Path to write the recipient to, for use with --encrypt-recipient.",
+			Required: true,
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return fmt.Errorf("generate identity: %w", err)
+		}
+
+		// The identity file is laid out as written by age-keygen
+		id := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().UTC().Format(time.RFC3339), identity.Recipient(), identity)
+		if err := os.WriteFile(cc.String("identity"), []byte(id), 0o600); err != nil {
+			return fmt.Errorf("write identity: %w", err)
+		}
+		if err := os.WriteFile(cc.String("recipient"), []byte(identity.Recipient().String()+"\n"), DefaultFilePerms); err != nil {
+			return fmt.Errorf("write recipient: %w", err)
+		}
+		return nil
+	},
+}
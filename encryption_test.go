@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	defer func(r []age.Recipient) { shipEncryptionRecipients = r }(shipEncryptionRecipients)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	shipEncryptionRecipients = []age.Recipient{identity.Recipient()}
+	ef := &ExportFile{Encryption: EncryptionAge}
+
+	testCases := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "partial chunk", size: 1000},
+		{name: "full chunk", size: 64 * 1024},
+		{name: "several chunks", size: 3*64*1024 + 17},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			plain := make([]byte, tc.size)
+			if _, err := rand.Read(plain); err != nil {
+				t.Fatalf("generate data: %v", err)
+			}
+
+			var enc bytes.Buffer
+			ew, err := encryptFile(ef, &enc)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			if _, err := ew.Write(plain); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if err := ew.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			dr, err := newDecryptingReader(bytes.NewReader(enc.Bytes()), []age.Identity{other, identity})
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			got, err := io.ReadAll(dr)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("decrypted %d bytes that do not match the %d written", len(got), len(plain))
+			}
+
+			// A file cut short must not read as complete
+			if tc.size > 0 {
+				truncated := enc.Bytes()[:enc.Len()-17]
+				if dr, err := newDecryptingReader(bytes.NewReader(truncated), []age.Identity{identity}); err == nil {
+					if _, err := io.ReadAll(dr); err == nil {
+						t.Errorf("got no error reading truncated file, wanted one")
+					}
+				}
+			}
+
+			if _, err := newDecryptingReader(bytes.NewReader(enc.Bytes()), []age.Identity{other}); err == nil {
+				t.Errorf("got no error decrypting with another identity, wanted one")
+			}
+		})
+	}
+
+	if _, err := encryptFile(&ExportFile{Encryption: "x25519-aes256gcm"}, io.Discard); err == nil {
+		t.Errorf("expected an error for an unsupported encryption scheme")
+	}
+}
+
+func TestEncryptionKeygen(t *testing.T) {
+	dir := t.TempDir()
+	idPath, recipientPath := filepath.Join(dir, "archive.key"), filepath.Join(dir, "archive.pub")
+
+	app := &cli.App{Commands: []*cli.Command{encryptionKeygenCommand}}
+	if err := app.Run([]string{"archiver", "encryption-keygen", "--identity", idPath, "--recipient", recipientPath}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(idPath); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("got identity file %v (%v), wanted mode 0600", info, err)
+	}
+
+	// The keys can be read back, and by age itself
+	identities, err := loadAgeIdentities(idPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients, err := loadAgeRecipients(recipientPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enc bytes.Buffer
+	ew, err := age.Encrypt(&enc, recipients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(ew, "1005360,messages\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dr, err := newDecryptingReader(&enc, identities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(dr); err != nil || string(got) != "1005360,messages\n" {
+		t.Errorf("got %q (%v) decrypting with the generated identity", got, err)
+	}
+
+	if _, err := loadAgeRecipients(idPath); err == nil {
+		t.Errorf("expected an error reading an identity as a recipient")
+	}
+}
+
+func TestEncryptedFilename(t *testing.T) {
+	ef := &ExportFile{Date: Date{2021, 8, 2}, Network: "mainnet", TableName: "messages", Schema: 1, Format: "csv", Compression: CompressionByName["gz"], Encryption: EncryptionAge}
+	if got, want := ef.Filename(), "messages-2021-08-02.csv.gz.age"; got != want {
+		t.Errorf("got file name %q, wanted %q", got, want)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +18,8 @@ import (
 	"github.com/filecoin-project/lily/commands"
 	"github.com/filecoin-project/lily/lens/lily"
 	"github.com/filecoin-project/lily/schedule"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
 	"github.com/ipfs/go-cid"
 	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
@@ -25,34 +28,52 @@ import (
 var ErrJobNotFound = errors.New("job not found")
 
 type ExportManifest struct {
-	Period  ExportPeriod
-	Network string
-	Files   []*ExportFile
+	Period      ExportPeriod
+	Network     string
+	Files       []*ExportFile
+	Provisional bool   // the period is exported before it is final, see provisionalManifestForPeriod
+	Report      string // path of the processing report shipped for the period, set when it is shipped
+	Group       string // name of the task group when the period's walk is split, see splitManifest
 }
 
-func manifestForDate(ctx context.Context, d Date, network string, genesisTs int64, shipPath string, schemaVersion int, allowedTables []Table, compression Compression) (*ExportManifest, error) {
-	p := firstExportPeriod(genesisTs)
-
-	if p.Date.After(d) {
-		return nil, fmt.Errorf("date is before genesis: %s", d.String())
-	}
-
-	// Iteration here guarantees we are always consistent with height ranges
-	for p.Date != d {
-		p = p.Next()
+func manifestForDate(ctx context.Context, d Date, network string, genesisTs int64, sh Shipper, schemaVersion int, allowedTables []Table, targets []ShipTarget) (*ExportManifest, error) {
+	p, err := exportPeriodForDate(d, genesisTs)
+	if err != nil {
+		return nil, err
 	}
 
-	return manifestForPeriod(ctx, p, network, genesisTs, shipPath, schemaVersion, allowedTables, compression)
+	return manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, allowedTables, targets)
 }
 
-func manifestForPeriod(ctx context.Context, p ExportPeriod, network string, genesisTs int64, shipPath string, schemaVersion int, allowedTables []Table, compression Compression) (*ExportManifest, error) {
+// manifestForPeriod creates a manifest listing a file for each allowed table expected in the period, for each of the
+// ship targets.
+func manifestForPeriod(ctx context.Context, p ExportPeriod, network string, genesisTs int64, sh Shipper, schemaVersion int, allowedTables []Table, targets []ShipTarget) (*ExportManifest, error) {
 	em := &ExportManifest{
 		Period:  p,
 		Network: network,
 	}
 
+	// Files that were part way through shipping when the archiver stopped may be present but incomplete
+	unfinished, err := unfinishedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("load file states: %w", err)
+	}
+
+	// Files removed by the retention policy remain shipped
+	pruned, err := prunedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("load pruned files: %w", err)
+	}
+
 	networkVersions := NetworkVersionsBetweenHeights(abi.ChainEpoch(p.StartHeight), abi.ChainEpoch(p.EndHeight))
 
+	annotations, err := loadAnnotations()
+	if err != nil {
+		return nil, fmt.Errorf("load annotations: %w", err)
+	}
+
+	tc := currentTableConfig(network)
+
 	for _, t := range TablesBySchema[schemaVersion] {
 		allowed := false
 		for i := range allowedTables {
@@ -67,7 +88,7 @@ func manifestForPeriod(ctx context.Context, p ExportPeriod, network string, gene
 
 		expected := false
 		for _, nv := range networkVersions {
-			if t.NetworkVersionRange.From <= nv && t.NetworkVersionRange.To >= nv {
+			if t.supportedAtVersion(nv) {
 				expected = true
 				break
 			}
@@ -76,27 +97,49 @@ func manifestForPeriod(ctx context.Context, p ExportPeriod, network string, gene
 			continue
 		}
 
-		f := ExportFile{
-			Date:        em.Period.Date,
-			Schema:      schemaVersion,
-			Network:     network,
-			TableName:   t.Name,
-			Format:      "csv", // hardcoded for now
-			Compression: compression,
-			Shipped:     true,
-			Cid:         cid.Undef,
-		}
+		annotation := annotations.Find(network, t.Name, em.Period.Date)
+		for _, target := range tc.TargetsForTable(t.Name, targets) {
+			f := ExportFile{
+				Date:        em.Period.Date,
+				Hour:        em.Period.Hour,
+				Length:      em.Period.Length(),
+				StartHeight: em.Period.StartHeight,
+				EndHeight:   em.Period.EndHeight,
+				Ranged:      em.Period.Ranged || storageConfig.fileNaming == FileNamingHeightRange,
+				Schema:      schemaVersion,
+				Network:     network,
+				TableName:   t.Name,
+				Format:      target.Format,
+				Compression: target.Compression,
+				Encryption:  shipEncryption(),
+				Shipped:     true,
+				Cid:         cid.Undef,
+				Annotation:  annotation,
+			}
 
-		_, err := os.Stat(filepath.Join(shipPath, f.Path()))
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
+			// Files are renamed into place once complete, so temporary files left behind by a crash while one was
+			// being written are never found here
+			_, err := sh.Stat(ctx, f.Path())
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					_, ok := pruned[f.Path()]
+					if !ok {
+						// Sharded tables are shipped as parts listed alongside the unsharded path
+						ok, err = shardListExists(ctx, &f, sh)
+						if err != nil {
+							return nil, err
+						}
+					}
+					f.Shipped = ok
+				} else {
+					return nil, fmt.Errorf("stat: %w", err)
+				}
+			} else if unfinished.Unfinished(f.Path()) {
 				f.Shipped = false
-			} else {
-				return nil, fmt.Errorf("stat: %w", err)
 			}
-		}
 
-		em.Files = append(em.Files, &f)
+			em.Files = append(em.Files, &f)
+		}
 	}
 
 	return em, nil
@@ -105,6 +148,9 @@ func manifestForPeriod(ctx context.Context, p ExportPeriod, network string, gene
 func (em *ExportManifest) FilterTables(allowed []Table) *ExportManifest {
 	out := new(ExportManifest)
 	out.Period = em.Period
+	out.Network = em.Network
+	out.Provisional = em.Provisional
+	out.Group = em.Group
 
 	for _, f := range em.Files {
 		include := false
@@ -123,9 +169,19 @@ func (em *ExportManifest) FilterTables(allowed []Table) *ExportManifest {
 	return out
 }
 
+// TableIsShipped reports whether every file of the table has been shipped.
+func (em *ExportManifest) TableIsShipped(table string) bool {
+	for _, f := range em.Files {
+		if f.TableName == table && !f.Shipped {
+			return false
+		}
+	}
+	return true
+}
+
 func (em *ExportManifest) HasUnshippedFiles() bool {
 	for _, f := range em.Files {
-		if !f.Shipped {
+		if f.NeedsShipping() {
 			return true
 		}
 	}
@@ -148,15 +204,54 @@ func (em *ExportManifest) FilesForTask(task string) []*ExportFile {
 	return files
 }
 
-// ExportPeriod holds the parameters for an export covering a date.
+// ExportPeriod holds the parameters for an export covering a date, or the hour or week starting on a date when the
+// period length is not a day.
 type ExportPeriod struct {
 	Date        Date
+	Hour        int // Hour is the hour of the day that an hourly period starts at
 	StartHeight int64
 	EndHeight   int64
+	Ranged      bool // Ranged indicates the period is an arbitrary height range rather than a calendar day
+}
+
+// String returns the name of the period, see periodName, or the height range of a ranged period.
+func (e *ExportPeriod) String() string {
+	if e.Ranged {
+		return heightRangeString(e.StartHeight, e.EndHeight)
+	}
+	return periodName(e.Length(), e.Date, e.Hour)
+}
+
+// Length returns the configured period length for periods that are not a day, or an empty string for daily and
+// ranged periods.
+func (e *ExportPeriod) Length() string {
+	if e.Ranged || PeriodLength == PeriodDay {
+		return ""
+	}
+	return PeriodLength
 }
 
-// Next returns the following export period which cover the next calendar day.
+// Next returns the following export period, which covers the next hour, day or week.
 func (e *ExportPeriod) Next() ExportPeriod {
+	switch PeriodLength {
+	case PeriodHour:
+		d, hour := e.Date, e.Hour+1
+		if hour == 24 {
+			d, hour = d.Next(), 0
+		}
+		return ExportPeriod{
+			Date:        d,
+			Hour:        hour,
+			StartHeight: e.EndHeight + 1,
+			EndHeight:   e.EndHeight + secondsInHour/BlockDelay,
+		}
+	case PeriodWeek:
+		return ExportPeriod{
+			Date:        DateFromTime(periodStartAfter(e.Date.Time())),
+			StartHeight: e.EndHeight + 1,
+			EndHeight:   e.EndHeight + 7*EpochsInDay,
+		}
+	}
 	return ExportPeriod{
 		Date:        e.Date.Next(),
 		StartHeight: e.EndHeight + 1,
@@ -164,21 +259,47 @@ func (e *ExportPeriod) Next() ExportPeriod {
 	}
 }
 
-// firstExportPeriod returns the first period that should be exported. This is the period covering the day
-// from genesis to 23:59:59 UTC the same day.
+// exportPeriodForDate returns the export period covering the start of a date, which is the daily period for the date,
+// the first hourly period of the date or the weekly period holding the date.
+func exportPeriodForDate(d Date, genesisTs int64) (ExportPeriod, error) {
+	p := firstExportPeriod(genesisTs)
+
+	if p.Date.After(d) {
+		return ExportPeriod{}, fmt.Errorf("date is before genesis: %s", d.String())
+	}
+
+	// Iteration here guarantees we are always consistent with height ranges
+	start := UnixToHeight(d.Time().Unix(), genesisTs)
+	for p.EndHeight < start {
+		p = p.Next()
+	}
+	return p, nil
+}
+
+// exportPeriodForHeight returns the export period that covers a height.
+func exportPeriodForHeight(height int64, genesisTs int64) ExportPeriod {
+	// Iteration here guarantees we are always consistent with height ranges
+	p := firstExportPeriod(genesisTs)
+	for p.EndHeight < height {
+		p = p.Next()
+	}
+	return p
+}
+
+// firstExportPeriod returns the first period that should be exported. This is the period covering the day, hour or
+// week from genesis to the start of the next period, such as from genesis to 23:59:59 UTC the same day.
 func firstExportPeriod(genesisTs int64) ExportPeriod {
 	genesisDt := time.Unix(genesisTs, 0).UTC()
-	midnightEpochAfterGenesis := midnightEpochForTs(genesisDt.AddDate(0, 0, 1).Unix(), genesisTs)
 
-	return ExportPeriod{
-		Date: Date{
-			Year:  genesisDt.Year(),
-			Month: int(genesisDt.Month()),
-			Day:   genesisDt.Day(),
-		},
+	p := ExportPeriod{
+		Date:        DateFromTime(genesisDt),
 		StartHeight: 0,
-		EndHeight:   midnightEpochAfterGenesis - 1,
+		EndHeight:   UnixToHeight(periodStartAfter(genesisDt).Unix(), genesisTs) - 1,
+	}
+	if PeriodLength == PeriodHour {
+		p.Hour = genesisDt.Hour()
 	}
+	return p
 }
 
 // firstExportPeriodAfter returns the first period that should be exported at or after a specified minimum height.
@@ -192,37 +313,127 @@ func firstExportPeriodAfter(minHeight int64, genesisTs int64) ExportPeriod {
 	return p
 }
 
-// Returns the height at midnight UTC (the start of the day) on the given date
-func midnightEpochForTs(ts int64, genesisTs int64) int64 {
-	t := time.Unix(ts, 0).UTC()
-	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
-	return UnixToHeight(midnight.Unix(), genesisTs)
+// exportPeriodForRange returns a period covering an arbitrary range of heights, inclusive. The date of the period is
+// the date of the start height and determines the year directory that files are shipped to.
+func exportPeriodForRange(from, to int64, genesisTs int64) ExportPeriod {
+	return ExportPeriod{
+		Date:        DateFromTs(HeightToUnix(from, genesisTs)),
+		StartHeight: from,
+		EndHeight:   to,
+		Ranged:      true,
+	}
+}
+
+func heightRangeString(from, to int64) string {
+	return fmt.Sprintf("%d__%d", from, to)
+}
+
+const (
+	FileNamingDate        = "date"         // files are named by the date they cover, such as messages-2021-08-02
+	FileNamingHeightRange = "height-range" // files are named by the heights they cover, such as messages-1005360__1008239
+)
+
+// applyFileNaming names a daily export file by its height range when the height-range file naming is configured,
+// setting the heights from the file's date.
+func applyFileNaming(ef *ExportFile, genesisTs int64) error {
+	if ef.Ranged || storageConfig.fileNaming != FileNamingHeightRange {
+		return nil
+	}
+
+	p, err := exportPeriodForDate(ef.Date, genesisTs)
+	if err != nil {
+		return err
+	}
+	ef.StartHeight, ef.EndHeight, ef.Ranged = p.StartHeight, p.EndHeight, true
+	return nil
 }
 
 type ExportFile struct {
-	Date        Date
-	Schema      int
-	Network     string
-	TableName   string
-	Format      string
-	Compression Compression
-	Shipped     bool // Shipped indicates that the file has been compressed and placed in the shared filesystem
-	Cid         cid.Cid
+	Date             Date
+	Hour             int    // Hour is the hour of the day that the file starts at when it covers an hourly period
+	Length           string // Length is the length of the period the file covers when it is not a day, see ExportPeriod.Length
+	StartHeight      int64
+	EndHeight        int64
+	Ranged           bool // Ranged files are named by their height range rather than their date
+	Schema           int
+	Network          string
+	TableName        string
+	Format           string
+	Compression      Compression
+	Encryption       string        // Encryption is the scheme the compressed file is encrypted with, empty if it is not encrypted
+	Shipped          bool          // Shipped indicates that the file has been compressed and placed in the shared filesystem
+	Size             int64         // Size is the size of the compressed file, set when the file is shipped
+	SHA256           string        // SHA256 is the hex encoded checksum of the compressed file, set when the file is shipped
+	Rows             int64         // Rows is the number of rows exported, set when the file is shipped
+	UncompressedSize int64         // UncompressedSize is the size of the csv the file was compressed from, set when the file is compressed
+	Cid              cid.Cid       // Cid is the CIDv1 of the raw contents of the compressed file, set when the file is shipped
+	IPFSCid          cid.Cid       // IPFSCid is the root of the file as added to IPFS, set when the file is shipped to IPFS
+	Annotation       *Annotation   // Annotation is set when the file has been marked as known bad and should not be exported
+	Shard            *ShardRange   // Shard is set when the file is a single part of a sharded table's file
+	Parts            []*ExportFile // Parts are the files a sharded table's file was shipped as, set when the file is shipped
+	Provisional      bool          // Provisional files are exported before the period is final and shipped beneath the provisional prefix
+	Provenance       bool          // Provenance is set when a csv file begins with a provenance comment line, set when the file is compressed
+	Dictionary       uint32        // Dictionary is the id of the zstd dictionary the file was compressed with, set when the file is compressed
+}
+
+// NeedsShipping reports whether the file is missing from the shared filesystem and should be exported.
+func (e *ExportFile) NeedsShipping() bool {
+	return !e.Shipped && e.Annotation == nil
 }
 
 // Path returns the path and file name that the export file should be written to.
 func (e *ExportFile) Path() string {
-	filename := e.Filename()
-	return filepath.Join(e.Network, e.Format, strconv.Itoa(e.Schema), e.TableName, strconv.Itoa(e.Date.Year), filename)
+	dir := defaultFileDir(e)
+	if fileLayout != nil {
+		dir = fileLayout.Dir(e)
+		if t, ok := TablesByName[e.TableName]; ok && t.Experimental {
+			dir = filepath.Join(ExperimentalPrefix, dir)
+		}
+	}
+	path := filepath.Join(dir, e.Filename())
+	if e.Provisional {
+		return filepath.Join(ProvisionalPrefix, path)
+	}
+	return path
+}
+
+// tableDirForFile returns the directory of an export file's table, which holds its ancillary files and table index
+// whatever the layout of the file itself.
+func tableDirForFile(e *ExportFile) string {
+	t, ok := TablesByName[e.TableName]
+	if !ok {
+		t = Table{Name: e.TableName}
+	}
+	return t.ShipDir(e.Network, e.Format, e.Schema)
+}
+
+// defaultFileDir returns the directory that an export file is written to when no layout is configured, which is the
+// directory for its year, or hourly or weekly directory, within its table's directory.
+func defaultFileDir(e *ExportFile) string {
+	return filepath.Join(tableDirForFile(e), periodDir(e.Length, e.Date))
 }
 
 // Filename returns file name that the export file should be written to.
 func (e *ExportFile) Filename() string {
-	return fmt.Sprintf("%s-%s.%s.%s", e.TableName, e.Date.String(), e.Format, e.Compression.Extension)
+	name := e.String()
+	if e.Shard != nil {
+		name = fmt.Sprintf("%s.part-%03d", name, e.Shard.Part)
+	}
+	name = fmt.Sprintf("%s.%s", name, e.Format)
+	if e.Compression.Extension != "" {
+		name = fmt.Sprintf("%s.%s", name, e.Compression.Extension)
+	}
+	if e.Encryption != "" {
+		name = fmt.Sprintf("%s.%s", name, EncryptedExtension)
+	}
+	return name
 }
 
 func (e *ExportFile) String() string {
-	return fmt.Sprintf("%s-%s", e.TableName, e.Date.String())
+	if e.Ranged {
+		return fmt.Sprintf("%s-%s", e.TableName, heightRangeString(e.StartHeight, e.EndHeight))
+	}
+	return fmt.Sprintf("%s-%s", e.TableName, periodName(e.Length, e.Date, e.Hour))
 }
 
 // tasksForManifest calculates the visor tasks needed to produce the unshipped files in the supplied manifest
@@ -230,7 +441,7 @@ func tasksForManifest(em *ExportManifest) []string {
 	tasks := make(map[string]struct{}, 0)
 
 	for _, f := range em.Files {
-		if f.Shipped {
+		if !f.NeedsShipping() {
 			continue
 		}
 		t := TablesByName[f.TableName]
@@ -245,13 +456,9 @@ func tasksForManifest(em *ExportManifest) []string {
 	return tasklist
 }
 
-// walkForManifest creates a walk configuration for the given manifest
-func walkForManifest(em *ExportManifest) (*lily.LilyWalkConfig, error) {
-	walkName, err := unusedWalkName(storageConfig.path, em.Period.Date.String())
-	if err != nil {
-		return nil, fmt.Errorf("walk name: %w", err)
-	}
-
+// walkTasksForManifest returns the tasks run by the walk for the supplied manifest, which always include the consensus
+// task needed for verification.
+func walkTasksForManifest(em *ExportManifest) []string {
 	tasks := tasksForManifest(em)
 
 	// Ensure we always produce the chain_consenus table
@@ -265,6 +472,24 @@ func walkForManifest(em *ExportManifest) (*lily.LilyWalkConfig, error) {
 	if !hasConsensusTask {
 		tasks = append(tasks, "consensus")
 	}
+	return tasks
+}
+
+// walkForManifest creates a walk configuration for the given manifest
+func walkForManifest(em *ExportManifest) (*lily.LilyWalkConfig, error) {
+	suffix := em.Period.String()
+	if em.Group != "" {
+		suffix += "-" + em.Group
+	}
+	if em.Provisional {
+		suffix += ProvisionalWalkSuffix
+	}
+	walkName, err := unusedWalkName(storageConfig.path, suffix)
+	if err != nil {
+		return nil, fmt.Errorf("walk name: %w", err)
+	}
+
+	tasks := walkTasksForManifest(em)
 
 	return &lily.LilyWalkConfig{
 		JobConfig: lily.LilyJobConfig{
@@ -300,7 +525,7 @@ func exportFilePath(exportPath, prefix, name string) string {
 	return filepath.Join(exportPath, fmt.Sprintf("%s-%s.csv", prefix, name))
 }
 
-func processExport(ctx context.Context, em *ExportManifest, shipPath string) error {
+func processExport(ctx context.Context, em *ExportManifest, sh Shipper) error {
 	ll := logger.With("date", em.Period.Date.String(), "from", em.Period.StartHeight, "to", em.Period.EndHeight)
 
 	if !em.HasUnshippedFiles() {
@@ -308,68 +533,239 @@ func processExport(ctx context.Context, em *ExportManifest, shipPath string) err
 		return nil
 	}
 
+	if em.Group == "" && jobConfig.splitWalks && jobConfig.jobType != JobTypeDatabase {
+		if groups := splitManifest(em, walkTaskGroups); len(groups) > 1 {
+			return processExportGroups(ctx, groups, sh)
+		}
+	}
+	if em.Group != "" {
+		ll = ll.With("group", em.Group)
+	}
+
 	for _, f := range em.Files {
-		if !f.Shipped {
+		if f.NeedsShipping() {
 			ll.Debugf("missing table %s", f.TableName)
+		} else if !f.Shipped {
+			ll.Debugf("skipping annotated table %s: %s", f.TableName, f.Annotation.Reason)
 		}
 	}
 
-	exportStartHeightGauge.Set(float64(em.Period.EndHeight + Finality))
+	delay := ExportDelay
+	if em.Provisional {
+		delay = FreshDelay
+		ll = ll.With("provisional", true)
+	} else {
+		exportStartHeightGauge.Set(float64(em.Period.EndHeight + delay))
+	}
 	ll.Info("preparing to export files for shipping")
 
-	// We must wait for one full finality after the end of the period before running the export
-	earliestStartTs := HeightToUnix(em.Period.EndHeight+Finality, networkConfig.genesisTs)
+	// Ship the output of a walk that completed before a restart rather than running another one
+	if resumed, err := resumableWalk(em); err != nil {
+		ll.Errorw("failed to check for completed walk", "error", err)
+	} else if resumed != nil {
+		ll.Infow("shipping output of previously completed walk", "walk", resumed.Name)
+		return shipExport(ctx, em, *resumed, sh)
+	}
+
+	// We must wait for the export delay, one full finality by default, after the end of the period before running
+	// the export
+	earliestStartTs := HeightToUnix(em.Period.EndHeight+delay, networkConfig.genesisTs)
 	if time.Now().Unix() < earliestStartTs {
 		ll.Infof("cannot start export until %s", time.Unix(earliestStartTs, 0).UTC().Format(time.RFC3339))
+		exportProgress.IdleUntil(time.Unix(earliestStartTs, 0))
 	}
 	if err := WaitUntil(ctx, timeIsAfter(earliestStartTs), 0, time.Second*30); err != nil {
 		return fmt.Errorf("failed waiting for earliest export time: %w", err)
 	}
 
-	if err := WaitUntil(ctx, lilyIsSyncedToEpoch(lilyConfig.apiAddr, lilyConfig.apiToken, em, ll), 0, time.Minute*10); err != nil {
-		return fmt.Errorf("failed waiting for lily to sync to required epoch: %w", err)
+	// A database export relies on verification to detect heights that lily has not yet written to the database
+	if jobConfig.jobType != JobTypeDatabase {
+		syncPolicy := requestRetryPolicy()
+		syncPolicy.Interval = time.Minute * 10
+		if err := Poll(ctx, syncPolicy, 0, onLilyNode(func(apiAddr, apiToken string) func(context.Context) (bool, error) {
+			return lilyIsSyncedToEpoch(apiAddr, apiToken, em, ll)
+		}, ll)); err != nil {
+			return fmt.Errorf("failed waiting for lily to sync to required epoch: %w", err)
+		}
 	}
 
 	processExportStartedCounter.Inc()
-	processExportInProgressGauge.Set(1)
+	processExportInProgressGauge.Inc()
 	defer func() {
-		processExportInProgressGauge.Set(0)
+		processExportInProgressGauge.Dec()
 	}()
 
 	var wi WalkInfo
-	if err := WaitUntil(ctx, walkIsCompleted(lilyConfig.apiAddr, lilyConfig.apiToken, em, &wi, ll), 0, time.Second*30); err != nil {
+	walkStart := time.Now()
+	if canShareRangeWalk(em) {
+		// Heights shared with other ranged exports running at the same time are only walked once
+		var err error
+		if wi, err = sharedRangeWalk(ctx, em, ll); err != nil {
+			return fmt.Errorf("failed performing walk: %w", err)
+		}
+	} else if err := Retry(ctx, walkRetryPolicy(), attemptCondition(onLilyNode(func(apiAddr, apiToken string) func(context.Context) (bool, error) {
+		return exportJobIsCompleted(apiAddr, apiToken, em, &wi, ll)
+	}, ll), errWalkFailed)); err != nil {
 		return fmt.Errorf("failed performing walk: %w", err)
 	}
+	recordWalkDuration(ctx, time.Since(walkStart))
 
 	ll.Info("export complete")
-	report, err := verifyTasks(ctx, wi, tasksForManifest(em))
+	if err := recordCompletedWalk(em, wi, tasksForManifest(em)); err != nil {
+		ll.Errorw("failed to record completed walk", "error", err, "walk", wi.Name)
+	}
+
+	return shipExport(ctx, em, wi, sh)
+}
+
+// shipExport verifies the output of a completed walk and ships each file that passes verification. When a repair job is
+// configured, heights that failed verification are repaired and the walk verified again before shipping. The completed
+// walk is forgotten once it no longer needs to be shipped, either because every file was shipped or because a file
+// failed verification and another walk is needed.
+func shipExport(ctx context.Context, em *ExportManifest, wi WalkInfo, sh Shipper) error {
+	ll := logger.With("date", em.Period.Date.String(), "from", em.Period.StartHeight, "to", em.Period.EndHeight)
+	if em.Group != "" {
+		ll = ll.With("group", em.Group)
+	}
+	defer activeWalks.hold(wi.Name)()
+
+	report, err := verifyTasks(ctx, wi, em.Period.StartHeight, em.Period.EndHeight, tasksForManifest(em))
 	if err != nil {
 		return fmt.Errorf("failed to verify export files: %w", err)
 	}
+	if jobConfig.repairJob != "" {
+		repaired, err := repairExport(ctx, em, wi, report, ll)
+		if err != nil {
+			walkRepairErrorsCounter.Inc()
+			ll.Errorw("failed to repair walk", "error", err, "walk", wi.Name)
+		} else if repaired {
+			walkRepairsCounter.Inc()
+			report, err = verifyTasks(ctx, wi, em.Period.StartHeight, em.Period.EndHeight, tasksForManifest(em))
+			if err != nil {
+				return fmt.Errorf("failed to verify repaired export files: %w", err)
+			}
+		}
+	}
 
-	shipFailure := false
-	for task, ts := range report.TaskStatus {
-		if !ts.IsOK() {
-			verifyTableErrorsCounter.Inc()
-			shipFailure = true
-			continue
+	var pending []*ExportFile
+	for _, ef := range em.Files {
+		if ef.NeedsShipping() {
+			pending = append(pending, ef)
 		}
+	}
+	if err := recordFileStage(wi, FileStageWalked, pending...); err != nil {
+		ll.Errorw("failed to record file states", "error", err, "stage", FileStageWalked)
+	}
 
+	shipFailure, verifyFailure := false, false
+	var blockedTables []string
+	shippedTables := map[string]*ExportFile{}
+	var shippedFiles []*ExportFile
+	for task, ts := range report.TaskStatus {
 		files := em.FilesForTask(task)
 		for _, ef := range files {
-			if !ef.Shipped {
-				if err := shipExportFile(ctx, ef, wi, shipPath); err != nil {
+			if ef.NeedsShipping() {
+				level, failed := verificationPolicy.Evaluate(ef.TableName, ts)
+				ar := auditRecordForFile(AuditVerification, em, ef)
+				ar.Walk, ar.Result, ar.Checks = wi.Name, "passed", failed
+				if len(failed) > 0 {
+					ar.Result = level.String()
+				}
+				auditLog.Record(ar)
+				switch level {
+				case StrictnessBlock:
+					verifyTableErrorsCounter.Inc()
+					shipFailure = true
+					verifyFailure = true
+					blockedTables = append(blockedTables, ef.TableName)
+					ll.Errorw("verification failed, not shipping export file", "table", ef.TableName, "checks", strings.Join(failed, ","))
+					continue
+				case StrictnessWarn:
+					verifyTableWarningsCounter.Inc()
+					ll.Warnw("verification failed, shipping export file with warnings", "table", ef.TableName, "checks", strings.Join(failed, ","))
+				}
+				if err := recordFileStage(wi, FileStageVerified, ef); err != nil {
+					ll.Errorw("failed to record file state", "error", err, "stage", FileStageVerified, "file", ef.Path())
+				}
+
+				previous := shippedChecksum(ctx, sh, ef.Path())
+				if err := shipExportFile(ctx, ef, wi, sh); err != nil {
 					shipTableErrorsCounter.Inc()
 					shipFailure = true
 					ll.Errorw("failed to ship export file", "error", err)
+
+					// Walk output holding invalid rows is treated as failing verification so that it is walked again
+					var rve *RowValidationError
+					if errors.As(err, &rve) {
+						rowValidationErrorsCounter.Inc()
+						verifyFailure = true
+						blockedTables = append(blockedTables, ef.TableName)
+						ar := auditRecordForFile(AuditQuarantine, em, ef)
+						ar.Walk, ar.Reason = wi.Name, rve.Error()
+						auditLog.Record(ar)
+					}
 					continue
 				}
-
-				if err := removeExportFile(ctx, ef, wi); err != nil {
-					ll.Errorw("failed to remove export file", "error", err, "file", wi.WalkFile(ef.TableName))
+				ef.Shipped = true
+				ar = auditRecordForFile(AuditFileShipped, em, ef)
+				ar.Walk, ar.Rows, ar.Size, ar.SHA256, ar.PreviousSHA256 = wi.Name, ef.Rows, ef.Size, ef.SHA256, previous
+				auditLog.Record(ar)
+				shippedTables[ef.TableName] = ef
+				shippedFiles = append(shippedFiles, ef)
+				recordShippedFileMetrics(ctx, ef)
+				exportProgress.Touch()
+
+				if ef.Provisional {
+					continue
 				}
+				if err := recordShippedFile(ctx, ef, sh); err != nil {
+					ll.Errorw("failed to record shipped file in catalog", "error", err, "file", ef.Path())
+				}
+			}
+		}
+	}
+
+	discardStreamedFiles(wi)
+
+	if len(shippedFiles) > 0 {
+		if shippingConfig.shipReports && !em.Provisional {
+			path, err := shipProcessingReport(ctx, em, wi, shippedFiles, sh)
+			if err != nil {
+				ll.Errorw("failed to ship processing report", "error", err)
+			} else {
+				em.Report = path
 			}
 		}
+		shippedFiles = append(shippedFiles, shipDeltaFiles(ctx, em, shippedFiles, sh)...)
+		if err := writePeriodManifest(ctx, em, shippedFiles, sh); err != nil {
+			ll.Errorw("failed to write period manifest", "error", err)
+		} else {
+			runTableHooks(ctx, em, shippedFiles, sh)
+		}
+	}
+
+	if len(blockedTables) > 0 {
+		sort.Strings(blockedTables)
+		notifyVerificationFailed(ctx, em, blockedTables)
+	}
+
+	// A table's walk output is only removed once it has been shipped to every target
+	for table, ef := range shippedTables {
+		if !em.TableIsShipped(table) {
+			continue
+		}
+		if err := removeExportFile(ctx, ef, wi); err != nil {
+			ll.Errorw("failed to remove export file", "error", err, "file", wi.WalkFile(ef.TableName))
+		}
+	}
+
+	if !shipFailure || verifyFailure {
+		if err := forgetCompletedWalk(em); err != nil {
+			ll.Errorw("failed to remove completed walk", "error", err, "walk", wi.Name)
+		}
+		if err := forgetWalkFileStates(wi); err != nil {
+			ll.Errorw("failed to remove file states", "error", err, "walk", wi.Name)
+		}
 	}
 
 	if shipFailure {
@@ -379,24 +775,94 @@ func processExport(ctx context.Context, em *ExportManifest, shipPath string) err
 	return nil
 }
 
-func exportIsProcessed(p ExportPeriod, allowedTables []Table, compression Compression, shipPath string) func(context.Context) (bool, error) {
-	return func(ctx context.Context) (bool, error) {
-		em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, shipPath, storageConfig.schemaVersion, allowedTables, compression)
-		if err != nil {
+// processPeriod claims the period, exports any of its files that have not been shipped and runs the work that follows
+// shipping. It reports whether any files were shipped for the period. An error wrapping ErrPeriodClaimed is returned
+// if another instance holds the period's claim.
+func processPeriod(ctx context.Context, p ExportPeriod, allowedTables []Table, targets []ShipTarget, sh Shipper) (bool, error) {
+	// The period is claimed before its manifest is built so that files shipped by another instance while it held
+	// the claim are seen
+	claim, err := claimPeriod(networkConfig.name, p, false)
+	if err != nil {
+		if errors.Is(err, ErrPeriodClaimed) {
+			periodClaimsContendedCounter.Inc()
+			logger.Infow("period claimed by another instance, waiting", "date", p.Date.String(), "reason", err)
+			return false, err
+		}
+		processExportErrorsCounter.Inc()
+		logger.Errorw("failed to claim period", "error", err, "date", p.Date.String())
+		return false, fmt.Errorf("claim period: %w", err)
+	}
+	defer claim.Release()
+
+	em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, allowedTables, targets)
+	if err != nil {
+		processExportErrorsCounter.Inc()
+		logger.Errorw("failed to create manifest", "error", err, "date", p.Date.String())
+		return false, fmt.Errorf("create manifest: %w", err)
+	}
+	markPublishedFiles(ctx, em)
+
+	pending := em.HasUnshippedFiles()
+	if err := processExport(ctx, em, sh); err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err() // shutting down
+		}
+		processExportErrorsCounter.Inc()
+		ll := logger.With("date", em.Period.Date.String(), "from", em.Period.StartHeight, "to", em.Period.EndHeight)
+		ll.Errorw("failed to process export", "error", err)
+		return false, fmt.Errorf("process export: %w", err)
+	}
+
+	// Destinations that failed to receive files shipped now or earlier are caught up from the ship path
+	if err := syncDestinations(ctx, networkConfig.name, p, sh); err != nil {
+		logger.Errorw("failed to catch up ship destinations", "error", err, "date", p.Date.String())
+	}
+
+	if snapshotConfig.enabled {
+		if err := shipChainSnapshot(ctx, p, networkConfig.name, sh); err != nil {
 			processExportErrorsCounter.Inc()
-			logger.Errorw("failed to create manifest", "error", err, "date", p.Date.String())
-			return false, nil // force a retry
+			logger.Errorw("failed to ship chain snapshot", "error", err, "date", p.Date.String())
+			return false, fmt.Errorf("ship chain snapshot: %w", err)
 		}
+	}
 
-		if err := processExport(ctx, em, shipPath); err != nil {
+	if len(dealsConfig.providers) > 0 {
+		if err := makePeriodDeals(ctx, p, networkConfig.name, sh); err != nil {
 			processExportErrorsCounter.Inc()
-			ll := logger.With("date", em.Period.Date.String(), "from", em.Period.StartHeight, "to", em.Period.EndHeight)
-			ll.Errorw("failed to process export", "error", err)
-			return false, nil // force a retry
+			logger.Errorw("failed to make storage deals", "error", err, "date", p.Date.String())
+			return false, fmt.Errorf("make storage deals: %w", err)
 		}
+	}
 
-		return true, nil
+	if sqliteConfig.enabled && !em.Provisional && !em.HasUnshippedFiles() {
+		if err := buildPeriodDatabase(ctx, networkConfig.name, p, sh); err != nil {
+			processExportErrorsCounter.Inc()
+			logger.Errorw("failed to build period database", "error", err, "date", p.Date.String())
+			return false, fmt.Errorf("build period database: %w", err)
+		}
+	}
+
+	if anchorConfig.wallet != "" && !em.Provisional && !em.HasUnshippedFiles() {
+		if err := anchorPeriod(ctx, networkConfig.name, p, sh); err != nil {
+			processExportErrorsCounter.Inc()
+			logger.Errorw("failed to anchor period", "error", err, "date", p.Date.String())
+			return false, fmt.Errorf("anchor period: %w", err)
+		}
 	}
+
+	if currentWarehouseConfig != nil {
+		if err := loadPeriodIntoWarehouses(ctx, p, networkConfig.name, sh); err != nil {
+			warehouseErrorsCounter.Inc()
+			logger.Errorw("failed to load files into warehouses", "error", err, "date", p.Date.String())
+			return false, fmt.Errorf("load warehouses: %w", err)
+		}
+	}
+
+	if pending {
+		notifyPeriodShipped(ctx, em)
+		runPeriodHooks(ctx, networkConfig.name, p, sh)
+	}
+	return pending, nil
 }
 
 type basicLogger interface {
@@ -421,16 +887,61 @@ func walkIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkIn
 		}
 		ll.Debugw(fmt.Sprintf("using tasks %s", strings.Join(walkCfg.JobConfig.Tasks, ",")), "walk", walkCfg.JobConfig.Name)
 
+		// A walk that was running when a previous run of the archiver shut down is adopted rather than repeated
+		var handoff *HandedOffWalk
+		if !em.Provisional {
+			handoff, err = handedOffWalk(em)
+		}
+		if err != nil {
+			ll.Errorw("failed to check for handed off walk", "error", err)
+		} else if handoff != nil && handoff.Lily != apiAddr {
+			ll.Infow("handed off walk was started on another lily node", "walk", handoff.Walk, "job_id", handoff.JobID, "lily", handoff.Lily)
+			handoff = nil
+		}
+
 		var jobID schedule.JobID
 		ll.Infow("starting walk", "walk", walkCfg.JobConfig.Name)
-		if err := WaitUntil(ctx, jobHasBeenStarted(lilyConfig.apiAddr, lilyConfig.apiToken, walkCfg, &jobID, ll), 0, time.Second*30); err != nil {
+		if err := Poll(ctx, requestRetryPolicy(), 0, jobHasBeenStarted(apiAddr, apiToken, walkCfg, "", handoff, &jobID, ll)); err != nil {
 			walkErrorsCounter.Inc()
 			ll.Errorw(fmt.Sprintf("failed starting walk: %v", err), "walk", walkCfg.JobConfig.Name)
 			return false, nil
 		}
+		// The walk is tracked in memory from here and only handed off again if waiting for it is interrupted
+		if err := forgetHandedOffWalk(em); err != nil {
+			ll.Errorw("failed to remove handed off walk", "error", err)
+		}
+		ar := newAuditRecord(AuditWalkStarted, em.Network, em.Period)
+		ar.Walk, ar.JobID, ar.Lily, ar.Tasks = walkCfg.JobConfig.Name, jobID, apiAddr, walkCfg.JobConfig.Tasks
+		auditLog.Record(ar)
+
+		wi := WalkInfo{
+			Name:   walkCfg.JobConfig.Name,
+			Path:   storageConfig.path,
+			Format: "csv",
+		}
+
+		// Walk output is compressed as it is written when streaming compression is enabled
+		streams := startWalkStreams(ctx, em, wi)
+		completed := false
+		defer func() {
+			if !completed {
+				streams.Abort()
+			}
+		}()
 
 		ll.Infow("waiting for walk to complete", "walk", walkCfg.JobConfig.Name, "job_id", jobID)
-		if err := WaitUntil(ctx, jobHasEnded(lilyConfig.apiAddr, lilyConfig.apiToken, jobID, ll), time.Second*30, time.Second*30); err != nil {
+		stopProgress := trackWalkProgress(ctx, wi, jobID, walkCfg.From, walkCfg.To, walkCfg.JobConfig.Tasks, ll)
+		err = Poll(ctx, requestRetryPolicy(), DefaultPollInterval, jobHasEnded(apiAddr, apiToken, jobID, ll))
+		stopProgress()
+		if err != nil {
+			if ctx.Err() != nil && !em.Provisional {
+				// The archiver is shutting down, leave the walk running for the next run to adopt
+				ll.Infow("handing off running walk", "walk", walkCfg.JobConfig.Name, "job_id", jobID)
+				if err := recordHandedOffWalk(em, walkCfg.JobConfig.Name, jobID, apiAddr, walkCfg.JobConfig.Tasks); err != nil {
+					ll.Errorw("failed to record handed off walk", "error", err, "walk", walkCfg.JobConfig.Name, "job_id", jobID)
+				}
+				return false, ctx.Err()
+			}
 			walkErrorsCounter.Inc()
 			ll.Errorw(fmt.Sprintf("failed waiting for walk to finish: %v", err), "walk", walkCfg.JobConfig.Name, "job_id", jobID)
 			return false, nil
@@ -438,7 +949,7 @@ func walkIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkIn
 
 		ll.Infow("walk complete", "walk", walkCfg.JobConfig.Name, "job_id", jobID)
 		var jobListRes schedule.JobListResult
-		if err := WaitUntil(ctx, jobGetResult(lilyConfig.apiAddr, lilyConfig.apiToken, walkCfg.JobConfig.Name, jobID, &jobListRes, ll), 0, time.Second*30); err != nil {
+		if err := Poll(ctx, requestRetryPolicy(), 0, jobGetResult(apiAddr, apiToken, walkCfg.JobConfig.Name, jobID, &jobListRes, ll)); err != nil {
 			walkErrorsCounter.Inc()
 			ll.Errorw(fmt.Sprintf("failed waiting walk result: %v", err), "walk", walkCfg.JobConfig.Name, "job_id", jobID)
 			return false, nil
@@ -446,15 +957,13 @@ func walkIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkIn
 
 		if jobListRes.Error != "" {
 			walkErrorsCounter.Inc()
+			ar := newAuditRecord(AuditWalkFailed, em.Network, em.Period)
+			ar.Walk, ar.JobID, ar.Lily, ar.Error = walkCfg.JobConfig.Name, jobID, apiAddr, jobListRes.Error
+			auditLog.Record(ar)
 			ll.Errorw(fmt.Sprintf("walk failed: %s", jobListRes.Error), "walk", walkCfg.JobConfig.Name, "job_id", jobID)
 			return false, nil
 		}
 
-		wi := WalkInfo{
-			Name:   walkCfg.JobConfig.Name,
-			Path:   storageConfig.path,
-			Format: "csv",
-		}
 		err = touchExportFiles(ctx, em, wi)
 		if err != nil {
 			walkErrorsCounter.Inc()
@@ -462,6 +971,9 @@ func walkIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkIn
 			return false, nil
 		}
 
+		completed = true
+		streams.Finish()
+
 		*walkInfo = wi
 		return true, nil
 	}
@@ -469,24 +981,27 @@ func walkIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkIn
 
 func jobHasEnded(apiAddr string, apiToken string, id schedule.JobID, ll basicLogger) func(context.Context) (bool, error) {
 	// To ensure this is robust in the case of a lily node restarting or being temporarily unresponsive, this
-	// function opens its own api connection and never returns an error unless the job cannot be found
+	// function opens its own api connection for each check. Failures to reach the node are transient, while a job
+	// that cannot be found or a node that has failed its health checks while another node is available are permanent
 	return func(ctx context.Context) (bool, error) {
+		if lilyNodes.ShouldFailOver(apiAddr) {
+			return false, errLilyNodeUnavailable
+		}
 		api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
 		if err != nil {
 			lilyConnectionErrorsCounter.Inc()
 			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
-			return false, nil
+			return false, fmt.Errorf("connect to lily api: %w", err)
 		}
 		defer closer()
 
 		jr, err := getJobResult(ctx, api, id)
 		if err != nil {
 			lilyJobErrorsCounter.Inc()
-			if errors.Is(err, ErrJobNotFound) {
-				return false, err
+			if !errors.Is(err, ErrJobNotFound) {
+				ll.Errorw("failed to get job result", "error", err, "job_id", id)
 			}
-			ll.Errorf("failed to get job result", "error", err, "job_id", id)
-			return false, nil
+			return false, err
 		}
 
 		if jr.Running {
@@ -496,40 +1011,54 @@ func jobHasEnded(apiAddr string, apiToken string, id schedule.JobID, ll basicLog
 	}
 }
 
-// note: jobID is an out parameter and the name in walkCfg may be updated with an existing name
-func jobHasBeenStarted(apiAddr string, apiToken string, walkCfg *lily.LilyWalkConfig, jobID *schedule.JobID, ll basicLogger) func(context.Context) (bool, error) {
+// note: jobID is an out parameter and the name in walkCfg may be updated with an existing name. When queue is not
+// empty the walk is started as a notify walk that enqueues tipsets for tipset workers consuming from the queue. A
+// walk handed off by a previous run is adopted if it is still known to the node, even if it has since ended.
+func jobHasBeenStarted(apiAddr string, apiToken string, walkCfg *lily.LilyWalkConfig, queue string, handoff *HandedOffWalk, jobID *schedule.JobID, ll basicLogger) func(context.Context) (bool, error) {
 	return func(ctx context.Context) (bool, error) {
+		if lilyNodes.ShouldFailOver(apiAddr) {
+			return false, errLilyNodeUnavailable
+		}
 		api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
 		if err != nil {
 			lilyConnectionErrorsCounter.Inc()
 			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
-			return false, nil
+			return false, fmt.Errorf("connect to lily api: %w", err)
 		}
 		defer closer()
 
 		// Check if walk is already running
-		jr, err := findExistingJob(ctx, api, walkCfg)
+		jr, err := findExistingJob(ctx, api, walkCfg, queue, handoff)
 		if err != nil {
 			if !errors.Is(err, ErrJobNotFound) {
 				lilyJobErrorsCounter.Inc()
 				ll.Errorw("failed to read jobs", "error", err)
-				return false, nil
+				return false, fmt.Errorf("read jobs: %w", err)
 			}
 
 			// No existing job, start a new walk
-			res, err := api.LilyWalk(ctx, walkCfg)
+			var res *schedule.JobSubmitResult
+			if queue == "" {
+				res, err = api.LilyWalk(ctx, walkCfg)
+			} else {
+				res, err = api.LilyWalkNotify(ctx, &lily.LilyWalkNotifyConfig{WalkConfig: *walkCfg, Queue: queue})
+			}
 			if err != nil {
 				ll.Errorw("failed to create walk", "error", err, "walk", walkCfg.JobConfig.Name)
-				return false, nil
+				return false, fmt.Errorf("create walk: %w", err)
 			}
 
 			// we're done
 			*jobID = res.ID
-			return true, err
+			return true, nil
 
 		}
 
-		ll.Infow("adopting running walk that matched required job", "job_id", jr.ID, "walk", jr.Name)
+		if jr.Running {
+			ll.Infow("adopting running walk that matched required job", "job_id", jr.ID, "walk", jr.Name)
+		} else {
+			ll.Infow("adopting handed off walk that ended while stopped", "job_id", jr.ID, "walk", jr.Name)
+		}
 		*jobID = jr.ID
 		walkCfg.JobConfig.Name = jr.Name
 		return true, nil
@@ -538,11 +1067,14 @@ func jobHasBeenStarted(apiAddr string, apiToken string, walkCfg *lily.LilyWalkCo
 
 func jobGetResult(apiAddr string, apiToken string, walkName string, walkID schedule.JobID, jobListRes *schedule.JobListResult, ll basicLogger) func(context.Context) (bool, error) {
 	return func(ctx context.Context) (bool, error) {
+		if lilyNodes.ShouldFailOver(apiAddr) {
+			return false, errLilyNodeUnavailable
+		}
 		api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
 		if err != nil {
 			lilyConnectionErrorsCounter.Inc()
 			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
-			return false, nil
+			return false, fmt.Errorf("connect to lily api: %w", err)
 		}
 		defer closer()
 
@@ -550,7 +1082,7 @@ func jobGetResult(apiAddr string, apiToken string, walkName string, walkID sched
 		if err != nil {
 			lilyJobErrorsCounter.Inc()
 			ll.Errorf("failed reading job result for walk %s with id %d: %v", walkName, walkID, err)
-			return false, nil
+			return false, fmt.Errorf("read job result: %w", err)
 		}
 		*jobListRes = *res
 		return true, nil
@@ -579,22 +1111,41 @@ func getJobResult(ctx context.Context, api lily.LilyAPI, id schedule.JobID) (*sc
 	return nil, ErrJobNotFound
 }
 
-func findExistingJob(ctx context.Context, api lily.LilyAPI, walkCfg *lily.LilyWalkConfig) (*schedule.JobListResult, error) {
+// findExistingJob returns a running job that produces the output required by walkCfg. When a handed off walk is given
+// its job is returned if the node still knows it, whether or not it is running, since a walk that ended while the
+// archiver was stopped has already written its output.
+func findExistingJob(ctx context.Context, api lily.LilyAPI, walkCfg *lily.LilyWalkConfig, queue string, handoff *HandedOffWalk) (*schedule.JobListResult, error) {
 	jobs, err := api.LilyJobList(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list jobs: %w", err)
 	}
 
+	if handoff != nil {
+		for _, jr := range jobs {
+			if jr.ID == handoff.JobID && jr.Name == handoff.Walk && jr.Type == "walk" && stringSliceContainsAll(jr.Tasks, walkCfg.JobConfig.Tasks) {
+				return &jr, nil
+			}
+		}
+	}
+
 	for _, jr := range jobs {
-		if jr.Type != "walk" {
-			continue
+		if queue == "" {
+			if jr.Type != "walk" || jr.Params["storage"] != walkCfg.JobConfig.Storage {
+				continue
+			}
+		} else {
+			// Notify walks have no storage, their output is written by the tipset workers
+			if jr.Type != "walk-notify" || jr.Params["queue"] != queue {
+				continue
+			}
 		}
 
 		if !jr.Running {
 			continue
 		}
 
-		if jr.Params["storage"] != walkCfg.JobConfig.Storage {
+		// Provisional walks run before the period is final so are never adopted for a final export, or the reverse
+		if strings.HasSuffix(jr.Name, ProvisionalWalkSuffix) != strings.HasSuffix(walkCfg.JobConfig.Name, ProvisionalWalkSuffix) {
 			continue
 		}
 
@@ -619,9 +1170,9 @@ func findExistingJob(ctx context.Context, api lily.LilyAPI, walkCfg *lily.LilyWa
 }
 
 type WalkInfo struct {
-	Name   string // name of walk
-	Path   string // storage output path
-	Format string // usually csv
+	Name   string `json:"name"`   // name of walk
+	Path   string `json:"path"`   // storage output path
+	Format string `json:"format"` // usually csv
 }
 
 // WalkFile returns the path to the file that the walk would write for the given table
@@ -690,14 +1241,14 @@ func lilyIsSyncedToEpoch(apiAddr string, apiToken string, em *ExportManifest, ll
 		if err != nil {
 			lilyConnectionErrorsCounter.Inc()
 			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
-			return false, nil
+			return false, fmt.Errorf("connect to lily api: %w", err)
 		}
 		defer closer()
 
 		height, err := getLilyChainHeight(ctx, api)
 		if err != nil {
 			ll.Errorw(fmt.Sprintf("failed to get chain head: %v", err))
-			return false, nil
+			return false, fmt.Errorf("get chain head: %w", err)
 		}
 
 		if height < em.Period.EndHeight {
@@ -718,6 +1269,27 @@ func getLilyChainHeight(ctx context.Context, api lily.LilyAPI) (int64, error) {
 	return int64(ts.Height()), nil
 }
 
+// getLilyNetworkParams derives the genesis timestamp and block delay of the network the lily node is following. Every
+// tipset is timestamped with the genesis timestamp plus a whole number of block delays, so the block delay can be
+// recovered from the current head.
+func getLilyNetworkParams(ctx context.Context, api lily.LilyAPI) (genesisTs int64, blockDelay int64, err error) {
+	genesis, err := api.ChainGetGenesis(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get genesis: %w", err)
+	}
+	head, err := api.ChainHead(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get chain head: %w", err)
+	}
+	if head.Height() <= 0 {
+		return 0, 0, fmt.Errorf("chain has no epochs after genesis")
+	}
+
+	genesisTs = int64(genesis.MinTimestamp())
+	blockDelay = (int64(head.MinTimestamp()) - genesisTs) / int64(head.Height())
+	return genesisTs, blockDelay, nil
+}
+
 type closerFunc func()
 
 func getLilyAPI(ctx context.Context, apiAddr string, apiToken string) (lily.LilyAPI, closerFunc, error) {
@@ -747,6 +1319,19 @@ func getLilyAPI(ctx context.Context, apiAddr string, apiToken string) (lily.Lily
 	}
 }
 
+// getLotusAPI connects to the v1 full node API of a lotus node.
+func getLotusAPI(ctx context.Context, apiAddr string, apiToken string) (lotusapi.FullNode, closerFunc, error) {
+	dialAddr, err := apiDialAddr(apiAddr, "v1")
+	if err != nil {
+		return nil, nil, fmt.Errorf("api dial addr: %w", err)
+	}
+	api, closer, err := client.NewFullNodeRPCV1(ctx, dialAddr, apiAuthHeader(apiToken))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to lotus: %w", err)
+	}
+	return api, closerFunc(closer), nil
+}
+
 func apiDialAddr(addr string, version string) (string, error) {
 	ma, err := multiaddr.NewMultiaddr(addr)
 	if err == nil {
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+var exportRangeCommand = &cli.Command{
+	Name:   "export-range",
+	Usage:  "Export an arbitrary range of heights, naming the shipped files by height range.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		lilyFlags,
+		jobFlags,
+		storageFlags,
+		stateFlags,
+		auditFlags,
+		claimFlags,
+		warehouseFlags,
+		verificationFlags,
+		shippingFlags,
+		destinationsFlags,
+		hooksFlags,
+		objectStoreFlags,
+		publishedFlags,
+		ipfsFlags,
+		tableConfigFlags,
+		notifyFlags,
+		queueFlags,
+		snapshotFlags,
+		signingFlags,
+		anchorFlags,
+		sqliteFlags,
+		exportFlags,
+		[]cli.Flag{
+			&cli.Int64Flag{
+				Name:     "from",
+				Usage:    "First height of the range to export.",
+				Required: true,
+			},
+			&cli.Int64Flag{
+				Name:     "to",
+				Usage:    "Last height of the range to export, inclusive.",
+				Required: true,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		if lilyNodes.Len() > 1 {
+			go lilyNodes.Run(ctx, lilyConfig.healthInterval)
+		}
+
+		from, to := cc.Int64("from"), cc.Int64("to")
+		if from < 0 {
+			return fmt.Errorf("from height must not be negative")
+		}
+		if to < from {
+			return fmt.Errorf("to height must not be less than from height")
+		}
+
+		allowedTables, err := allowedTablesFromFlags(cc)
+		if err != nil {
+			return err
+		}
+		allowedTables = currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to ship files: %w", err)
+		}
+		sh = withShipDestinations(sh)
+
+		if err := loadZstdDictionaries(ctx, sh); err != nil {
+			return err
+		}
+
+		if shippingConfig.stagingPath != "" {
+			if err := verifyShipPath(shippingConfig.stagingPath); err != nil {
+				return fmt.Errorf("unable to write to staging path: %w", err)
+			}
+		}
+
+		if err := ensureAncillaryFiles(ctx, sh, allowedTables); err != nil {
+			return fmt.Errorf("unable to ensure ancillary files exist: %w", err)
+		}
+
+		p := exportPeriodForRange(from, to, networkConfig.genesisTs)
+
+		// Retry this export until it works. Ranged exports are not added to the height index, which only covers
+		// daily files.
+		var shipped bool
+		if err := runExportJob(ctx, p, allowedTables, JobPriorityHead, func(ctx context.Context) (err error) {
+			shipped, err = processPeriod(ctx, p, allowedTables, targets, sh)
+			return err
+		}); err != nil {
+			if ctx.Err() != nil {
+				logger.Info("shutting down")
+				return nil
+			}
+			return fmt.Errorf("fatal error processing export: %w", err)
+		}
+
+		logger.Infow("range export complete", "from", p.StartHeight, "to", p.EndHeight, "shipped", shipped)
+		return nil
+	},
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// isTempFile reports whether name is a temporary file that is written alongside its destination and renamed into
+// place once complete. Temporary files may be left behind by a process that died while writing them and are never
+// complete.
+func isTempFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && (strings.HasSuffix(base, ".tmp") || strings.HasSuffix(base, ".stream"))
+}
+
+// syncDir flushes a directory to disk so that files renamed into it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over the destination so readers never observe a
+// partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// copyFile copies a file to a temporary file alongside the destination and renames it into place so readers never
+// observe a partially copied file.
+func copyFile(src, dst string) error {
+	return copyFileThrough(src, dst, nil)
+}
+
+// copyFileThrough copies a file like copyFile, writing the copy through the writer returned by wrap if it is not nil,
+// such as to limit the rate of the copy.
+func copyFileThrough(src, dst string, wrap func(io.Writer) io.Writer) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), DefaultDirPerms); err != nil {
+		return fmt.Errorf("mkdir %q: %w", filepath.Dir(dst), err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	if wrap != nil {
+		w = wrap(tmp)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// moveFile moves a file, falling back to copying when the source and destination are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), DefaultDirPerms); err != nil {
+		return fmt.Errorf("mkdir %q: %w", filepath.Dir(dst), err)
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+
+	return os.Remove(src)
+}
+
+// Link modes control how a staged file is placed into the ship path.
+const (
+	LinkModeAuto     = "auto"     // hardlink, falling back to reflink and then copy
+	LinkModeHardlink = "hardlink" // hardlink only, fails if the paths are on different filesystems
+	LinkModeReflink  = "reflink"  // copy-on-write clone only, fails if the filesystem does not support it
+	LinkModeCopy     = "copy"     // always write a full copy
+)
+
+var errReflinkUnsupported = errors.New("reflink not supported on this platform")
+
+// linkFile places src at dst without writing a second copy of the data when both are on the same filesystem. The
+// file is linked or cloned to a temporary name alongside the destination and then renamed into place, so readers
+// never observe a partial file. Copies are written through the writer returned by wrap if it is not nil.
+func linkFile(src, dst string, mode string, wrap func(io.Writer) io.Writer) error {
+	if err := os.MkdirAll(filepath.Dir(dst), DefaultDirPerms); err != nil {
+		return fmt.Errorf("mkdir %q: %w", filepath.Dir(dst), err)
+	}
+
+	switch mode {
+	case LinkModeHardlink:
+		return hardlinkFile(src, dst)
+	case LinkModeReflink:
+		return reflinkFile(src, dst)
+	case LinkModeCopy:
+		return copyFileThrough(src, dst, wrap)
+	case LinkModeAuto, "":
+		if err := hardlinkFile(src, dst); err == nil {
+			return nil
+		}
+		if err := reflinkFile(src, dst); err == nil {
+			return nil
+		}
+		return copyFileThrough(src, dst, wrap)
+	default:
+		return fmt.Errorf("unknown link mode %q", mode)
+	}
+}
+
+func hardlinkFile(src, dst string) error {
+	tmp, err := tempNameFor(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(src, tmp); err != nil {
+		return fmt.Errorf("link: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+func reflinkFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := cloneFile(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("clone: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// tempNameFor returns an unused name alongside path that a file can be created at before being renamed to path.
+func tempNameFor(path string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return "", fmt.Errorf("remove temp file: %w", err)
+	}
+	return name, nil
+}
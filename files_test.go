@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// checkPlaced checks that dst holds the contents of src and that no temporary files were left alongside it.
+func checkPlaced(t *testing.T, src, dst string) {
+	t.Helper()
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("read placed file: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got contents %q, wanted %q", got, want)
+	}
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	ai, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ai, bi)
+}
+
+func TestLinkFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "staging", "messages.csv.gz")
+	if err := os.MkdirAll(filepath.Dir(src), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("1005360,messages\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	var copied int64
+	wrap := func(w io.Writer) io.Writer { return countingWriter{w: w, n: &copied} }
+
+	for _, mode := range []string{LinkModeHardlink, LinkModeAuto, ""} {
+		dst := filepath.Join(dir, "ship", mode, "messages.csv.gz")
+		if err := linkFile(src, dst, mode, wrap); err != nil {
+			t.Fatalf("%q: %v", mode, err)
+		}
+		checkPlaced(t, src, dst)
+		if !sameFile(t, src, dst) {
+			t.Errorf("%q: file was not hardlinked on the same filesystem", mode)
+		}
+	}
+	if copied != 0 {
+		t.Errorf("linked files were written through the copy writer")
+	}
+
+	dst := filepath.Join(dir, "ship", "copy", "messages.csv.gz")
+	if err := linkFile(src, dst, LinkModeCopy, wrap); err != nil {
+		t.Fatal(err)
+	}
+	checkPlaced(t, src, dst)
+	if sameFile(t, src, dst) || copied == 0 {
+		t.Errorf("copy mode did not write a copy through the writer")
+	}
+
+	// Filesystems without copy-on-write support fail reflinks rather than silently copying
+	dst = filepath.Join(dir, "ship", "reflink", "messages.csv.gz")
+	if err := linkFile(src, dst, LinkModeReflink, nil); err == nil {
+		checkPlaced(t, src, dst)
+	} else if _, statErr := os.Stat(dst); !os.IsNotExist(statErr) {
+		t.Errorf("failed reflink left a file at the destination")
+	}
+
+	if err := linkFile(src, filepath.Join(dir, "ship", "x"), "symlink", nil); err == nil {
+		t.Errorf("expected an error for an unknown link mode")
+	}
+}
+
+// crossDeviceDir returns a directory on a different filesystem to the test's temporary directory, skipping the test
+// if there is none.
+func crossDeviceDir(t *testing.T) string {
+	t.Helper()
+	other, err := os.MkdirTemp("/dev/shm", "archiver-test-")
+	if err != nil {
+		t.Skip("no tmpfs available for a cross device test")
+	}
+	t.Cleanup(func() { os.RemoveAll(other) })
+
+	probe := filepath.Join(other, "probe")
+	if err := os.WriteFile(probe, nil, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(probe, filepath.Join(t.TempDir(), "probe")); !errors.Is(err, syscall.EXDEV) {
+		t.Skip("/dev/shm is on the same filesystem as the temporary directory")
+	}
+	return other
+}
+
+func TestLinkFileCrossDevice(t *testing.T) {
+	other := crossDeviceDir(t)
+	src := filepath.Join(other, "messages.csv.gz")
+	if err := os.WriteFile(src, []byte("1005360,messages\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	ship := t.TempDir()
+
+	dst := filepath.Join(ship, "hardlink", "messages.csv.gz")
+	if err := linkFile(src, dst, LinkModeHardlink, nil); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("got error %v from a cross device hardlink, wanted EXDEV", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("failed hardlink left a file at the destination")
+	}
+
+	var copied int64
+	dst = filepath.Join(ship, "auto", "messages.csv.gz")
+	if err := linkFile(src, dst, LinkModeAuto, func(w io.Writer) io.Writer { return countingWriter{w: w, n: &copied} }); err != nil {
+		t.Fatalf("auto mode did not fall back to copying: %v", err)
+	}
+	checkPlaced(t, src, dst)
+	if sameFile(t, src, dst) || copied == 0 {
+		t.Errorf("auto mode did not write a copy across filesystems")
+	}
+}
+
+func TestMoveFileCrossDevice(t *testing.T) {
+	other := crossDeviceDir(t)
+	src := filepath.Join(other, "messages.csv")
+	if err := os.WriteFile(src, []byte("1005360,messages\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "walk", "messages.csv")
+
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "1005360,messages\n" {
+		t.Errorf("got moved contents %q (%v)", got, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source was not removed after moving across filesystems")
+	}
+}
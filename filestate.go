@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const filesCollection = "files"
+
+// fileStateExpiry is how long the state of a file that was never shipped is kept without being updated. Such state is
+// left behind by walks that were abandoned, for example when the archiver is stopped and the period is later exported
+// by another instance.
+const fileStateExpiry = 7 * 24 * time.Hour
+
+// FileStage is the furthest point an export file has reached on its way to being shipped.
+type FileStage string
+
+const (
+	FileStageWalked     FileStage = "walked"     // the walk producing the file has completed
+	FileStageVerified   FileStage = "verified"   // the walk output for the file passed verification
+	FileStageCompressed FileStage = "compressed" // the file has been compressed and is waiting to be shipped
+	FileStagePinned     FileStage = "pinned"     // the compressed file has been added to IPFS
+	FileStageShipped    FileStage = "shipped"    // the file has been shipped but its ancillary files may not have been
+)
+
+// fileStageOrder gives the position of each stage in the shipping process.
+var fileStageOrder = map[FileStage]int{
+	FileStageWalked:     1,
+	FileStageVerified:   2,
+	FileStageCompressed: 3,
+	FileStagePinned:     4,
+	FileStageShipped:    5,
+}
+
+// Reached reports whether the stage is at or beyond s.
+func (f FileStage) Reached(s FileStage) bool {
+	return fileStageOrder[f] >= fileStageOrder[s]
+}
+
+// FileState records the progress of an export file through shipping so that shipping can resume from the last
+// completed stage after a crash. Files are removed from the collection once they have been shipped, since the ship
+// path then holds all that is needed to know about them, or when the walk that produced them is abandoned.
+//
+// File states are kept in the JSON state store alongside the archiver's other state rather than in an embedded
+// database. The collection only holds files part way through shipping, so it stays small, and each update is written
+// with an atomic rename under the collection lock so a crash leaves either the previous or the new state. Sharing the
+// store also lets command line tools read file states while the archiver runs, which a database holding an exclusive
+// lock on its file for the life of the process would prevent.
+type FileState struct {
+	Path       string     `json:"path"`             // path of the file relative to the ship path
+	Walk       string     `json:"walk"`             // name of the walk that produced the file
+	Stage      FileStage  `json:"stage"`            // furthest stage reached
+	Staged     string     `json:"staged,omitempty"` // location of the compressed file awaiting shipping
+	Rows       int64      `json:"rows,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	SHA256     string     `json:"sha256,omitempty"`
+	IPFSCid    string     `json:"ipfs_cid,omitempty"`
+	Provenance bool       `json:"provenance,omitempty"` // the compressed csv file begins with a provenance comment line
+	Seek       *SeekIndex `json:"seek,omitempty"`       // seek index of the compressed file, if it is seekable
+	Updated    time.Time  `json:"updated"`
+}
+
+// FileStates maps the path of an export file to its state.
+type FileStates map[string]*FileState
+
+// Unfinished reports whether a file found in the ship path may be incomplete. Only files that were compressed can have
+// been placed in the ship path by an interrupted export; state recorded before then belongs to a walk whose output
+// never reached the ship path, so a file found there was shipped by another export.
+func (fs FileStates) Unfinished(path string) bool {
+	st := fs[path]
+	return st != nil && st.Stage.Reached(FileStageCompressed)
+}
+
+// FileStates returns the state of every export file that is part way through shipping.
+func (s *StateStore) FileStates() (FileStates, error) {
+	fs := FileStates{}
+	if err := s.load(filesCollection, &fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// SetFileStates records the state of one or more export files, replacing any previous state for the same paths.
+func (s *StateStore) SetFileStates(states ...*FileState) error {
+	fs := FileStates{}
+	return s.update(filesCollection, &fs, func() error {
+		for _, st := range states {
+			fs[st.Path] = st
+		}
+		return nil
+	})
+}
+
+// AdvanceFileStage records that the export files at the given paths, produced by the named walk, have reached a
+// stage. Files already recorded as being further through shipping the output of the same walk are left unchanged so
+// their progress is not lost when shipping is resumed.
+func (s *StateStore) AdvanceFileStage(walk string, stage FileStage, paths ...string) error {
+	fs := FileStates{}
+	return s.update(filesCollection, &fs, func() error {
+		now := time.Now().UTC()
+		for _, path := range paths {
+			if st := fs[path]; st != nil && st.Walk == walk && st.Stage.Reached(stage) {
+				continue
+			}
+			fs[path] = &FileState{Path: path, Walk: walk, Stage: stage, Updated: now}
+		}
+		return nil
+	})
+}
+
+// RemoveFileState removes the state recorded for an export file.
+func (s *StateStore) RemoveFileState(path string) error {
+	fs := FileStates{}
+	return s.update(filesCollection, &fs, func() error {
+		delete(fs, path)
+		return nil
+	})
+}
+
+// RemoveWalkFileStates removes the state recorded for every export file produced by the named walk.
+func (s *StateStore) RemoveWalkFileStates(walk string) error {
+	fs := FileStates{}
+	return s.update(filesCollection, &fs, func() error {
+		for path, st := range fs {
+			if st.Walk == walk {
+				delete(fs, path)
+			}
+		}
+		return nil
+	})
+}
+
+// ExpireFileStates removes the state of files that were not shipped and have not been updated since the given time,
+// returning the state that remains. Files that reached the ship path are kept until their ancillary files have been
+// shipped.
+func (s *StateStore) ExpireFileStates(before time.Time) (FileStates, error) {
+	fs := FileStates{}
+	if err := s.update(filesCollection, &fs, func() error {
+		for path, st := range fs {
+			if !st.Stage.Reached(FileStageShipped) && st.Updated.Before(before) {
+				delete(fs, path)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// unfinishedFiles returns the state of export files that were part way through shipping, or nil if no state store is
+// configured. State that has expired is removed first.
+func unfinishedFiles() (FileStates, error) {
+	if stateStore == nil {
+		return nil, nil
+	}
+	return stateStore.ExpireFileStates(time.Now().Add(-fileStateExpiry))
+}
+
+// recordFileStage records that the export files produced by a walk have reached a stage, if a state store is
+// configured.
+func recordFileStage(wi WalkInfo, stage FileStage, files ...*ExportFile) error {
+	if stateStore == nil || len(files) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, ef := range files {
+		paths = append(paths, ef.Path())
+	}
+	return stateStore.AdvanceFileStage(wi.Name, stage, paths...)
+}
+
+// recordFileState records the full state of an export file, if a state store is configured.
+func recordFileState(st *FileState) error {
+	if stateStore == nil {
+		return nil
+	}
+	st.Updated = time.Now().UTC()
+	return stateStore.SetFileStates(st)
+}
+
+// forgetFileState removes the state of a shipped export file, if a state store is configured.
+func forgetFileState(ef *ExportFile) error {
+	if stateStore == nil {
+		return nil
+	}
+	return stateStore.RemoveFileState(ef.Path())
+}
+
+// forgetWalkFileStates removes the state of the files produced by an abandoned walk, if a state store is configured.
+// The walk is never resumed, so its files can only be shipped again from a new walk.
+func forgetWalkFileStates(wi WalkInfo) error {
+	if stateStore == nil {
+		return nil
+	}
+	return stateStore.RemoveWalkFileStates(wi.Name)
+}
+
+// resumableFile returns the recorded state of an export file that was compressed from the output of the walk before a
+// crash and whose compressed file is still intact, so shipping can continue without compressing it again. Files that
+// reached the ship path are checked there since the compressed file may have been consumed by the shipper.
+func resumableFile(ctx context.Context, ef *ExportFile, wi WalkInfo, sh Shipper) (*FileState, error) {
+	if stateStore == nil {
+		return nil, nil
+	}
+
+	fs, err := stateStore.FileStates()
+	if err != nil {
+		return nil, fmt.Errorf("read file states: %w", err)
+	}
+	st := fs[ef.Path()]
+	if st == nil || st.Walk != wi.Name || !st.Stage.Reached(FileStageCompressed) {
+		return nil, nil
+	}
+
+	if st.Stage.Reached(FileStageShipped) {
+		info, err := sh.Stat(ctx, ef.Path())
+		if err == nil && info.Size == st.Size {
+			return st, nil
+		}
+		st.Stage = FileStagePinned
+	}
+
+	info, err := os.Stat(st.Staged)
+	if err != nil || info.Size() != st.Size {
+		return nil, nil
+	}
+	sum, _, err := sha256File(st.Staged)
+	if err != nil || sum != st.SHA256 {
+		return nil, nil
+	}
+
+	if st.Stage.Reached(FileStagePinned) {
+		if _, err := cid.Decode(st.IPFSCid); err != nil {
+			st.Stage = FileStageCompressed
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdvanceFileStage(t *testing.T) {
+	s, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AdvanceFileStage("walk-1", FileStageWalked, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFileStates(&FileState{Path: "b", Walk: "walk-1", Stage: FileStageCompressed, Staged: "/staging/b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files of the same walk never move back to an earlier stage
+	if err := s.AdvanceFileStage("walk-1", FileStageVerified, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := s.FileStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs["a"].Stage != FileStageVerified {
+		t.Errorf("got stage %q for a, wanted %q", fs["a"].Stage, FileStageVerified)
+	}
+	if fs["b"].Stage != FileStageCompressed || fs["b"].Staged != "/staging/b" {
+		t.Errorf("compressed file was moved back to %q", fs["b"].Stage)
+	}
+
+	// A new walk starts its files again
+	if err := s.AdvanceFileStage("walk-2", FileStageWalked, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = s.FileStates(); err != nil {
+		t.Fatal(err)
+	}
+	if fs["b"].Walk != "walk-2" || fs["b"].Stage != FileStageWalked || fs["b"].Staged != "" {
+		t.Errorf("got state %+v for a file of a new walk", fs["b"])
+	}
+
+	if err := s.RemoveWalkFileStates("walk-1"); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = s.FileStates(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 || fs["b"] == nil {
+		t.Errorf("got file states %v after removing the first walk, wanted only b", fs)
+	}
+}
+
+func TestExpireFileStates(t *testing.T) {
+	s, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * fileStateExpiry)
+	if err := s.SetFileStates(
+		&FileState{Path: "walked", Stage: FileStageWalked, Updated: old},
+		&FileState{Path: "compressed", Stage: FileStageCompressed, Updated: old},
+		&FileState{Path: "shipped", Stage: FileStageShipped, Updated: old},
+		&FileState{Path: "recent", Stage: FileStageWalked, Updated: time.Now()},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := s.ExpireFileStates(time.Now().Add(-fileStateExpiry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"walked": false, "compressed": false, "shipped": true, "recent": true} {
+		if _, got := fs[path]; got != want {
+			t.Errorf("%s: got kept %v, wanted %v", path, got, want)
+		}
+	}
+	if stored, err := s.FileStates(); err != nil || len(stored) != len(fs) {
+		t.Errorf("got %d stored file states (%v), wanted %d", len(stored), err, len(fs))
+	}
+}
+
+func TestFileStatesUnfinished(t *testing.T) {
+	fs := FileStates{
+		"walked":     {Stage: FileStageWalked},
+		"verified":   {Stage: FileStageVerified},
+		"compressed": {Stage: FileStageCompressed},
+		"pinned":     {Stage: FileStagePinned},
+		"shipped":    {Stage: FileStageShipped},
+	}
+	for path, want := range map[string]bool{"walked": false, "verified": false, "compressed": true, "pinned": true, "shipped": true, "missing": false} {
+		if got := fs.Unfinished(path); got != want {
+			t.Errorf("%s: got unfinished %v, wanted %v", path, got, want)
+		}
+	}
+	if FileStates(nil).Unfinished("walked") {
+		t.Errorf("got an unfinished file without file states")
+	}
+}
+
+func TestResumableFile(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+
+	ctx := context.Background()
+	var err error
+	if stateStore, err = openStateStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	sh := &fileShipper{root: t.TempDir()}
+	wi := WalkInfo{Name: "walk-1"}
+	ef := &ExportFile{
+		Date:        Date{Year: 2021, Month: 8, Day: 2},
+		StartHeight: 1005360,
+		EndHeight:   1008239,
+		Schema:      1,
+		Network:     "mainnet",
+		TableName:   "messages",
+		Format:      FormatCSV,
+		Compression: CompressionByName["gz"],
+	}
+
+	staged := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(staged, []byte("compressed"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	sum, size, err := sha256File(staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(stage FileStage, ipfsCid string) {
+		t.Helper()
+		if err := recordFileState(&FileState{Path: ef.Path(), Walk: wi.Name, Stage: stage, Staged: staged, Size: size, SHA256: sum, IPFSCid: ipfsCid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resume := func() *FileState {
+		t.Helper()
+		st, err := resumableFile(ctx, ef, wi, sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	// Files that were not compressed are compressed again
+	if err := recordFileStage(wi, FileStageVerified, ef); err != nil {
+		t.Fatal(err)
+	}
+	if st := resume(); st != nil {
+		t.Errorf("got resumable state %+v for a file that was not compressed", st)
+	}
+
+	record(FileStageCompressed, "")
+	if st := resume(); st == nil || st.Stage != FileStageCompressed {
+		t.Errorf("got state %+v, wanted the compressed file to be resumed", st)
+	}
+
+	// Files of another walk are not resumed
+	if st, err := resumableFile(ctx, ef, WalkInfo{Name: "walk-2"}, sh); err != nil || st != nil {
+		t.Errorf("got resumable state %+v (%v) from another walk", st, err)
+	}
+
+	// A pinned file without a valid cid is added to ipfs again
+	record(FileStagePinned, "not-a-cid")
+	if st := resume(); st == nil || st.Stage != FileStageCompressed {
+		t.Errorf("got state %+v, wanted to resume from compression", st)
+	}
+	pinned, err := rawCidFromSHA256(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(FileStagePinned, pinned.String())
+	if st := resume(); st == nil || st.Stage != FileStagePinned {
+		t.Errorf("got state %+v, wanted to resume from pinning", st)
+	}
+
+	// A shipped file missing from the ship path is shipped again from the staged file
+	record(FileStageShipped, pinned.String())
+	if st := resume(); st == nil || st.Stage != FileStagePinned {
+		t.Errorf("got state %+v, wanted to resume from pinning", st)
+	}
+	if err := sh.Write(ctx, ef.Path(), []byte("compressed")); err != nil {
+		t.Fatal(err)
+	}
+	record(FileStageShipped, pinned.String())
+	if st := resume(); st == nil || st.Stage != FileStageShipped {
+		t.Errorf("got state %+v, wanted to resume after shipping", st)
+	}
+
+	// A staged file that changed after it was recorded is compressed again
+	if err := os.Remove(filepath.Join(sh.root, ef.Path())); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staged, []byte("corrupted!"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if st := resume(); st != nil {
+		t.Errorf("got resumable state %+v for a changed staged file", st)
+	}
+
+	if err := forgetWalkFileStates(wi); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err := unfinishedFiles(); err != nil || len(fs) != 0 {
+		t.Errorf("got file states %v (%v) after the walk was abandoned", fs, err)
+	}
+}
+
+func TestManifestIgnoresUnshippedFileStates(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+	defer func(n string, v int) { networkConfig.name, storageConfig.schemaVersion = n, v }(networkConfig.name, storageConfig.schemaVersion)
+	networkConfig.name, storageConfig.schemaVersion = "mainnet", 1
+
+	var err error
+	if stateStore, err = openStateStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	tables := []Table{TablesByName["chain_consensus"]}
+	targets := []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}}
+	sh := &fileShipper{root: t.TempDir()}
+
+	em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := em.Files[0]
+	if err := sh.Write(ctx, ef.Path(), []byte("shipped")); err != nil {
+		t.Fatal(err)
+	}
+
+	// State left by a walk that was abandoned before its output reached the ship path does not hide a file shipped
+	// by another export
+	if err := recordFileStage(WalkInfo{Name: "abandoned"}, FileStageVerified, ef); err != nil {
+		t.Fatal(err)
+	}
+	if em, err = manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets); err != nil {
+		t.Fatal(err)
+	}
+	if !em.Files[0].Shipped {
+		t.Errorf("file in the ship path was treated as unshipped because of a verified file state")
+	}
+
+	// A file that reached the ship path part way through shipping is shipped again
+	if err := recordFileState(&FileState{Path: ef.Path(), Walk: "crashed", Stage: FileStageShipped}); err != nil {
+		t.Fatal(err)
+	}
+	if em, err = manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets); err != nil {
+		t.Fatal(err)
+	}
+	if em.Files[0].Shipped {
+		t.Errorf("file part way through shipping was treated as shipped")
+	}
+}
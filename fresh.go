@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// ProvisionalPrefix is the directory beneath the ship path that provisional files are shipped to.
+	ProvisionalPrefix = "provisional"
+
+	// ProvisionalWalkSuffix is appended to the names of walks that export provisional files.
+	ProvisionalWalkSuffix = "-provisional"
+
+	// DefaultFreshDelay is the default number of epochs after the end of a period before its provisional files are
+	// exported, allowing time for the last tipsets of the period to be received.
+	DefaultFreshDelay = 10
+)
+
+// FreshDelay is the number of epochs after the end of a period before its provisional files are exported.
+var FreshDelay = int64(DefaultFreshDelay)
+
+// provisionalManifestForPeriod returns a manifest of the provisional files for a period. Provisional files are exported
+// shortly after the period ends, before the chain is final, and are shipped beneath the provisional prefix so that
+// they never take the place of the final files exported once the export delay has passed.
+func provisionalManifestForPeriod(ctx context.Context, p ExportPeriod, network string, genesisTs int64, sh Shipper, schemaVersion int, allowedTables []Table, targets []ShipTarget) (*ExportManifest, error) {
+	em, err := manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, allowedTables, targets)
+	if err != nil {
+		return nil, err
+	}
+	em.Provisional = true
+
+	unfinished, err := unfinishedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("load file states: %w", err)
+	}
+
+	for _, f := range em.Files {
+		f.Provisional = true
+		f.Shipped = true
+		if f.Annotation != nil {
+			continue
+		}
+
+		_, err := sh.Stat(ctx, f.Path())
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("stat: %w", err)
+			}
+			ok, err := shardListExists(ctx, f, sh)
+			if err != nil {
+				return nil, err
+			}
+			f.Shipped = ok
+		} else if unfinished.Unfinished(f.Path()) {
+			f.Shipped = false
+		}
+	}
+	return em, nil
+}
+
+// provisionalExportIsProcessed exports and ships the provisional files for a period. It gives up once the final
+// export of the period is due, since provisional files are no longer useful once final files can be exported.
+func provisionalExportIsProcessed(p ExportPeriod, allowedTables []Table, targets []ShipTarget, sh Shipper) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight, "provisional", true)
+		if CurrentHeight(networkConfig.genesisTs) > p.EndHeight+ExportDelay {
+			ll.Info("final export is due, not exporting provisional files")
+			return true, nil
+		}
+
+		claim, err := claimPeriod(networkConfig.name, p, true)
+		if err != nil {
+			if errors.Is(err, ErrPeriodClaimed) {
+				periodClaimsContendedCounter.Inc()
+				ll.Infow("period claimed by another instance, waiting", "reason", err)
+				return false, nil
+			}
+			processExportErrorsCounter.Inc()
+			ll.Errorw("failed to claim period", "error", err)
+			return false, nil // force a retry
+		}
+		defer claim.Release()
+
+		em, err := provisionalManifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, allowedTables, targets)
+		if err != nil {
+			processExportErrorsCounter.Inc()
+			ll.Errorw("failed to create manifest", "error", err)
+			return false, nil // force a retry
+		}
+
+		if err := processExport(ctx, em, sh); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err() // shutting down
+			}
+			processExportErrorsCounter.Inc()
+			ll.Errorw("failed to process export", "error", err)
+			return false, nil // force a retry
+		}
+		return true, nil
+	}
+}
+
+// runFreshExports exports provisional files for each period from p onwards as soon as the fresh delay has passed
+// after the period ends, until the context is cancelled. Periods whose final export is already due are skipped.
+func runFreshExports(ctx context.Context, p ExportPeriod, sh Shipper, allowedTables []Table, targets []ShipTarget) {
+	for ; ctx.Err() == nil; p = p.Next() {
+		if CurrentHeight(networkConfig.genesisTs) > p.EndHeight+ExportDelay {
+			continue
+		}
+
+		// Table selection is resolved for each period so that a reloaded table config takes effect
+		tables := currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+		if err := WaitUntil(ctx, provisionalExportIsProcessed(p, tables, targets, sh), 0, time.Minute*15); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logger.Errorw("fresh exports stopped", "error", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestWritePeriodManifestProvisional(t *testing.T) {
+	ctx := context.Background()
+	sh, err := newShipper(t.TempDir())
+	if err != nil {
+		t.Fatalf("new shipper: %v", err)
+	}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1000, EndHeight: 3879}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	file := func(table string, provisional bool) *ExportFile {
+		return &ExportFile{Date: p.Date, Network: "mainnet", TableName: table, Schema: 1, Format: "csv", Compression: CompressionByName["gz"], Provisional: provisional}
+	}
+
+	if err := writePeriodManifest(ctx, em, []*ExportFile{file("messages", true), file("blocks", true)}, sh); err != nil {
+		t.Fatalf("write provisional: %v", err)
+	}
+	if err := writePeriodManifest(ctx, em, []*ExportFile{file("messages", false)}, sh); err != nil {
+		t.Fatalf("write final: %v", err)
+	}
+
+	data, err := sh.Read(ctx, periodManifestPath("mainnet", p))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+
+	want := []struct {
+		path        string
+		provisional bool
+	}{
+		{path: file("messages", false).Path()},
+		{path: file("blocks", true).Path(), provisional: true},
+	}
+	if len(pm.Files) != len(want) {
+		t.Fatalf("got %d files in manifest, wanted %d", len(pm.Files), len(want))
+	}
+	for i, w := range want {
+		if pm.Files[i].Path != w.path || pm.Files[i].Provisional != w.provisional {
+			t.Errorf("got file %s (provisional %v), wanted %s (provisional %v)", pm.Files[i].Path, pm.Files[i].Provisional, w.path, w.provisional)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// latestFinalPeriod returns the most recent period that ended at least one finality ago, and so may be exported.
+func latestFinalPeriod(genesisTs int64) ExportPeriod {
+	current := CurrentHeight(genesisTs)
+	p := firstExportPeriod(genesisTs)
+	for next := p.Next(); next.EndHeight+ExportDelay < current; next = next.Next() {
+		p = next
+	}
+	return p
+}
+
+// findGaps scans the ship path for periods between first and last inclusive with expected files that have not been
+// shipped. It returns the plan for each such period as a backfill queue, ordered with the most recent period first.
+func findGaps(ctx context.Context, first, last ExportPeriod, network string, genesisTs int64, sh Shipper, schemaVersion int, allowedTables []Table, targets []ShipTarget) ([]*PeriodPlan, error) {
+	var queue []*PeriodPlan
+	for p := first; p.StartHeight <= last.StartHeight; p = p.Next() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		em, err := manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, allowedTables, targets)
+		if err != nil {
+			return nil, fmt.Errorf("build manifest for period %s: %w", p.Date.String(), err)
+		}
+		markPublishedFiles(ctx, em)
+		if pp := planForManifest(em); pp != nil {
+			queue = append(queue, pp)
+		}
+	}
+
+	sortBackfillQueue(queue)
+	return queue, nil
+}
+
+// sortBackfillQueue orders a backfill queue so that the most recent periods are exported first, since they are the
+// most likely to be wanted by consumers of the archive.
+func sortBackfillQueue(queue []*PeriodPlan) {
+	sort.Slice(queue, func(a, b int) bool { return queue[a].Period.StartHeight > queue[b].Period.StartHeight })
+}
+
+// BackfillScheduler exports the periods of a backfill queue using a limited number of concurrent workers.
+type BackfillScheduler struct {
+	Concurrency int
+
+	// Process exports a single period, returning only once the period has been exported or the context is cancelled.
+	Process func(ctx context.Context, p ExportPeriod) error
+}
+
+// Run exports every period in the queue, starting them in queue order. It returns once every period has been
+// processed or the context has been cancelled, reporting the first error returned by Process.
+func (s *BackfillScheduler) Run(ctx context.Context, queue []*PeriodPlan) error {
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	work := make(chan ExportPeriod)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		pending  = len(queue)
+	)
+	backfillPendingGauge.Set(float64(pending))
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				err := s.Process(ctx, p)
+
+				mu.Lock()
+				pending--
+				backfillPendingGauge.Set(float64(pending))
+				if err != nil && firstErr == nil && !errors.Is(err, context.Canceled) {
+					firstErr = fmt.Errorf("backfill %s: %w", p.Date.String(), err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, pp := range queue {
+		select {
+		case <-ctx.Done():
+			break feed
+		case work <- pp.Period:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// runBackfill finds the gaps between first and last and exports them using the configured number of concurrent
+// workers, adding each period that shipped files to the height index when the ship path is local.
+func runBackfill(ctx context.Context, first, last ExportPeriod, sh Shipper, tables []Table, targets []ShipTarget, concurrency int) {
+	ll := logger.With("from", first.Date.String(), "to", last.Date.String())
+
+	queue, err := findGaps(ctx, first, last, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+	if err != nil {
+		ll.Errorw("failed to find gaps for backfill", "error", err)
+		return
+	}
+	js, err := exportJobs()
+	if err != nil {
+		ll.Errorw("failed to read export jobs", "error", err)
+	}
+	queue = prioritizeBackfillQueue(queue, js)
+	ll.Infow("starting backfill", "periods", len(queue), "concurrency", concurrency)
+
+	s := &BackfillScheduler{
+		Concurrency: concurrency,
+		Process: func(ctx context.Context, p ExportPeriod) error {
+			var shipped bool
+			err := runExportJob(ctx, p, tables, JobPriorityBackfill, func(ctx context.Context) (err error) {
+				shipped, err = processPeriod(ctx, p, tables, targets, sh)
+				return err
+			})
+			if errors.Is(err, ErrJobDeadLettered) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			exportProgress.Touch()
+			if shipped {
+				if err := updateHeightIndex(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, targets); err != nil {
+					logger.Errorw("failed to update height index", "error", err, "date", p.Date.String())
+				}
+			}
+			return nil
+		},
+	}
+	if err := s.Run(ctx, queue); err != nil && !errors.Is(err, context.Canceled) {
+		ll.Errorw("backfill stopped", "error", err)
+		return
+	}
+	ll.Info("backfill complete")
+}
+
+var gapsCommand = &cli.Command{
+	Name:   "gaps",
+	Usage:  "Scan the ship path for periods between genesis and the chain head with tables that have not been shipped, and list them as a backfill queue.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		stateFlags,
+		objectStoreFlags,
+		publishedFlags,
+		tableConfigFlags,
+		exportFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:  "from-date",
+				Usage: "First date to scan, in YYYY-MM-DD format. Defaults to the first period after --min-height.",
+			},
+			&cli.StringFlag{
+				Name:  "to-date",
+				Usage: "Last date to scan, in YYYY-MM-DD format. Defaults to the most recent period that can be exported.",
+			},
+			&cli.Int64Flag{
+				Name:    "min-height",
+				EnvVars: []string{"ARCHIVER_MIN_HEIGHT"},
+				Usage:   "Minimum height that should be exported. Periods starting before this height are not scanned.",
+				Value:   0,
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Write the backfill queue as JSON.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := cc.Context
+
+		first := firstExportPeriodAfter(cc.Int64("min-height"), networkConfig.genesisTs)
+		if cc.IsSet("from-date") {
+			d, err := DateFromString(cc.String("from-date"))
+			if err != nil {
+				return fmt.Errorf("invalid from date: %w", err)
+			}
+			p, err := exportPeriodForDate(d, networkConfig.genesisTs)
+			if err != nil {
+				return fmt.Errorf("invalid from date: %w", err)
+			}
+			if p.StartHeight > first.StartHeight {
+				first = p
+			}
+		}
+
+		last := latestFinalPeriod(networkConfig.genesisTs)
+		if cc.IsSet("to-date") {
+			d, err := DateFromString(cc.String("to-date"))
+			if err != nil {
+				return fmt.Errorf("invalid to date: %w", err)
+			}
+			p, err := exportPeriodForDate(d, networkConfig.genesisTs)
+			if err != nil {
+				return fmt.Errorf("invalid to date: %w", err)
+			}
+			// Include every hourly period of the date
+			for next := p.Next(); next.Date == d; next = next.Next() {
+				p = next
+			}
+			if p.StartHeight < last.StartHeight {
+				last = p
+			}
+		}
+
+		allowedTables, err := allowedTablesFromFlags(cc)
+		if err != nil {
+			return err
+		}
+		allowedTables = currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+
+		queue, err := findGaps(ctx, first, last, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, allowedTables, targets)
+		if err != nil {
+			return err
+		}
+
+		if cc.Bool("json") {
+			type gap struct {
+				Date        Date     `json:"date"`
+				StartHeight int64    `json:"start_height"`
+				EndHeight   int64    `json:"end_height"`
+				Tables      []string `json:"tables"`
+			}
+			gaps := []gap{}
+			for _, pp := range queue {
+				gaps = append(gaps, gap{Date: pp.Period.Date, StartHeight: pp.Period.StartHeight, EndHeight: pp.Period.EndHeight, Tables: pp.Tables})
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(gaps)
+		}
+
+		for _, pp := range queue {
+			fmt.Printf("%s %d-%d %s\n", pp.Period.Date.String(), pp.Period.StartHeight, pp.Period.EndHeight, strings.Join(pp.Tables, ","))
+		}
+		fmt.Printf("%d periods with gaps between %s and %s\n", len(queue), first.Date.String(), last.Date.String())
+		return nil
+	},
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func TestBackfillScheduler(t *testing.T) {
+	backfillPendingGauge = metrics.NewCtx(context.Background(), "backfill_pending_periods", "").Gauge()
+
+	var queue []*PeriodPlan
+	for i := int64(0); i < 10; i++ {
+		queue = append(queue, &PeriodPlan{Period: ExportPeriod{StartHeight: i * 2880, EndHeight: i*2880 + 2879}})
+	}
+	sortBackfillQueue(queue)
+
+	var (
+		mu             sync.Mutex
+		running, most  int
+		started        []int64
+		release        = make(chan struct{})
+		concurrency    = 3
+		startedAtLimit = make(chan struct{}, 1)
+	)
+	s := &BackfillScheduler{
+		Concurrency: concurrency,
+		Process: func(ctx context.Context, p ExportPeriod) error {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			started = append(started, p.StartHeight)
+			if running == concurrency {
+				select {
+				case startedAtLimit <- struct{}{}:
+				default:
+				}
+			}
+			mu.Unlock()
+
+			<-release
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		},
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Run(context.Background(), queue) }()
+	<-startedAtLimit
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if most != concurrency {
+		t.Errorf("got at most %d periods processed at once, wanted %d", most, concurrency)
+	}
+	if len(started) != len(queue) {
+		t.Fatalf("got %d periods processed, wanted %d", len(started), len(queue))
+	}
+	// The first periods to start are the most recent
+	first := map[int64]bool{}
+	for _, h := range started[:concurrency] {
+		first[h] = true
+	}
+	if want := map[int64]bool{9 * 2880: true, 8 * 2880: true, 7 * 2880: true}; !reflect.DeepEqual(first, want) {
+		t.Errorf("got first periods %v, wanted %v", first, want)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+)
+
+// GenesisExpectation describes how the export of a table for the first period of a network differs from that of a
+// full period. The first period runs from genesis to the start of the next hour, day or week, so it is shorter than
+// the others, and much of the activity that later fills the tables had not begun.
+type GenesisExpectation struct {
+	// NoGenesisTipset marks a table derived from executing the messages of a tipset's parent. The genesis tipset has
+	// no parent, so the table has no rows for it and its task does not report processing it.
+	NoGenesisTipset bool
+
+	// MayBeEmpty marks a table recording activity that may not have happened at all in the first period.
+	MayBeEmpty bool
+}
+
+// genesisExpectations holds the expectations for tables whose export of the first period is partial or may be empty.
+// Tables that are not listed are exported for every height of the first period in the same way as any other.
+var genesisExpectations = map[string]GenesisExpectation{
+	"messages":                 {NoGenesisTipset: true, MayBeEmpty: true},
+	"receipts":                 {NoGenesisTipset: true, MayBeEmpty: true},
+	"parsed_messages":          {NoGenesisTipset: true, MayBeEmpty: true},
+	"derived_gas_outputs":      {NoGenesisTipset: true, MayBeEmpty: true},
+	"message_gas_economy":      {NoGenesisTipset: true, MayBeEmpty: true},
+	"internal_messages":        {NoGenesisTipset: true, MayBeEmpty: true},
+	"internal_parsed_messages": {NoGenesisTipset: true, MayBeEmpty: true},
+
+	"block_messages":                     {MayBeEmpty: true},
+	"market_deal_proposals":              {MayBeEmpty: true},
+	"market_deal_states":                 {MayBeEmpty: true},
+	"miner_fee_debts":                    {MayBeEmpty: true},
+	"miner_pre_commit_infos":             {MayBeEmpty: true},
+	"miner_sector_deals":                 {MayBeEmpty: true},
+	"miner_sector_events":                {MayBeEmpty: true},
+	"miner_sector_posts":                 {MayBeEmpty: true},
+	"multisig_approvals":                 {MayBeEmpty: true},
+	"multisig_transactions":              {MayBeEmpty: true},
+	"verified_registry_verified_clients": {MayBeEmpty: true},
+	"verified_registry_verifiers":        {MayBeEmpty: true},
+}
+
+// IncludesGenesis reports whether the period holds the genesis tipset. This is true of the first period of a network
+// and of ranged periods starting at height zero.
+func (e *ExportPeriod) IncludesGenesis() bool {
+	return e.StartHeight == 0
+}
+
+// fullPeriodHeights returns the number of heights in a period of the same length as p that does not start at
+// genesis, or zero for ranged periods, which have no regular length.
+func fullPeriodHeights(p ExportPeriod) int64 {
+	if p.Ranged {
+		return 0
+	}
+	switch p.Length() {
+	case PeriodHour:
+		return secondsInHour / BlockDelay
+	case PeriodWeek:
+		return 7 * EpochsInDay
+	}
+	return EpochsInDay
+}
+
+// taskProcessesGenesis reports whether lily is expected to report processing the genesis tipset for a task, which it
+// does not for tasks whose tables are all derived from a parent tipset.
+func taskProcessesGenesis(task string) bool {
+	tables := TablesByTask(task, storageConfig.schemaVersion)
+	if len(tables) == 0 {
+		return true
+	}
+	for _, t := range tables {
+		if !genesisExpectations[t.Name].NoGenesisTipset {
+			return true
+		}
+	}
+	return false
+}
+
+// PeriodGenesis describes the irregular export of a period holding the genesis tipset, so that consumers can tell a
+// short period and legitimately empty files from a truncated export.
+type PeriodGenesis struct {
+	Heights         int64    `json:"heights"`                     // heights from genesis to the end of the period
+	PeriodHeights   int64    `json:"period_heights,omitempty"`    // heights in a full period of the same length, absent for ranged periods
+	NoGenesisTipset []string `json:"no_genesis_tipset,omitempty"` // tables with no rows for the genesis tipset, which has no parent
+	EmptyTables     []string `json:"empty_tables,omitempty"`      // tables whose files legitimately have no rows
+}
+
+// periodGenesis returns the description of a period holding the genesis tipset from the files listed in its manifest,
+// or nil if the period does not hold it.
+func periodGenesis(p ExportPeriod, files []*PeriodManifestFile) *PeriodGenesis {
+	if !p.IncludesGenesis() {
+		return nil
+	}
+	pg := &PeriodGenesis{
+		Heights:       p.EndHeight - p.StartHeight + 1,
+		PeriodHeights: fullPeriodHeights(p),
+	}
+
+	rows := map[string]int64{}
+	for _, f := range files {
+		if f.Provisional {
+			continue
+		}
+		rows[f.Table] += f.Rows
+	}
+	for table, n := range rows {
+		ge := genesisExpectations[table]
+		if ge.NoGenesisTipset {
+			pg.NoGenesisTipset = append(pg.NoGenesisTipset, table)
+		}
+		if ge.MayBeEmpty && n == 0 {
+			pg.EmptyTables = append(pg.EmptyTables, table)
+		}
+	}
+	sort.Strings(pg.NoGenesisTipset)
+	sort.Strings(pg.EmptyTables)
+	return pg
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyGenesisPeriod(t *testing.T) {
+	dir := t.TempDir()
+	wi := WalkInfo{Name: "arch0824-2020-08-24", Path: dir, Format: "csv"}
+	messages, headers := TablesByName["messages"].Task, TablesByName["block_headers"].Task
+
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(wi.WalkFile("chain_consensus"), "0,r0,p0,{b0}\n1,r1,p1,{b1}\n")
+	write(wi.WalkFile("block_headers"), "b0\nb1\n")
+	write(wi.WalkFile("messages"), "")
+	write(wi.WalkFile(ProcessingReportsTable), ""+
+		"1,root,reporter,"+messages+",s,e,OK,,\n"+
+		"1,root,reporter,"+headers+",s,e,OK,,\n")
+
+	report, err := verifyTasks(context.Background(), wi, 0, 1, []string{messages, headers})
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// The message task does not process the genesis tipset and its table may have no rows in the first period, but
+	// block headers are still expected for genesis
+	if ts := report.TaskStatus[messages]; !ts.IsOK() {
+		t.Errorf("got status %+v for messages, wanted ok", ts)
+	}
+	if ts := report.TaskStatus[headers]; !reflect.DeepEqual(ts.Missing, []int64{0}) {
+		t.Errorf("got missing heights %v for block headers, wanted [0]", ts.Missing)
+	}
+
+	// Outside the first period an empty messages table is still implausible
+	write(wi.WalkFile("chain_consensus"), "1,r1,p1,{b1}\n")
+	report, err = verifyTasks(context.Background(), wi, 1, 1, []string{messages})
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if ts := report.TaskStatus[messages]; ts.Implausible["messages"] == "" {
+		t.Errorf("got status %+v for messages, wanted an implausible row count", ts)
+	}
+}
+
+func TestPeriodGenesis(t *testing.T) {
+	ctx := context.Background()
+	sh := &fileShipper{root: t.TempDir()}
+
+	p := firstExportPeriod(MainnetGenesisTs)
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	var files []*ExportFile
+	for table, rows := range map[string]int64{"messages": 0, "block_headers": 240, "miner_sector_events": 0, "actors": 0} {
+		files = append(files, &ExportFile{Date: p.Date, Network: "mainnet", TableName: table, Schema: 1, Format: "csv", Compression: CompressionByName["gz"], Rows: rows, SHA256: "aaaa"})
+	}
+	if err := writePeriodManifest(ctx, em, files, sh); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := sh.Read(ctx, periodManifestPath("mainnet", p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		t.Fatal(err)
+	}
+	want := &PeriodGenesis{
+		Heights:         p.EndHeight + 1,
+		PeriodHeights:   EpochsInDay,
+		NoGenesisTipset: []string{"messages"},
+		EmptyTables:     []string{"messages", "miner_sector_events"},
+	}
+	if !reflect.DeepEqual(pm.Genesis, want) || want.Heights >= want.PeriodHeights {
+		t.Errorf("got genesis %+v, wanted %+v", pm.Genesis, want)
+	}
+
+	next := p.Next()
+	if pg := periodGenesis(next, pm.Files); pg != nil {
+		t.Errorf("got genesis %+v for a period after genesis", pg)
+	}
+}
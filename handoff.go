@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/lily/schedule"
+)
+
+const handoffCollection = "handoff"
+
+// HandedOffWalk records a lily walk that was still running when the archiver shut down, so that the walk can be
+// adopted after a restart instead of starting another one. The job ID is only meaningful on the lily node the walk was
+// started on.
+type HandedOffWalk struct {
+	Network   string         `json:"network"`
+	Date      Date           `json:"date"`
+	Hour      int            `json:"hour,omitempty"`   // hour the walk's period starts at, for hourly periods
+	Ranged    bool           `json:"ranged,omitempty"` // walk covers a height range rather than a calendar day
+	From      int64          `json:"from,omitempty"`
+	To        int64          `json:"to,omitempty"`
+	Group     string         `json:"group,omitempty"` // task group run by the walk when the period's walk is split
+	Walk      string         `json:"walk"`            // name of the walk
+	JobID     schedule.JobID `json:"job_id"`
+	Lily      string         `json:"lily"` // address of the lily node running the walk
+	Tasks     []string       `json:"tasks"`
+	HandedOff time.Time      `json:"handed_off"`
+}
+
+// Period returns the export period covered by the walk.
+func (w *HandedOffWalk) Period() ExportPeriod {
+	return ExportPeriod{Date: w.Date, Hour: w.Hour, StartHeight: w.From, EndHeight: w.To, Ranged: w.Ranged}
+}
+
+// HandedOffWalks maps a key made up of network, export period and task group to the walk handed off for that export
+// period.
+type HandedOffWalks map[string]*HandedOffWalk
+
+// HandedOffWalk returns the walk handed off for the network, period and task group, or nil if there is none.
+func (s *StateStore) HandedOffWalk(network string, p ExportPeriod, group string) (*HandedOffWalk, error) {
+	hw := HandedOffWalks{}
+	if err := s.load(handoffCollection, &hw); err != nil {
+		return nil, err
+	}
+	return hw[completedWalkKey(network, p, group)], nil
+}
+
+// HandedOffWalks returns every walk handed off by a previous run of the archiver that has not yet been adopted.
+func (s *StateStore) HandedOffWalks() (HandedOffWalks, error) {
+	hw := HandedOffWalks{}
+	if err := s.load(handoffCollection, &hw); err != nil {
+		return nil, err
+	}
+	return hw, nil
+}
+
+// AddHandedOffWalk records a handed off walk, replacing any previous walk for the same network, period and task group.
+func (s *StateStore) AddHandedOffWalk(w *HandedOffWalk) error {
+	hw := HandedOffWalks{}
+	return s.update(handoffCollection, &hw, func() error {
+		hw[completedWalkKey(w.Network, w.Period(), w.Group)] = w
+		return nil
+	})
+}
+
+// RemoveHandedOffWalk removes the walk handed off for the network, period and task group.
+func (s *StateStore) RemoveHandedOffWalk(network string, p ExportPeriod, group string) error {
+	hw := HandedOffWalks{}
+	return s.update(handoffCollection, &hw, func() error {
+		delete(hw, completedWalkKey(network, p, group))
+		return nil
+	})
+}
+
+// handedOffWalk returns the walk handed off for the manifest by a previous run of the archiver, if a state store is
+// configured and a walk was handed off.
+func handedOffWalk(em *ExportManifest) (*HandedOffWalk, error) {
+	if stateStore == nil {
+		return nil, nil
+	}
+	hw, err := stateStore.HandedOffWalk(em.Network, em.Period, em.Group)
+	if err != nil {
+		return nil, fmt.Errorf("read handed off walk: %w", err)
+	}
+	return hw, nil
+}
+
+// recordHandedOffWalk records a walk for the manifest that is still running on the lily node at apiAddr in the state
+// store, if one is configured.
+func recordHandedOffWalk(em *ExportManifest, walkName string, jobID schedule.JobID, apiAddr string, tasks []string) error {
+	if stateStore == nil {
+		return nil
+	}
+
+	return stateStore.AddHandedOffWalk(&HandedOffWalk{
+		Network:   em.Network,
+		Date:      em.Period.Date,
+		Hour:      em.Period.Hour,
+		Ranged:    em.Period.Ranged,
+		From:      em.Period.StartHeight,
+		To:        em.Period.EndHeight,
+		Group:     em.Group,
+		Walk:      walkName,
+		JobID:     jobID,
+		Lily:      apiAddr,
+		Tasks:     tasks,
+		HandedOff: time.Now().UTC(),
+	})
+}
+
+// forgetHandedOffWalk removes the walk handed off for the manifest from the state store, if one is configured.
+func forgetHandedOffWalk(em *ExportManifest) error {
+	if stateStore == nil {
+		return nil
+	}
+
+	return stateStore.RemoveHandedOffWalk(em.Network, em.Period, em.Group)
+}
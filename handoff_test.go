@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/lily/lens/lily"
+	"github.com/filecoin-project/lily/schedule"
+)
+
+// jobListLily serves a fixed list of jobs
+type jobListLily struct {
+	lily.LilyAPI
+	jobs []schedule.JobListResult
+}
+
+func (l *jobListLily) LilyJobList(ctx context.Context) ([]schedule.JobListResult, error) {
+	return l.jobs, nil
+}
+
+func TestFindExistingJobHandoff(t *testing.T) {
+	walkCfg := &lily.LilyWalkConfig{From: 1000, To: 1999, JobConfig: lily.LilyJobConfig{Storage: "CSV", Tasks: []string{"blocks"}}}
+	params := map[string]string{"storage": "CSV", "minHeight": "1000", "maxHeight": "1999"}
+	api := &jobListLily{jobs: []schedule.JobListResult{
+		{ID: 1, Name: "walk-a", Type: "walk", Tasks: []string{"blocks"}, Params: params, Running: false},
+		{ID: 2, Name: "walk-b", Type: "walk", Tasks: []string{"blocks"}, Params: params, Running: true},
+	}}
+
+	testCases := []struct {
+		name    string
+		handoff *HandedOffWalk
+		wantID  schedule.JobID
+	}{
+		{name: "no handoff", wantID: 2},
+		{name: "ended handoff", handoff: &HandedOffWalk{Walk: "walk-a", JobID: 1}, wantID: 1},
+		{name: "renamed job", handoff: &HandedOffWalk{Walk: "walk-c", JobID: 1}, wantID: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jr, err := findExistingJob(context.Background(), api, walkCfg, "", tc.handoff)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if jr.ID != tc.wantID {
+				t.Errorf("got job %d, wanted %d", jr.ID, tc.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// healthCheckTimeout bounds the time taken by the checks of a single health or readiness probe.
+const healthCheckTimeout = 15 * time.Second
+
+// progressMonitor records when the export loop last made progress, so that health checks can detect an archiver that
+// is wedged, such as one waiting forever on a lily job that never ends. Time spent waiting for a period to end before
+// it can be exported is not counted against it.
+type progressMonitor struct {
+	mu        sync.Mutex
+	last      time.Time // when progress was last made, zero if the export loop has not started
+	idleUntil time.Time // when the export loop is expected to resume after waiting for a period to end
+}
+
+// exportProgress monitors the export loop of the run command and the walks and backfills it starts.
+var exportProgress = &progressMonitor{}
+
+// Touch records that progress has been made.
+func (m *progressMonitor) Touch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = time.Now()
+}
+
+// IdleUntil records that the export loop is waiting until t for a period to end before it can be exported.
+func (m *progressMonitor) IdleUntil(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.After(m.idleUntil) {
+		m.idleUntil = t
+	}
+}
+
+// Stalled reports whether no progress has been made for longer than the timeout, discounting time spent waiting for a
+// period to end, and the time since progress was made. It never reports a stall if the timeout is zero or the export
+// loop has not started.
+func (m *progressMonitor) Stalled(timeout time.Duration) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.IsZero() {
+		return 0, false
+	}
+	since := time.Since(m.last)
+	from := m.last
+	if m.idleUntil.After(from) {
+		from = m.idleUntil
+	}
+	return since, timeout > 0 && time.Since(from) > timeout
+}
+
+// HealthCheck is the result of a single check made by a health or readiness probe.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is returned by the health and readiness probes of the status API.
+type HealthReport struct {
+	OK     bool           `json:"ok"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+func newHealthReport(checks []*HealthCheck) *HealthReport {
+	hr := &HealthReport{OK: true, Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			hr.OK = false
+		}
+	}
+	return hr
+}
+
+// livenessChecks reports whether the export loop is making progress and keeping within the lag slo. An archiver that
+// fails them is wedged and should be restarted.
+func livenessChecks() []*HealthCheck {
+	var checks []*HealthCheck
+
+	since, stalled := exportProgress.Stalled(healthConfig.stallTimeout)
+	pc := &HealthCheck{Name: "export_progress", OK: !stalled}
+	if since > 0 {
+		pc.Message = fmt.Sprintf("last progress %s ago", since.Truncate(time.Second))
+	}
+	if stalled {
+		pc.Message += fmt.Sprintf(", exceeding the stall timeout of %s", healthConfig.stallTimeout)
+	}
+	checks = append(checks, pc)
+
+	if ls := exportLag.Status(); ls != nil {
+		lc := &HealthCheck{Name: "export_lag", OK: !ls.Breached, Message: "lag " + ls.Lag}
+		if ls.SLO != "" {
+			lc.Message += ", slo " + ls.SLO
+		}
+		checks = append(checks, lc)
+	}
+	return checks
+}
+
+// readinessChecks reports whether the lily api can be reached and whether the filesystem paths the command writes
+// to are writable. An archiver that fails them cannot currently export.
+func readinessChecks(ctx context.Context, paths map[string]string) []*HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var checks []*HealthCheck
+	if lilyNodes != nil {
+		lc := &HealthCheck{Name: "lily"}
+		var errs []string
+		for _, n := range lilyNodes.nodes {
+			if err := checkLilyNode(ctx, n.Addr, n.Token); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", n.Addr, err))
+				continue
+			}
+			lc.OK = true
+		}
+		lc.Message = strings.Join(errs, "; ")
+		checks = append(checks, lc)
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pc := &HealthCheck{Name: name, OK: true}
+		if err := checkWritable(paths[name]); err != nil {
+			pc.OK, pc.Message = false, err.Error()
+		}
+		checks = append(checks, pc)
+	}
+	return checks
+}
+
+// checkWritable checks that a file can be created in the directory.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".archiver-health-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return os.Remove(name)
+}
+
+// writablePaths returns the filesystem paths, by check name, that the command writes to. Object store ship paths
+// are not checked.
+func writablePaths(cc *cli.Context) map[string]string {
+	paths := map[string]string{}
+	for _, flag := range []struct {
+		check string
+		name  string
+	}{
+		{check: "ship_path", name: "ship-path"},
+		{check: "storage_path", name: "storage-path"},
+		{check: "staging_path", name: "staging-path"},
+		{check: "state_path", name: "state-path"},
+	} {
+		if path := cc.String(flag.name); path != "" && !strings.Contains(path, "://") {
+			paths[flag.check] = path
+		}
+	}
+	return paths
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressMonitorStalled(t *testing.T) {
+	m := &progressMonitor{}
+	if _, stalled := m.Stalled(time.Millisecond); stalled {
+		t.Errorf("monitor should not report a stall before the export loop starts")
+	}
+
+	m.last = time.Now().Add(-time.Hour)
+	if since, stalled := m.Stalled(30 * time.Minute); !stalled || since < time.Hour {
+		t.Errorf("expected a stall after an hour without progress, got %s", since)
+	}
+	if _, stalled := m.Stalled(0); stalled {
+		t.Errorf("monitor should not report a stall when the timeout is disabled")
+	}
+
+	// Waiting for a period to end is not counted against the loop
+	m.IdleUntil(time.Now().Add(-10 * time.Minute))
+	if _, stalled := m.Stalled(30 * time.Minute); stalled {
+		t.Errorf("time spent waiting for a period to end should not count as a stall")
+	}
+
+	m.Touch()
+	if since, stalled := m.Stalled(time.Minute); stalled || since > time.Second {
+		t.Errorf("expected progress to be recent, got %s", since)
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	defer func(p *LilyPool) { lilyNodes = p }(lilyNodes)
+	lilyNodes = nil
+
+	dir := t.TempDir()
+	checks := readinessChecks(context.Background(), map[string]string{
+		"ship_path":    dir,
+		"storage_path": filepath.Join(dir, "missing"),
+	})
+	if len(checks) != 2 || checks[0].Name != "ship_path" || !checks[0].OK || checks[1].Name != "storage_path" || checks[1].OK {
+		t.Fatalf("unexpected checks: %+v %+v", checks[0], checks[1])
+	}
+
+	rec := httptest.NewRecorder()
+	writeHealthReport(rec, newHealthReport(checks))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for a failed check, wanted %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var hr HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &hr); err != nil {
+		t.Fatal(err)
+	}
+	if hr.OK || len(hr.Checks) != 2 {
+		t.Errorf("unexpected health report: %+v", hr)
+	}
+
+	rec = httptest.NewRecorder()
+	writeHealthReport(rec, newHealthReport(checks[:1]))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d for passing checks, wanted %d", rec.Code, http.StatusOK)
+	}
+}
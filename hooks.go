@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Events that hooks are run for.
+const (
+	HookTableShipped    = "table_shipped"    // a file of a table has been shipped and listed in its period manifest
+	HookPeriodCompleted = "period_completed" // every file of a period has been shipped and the work that follows it is done
+)
+
+// DefaultHookTimeout bounds the time a hook may take when it does not set its own timeout.
+const DefaultHookTimeout = time.Minute
+
+// HooksConfig is read from the file given by --hooks-config. It lists the hooks run after files and periods are
+// shipped, in the order they are run.
+type HooksConfig struct {
+	Hooks []*HookSpec `yaml:"hooks" toml:"hooks"`
+}
+
+// HookSpec describes a single hook, which either runs a command or posts to a webhook. The command's arguments and the
+// webhook url are templates expanded with the fields of the HookEvent.
+type HookSpec struct {
+	Name    string   `yaml:"name" toml:"name"`
+	Event   string   `yaml:"event" toml:"event"`     // one of table_shipped or period_completed
+	Command []string `yaml:"command" toml:"command"` // executable and arguments, given the event as json on stdin
+	Webhook string   `yaml:"webhook" toml:"webhook"` // url posted the event as json
+	Tables  []string `yaml:"tables" toml:"tables"`   // tables a table_shipped hook is run for, every table if empty
+	Timeout string   `yaml:"timeout" toml:"timeout"` // maximum time the hook may take, 1m if not set
+
+	command []*template.Template
+	webhook *template.Template
+	timeout time.Duration
+}
+
+// HookEvent describes the event a hook is run for. It is given to the hook as json and its fields may be used in the
+// hook's templates, such as {{.Path}} or {{.Period}}.
+type HookEvent struct {
+	Event        string              `json:"event"`
+	Network      string              `json:"network"`
+	Period       string              `json:"period"` // the date of the period, or its height range for ranged periods
+	Date         Date                `json:"date"`
+	StartHeight  int64               `json:"start_height"`
+	EndHeight    int64               `json:"end_height"`
+	ShipPath     string              `json:"ship_path"`
+	ManifestPath string              `json:"manifest_path"`      // path of the period manifest relative to the ship path
+	Table        string              `json:"table,omitempty"`    // the table shipped, for table_shipped
+	Path         string              `json:"path,omitempty"`     // path of the file shipped relative to the ship path, for table_shipped
+	File         *PeriodManifestFile `json:"file,omitempty"`     // the manifest entry of the file shipped, for table_shipped
+	Manifest     *PeriodManifest     `json:"manifest,omitempty"` // the period manifest, for period_completed
+}
+
+// loadHooksConfig reads a hooks configuration file, decoding it as toml if its name ends in .toml and yaml otherwise.
+func loadHooksConfig(path string) (*HooksConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var hc HooksConfig
+	switch filepath.Ext(path) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &hc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	default:
+		if err := yaml.Unmarshal(data, &hc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if err := hc.Validate(); err != nil {
+		return nil, err
+	}
+	return &hc, nil
+}
+
+// Validate checks that every hook has a known event and exactly one action, and prepares its templates.
+func (hc *HooksConfig) Validate() error {
+	seen := map[string]bool{}
+	for i, h := range hc.Hooks {
+		if h == nil || h.Name == "" {
+			return fmt.Errorf("hook %d: missing name", i)
+		}
+		if seen[h.Name] {
+			return fmt.Errorf("hook %s: name is used by more than one hook", h.Name)
+		}
+		seen[h.Name] = true
+
+		if h.Event != HookTableShipped && h.Event != HookPeriodCompleted {
+			return fmt.Errorf("hook %s: unknown event %q", h.Name, h.Event)
+		}
+		if (len(h.Command) == 0) == (h.Webhook == "") {
+			return fmt.Errorf("hook %s: exactly one of command or webhook is required", h.Name)
+		}
+		if len(h.Tables) > 0 && h.Event != HookTableShipped {
+			return fmt.Errorf("hook %s: tables may only be given for %s hooks", h.Name, HookTableShipped)
+		}
+		for _, table := range h.Tables {
+			if _, ok := TablesByName[table]; !ok {
+				return fmt.Errorf("hook %s: unknown table %q", h.Name, table)
+			}
+		}
+
+		h.timeout = DefaultHookTimeout
+		if h.Timeout != "" {
+			d, err := time.ParseDuration(h.Timeout)
+			if err != nil {
+				return fmt.Errorf("hook %s: invalid timeout: %w", h.Name, err)
+			}
+			if d <= 0 {
+				return fmt.Errorf("hook %s: timeout must be positive", h.Name)
+			}
+			h.timeout = d
+		}
+
+		h.command = nil
+		for _, arg := range h.Command {
+			t, err := parseHookTemplate(h.Name, arg)
+			if err != nil {
+				return err
+			}
+			h.command = append(h.command, t)
+		}
+		if h.Webhook != "" {
+			t, err := parseHookTemplate(h.Name, h.Webhook)
+			if err != nil {
+				return err
+			}
+			h.webhook = t
+		}
+	}
+	return nil
+}
+
+// parseHookTemplate parses a template of a hook and checks that it only uses fields of the HookEvent.
+func parseHookTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("hook %s: invalid template %q: %w", name, text, err)
+	}
+	if err := t.Execute(&bytes.Buffer{}, &HookEvent{File: &PeriodManifestFile{}, Manifest: &PeriodManifest{}}); err != nil {
+		return nil, fmt.Errorf("hook %s: invalid template %q: %w", name, text, err)
+	}
+	return t, nil
+}
+
+// exportHooks are the hooks of the running command, empty if none are configured.
+var exportHooks []*HookSpec
+
+// hooksFor returns the hooks run for an event, and for table_shipped events the table shipped.
+func hooksFor(event string, table string) []*HookSpec {
+	var hooks []*HookSpec
+	for _, h := range exportHooks {
+		if h.Event != event {
+			continue
+		}
+		if table != "" && len(h.Tables) > 0 && !stringSliceContainsAll(h.Tables, []string{table}) {
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+// runTableHooks runs the table_shipped hooks for each file shipped for the manifest, using the entries written to the
+// period manifest. Failures are logged rather than returned since a hook must never cause an export to fail.
+func runTableHooks(ctx context.Context, em *ExportManifest, shipped []*ExportFile, sh Shipper) {
+	if len(hooksFor(HookTableShipped, "")) == 0 {
+		return
+	}
+
+	path := periodManifestPath(em.Network, em.Period)
+	pm, err := readPeriodManifest(ctx, path, sh)
+	if err != nil {
+		logger.Errorw("failed to read period manifest for hooks", "error", err, "date", em.Period.Date.String())
+		return
+	}
+	entries := map[string]*PeriodManifestFile{}
+	for _, f := range pm.Files {
+		entries[f.Path] = f
+	}
+
+	for _, ef := range shipped {
+		for _, sf := range ef.ShippedFiles() {
+			f, ok := entries[filepath.ToSlash(sf.Path())]
+			if !ok {
+				continue
+			}
+			ev := newHookEvent(HookTableShipped, em.Network, em.Period, sh)
+			ev.Table, ev.Path, ev.File = f.Table, f.Path, f
+			for _, h := range hooksFor(HookTableShipped, f.Table) {
+				runHook(ctx, h, ev)
+			}
+		}
+	}
+}
+
+// runPeriodHooks runs the period_completed hooks for a period, giving them its manifest.
+func runPeriodHooks(ctx context.Context, network string, p ExportPeriod, sh Shipper) {
+	hooks := hooksFor(HookPeriodCompleted, "")
+	if len(hooks) == 0 {
+		return
+	}
+
+	ev := newHookEvent(HookPeriodCompleted, network, p, sh)
+	pm, err := readPeriodManifest(ctx, ev.ManifestPath, sh)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Errorw("failed to read period manifest for hooks", "error", err, "date", p.Date.String())
+		return
+	}
+	ev.Manifest = pm
+	for _, h := range hooks {
+		runHook(ctx, h, ev)
+	}
+}
+
+func newHookEvent(event string, network string, p ExportPeriod, sh Shipper) *HookEvent {
+	return &HookEvent{
+		Event:        event,
+		Network:      network,
+		Period:       p.String(),
+		Date:         p.Date,
+		StartHeight:  p.StartHeight,
+		EndHeight:    p.EndHeight,
+		ShipPath:     sh.String(),
+		ManifestPath: filepath.ToSlash(periodManifestPath(network, p)),
+	}
+}
+
+func readPeriodManifest(ctx context.Context, path string, sh Shipper) (*PeriodManifest, error) {
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var pm PeriodManifest
+	if err := json.Unmarshal(data, &pm); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return &pm, nil
+}
+
+// runHook runs a single hook for the event, logging and counting any failure.
+func runHook(ctx context.Context, h *HookSpec, ev *HookEvent) {
+	ll := logger.With("hook", h.Name, "event", ev.Event, "period", ev.Period)
+	if ev.Path != "" {
+		ll = ll.With("path", ev.Path)
+	}
+
+	start := time.Now()
+	if err := h.run(ctx, ev); err != nil {
+		recordHookFailure(ctx, h.Name)
+		ll.Errorw("hook failed", "error", err)
+		return
+	}
+	ll.Debugw("hook completed", "duration", time.Since(start))
+}
+
+// run runs the hook's command, or posts to its webhook, with the event as json.
+func (h *HookSpec) run(ctx context.Context, ev *HookEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	if h.webhook != nil {
+		var url bytes.Buffer
+		if err := h.webhook.Execute(&url, ev); err != nil {
+			return fmt.Errorf("expand webhook: %w", err)
+		}
+		return postJSON(ctx, url.String(), payload)
+	}
+
+	args := make([]string, len(h.command))
+	for i, t := range h.command {
+		var arg bytes.Buffer
+		if err := t.Execute(&arg, ev); err != nil {
+			return fmt.Errorf("expand argument %d: %w", i, err)
+		}
+		args[i] = arg.String()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "ARCHIVER_HOOK_EVENT="+ev.Event)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) > 4096 {
+			out = out[len(out)-4096:]
+		}
+		return fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
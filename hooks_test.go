@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHooksConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name string
+		hook HookSpec
+		ok   bool
+	}{
+		{name: "command", hook: HookSpec{Name: "h", Event: HookTableShipped, Command: []string{"echo", "{{.Path}}"}, Tables: []string{"messages"}}, ok: true},
+		{name: "webhook", hook: HookSpec{Name: "h", Event: HookPeriodCompleted, Webhook: "http://example.com/{{.Network}}/{{.Period}}", Timeout: "5s"}, ok: true},
+		{name: "unknown event", hook: HookSpec{Name: "h", Event: "shipped", Command: []string{"true"}}},
+		{name: "no action", hook: HookSpec{Name: "h", Event: HookTableShipped}},
+		{name: "both actions", hook: HookSpec{Name: "h", Event: HookTableShipped, Command: []string{"true"}, Webhook: "http://example.com"}},
+		{name: "unknown field", hook: HookSpec{Name: "h", Event: HookTableShipped, Command: []string{"echo", "{{.Height}}"}}},
+		{name: "tables of period hook", hook: HookSpec{Name: "h", Event: HookPeriodCompleted, Command: []string{"true"}, Tables: []string{"messages"}}},
+		{name: "unknown table", hook: HookSpec{Name: "h", Event: HookTableShipped, Command: []string{"true"}, Tables: []string{"nope"}}},
+		{name: "invalid timeout", hook: HookSpec{Name: "h", Event: HookTableShipped, Command: []string{"true"}, Timeout: "-1s"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc := HooksConfig{Hooks: []*HookSpec{&tc.hook}}
+			err := hc.Validate()
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	defer func(hooks []*HookSpec) { exportHooks = hooks }(exportHooks)
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	sh := &fileShipper{root: t.TempDir()}
+
+	var posted []*HookEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mainnet/2021-08-09" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var ev HookEvent
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &ev); err != nil {
+			t.Errorf("decode posted event: %v", err)
+		}
+		posted = append(posted, &ev)
+	}))
+	defer srv.Close()
+
+	hc := HooksConfig{Hooks: []*HookSpec{
+		{Name: "record", Event: HookTableShipped, Command: []string{"sh", "-c", `cat > "$1"`, "hook", filepath.Join(dir, "{{.Table}}.json")}, Tables: []string{"messages"}},
+		{Name: "dag", Event: HookPeriodCompleted, Webhook: srv.URL + "/{{.Network}}/{{.Period}}"},
+		{Name: "broken", Event: HookPeriodCompleted, Command: []string{"false"}},
+	}}
+	if err := hc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	exportHooks = hc.Hooks
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 9}, StartHeight: 1005360, EndHeight: 1008239}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	shipped := []*ExportFile{
+		{Date: p.Date, StartHeight: p.StartHeight, EndHeight: p.EndHeight, Schema: 1, Network: "mainnet", TableName: "messages", Format: FormatCSV, Compression: CompressionByName["gz"]},
+		{Date: p.Date, StartHeight: p.StartHeight, EndHeight: p.EndHeight, Schema: 1, Network: "mainnet", TableName: "receipts", Format: FormatCSV, Compression: CompressionByName["gz"]},
+	}
+	if err := writePeriodManifest(ctx, em, shipped, sh); err != nil {
+		t.Fatal(err)
+	}
+
+	runTableHooks(ctx, em, shipped, sh)
+	data, err := os.ReadFile(filepath.Join(dir, "messages.json"))
+	if err != nil {
+		t.Fatalf("table hook did not run for messages: %v", err)
+	}
+	var ev HookEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Event != HookTableShipped || ev.Table != "messages" || ev.File == nil || ev.File.Path != shipped[0].Path() || ev.ShipPath != sh.root {
+		t.Errorf("unexpected event given to table hook %+v", ev)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "receipts.json")); err == nil {
+		t.Errorf("table hook ran for a table it was not configured for")
+	}
+
+	runPeriodHooks(ctx, "mainnet", p, sh)
+	if len(posted) != 1 {
+		t.Fatalf("got %d webhook posts, wanted 1", len(posted))
+	}
+	if posted[0].Event != HookPeriodCompleted || posted[0].Manifest == nil || len(posted[0].Manifest.Files) != 2 || !strings.HasSuffix(posted[0].ManifestPath, "2021-08-09.json") {
+		t.Errorf("unexpected event posted to webhook %+v", posted[0])
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HeightIndexFilename is the name of the height index file written to each network's directory in the ship path.
+const HeightIndexFilename = "heights.json"
+
+// HeightIndex maps every shipped date-named file to the range of heights it covers and each height range to the files
+// that cover it, so consumers can locate files by epoch without knowing the genesis timestamp. It also lists the size
+// and checksum of each file, allowing mirrors to discover and verify the contents of the archive.
+type HeightIndex struct {
+	Network   string                         `json:"network"`
+	GenesisTs int64                          `json:"genesis_ts"`
+	Generated time.Time                      `json:"generated"`
+	Periods   []*HeightIndexPeriod           `json:"periods"` // sorted by start height
+	Files     map[string]*HeightIndexFileRef `json:"files"`   // keyed by path relative to the ship path
+}
+
+// HeightIndexPeriod lists the shipped files covering a single export period.
+type HeightIndexPeriod struct {
+	Date        Date     `json:"date"`
+	Hour        int      `json:"hour,omitempty"` // hour the period starts at, for hourly periods
+	StartHeight int64    `json:"start_height"`
+	EndHeight   int64    `json:"end_height"`
+	Files       []string `json:"files"`
+}
+
+// HeightIndexFileRef is the height range covered by a single shipped file along with its size and checksum.
+type HeightIndexFileRef struct {
+	Date        Date   `json:"date"`
+	StartHeight int64  `json:"start_height"`
+	EndHeight   int64  `json:"end_height"`
+	Table       string `json:"table"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	CID         string `json:"cid"`                  // CIDv1 of the raw file contents
+	IPFSCID     string `json:"ipfs_cid,omitempty"`   // root of the file as added to IPFS, if it was
+	ShardList   string `json:"shard_list,omitempty"` // path of the shard list the file is a part of, if it is one
+	TableDir    string `json:"table_dir,omitempty"`  // directory of the file's table, if the file was shipped with a layout
+	Period      string `json:"period,omitempty"`     // length of the period covered by the file, if it was shipped with a layout
+}
+
+// heightIndexPath returns the path of a network's height index relative to the ship path.
+func heightIndexPath(network string) string {
+	return network + "/" + HeightIndexFilename
+}
+
+// SetPeriod replaces the index entries for the period with the shipped files of the manifest. Checksums are retained
+// from the previous entry of any file whose size is unchanged or taken from the period manifest, which records those
+// computed while the files were shipped, otherwise they are computed from the file in the ship path.
+func (hi *HeightIndex) SetPeriod(ctx context.Context, em *ExportManifest, sh Shipper) error {
+	// Periods shorter than a day share their date, so entries are matched by the heights they cover
+	previous := map[string]*HeightIndexFileRef{}
+	for path, ref := range hi.Files {
+		if ref.StartHeight >= em.Period.StartHeight && ref.EndHeight <= em.Period.EndHeight {
+			previous[path] = ref
+			delete(hi.Files, path)
+		}
+	}
+
+	for i := range hi.Periods {
+		if hi.Periods[i].StartHeight == em.Period.StartHeight {
+			hi.Periods = append(hi.Periods[:i], hi.Periods[i+1:]...)
+			break
+		}
+	}
+
+	pruned, err := prunedFiles()
+	if err != nil {
+		return fmt.Errorf("load pruned files: %w", err)
+	}
+
+	shipped, err := shippedChecksums(ctx, sh, em)
+	if err != nil {
+		return fmt.Errorf("read period manifest: %w", err)
+	}
+
+	hp := &HeightIndexPeriod{
+		Date:        em.Period.Date,
+		Hour:        em.Period.Hour,
+		StartHeight: em.Period.StartHeight,
+		EndHeight:   em.Period.EndHeight,
+	}
+	for _, ef := range em.Files {
+		if !ef.Shipped {
+			continue
+		}
+
+		ref := &HeightIndexFileRef{
+			Date:        em.Period.Date,
+			StartHeight: em.Period.StartHeight,
+			EndHeight:   em.Period.EndHeight,
+			Table:       ef.TableName,
+		}
+		if fileLayout != nil {
+			ref.TableDir, ref.Period = tableDirForFile(ef), fileLayoutData(ef).Period
+		}
+
+		// Each part of a sharded file is indexed with the heights it holds
+		sl, err := readShardList(ctx, ef, sh)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("read shard list: %w", err)
+		}
+		if sl != nil {
+			for _, part := range sl.Parts {
+				path := filepath.FromSlash(part.Path)
+				hp.Files = append(hp.Files, path)
+				hi.Files[path] = &HeightIndexFileRef{
+					Date:        em.Period.Date,
+					StartHeight: part.StartHeight,
+					EndHeight:   part.EndHeight,
+					Table:       ef.TableName,
+					Size:        part.Size,
+					SHA256:      part.SHA256,
+					CID:         part.CID,
+					ShardList:   ef.ShardListPath(),
+					TableDir:    ref.TableDir,
+					Period:      ref.Period,
+				}
+			}
+			continue
+		}
+
+		info, err := sh.Stat(ctx, filepath.ToSlash(ef.Path()))
+		if err != nil {
+			// Pruned files keep the entry they had when they were present in the ship path
+			pf, ok := pruned[ef.Path()]
+			if !errors.Is(err, os.ErrNotExist) || !ok {
+				return fmt.Errorf("stat: %w", err)
+			}
+			if prev, ok := previous[ef.Path()]; ok {
+				ref = prev
+			} else {
+				ref.Size, ref.SHA256 = pf.Size, pf.SHA256
+				c, err := rawCidFromSHA256(ref.SHA256)
+				if err != nil {
+					return fmt.Errorf("cid %s: %w", ef.Path(), err)
+				}
+				ref.CID = c.String()
+			}
+			hp.Files = append(hp.Files, ef.Path())
+			hi.Files[ef.Path()] = ref
+			continue
+		}
+
+		if prev, ok := previous[ef.Path()]; ok && prev.Size == info.Size && prev.SHA256 != "" {
+			ref.Size, ref.SHA256, ref.IPFSCID = prev.Size, prev.SHA256, prev.IPFSCID
+		} else if f, ok := shipped[filepath.ToSlash(ef.Path())]; ok && f.Size == info.Size && f.SHA256 != "" {
+			ref.Size, ref.SHA256 = f.Size, f.SHA256
+		} else {
+			ref.SHA256, ref.Size, err = sha256Shipped(ctx, sh, ef.Path())
+			if err != nil {
+				return fmt.Errorf("checksum %s: %w", ef.Path(), err)
+			}
+		}
+
+		c, err := rawCidFromSHA256(ref.SHA256)
+		if err != nil {
+			return fmt.Errorf("cid %s: %w", ef.Path(), err)
+		}
+		ref.CID = c.String()
+		if ef.IPFSCid.Defined() && ef.Size == ref.Size {
+			ref.IPFSCID = ef.IPFSCid.String()
+		}
+
+		hp.Files = append(hp.Files, ef.Path())
+		hi.Files[ef.Path()] = ref
+	}
+
+	if len(hp.Files) == 0 {
+		return nil
+	}
+	sort.Strings(hp.Files)
+
+	hi.Periods = append(hi.Periods, hp)
+	sort.Slice(hi.Periods, func(a, b int) bool { return hi.Periods[a].StartHeight < hi.Periods[b].StartHeight })
+	return nil
+}
+
+// shippedChecksums returns the files listed in the manifest of the period in the ship path, keyed by their path. It
+// returns no files if the manifest has not been written or cannot be decoded.
+func shippedChecksums(ctx context.Context, sh Shipper, em *ExportManifest) (map[string]*PeriodManifestFile, error) {
+	data, err := sh.Read(ctx, filepath.ToSlash(periodManifestPath(em.Network, em.Period)))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var pm PeriodManifest
+	if err := json.Unmarshal(data, &pm); err != nil {
+		logger.Warnw("ignoring invalid period manifest", "error", err, "date", em.Period.Date.String())
+		return nil, nil
+	}
+	files := map[string]*PeriodManifestFile{}
+	for _, f := range pm.Files {
+		files[f.Path] = f
+	}
+	return files, nil
+}
+
+// PeriodForHeight returns the indexed period that covers the height, or nil if the height is not covered.
+func (hi *HeightIndex) PeriodForHeight(height int64) *HeightIndexPeriod {
+	idx := sort.Search(len(hi.Periods), func(i int) bool { return hi.Periods[i].EndHeight >= height })
+	if idx < len(hi.Periods) && hi.Periods[idx].StartHeight <= height {
+		return hi.Periods[idx]
+	}
+	return nil
+}
+
+// sha256Shipped returns the hex encoded SHA-256 checksum and size of a shipped file. Files in an object store are read
+// in full.
+func sha256Shipped(ctx context.Context, sh Shipper, path string) (string, int64, error) {
+	if root, ok := localShipPath(sh); ok {
+		return sha256File(filepath.Join(root, path))
+	}
+	data, err := sh.Read(ctx, filepath.ToSlash(path))
+	if err != nil {
+		return "", 0, fmt.Errorf("read: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), int64(len(data)), nil
+}
+
+// readHeightIndex reads the height index for a network from the ship path. It returns nil if no index has been written.
+func readHeightIndex(ctx context.Context, sh Shipper, network string) (*HeightIndex, error) {
+	data, err := sh.Read(ctx, heightIndexPath(network))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var hi HeightIndex
+	if err := json.Unmarshal(data, &hi); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if hi.Files == nil {
+		hi.Files = map[string]*HeightIndexFileRef{}
+	}
+	return &hi, nil
+}
+
+func writeHeightIndex(ctx context.Context, sh Shipper, hi *HeightIndex) error {
+	hi.Generated = time.Now().UTC()
+	data, err := json.MarshalIndent(hi, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return sh.Write(ctx, heightIndexPath(hi.Network), data)
+}
+
+// buildHeightIndex scans the ship path for all shipped files up to and including the given period.
+func buildHeightIndex(ctx context.Context, last ExportPeriod, network string, genesisTs int64, sh Shipper, schemaVersion int, targets []ShipTarget) (*HeightIndex, error) {
+	hi := &HeightIndex{
+		Network:   network,
+		GenesisTs: genesisTs,
+		Files:     map[string]*HeightIndexFileRef{},
+	}
+
+	for p := firstExportPeriod(genesisTs); p.StartHeight <= last.StartHeight; p = p.Next() {
+		em, err := manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, StableTables, targets)
+		if err != nil {
+			return nil, fmt.Errorf("build manifest for period: %w", err)
+		}
+		if err := hi.SetPeriod(ctx, em, sh); err != nil {
+			return nil, fmt.Errorf("index period %s: %w", p.Date.String(), err)
+		}
+	}
+
+	return hi, nil
+}
+
+var heightIndexMu sync.Mutex
+
+// updateHeightIndex updates the height index in the ship path with the files shipped for a period. The index is
+// rebuilt from the ship path if it has not been written before.
+func updateHeightIndex(ctx context.Context, p ExportPeriod, network string, genesisTs int64, sh Shipper, schemaVersion int, targets []ShipTarget) error {
+	// Backfill workers and the export loop may update the index at the same time
+	heightIndexMu.Lock()
+	defer heightIndexMu.Unlock()
+
+	hi, err := readHeightIndex(ctx, sh, network)
+	if err != nil {
+		return fmt.Errorf("read height index: %w", err)
+	}
+
+	if hi == nil || hi.GenesisTs != genesisTs {
+		hi, err = buildHeightIndex(ctx, p, network, genesisTs, sh, schemaVersion, targets)
+		if err != nil {
+			return fmt.Errorf("build height index: %w", err)
+		}
+	} else {
+		em, err := manifestForPeriod(ctx, p, network, genesisTs, sh, schemaVersion, StableTables, targets)
+		if err != nil {
+			return fmt.Errorf("build manifest for period: %w", err)
+		}
+		if err := hi.SetPeriod(ctx, em, sh); err != nil {
+			return fmt.Errorf("index period %s: %w", p.Date.String(), err)
+		}
+	}
+
+	if err := writeHeightIndex(ctx, sh, hi); err != nil {
+		return err
+	}
+	if err := writeTableIndexes(ctx, sh, hi); err != nil {
+		return err
+	}
+
+	// Every network's indexes are read from the ship path so the archive index also lists networks shipped by other
+	// archivers sharing the ship path
+	if err := writeArchiveIndex(ctx, sh, network); err != nil {
+		return fmt.Errorf("write archive index: %w", err)
+	}
+	return nil
+}
+
+// TableIndexSuffix is appended to the name of a table to form the name of the table index file written to the table's
+// directory in the ship path.
+const TableIndexSuffix = ".index.json"
+
+// TableIndex lists every shipped file of a single table, across all years, so consumers can plan bulk downloads of a
+// table without listing its directories.
+type TableIndex struct {
+	Network   string            `json:"network"`
+	Table     string            `json:"table"`
+	Generated time.Time         `json:"generated"`
+	TotalSize int64             `json:"total_size"`
+	Files     []*TableIndexFile `json:"files"` // sorted by date
+}
+
+// TableIndexFile describes a single shipped file of a table.
+type TableIndexFile struct {
+	Path        string `json:"path"` // path relative to the ship path
+	Date        Date   `json:"date"`
+	StartHeight int64  `json:"start_height"`
+	EndHeight   int64  `json:"end_height"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	CID         string `json:"cid"`
+	IPFSCID     string `json:"ipfs_cid,omitempty"`
+}
+
+// tableIndexPath returns the path of the table index for a table directory, relative to the ship path.
+func tableIndexPath(tableDir, table string) string {
+	return filepath.Join(tableDir, table+TableIndexSuffix)
+}
+
+// tableIndexesFromHeightIndex groups the files of a height index into an index per table, keyed by the path of the
+// table index relative to the ship path.
+func tableIndexesFromHeightIndex(hi *HeightIndex) map[string]*TableIndex {
+	indexes := map[string]*TableIndex{}
+	for path, ref := range hi.Files {
+		// Files are written to <table dir>/<year>/<file> unless they were shipped with a layout
+		tableDir := filepath.Dir(filepath.Dir(path))
+		if ref.TableDir != "" {
+			tableDir = ref.TableDir
+		}
+		ip := tableIndexPath(tableDir, ref.Table)
+		ti, ok := indexes[ip]
+		if !ok {
+			ti = &TableIndex{
+				Network:   hi.Network,
+				Table:     ref.Table,
+				Generated: hi.Generated,
+			}
+			indexes[ip] = ti
+		}
+
+		ti.Files = append(ti.Files, &TableIndexFile{
+			Path:        path,
+			Date:        ref.Date,
+			StartHeight: ref.StartHeight,
+			EndHeight:   ref.EndHeight,
+			Size:        ref.Size,
+			SHA256:      ref.SHA256,
+			CID:         ref.CID,
+			IPFSCID:     ref.IPFSCID,
+		})
+		ti.TotalSize += ref.Size
+	}
+
+	for _, ti := range indexes {
+		sort.Slice(ti.Files, func(a, b int) bool {
+			if ti.Files[a].StartHeight != ti.Files[b].StartHeight {
+				return ti.Files[a].StartHeight < ti.Files[b].StartHeight
+			}
+			return ti.Files[a].Path < ti.Files[b].Path
+		})
+	}
+
+	return indexes
+}
+
+// writeTableIndexes regenerates the table index of every table in the height index. Each index is replaced
+// atomically so consumers never read a partially written index.
+func writeTableIndexes(ctx context.Context, sh Shipper, hi *HeightIndex) error {
+	for path, ti := range tableIndexesFromHeightIndex(hi) {
+		data, err := json.MarshalIndent(ti, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode table index for %s: %w", ti.Table, err)
+		}
+		if err := sh.Write(ctx, filepath.ToSlash(path), data); err != nil {
+			return fmt.Errorf("write table index for %s: %w", ti.Table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTableIndexesFromHeightIndex(t *testing.T) {
+	hi := &HeightIndex{
+		Network: "mainnet",
+		Files: map[string]*HeightIndexFileRef{
+			"mainnet/csv/1/messages/2022/messages-2022-01-01.csv.gz": {Table: "messages", StartHeight: 1440000, EndHeight: 1442879, Size: 30},
+			"mainnet/csv/1/messages/2021/messages-2021-12-31.csv.gz": {Table: "messages", StartHeight: 1437120, EndHeight: 1439999, Size: 20},
+			"mainnet/csv/1/receipts/2021/receipts-2021-12-31.csv.gz": {Table: "receipts", StartHeight: 1437120, EndHeight: 1439999, Size: 5},
+		},
+	}
+
+	indexes := tableIndexesFromHeightIndex(hi)
+	if len(indexes) != 2 {
+		t.Fatalf("got %d table indexes, wanted 2", len(indexes))
+	}
+
+	ti, ok := indexes["mainnet/csv/1/messages/messages.index.json"]
+	if !ok {
+		t.Fatalf("missing index for messages table")
+	}
+	if ti.Table != "messages" || ti.TotalSize != 50 {
+		t.Errorf("got table %q with total size %d, wanted messages with total size 50", ti.Table, ti.TotalSize)
+	}
+	if len(ti.Files) != 2 {
+		t.Fatalf("got %d files, wanted 2", len(ti.Files))
+	}
+	if ti.Files[0].StartHeight != 1437120 || ti.Files[1].StartHeight != 1440000 {
+		t.Errorf("files not sorted by height: %d, %d", ti.Files[0].StartHeight, ti.Files[1].StartHeight)
+	}
+}
+
+func TestHeightIndexSetPeriod(t *testing.T) {
+	ctx := context.Background()
+	shipPath := t.TempDir()
+	// Files in an object store are hashed by reading them through the shipper
+	sh := &opaqueShipper{Shipper: &fileShipper{root: shipPath}}
+	first := firstExportPeriod(MainnetGenesisTs)
+	p := first.Next()
+	file := func(table string, shipped bool) *ExportFile {
+		return &ExportFile{Date: p.Date, Network: "mainnet", TableName: table, Schema: 1, Format: "csv", Compression: CompressionByName["gz"], Shipped: shipped}
+	}
+	write := func(ef *ExportFile, data string) {
+		path := filepath.Join(shipPath, ef.Path())
+		if err := os.MkdirAll(filepath.Dir(path), DefaultDirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, receipts := file("messages", true), file("receipts", true)
+	write(messages, "messages")
+	write(receipts, "receipts")
+	em := &ExportManifest{Period: p, Network: "mainnet", Files: []*ExportFile{messages, receipts, file("block_headers", false)}}
+
+	hi := &HeightIndex{Network: "mainnet", GenesisTs: MainnetGenesisTs, Files: map[string]*HeightIndexFileRef{}}
+	if err := hi.SetPeriod(ctx, em, sh); err != nil {
+		t.Fatal(err)
+	}
+	if len(hi.Periods) != 1 || !reflect.DeepEqual(hi.Periods[0].Files, []string{messages.Path(), receipts.Path()}) {
+		t.Fatalf("got periods %+v, wanted one period with the shipped files", hi.Periods)
+	}
+	sum := sha256.Sum256([]byte("messages"))
+	ref := hi.Files[messages.Path()]
+	if ref == nil || ref.SHA256 != hex.EncodeToString(sum[:]) || ref.Size != 8 || ref.CID == "" || ref.StartHeight != p.StartHeight || ref.EndHeight != p.EndHeight {
+		t.Errorf("got file %+v", ref)
+	}
+
+	// Checksums are kept while a file's size is unchanged and recomputed when it changes
+	write(messages, "MESSAGES")
+	if err := hi.SetPeriod(ctx, em, sh); err != nil {
+		t.Fatal(err)
+	}
+	if hi.Files[messages.Path()].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum of a file with an unchanged size was recomputed")
+	}
+	write(messages, "more messages")
+	if err := hi.SetPeriod(ctx, em, sh); err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256([]byte("more messages"))
+	if hi.Files[messages.Path()].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum of a file with a changed size was not recomputed")
+	}
+	if len(hi.Periods) != 1 || len(hi.Files) != 2 {
+		t.Errorf("got %d periods and %d files after reindexing the period, wanted 1 and 2", len(hi.Periods), len(hi.Files))
+	}
+
+	// A shipped file missing from the ship path that was not pruned is an error
+	if err := os.Remove(filepath.Join(shipPath, receipts.Path())); err != nil {
+		t.Fatal(err)
+	}
+	if err := hi.SetPeriod(ctx, em, sh); err == nil {
+		t.Errorf("expected an error indexing a missing file")
+	}
+}
+
+func TestHeightIndexPeriodForHeight(t *testing.T) {
+	hi := &HeightIndex{}
+	for p, i := firstExportPeriod(MainnetGenesisTs), 0; i < 3; p, i = p.Next(), i+1 {
+		if i == 1 {
+			continue // a gap in the index
+		}
+		hi.Periods = append(hi.Periods, &HeightIndexPeriod{Date: p.Date, StartHeight: p.StartHeight, EndHeight: p.EndHeight})
+	}
+
+	testCases := []struct {
+		height int64
+		want   int // index of the expected period, -1 for none
+	}{
+		{height: 0, want: 0},
+		{height: hi.Periods[0].EndHeight, want: 0},
+		{height: hi.Periods[0].EndHeight + 1, want: -1},
+		{height: hi.Periods[1].StartHeight, want: 1},
+		{height: hi.Periods[1].EndHeight, want: 1},
+		{height: hi.Periods[1].EndHeight + 1, want: -1},
+		{height: -1, want: -1},
+	}
+	for _, tc := range testCases {
+		var want *HeightIndexPeriod
+		if tc.want >= 0 {
+			want = hi.Periods[tc.want]
+		}
+		if got := hi.PeriodForHeight(tc.height); got != want {
+			t.Errorf("height %d: got period %+v, wanted %+v", tc.height, got, want)
+		}
+	}
+}
+
+func TestReadWriteHeightIndex(t *testing.T) {
+	ctx := context.Background()
+	shipPath := t.TempDir()
+	sh := &fileShipper{root: shipPath}
+	hi, err := readHeightIndex(ctx, sh, "mainnet")
+	if err != nil || hi != nil {
+		t.Fatalf("got index %+v (%v) before one was written, wanted none", hi, err)
+	}
+
+	written := &HeightIndex{
+		Network:   "mainnet",
+		GenesisTs: MainnetGenesisTs,
+		Periods:   []*HeightIndexPeriod{{StartHeight: 0, EndHeight: 2879, Files: []string{"a"}}},
+		Files:     map[string]*HeightIndexFileRef{"a": {Table: "messages", EndHeight: 2879, Size: 1, SHA256: "ab"}},
+	}
+	if err := writeHeightIndex(ctx, sh, written); err != nil {
+		t.Fatal(err)
+	}
+	hi, err = readHeightIndex(ctx, sh, "mainnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hi.Generated.Equal(written.Generated) {
+		t.Errorf("got generated time %v, wanted %v", hi.Generated, written.Generated)
+	}
+	hi.Generated = written.Generated
+	if !reflect.DeepEqual(hi, written) {
+		t.Errorf("got index %+v, wanted %+v", hi, written)
+	}
+
+	if err := os.WriteFile(filepath.Join(shipPath, heightIndexPath("mainnet")), []byte("{"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readHeightIndex(ctx, sh, "mainnet"); err == nil {
+		t.Errorf("expected an error reading a corrupt index")
+	}
+}
+
+func TestHeightIndexChecksumsFromManifest(t *testing.T) {
+	ctx := context.Background()
+	shipPath := t.TempDir()
+	sh := &fileShipper{root: shipPath}
+	p := firstExportPeriod(MainnetGenesisTs)
+	ef := &ExportFile{Date: p.Date, Network: "mainnet", TableName: "messages", Schema: 1, Format: "csv", Compression: CompressionByName["gz"], Shipped: true}
+	if err := os.MkdirAll(filepath.Join(shipPath, filepath.Dir(ef.Path())), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shipPath, ef.Path()), []byte("messages"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	em := &ExportManifest{Period: p, Network: "mainnet", Files: []*ExportFile{ef}}
+
+	// The checksum recorded when the file was shipped is used without rereading the file, so a manifest recording a
+	// different checksum for a file of the same size is believed
+	recorded := sha256.Sum256([]byte("MESSAGES"))
+	shipped := *ef
+	shipped.Size, shipped.SHA256 = 8, hex.EncodeToString(recorded[:])
+	if err := writePeriodManifest(ctx, em, []*ExportFile{&shipped}, sh); err != nil {
+		t.Fatal(err)
+	}
+	hi := &HeightIndex{Network: "mainnet", Files: map[string]*HeightIndexFileRef{}}
+	if err := hi.SetPeriod(ctx, em, sh); err != nil {
+		t.Fatal(err)
+	}
+	if got := hi.Files[ef.Path()].SHA256; got != shipped.SHA256 {
+		t.Errorf("got checksum %s, wanted %s from the manifest", got, shipped.SHA256)
+	}
+
+	// A file whose size differs from the manifest is hashed
+	shipped.Size = 9
+	if err := writePeriodManifest(ctx, em, []*ExportFile{&shipped}, sh); err != nil {
+		t.Fatal(err)
+	}
+	hi = &HeightIndex{Network: "mainnet", Files: map[string]*HeightIndexFileRef{}}
+	if err := hi.SetPeriod(ctx, em, sh); err != nil {
+		t.Fatal(err)
+	}
+	actual := sha256.Sum256([]byte("messages"))
+	if got := hi.Files[ef.Path()].SHA256; got != hex.EncodeToString(actual[:]) {
+		t.Errorf("got checksum %s, wanted %s computed from the file", got, hex.EncodeToString(actual[:]))
+	}
+}
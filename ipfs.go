@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// ipfsAPIURL converts the address of an IPFS API, given as a multiaddr or a URL, to the base URL of its HTTP API.
+func ipfsAPIURL(addr string) (string, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err == nil {
+		network, daddr, err := manet.DialArgs(ma)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(network, "tcp") {
+			return "", fmt.Errorf("unsupported ipfs api address %q, the http api is served over tcp", addr)
+		}
+		return "http://" + daddr, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported ipfs api address %q, expected a multiaddr or an http url", addr)
+	}
+	return strings.TrimSuffix(addr, "/"), nil
+}
+
+type ipfsAddResponse struct {
+	Name string `json:"Name"`
+	Hash string `json:"Hash"`
+}
+
+// ipfsAddFile adds a file to IPFS using the add endpoint of the HTTP API, pinning it if requested, and returns the CID
+// of the root of the file. Files are added as CIDv1 with raw leaves so a file made of a single block has the same CID
+// as its raw contents.
+func ipfsAddFile(ctx context.Context, client *http.Client, apiURL string, path string, pin bool) (cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	limits := shipLimitsFor(apiURL)
+	release, err := limits.acquire(ctx)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer release()
+
+	// The file is streamed to the API rather than being buffered since shipped files may be very large
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(path))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(limits.writer(ctx, part), &contextReader{ctx: ctx, r: f}); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	query := url.Values{
+		"pin":         {fmt.Sprint(pin)},
+		"cid-version": {"1"},
+		"quieter":     {"true"},
+		"progress":    {"false"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"/api/v0/add?"+query.Encode(), pr)
+	if err != nil {
+		pr.Close()
+		return cid.Undef, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		pr.Close()
+		return cid.Undef, fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return cid.Undef, fmt.Errorf("add: unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	// The response is a stream of json objects, the last of which describes the root
+	var last ipfsAddResponse
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var r ipfsAddResponse
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return cid.Undef, fmt.Errorf("decode response: %w", err)
+		}
+		if r.Hash != "" {
+			last = r
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cid.Undef, fmt.Errorf("read response: %w", err)
+	}
+	if last.Hash == "" {
+		return cid.Undef, fmt.Errorf("no cid returned")
+	}
+
+	c, err := cid.Decode(last.Hash)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("decode cid %q: %w", last.Hash, err)
+	}
+	return c, nil
+}
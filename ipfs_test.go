@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestIPFSAPIURL(t *testing.T) {
+	testCases := []struct {
+		addr string
+		want string
+		err  bool
+	}{
+		{addr: "/ip4/127.0.0.1/tcp/5001", want: "http://127.0.0.1:5001"},
+		{addr: "/ip6/::1/tcp/5001", want: "http://[::1]:5001"},
+		{addr: "/dns4/ipfs.example.com/tcp/5001", want: "http://ipfs.example.com:5001"},
+		{addr: "http://127.0.0.1:5001", want: "http://127.0.0.1:5001"},
+		{addr: "https://ipfs.example.com/", want: "https://ipfs.example.com"},
+		{addr: "/ip4/127.0.0.1/udp/5001", err: true},
+		{addr: "ftp://ipfs.example.com", err: true},
+		{addr: "127.0.0.1:5001", err: true},
+	}
+	for _, tc := range testCases {
+		got, err := ipfsAPIURL(tc.addr)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: got error %v, wanted error %v", tc.addr, err, tc.err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, wanted %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestIPFSAddFile(t *testing.T) {
+	data := "1005360,messages\n"
+	sum := sha256.Sum256([]byte(data))
+	want, err := rawCidFromSHA256(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotQuery, gotName, gotData string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v0/add" {
+			http.NotFound(w, r)
+			return
+		}
+		gotQuery = r.URL.RawQuery
+		f, fh, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		gotName, gotData = fh.Filename, string(b)
+		fmt.Fprintf(w, "{\"Name\":\"\",\"Bytes\":%d}\n", len(b))
+		fmt.Fprintf(w, "{\"Name\":%q,\"Hash\":%q,\"Size\":\"%d\"}\n", fh.Filename, want.String(), len(b))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(path, []byte(data), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ipfsAddFile(context.Background(), srv.Client(), srv.URL, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got cid %s, wanted %s", got, want)
+	}
+	if gotName != "messages.csv.gz" || gotData != data {
+		t.Errorf("api received file %q with contents %q", gotName, gotData)
+	}
+	if gotQuery != "cid-version=1&pin=true&progress=false&quieter=true" {
+		t.Errorf("got query %q", gotQuery)
+	}
+}
+
+func TestIPFSAddFileErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(path, []byte("1005360,messages\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "repo is locked", http.StatusInternalServerError)
+			},
+		},
+		{
+			name:    "no cid",
+			handler: func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, `{"Name":"messages.csv.gz"}`) },
+		},
+		{
+			name: "invalid cid",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, `{"Name":"messages.csv.gz","Hash":"bafy"}`)
+			},
+		},
+		{
+			name:    "invalid json",
+			handler: func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, `{"Name":`) },
+		},
+	}
+	for _, tc := range testCases {
+		srv := httptest.NewServer(tc.handler)
+		c, err := ipfsAddFile(context.Background(), srv.Client(), srv.URL, path, false)
+		if err == nil {
+			t.Errorf("%s: got cid %s, wanted an error", tc.name, c)
+		}
+		srv.Close()
+	}
+
+	// An unresponsive api fails once the client's timeout passes rather than blocking the export
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+	defer srv.Close()
+	defer close(block)
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	if c, err := ipfsAddFile(context.Background(), client, srv.URL, path, false); err == nil || c != cid.Undef {
+		t.Errorf("got cid %s (%v) from an unresponsive api, wanted an error", c, err)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lily/lens/lily"
+	"github.com/filecoin-project/lily/schedule"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// Types of lily job that may be used to produce the files for an export
+const (
+	JobTypeWalk   = "walk"   // a single walk job covering the period
+	JobTypeIndex  = "index"  // an index request for each tipset in the period, run by the archiver
+	JobTypeNotify = "notify" // a notify walk that enqueues each tipset for a tipset worker
+
+	JobTypeDatabase = "database" // a copy of the period from an existing lily database
+)
+
+func parseJobType(s string) (string, error) {
+	switch s {
+	case JobTypeWalk, JobTypeIndex, JobTypeNotify, JobTypeDatabase:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown job type %q", s)
+	}
+}
+
+// exportJobIsCompleted runs the configured type of lily job to produce the files for the manifest.
+// note: walkInfo is an out parameter
+func exportJobIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkInfo *WalkInfo, ll basicLogger) func(context.Context) (bool, error) {
+	switch jobConfig.jobType {
+	case JobTypeIndex:
+		return indexIsCompleted(apiAddr, apiToken, em, walkInfo, ll)
+	case JobTypeNotify:
+		return notifyWalkIsCompleted(apiAddr, apiToken, em, walkInfo, ll)
+	case JobTypeDatabase:
+		return databaseExportIsCompleted(em, walkInfo, ll)
+	default:
+		return walkIsCompleted(apiAddr, apiToken, em, walkInfo, ll)
+	}
+}
+
+// indexIsCompleted indexes every tipset in the period using individual index requests. Unlike a walk, each request
+// completes when its tipset has been indexed, so requests can be run in parallel and a failure only requires the
+// affected tipset to be retried.
+func indexIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkInfo *WalkInfo, ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		walkCfg, err := walkForManifest(em)
+		if err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorf("failed to create index configuration: %v", err)
+			return false, nil
+		}
+
+		api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
+		if err != nil {
+			lilyConnectionErrorsCounter.Inc()
+			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
+			return false, nil
+		}
+		defer closer()
+
+		keys, err := tipSetKeysForRange(ctx, api, walkCfg.From, walkCfg.To)
+		if err != nil {
+			lilyJobErrorsCounter.Inc()
+			ll.Errorw("failed to list tipsets for period", "error", err)
+			return false, nil
+		}
+
+		ll.Infow("indexing tipsets", "walk", walkCfg.JobConfig.Name, "tipsets", len(keys), "workers", jobConfig.indexWorkers)
+		if failed := indexTipSets(ctx, api, walkCfg.JobConfig, keys, jobConfig.indexWorkers, requestRetryPolicy(), ll); failed > 0 {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed to index %d tipsets", failed), "walk", walkCfg.JobConfig.Name)
+			return false, nil
+		}
+		ll.Infow("indexing complete", "walk", walkCfg.JobConfig.Name)
+
+		wi := WalkInfo{
+			Name:   walkCfg.JobConfig.Name,
+			Path:   storageConfig.path,
+			Format: "csv",
+		}
+		if err := touchExportFiles(ctx, em, wi); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed to touch export files: %v", err), "walk", walkCfg.JobConfig.Name)
+			return false, nil
+		}
+
+		*walkInfo = wi
+		return true, nil
+	}
+}
+
+// tipSetKeysForRange returns the keys of every tipset between the heights, inclusive, in descending height order.
+func tipSetKeysForRange(ctx context.Context, api lily.LilyAPI, from, to int64) ([]types.TipSetKey, error) {
+	tss, err := tipSetsForRange(ctx, api, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]types.TipSetKey, 0, len(tss))
+	for _, ts := range tss {
+		keys = append(keys, ts.Key())
+	}
+	return keys, nil
+}
+
+// tipSetsForRange returns every tipset of the node's canonical chain between the heights, inclusive, in descending
+// height order.
+func tipSetsForRange(ctx context.Context, api lily.LilyAPI, from, to int64) ([]*types.TipSet, error) {
+	ts, err := api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(to), types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("get tipset at height %d: %w", to, err)
+	}
+
+	var tss []*types.TipSet
+	for int64(ts.Height()) >= from {
+		tss = append(tss, ts)
+		if ts.Height() == 0 {
+			break
+		}
+
+		parent, err := api.ChainGetTipSet(ctx, ts.Parents())
+		if err != nil {
+			return nil, fmt.Errorf("get parent of tipset at height %d: %w", ts.Height(), err)
+		}
+		ts = parent
+	}
+
+	return tss, nil
+}
+
+// indexTipSets indexes the tipsets using the given number of parallel requests and returns the number of tipsets that
+// could not be indexed. Each failed request is retried by the policy.
+func indexTipSets(ctx context.Context, api lily.LilyAPI, cfg lily.LilyJobConfig, keys []types.TipSetKey, workers int, policy RetryPolicy, ll basicLogger) int {
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan types.TipSetKey)
+	var (
+		mu     sync.Mutex
+		failed int
+		wg     sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				err := Retry(ctx, policy, func(ctx context.Context) error {
+					_, err := api.LilyIndex(ctx, &lily.LilyIndexConfig{JobConfig: cfg, TipSet: key})
+					return err
+				})
+				if err != nil {
+					ll.Errorw("failed to index tipset", "error", err, "tipset", key.String())
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		select {
+		case work <- key:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return len(keys)
+	}
+	return failed
+}
+
+// notifyWalkIsCompleted starts a tipset worker writing to the archiver's storage and a notify walk that enqueues the
+// tipsets of the period for it. The walk ends once every tipset has been enqueued, so completion is determined by
+// waiting for the worker's output to cover the whole period. Versions of lily whose tipset workers cannot write to
+// file storage are detected when the worker is started and the export falls back to a classic walk.
+func notifyWalkIsCompleted(apiAddr string, apiToken string, em *ExportManifest, walkInfo *WalkInfo, ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		walkCfg, err := walkForManifest(em)
+		if err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorf("failed to create walk configuration: %v", err)
+			return false, nil
+		}
+
+		var jobID schedule.JobID
+		ll.Infow("starting notify walk", "walk", walkCfg.JobConfig.Name, "queue", jobConfig.queue)
+		if err := Poll(ctx, requestRetryPolicy(), 0, jobHasBeenStarted(apiAddr, apiToken, walkCfg, jobConfig.queue, nil, &jobID, ll)); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed starting notify walk: %v", err), "walk", walkCfg.JobConfig.Name)
+			return false, nil
+		}
+
+		// The worker is named after the walk so that its output files are named the same as those of a classic walk
+		var workerID schedule.JobID
+		if err := Poll(ctx, requestRetryPolicy(), 0, tipSetWorkerHasBeenStarted(apiAddr, apiToken, walkCfg.JobConfig, jobConfig.queue, &workerID, ll)); err != nil {
+			ll.Errorw(fmt.Sprintf("failed starting tipset worker, falling back to walk: %v", err), "walk", walkCfg.JobConfig.Name)
+			stopJob(ctx, apiAddr, apiToken, jobID, ll)
+			return walkIsCompleted(apiAddr, apiToken, em, walkInfo, ll)(ctx)
+		}
+		defer stopJob(ctx, apiAddr, apiToken, workerID, ll)
+
+		ll.Infow("waiting for notify walk to enqueue tipsets", "walk", walkCfg.JobConfig.Name, "job_id", jobID)
+		if err := Poll(ctx, requestRetryPolicy(), DefaultPollInterval, jobHasEnded(apiAddr, apiToken, jobID, ll)); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed waiting for notify walk to finish: %v", err), "walk", walkCfg.JobConfig.Name, "job_id", jobID)
+			return false, nil
+		}
+
+		var jobListRes schedule.JobListResult
+		if err := Poll(ctx, requestRetryPolicy(), 0, jobGetResult(apiAddr, apiToken, walkCfg.JobConfig.Name, jobID, &jobListRes, ll)); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed waiting notify walk result: %v", err), "walk", walkCfg.JobConfig.Name, "job_id", jobID)
+			return false, nil
+		}
+		if jobListRes.Error != "" {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("notify walk failed: %s", jobListRes.Error), "walk", walkCfg.JobConfig.Name, "job_id", jobID)
+			return false, nil
+		}
+
+		wi := WalkInfo{
+			Name:   walkCfg.JobConfig.Name,
+			Path:   storageConfig.path,
+			Format: "csv",
+		}
+
+		ll.Infow("waiting for tipset worker to process enqueued tipsets", "walk", walkCfg.JobConfig.Name, "worker_id", workerID)
+		wctx, cancel := context.WithTimeout(ctx, jobConfig.notifyTimeout)
+		coverPolicy := requestRetryPolicy()
+		coverPolicy.Interval = time.Minute
+		err = Poll(wctx, coverPolicy, 0, exportCoversPeriod(wi, em, tasksForManifest(em)))
+		cancel()
+		if err != nil {
+			if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+				return false, err
+			}
+			// Verification will report whatever is still missing
+			ll.Errorw("timed out waiting for tipset worker, verifying partial export", "walk", walkCfg.JobConfig.Name)
+		}
+
+		if err := touchExportFiles(ctx, em, wi); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw(fmt.Sprintf("failed to touch export files: %v", err), "walk", walkCfg.JobConfig.Name)
+			return false, nil
+		}
+
+		*walkInfo = wi
+		return true, nil
+	}
+}
+
+// note: workerID is an out parameter
+func tipSetWorkerHasBeenStarted(apiAddr string, apiToken string, cfg lily.LilyJobConfig, queue string, workerID *schedule.JobID, ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
+		if err != nil {
+			lilyConnectionErrorsCounter.Inc()
+			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
+			return false, fmt.Errorf("connect to lily api: %w", err)
+		}
+		defer closer()
+
+		jobs, err := api.LilyJobList(ctx)
+		if err != nil {
+			lilyJobErrorsCounter.Inc()
+			ll.Errorw("failed to read jobs", "error", err)
+			return false, fmt.Errorf("read jobs: %w", err)
+		}
+		for _, jr := range jobs {
+			if jr.Type == "tipset-worker" && jr.Running && jr.Name == cfg.Name && jr.Params["queue"] == queue {
+				ll.Infow("adopting running tipset worker", "job_id", jr.ID, "worker", jr.Name)
+				*workerID = jr.ID
+				return true, nil
+			}
+		}
+
+		// Errors starting the worker are configuration problems rather than transient failures
+		res, err := api.StartTipSetWorker(ctx, &lily.LilyTipSetWorkerConfig{JobConfig: cfg, Queue: queue})
+		if err != nil {
+			return false, Permanent(err)
+		}
+		*workerID = res.ID
+		return true, nil
+	}
+}
+
+func stopJob(ctx context.Context, apiAddr string, apiToken string, id schedule.JobID, ll basicLogger) {
+	api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
+	if err != nil {
+		lilyConnectionErrorsCounter.Inc()
+		ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
+		return
+	}
+	defer closer()
+
+	if err := api.LilyJobStop(ctx, id); err != nil {
+		lilyJobErrorsCounter.Inc()
+		ll.Errorw("failed to stop job", "error", err, "job_id", id)
+	}
+}
+
+// exportCoversPeriod reports whether the chain consensus export includes every height of the period and the
+// processing reports include every expected height for each task.
+func exportCoversPeriod(wi WalkInfo, em *ExportManifest, tasks []string) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		covered, err := consensusCoversRange(wi, em.Period.StartHeight, em.Period.EndHeight)
+		if err != nil || !covered {
+			return false, nil
+		}
+
+		report, err := verifyTasks(ctx, wi, em.Period.StartHeight, em.Period.EndHeight, tasks)
+		if err != nil {
+			return false, nil
+		}
+		for _, ts := range report.TaskStatus {
+			if len(ts.Missing) > 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// consensusCoversRange reports whether the chain consensus export has a row for every height in the range.
+func consensusCoversRange(wi WalkInfo, from, to int64) (bool, error) {
+	f, err := os.Open(wi.WalkFile("chain_consensus"))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	seen := map[int64]bool{}
+	r := csv.NewReader(bufio.NewReader(f))
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("read: %w", err)
+		}
+		height, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("malformed height: %w", err)
+		}
+		seen[height] = true
+	}
+
+	for h := from; h <= to; h++ {
+		if !seen[h] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lily/lens/lily"
+	"github.com/filecoin-project/lotus/chain/types"
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+// flakyIndexLily fails the first requests to index each tipset
+type flakyIndexLily struct {
+	lily.LilyAPI
+	failures map[string]int   // number of requests that fail for each tipset
+	errs     map[string]error // error returned by failing requests for each tipset, a transient error if nil
+
+	mu       sync.Mutex
+	requests map[string]int
+	times    map[string][]time.Time
+}
+
+func (l *flakyIndexLily) LilyIndex(ctx context.Context, cfg *lily.LilyIndexConfig) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := cfg.TipSet.String()
+	l.requests[key]++
+	l.times[key] = append(l.times[key], time.Now())
+	if l.requests[key] <= l.failures[key] {
+		if err := l.errs[key]; err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("index request %d failed", l.requests[key])
+	}
+	return true, nil
+}
+
+func testTipSetKey(t *testing.T, seed string) types.TipSetKey {
+	t.Helper()
+	sum := sha256.Sum256([]byte(seed))
+	c, err := rawCidFromSHA256(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.NewTipSetKey(c)
+}
+
+func TestIndexTipSetsRetries(t *testing.T) {
+	retryAttemptsCounter = metrics.NewCtx(context.Background(), "retry_attempts_total", "").Counter()
+	retryExhaustedCounter = metrics.NewCtx(context.Background(), "retry_exhausted_total", "").Counter()
+
+	ok, flaky, broken, missing := testTipSetKey(t, "ok"), testTipSetKey(t, "flaky"), testTipSetKey(t, "broken"), testTipSetKey(t, "missing")
+	api := &flakyIndexLily{
+		failures: map[string]int{flaky.String(): 2, broken.String(): 100, missing.String(): 100},
+		errs:     map[string]error{missing.String(): Permanent(errors.New("tipset not found"))},
+		requests: map[string]int{},
+		times:    map[string][]time.Time{},
+	}
+	policy := RetryPolicy{Initial: 20 * time.Millisecond, Max: 40 * time.Millisecond, MaxAttempts: 4}
+
+	failed := indexTipSets(context.Background(), api, lily.LilyJobConfig{Name: "index"}, []types.TipSetKey{ok, flaky, broken, missing}, 2, policy, logger)
+	if failed != 2 {
+		t.Errorf("got %d failed tipsets, wanted the broken and missing tipsets to fail", failed)
+	}
+
+	for key, want := range map[types.TipSetKey]int{ok: 1, flaky: 3, broken: 4, missing: 1} {
+		if got := api.requests[key.String()]; got != want {
+			t.Errorf("got %d requests to index %s, wanted %d", got, key, want)
+		}
+	}
+
+	// Retries wait for the policy's backoff rather than following each other at once
+	times := api.times[broken.String()]
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond} {
+		if got := times[i+1].Sub(times[i]); got < want {
+			t.Errorf("retry %d followed after %s, wanted at least %s", i+1, got, want)
+		}
+	}
+}
+
+func TestIndexTipSetsCancelled(t *testing.T) {
+	api := &flakyIndexLily{requests: map[string]int{}, times: map[string][]time.Time{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	keys := []types.TipSetKey{testTipSetKey(t, "a"), testTipSetKey(t, "b")}
+	if failed := indexTipSets(ctx, api, lily.LilyJobConfig{Name: "index"}, keys, 1, RetryPolicy{MaxAttempts: 1}, logger); failed != len(keys) {
+		t.Errorf("got %d failed tipsets after cancellation, wanted all %d", failed, len(keys))
+	}
+}
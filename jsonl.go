@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// convertCSVToJSONL converts a lily csv file read from r to newline delimited JSON written to w, with one object per
+// row holding the row's columns in the order of the table's model. Values are typed using the same mapping as parquet:
+// integers, floating point numbers and booleans are written natively, JSON columns are embedded as JSON and values
+// that lily exports as NULL are written as null. Arbitrary precision numbers such as token amounts are written as
+// strings so that no precision is lost by consumers that read numbers as floating point.
+func convertCSVToJSONL(ef *ExportFile, r io.Reader, w io.Writer) error {
+	t, ok := TablesByName[ef.TableName]
+	if !ok {
+		return fmt.Errorf("unknown table %q", ef.TableName)
+	}
+	cols, err := parquetColumnsForModel(t.Model)
+	if err != nil {
+		return fmt.Errorf("jsonl schema: %w", err)
+	}
+
+	// Column names are encoded once as object keys
+	keys := make([][]byte, len(cols))
+	for i, c := range cols {
+		k, err := json.Marshal(c.Name)
+		if err != nil {
+			return fmt.Errorf("encode column name: %w", err)
+		}
+		keys[i] = append(k, ':')
+	}
+
+	bw := bufio.NewWriter(w)
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(cols)
+	cr.ReuseRecord = true
+	var buf bytes.Buffer
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read csv: %w", err)
+		}
+
+		buf.Reset()
+		buf.WriteByte('{')
+		for i, c := range cols {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(keys[i])
+			if err := appendJSONLValue(&buf, c, row[i]); err != nil {
+				return fmt.Errorf("column %s: %w", c.Name, err)
+			}
+		}
+		buf.WriteString("}\n")
+		if _, err := bw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// appendJSONLValue appends the JSON encoding of a csv formatted value of the column to buf.
+func appendJSONLValue(buf *bytes.Buffer, c parquetColumn, v string) error {
+	if c.Nullable && v == parquetNullCSVValue {
+		buf.WriteString("null")
+		return nil
+	}
+
+	switch {
+	case c.ConvertedType == parquetJSON:
+		if !json.Valid([]byte(v)) {
+			return fmt.Errorf("invalid json value %q", v)
+		}
+		buf.WriteString(v)
+		return nil
+	case c.ConvertedType == parquetTimestampMicros || c.ConvertedType == parquetUTF8:
+		return appendJSONString(buf, v)
+	}
+
+	// Lily writes empty values for nil pointers to numbers and booleans
+	if v == "" {
+		buf.WriteString("null")
+		return nil
+	}
+
+	switch c.Type {
+	case parquetBoolean:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("malformed boolean %q", v)
+		}
+		buf.WriteString(strconv.FormatBool(b))
+	case parquetInt64:
+		if c.ConvertedType == parquetUint64 {
+			if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+				return fmt.Errorf("malformed integer %q", v)
+			}
+		} else if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("malformed integer %q", v)
+		}
+		buf.WriteString(v)
+	case parquetDouble:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("malformed number %q", v)
+		}
+		// JSON has no representation of infinities or NaN
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return appendJSONString(buf, v)
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	default:
+		return appendJSONString(buf, v)
+	}
+	return nil
+}
+
+func appendJSONString(buf *bytes.Buffer, s string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
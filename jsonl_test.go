@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAppendJSONLValue(t *testing.T) {
+	testCases := []struct {
+		name    string
+		col     parquetColumn
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "int", col: parquetColumn{Type: parquetInt64, ConvertedType: parquetNoConvertedType}, value: "1024", want: "1024"},
+		{name: "malformed int", col: parquetColumn{Type: parquetInt64, ConvertedType: parquetNoConvertedType}, value: "1.5", wantErr: true},
+		{name: "uint", col: parquetColumn{Type: parquetInt64, ConvertedType: parquetUint64}, value: "18446744073709551615", want: "18446744073709551615"},
+		{name: "bool", col: parquetColumn{Type: parquetBoolean, ConvertedType: parquetNoConvertedType}, value: "true", want: "true"},
+		{name: "double", col: parquetColumn{Type: parquetDouble, ConvertedType: parquetNoConvertedType}, value: "0.25", want: "0.25"},
+		{name: "infinite double", col: parquetColumn{Type: parquetDouble, ConvertedType: parquetNoConvertedType}, value: "+Inf", want: `"+Inf"`},
+		{name: "string", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetUTF8}, value: `say "hi"`, want: `"say \"hi\""`},
+		{name: "big number", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetUTF8}, value: "100000000000000000000", want: `"100000000000000000000"`},
+		{name: "timestamp", col: parquetColumn{Type: parquetInt64, ConvertedType: parquetTimestampMicros}, value: "2021-08-02T00:00:30Z", want: `"2021-08-02T00:00:30Z"`},
+		{name: "json", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetJSON, Nullable: true}, value: `{"a":[1,2]}`, want: `{"a":[1,2]}`},
+		{name: "json null", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetJSON, Nullable: true}, value: "null", want: "null"},
+		{name: "invalid json", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetJSON}, value: `{"a":`, wantErr: true},
+		{name: "null", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetUTF8, Nullable: true}, value: "NULL", want: "null"},
+		{name: "not nullable", col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetUTF8}, value: "NULL", want: `"NULL"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := appendJSONLValue(&buf, tc.col, tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %s", buf.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("got %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConvertCSVToJSONL(t *testing.T) {
+	in := "100,bafyroot,\"{bafy1,bafy2}\",{bafy3}\n101,bafyroot2,{bafy3},{}\n"
+	var out bytes.Buffer
+	if err := convertCSVToJSONL(&ExportFile{TableName: "chain_consensus"}, strings.NewReader(in), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `{"height":100,"parent_state_root":"bafyroot","parent_tip_set":"{bafy1,bafy2}","tip_set":"{bafy3}"}` + "\n" +
+		`{"height":101,"parent_state_root":"bafyroot2","parent_tip_set":"{bafy3}","tip_set":"{}"}` + "\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+// ErrLagSLOBreached is returned by the lag command when the archive is further behind the chain head than the lag SLO.
+var ErrLagSLOBreached = errors.New("export lag exceeds slo")
+
+// LagStatus describes how far the shipped archive is behind the chain head.
+type LagStatus struct {
+	CompletedHeight int64   `json:"completed_height"` // end height of the latest completed export period
+	HeadHeight      int64   `json:"head_height"`      // current height of the chain
+	Lag             string  `json:"lag"`
+	LagSeconds      float64 `json:"lag_seconds"`
+	SLO             string  `json:"slo,omitempty"` // empty when no lag slo is configured
+	Breached        bool    `json:"breached"`
+}
+
+// exportLagFor returns the time elapsed since the chain reached the height following the end of the latest completed
+// export period, which is how long the data after that period has been waiting to be exported.
+func exportLagFor(height int64, genesisTs int64) time.Duration {
+	lag := time.Since(time.Unix(HeightToUnix(height+1, genesisTs), 0))
+	if lag < 0 {
+		return 0
+	}
+	return lag.Truncate(time.Second)
+}
+
+// lagStatus reports the lag of the latest completed export period against the configured lag slo.
+func lagStatus(height int64, genesisTs int64) *LagStatus {
+	lag := exportLagFor(height, genesisTs)
+	ls := &LagStatus{
+		CompletedHeight: height,
+		HeadHeight:      CurrentHeight(genesisTs),
+		Lag:             lag.String(),
+		LagSeconds:      lag.Seconds(),
+	}
+	if lagConfig.slo > 0 {
+		ls.SLO = lagConfig.slo.String()
+		ls.Breached = lag > lagConfig.slo
+	}
+	return ls
+}
+
+// exportLagTracker reports how far the latest completed export period is behind the chain head. The lag is refreshed
+// periodically so it continues to grow while the archiver waits for, or is stuck on, the next period. The lag is only
+// compared with the lag slo when it is refreshed, so periods that complete in quick succession while the archiver
+// catches up do not raise alerts. A notification is sent when the lag first exceeds the slo and again once it recovers.
+type exportLagTracker struct {
+	mu       sync.Mutex
+	height   int64 // end height of the latest completed export period
+	started  bool  // whether any height has been recorded
+	breached bool
+}
+
+// exportLag tracks the lag of the export loop of the run command.
+var exportLag = &exportLagTracker{}
+
+// Completed records the end height of an export period that has been completed.
+func (t *exportLagTracker) Completed(height int64) {
+	t.mu.Lock()
+	t.height, t.started = height, true
+	t.mu.Unlock()
+	exportLagGauge.Set(float64(CurrentHeight(networkConfig.genesisTs) - height))
+	exportLagSecondsGauge.Set(exportLagFor(height, networkConfig.genesisTs).Seconds())
+}
+
+// Status returns the current lag, or nil if no export period has been recorded.
+func (t *exportLagTracker) Status() *LagStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started {
+		return nil
+	}
+	ls := lagStatus(t.height, networkConfig.genesisTs)
+	ls.Breached = t.breached
+	return ls
+}
+
+// Breached reports whether the lag exceeded the lag slo when it was last refreshed.
+func (t *exportLagTracker) Breached() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.breached
+}
+
+func (t *exportLagTracker) update(ctx context.Context) {
+	t.mu.Lock()
+	if !t.started {
+		t.mu.Unlock()
+		return
+	}
+	height := t.height
+	ls := lagStatus(height, networkConfig.genesisTs)
+	changed := ls.Breached != t.breached
+	t.breached = ls.Breached
+	t.mu.Unlock()
+
+	exportLagGauge.Set(float64(CurrentHeight(networkConfig.genesisTs) - height))
+	exportLagSecondsGauge.Set(ls.LagSeconds)
+	if ls.Breached {
+		exportLagSLOBreachedGauge.Set(1)
+	} else {
+		exportLagSLOBreachedGauge.Set(0)
+	}
+
+	if !changed {
+		return
+	}
+	if ls.Breached {
+		logger.Errorw("export lag exceeds slo", "lag", ls.Lag, "slo", ls.SLO, "completed_height", height)
+	} else {
+		logger.Infow("export lag recovered", "lag", ls.Lag, "slo", ls.SLO, "completed_height", height)
+	}
+	notifyLagSLO(ctx, networkConfig.name, ls)
+}
+
+// Run refreshes the lag at the given interval until the context is cancelled.
+func (t *exportLagTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.update(ctx)
+		}
+	}
+}
+
+// latestShippedPeriod returns the most recent period listed in the height index whose expected files have all been
+// shipped, or nil if there is no such period.
+func latestShippedPeriod(ctx context.Context, hi *HeightIndex, sh Shipper, tables []Table, targets []ShipTarget) (*ExportPeriod, error) {
+	for i := len(hi.Periods) - 1; i >= 0; i-- {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		ip := hi.Periods[i]
+		p := ExportPeriod{Date: ip.Date, Hour: ip.Hour, StartHeight: ip.StartHeight, EndHeight: ip.EndHeight}
+		em, err := manifestForPeriod(ctx, p, hi.Network, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+		if err != nil {
+			return nil, fmt.Errorf("build manifest for period %s: %w", p.String(), err)
+		}
+		shipped := true
+		for _, ef := range em.Files {
+			if ef.NeedsShipping() {
+				shipped = false
+				break
+			}
+		}
+		if shipped {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+var lagCommand = &cli.Command{
+	Name:   "lag",
+	Usage:  "Report how far the shipped archive is behind the chain head, failing if it exceeds the lag slo.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		objectStoreFlags,
+		lagFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path or s3://bucket/prefix or gs://bucket/prefix object store location that files were shipped to.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "ship-formats",
+				EnvVars: []string{"ARCHIVER_SHIP_FORMATS"},
+				Usage:   "Comma separated list of format.compression entries that each table is expected to be shipped in.",
+				Value:   "csv.gz",
+			},
+			&cli.StringFlag{
+				Name:  "tables",
+				Usage: "Comma separated list of tables expected in each period. Default is every stable table.",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the lag as json.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		targets, err := parseShipTargets(cc.String("ship-formats"))
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+		tables := StableTables
+		if cc.IsSet("tables") {
+			names, err := parseTableList(cc.String("tables"))
+			if err != nil {
+				return fmt.Errorf("invalid tables: %w", err)
+			}
+			tables = nil
+			for _, name := range names {
+				tables = append(tables, TablesByName[name])
+			}
+		}
+		tables = currentTableConfig(networkConfig.name).FilterTables(tables)
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to read shipped files: %w", err)
+		}
+
+		data, err := sh.Read(ctx, path.Join(networkConfig.name, HeightIndexFilename))
+		if err != nil {
+			return fmt.Errorf("read height index: %w", err)
+		}
+		var hi HeightIndex
+		if err := json.Unmarshal(data, &hi); err != nil {
+			return fmt.Errorf("decode height index: %w", err)
+		}
+		hi.Network = networkConfig.name
+
+		p, err := latestShippedPeriod(ctx, &hi, sh, tables, targets)
+		if err != nil {
+			return err
+		}
+		// An archive without a complete period is as far behind as the chain is old
+		height := int64(-1)
+		if p != nil {
+			height = p.EndHeight
+		}
+		ls := lagStatus(height, networkConfig.genesisTs)
+
+		if cc.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(ls); err != nil {
+				return err
+			}
+		} else {
+			latest := "none"
+			if p != nil {
+				latest = p.String()
+			}
+			fmt.Printf("latest shipped period: %s (heights to %d)\n", latest, height)
+			fmt.Printf("lag: %s\n", ls.Lag)
+			if ls.SLO != "" {
+				fmt.Printf("slo: %s\n", ls.SLO)
+			}
+		}
+
+		if ls.Breached {
+			return fmt.Errorf("%w: %s behind, slo is %s", ErrLagSLOBreached, ls.Lag, ls.SLO)
+		}
+		return nil
+	},
+}
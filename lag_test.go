@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func TestExportLagTrackerSLO(t *testing.T) {
+	defer func(slo time.Duration, webhooks []string, genesisTs int64) {
+		lagConfig.slo, notifyConfig.webhooks, networkConfig.genesisTs = slo, webhooks, genesisTs
+	}(lagConfig.slo, notifyConfig.webhooks, networkConfig.genesisTs)
+	exportLagGauge = metrics.NewCtx(context.Background(), "export_lag_epochs", "").Gauge()
+	exportLagSecondsGauge = metrics.NewCtx(context.Background(), "export_lag_seconds", "").Gauge()
+	exportLagSLOBreachedGauge = metrics.NewCtx(context.Background(), "export_lag_slo_breached", "").Gauge()
+
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		events = append(events, n.Event)
+	}))
+	defer srv.Close()
+	notifyConfig.webhooks = []string{srv.URL}
+
+	lagConfig.slo = 36 * time.Hour
+	networkConfig.genesisTs = time.Now().Add(-100 * 24 * time.Hour).Unix()
+	current := CurrentHeight(networkConfig.genesisTs)
+
+	tr := &exportLagTracker{}
+	tr.update(context.Background())
+	if tr.Status() != nil || tr.Breached() {
+		t.Fatalf("tracker without a completed period should not report a lag")
+	}
+
+	// Completing a period does not raise an alert until the lag is refreshed
+	tr.Completed(current - 2*EpochsInDay)
+	if tr.Breached() || len(events) != 0 {
+		t.Fatalf("lag should only be compared with the slo when refreshed")
+	}
+	tr.update(context.Background())
+	if ls := tr.Status(); !tr.Breached() || ls == nil || !ls.Breached || ls.LagSeconds < (47*time.Hour).Seconds() {
+		t.Errorf("expected the slo to be breached, got %+v", ls)
+	}
+	tr.update(context.Background())
+
+	tr.Completed(current - 100)
+	tr.update(context.Background())
+	if tr.Breached() {
+		t.Errorf("expected the lag to recover")
+	}
+
+	if len(events) != 2 || events[0] != EventLagSLOBreached || events[1] != EventLagSLORecovered {
+		t.Errorf("got events %v, wanted one breach and one recovery", events)
+	}
+
+	// The slo is not checked when disabled
+	lagConfig.slo = 0
+	if ls := lagStatus(current-10*EpochsInDay, networkConfig.genesisTs); ls.Breached || ls.SLO != "" {
+		t.Errorf("lag should not breach a disabled slo, got %+v", ls)
+	}
+}
+
+// recordingGauge holds the last value a gauge was set to.
+type recordingGauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *recordingGauge) Set(v float64) { g.mu.Lock(); g.value = v; g.mu.Unlock() }
+func (g *recordingGauge) Inc()          { g.Add(1) }
+func (g *recordingGauge) Dec()          { g.Add(-1) }
+func (g *recordingGauge) Add(v float64) { g.mu.Lock(); g.value += v; g.mu.Unlock() }
+func (g *recordingGauge) Sub(v float64) { g.Add(-v) }
+
+func (g *recordingGauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+// recordLagGauges replaces the export lag gauges with gauges whose values can be read, restoring them when the test
+// completes.
+func recordLagGauges(t *testing.T) (epochs, seconds, breached *recordingGauge) {
+	t.Helper()
+	e, s, b := exportLagGauge, exportLagSecondsGauge, exportLagSLOBreachedGauge
+	t.Cleanup(func() { exportLagGauge, exportLagSecondsGauge, exportLagSLOBreachedGauge = e, s, b })
+	epochs, seconds, breached = &recordingGauge{}, &recordingGauge{}, &recordingGauge{}
+	exportLagGauge, exportLagSecondsGauge, exportLagSLOBreachedGauge = epochs, seconds, breached
+	return epochs, seconds, breached
+}
+
+func TestExportLagFor(t *testing.T) {
+	genesisTs := time.Now().Add(-100 * 24 * time.Hour).Unix()
+	current := CurrentHeight(genesisTs)
+
+	// The lag runs from the time of the height after the completed period
+	lag := exportLagFor(current-EpochsInDay, genesisTs)
+	if lag < 24*time.Hour-time.Duration(2*BlockDelay)*time.Second || lag > 24*time.Hour {
+		t.Errorf("got lag %s a day behind the head, wanted about 24h", lag)
+	}
+	if lag != lag.Truncate(time.Second) {
+		t.Errorf("got lag %s, wanted whole seconds", lag)
+	}
+
+	// A period ending at or beyond the head has no lag
+	for _, height := range []int64{current, current + 100} {
+		if lag := exportLagFor(height, genesisTs); lag != 0 {
+			t.Errorf("got lag %s for height %d at the head %d, wanted none", lag, height, current)
+		}
+	}
+}
+
+func TestExportLagTrackerGauges(t *testing.T) {
+	defer func(slo time.Duration, webhooks []string, genesisTs int64) {
+		lagConfig.slo, notifyConfig.webhooks, networkConfig.genesisTs = slo, webhooks, genesisTs
+	}(lagConfig.slo, notifyConfig.webhooks, networkConfig.genesisTs)
+	epochs, seconds, breached := recordLagGauges(t)
+
+	lagConfig.slo, notifyConfig.webhooks = 0, nil
+	networkConfig.genesisTs = time.Now().Add(-100 * 24 * time.Hour).Unix()
+	current := CurrentHeight(networkConfig.genesisTs)
+
+	// Completing a period sets the lag gauges at once
+	tr := &exportLagTracker{}
+	tr.Completed(current - 2*EpochsInDay)
+	if got := epochs.Value(); got < float64(2*EpochsInDay) || got > float64(2*EpochsInDay+1) {
+		t.Errorf("got lag of %v epochs, wanted %d", got, 2*EpochsInDay)
+	}
+	if got := seconds.Value(); got < (47 * time.Hour).Seconds() {
+		t.Errorf("got lag of %v seconds, wanted about two days", got)
+	}
+
+	ls := tr.Status()
+	if ls == nil || ls.CompletedHeight != current-2*EpochsInDay || ls.HeadHeight < current || ls.Breached || ls.SLO != "" {
+		t.Errorf("got status %+v without an slo", ls)
+	}
+
+	// The lag keeps growing on refresh while no period completes
+	seconds.Set(0)
+	tr.update(context.Background())
+	if seconds.Value() == 0 || breached.Value() != 0 {
+		t.Errorf("got lag of %v seconds and breach gauge %v after refreshing without an slo", seconds.Value(), breached.Value())
+	}
+
+	lagConfig.slo = time.Hour
+	tr.update(context.Background())
+	if breached.Value() != 1 || !tr.Breached() {
+		t.Errorf("got breach gauge %v, wanted 1 once the slo is exceeded", breached.Value())
+	}
+
+	// Completing a later period brings the lag back within the slo
+	tr.Completed(current - 10)
+	tr.update(context.Background())
+	if breached.Value() != 0 || tr.Breached() {
+		t.Errorf("got breach gauge %v, wanted 0 once the lag recovered", breached.Value())
+	}
+	if ls := tr.Status(); ls.CompletedHeight != current-10 {
+		t.Errorf("got completed height %d, wanted %d", ls.CompletedHeight, current-10)
+	}
+}
+
+func TestExportLagTrackerRun(t *testing.T) {
+	defer func(slo time.Duration, webhooks []string, genesisTs int64) {
+		lagConfig.slo, notifyConfig.webhooks, networkConfig.genesisTs = slo, webhooks, genesisTs
+	}(lagConfig.slo, notifyConfig.webhooks, networkConfig.genesisTs)
+	_, _, breached := recordLagGauges(t)
+
+	lagConfig.slo, notifyConfig.webhooks = time.Hour, nil
+	networkConfig.genesisTs = time.Now().Add(-100 * 24 * time.Hour).Unix()
+
+	tr := &exportLagTracker{}
+	tr.Completed(CurrentHeight(networkConfig.genesisTs) - EpochsInDay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tr.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !tr.Breached() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !tr.Breached() || breached.Value() != 1 {
+		t.Errorf("lag was not refreshed while running")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return once the context was cancelled")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// HiveFileLayout is the layout selected by --ship-layout=hive, which partitions each table's files by date using Hive
+// style key=value directories.
+const HiveFileLayout = "{{.Network}}/{{.Format}}/{{.Schema}}/{{.Table}}/year={{.Year}}/month={{.Month}}/day={{.Day}}"
+
+// fileLayout is the layout of shipped files in effect for the process, nil when files are shipped to the default
+// <network>/<format>/<schema>/<table>/<year> directories.
+var fileLayout *FileLayout
+
+// FileLayout renders the directory that a shipped file is written to from a Go template, so that the ship path can
+// follow the partitioning conventions of an existing data lake. File names are not affected by the layout.
+type FileLayout struct {
+	Template string
+	tmpl     *template.Template
+}
+
+// FileLayoutData holds the values available to a layout template. Dates are zero padded so that directories sort in
+// date order.
+type FileLayoutData struct {
+	Network string
+	Format  string
+	Schema  int
+	Table   string
+	Period  string // length of the period covered by the file, one of day, hour or week
+	Date    string // date the period starts on, formatted as YYYY-MM-DD
+	Year    string // four digit year, which is the year of the ISO week for weekly files
+	Month   string // two digit month
+	Day     string // two digit day of the month
+	Hour    string // two digit hour the period starts at, 00 for daily and weekly files
+	Week    string // two digit ISO week
+}
+
+// fileLayoutData returns the values used to render the directory of an export file.
+func fileLayoutData(ef *ExportFile) FileLayoutData {
+	period := ef.Length
+	if period == "" {
+		period = PeriodDay
+	}
+	year, week := ef.Date.Time().ISOWeek()
+	if period != PeriodWeek {
+		year = ef.Date.Year
+	}
+	return FileLayoutData{
+		Network: ef.Network,
+		Format:  ef.Format,
+		Schema:  ef.Schema,
+		Table:   ef.TableName,
+		Period:  period,
+		Date:    ef.Date.String(),
+		Year:    fmt.Sprintf("%04d", year),
+		Month:   fmt.Sprintf("%02d", ef.Date.Month),
+		Day:     fmt.Sprintf("%02d", ef.Date.Day),
+		Hour:    fmt.Sprintf("%02d", ef.Hour),
+		Week:    fmt.Sprintf("%02d", week),
+	}
+}
+
+// parseFileLayout parses a layout template, or the name of a predefined layout, and checks that it renders a relative
+// path beginning with the network's directory that keeps the files of each schema version apart. The template is
+// rendered for every table and period length so that it cannot fail once files are being shipped. An empty layout
+// selects the default directories and returns nil.
+func parseFileLayout(s string) (*FileLayout, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "hive":
+		s = HiveFileLayout
+	}
+
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	l := &FileLayout{Template: s, tmpl: tmpl}
+
+	sample := &ExportFile{
+		Date:      Date{Year: 2021, Month: 8, Day: 2},
+		Schema:    1,
+		Network:   "mainnet",
+		TableName: "messages",
+		Format:    FormatCSV,
+	}
+	dir, err := l.render(sample)
+	if err != nil {
+		return nil, fmt.Errorf("execute: %w", err)
+	}
+	for _, t := range TableList {
+		for _, length := range []string{"", PeriodHour, PeriodWeek} {
+			ef := *sample
+			ef.TableName, ef.Length = t.Name, length
+			if _, err := l.render(&ef); err != nil {
+				return nil, fmt.Errorf("execute for table %s: %w", t.Name, err)
+			}
+		}
+	}
+	if dir == "" || filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") {
+		return nil, fmt.Errorf("layout must render a relative path, got %q", dir)
+	}
+	parts := strings.Split(dir, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return nil, fmt.Errorf("layout must not render empty, . or .. path elements, got %q", dir)
+		}
+	}
+	if parts[0] != sample.Network {
+		return nil, fmt.Errorf("layout must begin with the network directory, got %q", dir)
+	}
+
+	sample.Schema++
+	other, err := l.render(sample)
+	if err != nil {
+		return nil, fmt.Errorf("execute: %w", err)
+	}
+	if other == dir {
+		return nil, fmt.Errorf("layout must include the schema version so files of different versions are kept apart")
+	}
+	return l, nil
+}
+
+func (l *FileLayout) render(ef *ExportFile) (string, error) {
+	var sb strings.Builder
+	if err := l.tmpl.Execute(&sb, fileLayoutData(ef)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(sb.String(), "/"), nil
+}
+
+// Dir returns the directory that the export file is written to, relative to the ship path and before any experimental
+// or provisional prefix is applied.
+func (l *FileLayout) Dir(ef *ExportFile) string {
+	dir, err := l.render(ef)
+	if err != nil {
+		// Layouts are rendered for every table and period length when they are parsed, so this should not happen
+		logger.Errorw("failed to render file layout, using default directory", "error", err, "table", ef.TableName)
+		return defaultFileDir(ef)
+	}
+	return filepath.FromSlash(dir)
+}
+
+func configureFileLayout(s string) error {
+	l, err := parseFileLayout(s)
+	if err != nil {
+		return err
+	}
+	fileLayout = l
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFileLayout(t *testing.T) {
+	testCases := []struct {
+		layout string
+		ok     bool
+	}{
+		{layout: "", ok: true},
+		{layout: "hive", ok: true},
+		{layout: "{{.Network}}/{{.Table}}/v{{.Schema}}/{{.Year}}/{{.Month}}/", ok: true},
+		{layout: "{{.Network}}/{{.Table}}/{{.Year}}"},              // no schema version
+		{layout: "{{.Table}}/{{.Network}}/{{.Schema}}"},            // does not begin with the network
+		{layout: "/{{.Network}}/{{.Schema}}"},                      // absolute
+		{layout: "{{.Network}}/../{{.Schema}}"},                    // escapes the network directory
+		{layout: "{{.Network}}//{{.Schema}}"},                      // empty element
+		{layout: "{{.Network}}/{{.Schema}}/{{.Nonsense}}"},         // unknown field
+		{layout: "{{.Network}}/{{.Schema}}/{{slice .Table 0 12}}"}, // fails for short table names
+		{layout: "{{.Network}}/{{.Schema"},                         // malformed
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.layout, func(t *testing.T) {
+			_, err := parseFileLayout(tc.layout)
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestExportFilePathWithLayout(t *testing.T) {
+	defer func(l *FileLayout) { fileLayout = l }(fileLayout)
+
+	var err error
+	fileLayout, err = parseFileLayout("hive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ef := &ExportFile{
+		Date:        Date{Year: 2021, Month: 8, Day: 2},
+		Schema:      1,
+		Network:     "mainnet",
+		TableName:   "messages",
+		Format:      FormatCSV,
+		Compression: CompressionByName["gz"],
+	}
+	want := filepath.FromSlash("mainnet/csv/1/messages/year=2021/month=08/day=02/messages-2021-08-02.csv.gz")
+	if got := ef.Path(); got != want {
+		t.Errorf("got path %q, wanted %q", got, want)
+	}
+
+	ef.Provisional = true
+	if got := ef.Path(); got != filepath.Join(ProvisionalPrefix, want) {
+		t.Errorf("got provisional path %q", got)
+	}
+
+	// Ancillary files stay in the table's directory
+	if got := tableDirForFile(ef); got != filepath.FromSlash("mainnet/csv/1/messages") {
+		t.Errorf("got table directory %q", got)
+	}
+
+	hi := &HeightIndex{
+		Network: "mainnet",
+		Files: map[string]*HeightIndexFileRef{
+			want: {Date: ef.Date, Table: "messages", TableDir: tableDirForFile(ef), Period: PeriodDay},
+		},
+	}
+	indexes := tableIndexesFromHeightIndex(hi)
+	if _, ok := indexes[filepath.FromSlash("mainnet/csv/1/messages/messages.index.json")]; !ok || len(indexes) != 1 {
+		t.Errorf("unexpected table indexes: %v", indexes)
+	}
+	an := archiveIndexNetwork(hi)
+	if len(an.Tables) != 1 || an.Tables[0].Format != FormatCSV || an.Tables[0].Schema != 1 || an.Tables[0].Period != PeriodDay {
+		t.Errorf("unexpected archive index tables: %+v", an.Tables)
+	}
+}
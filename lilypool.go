@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lilyHealthTimeout is the maximum time a lily node may take to respond to a health check
+const lilyHealthTimeout = time.Second * 10
+
+// errLilyNodeUnavailable is returned when waiting on a lily node is abandoned because the node failed its health
+// checks while another node is available.
+var errLilyNodeUnavailable = errors.New("lily node is unavailable")
+
+// lilyNodes holds the lily nodes that exports are run against, configured from the lily address flag.
+var lilyNodes *LilyPool
+
+// LilyNode is a lily API endpoint that exports may be run against.
+type LilyNode struct {
+	Addr  string
+	Token string
+
+	healthy bool
+	active  int // number of exports currently running on the node
+}
+
+// LilyPool balances exports across a set of lily nodes, avoiding nodes that fail their health checks.
+type LilyPool struct {
+	mu    sync.Mutex
+	nodes []*LilyNode
+}
+
+// newLilyPool creates a pool from comma separated lists of addresses and tokens. A single token is used for every
+// node, otherwise there must be one token for each address. Nodes are assumed to be healthy until they are checked.
+func newLilyPool(addrs string, tokens string) (*LilyPool, error) {
+	var as []string
+	for _, a := range strings.Split(addrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			as = append(as, a)
+		}
+	}
+	if len(as) == 0 {
+		return nil, fmt.Errorf("no lily addresses")
+	}
+
+	ts := strings.Split(tokens, ",")
+	if len(ts) != 1 && len(ts) != len(as) {
+		return nil, fmt.Errorf("got %d lily tokens for %d addresses, wanted one token or one for each address", len(ts), len(as))
+	}
+
+	p := &LilyPool{}
+	for i, a := range as {
+		token := ts[0]
+		if len(ts) > 1 {
+			token = ts[i]
+		}
+		p.nodes = append(p.nodes, &LilyNode{Addr: a, Token: strings.TrimSpace(token), healthy: true})
+	}
+	return p, nil
+}
+
+// Len returns the number of nodes in the pool.
+func (p *LilyPool) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.nodes)
+}
+
+// Nodes returns every node in the pool, healthy or not.
+func (p *LilyPool) Nodes() []*LilyNode {
+	if p == nil {
+		return []*LilyNode{{Addr: lilyConfig.apiAddr, Token: lilyConfig.apiToken, healthy: true}}
+	}
+	return p.nodes
+}
+
+// Acquire returns the healthy node running the fewest exports, preferring nodes in the order they were configured.
+// When no node is healthy the node running the fewest exports is returned so that the export keeps retrying. Each
+// node returned must be released once the export no longer needs it.
+func (p *LilyPool) Acquire() *LilyNode {
+	if p == nil {
+		return &LilyNode{Addr: lilyConfig.apiAddr, Token: lilyConfig.apiToken, healthy: true}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *LilyNode
+	for _, n := range p.nodes {
+		if best == nil || (n.healthy && !best.healthy) || (n.healthy == best.healthy && n.active < best.active) {
+			best = n
+		}
+	}
+	best.active++
+	lilyNodeExportsGauge.Set(float64(p.activeLocked()))
+	return best
+}
+
+// Release marks an export acquired from the pool as no longer running on its node.
+func (p *LilyPool) Release(n *LilyNode) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n.active > 0 {
+		n.active--
+	}
+	lilyNodeExportsGauge.Set(float64(p.activeLocked()))
+}
+
+func (p *LilyPool) activeLocked() int {
+	active := 0
+	for _, n := range p.nodes {
+		active += n.active
+	}
+	return active
+}
+
+// ShouldFailOver reports whether work waiting on the node at addr should be abandoned and retried on another node,
+// which is the case when the node has failed its health checks and another node is healthy. With a single node work
+// always keeps waiting for the node to recover.
+func (p *LilyPool) ShouldFailOver(addr string) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failed, other := false, false
+	for _, n := range p.nodes {
+		if n.Addr == addr {
+			failed = !n.healthy
+		} else if n.healthy {
+			other = true
+		}
+	}
+	return failed && other
+}
+
+// Check checks the health of every node in the pool concurrently. A node is healthy when it responds with its current
+// chain height within the health check timeout.
+func (p *LilyPool) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *LilyNode) {
+			defer wg.Done()
+			err := checkLilyNode(ctx, n.Addr, n.Token)
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if err != nil && n.healthy {
+				logger.Errorw("lily node failed health check", "error", err, "lily", n.Addr)
+			} else if err == nil && !n.healthy {
+				logger.Infow("lily node recovered", "lily", n.Addr)
+			}
+			n.healthy = err == nil
+		}(n)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	healthy := 0
+	for _, n := range p.nodes {
+		if n.healthy {
+			healthy++
+		}
+	}
+	p.mu.Unlock()
+	lilyNodesHealthyGauge.Set(float64(healthy))
+}
+
+// Run checks the health of the pool's nodes at the given interval until the context is cancelled.
+func (p *LilyPool) Run(ctx context.Context, interval time.Duration) {
+	check := func(ctx context.Context) (bool, error) {
+		p.Check(ctx)
+		return false, nil
+	}
+
+	if err := WaitUntil(ctx, check, 0, interval); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Errorw("lily health checks stopped", "error", err)
+	}
+}
+
+func checkLilyNode(ctx context.Context, addr string, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, lilyHealthTimeout)
+	defer cancel()
+
+	api, closer, err := getLilyAPI(ctx, addr, token)
+	if err != nil {
+		lilyConnectionErrorsCounter.Inc()
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer closer()
+
+	if _, err := getLilyChainHeight(ctx, api); err != nil {
+		return fmt.Errorf("chain height: %w", err)
+	}
+	return nil
+}
+
+// onLilyNode runs each attempt of a lily job on the node acquired from the pool for that attempt, so that an attempt
+// that fails because its node is unavailable is retried on another node.
+func onLilyNode(fn func(apiAddr string, apiToken string) func(context.Context) (bool, error), ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		n := lilyNodes.Acquire()
+		defer lilyNodes.Release(n)
+		if lilyNodes.Len() > 1 {
+			ll.Debugf("using lily node %s", n.Addr)
+		}
+		return fn(n.Addr, n.Token)(ctx)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func TestNewLilyPool(t *testing.T) {
+	p, err := newLilyPool("/ip4/10.0.0.1/tcp/1234, /ip4/10.0.0.2/tcp/1234", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Len() != 2 || p.nodes[1].Addr != "/ip4/10.0.0.2/tcp/1234" || p.nodes[1].Token != "secret" {
+		t.Errorf("got nodes %+v, wanted two nodes sharing the token", p.nodes)
+	}
+
+	if _, err := newLilyPool("/ip4/10.0.0.1/tcp/1234,/ip4/10.0.0.2/tcp/1234,/ip4/10.0.0.3/tcp/1234", "a,b"); err == nil {
+		t.Errorf("expected error for mismatched tokens")
+	}
+}
+
+func TestLilyPoolAcquire(t *testing.T) {
+	lilyNodeExportsGauge = metrics.NewCtx(context.Background(), "lily_node_exports", "").Gauge()
+
+	p, err := newLilyPool("a,b,c", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Exports are spread across the nodes in order
+	first, second, third := p.Acquire(), p.Acquire(), p.Acquire()
+	if first.Addr != "a" || second.Addr != "b" || third.Addr != "c" {
+		t.Errorf("got nodes %s, %s, %s, wanted a, b, c", first.Addr, second.Addr, third.Addr)
+	}
+	p.Release(second)
+	if n := p.Acquire(); n.Addr != "b" {
+		t.Errorf("got node %s, wanted the least busy node b", n.Addr)
+	}
+
+	// Unhealthy nodes are avoided, and work on them fails over while another node is healthy
+	p.nodes[0].healthy = false
+	p.nodes[1].healthy = false
+	if n := p.Acquire(); n.Addr != "c" {
+		t.Errorf("got node %s, wanted the only healthy node c", n.Addr)
+	}
+	if !p.ShouldFailOver("a") {
+		t.Errorf("expected work on unhealthy node a to fail over")
+	}
+	if p.ShouldFailOver("c") {
+		t.Errorf("did not expect work on healthy node c to fail over")
+	}
+
+	p.nodes[2].healthy = false
+	if p.ShouldFailOver("a") {
+		t.Errorf("did not expect work to fail over when no node is healthy")
+	}
+}
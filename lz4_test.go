@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLZ4RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rnd.Read(random)
+
+	testCases := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repetitive": []byte(strings.Repeat("1000,bafy2bzacea,f01234\n", 50000)),
+		"overlap":    bytes.Repeat([]byte{'a'}, 1000),
+		"random":     random,
+		"multiblock": []byte(strings.Repeat("row with some variation 12345\n", 300000)),
+	}
+
+	for name, input := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var compressed bytes.Buffer
+			if _, err := compressLZ4(nil, bytes.NewReader(input), &compressed); err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+
+			zr, err := decompressLZ4(&compressed)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, input) {
+				t.Errorf("decompressed %d bytes that do not match the %d byte input", len(got), len(input))
+			}
+		})
+	}
+}
+
+func TestLZ4Reference(t *testing.T) {
+	bin, err := exec.LookPath("lz4")
+	if err != nil {
+		t.Skip("lz4 command line tool is not installed")
+	}
+	input := []byte(strings.Repeat("1000,bafy2bzacea,f01234,\"quoted, value\"\n", 200000))
+	dir := t.TempDir()
+
+	// Files written by the archiver are read by the reference tool
+	var compressed bytes.Buffer
+	if _, err := compressLZ4(nil, bytes.NewReader(input), &compressed); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "-d", "-c")
+	cmd.Stdin = &compressed
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("lz4 -d: %v", err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Errorf("lz4 decompressed %d bytes that do not match the %d byte input", len(got), len(input))
+	}
+
+	// Files written by the reference tool are read by the archiver
+	src := filepath.Join(dir, "input.csv")
+	if err := os.WriteFile(src, input, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(bin, "-c", src).Output()
+	if err != nil {
+		t.Fatalf("lz4: %v", err)
+	}
+	zr, err := decompressLZ4(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, input) {
+		t.Errorf("decompressed a file written by lz4 incorrectly: %v", err)
+	}
+}
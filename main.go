@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	metrics "github.com/ipfs/go-metrics-interface"
@@ -27,13 +30,93 @@ func init() {
 }
 
 func main() {
-	ctx := context.Background()
+	// Waiting loops stop when the archiver is asked to shut down so that running walks can be handed off
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	if err := app.RunContext(ctx, os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
 
+// defaultMinHeight is the default --min-height of the run command, which the plan command shares so that a plan
+// covers the periods that run would export.
+const defaultMinHeight = 1005360 // TODO: remove default
+
+// runFlags are the flags of the run command. They are shared with run-networks, which passes them to its workers.
+var runFlags = flagSet(
+	loggingFlags,
+	networkFlags,
+	tableRegistryFlags,
+	lilyFlags,
+	jobFlags,
+	storageFlags,
+	stateFlags,
+	auditFlags,
+	claimFlags,
+	warehouseFlags,
+	verificationFlags,
+	shippingFlags,
+	destinationsFlags,
+	hooksFlags,
+	objectStoreFlags,
+	publishedFlags,
+	ipfsFlags,
+	tableConfigFlags,
+	notifyFlags,
+	queueFlags,
+	lagFlags,
+	healthFlags,
+	snapshotFlags,
+	signingFlags,
+	anchorFlags,
+	sqliteFlags,
+	retentionFlags,
+	walkGCFlags,
+	reorgFlags,
+	dealFlags,
+	controlFlags,
+	diagnosticsFlags,
+	exportFlags,
+	[]cli.Flag{
+		&cli.Int64Flag{
+			Name:    "min-height",
+			EnvVars: []string{"ARCHIVER_MIN_HEIGHT"},
+			Usage:   "Minimum height that should be exported. This may be used for nodes that do not have full state history.",
+			Value:   defaultMinHeight,
+		},
+		&cli.StringFlag{
+			Name:    "replica-path",
+			EnvVars: []string{"ARCHIVER_REPLICA_PATH"},
+			Usage:   "Path of a second destination that is periodically reconciled with the ship path.",
+			Value:   "",
+		},
+		&cli.IntFlag{
+			Name:    "backfill-concurrency",
+			EnvVars: []string{"ARCHIVER_BACKFILL_CONCURRENCY"},
+			Usage:   "Number of periods before the chain head to export at once when filling gaps in the archive, most recent first. The export loop starts from the chain head when this is set, otherwise it fills gaps one period at a time from the minimum height.",
+			Value:   0,
+		},
+		&cli.BoolFlag{
+			Name:    "fresh",
+			EnvVars: []string{"ARCHIVER_FRESH"},
+			Usage:   "Also export provisional files for each period at the chain head shortly after it ends, shipped beneath the provisional prefix. Final files are still exported once the export delay has passed.",
+		},
+		&cli.Int64Flag{
+			Name:    "fresh-delay",
+			EnvVars: []string{"ARCHIVER_FRESH_DELAY"},
+			Usage:   "Number of epochs to wait after the end of a period before exporting its provisional files.",
+			Value:   DefaultFreshDelay,
+		},
+		&cli.DurationFlag{
+			Name:    "replica-interval",
+			EnvVars: []string{"ARCHIVER_REPLICA_INTERVAL"},
+			Usage:   "Time to wait between reconciliations of the replica.",
+			Value:   time.Hour,
+		},
+	},
+)
+
 var app = &cli.App{
 	Name:    appName,
 	Usage:   "produces regular archives of on-chain state for the Filecoin network.",
@@ -43,86 +126,155 @@ var app = &cli.App{
 			Name:   "run",
 			Usage:  "Produce daily archives of data.",
 			Before: configure,
-			Flags: flagSet(
-				loggingFlags,
-				networkFlags,
-				lilyFlags,
-				storageFlags,
-				diagnosticsFlags,
-				[]cli.Flag{
-					&cli.StringFlag{
-						Name:     "ship-path",
-						EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
-						Usage:    "Path used to write verified exports from lily.",
-						Required: true,
-					},
-					&cli.Int64Flag{
-						Name:    "min-height",
-						EnvVars: []string{"ARCHIVER_MIN_HEIGHT"},
-						Usage:   "Minimum height that should be exported. This may be used for nodes that do not have full state history.",
-						Value:   1005360, // TODO: remove default
-					},
-					&cli.StringFlag{
-						Name:    "tasks",
-						EnvVars: []string{"ARCHIVER_TASKS"},
-						Usage:   "Comma separated list of tasks that are allowed to be processed. Default is all tasks.",
-						Value:   "",
-					},
-					&cli.StringFlag{
-						Name:    "compression",
-						EnvVars: []string{"ARCHIVER_COMPRESSION"},
-						Usage:   "Type of compression to use.",
-						Value:   "gz",
-						Hidden:  true,
-					},
-				},
-			),
+			Flags:  runFlags,
 			Action: func(cc *cli.Context) error {
 				ctx := metrics.CtxScope(cc.Context, appName)
 				setupMetrics(ctx)
 
-				tasks := cc.String("tasks")
 				shipPath := cc.String("ship-path")
 				minHeight := cc.Int64("min-height")
 
-				// Build list of allowed tables. Could be all tables.
-				var allowedTables []Table
-				if tasks == "" || tasks == "all" {
-					allowedTables = append(allowedTables, TableList...)
-				} else {
-					taskList, err := parseTaskList(cc.String("tasks"))
-					if err != nil {
-						return fmt.Errorf("invalid tasks specified: %v", err)
+				allowedTables, err := allowedTablesFromFlags(cc)
+				if err != nil {
+					return err
+				}
+
+				targets, err := shipTargetsFromFlags(cc)
+				if err != nil {
+					return fmt.Errorf("invalid ship formats: %w", err)
+				}
+
+				sh, err := newShipper(shipPath)
+				if err != nil {
+					return fmt.Errorf("unable to ship files: %w", err)
+				}
+				sh = withShipDestinations(sh)
+
+				if err := loadZstdDictionaries(ctx, sh); err != nil {
+					return err
+				}
+
+				if shippingConfig.stagingPath != "" {
+					if err := verifyShipPath(shippingConfig.stagingPath); err != nil {
+						return fmt.Errorf("unable to write to staging path: %w", err)
 					}
-					if len(taskList) == 0 {
-						return fmt.Errorf("invalid tasks specified")
+				}
+
+				if err := ensureAncillaryFiles(ctx, sh, currentTableConfig(networkConfig.name).FilterTables(allowedTables)); err != nil {
+					return fmt.Errorf("unable to ensure ancillary files exist: %w", err)
+				}
+
+				// Tables added by a reloaded table config need their ancillary files before they are exported
+				if path := cc.String("table-config"); path != "" {
+					go reloadTableConfigOnHangup(ctx, path, func(nc *NetworkTableConfig) error {
+						return ensureAncillaryFiles(ctx, sh, nc.FilterTables(allowedTables))
+					})
+				}
+
+				// Replication and storage deals read the shipped files directly
+				localPath, isLocal := localShipPath(sh)
+
+				if replicaPath := cc.String("replica-path"); replicaPath != "" {
+					if !isLocal {
+						return fmt.Errorf("replication requires a filesystem ship path")
 					}
-					for _, task := range taskList {
-						tables := TablesByTask(task, storageConfig.schemaVersion)
-						allowedTables = append(allowedTables, tables...)
+					if err := verifyShipPath(replicaPath); err != nil {
+						return fmt.Errorf("unable to write to replica: %w", err)
 					}
+					r := NewReplicaReconciler(localPath, replicaPath, networkConfig.name)
+					go r.Run(ctx, cc.Duration("replica-interval"))
 				}
 
-				c, ok := CompressionByName[cc.String("compression")]
-				if !ok {
-					return fmt.Errorf("unknown compression %q", cc.String("compression"))
+				if len(dealsConfig.providers) > 0 {
+					if !isLocal {
+						return fmt.Errorf("storage deals require a filesystem ship path")
+					}
+					t := &DealTracker{ShipPath: localPath, Network: networkConfig.name}
+					go t.Run(ctx, dealsConfig.interval)
 				}
 
-				if err := verifyShipDependencies(shipPath, c); err != nil {
-					return fmt.Errorf("unable to ship files: %w", err)
+				pruner, err := newPrunerFromConfig(sh)
+				if err != nil {
+					return fmt.Errorf("invalid retention policy: %w", err)
+				}
+				if pruner != nil {
+					go pruner.Run(ctx, retentionConfig.interval)
 				}
 
-				if err := ensureAncillaryFiles(shipPath, allowedTables); err != nil {
-					return fmt.Errorf("unable to ensure ancillary files exist: %w", err)
+				if walkGCConfig.enabled {
+					go NewWalkCollector().Run(ctx, walkGCConfig.interval)
+				}
+
+				if reorgConfig.enabled {
+					r := NewReorgReconciler(networkConfig.name, sh, allowedTables, targets)
+					go r.Run(ctx, reorgConfig.interval)
+				}
+
+				if lilyNodes.Len() > 1 {
+					go lilyNodes.Run(ctx, lilyConfig.healthInterval)
 				}
 
+				if controlConfig.addr != "" {
+					if err := startControlServer(ctx, newControlService(sh, allowedTables, targets)); err != nil {
+						return fmt.Errorf("start control server: %w", err)
+					}
+				}
+
+				dashboardArchive.Set(sh, allowedTables, targets)
+
 				p := firstExportPeriodAfter(minHeight, networkConfig.genesisTs)
+
+				// Lag is measured from the first period the archiver is responsible for until a later one completes,
+				// so an archiver that is stuck from the moment it starts is still reported
+				exportLag.Completed(p.StartHeight - 1)
+				go exportLag.Run(ctx, time.Minute)
+				exportProgress.Touch()
+				if n := cc.Int("backfill-concurrency"); n > 0 {
+					// Periods that are already final are handed to the backfill workers so the export loop only
+					// follows the head
+					if last := latestFinalPeriod(networkConfig.genesisTs); last.StartHeight >= p.StartHeight {
+						tables := currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+						go runBackfill(ctx, p, last, sh, tables, targets, n)
+						p = last.Next()
+					}
+				}
+				if cc.Bool("fresh") {
+					if FreshDelay = cc.Int64("fresh-delay"); FreshDelay < 0 {
+						return fmt.Errorf("fresh delay must not be negative")
+					}
+					go runFreshExports(ctx, p, sh, allowedTables, targets)
+				}
+
 				for {
-					// Retry this export until it works
-					if err := WaitUntil(ctx, exportIsProcessed(p, allowedTables, c, shipPath), 0, time.Minute*15); err != nil {
+					// Retry this export until it works or is dead-lettered. Table selection is resolved for each
+					// period so that a reloaded table config takes effect from the next period.
+					tables := currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+					var shipped bool
+					err := runExportJob(ctx, p, tables, JobPriorityHead, func(ctx context.Context) (err error) {
+						shipped, err = processPeriod(ctx, p, tables, targets, sh)
+						return err
+					})
+					if errors.Is(err, ErrJobDeadLettered) {
+						logger.Errorw("skipping dead-lettered period", "error", err, "date", p.Date.String())
+						p = p.Next()
+						continue
+					}
+					if err != nil {
+						if ctx.Err() != nil {
+							logger.Info("shutting down")
+							return nil
+						}
 						return fmt.Errorf("fatal error processing export: %w", err)
 					}
 					exportLastCompletedHeightGauge.Set(float64(p.EndHeight))
+					exportLag.Completed(p.EndHeight)
+					exportProgress.Touch()
+
+					if shipped {
+						if err := updateHeightIndex(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, targets); err != nil {
+							logger.Errorw("failed to update height index", "error", err, "date", p.Date.String())
+						}
+					}
 					p = p.Next()
 				}
 			},
@@ -135,7 +287,12 @@ var app = &cli.App{
 			Flags: flagSet(
 				loggingFlags,
 				networkFlags,
+				tableRegistryFlags,
 				storageFlags,
+				stateFlags,
+				objectStoreFlags,
+				tableConfigFlags,
+				shipFormatFlags,
 				[]cli.Flag{
 					&cli.StringFlag{
 						Name:     "ship-path",
@@ -159,13 +316,6 @@ var app = &cli.App{
 						EnvVars: []string{"ARCHIVER_TO_DATE"},
 						Usage:   "Include only files that are exported on or before this date.",
 					},
-					&cli.StringFlag{
-						Name:    "compression",
-						EnvVars: []string{"ARCHIVER_COMPRESSION"},
-						Usage:   "Type of compression to use.",
-						Value:   "gz",
-						Hidden:  true,
-					},
 				},
 			),
 			Action: func(cc *cli.Context) error {
@@ -188,17 +338,20 @@ var app = &cli.App{
 					}
 				}
 
-				c, ok := CompressionByName[cc.String("compression")]
-				if !ok {
-					return fmt.Errorf("unknown compression %q", cc.String("compression"))
+				targets, err := shipTargetsFromFlags(cc)
+				if err != nil {
+					return fmt.Errorf("invalid ship formats: %w", err)
 				}
 
-				shipPath := cc.String("ship-path")
+				sh, err := newShipper(cc.String("ship-path"))
+				if err != nil {
+					return fmt.Errorf("invalid ship path: %w", err)
+				}
 				includeShipped := cc.Bool("shipped")
 
 				current := CurrentHeight(networkConfig.genesisTs)
 
-				for p := firstExportPeriod(networkConfig.genesisTs); p.EndHeight+Finality < current; p = p.Next() {
+				for p := firstExportPeriod(networkConfig.genesisTs); p.EndHeight+ExportDelay < current; p = p.Next() {
 					if !fromDate.IsZero() && fromDate.After(p.Date) {
 						continue
 					}
@@ -207,20 +360,28 @@ var app = &cli.App{
 						continue
 					}
 
-					em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, shipPath, storageConfig.schemaVersion, TableList, c)
+					em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, StableTables, targets)
 					if err != nil {
 						return fmt.Errorf("build manifest for period: %w", err)
 					}
 
 					for _, ef := range em.Files {
+						name := ef.TableName
+						if len(targets) > 1 {
+							name = ef.TableName + "." + ef.Format + "." + ef.Compression.Extension
+						}
+
 						shipped := "x"
 						if ef.Shipped {
 							if !includeShipped {
 								continue
 							}
 							shipped = "S"
+						} else if ef.Annotation != nil {
+							fmt.Printf("A %s %d-%d %s (%s)\n", p.Date.String(), p.StartHeight, p.EndHeight, name, ef.Annotation.Reason)
+							continue
 						}
-						fmt.Printf("%s %s %d-%d %s\n", shipped, p.Date.String(), p.StartHeight, p.EndHeight, ef.TableName)
+						fmt.Printf("%s %s %d-%d %s\n", shipped, p.Date.String(), p.StartHeight, p.EndHeight, name)
 					}
 
 				}
@@ -229,6 +390,32 @@ var app = &cli.App{
 			},
 		},
 
+		runNetworksCommand,
+		gapsCommand,
+		coverageCommand,
+		trainDictionariesCommand,
+		annotateCommand,
+		migrateCommand,
+		mirrorCommand,
+		jobsCommand,
+		transcodeCommand,
+		lagCommand,
+		benchmarkCompressionCommand,
+		pruneCommand,
+		planCommand,
+		exportRangeCommand,
+		exportCarCommand,
+		serveCommand,
+		reexportCommand,
+		catCommand,
+		diffCommand,
+		encryptionKeygenCommand,
+		warehouseLoadCommand,
+		verifyShippedCommand,
+		verifyRemoteCommand,
+		tableRegistryCommand,
+		versionCommand,
+
 		{
 			Name:   "verify",
 			Usage:  "Verify raw export files.",
@@ -236,7 +423,9 @@ var app = &cli.App{
 			Flags: flagSet(
 				loggingFlags,
 				networkFlags,
+				tableRegistryFlags,
 				storageFlags,
+				verificationFlags,
 				[]cli.Flag{
 					&cli.StringFlag{
 						Name:     "tables",
@@ -250,6 +439,16 @@ var app = &cli.App{
 						Usage:    "Name of the export to be verified.",
 						Required: true,
 					},
+					&cli.Int64Flag{
+						Name:     "from",
+						Usage:    "First height of the walk being verified.",
+						Required: true,
+					},
+					&cli.Int64Flag{
+						Name:     "to",
+						Usage:    "Last height of the walk being verified, inclusive.",
+						Required: true,
+					},
 				},
 			),
 			Action: func(cc *cli.Context) error {
@@ -278,7 +477,11 @@ var app = &cli.App{
 					Format: "csv",
 				}
 
-				rep, err := verifyTasks(cc.Context, wi, tasklist)
+				if cc.Int64("to") < cc.Int64("from") {
+					return fmt.Errorf("to height must not be less than from height")
+				}
+
+				rep, err := verifyTasks(cc.Context, wi, cc.Int64("from"), cc.Int64("to"), tasklist)
 				if err != nil {
 					return fmt.Errorf("verify task: %w", err)
 				}
@@ -293,23 +496,38 @@ var app = &cli.App{
 						continue
 					}
 
-					if len(status.Missing) == 0 && len(status.Error) == 0 && len(status.Unexpected) == 0 {
+					level, _ := verificationPolicy.Evaluate(table, status)
+					if level == StrictnessOff {
 						fmt.Printf("%s: ok\n", table)
 						continue
 					}
-					rs := ranges(status.Missing)
-					for _, r := range rs {
-						fmt.Printf("%s: found gap from %d to %d\n", table, r.Lower, r.Upper)
+					if level == StrictnessBlock {
 						reportFailed = true
 					}
 
-					if len(status.Error) > 0 {
-						fmt.Printf("%s: found %d errors\n", table, len(status.Error))
-						reportFailed = true
+					// suffix distinguishes failures that would not block shipping
+					suffix := func(check string) string {
+						if verificationPolicy.Strictness(table, check) == StrictnessWarn {
+							return " (warning)"
+						}
+						return ""
 					}
-					if len(status.Unexpected) > 0 {
-						fmt.Printf("%s: found %d unexpected processing reports\n", table, len(status.Unexpected))
-						reportFailed = true
+
+					if verificationPolicy.Strictness(table, CheckMissing) != StrictnessOff {
+						rs := ranges(status.Missing)
+						for _, r := range rs {
+							fmt.Printf("%s: found gap from %d to %d%s\n", table, r.Lower, r.Upper, suffix(CheckMissing))
+						}
+					}
+
+					if len(status.Error) > 0 && verificationPolicy.Strictness(table, CheckError) != StrictnessOff {
+						fmt.Printf("%s: found %d errors%s\n", table, len(status.Error), suffix(CheckError))
+					}
+					if len(status.Unexpected) > 0 && verificationPolicy.Strictness(table, CheckUnexpected) != StrictnessOff {
+						fmt.Printf("%s: found %d unexpected processing reports%s\n", table, len(status.Unexpected), suffix(CheckUnexpected))
+					}
+					if reason, ok := status.Implausible[table]; ok && verificationPolicy.Strictness(table, CheckRowCount) != StrictnessOff {
+						fmt.Printf("%s: implausible row count, %s%s\n", table, reason, suffix(CheckRowCount))
 					}
 
 				}
@@ -323,6 +541,34 @@ var app = &cli.App{
 	},
 }
 
+// allowedTablesFromFlags builds the list of tables allowed by the tasks and experimental-tables flags. Could be all
+// tables.
+func allowedTablesFromFlags(cc *cli.Context) ([]Table, error) {
+	experimental, err := parseExperimentalTableList(cc.String("experimental-tables"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid experimental tables specified: %w", err)
+	}
+
+	var allowedTables []Table
+	tasks := cc.String("tasks")
+	if tasks == "" || tasks == "all" {
+		allowedTables = append(allowedTables, TableList...)
+	} else {
+		taskList, err := parseTaskList(tasks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tasks specified: %v", err)
+		}
+		if len(taskList) == 0 {
+			return nil, fmt.Errorf("invalid tasks specified")
+		}
+		for _, task := range taskList {
+			tables := TablesByTask(task, storageConfig.schemaVersion)
+			allowedTables = append(allowedTables, tables...)
+		}
+	}
+	return filterExperimentalTables(allowedTables, experimental), nil
+}
+
 func flagSet(fs ...[]cli.Flag) []cli.Flag {
 	var flags []cli.Flag
 
@@ -333,16 +579,48 @@ func flagSet(fs ...[]cli.Flag) []cli.Flag {
 	return flags
 }
 
+// parseTableList parses a comma separated list of table names. The name of a family of tables is expanded to all of
+// its variants so that whichever is active during a period is selected.
 func parseTableList(str string) ([]string, error) {
-	tables := strings.Split(str, ",")
-	for _, table := range tables {
-		if _, ok := TablesByName[table]; !ok {
-			return nil, fmt.Errorf("unknown table: %q", table)
+	var tables []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(str, ",") {
+		variants, ok := TableVariants(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown table: %q", name)
+		}
+		for _, t := range variants {
+			if !seen[t.Name] {
+				seen[t.Name] = true
+				tables = append(tables, t.Name)
+			}
 		}
 	}
 	return tables, nil
 }
 
+// parseExperimentalTableList parses a comma separated list of experimental table names into a set. The name all
+// enables every experimental table.
+func parseExperimentalTableList(str string) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	if str == "" {
+		return enabled, nil
+	}
+	for _, name := range strings.Split(str, ",") {
+		if name != "all" {
+			table, ok := TablesByName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown table: %q", name)
+			}
+			if !table.Experimental {
+				return nil, fmt.Errorf("table is not experimental: %q", name)
+			}
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
 func parseTaskList(str string) ([]string, error) {
 	tasks := strings.Split(str, ",")
 	for _, task := range tasks {
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestDir is the directory within each network's directory in the ship path that period manifests are written to.
+const ManifestDir = "manifests"
+
+// PeriodManifest describes the files shipped for a single export period, so downstream systems can discover what was
+// produced from one file. Manifests of daily periods are written to <network>/manifests/<year>/<period>.json.
+type PeriodManifest struct {
+	Network     string                `json:"network"`
+	Date        Date                  `json:"date"`
+	Hour        int                   `json:"hour,omitempty"`   // hour the period starts at, for hourly periods
+	Length      string                `json:"length,omitempty"` // length of the period when it is an hour or a week rather than a day
+	StartHeight int64                 `json:"start_height"`
+	EndHeight   int64                 `json:"end_height"`
+	Ranged      bool                  `json:"ranged,omitempty"` // the period is a height range rather than a calendar day
+	Generated   time.Time             `json:"generated"`
+	Files       []*PeriodManifestFile `json:"files"`                 // sorted by path
+	Archive     *PeriodArchive        `json:"archive,omitempty"`     // CAR package of the files made for storage deals
+	Deals       []*PeriodManifestDeal `json:"deals,omitempty"`       // storage deals made for the archive
+	Report      string                `json:"report,omitempty"`      // path of the processing report of the walks that produced the files
+	Reorgs      []*PeriodReorg        `json:"reorgs,omitempty"`      // reorgs found to have changed tipsets of the period after it was shipped
+	MerkleRoot  string                `json:"merkle_root,omitempty"` // root over the checksums of the files, see MerkleAlgorithm
+	Anchor      *PeriodAnchor         `json:"anchor,omitempty"`      // most recent message placing the merkle root on chain
+	Database    *PeriodDatabase       `json:"database,omitempty"`    // SQLite database built from the csv files
+	Genesis     *PeriodGenesis        `json:"genesis,omitempty"`     // irregular range and expected gaps of a period holding genesis
+	Signature   *Signature            `json:"signature,omitempty"`   // made by the archiver over the rest of the manifest
+}
+
+// PeriodManifestFile describes a single shipped file of a period.
+type PeriodManifestFile struct {
+	Path        string      `json:"path"` // path relative to the ship path
+	Table       string      `json:"table"`
+	Schema      int         `json:"schema"`
+	Format      string      `json:"format"`
+	Compression string      `json:"compression"`          // name of the compression scheme
+	Encryption  string      `json:"encryption,omitempty"` // name of the encryption scheme, if the file is encrypted
+	Rows        int64       `json:"rows"`
+	Size        int64       `json:"size"`
+	SHA256      string      `json:"sha256"`
+	CID         string      `json:"cid"`                   // CIDv1 of the raw file contents
+	IPFSCID     string      `json:"ipfs_cid,omitempty"`    // root of the file as added to IPFS, if it was
+	Shard       *ShardRange `json:"shard,omitempty"`       // heights held by the file if it is one part of a sharded table
+	Provisional bool        `json:"provisional,omitempty"` // exported before the period was final
+	Provenance  bool        `json:"provenance,omitempty"`  // the csv file begins with a provenance comment line
+	Dictionary  uint32      `json:"dictionary,omitempty"`  // id of the zstd dictionary the file was compressed with, if any
+	Stale       bool        `json:"stale,omitempty"`       // exported from tipsets since replaced by a reorg, until it is re-exported
+	Shipped     time.Time   `json:"shipped"`
+
+	Destinations []string `json:"destinations,omitempty"` // names of the additional destinations holding the file
+
+	History []*PeriodManifestFileVersion `json:"history,omitempty"` // earlier versions of the file that it replaced, oldest first
+}
+
+// PeriodReorg describes a reorg that changed tipsets of a period after its files were shipped.
+type PeriodReorg struct {
+	Detected    time.Time `json:"detected"`
+	StartHeight int64     `json:"start_height"` // first height whose tipset changed
+	EndHeight   int64     `json:"end_height"`   // last height whose tipset changed
+	Heights     int       `json:"heights"`      // number of heights whose tipset changed
+}
+
+// PeriodManifestFileVersion describes an earlier version of a shipped file that was replaced by a re-export.
+type PeriodManifestFileVersion struct {
+	Rows     int64     `json:"rows"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	CID      string    `json:"cid"`
+	Shipped  time.Time `json:"shipped"`
+	Replaced time.Time `json:"replaced"`
+}
+
+// periodManifestPath returns the path of the manifest for a period, relative to the ship path.
+func periodManifestPath(network string, p ExportPeriod) string {
+	return filepath.Join(network, ManifestDir, periodDir(p.Length(), p.Date), p.String()+".json")
+}
+
+// periodManifestMu serialises updates to period manifests, which are read, modified and written back.
+var periodManifestMu sync.Mutex
+
+// updatePeriodManifest reads the manifest at path, or starts an empty one if none exists, applies fn to it and writes
+// it back.
+func updatePeriodManifest(ctx context.Context, path string, sh Shipper, fn func(pm *PeriodManifest) error) error {
+	periodManifestMu.Lock()
+	defer periodManifestMu.Unlock()
+
+	pm := &PeriodManifest{}
+	data, err := sh.Read(ctx, path)
+	if err == nil {
+		if err := json.Unmarshal(data, pm); err != nil {
+			return fmt.Errorf("decode existing manifest: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read existing manifest: %w", err)
+	}
+
+	if err := fn(pm); err != nil {
+		return err
+	}
+	pm.MerkleRoot = periodMerkleRoot(pm.Files)
+	if err := signPeriodManifest(ctx, pm); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(pm, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return sh.Write(ctx, path, data)
+}
+
+// writePeriodManifest records the files shipped in this pass in the manifest for the period. Entries for files that
+// were shipped previously, including those shipped by other archivers responsible for different tasks, are retained
+// from the existing manifest.
+func writePeriodManifest(ctx context.Context, em *ExportManifest, shipped []*ExportFile, sh Shipper) error {
+	return updatePeriodManifest(ctx, periodManifestPath(em.Network, em.Period), sh, func(pm *PeriodManifest) error {
+		pm.Network = em.Network
+		pm.Date = em.Period.Date
+		pm.Hour = em.Period.Hour
+		pm.Length = em.Period.Length()
+		pm.StartHeight = em.Period.StartHeight
+		pm.EndHeight = em.Period.EndHeight
+		pm.Ranged = em.Period.Ranged
+		pm.Generated = time.Now().UTC()
+		if em.Report != "" {
+			pm.Report = filepath.ToSlash(em.Report)
+		}
+
+		files := map[string]*PeriodManifestFile{}
+		for _, f := range pm.Files {
+			files[f.Path] = f
+		}
+		var shippedFiles []*ExportFile
+		for _, ef := range shipped {
+			shippedFiles = append(shippedFiles, ef.ShippedFiles()...)
+		}
+		for _, ef := range shippedFiles {
+			f := &PeriodManifestFile{
+				Path:        filepath.ToSlash(ef.Path()),
+				Table:       ef.TableName,
+				Schema:      ef.Schema,
+				Format:      ef.Format,
+				Compression: ef.Compression.Names[0],
+				Encryption:  ef.Encryption,
+				Rows:        ef.Rows,
+				Size:        ef.Size,
+				SHA256:      ef.SHA256,
+				Shard:       ef.Shard,
+				Provisional: ef.Provisional,
+				Provenance:  ef.Provenance,
+				Dictionary:  ef.Dictionary,
+				Shipped:     pm.Generated,
+			}
+			if ef.Cid.Defined() {
+				f.CID = ef.Cid.String()
+			}
+			if ef.IPFSCid.Defined() {
+				f.IPFSCID = ef.IPFSCid.String()
+			}
+			f.Destinations = shipDestinationsHolding(ctx, sh, f.Path)
+			// The checksum of a file replaced with different contents is kept so the change can be audited
+			if old, ok := files[f.Path]; ok {
+				f.History = old.History
+				if old.SHA256 != "" && old.SHA256 != f.SHA256 {
+					f.History = append(f.History, &PeriodManifestFileVersion{
+						Rows:     old.Rows,
+						Size:     old.Size,
+						SHA256:   old.SHA256,
+						CID:      old.CID,
+						Shipped:  old.Shipped,
+						Replaced: pm.Generated,
+					})
+				}
+			}
+			files[f.Path] = f
+		}
+
+		// Provisional files are no longer listed once the final file that corrects them has been shipped
+		pm.Files = pm.Files[:0]
+		for _, f := range files {
+			if f.Provisional {
+				if _, ok := files[strings.TrimPrefix(f.Path, ProvisionalPrefix+"/")]; ok {
+					continue
+				}
+			}
+			pm.Files = append(pm.Files, f)
+		}
+		sort.Slice(pm.Files, func(a, b int) bool { return pm.Files[a].Path < pm.Files[b].Path })
+		pm.Genesis = periodGenesis(em.Period, pm.Files)
+		return nil
+	})
+}
+
+// csvRowCounter counts the csv records and bytes read through it. Newlines within quoted fields do not end a record.
+type csvRowCounter struct {
+	r       io.Reader
+	rows    int64
+	size    int64 // number of bytes read
+	quoted  bool
+	partial bool // part of a record has been read since the last record ended
+}
+
+func (c *csvRowCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.size += int64(n)
+	for _, b := range p[:n] {
+		switch {
+		case b == '"':
+			c.quoted = !c.quoted
+		case b == '\n' && !c.quoted:
+			c.rows++
+			c.partial = false
+			continue
+		}
+		c.partial = true
+	}
+	return n, err
+}
+
+// Rows returns the number of records read, including a final record that is not terminated by a newline.
+func (c *csvRowCounter) Rows() int64 {
+	if c.partial {
+		return c.rows + 1
+	}
+	return c.rows
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCSVRowCounter(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want int64
+	}{
+		{name: "empty", in: "", want: 0},
+		{name: "terminated", in: "a,1\nb,2\n", want: 2},
+		{name: "unterminated", in: "a,1\nb,2", want: 2},
+		{name: "quoted newline", in: "a,\"multi\nline\"\nb,2\n", want: 2},
+		{name: "escaped quote", in: "a,\"say \"\"hi\"\"\n\"\nb,2\n", want: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := &csvRowCounter{r: iotest.OneByteReader(strings.NewReader(tc.in))}
+			if _, err := io.Copy(io.Discard, rc); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := rc.Rows(); got != tc.want {
+				t.Errorf("got %d rows, wanted %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlanForManifest(t *testing.T) {
+	em := &ExportManifest{
+		Period: ExportPeriod{StartHeight: 100, EndHeight: 199},
+		Files: []*ExportFile{
+			{TableName: "messages"},
+			{TableName: "block_headers", Shipped: true},
+			{TableName: "receipts", Annotation: &Annotation{Reason: "known bad"}},
+		},
+	}
+
+	pp := planForManifest(em)
+	if pp == nil {
+		t.Fatalf("got no plan, wanted one")
+	}
+	want := &PeriodPlan{
+		Period:    em.Period,
+		Tables:    []string{"messages"},
+		Annotated: []string{"receipts"},
+		Tasks:     []string{"consensus", "message"},
+	}
+	if !reflect.DeepEqual(pp, want) {
+		t.Errorf("got %+v, wanted %+v", pp, want)
+	}
+	if pp.Epochs() != 100 {
+		t.Errorf("got %d epochs, wanted 100", pp.Epochs())
+	}
+
+	em.Files = em.Files[1:]
+	if pp := planForManifest(em); pp != nil {
+		t.Errorf("got plan %+v for shipped manifest, wanted none", pp)
+	}
+}
+
+func TestWritePeriodManifestHistory(t *testing.T) {
+	ctx := context.Background()
+	sh, err := newShipper(t.TempDir())
+	if err != nil {
+		t.Fatalf("new shipper: %v", err)
+	}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1000, EndHeight: 3879}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	ship := func(sum string) {
+		ef := &ExportFile{Date: p.Date, Network: "mainnet", TableName: "messages", Schema: 1, Format: "csv", Compression: CompressionByName["gz"], SHA256: sum}
+		if err := writePeriodManifest(ctx, em, []*ExportFile{ef}, sh); err != nil {
+			t.Fatalf("write manifest: %v", err)
+		}
+	}
+
+	// Rewriting a file with the same contents is not a replacement
+	ship("aaaa")
+	ship("aaaa")
+	ship("bbbb")
+	ship("cccc")
+
+	data, err := sh.Read(ctx, periodManifestPath("mainnet", p))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if len(pm.Files) != 1 {
+		t.Fatalf("got %d files in manifest, wanted 1", len(pm.Files))
+	}
+
+	f := pm.Files[0]
+	var got []string
+	for _, v := range f.History {
+		got = append(got, v.SHA256)
+	}
+	if want := []string{"aaaa", "bbbb"}; f.SHA256 != "cccc" || !reflect.DeepEqual(got, want) {
+		t.Errorf("got checksum %s with history %v, wanted cccc with history %v", f.SHA256, got, want)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// csvRowLayout identifies the columns of a table's csv output that are used to order and deduplicate its rows.
+type csvRowLayout struct {
+	heightColumn int   // index of the height column, or -1 if the table has none
+	keyColumns   []int // columns that identify a row, or nil if rows are identified by all of their columns
+}
+
+// rowLayoutForTable returns the row layout of a table, keying rows by the primary key of the table's model.
+func rowLayoutForTable(name string) (csvRowLayout, error) {
+	layout := csvRowLayout{heightColumn: -1}
+
+	// Delta files hold rows of the table they are taken from
+	t, ok := TablesByName[deltaBaseTable(name)]
+	if !ok {
+		return layout, nil
+	}
+
+	headers, err := TableHeaders(t.Model)
+	if err != nil {
+		return layout, fmt.Errorf("table headers: %w", err)
+	}
+	keys, err := TableKeyColumns(t.Model)
+	if err != nil {
+		return layout, fmt.Errorf("table key columns: %w", err)
+	}
+
+	isKey := map[string]bool{}
+	for _, k := range keys {
+		isKey[k] = true
+	}
+	for i, h := range headers {
+		if h == "height" {
+			layout.heightColumn = i
+		}
+		if isKey[h] {
+			layout.keyColumns = append(layout.keyColumns, i)
+		}
+	}
+	return layout, nil
+}
+
+// csvRow is a single record of csv output held for merging.
+type csvRow struct {
+	height int64
+	key    string
+	raw    []byte // the record in canonical form, always ending in a newline
+}
+
+// mergeCSVRows reads the csv records from r and writes them to w ordered by height and then by key, keeping only the
+// last record read for each key. Blank lines are skipped. Records are rewritten in a canonical form by formatCSVRecord
+// so the output depends only on the set of records, not on the order in which they were produced or on their line
+// endings and quoting, and repeated or overlapping exports of the same heights produce identical files. It returns the
+// number of duplicate records that were dropped. All records are held in memory while they are sorted.
+func mergeCSVRows(r io.Reader, w io.Writer, layout csvRowLayout) (int64, error) {
+	var rows []*csvRow
+	byKey := map[string]int{}
+	var dropped int64
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	sc.Split(scanCSVRecords)
+	for sc.Scan() {
+		if len(bytes.TrimRight(sc.Bytes(), "\r\n")) == 0 {
+			continue
+		}
+		row, err := parseCSVRow(sc.Bytes(), layout)
+		if err != nil {
+			return 0, err
+		}
+		if i, ok := byKey[row.key]; ok {
+			rows[i] = row
+			dropped++
+			continue
+		}
+		byKey[row.key] = len(rows)
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	sort.Slice(rows, func(a, b int) bool {
+		if rows[a].height != rows[b].height {
+			return rows[a].height < rows[b].height
+		}
+		if rows[a].key != rows[b].key {
+			return rows[a].key < rows[b].key
+		}
+		return bytes.Compare(rows[a].raw, rows[b].raw) < 0
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, row := range rows {
+		if _, err := bw.Write(row.raw); err != nil {
+			return 0, fmt.Errorf("write: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+	return dropped, nil
+}
+
+func parseCSVRow(rec []byte, layout csvRowLayout) (*csvRow, error) {
+	fields, quoted, err := splitCSVRecord(rec)
+	if err != nil {
+		return nil, fmt.Errorf("parse row: %w", err)
+	}
+
+	row := &csvRow{raw: formatCSVRecord(fields, quoted)}
+	if layout.heightColumn >= 0 {
+		if layout.heightColumn >= len(fields) {
+			return nil, fmt.Errorf("row has too few columns")
+		}
+		row.height, err = strconv.ParseInt(fields[layout.heightColumn], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed height %q: %w", fields[layout.heightColumn], err)
+		}
+	}
+
+	if len(layout.keyColumns) == 0 {
+		row.key = strings.Join(fields, "\x00")
+		return row, nil
+	}
+	key := make([]string, 0, len(layout.keyColumns))
+	for _, c := range layout.keyColumns {
+		if c >= len(fields) {
+			return nil, fmt.Errorf("row has too few columns")
+		}
+		key = append(key, fields[c])
+	}
+	row.key = strings.Join(key, "\x00")
+	return row, nil
+}
+
+// splitCSVRecord splits a single csv record into its fields, reporting which fields were quoted. The record may end
+// with a newline or a carriage return and newline. Values of quoted fields, including any line breaks they hold, are
+// returned exactly as written apart from the unescaping of doubled quotes.
+func splitCSVRecord(rec []byte) ([]string, []bool, error) {
+	rec = bytes.TrimSuffix(rec, []byte("\n"))
+	rec = bytes.TrimSuffix(rec, []byte("\r"))
+
+	var fields []string
+	var quoted []bool
+	for i := 0; ; {
+		if i < len(rec) && rec[i] == '"' {
+			var v []byte
+			for i++; ; i++ {
+				if i >= len(rec) {
+					return nil, nil, fmt.Errorf("unterminated quoted field")
+				}
+				if rec[i] == '"' {
+					if i+1 >= len(rec) || rec[i+1] != '"' {
+						i++
+						break
+					}
+					i++
+				}
+				v = append(v, rec[i])
+			}
+			fields = append(fields, string(v))
+			quoted = append(quoted, true)
+			if i == len(rec) {
+				break
+			}
+			if rec[i] != ',' {
+				return nil, nil, fmt.Errorf("unexpected %q after quoted field", rec[i])
+			}
+			i++
+			continue
+		}
+
+		end := bytes.IndexByte(rec[i:], ',')
+		if end < 0 {
+			end = len(rec) - i
+		}
+		v := rec[i : i+end]
+		if bytes.IndexByte(v, '"') >= 0 {
+			return nil, nil, fmt.Errorf("bare quote in unquoted field")
+		}
+		fields = append(fields, string(v))
+		quoted = append(quoted, false)
+		i += end
+		if i == len(rec) {
+			break
+		}
+		i++
+	}
+	return fields, quoted, nil
+}
+
+// formatCSVRecord writes the fields of a record in a canonical form, ending in a newline. Fields are only quoted when
+// they hold a comma, quote or line break, or when they are empty or the null value and were quoted when read, since
+// quoting distinguishes an empty string or the string NULL from a null value.
+func formatCSVRecord(fields []string, quoted []bool) []byte {
+	var b []byte
+	for i, v := range fields {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		if !strings.ContainsAny(v, ",\"\r\n") && !(quoted[i] && (v == "" || v == parquetNullCSVValue)) {
+			b = append(b, v...)
+			continue
+		}
+		b = append(b, '"')
+		b = append(b, strings.ReplaceAll(v, `"`, `""`)...)
+		b = append(b, '"')
+	}
+	return append(b, '\n')
+}
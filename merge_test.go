@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMergeCSVRows(t *testing.T) {
+	testCases := []struct {
+		name        string
+		input       string
+		layout      csvRowLayout
+		want        string
+		wantDropped int64
+	}{
+		{
+			name:   "ordered by height then key",
+			input:  "b,11,x\na,11,y\nc,10,z\n",
+			layout: csvRowLayout{heightColumn: 1, keyColumns: []int{0, 1}},
+			want:   "c,10,z\na,11,y\nb,11,x\n",
+		},
+		{
+			name:        "last duplicate wins",
+			input:       "a,10,old\nb,10,x\na,10,new\n",
+			layout:      csvRowLayout{heightColumn: 1, keyColumns: []int{0, 1}},
+			want:        "a,10,new\nb,10,x\n",
+			wantDropped: 1,
+		},
+		{
+			name:        "overlapping rows converge",
+			input:       "a,10,x\nb,11,y\nc,12,z\nb,11,y\n",
+			layout:      csvRowLayout{heightColumn: 1, keyColumns: []int{0, 1}},
+			want:        "a,10,x\nb,11,y\nc,12,z\n",
+			wantDropped: 1,
+		},
+		{
+			name:        "whole row key",
+			input:       "x,1\nx,1\nx,2\n",
+			layout:      csvRowLayout{heightColumn: -1},
+			want:        "x,1\nx,2\n",
+			wantDropped: 1,
+		},
+		{
+			name:   "quoted newlines and unterminated last record",
+			input:  "b,2,\"multi\nline\"\na,1,z",
+			layout: csvRowLayout{heightColumn: 1, keyColumns: []int{0}},
+			want:   "a,1,z\nb,2,\"multi\nline\"\n",
+		},
+		{
+			name:   "line endings and quoting normalized",
+			input:  "b,2,\"x\"\r\na,1,\"y,\"\"z\"\"\"\r\n",
+			layout: csvRowLayout{heightColumn: 1, keyColumns: []int{0}},
+			want:   "a,1,\"y,\"\"z\"\"\"\nb,2,x\n",
+		},
+		{
+			name:   "blank lines skipped",
+			input:  "b,2,x\n\r\n\na,1,y\n",
+			layout: csvRowLayout{heightColumn: 1, keyColumns: []int{0}},
+			want:   "a,1,y\nb,2,x\n",
+		},
+		{
+			name:   "quoted empty and null values keep their quotes",
+			input:  "a,1,\"\",\"NULL\",,NULL\n",
+			layout: csvRowLayout{heightColumn: 1, keyColumns: []int{0}},
+			want:   "a,1,\"\",\"NULL\",,NULL\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			dropped, err := mergeCSVRows(strings.NewReader(tc.input), &out, tc.layout)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.String() != tc.want {
+				t.Errorf("got %q, wanted %q", out.String(), tc.want)
+			}
+			if dropped != tc.wantDropped {
+				t.Errorf("got %d dropped, wanted %d", dropped, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestRowLayoutForTable(t *testing.T) {
+	layout, err := rowLayoutForTable("block_headers")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if layout.heightColumn < 0 {
+		t.Errorf("expected a height column")
+	}
+	if len(layout.keyColumns) == 0 {
+		t.Errorf("expected key columns")
+	}
+}
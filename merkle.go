@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// MerkleAlgorithm names the tree whose root is recorded in period manifests: the Merkle tree hash of RFC 6962 over
+// SHA-256, with a leaf for each file of the period.
+const MerkleAlgorithm = "sha256-rfc6962"
+
+// PeriodAnchor records a message that placed the Merkle root of a period on chain.
+type PeriodAnchor struct {
+	Root    string    `json:"root"`    // Merkle root held by the message, which later changes to the period leave unanchored
+	Message string    `json:"message"` // CID of the signed message
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Pushed  time.Time `json:"pushed"`
+}
+
+// merkleLeaf returns the leaf data of a file, which is its line in the output of sha256sum, so that the root can be
+// checked from a listing of the period's files.
+func merkleLeaf(f *PeriodManifestFile) []byte {
+	return []byte(f.SHA256 + "  " + f.Path + "\n")
+}
+
+// periodMerkleRoot returns the hex encoded Merkle root over the files of a period, taken in order of their paths, or
+// an empty string if the period has no files.
+func periodMerkleRoot(files []*PeriodManifestFile) string {
+	if len(files) == 0 {
+		return ""
+	}
+	sorted := append([]*PeriodManifestFile(nil), files...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].Path < sorted[b].Path })
+	leaves := make([][]byte, len(sorted))
+	for i, f := range sorted {
+		leaves[i] = merkleLeaf(f)
+	}
+	return hex.EncodeToString(merkleTreeHash(leaves))
+}
+
+// merkleTreeHash computes the Merkle tree hash of RFC 6962. Leaves are hashed with a 0x00 prefix and interior nodes
+// with a 0x01 prefix, and the leaves are split at the largest power of two smaller than their number.
+func merkleTreeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		h := sha256.Sum256(append([]byte{0x00}, leaves[0]...))
+		return h[:]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	node := append([]byte{0x01}, merkleTreeHash(leaves[:k])...)
+	node = append(node, merkleTreeHash(leaves[k:])...)
+	h := sha256.Sum256(node)
+	return h[:]
+}
+
+// periodNeedsAnchor reports whether the Merkle root of a manifest has yet to be anchored.
+func periodNeedsAnchor(pm *PeriodManifest) bool {
+	return pm.MerkleRoot != "" && (pm.Anchor == nil || pm.Anchor.Root != pm.MerkleRoot)
+}
+
+// anchorMessage returns a message that places a Merkle root on chain as the parameters of a plain transfer of no
+// value.
+func anchorMessage(root string, from, to address.Address) (*types.Message, error) {
+	params, err := hex.DecodeString(root)
+	if err != nil {
+		return nil, fmt.Errorf("decode root: %w", err)
+	}
+	return &types.Message{
+		From:   from,
+		To:     to,
+		Value:  big.Zero(),
+		Method: 0,
+		Params: params,
+	}, nil
+}
+
+// anchorPeriod pushes a message holding the Merkle root of a period's manifest from the anchor wallet, and records it
+// in the manifest. Periods whose current root has already been anchored are left alone.
+func anchorPeriod(ctx context.Context, network string, p ExportPeriod, sh Shipper) error {
+	path := periodManifestPath(network, p)
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // nothing has been shipped for the period
+		}
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	var pm PeriodManifest
+	if err := json.Unmarshal(data, &pm); err != nil {
+		return fmt.Errorf("decode manifest: %w", err)
+	}
+	if !periodNeedsAnchor(&pm) {
+		return nil
+	}
+
+	msg, err := anchorMessage(pm.MerkleRoot, anchorConfig.from, anchorConfig.to)
+	if err != nil {
+		return err
+	}
+	api, closer, err := getLotusAPI(ctx, anchorConfig.lotusAddr, anchorConfig.lotusToken)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	sm, err := api.MpoolPushMessage(ctx, msg, nil)
+	if err != nil {
+		return fmt.Errorf("push message: %w", err)
+	}
+
+	anchor := &PeriodAnchor{
+		Root:    pm.MerkleRoot,
+		Message: sm.Cid().String(),
+		From:    anchorConfig.from.String(),
+		To:      anchorConfig.to.String(),
+		Pushed:  time.Now().UTC(),
+	}
+	logger.Infow("anchored period merkle root", "date", p.Date.String(), "root", anchor.Root, "message", anchor.Message)
+	return updatePeriodManifest(ctx, path, sh, func(pm *PeriodManifest) error {
+		pm.Anchor = anchor
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+)
+
+func TestMerkleTreeHash(t *testing.T) {
+	// Test vectors of the certificate transparency implementation of RFC 6962
+	var leaves [][]byte
+	for _, s := range []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"} {
+		b, _ := hex.DecodeString(s)
+		leaves = append(leaves, b)
+	}
+	roots := map[int]string{
+		0: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		1: "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		2: "fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		3: "aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		8: "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+	for n, want := range roots {
+		if got := hex.EncodeToString(merkleTreeHash(leaves[:n])); got != want {
+			t.Errorf("got root %s of %d leaves, wanted %s", got, n, want)
+		}
+	}
+}
+
+func TestPeriodMerkleRoot(t *testing.T) {
+	ctx := context.Background()
+	sh := &fileShipper{root: t.TempDir()}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1000, EndHeight: 3879}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	file := func(table, sum string) *ExportFile {
+		return &ExportFile{Date: p.Date, Network: "mainnet", TableName: table, Schema: 1, Format: "csv", Compression: CompressionByName["gz"], SHA256: sum}
+	}
+	read := func() *PeriodManifest {
+		data, err := sh.Read(ctx, periodManifestPath("mainnet", p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pm := &PeriodManifest{}
+		if err := json.Unmarshal(data, pm); err != nil {
+			t.Fatal(err)
+		}
+		return pm
+	}
+
+	if err := writePeriodManifest(ctx, em, []*ExportFile{file("messages", "aaaa"), file("blocks", "bbbb")}, sh); err != nil {
+		t.Fatal(err)
+	}
+	pm := read()
+	// Leaves are the sha256sum lines of the files in order of their paths
+	want := hex.EncodeToString(merkleTreeHash([][]byte{
+		[]byte("bbbb  " + pm.Files[0].Path + "\n"),
+		[]byte("aaaa  " + pm.Files[1].Path + "\n"),
+	}))
+	if pm.MerkleRoot != want {
+		t.Errorf("got merkle root %s, wanted %s", pm.MerkleRoot, want)
+	}
+	if !periodNeedsAnchor(pm) {
+		t.Errorf("a root that has not been anchored does not need anchoring")
+	}
+
+	pm.Anchor = &PeriodAnchor{Root: pm.MerkleRoot}
+	if periodNeedsAnchor(pm) {
+		t.Errorf("an anchored root needs anchoring")
+	}
+
+	// Replacing a file changes the root, which must be anchored again
+	if err := writePeriodManifest(ctx, em, []*ExportFile{file("messages", "cccc")}, sh); err != nil {
+		t.Fatal(err)
+	}
+	if changed := read(); changed.MerkleRoot == pm.MerkleRoot || !periodNeedsAnchor(&PeriodManifest{MerkleRoot: changed.MerkleRoot, Anchor: pm.Anchor}) {
+		t.Errorf("replacing a file did not change the merkle root")
+	}
+}
+
+func TestAnchorMessage(t *testing.T) {
+	from, _ := address.NewIDAddress(1000)
+	to, _ := address.NewIDAddress(2000)
+	root := "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"
+
+	msg, err := anchorMessage(root, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != from || msg.To != to || msg.Method != 0 || !msg.Value.IsZero() || hex.EncodeToString(msg.Params) != root {
+		t.Errorf("unexpected anchor message %+v", msg)
+	}
+	if _, err := anchorMessage("not hex", from, to); err == nil {
+		t.Errorf("expected an error for an invalid root")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Per-table metrics are recorded using opencensus, which supports the labels that the ipfs metrics interface lacks.
+// They are served alongside the other metrics by the prometheus server.
+var (
+	tableTagKey  = tag.MustNewKey("table")
+	formatTagKey = tag.MustNewKey("format") // ship target of the file, such as csv.gz
+	taskTagKey   = tag.MustNewKey("task")
+
+	destinationTagKey = tag.MustNewKey("destination") // name of an additional ship destination
+	hookTagKey        = tag.MustNewKey("hook")        // name of a post-processing hook
+
+	walkDurationMeasure     = stats.Float64("walk_duration_seconds", "Time taken for a lily walk to complete", stats.UnitSeconds)
+	tableRowsMeasure        = stats.Int64("table_rows_exported", "Number of rows exported in a shipped file", stats.UnitDimensionless)
+	tableBytesMeasure       = stats.Int64("table_bytes_shipped", "Number of bytes shipped in a file", stats.UnitBytes)
+	compressionRatioMeasure = stats.Float64("table_compression_ratio", "Ratio of uncompressed to compressed size of a shipped file", stats.UnitDimensionless)
+	walkTaskProgressMeasure = stats.Float64("walk_task_progress_percent", "Percentage of a running walk's heights reported by a task", stats.UnitDimensionless)
+
+	destinationFailuresMeasure = stats.Int64("destination_ship_failures", "Number of files that could not be shipped to an additional destination", stats.UnitDimensionless)
+	hookFailuresMeasure        = stats.Int64("hook_failures", "Number of times a post-processing hook failed", stats.UnitDimensionless)
+)
+
+var tableMetricViews = []*view.View{
+	{
+		Name:        "walk_duration_seconds",
+		Measure:     walkDurationMeasure,
+		Description: walkDurationMeasure.Description(),
+		Aggregation: view.Distribution(60, 300, 600, 1800, 3600, 2*3600, 4*3600, 8*3600, 16*3600, 24*3600),
+	},
+	{
+		Name:        "table_rows_exported",
+		Measure:     tableRowsMeasure,
+		Description: "Number of rows in the most recently shipped file for a table",
+		TagKeys:     []tag.Key{tableTagKey, formatTagKey},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "table_rows_exported_total",
+		Measure:     tableRowsMeasure,
+		Description: "Total number of rows shipped for a table",
+		TagKeys:     []tag.Key{tableTagKey, formatTagKey},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "table_bytes_shipped_total",
+		Measure:     tableBytesMeasure,
+		Description: "Total number of bytes shipped for a table",
+		TagKeys:     []tag.Key{tableTagKey, formatTagKey},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "table_compression_ratio",
+		Measure:     compressionRatioMeasure,
+		Description: "Ratio of uncompressed to compressed size of the most recently shipped file for a table",
+		TagKeys:     []tag.Key{tableTagKey, formatTagKey},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "walk_task_progress_percent",
+		Measure:     walkTaskProgressMeasure,
+		Description: "Percentage of the heights of the running walk that a task has reported on",
+		TagKeys:     []tag.Key{taskTagKey},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "destination_ship_failures_total",
+		Measure:     destinationFailuresMeasure,
+		Description: "Total number of files that could not be shipped to an additional destination after exhausting its retries",
+		TagKeys:     []tag.Key{destinationTagKey},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "hook_failures_total",
+		Measure:     hookFailuresMeasure,
+		Description: "Total number of times a post-processing hook failed or timed out",
+		TagKeys:     []tag.Key{hookTagKey},
+		Aggregation: view.Count(),
+	},
+}
+
+func registerTableMetricViews() error {
+	return view.Register(tableMetricViews...)
+}
+
+// recordShippedFileMetrics records the per-table metrics for a file that has been shipped.
+func recordShippedFileMetrics(ctx context.Context, ef *ExportFile) {
+	target := ShipTarget{Format: ef.Format, Compression: ef.Compression}
+	ms := []stats.Measurement{
+		tableRowsMeasure.M(ef.Rows),
+		tableBytesMeasure.M(ef.Size),
+	}
+	if ef.UncompressedSize > 0 && ef.Size > 0 {
+		ms = append(ms, compressionRatioMeasure.M(float64(ef.UncompressedSize)/float64(ef.Size)))
+	}
+
+	err := stats.RecordWithTags(ctx, []tag.Mutator{
+		tag.Upsert(tableTagKey, ef.TableName),
+		tag.Upsert(formatTagKey, target.String()),
+	}, ms...)
+	if err != nil {
+		logger.Errorw("failed to record shipped file metrics", "error", err, "table", ef.TableName)
+	}
+}
+
+// recordWalkDuration records the time taken for a walk to complete.
+func recordWalkDuration(ctx context.Context, d time.Duration) {
+	stats.Record(ctx, walkDurationMeasure.M(d.Seconds()))
+}
+
+// recordDestinationFailure records that a file could not be shipped to an additional destination.
+func recordDestinationFailure(ctx context.Context, destination string) {
+	err := stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(destinationTagKey, destination)}, destinationFailuresMeasure.M(1))
+	if err != nil {
+		logger.Errorw("failed to record destination failure", "error", err, "destination", destination)
+	}
+}
+
+// recordHookFailure records that a post-processing hook failed.
+func recordHookFailure(ctx context.Context, hook string) {
+	err := stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(hookTagKey, hook)}, hookFailuresMeasure.M(1))
+	if err != nil {
+		logger.Errorw("failed to record hook failure", "error", err, "hook", hook)
+	}
+}
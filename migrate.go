@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+// DefaultLegacyLayout is the layout used by early versions of the archiver, before the schema version was included in
+// the directory hierarchy.
+const DefaultLegacyLayout = "{network}/{format}/{table}/{year}/{table}-{date}.{format}.{compression}"
+
+// layoutPlaceholders maps each placeholder that may be used in a legacy layout to the expression it matches.
+var layoutPlaceholders = map[string]string{
+	"network":     `[^/]+`,
+	"format":      `[a-z0-9]+`,
+	"schema":      `[0-9]+`,
+	"table":       `[a-z0-9_]+`,
+	"year":        `[0-9]{4}`,
+	"month":       `[0-9]{2}`,
+	"day":         `[0-9]{2}`,
+	"date":        `[0-9]{4}-[0-9]{2}-[0-9]{2}`,
+	"compression": `[a-z0-9]+`,
+}
+
+var placeholderRe = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// LegacyLayout matches the paths of files written using a previous archive layout.
+type LegacyLayout struct {
+	re *regexp.Regexp
+}
+
+// parseLegacyLayout compiles a layout pattern made up of literal path segments and placeholders such as {table} or
+// {date}. A placeholder that is used more than once must match the same value each time.
+func parseLegacyLayout(pattern string) (*LegacyLayout, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	seen := map[string]bool{}
+	last := 0
+	for _, loc := range placeholderRe.FindAllStringSubmatchIndex(pattern, -1) {
+		sb.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		name := pattern[loc[2]:loc[3]]
+		expr, ok := layoutPlaceholders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+
+		// Go regular expressions do not support backreferences so repeated placeholders are captured separately and
+		// compared after matching
+		group := name
+		if seen[name] {
+			group = name + "_" + strconv.Itoa(loc[0])
+		}
+		seen[name] = true
+
+		sb.WriteString(fmt.Sprintf("(?P<%s>%s)", group, expr))
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(pattern[last:]))
+	sb.WriteString("$")
+
+	if !seen["table"] {
+		return nil, fmt.Errorf("layout must include the {table} placeholder")
+	}
+	if !seen["date"] && !(seen["year"] && seen["month"] && seen["day"]) {
+		return nil, fmt.Errorf("layout must include the {date} placeholder or all of {year}, {month} and {day}")
+	}
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("compile layout: %w", err)
+	}
+
+	return &LegacyLayout{re: re}, nil
+}
+
+// Match parses a path relative to the root of a legacy archive, returning the values of each placeholder. It reports
+// false if the path does not match the layout.
+func (l *LegacyLayout) Match(path string) (map[string]string, bool) {
+	m := l.re.FindStringSubmatch(filepath.ToSlash(path))
+	if m == nil {
+		return nil, false
+	}
+
+	values := map[string]string{}
+	for i, group := range l.re.SubexpNames() {
+		if group == "" {
+			continue
+		}
+		name := group
+		if idx := strings.Index(group, "_"); idx > -1 && layoutPlaceholders[group] == "" {
+			name = group[:idx]
+		}
+		if existing, ok := values[name]; ok && existing != m[i] {
+			return nil, false
+		}
+		values[name] = m[i]
+	}
+
+	return values, true
+}
+
+// exportFileFromLegacyPath builds the export file in the current layout that corresponds to a file found in a legacy
+// archive. Values not present in the legacy layout are taken from the supplied defaults.
+func exportFileFromLegacyPath(values map[string]string, defaults ExportFile) (*ExportFile, error) {
+	ef := defaults
+	ef.Cid = cid.Undef
+	ef.Shipped = true
+
+	if v, ok := values["network"]; ok {
+		ef.Network = v
+	}
+	if v, ok := values["format"]; ok {
+		ef.Format = v
+	}
+	if v, ok := values["schema"]; ok {
+		schema, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema %q: %w", v, err)
+		}
+		ef.Schema = schema
+	}
+	if v, ok := values["compression"]; ok {
+		c, ok := CompressionByName[v]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression %q", v)
+		}
+		ef.Compression = c
+	}
+
+	ef.TableName = values["table"]
+	if _, ok := TablesByName[ef.TableName]; !ok {
+		return nil, fmt.Errorf("unknown table %q", ef.TableName)
+	}
+
+	if v, ok := values["date"]; ok {
+		d, err := DateFromString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q: %w", v, err)
+		}
+		ef.Date = d
+	} else {
+		d, err := DateFromString(fmt.Sprintf("%s-%s-%s", values["year"], values["month"], values["day"]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid date: %w", err)
+		}
+		ef.Date = d
+	}
+
+	if v, ok := values["year"]; ok && v != strconv.Itoa(ef.Date.Year) {
+		return nil, fmt.Errorf("year %s does not match date %s", v, ef.Date.String())
+	}
+
+	return &ef, nil
+}
+
+var migrateCommand = &cli.Command{
+	Name:   "migrate",
+	Usage:  "Import files from an archive written with a previous layout into the state catalog.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		requiredStateFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path used to write verified exports from lily.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "legacy-path",
+				Usage: "Root of the archive using the previous layout. Defaults to the ship path.",
+			},
+			&cli.StringFlag{
+				Name:  "legacy-layout",
+				Usage: "Layout of files in the legacy archive. Supported placeholders are {network}, {format}, {schema}, {table}, {year}, {month}, {day}, {date} and {compression}.",
+				Value: DefaultLegacyLayout,
+			},
+			&cli.StringFlag{
+				Name:   "compression",
+				Usage:  "Type of compression assumed when the layout does not include {compression}.",
+				Value:  "gz",
+				Hidden: true,
+			},
+			&cli.BoolFlag{
+				Name:  "move",
+				Usage: "Move imported files into the current layout beneath the ship path.",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report what would be imported without changing any files or state.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		layout, err := parseLegacyLayout(cc.String("legacy-layout"))
+		if err != nil {
+			return fmt.Errorf("invalid legacy layout: %w", err)
+		}
+
+		c, ok := CompressionByName[cc.String("compression")]
+		if !ok {
+			return fmt.Errorf("unknown compression %q", cc.String("compression"))
+		}
+
+		shipPath := cc.String("ship-path")
+		legacyPath := shipPath
+		if cc.IsSet("legacy-path") {
+			legacyPath = cc.String("legacy-path")
+		}
+		move := cc.Bool("move")
+		dryRun := cc.Bool("dry-run")
+
+		if !move && filepath.Clean(legacyPath) != filepath.Clean(shipPath) {
+			return fmt.Errorf("files outside the ship path must be imported using --move")
+		}
+
+		defaults := ExportFile{
+			Schema:      storageConfig.schemaVersion,
+			Network:     networkConfig.name,
+			Format:      "csv",
+			Compression: c,
+		}
+
+		var entries []*CatalogEntry
+		var imported, skipped int
+		err = filepath.WalkDir(legacyPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(legacyPath, path)
+			if err != nil {
+				return err
+			}
+
+			values, ok := layout.Match(rel)
+			if !ok {
+				return nil
+			}
+
+			ef, err := exportFileFromLegacyPath(values, defaults)
+			if err != nil {
+				logger.Infof("skipping %s: %v", rel, err)
+				skipped++
+				return nil
+			}
+			if err := applyFileNaming(ef, networkConfig.genesisTs); err != nil {
+				logger.Infof("skipping %s: %v", rel, err)
+				skipped++
+				return nil
+			}
+
+			src := path
+			dst := filepath.Join(shipPath, ef.Path())
+			if move && src != dst {
+				if _, err := os.Stat(dst); err == nil {
+					logger.Infof("skipping %s: %s already exists", rel, dst)
+					skipped++
+					return nil
+				}
+
+				fmt.Printf("move %s %s\n", src, dst)
+				if !dryRun {
+					if err := moveFile(src, dst); err != nil {
+						return fmt.Errorf("move %s: %w", src, err)
+					}
+				}
+			} else {
+				fmt.Printf("import %s\n", src)
+			}
+			imported++
+
+			if dryRun {
+				return nil
+			}
+
+			// Files that are not moved are recorded at their legacy location
+			entryPath := ef.Path()
+			if !move {
+				entryPath = rel
+			}
+
+			info, err := os.Stat(filepath.Join(shipPath, entryPath))
+			if err != nil {
+				return fmt.Errorf("stat: %w", err)
+			}
+
+			entries = append(entries, &CatalogEntry{
+				Path:        entryPath,
+				Network:     ef.Network,
+				Format:      ef.Format,
+				Schema:      ef.Schema,
+				Table:       ef.TableName,
+				Date:        ef.Date,
+				Compression: ef.Compression.Extension,
+				Size:        info.Size(),
+				ModTime:     info.ModTime().UTC(),
+				Source:      CatalogSourceImport,
+			})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("scan legacy archive: %w", err)
+		}
+
+		if !dryRun && len(entries) > 0 {
+			if err := stateStore.AddCatalogEntries(entries...); err != nil {
+				return fmt.Errorf("update catalog: %w", err)
+			}
+		}
+
+		fmt.Printf("imported %d files, skipped %d files\n", imported, skipped)
+		return nil
+	},
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLegacyLayoutMatch(t *testing.T) {
+	testCases := []struct {
+		layout string
+		path   string
+		want   string // path in current layout, empty if no match expected
+	}{
+		{
+			layout: DefaultLegacyLayout,
+			path:   "mainnet/csv/messages/2021/messages-2021-08-02.csv.gz",
+			want:   "mainnet/csv/1/messages/2021/messages-2021-08-02.csv.gz",
+		},
+		{
+			layout: "{table}/{year}{month}{day}.csv.gz",
+			path:   "block_headers/20210802.csv.gz",
+			want:   "mainnet/csv/1/block_headers/2021/block_headers-2021-08-02.csv.gz",
+		},
+		{
+			layout: DefaultLegacyLayout,
+			path:   "mainnet/csv/messages/2021/receipts-2021-08-02.csv.gz", // table mismatch
+		},
+		{
+			layout: DefaultLegacyLayout,
+			path:   "mainnet/csv/messages/2020/messages-2021-08-02.csv.gz", // year mismatch
+		},
+		{
+			layout: DefaultLegacyLayout,
+			path:   "mainnet/csv/messages/messages.header",
+		},
+	}
+
+	defaults := ExportFile{
+		Schema:      1,
+		Network:     "mainnet",
+		Format:      "csv",
+		Compression: CompressionByName["gz"],
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			l, err := parseLegacyLayout(tc.layout)
+			if err != nil {
+				t.Fatalf("unexpected error parsing layout: %v", err)
+			}
+
+			var got string
+			if values, ok := l.Match(tc.path); ok {
+				ef, err := exportFileFromLegacyPath(values, defaults)
+				if err == nil {
+					got = ef.Path()
+				}
+			}
+
+			if got != tc.want {
+				t.Errorf("got %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseLegacyLayoutInvalid(t *testing.T) {
+	for _, layout := range []string{"{table}/{unknown}.csv", "{network}/{date}.csv", "{table}/{year}.csv"} {
+		if _, err := parseLegacyLayout(layout); err == nil {
+			t.Errorf("expected error parsing %q", layout)
+		}
+	}
+}
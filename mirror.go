@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+var errNotFoundAtSource = errors.New("not found at source")
+
+// mirrorSourceURL converts the location of a primary archive to the base URL that files can be fetched from. Public
+// S3 buckets (s3://bucket/prefix) are accessed via their HTTPS endpoint and IPFS paths (ipfs://cid/prefix) via the
+// given gateway.
+func mirrorSourceURL(source string, ipfsGateway string) (*url.URL, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return u, nil
+	case "s3":
+		return url.Parse(fmt.Sprintf("https://%s.s3.amazonaws.com/%s", u.Host, strings.TrimPrefix(u.Path, "/")))
+	case "ipfs":
+		gw, err := url.Parse(ipfsGateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipfs gateway: %w", err)
+		}
+		gw.Path = path.Join(gw.Path, "ipfs", u.Host, u.Path)
+		return gw, nil
+	default:
+		return nil, fmt.Errorf("unsupported source scheme %q", u.Scheme)
+	}
+}
+
+// mirrorSource reads files from a primary archive.
+type mirrorSource interface {
+	// Open returns the contents of a file given its path relative to the root of the archive. It returns
+	// errNotFoundAtSource if there is no such file.
+	Open(ctx context.Context, rel string) (io.ReadCloser, error)
+
+	// OpenFrom returns the contents of a file starting at offset, along with the offset the contents actually start
+	// at, which is zero if the source could not skip to the offset.
+	OpenFrom(ctx context.Context, rel string, offset int64) (io.ReadCloser, int64, error)
+}
+
+// newMirrorSource returns the source for an archive given as a local directory or as a location accepted by
+// mirrorSourceURL.
+func newMirrorSource(location string, ipfsGateway string) (mirrorSource, error) {
+	if !strings.Contains(location, "://") {
+		return &localMirrorSource{root: location}, nil
+	}
+	base, err := mirrorSourceURL(location, ipfsGateway)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPMirrorSource{Base: base, Client: &http.Client{Timeout: 6 * time.Hour}}, nil
+}
+
+// localMirrorSource reads files from an archive on the local filesystem.
+type localMirrorSource struct {
+	root string
+}
+
+func (s *localMirrorSource) Open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	rc, _, err := s.OpenFrom(ctx, rel, 0)
+	return rc, err
+}
+
+func (s *localMirrorSource) OpenFrom(ctx context.Context, rel string, offset int64) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(rel)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, errNotFoundAtSource
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("seek: %w", err)
+	}
+	return f, offset, nil
+}
+
+// HTTPMirrorSource fetches files from a primary archive that is published over HTTP.
+type HTTPMirrorSource struct {
+	Base   *url.URL
+	Client *http.Client
+}
+
+// Open returns the contents of a file in the primary archive given its path relative to the root of the archive.
+func (s *HTTPMirrorSource) Open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	rc, _, err := s.OpenFrom(ctx, rel, 0)
+	return rc, err
+}
+
+// OpenFrom returns the contents of a file in the primary archive starting at offset, using a range request. Servers
+// that ignore the range return the whole file.
+func (s *HTTPMirrorSource) OpenFrom(ctx context.Context, rel string, offset int64) (io.ReadCloser, int64, error) {
+	u := *s.Base
+	u.Path = path.Join(u.Path, filepath.ToSlash(rel))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("new request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("get %s: %w", u.String(), err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, 0, nil
+	case http.StatusPartialContent:
+		return resp.Body, offset, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is at least as long as the file at the source, so it cannot be resumed
+		resp.Body.Close()
+		return s.OpenFrom(ctx, rel, 0)
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errNotFoundAtSource
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("get %s: unexpected status %s", u.String(), resp.Status)
+	}
+}
+
+// MirrorFilter restricts the files that are mirrored to those of some tables or dates. The zero value includes every
+// file.
+type MirrorFilter struct {
+	Tables   map[string]bool // tables to include, nil to include every table
+	FromDate Date            // first date to include, zero for no limit
+	ToDate   Date            // last date to include, zero for no limit
+}
+
+// IsZero reports whether the filter includes every file.
+func (f MirrorFilter) IsZero() bool {
+	return f.Tables == nil && f.FromDate.IsZero() && f.ToDate.IsZero()
+}
+
+// Includes reports whether the file with the given height index entry should be mirrored.
+func (f MirrorFilter) Includes(ref *HeightIndexFileRef) bool {
+	if f.Tables != nil && !f.Tables[ref.Table] {
+		return false
+	}
+	if !f.FromDate.IsZero() && f.FromDate.After(ref.Date) {
+		return false
+	}
+	if !f.ToDate.IsZero() && ref.Date.After(f.ToDate) {
+		return false
+	}
+	return true
+}
+
+// filterHeightIndex returns a copy of the height index that lists only the files included by the filter. Periods
+// left without any files are dropped.
+func filterHeightIndex(hi *HeightIndex, f MirrorFilter) *HeightIndex {
+	filtered := &HeightIndex{
+		Network:   hi.Network,
+		GenesisTs: hi.GenesisTs,
+		Generated: hi.Generated,
+		Files:     map[string]*HeightIndexFileRef{},
+	}
+	for rel, ref := range hi.Files {
+		if f.Includes(ref) {
+			filtered.Files[rel] = ref
+		}
+	}
+	for _, p := range hi.Periods {
+		fp := *p
+		fp.Files = nil
+		for _, rel := range p.Files {
+			if _, ok := filtered.Files[rel]; ok {
+				fp.Files = append(fp.Files, rel)
+			}
+		}
+		if len(fp.Files) > 0 {
+			filtered.Periods = append(filtered.Periods, &fp)
+		}
+	}
+	return filtered
+}
+
+// MirrorOptions controls how a network is mirrored.
+type MirrorOptions struct {
+	Filter MirrorFilter
+
+	// PartialPath is the directory that files are downloaded to before being shipped when the ship path is not a
+	// filesystem. Files are downloaded alongside their destination in a filesystem ship path.
+	PartialPath string
+
+	// CIDSource fetches files by their IPFS CID, for files that list one in the height index. Files are fetched by
+	// path from the primary archive if this is nil.
+	CIDSource mirrorSource
+
+	// Verified records the files in a filesystem ship path whose checksum has been confirmed, so that unchanged files
+	// are not rehashed on every sync. Files are rehashed on every sync if this is nil.
+	Verified map[string]mirroredFile
+}
+
+// mirroredFile is the state of a mirrored file when its checksum was confirmed.
+type mirroredFile struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// MirrorStats summarises a single sync of a mirror.
+type MirrorStats struct {
+	Fetched int
+	Bytes   int64
+	Resumed int
+	Present int
+	Failed  int
+}
+
+// mirrorNetwork syncs the files listed in the height index of a network in the primary archive that are included by
+// the filter into the ship path, verifying the size and checksum of each file as it arrives. Downloads that are
+// interrupted are resumed by the next sync. The primary's height index, restricted to the included files, is written
+// to the ship path once all files have been synced.
+func mirrorNetwork(ctx context.Context, src mirrorSource, network string, sh Shipper, opts MirrorOptions) (*MirrorStats, error) {
+	ll := logger.With("network", network)
+	stats := &MirrorStats{}
+
+	idxPath := filepath.Join(network, HeightIndexFilename)
+	rc, err := src.Open(ctx, idxPath)
+	if err != nil {
+		return nil, fmt.Errorf("fetch height index: %w", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read height index: %w", err)
+	}
+
+	var hi HeightIndex
+	if err := json.Unmarshal(data, &hi); err != nil {
+		return nil, fmt.Errorf("decode height index: %w", err)
+	}
+	if hi.Network != network {
+		return nil, fmt.Errorf("height index is for network %q", hi.Network)
+	}
+	if !opts.Filter.IsZero() {
+		hi = *filterHeightIndex(&hi, opts.Filter)
+		if data, err = json.MarshalIndent(&hi, "", "  "); err != nil {
+			return nil, fmt.Errorf("encode height index: %w", err)
+		}
+	}
+
+	partialPath := opts.PartialPath
+	if root, ok := localShipPath(sh); ok {
+		partialPath = root
+	}
+
+	// The index written by the previous sync holds the checksums of files already in the mirror
+	var previous HeightIndex
+	if data, err := sh.Read(ctx, heightIndexPath(network)); err == nil {
+		if err := json.Unmarshal(data, &previous); err != nil {
+			ll.Warnw("ignoring invalid height index in ship path", "error", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read mirrored height index: %w", err)
+	}
+
+	paths := make([]string, 0, len(hi.Files))
+	for p := range hi.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	tables := map[string]string{} // table name to table directory
+	fetched := map[string]bool{}  // files fetched by this sync
+	var ancillary []string        // files that are not listed in the index but are mirrored along with those that are
+	shardLists := map[string]bool{}
+	for _, rel := range paths {
+		ref := hi.Files[rel]
+		tables[ref.Table] = filepath.Dir(filepath.Dir(rel))
+		if ref.TableDir != "" {
+			tables[ref.Table] = ref.TableDir
+		}
+		ancillary = append(ancillary, rel+SeekIndexSuffix, rel+ChecksumSuffix, rel+ChecksumSuffix+SignatureSuffix)
+		if ref.ShardList != "" && !shardLists[ref.ShardList] {
+			shardLists[ref.ShardList] = true
+			ancillary = append(ancillary, ref.ShardList)
+		}
+
+		present, err := mirroredFilePresent(ctx, sh, rel, ref, previous.Files[rel], opts.Verified)
+		if err != nil {
+			ll.Warnw("failed to check mirrored file", "file", rel, "error", err)
+		}
+		if present {
+			stats.Present++
+			continue
+		}
+
+		fsrc, srcRel := src, rel
+		if opts.CIDSource != nil && ref.IPFSCID != "" {
+			fsrc, srcRel = opts.CIDSource, ref.IPFSCID
+		}
+
+		ll.Infow("fetching file", "file", rel)
+		partial := mirrorPartialPath(partialPath, rel)
+		n, resumed, err := fetchMirrorFile(ctx, fsrc, srcRel, partial, ref.Size, ref.SHA256)
+		if err == nil {
+			err = sh.Put(ctx, filepath.ToSlash(rel), partial)
+		}
+		if err != nil {
+			mirrorErrorsCounter.Inc()
+			ll.Errorw("failed to fetch file", "file", rel, "error", err)
+			stats.Failed++
+			continue
+		}
+		if root, ok := localShipPath(sh); ok && opts.Verified != nil && ref.SHA256 != "" {
+			if info, err := os.Stat(filepath.Join(root, rel)); err == nil {
+				opts.Verified[rel] = mirroredFile{Size: info.Size(), ModTime: info.ModTime(), SHA256: ref.SHA256}
+			}
+		}
+		mirrorFilesCounter.Inc()
+		fetched[rel] = true
+		stats.Fetched++
+		stats.Bytes += n
+		if resumed {
+			stats.Resumed++
+		}
+	}
+
+	// Seek indexes, checksum, signature, shard list, header, schema, schema descriptor, manifest and report files are
+	// not listed in the index. They are fetched when missing, and again along with the files they describe since the
+	// primary rewrites them when those files change.
+	refresh := map[string]bool{}
+	for rel := range fetched {
+		refresh[rel+SeekIndexSuffix], refresh[rel+ChecksumSuffix], refresh[rel+ChecksumSuffix+SignatureSuffix] = true, true, true
+		if ref := hi.Files[rel]; ref.ShardList != "" {
+			refresh[ref.ShardList] = true
+		}
+	}
+	for table, dir := range tables {
+		ancillary = append(ancillary, filepath.Join(dir, table+".header"), filepath.Join(dir, table+".schema"), filepath.Join(dir, table+SchemaDescriptorSuffix))
+	}
+	for _, p := range hi.Periods {
+		ep := ExportPeriod{Date: p.Date, Hour: p.Hour, StartHeight: p.StartHeight, EndHeight: p.EndHeight}
+		report := processingReportPath(network, ep)
+		period := []string{periodManifestPath(network, ep), report, report + ChecksumSuffix, report + ChecksumSuffix + SignatureSuffix}
+		ancillary = append(ancillary, period...)
+		for _, rel := range p.Files {
+			if fetched[rel] {
+				for _, a := range period {
+					refresh[a] = true
+				}
+				break
+			}
+		}
+	}
+	for _, rel := range ancillary {
+		if !refresh[rel] {
+			if _, err := sh.Stat(ctx, filepath.ToSlash(rel)); err == nil {
+				continue
+			}
+		}
+		partial := mirrorPartialPath(partialPath, rel)
+		_, _, err := fetchMirrorFile(ctx, src, rel, partial, -1, "")
+		if err == nil {
+			err = sh.Put(ctx, filepath.ToSlash(rel), partial)
+		}
+		if err != nil && !errors.Is(err, errNotFoundAtSource) {
+			ll.Errorw("failed to fetch ancillary file", "file", rel, "error", err)
+		}
+	}
+
+	if stats.Failed > 0 {
+		return stats, fmt.Errorf("failed to fetch %d files", stats.Failed)
+	}
+
+	if err := writeTableIndexes(ctx, sh, &hi); err != nil {
+		return stats, fmt.Errorf("write table indexes: %w", err)
+	}
+	if err := sh.Write(ctx, heightIndexPath(network), data); err != nil {
+		return stats, fmt.Errorf("write height index: %w", err)
+	}
+	if err := writeArchiveIndex(ctx, sh, network); err != nil {
+		return stats, fmt.Errorf("write archive index: %w", err)
+	}
+
+	return stats, nil
+}
+
+// mirroredFilePresent reports whether the ship path already holds a file with the size and checksum listed in the
+// primary's height index. Files in a filesystem ship path are hashed, unless they are unchanged since their checksum
+// was last confirmed. Files in an object store cannot be hashed without fetching them, so they are compared with the
+// entry of the height index written by the previous sync, and are trusted by size if it does not list them.
+func mirroredFilePresent(ctx context.Context, sh Shipper, rel string, ref *HeightIndexFileRef, previous *HeightIndexFileRef, verified map[string]mirroredFile) (bool, error) {
+	info, err := sh.Stat(ctx, filepath.ToSlash(rel))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if info.Size != ref.Size {
+		return false, nil
+	}
+	if ref.SHA256 == "" {
+		return true, nil
+	}
+
+	root, ok := localShipPath(sh)
+	if !ok {
+		return previous == nil || previous.SHA256 == ref.SHA256, nil
+	}
+
+	state := mirroredFile{Size: info.Size, ModTime: info.ModTime, SHA256: ref.SHA256}
+	if v, ok := verified[rel]; ok && v == state {
+		return true, nil
+	}
+	sum, _, err := sha256File(filepath.Join(root, rel))
+	if err != nil {
+		return false, fmt.Errorf("checksum: %w", err)
+	}
+	if sum != ref.SHA256 {
+		return false, nil
+	}
+	if verified != nil {
+		verified[rel] = state
+	}
+	return true, nil
+}
+
+// mirrorPartialPath returns the path a file is downloaded to before it is verified and shipped. Partial files are
+// hidden so they are not mistaken for shipped files.
+func mirrorPartialPath(root string, rel string) string {
+	return filepath.Join(root, filepath.Dir(rel), "."+filepath.Base(rel)+".partial")
+}
+
+// fetchMirrorFile downloads a file to the partial path, continuing from the end of any partial file left by an
+// earlier download, and verifies it against the expected size and checksum. A negative size or empty checksum skips
+// that check. The partial file is kept if the download is interrupted so that it can be resumed, and removed if it
+// fails verification. It returns the number of bytes downloaded and whether an earlier download was resumed.
+func fetchMirrorFile(ctx context.Context, src mirrorSource, rel string, partial string, size int64, checksum string) (int64, bool, error) {
+	var offset int64
+	if info, err := os.Stat(partial); err == nil && size >= 0 && info.Size() <= size {
+		offset = info.Size()
+	}
+
+	var n int64
+	if size < 0 || offset < size {
+		var err error
+		n, offset, err = downloadMirrorFile(ctx, src, rel, partial, offset)
+		if err != nil {
+			return n, offset > 0, err
+		}
+	}
+	resumed := offset > 0
+
+	sum, total, err := sha256File(partial)
+	if err != nil {
+		return n, resumed, fmt.Errorf("checksum: %w", err)
+	}
+	if size >= 0 && total != size {
+		os.Remove(partial)
+		return n, resumed, fmt.Errorf("size mismatch: got %d bytes, expected %d", total, size)
+	}
+	if checksum != "" && sum != checksum {
+		os.Remove(partial)
+		return n, resumed, fmt.Errorf("checksum mismatch: got %s, expected %s", sum, checksum)
+	}
+
+	if err := os.Chmod(partial, DefaultFilePerms); err != nil {
+		return n, resumed, fmt.Errorf("chmod: %w", err)
+	}
+	return n, resumed, nil
+}
+
+// downloadMirrorFile writes the contents of a file from offset onwards to the partial file. It returns the number of
+// bytes written and the offset they were written from, which is zero if the source could not resume the download.
+func downloadMirrorFile(ctx context.Context, src mirrorSource, rel string, partial string, offset int64) (int64, int64, error) {
+	rc, start, err := src.OpenFrom(ctx, rel, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(partial), DefaultDirPerms); err != nil {
+		return 0, 0, fmt.Errorf("mkdir %q: %w", filepath.Dir(partial), err)
+	}
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, DefaultFilePerms)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open partial file: %w", err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(start); err != nil {
+		return 0, 0, fmt.Errorf("truncate partial file: %w", err)
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("seek partial file: %w", err)
+	}
+
+	n, err := io.Copy(f, rc)
+	if err != nil {
+		return n, start, fmt.Errorf("download: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return n, start, fmt.Errorf("close partial file: %w", err)
+	}
+	return n, start, nil
+}
+
+var mirrorCommand = &cli.Command{
+	Name:   "mirror",
+	Usage:  "Maintain a read-only mirror of an archive produced by another deployment.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		diagnosticsFlags,
+		objectStoreFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path that mirrored files will be written to, or an s3://bucket/prefix or gs://bucket/prefix object store location.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "source",
+				EnvVars:  []string{"ARCHIVER_MIRROR_SOURCE"},
+				Usage:    "Location of the primary archive, as a local directory, an http(s):// URL, a public s3://bucket/prefix or an ipfs://cid/prefix path.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "ipfs-gateway",
+				EnvVars: []string{"ARCHIVER_IPFS_GATEWAY"},
+				Usage:   "IPFS gateway used to fetch files from ipfs:// sources.",
+				Value:   "https://ipfs.io",
+			},
+			&cli.BoolFlag{
+				Name:    "fetch-by-cid",
+				EnvVars: []string{"ARCHIVER_MIRROR_FETCH_BY_CID"},
+				Usage:   "Fetch files that list an IPFS CID in the primary's height index from the IPFS gateway by CID rather than from the source.",
+			},
+			&cli.StringFlag{
+				Name:    "tables",
+				EnvVars: []string{"ARCHIVER_MIRROR_TABLES"},
+				Usage:   "Comma separated list of tables to mirror. Default is every table.",
+			},
+			&cli.StringFlag{
+				Name:    "from-date",
+				EnvVars: []string{"ARCHIVER_FROM_DATE"},
+				Usage:   "Mirror only files that are exported on or after this date, in YYYY-MM-DD format.",
+			},
+			&cli.StringFlag{
+				Name:    "to-date",
+				EnvVars: []string{"ARCHIVER_TO_DATE"},
+				Usage:   "Mirror only files that are exported on or before this date, in YYYY-MM-DD format.",
+			},
+			&cli.StringFlag{
+				Name:    "staging-path",
+				EnvVars: []string{"ARCHIVER_STAGING_PATH"},
+				Usage:   "Path that files are downloaded to before being uploaded when the ship path is an object store. Defaults to the system temporary directory.",
+			},
+			&cli.DurationFlag{
+				Name:    "interval",
+				EnvVars: []string{"ARCHIVER_MIRROR_INTERVAL"},
+				Usage:   "Time to wait between syncs of the mirror.",
+				Value:   time.Hour,
+			},
+			&cli.BoolFlag{
+				Name:  "once",
+				Usage: "Sync the mirror once and exit.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		src, err := newMirrorSource(cc.String("source"), cc.String("ipfs-gateway"))
+		if err != nil {
+			return fmt.Errorf("invalid source: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to write mirrored files: %w", err)
+		}
+
+		opts := MirrorOptions{PartialPath: cc.String("staging-path"), Verified: map[string]mirroredFile{}}
+		if opts.PartialPath == "" {
+			opts.PartialPath = filepath.Join(os.TempDir(), appName+"-mirror")
+		}
+		if cc.Bool("fetch-by-cid") {
+			if opts.CIDSource, err = newMirrorSource("ipfs://", cc.String("ipfs-gateway")); err != nil {
+				return fmt.Errorf("invalid ipfs gateway: %w", err)
+			}
+		}
+		if cc.String("tables") != "" {
+			opts.Filter.Tables = map[string]bool{}
+			for _, t := range strings.Split(cc.String("tables"), ",") {
+				t = strings.TrimSpace(t)
+				if _, ok := TablesByName[t]; !ok {
+					return fmt.Errorf("unknown table %q", t)
+				}
+				opts.Filter.Tables[t] = true
+			}
+		}
+		if cc.IsSet("from-date") {
+			if opts.Filter.FromDate, err = DateFromString(cc.String("from-date")); err != nil {
+				return fmt.Errorf("invalid from date: %w", err)
+			}
+		}
+		if cc.IsSet("to-date") {
+			if opts.Filter.ToDate, err = DateFromString(cc.String("to-date")); err != nil {
+				return fmt.Errorf("invalid to date: %w", err)
+			}
+		}
+
+		sync := func(ctx context.Context) (bool, error) {
+			start := time.Now()
+			stats, err := mirrorNetwork(ctx, src, networkConfig.name, sh, opts)
+			if err != nil {
+				logger.Errorw("mirror sync failed", "error", err)
+			}
+			if stats != nil {
+				logger.Infow("mirror sync complete", "fetched", stats.Fetched, "resumed", stats.Resumed, "bytes", stats.Bytes, "present", stats.Present, "failed", stats.Failed, "duration", time.Since(start).String())
+			}
+			if err == nil {
+				mirrorLastSyncGauge.Set(float64(time.Now().Unix()))
+			}
+			if cc.Bool("once") {
+				return true, err
+			}
+			return false, nil
+		}
+
+		return WaitUntil(ctx, sync, 0, cc.Duration("interval"))
+	},
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func TestFetchMirrorFileResumes(t *testing.T) {
+	content := bytes.Repeat([]byte("1005360,root,parent,tipset\n"), 100)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	base, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &HTTPMirrorSource{Base: base, Client: srv.Client()}
+
+	partial := mirrorPartialPath(t.TempDir(), "mainnet/csv/1/chain_consensus/2021/chain_consensus-2021-08-02.csv.gz")
+	if err := os.MkdirAll(filepath.Dir(partial), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, content[:1000], DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	n, resumed, err := fetchMirrorFile(context.Background(), src, "file", partial, int64(len(content)), checksum)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if !resumed || n != int64(len(content)-1000) {
+		t.Errorf("got resumed %v after %d bytes, wanted a resumed download of %d bytes", resumed, n, len(content)-1000)
+	}
+	if got, _ := os.ReadFile(partial); !bytes.Equal(got, content) {
+		t.Errorf("downloaded file does not match the source")
+	}
+
+	// A partial file that does not match the source fails verification and is discarded
+	if err := os.WriteFile(partial, []byte("garbage"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetchMirrorFile(context.Background(), src, "file", partial, int64(len(content)), checksum); err == nil {
+		t.Errorf("expected a checksum mismatch")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("expected the partial file to be removed")
+	}
+}
+
+func TestMirrorNetworkFilter(t *testing.T) {
+	mirrorFilesCounter = metrics.NewCtx(context.Background(), "mirror_files_total", "").Counter()
+	mirrorErrorsCounter = metrics.NewCtx(context.Background(), "mirror_errors_total", "").Counter()
+
+	srcRoot, dstRoot := t.TempDir(), t.TempDir()
+
+	hi := &HeightIndex{Network: "mainnet", Files: map[string]*HeightIndexFileRef{}}
+	for _, f := range []struct {
+		table string
+		date  Date
+	}{
+		{table: "messages", date: Date{Year: 2021, Month: 8, Day: 1}},
+		{table: "messages", date: Date{Year: 2021, Month: 8, Day: 2}},
+		{table: "blocks", date: Date{Year: 2021, Month: 8, Day: 2}},
+	} {
+		rel := filepath.Join("mainnet", "csv", "1", f.table, "2021", f.table+"-"+f.date.String()+".csv.gz")
+		data := []byte(f.table + f.date.String())
+		sum := sha256.Sum256(data)
+		hi.Files[rel] = &HeightIndexFileRef{Date: f.date, Table: f.table, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+		hi.Periods = append(hi.Periods, &HeightIndexPeriod{Date: f.date, Files: []string{rel}})
+
+		if err := os.MkdirAll(filepath.Join(srcRoot, filepath.Dir(rel)), DefaultDirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(srcRoot, rel), data, DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(hi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcRoot, "mainnet", HeightIndexFilename), data, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := MirrorOptions{Filter: MirrorFilter{Tables: map[string]bool{"messages": true}, FromDate: Date{Year: 2021, Month: 8, Day: 2}}}
+	stats, err := mirrorNetwork(context.Background(), &localMirrorSource{root: srcRoot}, "mainnet", &fileShipper{root: dstRoot}, opts)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if stats.Fetched != 1 || stats.Failed != 0 {
+		t.Errorf("got %d fetched and %d failed files, wanted 1 fetched", stats.Fetched, stats.Failed)
+	}
+
+	want := filepath.Join("mainnet", "csv", "1", "messages", "2021", "messages-2021-08-02.csv.gz")
+	if _, err := os.Stat(filepath.Join(dstRoot, want)); err != nil {
+		t.Errorf("mirrored file is missing: %v", err)
+	}
+
+	var mirrored HeightIndex
+	data, err = os.ReadFile(filepath.Join(dstRoot, "mainnet", HeightIndexFilename))
+	if err != nil {
+		t.Fatalf("read mirrored height index: %v", err)
+	}
+	if err := json.Unmarshal(data, &mirrored); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mirrored.Files[want]; !ok || len(mirrored.Files) != 1 || len(mirrored.Periods) != 1 {
+		t.Errorf("mirrored height index should list only the included file, got %v", mirrored.Files)
+	}
+}
+
+// opaqueShipper hides the filesystem ship path beneath it, as an object store would.
+type opaqueShipper struct {
+	Shipper
+}
+
+func TestMirroredFilePresent(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	rel := filepath.Join("mainnet", "csv", "1", "messages", "2021", "messages-2021-08-02.csv.gz")
+	write := func(data string) {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), DefaultDirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, rel), []byte(data), DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refFor := func(data string) *HeightIndexFileRef {
+		sum := sha256.Sum256([]byte(data))
+		return &HeightIndexFileRef{Table: "messages", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+	}
+	sh := &fileShipper{root: root}
+	verified := map[string]mirroredFile{}
+
+	if present, err := mirroredFilePresent(ctx, sh, rel, refFor("messages"), nil, verified); err != nil || present {
+		t.Errorf("got present %v (%v) for a missing file", present, err)
+	}
+
+	write("messages")
+	if present, err := mirroredFilePresent(ctx, sh, rel, refFor("messages"), nil, verified); err != nil || !present {
+		t.Errorf("got present %v (%v) for a matching file", present, err)
+	}
+	if _, ok := verified[rel]; !ok {
+		t.Errorf("matching file was not recorded as verified")
+	}
+
+	// A corrupt file of the same size is fetched again
+	write("MESSAGES")
+	if present, err := mirroredFilePresent(ctx, sh, rel, refFor("messages"), nil, verified); err != nil || present {
+		t.Errorf("got present %v (%v) for a corrupt file of the same size", present, err)
+	}
+
+	// As is a file the primary has replaced with one of the same size
+	write("messages")
+	if present, err := mirroredFilePresent(ctx, sh, rel, refFor("massages"), nil, verified); err != nil || present {
+		t.Errorf("got present %v (%v) for a stale file of the same size", present, err)
+	}
+
+	// Object stores are compared with the index written by the previous sync
+	opaque := &opaqueShipper{Shipper: sh}
+	testCases := []struct {
+		ref      *HeightIndexFileRef
+		previous *HeightIndexFileRef
+		want     bool
+	}{
+		{ref: refFor("messages"), previous: refFor("messages"), want: true},
+		{ref: refFor("massages"), previous: refFor("messages"), want: false},
+		{ref: refFor("messages"), previous: nil, want: true},
+		{ref: refFor("more messages"), previous: refFor("more messages"), want: false},
+	}
+	for _, tc := range testCases {
+		if present, err := mirroredFilePresent(ctx, opaque, rel, tc.ref, tc.previous, nil); err != nil || present != tc.want {
+			t.Errorf("got present %v (%v) in an object store, wanted %v", present, err, tc.want)
+		}
+	}
+}
+
+func TestMirrorNetworkRefetchesCorruptFiles(t *testing.T) {
+	mirrorFilesCounter = metrics.NewCtx(context.Background(), "mirror_files_total", "").Counter()
+	mirrorErrorsCounter = metrics.NewCtx(context.Background(), "mirror_errors_total", "").Counter()
+
+	srcRoot, dstRoot := t.TempDir(), t.TempDir()
+	rel := filepath.Join("mainnet", "csv", "1", "messages", "2021", "messages-2021-08-02.csv.gz")
+	data := []byte("messages")
+	sum := sha256.Sum256(data)
+	hi := &HeightIndex{
+		Network: "mainnet",
+		Periods: []*HeightIndexPeriod{{Date: Date{Year: 2021, Month: 8, Day: 2}, Files: []string{rel}}},
+		Files:   map[string]*HeightIndexFileRef{rel: {Date: Date{Year: 2021, Month: 8, Day: 2}, Table: "messages", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}},
+	}
+	idx, err := json.Marshal(hi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for root, contents := range map[string][]byte{srcRoot: data, dstRoot: []byte("MESSAGES")} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), DefaultDirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, rel), contents, DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(srcRoot, "mainnet", HeightIndexFilename), idx, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := MirrorOptions{Verified: map[string]mirroredFile{}}
+	for i, want := range []MirrorStats{{Fetched: 1, Bytes: int64(len(data))}, {Present: 1}} {
+		stats, err := mirrorNetwork(context.Background(), &localMirrorSource{root: srcRoot}, "mainnet", &fileShipper{root: dstRoot}, opts)
+		if err != nil {
+			t.Fatalf("mirror: %v", err)
+		}
+		if *stats != want {
+			t.Errorf("sync %d: got stats %+v, wanted %+v", i, *stats, want)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(dstRoot, rel)); !bytes.Equal(got, data) {
+		t.Errorf("corrupt file was not replaced, got %q", got)
+	}
+}
+
+func TestMirrorNetworkAncillaryFiles(t *testing.T) {
+	mirrorFilesCounter = metrics.NewCtx(context.Background(), "mirror_files_total", "").Counter()
+	mirrorErrorsCounter = metrics.NewCtx(context.Background(), "mirror_errors_total", "").Counter()
+
+	srcRoot, dstRoot := t.TempDir(), t.TempDir()
+	date := Date{Year: 2021, Month: 8, Day: 2}
+	rel := filepath.Join("mainnet", "csv", "1", "messages", "2021", "messages-2021-08-02.csv.gz")
+	data := []byte("messages")
+	sum := sha256.Sum256(data)
+	hi := &HeightIndex{
+		Network: "mainnet",
+		Periods: []*HeightIndexPeriod{{Date: date, Files: []string{rel}}},
+		Files:   map[string]*HeightIndexFileRef{rel: {Date: date, Table: "messages", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}},
+	}
+	report := processingReportPath("mainnet", ExportPeriod{Date: date})
+	ancillary := []string{
+		rel + SeekIndexSuffix,
+		rel + ChecksumSuffix,
+		rel + ChecksumSuffix + SignatureSuffix,
+		filepath.Join("mainnet", "csv", "1", "messages", "messages.header"),
+		periodManifestPath("mainnet", ExportPeriod{Date: date}),
+		report,
+		report + ChecksumSuffix,
+		report + ChecksumSuffix + SignatureSuffix,
+	}
+	write := func(rel string, data []byte) {
+		if err := os.MkdirAll(filepath.Join(srcRoot, filepath.Dir(rel)), DefaultDirPerms); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(srcRoot, rel), data, DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(rel, data)
+	for _, a := range ancillary {
+		write(a, []byte(a))
+	}
+	idx, err := json.Marshal(hi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join("mainnet", HeightIndexFilename), idx)
+
+	sh := &opaqueShipper{Shipper: &fileShipper{root: dstRoot}}
+	stats, err := mirrorNetwork(context.Background(), &localMirrorSource{root: srcRoot}, "mainnet", sh, MirrorOptions{})
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if want := (MirrorStats{Fetched: 1, Bytes: int64(len(data))}); *stats != want {
+		t.Errorf("got stats %+v, wanted %+v", *stats, want)
+	}
+	for _, a := range ancillary {
+		if got, err := os.ReadFile(filepath.Join(dstRoot, a)); err != nil || string(got) != a {
+			t.Errorf("got %q (%v) for %s, wanted it mirrored", got, err, a)
+		}
+	}
+
+	// The primary rewrites the checksum and report of a file it replaces, which are fetched again along with the file
+	data = []byte("more messages")
+	sum = sha256.Sum256(data)
+	hi.Files[rel].Size, hi.Files[rel].SHA256 = int64(len(data)), hex.EncodeToString(sum[:])
+	if idx, err = json.Marshal(hi); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join("mainnet", HeightIndexFilename), idx)
+	write(rel, data)
+	write(rel+ChecksumSuffix, []byte("new checksum"))
+	write(report, []byte("new report"))
+	if _, err := mirrorNetwork(context.Background(), &localMirrorSource{root: srcRoot}, "mainnet", sh, MirrorOptions{}); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	for a, want := range map[string]string{rel + ChecksumSuffix: "new checksum", report: "new report"} {
+		if got, _ := os.ReadFile(filepath.Join(dstRoot, a)); string(got) != want {
+			t.Errorf("got %q for %s, wanted %q", got, a, want)
+		}
+	}
+}
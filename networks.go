@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+)
+
+// NetworkRunConfig describes a network exported by the run-networks command.
+type NetworkRunConfig struct {
+	Name        string            `json:"name"`
+	LilyAddr    string            `json:"lily_addr"`
+	LilyToken   string            `json:"lily_token,omitempty"`
+	ShipPath    string            `json:"ship_path"`
+	StoragePath string            `json:"storage_path,omitempty"`
+	GenesisTs   int64             `json:"genesis_ts,omitempty"`
+	BlockDelay  int64             `json:"block_delay,omitempty"`
+	Finality    int64             `json:"finality,omitempty"`
+	Flags       map[string]string `json:"flags,omitempty"` // any other flags of the run command, by flag name
+}
+
+// exclusiveNetworkFlags must differ between networks since they name resources that cannot be shared.
+var exclusiveNetworkFlags = []string{"storage-path", "ship-path", "state-path", "staging-path", "debug-addr", "prometheus-addr", "status-addr"}
+
+// MultiNetworkConfig is the configuration file read by the run-networks command.
+type MultiNetworkConfig struct {
+	Networks []NetworkRunConfig `json:"networks"`
+}
+
+// reservedNetworkFlags are set from the fields of a network's configuration and may not be given in its flags.
+var reservedNetworkFlags = []string{"network", "lily-addr", "lily-token", "ship-path", "storage-path", "genesis-ts", "block-delay", "finality"}
+
+func loadMultiNetworkConfig(path string) (*MultiNetworkConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var mc MultiNetworkConfig
+	if err := json.Unmarshal(data, &mc); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if err := mc.Validate(); err != nil {
+		return nil, err
+	}
+	return &mc, nil
+}
+
+// Validate checks that each network is fully described and that networks do not share resources. Resources are
+// compared using the values each worker will see, including those it inherits from the environment and the defaults of
+// the run command.
+func (mc *MultiNetworkConfig) Validate() error {
+	if len(mc.Networks) == 0 {
+		return fmt.Errorf("no networks configured")
+	}
+
+	names := map[string]bool{}
+	exclusive := map[string]string{}
+	for _, n := range mc.Networks {
+		if n.Name == "" {
+			return fmt.Errorf("network without a name")
+		}
+		if names[n.Name] {
+			return fmt.Errorf("duplicate network %q", n.Name)
+		}
+		names[n.Name] = true
+
+		if n.LilyAddr == "" {
+			return fmt.Errorf("network %s: no lily address", n.Name)
+		}
+		if n.ShipPath == "" {
+			return fmt.Errorf("network %s: no ship path", n.Name)
+		}
+
+		for _, f := range reservedNetworkFlags {
+			if _, ok := n.Flags[f]; ok {
+				return fmt.Errorf("network %s: flag %s must be set using the network's configuration fields", n.Name, f)
+			}
+		}
+		for name := range n.Flags {
+			if runFlagEnvVar(name) == "" {
+				return fmt.Errorf("network %s: unknown flag %s", n.Name, name)
+			}
+		}
+		for _, f := range exclusiveNetworkFlags {
+			v := n.flagValue(f)
+			if v == "" {
+				continue
+			}
+			if other, ok := exclusive[f+"="+v]; ok {
+				return fmt.Errorf("network %s: %s %q is also used by network %s", n.Name, f, v, other)
+			}
+			exclusive[f+"="+v] = n.Name
+		}
+	}
+	return nil
+}
+
+// Args returns the arguments of the run command that exports the network. Other flags are passed in the environment,
+// see Env.
+func (n *NetworkRunConfig) Args() []string {
+	args := []string{"run", "--network", n.Name, "--lily-addr", n.LilyAddr, "--ship-path", n.ShipPath}
+	if n.StoragePath != "" {
+		args = append(args, "--storage-path", n.StoragePath)
+	}
+	if n.GenesisTs != 0 {
+		args = append(args, "--genesis-ts", strconv.FormatInt(n.GenesisTs, 10))
+	}
+	if n.BlockDelay != 0 {
+		args = append(args, "--block-delay", strconv.FormatInt(n.BlockDelay, 10))
+	}
+	if n.Finality != 0 {
+		args = append(args, "--finality", strconv.FormatInt(n.Finality, 10))
+	}
+	return args
+}
+
+// Env returns the environment of the run command that exports the network: the environment of this process with the
+// lily token and the network's flags set in the environment variables read by the run command. They are passed in the
+// environment rather than on the command line so that tokens, credentials and webhook urls are not visible to other
+// users of the host. A flag set for the network replaces the same setting inherited from this process.
+func (n *NetworkRunConfig) Env() []string {
+	env := os.Environ()
+	if n.LilyToken != "" {
+		env = append(env, "ARCHIVER_LILY_TOKEN="+n.LilyToken)
+	}
+
+	// Flags are sorted so the environment is stable between restarts
+	names := make([]string, 0, len(n.Flags))
+	for name := range n.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, runFlagEnvVar(name)+"="+n.Flags[name])
+	}
+	return env
+}
+
+// flagValue returns the value of a flag of the run command as the network's worker will see it: set by the network's
+// configuration, inherited from the environment of this process or the flag's default.
+func (n *NetworkRunConfig) flagValue(name string) string {
+	switch name {
+	case "ship-path":
+		return n.ShipPath
+	case "storage-path":
+		if n.StoragePath != "" {
+			return n.StoragePath
+		}
+	}
+	if v, ok := n.Flags[name]; ok {
+		return v
+	}
+
+	f := runFlag(name)
+	if f == nil {
+		return ""
+	}
+	for _, ev := range f.GetEnvVars() {
+		if v, ok := os.LookupEnv(ev); ok {
+			return v
+		}
+	}
+	return f.GetValue()
+}
+
+// runFlag returns the flag of the run command with the given name, or nil if there is none.
+func runFlag(name string) cli.DocGenerationFlag {
+	for _, f := range runFlags {
+		for _, n := range f.Names() {
+			if n == name {
+				df, _ := f.(cli.DocGenerationFlag)
+				return df
+			}
+		}
+	}
+	return nil
+}
+
+// runFlagEnvVar returns the environment variable read by the run command for a flag, or an empty string if the run
+// command has no such flag or it cannot be set in the environment.
+func runFlagEnvVar(name string) string {
+	f := runFlag(name)
+	if f == nil || len(f.GetEnvVars()) == 0 {
+		return ""
+	}
+	return f.GetEnvVars()[0]
+}
+
+// networkRestartDelay is the time waited before restarting the export loop of a network that exited.
+const networkRestartDelay = 30 * time.Second
+
+// runNetwork runs the export loop for a network in a child process, restarting it whenever it exits, until the context
+// is cancelled. Output of the child is prefixed with the network name.
+func runNetwork(ctx context.Context, exe string, n NetworkRunConfig) {
+	ll := logger.With("network", n.Name)
+	for {
+		err := runNetworkOnce(ctx, exe, n)
+		if ctx.Err() != nil {
+			return
+		}
+		ll.Errorw("network export loop exited, restarting", "error", err, "delay", networkRestartDelay.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(networkRestartDelay):
+		}
+	}
+}
+
+func runNetworkOnce(ctx context.Context, exe string, n NetworkRunConfig) error {
+	cmd := exec.Command(exe, n.Args()...)
+	cmd.Env = n.Env()
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sc := bufio.NewScanner(pr)
+		sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for sc.Scan() {
+			fmt.Fprintf(os.Stderr, "[%s] %s\n", n.Name, sc.Text())
+		}
+		io.Copy(io.Discard, pr) // drain output following an overlong line
+	}()
+
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		wg.Wait()
+		return fmt.Errorf("start: %w", err)
+	}
+	logger.Infow("started network export loop", "network", n.Name, "pid", cmd.Process.Pid)
+
+	// The child is asked to stop when the context is cancelled and killed if it does not exit promptly. SIGHUP is
+	// passed on so that workers reload their table config.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				cmd.Process.Signal(syscall.SIGHUP)
+			case <-ctx.Done():
+				cmd.Process.Signal(syscall.SIGTERM)
+				select {
+				case <-done:
+				case <-time.After(30 * time.Second):
+					cmd.Process.Kill()
+				}
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	close(done)
+	pw.Close()
+	wg.Wait()
+	return err
+}
+
+// runNetworksCommand runs each network in a worker process running the run command. Network parameters, metrics, the
+// state store and the table configuration are process-wide, so networks cannot share a process without every export
+// path being given its network's configuration explicitly. Workers also isolate the networks from each other's
+// failures.
+var runNetworksCommand = &cli.Command{
+	Name:  "run-networks",
+	Usage: "Run the export loops of several networks, each in its own worker process.",
+	// Network parameters are configured by each worker, only logging is needed here
+	Before: func(cc *cli.Context) error {
+		return logging.SetLogLevel(appName, loggingConfig.level)
+	},
+	Flags: flagSet(
+		loggingFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "networks-config",
+				EnvVars:  []string{"ARCHIVER_NETWORKS_CONFIG"},
+				Usage:    "Path to a json file describing the networks to export.",
+				Required: true,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		mc, err := loadMultiNetworkConfig(cc.String("networks-config"))
+		if err != nil {
+			return fmt.Errorf("invalid networks config: %w", err)
+		}
+
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("find executable: %w", err)
+		}
+
+		ctx, stop := signal.NotifyContext(cc.Context, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// SIGHUP is passed on to the workers and must not stop this process while a worker is being restarted
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for _, n := range mc.Networks {
+			wg.Add(1)
+			go func(n NetworkRunConfig) {
+				defer wg.Done()
+				runNetwork(ctx, exe, n)
+			}(n)
+		}
+		wg.Wait()
+		return nil
+	},
+}
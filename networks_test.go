@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMultiNetworkConfigValidate(t *testing.T) {
+	// Paths inherited from the environment of the test would be shared by every network
+	for _, ev := range []string{"ARCHIVER_STATE_PATH", "ARCHIVER_STAGING_PATH", "ARCHIVER_PROMETHEUS_ADDR", "ARCHIVER_STORAGE_PATH"} {
+		t.Setenv(ev, "")
+		os.Unsetenv(ev)
+	}
+
+	mainnet := NetworkRunConfig{Name: "mainnet", LilyAddr: "/ip4/127.0.0.1/tcp/1234", ShipPath: "/data/mainnet/ship", StoragePath: "/data/lily/mainnet"}
+	calibnet := NetworkRunConfig{Name: "calibnet", LilyAddr: "/ip4/127.0.0.1/tcp/1235", ShipPath: "/data/calibnet/ship", StoragePath: "/data/lily/calibnet"}
+
+	withFlags := func(n NetworkRunConfig, flags map[string]string) NetworkRunConfig {
+		n.Flags = flags
+		return n
+	}
+	with := func(n NetworkRunConfig, fn func(n *NetworkRunConfig)) NetworkRunConfig {
+		fn(&n)
+		return n
+	}
+
+	testCases := []struct {
+		name     string
+		networks []NetworkRunConfig
+		env      map[string]string
+		wantErr  bool
+	}{
+		{name: "ok", networks: []NetworkRunConfig{mainnet, calibnet}},
+		{name: "empty", networks: nil, wantErr: true},
+		{name: "duplicate", networks: []NetworkRunConfig{mainnet, mainnet}, wantErr: true},
+		{name: "no ship path", networks: []NetworkRunConfig{{Name: "mainnet", LilyAddr: "/ip4/127.0.0.1/tcp/1234"}}, wantErr: true},
+		{name: "reserved flag", networks: []NetworkRunConfig{withFlags(mainnet, map[string]string{"network": "x"})}, wantErr: true},
+		{name: "unknown flag", networks: []NetworkRunConfig{withFlags(mainnet, map[string]string{"no-such-flag": "x"})}, wantErr: true},
+		{
+			name:     "shared ship path",
+			networks: []NetworkRunConfig{mainnet, with(calibnet, func(n *NetworkRunConfig) { n.ShipPath = mainnet.ShipPath })},
+			wantErr:  true,
+		},
+		{
+			name:     "shared storage path",
+			networks: []NetworkRunConfig{mainnet, with(calibnet, func(n *NetworkRunConfig) { n.StoragePath = mainnet.StoragePath })},
+			wantErr:  true,
+		},
+		{
+			name: "default storage path",
+			networks: []NetworkRunConfig{
+				with(mainnet, func(n *NetworkRunConfig) { n.StoragePath = "" }),
+				with(calibnet, func(n *NetworkRunConfig) { n.StoragePath = "" }),
+			},
+			wantErr: true,
+		},
+		{
+			name:     "storage path inherited from the environment",
+			networks: []NetworkRunConfig{mainnet, with(calibnet, func(n *NetworkRunConfig) { n.StoragePath = "" })},
+			env:      map[string]string{"ARCHIVER_STORAGE_PATH": mainnet.StoragePath},
+			wantErr:  true,
+		},
+		{
+			name: "shared state path",
+			networks: []NetworkRunConfig{
+				withFlags(mainnet, map[string]string{"state-path": "/data/state"}),
+				withFlags(calibnet, map[string]string{"state-path": "/data/state"}),
+			},
+			wantErr: true,
+		},
+		{
+			name:     "state path inherited from the environment",
+			networks: []NetworkRunConfig{mainnet, calibnet},
+			env:      map[string]string{"ARCHIVER_STATE_PATH": "/data/state"},
+			wantErr:  true,
+		},
+		{
+			name: "state path overridden for each network",
+			networks: []NetworkRunConfig{
+				withFlags(mainnet, map[string]string{"state-path": "/data/mainnet/state"}),
+				withFlags(calibnet, map[string]string{"state-path": "/data/calibnet/state"}),
+			},
+			env: map[string]string{"ARCHIVER_STATE_PATH": "/data/state"},
+		},
+		{
+			name: "shared prometheus address",
+			networks: []NetworkRunConfig{
+				withFlags(mainnet, map[string]string{"prometheus-addr": ":9991"}),
+				withFlags(calibnet, map[string]string{"prometheus-addr": ":9991"}),
+			},
+			wantErr: true,
+		},
+		{
+			name: "distinct prometheus addresses",
+			networks: []NetworkRunConfig{
+				withFlags(mainnet, map[string]string{"prometheus-addr": ":9991"}),
+				withFlags(calibnet, map[string]string{"prometheus-addr": ":9992"}),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			mc := &MultiNetworkConfig{Networks: tc.networks}
+			err := mc.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, wanted error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNetworkRunConfigArgs(t *testing.T) {
+	n := NetworkRunConfig{
+		Name:      "calibnet",
+		LilyAddr:  "/ip4/127.0.0.1/tcp/1235",
+		LilyToken: "secret",
+		ShipPath:  "/data/ship",
+		GenesisTs: 1667326380,
+		Flags:     map[string]string{"tasks": "block_header", "compression": "zstd"},
+	}
+	want := []string{
+		"run", "--network", "calibnet", "--lily-addr", "/ip4/127.0.0.1/tcp/1235", "--ship-path", "/data/ship",
+		"--genesis-ts", "1667326380",
+	}
+	if got := n.Args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestNetworkRunConfigEnv(t *testing.T) {
+	t.Setenv("ARCHIVER_COMPRESSION", "gz")
+	n := NetworkRunConfig{
+		Name:      "calibnet",
+		LilyAddr:  "/ip4/127.0.0.1/tcp/1235",
+		LilyToken: "secret",
+		ShipPath:  "/data/ship",
+		Flags: map[string]string{
+			"compression":             "zstd",
+			"object-store-secret-key": "s3cret",
+			"notify-slack-webhook":    "https://hooks.slack.com/services/x",
+		},
+	}
+
+	// Secrets are never placed on the command line
+	for _, arg := range n.Args() {
+		if strings.Contains(arg, "secret") || strings.Contains(arg, "s3cret") || strings.Contains(arg, "hooks.slack.com") {
+			t.Errorf("argument %q exposes a secret", arg)
+		}
+	}
+
+	// Later entries of the environment take precedence, so each network's flags replace inherited settings
+	got := map[string]string{}
+	for _, kv := range n.Env() {
+		parts := strings.SplitN(kv, "=", 2)
+		got[parts[0]] = parts[1]
+	}
+	for k, v := range map[string]string{
+		"ARCHIVER_LILY_TOKEN":              "secret",
+		"ARCHIVER_COMPRESSION":             "zstd",
+		"ARCHIVER_OBJECT_STORE_SECRET_KEY": "s3cret",
+		"ARCHIVER_NOTIFY_SLACK_WEBHOOK":    "https://hooks.slack.com/services/x",
+	} {
+		if got[k] != v {
+			t.Errorf("got %s=%q in the environment, wanted %q", k, got[k], v)
+		}
+	}
+}
+
+func TestRunFlagsHaveEnvVars(t *testing.T) {
+	// Every flag of the run command may be set for a network, so each must be readable from the environment
+	for _, f := range runFlags {
+		if runFlagEnvVar(f.Names()[0]) == "" {
+			t.Errorf("run flag %s has no environment variable", f.Names()[0])
+		}
+	}
+}
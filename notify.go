@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Events that notifications are sent for.
+const (
+	EventPeriodShipped      = "period_shipped"      // every file of a period has been shipped
+	EventVerificationFailed = "verification_failed" // one or more tables of a period failed verification and were not shipped
+	EventShippingFailed     = "shipping_failed"     // processing of a period has failed repeatedly
+	EventLagSLOBreached     = "lag_slo_breached"    // the archive has fallen further behind the chain head than the lag slo
+	EventLagSLORecovered    = "lag_slo_recovered"   // the archive has caught up to within the lag slo again
+)
+
+// DefaultNotifyFailureThreshold is the number of consecutive failures processing a period after which a notification
+// is sent.
+const DefaultNotifyFailureThreshold = 3
+
+// notifyTimeout bounds the time taken to deliver a notification to each destination so that an unresponsive webhook
+// cannot hold up exports.
+const notifyTimeout = 10 * time.Second
+
+// Notification is the payload posted to webhooks.
+type Notification struct {
+	Event       string    `json:"event"`
+	Network     string    `json:"network"`
+	Period      string    `json:"period"` // the date of the period, or its height range for ranged periods
+	Date        Date      `json:"date"`
+	StartHeight int64     `json:"start_height"`
+	EndHeight   int64     `json:"end_height"`
+	Tables      []string  `json:"tables,omitempty"` // tables shipped, or that failed verification
+	Message     string    `json:"message"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// newNotification creates a notification for an event affecting a period.
+func newNotification(event string, network string, p ExportPeriod, message string) *Notification {
+	return &Notification{
+		Event:       event,
+		Network:     network,
+		Period:      p.String(),
+		Date:        p.Date,
+		StartHeight: p.StartHeight,
+		EndHeight:   p.EndHeight,
+		Message:     message,
+		Time:        time.Now().UTC(),
+	}
+}
+
+// notificationsEnabled reports whether any notification destination has been configured.
+func notificationsEnabled() bool {
+	return len(notifyConfig.webhooks) > 0 || notifyConfig.slackWebhook != "" || notifyConfig.discordWebhook != ""
+}
+
+// notify delivers a notification to each configured destination. Delivery failures are logged rather than returned
+// since a notification must never cause an export to fail.
+func notify(ctx context.Context, n *Notification) {
+	if !notificationsEnabled() {
+		return
+	}
+
+	payload, err := json.Marshal(n)
+	if err != nil {
+		logger.Errorw("failed to encode notification", "error", err, "event", n.Event)
+		return
+	}
+
+	for _, url := range notifyConfig.webhooks {
+		if err := postNotification(ctx, url, payload); err != nil {
+			logger.Errorw("failed to send webhook notification", "error", err, "event", n.Event)
+		}
+	}
+
+	// Chat services expect their own payloads and only need a readable message
+	text := n.Text()
+	if notifyConfig.slackWebhook != "" {
+		payload, _ := json.Marshal(map[string]string{"text": text})
+		if err := postNotification(ctx, notifyConfig.slackWebhook, payload); err != nil {
+			logger.Errorw("failed to send slack notification", "error", err, "event", n.Event)
+		}
+	}
+	if notifyConfig.discordWebhook != "" {
+		payload, _ := json.Marshal(map[string]string{"content": text})
+		if err := postNotification(ctx, notifyConfig.discordWebhook, payload); err != nil {
+			logger.Errorw("failed to send discord notification", "error", err, "event", n.Event)
+		}
+	}
+}
+
+// Text returns a single line summary of the notification for chat services.
+func (n *Notification) Text() string {
+	var sb strings.Builder
+	if n.Period == "" {
+		fmt.Fprintf(&sb, "[%s] %s: %s", n.Event, n.Network, n.Message)
+	} else {
+		fmt.Fprintf(&sb, "[%s] %s %s (heights %d-%d): %s", n.Event, n.Network, n.Period, n.StartHeight, n.EndHeight, n.Message)
+	}
+	if len(n.Tables) > 0 {
+		fmt.Fprintf(&sb, " tables: %s", strings.Join(n.Tables, ", "))
+	}
+	if n.Error != "" {
+		fmt.Fprintf(&sb, " error: %s", n.Error)
+	}
+	return sb.String()
+}
+
+func postNotification(ctx context.Context, url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	return postJSON(ctx, url, payload)
+}
+
+// postJSON posts a json payload to the url, returning an error unless the response has a success status.
+func postJSON(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// notifyPeriodShipped sends a notification listing the tables of a period once all of its files have been shipped.
+func notifyPeriodShipped(ctx context.Context, em *ExportManifest) {
+	n := newNotification(EventPeriodShipped, em.Network, em.Period, "all files shipped")
+	n.Tables = manifestTables(em, func(ef *ExportFile) bool { return ef.Shipped })
+	notify(ctx, n)
+}
+
+// notifyVerificationFailed sends a notification listing the tables of a period that were held back by verification.
+func notifyVerificationFailed(ctx context.Context, em *ExportManifest, tables []string) {
+	n := newNotification(EventVerificationFailed, em.Network, em.Period, "verification failed, tables not shipped")
+	n.Tables = tables
+	notify(ctx, n)
+}
+
+// notifyShippingFailed sends a notification when processing of a period has failed repeatedly.
+func notifyShippingFailed(ctx context.Context, network string, p ExportPeriod, failures int, err error) {
+	n := newNotification(EventShippingFailed, network, p, fmt.Sprintf("processing failed %d times, still retrying", failures))
+	if err != nil {
+		n.Error = err.Error()
+	}
+	notify(ctx, n)
+}
+
+// notifyLagSLO sends a notification when the lag of the archive exceeds the lag slo, or recovers after doing so. The
+// notification is not for a single period, so only the end height of the latest completed period is set.
+func notifyLagSLO(ctx context.Context, network string, ls *LagStatus) {
+	n := &Notification{
+		Event:     EventLagSLORecovered,
+		Network:   network,
+		EndHeight: ls.CompletedHeight,
+		Message:   fmt.Sprintf("export lag is %s, within the slo of %s", ls.Lag, ls.SLO),
+		Time:      time.Now().UTC(),
+	}
+	if ls.Breached {
+		n.Event = EventLagSLOBreached
+		n.Message = fmt.Sprintf("export lag is %s, exceeding the slo of %s", ls.Lag, ls.SLO)
+	}
+	notify(ctx, n)
+}
+
+// manifestTables returns the sorted names of the tables with a file in the manifest matching fn.
+func manifestTables(em *ExportManifest, fn func(*ExportFile) bool) []string {
+	seen := map[string]bool{}
+	var tables []string
+	for _, ef := range em.Files {
+		if fn(ef) && !seen[ef.TableName] {
+			seen[ef.TableName] = true
+			tables = append(tables, ef.TableName)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
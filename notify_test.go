@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	defer func(webhooks []string, slack string) {
+		notifyConfig.webhooks, notifyConfig.slackWebhook = webhooks, slack
+	}(notifyConfig.webhooks, notifyConfig.slackWebhook)
+
+	received := map[string]map[string]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		received[r.URL.Path] = body
+	}))
+	defer srv.Close()
+
+	notifyConfig.webhooks = []string{srv.URL + "/hook"}
+	notifyConfig.slackWebhook = srv.URL + "/slack"
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	em := &ExportManifest{
+		Period:  p,
+		Network: "mainnet",
+		Files: []*ExportFile{
+			{TableName: "messages", Shipped: true},
+			{TableName: "block_headers", Shipped: true},
+			{TableName: "messages", Shipped: true},
+		},
+	}
+	notifyPeriodShipped(context.Background(), em)
+
+	hook := received["/hook"]
+	if hook["event"] != EventPeriodShipped || hook["period"] != "2021-08-02" {
+		t.Errorf("unexpected webhook payload: %v", hook)
+	}
+	if tables, _ := hook["tables"].([]interface{}); len(tables) != 2 || tables[0] != "block_headers" {
+		t.Errorf("unexpected tables: %v", hook["tables"])
+	}
+	if text, _ := received["/slack"]["text"].(string); text == "" {
+		t.Errorf("expected slack message text, got %v", received["/slack"])
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	DefaultObjectStorePartSize = 64 << 20 // 64 MiB
+	MinObjectStorePartSize     = 5 << 20  // smallest part other than the last accepted by S3 multipart uploads
+
+	gcsEndpoint = "https://storage.googleapis.com"
+)
+
+// objectStoreShipper ships files to an S3 compatible object store. Google Cloud Storage is accessed through its S3
+// compatible XML API using HMAC keys.
+type objectStoreShipper struct {
+	location string // the ship path, for logging
+	bucket   string
+	prefix   string
+	partSize int64
+	client   *minio.Client
+	limits   *shipLimits // bandwidth and concurrency limits of the destination, nil if unlimited
+}
+
+var _ Shipper = (*objectStoreShipper)(nil)
+
+func newObjectStoreShipper(u *url.URL) (*objectStoreShipper, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("ship path %q has no bucket", u.String())
+	}
+	if objectStoreConfig.accessKey == "" || objectStoreConfig.secretKey == "" {
+		return nil, fmt.Errorf("shipping to %s requires an object store access key and secret key", u.Scheme)
+	}
+
+	region := objectStoreConfig.region
+	endpoint := objectStoreConfig.endpoint
+	switch u.Scheme {
+	case "s3":
+		if region == "" {
+			region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		}
+	case "gs":
+		if region == "" {
+			region = "auto"
+		}
+		if endpoint == "" {
+			endpoint = gcsEndpoint
+		}
+	default:
+		return nil, fmt.Errorf("unsupported object store scheme %q", u.Scheme)
+	}
+
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store endpoint: %w", err)
+	}
+	if ep.Scheme != "http" && ep.Scheme != "https" {
+		return nil, fmt.Errorf("invalid object store endpoint %q, expected an http or https url", endpoint)
+	}
+	if strings.Trim(ep.Path, "/") != "" {
+		return nil, fmt.Errorf("invalid object store endpoint %q, the endpoint may not have a path", endpoint)
+	}
+
+	lookup := minio.BucketLookupDNS
+	if objectStoreConfig.pathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(ep.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(objectStoreConfig.accessKey, objectStoreConfig.secretKey, objectStoreConfig.sessionToken),
+		Secure:       ep.Scheme == "https",
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new object store client: %w", err)
+	}
+
+	partSize := objectStoreConfig.partSize
+	if partSize == 0 {
+		partSize = DefaultObjectStorePartSize
+	}
+
+	return &objectStoreShipper{
+		location: u.String(),
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		partSize: partSize,
+		client:   client,
+		limits:   shipLimitsFor(u.String()),
+	}, nil
+}
+
+func (s *objectStoreShipper) String() string {
+	return s.location
+}
+
+func (s *objectStoreShipper) Stat(ctx context.Context, path string) (*ObjectInfo, error) {
+	key := joinObjectKey(s.prefix, path)
+	oi, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, objectStoreError(err, "head "+key)
+	}
+	return &ObjectInfo{Size: oi.Size, ModTime: oi.LastModified}, nil
+}
+
+func (s *objectStoreShipper) Write(ctx context.Context, path string, data []byte) error {
+	release, err := s.limits.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	key := joinObjectKey(s.prefix, path)
+	if _, err := s.client.PutObject(ctx, s.bucket, key, s.limits.reader(ctx, bytes.NewReader(data)), int64(len(data)), minio.PutObjectOptions{}); err != nil {
+		return objectStoreError(err, "put "+key)
+	}
+	return nil
+}
+
+// Read fetches a small object. Objects larger than the part size are not read.
+func (s *objectStoreShipper) Read(ctx context.Context, path string) ([]byte, error) {
+	key := joinObjectKey(s.prefix, path)
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, objectStoreError(err, "get "+key)
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj, s.partSize+1))
+	if err != nil {
+		return nil, objectStoreError(err, "get "+key)
+	}
+	if int64(len(data)) > s.partSize {
+		return nil, fmt.Errorf("object %s is too large to read", key)
+	}
+	return data, nil
+}
+
+// Put uploads the file, using a multipart upload for files larger than the configured part size. The local file is
+// removed once it has been uploaded.
+func (s *objectStoreShipper) Put(ctx context.Context, path string, src string) error {
+	release, err := s.limits.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	// Parts of an unlimited upload are read from the file and sent in parallel. A bandwidth limited upload is read
+	// through the limit, so its parts are sent one at a time. The client aborts a multipart upload that fails so that
+	// the store does not retain its parts.
+	key := joinObjectKey(s.prefix, path)
+	opts := minio.PutObjectOptions{PartSize: uint64(s.partSize)}
+	if _, err := s.client.PutObject(ctx, s.bucket, key, s.limits.reader(ctx, f), info.Size(), opts); err != nil {
+		return objectStoreError(err, "put "+key)
+	}
+
+	f.Close()
+	if err := os.Remove(src); err != nil {
+		logger.Errorw("failed to remove staged file", "error", err, "file", src)
+	}
+	return nil
+}
+
+// objectStoreError describes a failed request, including the error code returned by the store if there is one. Missing
+// objects are reported as errors satisfying errors.Is(err, os.ErrNotExist).
+func objectStoreError(err error, op string) error {
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && resp.Code != "NoSuchBucket":
+		return fmt.Errorf("%s: %w", op, os.ErrNotExist)
+	case resp.Code != "":
+		return fmt.Errorf("%s: unexpected status %d: %s: %s", op, resp.StatusCode, resp.Code, resp.Message)
+	default:
+		return fmt.Errorf("%s: %w", op, err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeObjectStore is a minimal S3 server holding objects in memory, supporting the requests made by
+// objectStoreShipper including multipart uploads.
+type fakeObjectStore struct {
+	mu         sync.Mutex
+	objects    map[string][]byte         // keyed by bucket/key
+	uploads    map[string]map[int][]byte // parts of in progress uploads, keyed by upload id
+	uploadKeys map[string]string         // bucket/key of in progress uploads, keyed by upload id
+	completed  map[string]int            // number of parts in completed multipart uploads, keyed by bucket/key
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{
+		objects:    map[string][]byte{},
+		uploads:    map[string]map[int][]byte{},
+		uploadKeys: map[string]string{},
+		completed:  map[string]int{},
+	}
+}
+
+func (s *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		s.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	// Path style requests only; the bucket is the first path segment
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.Itoa(len(s.uploadKeys) + 1)
+		s.uploads[id] = map[int][]byte{}
+		s.uploadKeys[id] = name
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		data, err := readObjectBody(r)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		parts[n] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, n))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		id := q.Get("uploadId")
+		parts, ok := s.uploads[id]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		s.objects[s.uploadKeys[id]] = data
+		s.completed[s.uploadKeys[id]] = len(parts)
+		delete(s.uploads, id)
+		bucketKey := strings.SplitN(s.uploadKeys[id], "/", 2)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"complete"</ETag></CompleteMultipartUploadResult>`, bucketKey[0], bucketKey[1])
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := readObjectBody(r)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[name] = data
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := s.objects[name]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", "Mon, 02 Aug 2021 00:00:00 GMT")
+		w.Header().Set("ETag", `"object"`)
+		if r.Method == http.MethodGet {
+			w.Write(data) // nolint: errcheck
+		}
+	default:
+		s.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeObjectStore) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct { // nolint: errcheck
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+// readObjectBody reads a request body, decoding the aws-chunked encoding used for streaming signed uploads.
+func readObjectBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(line, ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func testObjectStoreShipper(t *testing.T, store *fakeObjectStore, shipPath string, partSize int64) *objectStoreShipper {
+	t.Helper()
+	srv := httptest.NewServer(store)
+	t.Cleanup(srv.Close)
+
+	saved := objectStoreConfig
+	t.Cleanup(func() { objectStoreConfig = saved })
+	objectStoreConfig.endpoint = srv.URL
+	objectStoreConfig.region = "us-east-1"
+	objectStoreConfig.accessKey = "access"
+	objectStoreConfig.secretKey = "secret"
+	objectStoreConfig.pathStyle = true
+	objectStoreConfig.partSize = partSize
+
+	u, err := url.Parse(shipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newObjectStoreShipper(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestObjectStoreShipper(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeObjectStore()
+	s := testObjectStoreShipper(t, store, "s3://archive/mainnet/", MinObjectStorePartSize)
+
+	if _, err := s.Stat(ctx, "2021/08/02/messages.csv.gz"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v for a missing object, wanted os.ErrNotExist", err)
+	}
+	if _, err := s.Read(ctx, "2021/08/02/messages.csv.gz"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v reading a missing object, wanted os.ErrNotExist", err)
+	}
+
+	if err := s.Write(ctx, "2021/08/02/manifest.json", []byte(`{"network":"mainnet"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(store.objects["archive/mainnet/2021/08/02/manifest.json"]); got != `{"network":"mainnet"}` {
+		t.Errorf("got stored object %q", got)
+	}
+	got, err := s.Read(ctx, "2021/08/02/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"network":"mainnet"}` {
+		t.Errorf("got object %q", got)
+	}
+	info, err := s.Stat(ctx, "2021/08/02/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(got)) || info.ModTime.IsZero() {
+		t.Errorf("got object info %+v", info)
+	}
+
+	// Files smaller than the part size are uploaded in a single request and removed once shipped
+	src := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(src, []byte("1005360,messages\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "2021/08/02/messages.csv.gz", src); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(store.objects["archive/mainnet/2021/08/02/messages.csv.gz"]); got != "1005360,messages\n" {
+		t.Errorf("got stored object %q", got)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("shipped file was not removed")
+	}
+}
+
+func TestObjectStoreShipperMultipart(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeObjectStore()
+	s := testObjectStoreShipper(t, store, "s3://archive", MinObjectStorePartSize)
+
+	data := bytes.Repeat([]byte("1005360,bafy2bzacea,messages\n"), (11<<20)/29)
+	src := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(src, data, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "2021/08/02/messages.csv.gz", src); err != nil {
+		t.Fatal(err)
+	}
+
+	if parts := store.completed["archive/2021/08/02/messages.csv.gz"]; parts != 3 {
+		t.Errorf("got %d parts, wanted 3", parts)
+	}
+	if !bytes.Equal(store.objects["archive/2021/08/02/messages.csv.gz"], data) {
+		t.Errorf("multipart object does not match the shipped file")
+	}
+	if len(store.uploads) != 0 {
+		t.Errorf("%d uploads left incomplete", len(store.uploads))
+	}
+
+	// Objects larger than a part are not read into memory
+	if _, err := s.Read(ctx, "2021/08/02/messages.csv.gz"); err == nil {
+		t.Errorf("expected an error reading an object larger than the part size")
+	}
+}
+
+func TestNewObjectStoreShipper(t *testing.T) {
+	saved := objectStoreConfig
+	defer func() { objectStoreConfig = saved }()
+	objectStoreConfig.accessKey, objectStoreConfig.secretKey = "access", "secret"
+
+	testCases := []struct {
+		shipPath string
+		endpoint string
+		err      bool
+	}{
+		{shipPath: "s3://archive/mainnet"},
+		{shipPath: "gs://archive"},
+		{shipPath: "s3:///mainnet", err: true},
+		{shipPath: "s3://archive", endpoint: "https://minio.example.com/s3", err: true},
+		{shipPath: "s3://archive", endpoint: "ftp://minio.example.com", err: true},
+	}
+	for _, tc := range testCases {
+		objectStoreConfig.endpoint = tc.endpoint
+		u, _ := url.Parse(tc.shipPath)
+		_, err := newObjectStoreShipper(u)
+		if (err != nil) != tc.err {
+			t.Errorf("%s %s: got error %v, wanted error %v", tc.shipPath, tc.endpoint, err, tc.err)
+		}
+	}
+}
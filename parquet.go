@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Parquet files are written with parquet-go. Every column is written as an optional column in snappy compressed
+// pages.
+
+// Parquet physical types
+const (
+	parquetBoolean   = parquet.Type_BOOLEAN
+	parquetInt64     = parquet.Type_INT64
+	parquetDouble    = parquet.Type_DOUBLE
+	parquetByteArray = parquet.Type_BYTE_ARRAY
+)
+
+// Parquet converted types
+const (
+	parquetNoConvertedType = parquet.ConvertedType(-1)
+	parquetUTF8            = parquet.ConvertedType_UTF8
+	parquetTimestampMicros = parquet.ConvertedType_TIMESTAMP_MICROS
+	parquetUint64          = parquet.ConvertedType_UINT_64
+	parquetJSON            = parquet.ConvertedType_JSON
+)
+
+const (
+	parquetPageSize       = 1 << 20  // uncompressed size at which a data page is written
+	parquetRowGroupSize   = 64 << 20 // uncompressed size at which a row group is written
+	parquetParallelism    = 4        // goroutines encoding the pages of a row group
+	parquetNullCSVValue   = "NULL"   // value lily writes for nil values
+	parquetCreatedByLabel = "sentinel-archiver"
+)
+
+// parquetColumn describes how a csv column of a lily model is written to parquet.
+type parquetColumn struct {
+	Name          string
+	Type          parquet.Type
+	ConvertedType parquet.ConvertedType
+	Nullable      bool // whether lily writes nil values as NULL
+}
+
+// metadata returns the column in the schema definition format of parquet-go.
+func (c parquetColumn) metadata() string {
+	md := "name=" + c.Name + ", type=" + c.Type.String() + ", repetitiontype=OPTIONAL"
+	if c.ConvertedType != parquetNoConvertedType {
+		md += ", convertedtype=" + c.ConvertedType.String()
+	}
+	return md
+}
+
+// value converts a csv formatted value to the value parquet-go writes for the column, nil for a null value.
+func (c parquetColumn) value(s string) (interface{}, error) {
+	if c.Nullable && s == parquetNullCSVValue {
+		return nil, nil
+	}
+
+	switch c.Type {
+	case parquetBoolean:
+		return strconv.ParseBool(s)
+	case parquetInt64:
+		switch c.ConvertedType {
+		case parquetTimestampMicros:
+			ts, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, err
+			}
+			return ts.UnixMicro(), nil
+		case parquetUint64:
+			u, err := strconv.ParseUint(s, 10, 64)
+			return int64(u), err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case parquetDouble:
+		return strconv.ParseFloat(s, 64)
+	}
+	return s, nil
+}
+
+// parquetColumnsForModel derives the parquet schema of a table from its lily model.
+func parquetColumnsForModel(v interface{}) ([]parquetColumn, error) {
+	if td, ok := v.(*TableDescriptor); ok {
+		var cols []parquetColumn
+		for _, c := range td.Columns {
+			cols = append(cols, parquetColumnForDescriptor(c))
+		}
+		return cols, nil
+	}
+
+	q := orm.NewQuery(nil, v)
+	m := q.TableModel().Table()
+	if len(m.Fields) == 0 {
+		return nil, fmt.Errorf("invalid table model: no fields found")
+	}
+
+	timeType := reflect.TypeOf(time.Time{})
+
+	var cols []parquetColumn
+	for _, fld := range m.Fields {
+		col := parquetColumn{Name: fld.SQLName, ConvertedType: parquetNoConvertedType}
+
+		t := fld.Type
+		col.Nullable = modelFieldIsNullable(t)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch {
+		case fld.SQLType == "json" || fld.SQLType == "jsonb":
+			col.Type, col.ConvertedType = parquetByteArray, parquetJSON
+		case t == timeType:
+			col.Type, col.ConvertedType = parquetInt64, parquetTimestampMicros
+		default:
+			switch t.Kind() {
+			case reflect.Bool:
+				col.Type = parquetBoolean
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+				col.Type = parquetInt64
+			case reflect.Uint, reflect.Uint64:
+				col.Type, col.ConvertedType = parquetInt64, parquetUint64
+			case reflect.Float32, reflect.Float64:
+				col.Type = parquetDouble
+			default:
+				// Strings and arbitrary precision numbers, which are kept as text to preserve their precision
+				col.Type, col.ConvertedType = parquetByteArray, parquetUTF8
+			}
+		}
+
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// parquetColumnForDescriptor returns the parquet column for a column of a table described by a table registry, whose
+// type is given by its type in lily's database and the type of its field in lily's model.
+func parquetColumnForDescriptor(c *ColumnDescriptor) parquetColumn {
+	col := parquetColumn{Name: c.Name, ConvertedType: parquetNoConvertedType, Nullable: c.Nullable}
+	goType := strings.TrimPrefix(c.GoType, "*")
+	switch sqlType := strings.ToLower(c.Type); {
+	case sqlType == "json" || sqlType == "jsonb":
+		col.Type, col.ConvertedType = parquetByteArray, parquetJSON
+	case strings.HasPrefix(sqlType, "timestamp") || goType == "time.Time":
+		col.Type, col.ConvertedType = parquetInt64, parquetTimestampMicros
+	case goType == "bool" || sqlType == "boolean":
+		col.Type = parquetBoolean
+	case goType == "uint64" || goType == "uint":
+		col.Type, col.ConvertedType = parquetInt64, parquetUint64
+	case goType == "float64" || goType == "float32" || sqlType == "double precision" || sqlType == "real":
+		col.Type = parquetDouble
+	case strings.HasPrefix(goType, "int") || strings.HasPrefix(goType, "uint") || sqlType == "bigint" || sqlType == "integer" || sqlType == "smallint":
+		col.Type = parquetInt64
+	default:
+		col.Type, col.ConvertedType = parquetByteArray, parquetUTF8
+	}
+	return col
+}
+
+// convertCSVToParquet converts a lily csv file read from r to parquet written to w using the model of the export
+// file's table as the schema.
+func convertCSVToParquet(ef *ExportFile, r io.Reader, w io.Writer) error {
+	t, ok := TablesByName[ef.TableName]
+	if !ok {
+		return fmt.Errorf("unknown table %q", ef.TableName)
+	}
+	cols, err := parquetColumnsForModel(t.Model)
+	if err != nil {
+		return fmt.Errorf("parquet schema: %w", err)
+	}
+
+	pw, err := newParquetWriter(w, cols, provenanceForFile(ef).parquetKeyValues())
+	if err != nil {
+		return err
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(cols)
+	cr.ReuseRecord = true
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read csv: %w", err)
+		}
+		if err := pw.WriteRow(row); err != nil {
+			return err
+		}
+	}
+
+	return pw.Close()
+}
+
+// parquetWriter writes rows of csv formatted values as a parquet file.
+type parquetWriter struct {
+	cols []parquetColumn
+	w    *writer.CSVWriter
+}
+
+// newParquetWriter returns a writer of a parquet file with the columns and key value metadata to w.
+func newParquetWriter(w io.Writer, cols []parquetColumn, keyValues []*parquet.KeyValue) (*parquetWriter, error) {
+	md := make([]string, len(cols))
+	for i, c := range cols {
+		md[i] = c.metadata()
+	}
+	cw, err := writer.NewCSVWriterFromWriter(md, w, parquetParallelism)
+	if err != nil {
+		return nil, fmt.Errorf("create parquet writer: %w", err)
+	}
+	cw.PageSize = parquetPageSize
+	cw.RowGroupSize = parquetRowGroupSize
+	cw.CompressionType = parquet.CompressionCodec_SNAPPY
+	createdBy := parquetCreatedByLabel + " version " + version
+	cw.Footer.CreatedBy = &createdBy
+	cw.Footer.KeyValueMetadata = keyValues
+	return &parquetWriter{cols: cols, w: cw}, nil
+}
+
+// WriteRow appends a row holding one csv formatted value for each column.
+func (pw *parquetWriter) WriteRow(row []string) error {
+	if len(row) != len(pw.cols) {
+		return fmt.Errorf("row has %d values, expected %d", len(row), len(pw.cols))
+	}
+
+	rec := make([]interface{}, len(row))
+	for i, c := range pw.cols {
+		v, err := c.value(row[i])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c.Name, err)
+		}
+		rec[i] = v
+	}
+	return pw.w.Write(rec)
+}
+
+// Close writes any buffered rows and the file footer. It does not close the underlying writer.
+func (pw *parquetWriter) Close() error {
+	return pw.w.WriteStop()
+}
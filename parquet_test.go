@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetColumnsForModel(t *testing.T) {
+	cols, err := parquetColumnsForModel(TablesByName["messages"].Model)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	byName := map[string]parquetColumn{}
+	for _, c := range cols {
+		byName[c.Name] = c
+	}
+	if c := byName["height"]; c.Type != parquetInt64 || c.ConvertedType != parquetNoConvertedType {
+		t.Errorf("got height column %+v, wanted int64", c)
+	}
+	if c := byName["cid"]; c.Type != parquetByteArray || c.ConvertedType != parquetUTF8 {
+		t.Errorf("got cid column %+v, wanted utf8 byte array", c)
+	}
+}
+
+// TestParquetWriter reads the output of the writer back with parquet-go's reader, across several data pages of each
+// column.
+func TestParquetWriter(t *testing.T) {
+	cols := []parquetColumn{
+		{Name: "height", Type: parquetInt64, ConvertedType: parquetNoConvertedType},
+		{Name: "cid", Type: parquetByteArray, ConvertedType: parquetUTF8},
+		{Name: "note", Type: parquetByteArray, ConvertedType: parquetUTF8, Nullable: true},
+		{Name: "ok", Type: parquetBoolean, ConvertedType: parquetNoConvertedType},
+		{Name: "at", Type: parquetInt64, ConvertedType: parquetTimestampMicros},
+		{Name: "ratio", Type: parquetDouble, ConvertedType: parquetNoConvertedType},
+		{Name: "nonce", Type: parquetInt64, ConvertedType: parquetUint64},
+		{Name: "params", Type: parquetByteArray, ConvertedType: parquetJSON, Nullable: true},
+	}
+	const rows = 60000 // enough for the cid column to span several pages
+	row := func(i int) []string {
+		note, params := "NULL", "NULL"
+		if i%3 == 0 {
+			note, params = fmt.Sprintf("note %d", i), fmt.Sprintf(`{"n":%d}`, i)
+		}
+		return []string{
+			strconv.Itoa(1005360 + i),
+			fmt.Sprintf("bafy2bzacea%030d", i),
+			note,
+			strconv.FormatBool(i%7 == 0),
+			time.Unix(1627862400+int64(i)*30, 0).UTC().Format(time.RFC3339),
+			strconv.FormatFloat(float64(i)/4, 'f', -1, 64),
+			strconv.FormatUint(math.MaxUint64-uint64(i), 10),
+			params,
+		}
+	}
+
+	var buf bytes.Buffer
+	table := "messages"
+	pw, err := newParquetWriter(&buf, cols, []*parquet.KeyValue{{Key: ParquetProvenancePrefix + "table", Value: &table}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < rows; i++ {
+		if err := pw.WriteRow(row(i)); err != nil {
+			t.Fatalf("write row %d: %v", i, err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	b := buf.Bytes()
+	if string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		t.Fatalf("missing parquet magic")
+	}
+	pr, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(buf.Bytes()), 1)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if n := pr.GetNumRows(); n != rows {
+		t.Errorf("got %d rows, wanted %d", n, rows)
+	}
+	if kv := pr.Footer.GetKeyValueMetadata(); len(kv) != 1 || kv[0].Key != ParquetProvenancePrefix+"table" || kv[0].GetValue() != "messages" {
+		t.Errorf("got key value metadata %v", kv)
+	}
+	schema := pr.Footer.GetSchema()
+	if len(schema) != len(cols)+1 {
+		t.Fatalf("got %d schema elements, wanted %d", len(schema), len(cols)+1)
+	}
+
+	for ci, c := range cols {
+		el := schema[ci+1]
+		// The reader renames the schema's elements to exported Go names, keeping the names in the file alongside
+		if name := pr.SchemaHandler.GetExName(ci + 1); name != c.Name || el.GetType() != c.Type {
+			t.Errorf("schema element %d: got %s of type %s, wanted column %s", ci, name, el.GetType(), c.Name)
+		}
+		if c.ConvertedType != parquetNoConvertedType && (!el.IsSetConvertedType() || el.GetConvertedType() != c.ConvertedType) {
+			t.Errorf("%s: got converted type %s, wanted %s", c.Name, el.GetConvertedType(), c.ConvertedType)
+		}
+
+		values, _, dls, err := pr.ReadColumnByIndex(int64(ci), rows)
+		if err != nil {
+			t.Fatalf("read %s: %v", c.Name, err)
+		}
+		if len(values) != rows {
+			t.Fatalf("read %d values of %s, wanted %d", len(values), c.Name, rows)
+		}
+		for i, v := range values {
+			want := row(i)[ci]
+			var got string
+			switch x := v.(type) {
+			case nil:
+				if dls[i] != 0 {
+					t.Fatalf("%s row %d: got nil value with definition level %d", c.Name, i, dls[i])
+				}
+				got = parquetNullCSVValue
+			case int64:
+				switch c.ConvertedType {
+				case parquetTimestampMicros:
+					got = time.UnixMicro(x).UTC().Format(time.RFC3339)
+				case parquetUint64:
+					got = strconv.FormatUint(uint64(x), 10)
+				default:
+					got = strconv.FormatInt(x, 10)
+				}
+			case bool:
+				got = strconv.FormatBool(x)
+			case float64:
+				got = strconv.FormatFloat(x, 'f', -1, 64)
+			case string:
+				got = x
+			default:
+				t.Fatalf("%s row %d: unexpected value type %T", c.Name, i, v)
+			}
+			if got != want {
+				t.Fatalf("%s row %d: got %q, wanted %q", c.Name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestParquetWriterRejectsInvalidValues(t *testing.T) {
+	cols := []parquetColumn{{Name: "height", Type: parquetInt64, ConvertedType: parquetNoConvertedType}}
+	pw, err := newParquetWriter(&bytes.Buffer{}, cols, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.WriteRow([]string{"NULL"}); err == nil {
+		t.Errorf("got no error for null value in non-nullable column, wanted one")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Period lengths select how much of the chain each export period covers.
+const (
+	PeriodDay  = "day"  // periods cover a calendar day, the default
+	PeriodHour = "hour" // periods cover an hour, for consumers that need low latency
+	PeriodWeek = "week" // periods cover a calendar week starting on Monday, for archival roll-ups
+
+	secondsInHour = 60 * 60
+)
+
+// PeriodLength is the length of the periods that are exported. Every command reading a ship path must use the same
+// period length since files of one length are not found under another.
+var PeriodLength = PeriodDay
+
+// configurePeriodLength sets the period length, checking that every period starts on an epoch boundary.
+func configurePeriodLength(length string) error {
+	switch length {
+	case "", PeriodDay:
+		PeriodLength = PeriodDay
+	case PeriodHour:
+		if secondsInHour%BlockDelay != 0 {
+			return fmt.Errorf("block delay of %ds does not divide an hour into a whole number of epochs", BlockDelay)
+		}
+		PeriodLength = PeriodHour
+	case PeriodWeek:
+		PeriodLength = PeriodWeek
+	default:
+		return fmt.Errorf("invalid period length %q", length)
+	}
+	return nil
+}
+
+// periodStartAfter returns the start of the period following the one that holds t.
+func periodStartAfter(t time.Time) time.Time {
+	t = t.UTC()
+	switch PeriodLength {
+	case PeriodHour:
+		return t.Truncate(time.Hour).Add(time.Hour)
+	case PeriodWeek:
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return midnight.AddDate(0, 0, 7-daysSinceMonday)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+}
+
+// periodName names a period of the given length by the date and hour it starts at. Daily periods are named by their
+// date, hourly periods by their date and hour, such as 2021-08-02T13, and weekly periods by their ISO week, such as
+// 2021-W31. An empty length is a day.
+func periodName(length string, d Date, hour int) string {
+	switch length {
+	case PeriodHour:
+		return fmt.Sprintf("%sT%02d", d.String(), hour)
+	case PeriodWeek:
+		year, week := d.Time().ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	}
+	return d.String()
+}
+
+// periodDir returns the directory, relative to a table's directory, holding the files of periods of the given length
+// that start on a date. Daily files are held in a directory for their year, hourly and weekly files are held beneath
+// an hourly or weekly directory so that the granularity of the files is clear from their path. Weekly files use the
+// year of their ISO week. An empty length is a day.
+func periodDir(length string, d Date) string {
+	switch length {
+	case PeriodHour:
+		return filepath.Join("hourly", strconv.Itoa(d.Year))
+	case PeriodWeek:
+		year, _ := d.Time().ISOWeek()
+		return filepath.Join("weekly", strconv.Itoa(year))
+	}
+	return strconv.Itoa(d.Year)
+}
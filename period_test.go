@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExportPeriodLengths(t *testing.T) {
+	testCases := []struct {
+		length    string
+		wantFirst ExportPeriod
+		wantNext  ExportPeriod
+		wantName  string
+		date      Date
+		wantDate  ExportPeriod
+		wantPath  string
+	}{
+		{
+			length:    PeriodDay,
+			wantFirst: ExportPeriod{Date: Date{2020, 8, 24}, StartHeight: 0, EndHeight: 239},
+			wantNext:  ExportPeriod{Date: Date{2020, 8, 25}, StartHeight: 240, EndHeight: 3119},
+			wantName:  "2020-08-25",
+			date:      Date{2020, 8, 26},
+			wantDate:  ExportPeriod{Date: Date{2020, 8, 26}, StartHeight: 3120, EndHeight: 5999},
+			wantPath:  "mainnet/csv/1/messages/2020/messages-2020-08-25.csv.gz",
+		},
+		{
+			length:    PeriodHour,
+			wantFirst: ExportPeriod{Date: Date{2020, 8, 24}, Hour: 22, StartHeight: 0, EndHeight: 119},
+			wantNext:  ExportPeriod{Date: Date{2020, 8, 24}, Hour: 23, StartHeight: 120, EndHeight: 239},
+			wantName:  "2020-08-24T23",
+			date:      Date{2020, 8, 26},
+			wantDate:  ExportPeriod{Date: Date{2020, 8, 26}, Hour: 0, StartHeight: 3120, EndHeight: 3239},
+			wantPath:  "mainnet/csv/1/messages/hourly/2020/messages-2020-08-24T23.csv.gz",
+		},
+		{
+			length:    PeriodWeek,
+			wantFirst: ExportPeriod{Date: Date{2020, 8, 24}, StartHeight: 0, EndHeight: 17519},
+			wantNext:  ExportPeriod{Date: Date{2020, 8, 31}, StartHeight: 17520, EndHeight: 37679},
+			wantName:  "2020-W36",
+			date:      Date{2020, 9, 2},
+			wantDate:  ExportPeriod{Date: Date{2020, 8, 31}, StartHeight: 17520, EndHeight: 37679},
+			wantPath:  "mainnet/csv/1/messages/weekly/2020/messages-2020-W36.csv.gz",
+		},
+	}
+
+	defer configurePeriodLength(PeriodDay)
+	for _, tc := range testCases {
+		t.Run(tc.length, func(t *testing.T) {
+			if err := configurePeriodLength(tc.length); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			first := firstExportPeriod(MainnetGenesisTs)
+			if first != tc.wantFirst {
+				t.Errorf("got first period %+v, wanted %+v", first, tc.wantFirst)
+			}
+			next := first.Next()
+			if next != tc.wantNext {
+				t.Errorf("got next period %+v, wanted %+v", next, tc.wantNext)
+			}
+			if next.String() != tc.wantName {
+				t.Errorf("got name %q, wanted %q", next.String(), tc.wantName)
+			}
+
+			p, err := exportPeriodForDate(tc.date, MainnetGenesisTs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p != tc.wantDate {
+				t.Errorf("got period %+v for %s, wanted %+v", p, tc.date.String(), tc.wantDate)
+			}
+
+			ef := &ExportFile{Date: next.Date, Hour: next.Hour, Length: next.Length(), Network: "mainnet", TableName: "messages", Schema: 1, Format: "csv", Compression: CompressionByName["gz"]}
+			if ef.Path() != tc.wantPath {
+				t.Errorf("got path %q, wanted %q", ef.Path(), tc.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// PeriodPlan describes the work needed to complete the export of a single period.
+type PeriodPlan struct {
+	Period    ExportPeriod
+	Tables    []string // tables with files still to be shipped
+	Annotated []string // tables skipped because they are annotated as known bad
+	Tasks     []string // tasks run by the walk
+	Resume    string   // name of a completed walk whose output would be shipped instead of running a walk
+}
+
+// Epochs returns the number of epochs covered by the walk for the period.
+func (pp *PeriodPlan) Epochs() int64 {
+	return pp.Period.EndHeight - pp.Period.StartHeight + 1
+}
+
+// planForManifest returns the plan for the export of a manifest, or nil if the manifest has no unshipped files.
+func planForManifest(em *ExportManifest) *PeriodPlan {
+	if !em.HasUnshippedFiles() {
+		return nil
+	}
+
+	pp := &PeriodPlan{Period: em.Period}
+	pending := map[string]bool{}
+	annotated := map[string]bool{}
+	for _, ef := range em.Files {
+		if ef.NeedsShipping() {
+			pending[ef.TableName] = true
+		} else if !ef.Shipped {
+			annotated[ef.TableName] = true
+		}
+	}
+	for table := range pending {
+		pp.Tables = append(pp.Tables, table)
+	}
+	for table := range annotated {
+		pp.Annotated = append(pp.Annotated, table)
+	}
+	pp.Tasks = walkTasksForManifest(em)
+
+	sort.Strings(pp.Tables)
+	sort.Strings(pp.Annotated)
+	sort.Strings(pp.Tasks)
+	return pp
+}
+
+var planCommand = &cli.Command{
+	Name:   "plan",
+	Usage:  "Show the periods that are missing between two dates and the walks that would export them, without running any.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		stateFlags,
+		objectStoreFlags,
+		publishedFlags,
+		tableConfigFlags,
+		exportFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "from-date",
+				Usage:    "First date to plan, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "to-date",
+				Usage:    "Last date to plan, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.Int64Flag{
+				Name:    "min-height",
+				EnvVars: []string{"ARCHIVER_MIN_HEIGHT"},
+				Usage:   "Minimum height that should be exported. Periods starting before this height are not planned.",
+				Value:   defaultMinHeight,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := cc.Context
+
+		fromDate, err := DateFromString(cc.String("from-date"))
+		if err != nil {
+			return fmt.Errorf("invalid from date: %w", err)
+		}
+		toDate, err := DateFromString(cc.String("to-date"))
+		if err != nil {
+			return fmt.Errorf("invalid to date: %w", err)
+		}
+		if fromDate.After(toDate) {
+			return fmt.Errorf("from date must not be after to date")
+		}
+
+		allowedTables, err := allowedTablesFromFlags(cc)
+		if err != nil {
+			return err
+		}
+		allowedTables = currentTableConfig(networkConfig.name).FilterTables(allowedTables)
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+
+		p, err := exportPeriodForDate(fromDate, networkConfig.genesisTs)
+		if err != nil {
+			return fmt.Errorf("invalid from date: %w", err)
+		}
+
+		var periods, walks int
+		var epochs int64
+		for ; !p.Date.After(toDate); p = p.Next() {
+			if p.StartHeight < cc.Int64("min-height") {
+				continue
+			}
+
+			em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, allowedTables, targets)
+			if err != nil {
+				return fmt.Errorf("build manifest for period: %w", err)
+			}
+			markPublishedFiles(ctx, em)
+			pp := planForManifest(em)
+			if pp == nil {
+				continue
+			}
+			if wi, err := resumableWalk(em); err != nil {
+				logger.Errorw("failed to check for completed walk", "error", err, "date", p.Date.String())
+			} else if wi != nil {
+				pp.Resume = wi.Name
+			}
+
+			periods++
+			fmt.Printf("%s %d-%d\n", p.Date.String(), p.StartHeight, p.EndHeight)
+			fmt.Printf("  tables: %s\n", strings.Join(pp.Tables, ","))
+			if len(pp.Annotated) > 0 {
+				fmt.Printf("  annotated: %s\n", strings.Join(pp.Annotated, ","))
+			}
+			if pp.Resume != "" {
+				fmt.Printf("  ship output of completed walk %s\n", pp.Resume)
+				continue
+			}
+
+			walks++
+			epochs += pp.Epochs()
+			fmt.Printf("  walk: %d-%d (%d epochs)\n", p.StartHeight, p.EndHeight, pp.Epochs())
+			fmt.Printf("  tasks: %s\n", strings.Join(pp.Tasks, ","))
+			if earliest := HeightToUnix(p.EndHeight+ExportDelay, networkConfig.genesisTs); earliest > time.Now().Unix() {
+				fmt.Printf("  not final until %s\n", time.Unix(earliest, 0).UTC().Format(time.RFC3339))
+			}
+		}
+
+		fmt.Printf("%d periods missing, %d walks covering %d epochs\n", periods, walks, epochs)
+		return nil
+	},
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lily/schedule"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// DefaultProgressInterval is how often the progress of a running walk is read from its processing reports
+const DefaultProgressInterval = time.Minute
+
+// WalkProgress is the progress of a running walk, reported by the status API.
+type WalkProgress struct {
+	Walk    string             `json:"walk"`
+	JobID   schedule.JobID     `json:"job_id"`
+	From    int64              `json:"from"`
+	To      int64              `json:"to"`
+	Tasks   map[string]float64 `json:"tasks"` // percentage of the walk's heights reported by each task
+	Started time.Time          `json:"started"`
+	Updated time.Time          `json:"updated,omitempty"`
+}
+
+// runningWalks holds the progress of every walk being waited on, keyed by walk name.
+var runningWalks = struct {
+	sync.Mutex
+	walks map[string]*WalkProgress
+}{walks: map[string]*WalkProgress{}}
+
+// currentWalkProgress returns a copy of the progress of every running walk, ordered by walk name.
+func currentWalkProgress() []WalkProgress {
+	runningWalks.Lock()
+	defer runningWalks.Unlock()
+	var wps []WalkProgress
+	for _, wp := range runningWalks.walks {
+		c := *wp
+		c.Tasks = map[string]float64{}
+		for task, pct := range wp.Tasks {
+			c.Tasks[task] = pct
+		}
+		wps = append(wps, c)
+	}
+	sort.Slice(wps, func(a, b int) bool { return wps[a].Walk < wps[b].Walk })
+	return wps
+}
+
+// trackWalkProgress reports the progress of a walk at the progress interval until the returned function is called.
+// Progress is read from the processing reports written by the walk, so each task's percentage is the fraction of the
+// walk's heights that the task has reported on. Null rounds are only reported by the consensus task, so other tasks
+// may stay short of 100% until the walk completes.
+func trackWalkProgress(ctx context.Context, wi WalkInfo, jobID schedule.JobID, from, to int64, tasks []string, ll basicLogger) func() {
+	wp := &WalkProgress{
+		Walk:    wi.Name,
+		JobID:   jobID,
+		From:    from,
+		To:      to,
+		Tasks:   map[string]float64{},
+		Started: time.Now().UTC(),
+	}
+	for _, task := range tasks {
+		wp.Tasks[task] = 0
+	}
+	runningWalks.Lock()
+	runningWalks.walks[wi.Name] = wp
+	runningWalks.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		update := func(ctx context.Context) (bool, error) {
+			progress, err := walkProgress(wi.WalkFile(ProcessingReportsTable), from, to, tasks)
+			if err != nil {
+				ll.Debugw("failed to read walk progress", "error", err, "walk", wi.Name)
+				return false, nil
+			}
+
+			runningWalks.Lock()
+			for task, pct := range progress {
+				if pct > wp.Tasks[task] {
+					exportProgress.Touch()
+					break
+				}
+			}
+			wp.Tasks = progress
+			wp.Updated = time.Now().UTC()
+			runningWalks.Unlock()
+
+			kvs := []interface{}{"walk", wi.Name, "job_id", jobID}
+			for _, task := range tasks {
+				kvs = append(kvs, task, fmt.Sprintf("%.1f%%", progress[task]))
+			}
+			ll.Infow("walk progress", kvs...)
+			recordWalkProgress(ctx, progress)
+			return false, nil
+		}
+		WaitUntil(ctx, update, DefaultProgressInterval, DefaultProgressInterval)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		runningWalks.Lock()
+		delete(runningWalks.walks, wi.Name)
+		runningWalks.Unlock()
+	}
+}
+
+// walkProgress reads a walk's processing reports and returns the percentage of the heights between from and to,
+// inclusive, that each task has reported on. A reports file that has not been created yet shows no progress and a
+// partially written final row is ignored.
+func walkProgress(path string, from, to int64, tasks []string) (map[string]float64, error) {
+	progress := map[string]float64{}
+	seen := map[string]map[int64]bool{}
+	for _, task := range tasks {
+		progress[task] = 0
+		seen[task] = map[int64]bool{}
+	}
+	if to < from {
+		return progress, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return progress, nil
+		}
+		return nil, fmt.Errorf("read processing reports: %w", err)
+	}
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("processing reports: read: %w", err)
+		}
+		if len(row) < 4 {
+			continue
+		}
+		s, wanted := seen[row[3]]
+		if !wanted {
+			continue
+		}
+		height, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil || height < from || height > to {
+			continue
+		}
+		s[height] = true
+	}
+
+	total := float64(to - from + 1)
+	for task, s := range seen {
+		progress[task] = float64(len(s)) * 100 / total
+	}
+	return progress, nil
+}
+
+// recordWalkProgress records the percentage complete of each task of a running walk.
+func recordWalkProgress(ctx context.Context, progress map[string]float64) {
+	for task, pct := range progress {
+		err := stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(taskTagKey, task)}, walkTaskProgressMeasure.M(pct))
+		if err != nil {
+			logger.Errorw("failed to record walk progress metrics", "error", err, "task", task)
+		}
+	}
+}
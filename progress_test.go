@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "walk-visor_processing_reports.csv")
+
+	got, err := walkProgress(path, 100, 103, []string{"blocks", "messages"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := map[string]float64{"blocks": 0, "messages": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v before reports were written, wanted %v", got, want)
+	}
+
+	reports := "" +
+		"103,stateroot,0,blocks,2021-08-02T00:00:00Z,2021-08-02T00:00:01Z,OK,NULL,NULL\n" +
+		"102,stateroot,0,blocks,2021-08-02T00:00:00Z,2021-08-02T00:00:01Z,OK,NULL,NULL\n" +
+		"102,stateroot,0,blocks,2021-08-02T00:00:00Z,2021-08-02T00:00:01Z,OK,NULL,NULL\n" +
+		"99,stateroot,0,blocks,2021-08-02T00:00:00Z,2021-08-02T00:00:01Z,OK,NULL,NULL\n" +
+		"103,stateroot,0,messages,2021-08-02T00:00:00Z,2021-08-02T00:00:01Z,ERROR,NULL,failed\n" +
+		"103,stateroot,0,consensus,2021-08-02T00:00:00Z,2021-08-02T00:00:01Z,OK,NULL,NULL\n" +
+		"101,stateroot,0,bl" // partially written row
+	if err := os.WriteFile(path, []byte(reports), 0o644); err != nil {
+		t.Fatalf("write reports: %v", err)
+	}
+
+	got, err = walkProgress(path, 100, 103, []string{"blocks", "messages"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := map[string]float64{"blocks": 50, "messages": 25}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// CSVProvenancePrefix begins the comment line holding the provenance of a csv file, written as the first line of the
+// file when --csv-provenance is set.
+const CSVProvenancePrefix = "#sentinel-archiver "
+
+// ParquetProvenancePrefix begins the keys of the provenance held in the key value metadata of parquet files.
+const ParquetProvenancePrefix = "sentinel_archiver."
+
+// FileProvenance records where a shipped file came from. It is embedded in shipped files so that their origin is not
+// lost when they are copied out of the archive's directory structure.
+type FileProvenance struct {
+	Network     string `json:"network"`
+	Table       string `json:"table"`
+	Schema      int    `json:"schema"`
+	StartHeight int64  `json:"start_height"`
+	EndHeight   int64  `json:"end_height"`
+	Version     string `json:"archiver_version"`
+	GitCommit   string `json:"archiver_commit"`
+}
+
+// provenanceForFile returns the provenance of an export file, which covers the heights of its part for sharded files.
+func provenanceForFile(ef *ExportFile) FileProvenance {
+	bi := currentBuildInfo()
+	return FileProvenance{
+		Network:     ef.Network,
+		Table:       ef.TableName,
+		Schema:      ef.Schema,
+		StartHeight: ef.StartHeight,
+		EndHeight:   ef.EndHeight,
+		Version:     bi.Version,
+		GitCommit:   bi.GitCommit,
+	}
+}
+
+// csvLine returns the provenance as a csv comment line, including the terminating newline.
+func (p FileProvenance) csvLine() string {
+	data, _ := json.Marshal(p)
+	return CSVProvenancePrefix + string(data) + "\n"
+}
+
+// parquetKeyValues returns the provenance as parquet key value metadata.
+func (p FileProvenance) parquetKeyValues() []*parquet.KeyValue {
+	kv := func(key, value string) *parquet.KeyValue {
+		return &parquet.KeyValue{Key: ParquetProvenancePrefix + key, Value: &value}
+	}
+	return []*parquet.KeyValue{
+		kv("network", p.Network),
+		kv("table", p.Table),
+		kv("schema", strconv.Itoa(p.Schema)),
+		kv("start_height", strconv.FormatInt(p.StartHeight, 10)),
+		kv("end_height", strconv.FormatInt(p.EndHeight, 10)),
+		kv("archiver_version", p.Version),
+		kv("archiver_commit", p.GitCommit),
+	}
+}
+
+// readCSVProvenance reads the provenance comment line from the start of a csv file, if it has one, leaving the reader
+// positioned at the first row. It returns nil if the file has no provenance line.
+func readCSVProvenance(br *bufio.Reader) (*FileProvenance, error) {
+	prefix, err := br.Peek(len(CSVProvenancePrefix))
+	if err != nil || string(prefix) != CSVProvenancePrefix {
+		return nil, nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read provenance: %w", err)
+	}
+
+	var p FileProvenance
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, CSVProvenancePrefix)), &p); err != nil {
+		return nil, fmt.Errorf("decode provenance: %w", err)
+	}
+	return &p, nil
+}
+
+// skipCSVProvenance returns a reader of the rows of a csv file that skips its provenance comment line, if it has one.
+func skipCSVProvenance(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if _, err := readCSVProvenance(br); err != nil {
+		return &errReader{err: err}
+	}
+	return br
+}
+
+// errReader is a reader that always fails with an error.
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestCSVProvenance(t *testing.T) {
+	defer func(v bool) { shippingConfig.csvProvenance = v }(shippingConfig.csvProvenance)
+	shippingConfig.csvProvenance = true
+
+	ef := &ExportFile{
+		Date:        Date{Year: 2021, Month: 8, Day: 2},
+		StartHeight: 1005360,
+		EndHeight:   1008239,
+		Schema:      1,
+		Network:     "mainnet",
+		TableName:   "chain_consensus",
+		Format:      FormatCSV,
+		Compression: CompressionByName["gz"],
+	}
+	rows := "1005360,root,parent,tipset\n1005361,root,parent,tipset\n"
+
+	var buf bytes.Buffer
+	if _, err := compressExportReader(context.Background(), ef, strings.NewReader(rows), &buf); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if !ef.Provenance || ef.Rows != 2 {
+		t.Errorf("got provenance %v and %d rows, wanted provenance and 2 rows", ef.Provenance, ef.Rows)
+	}
+
+	zr, err := ef.Compression.Decompress(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(zr)
+	p, err := readCSVProvenance(br)
+	if err != nil {
+		t.Fatalf("read provenance: %v", err)
+	}
+	if p == nil || p.Network != "mainnet" || p.Table != "chain_consensus" || p.Schema != 1 || p.StartHeight != 1005360 || p.EndHeight != 1008239 || p.Version != version {
+		t.Errorf("unexpected provenance: %+v", p)
+	}
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != rows {
+		t.Errorf("got rows %q after provenance, wanted %q", rest, rows)
+	}
+
+	// Readers of shipped files skip the line, and files without one are read unchanged
+	for _, data := range []string{p.csvLine() + rows, rows} {
+		got, err := io.ReadAll(skipCSVProvenance(strings.NewReader(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != rows {
+			t.Errorf("got %q, wanted %q", got, rows)
+		}
+	}
+}
+
+func TestParquetProvenance(t *testing.T) {
+	ef := &ExportFile{Network: "mainnet", TableName: "chain_consensus", Schema: 1, StartHeight: 10, EndHeight: 20}
+
+	var buf bytes.Buffer
+	pw, err := newParquetWriter(&buf, []parquetColumn{{Name: "height", Type: parquetInt64, ConvertedType: parquetNoConvertedType}}, provenanceForFile(ef).parquetKeyValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.WriteRow([]string{"10"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(buf.Bytes()), 1)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	kvs := map[string]string{}
+	for _, kv := range pr.Footer.GetKeyValueMetadata() {
+		kvs[kv.Key] = kv.GetValue()
+	}
+	for key, want := range map[string]string{"network": "mainnet", "table": "chain_consensus", "schema": "1", "start_height": "10", "end_height": "20"} {
+		if got := kvs[ParquetProvenancePrefix+key]; got != want {
+			t.Errorf("got %s %q, wanted %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+const prunedCollection = "pruned"
+
+// PrunedFile records a shipped file that was removed from the ship path by the retention policy. Pruned files continue
+// to be treated as shipped so that their periods are not exported again.
+type PrunedFile struct {
+	Path      string    `json:"path"` // path of the file relative to the ship path
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Confirmed string    `json:"confirmed,omitempty"` // location holding a confirmed copy of the file, if one was required
+	Pruned    time.Time `json:"pruned"`
+}
+
+// PrunedFiles maps the path of a pruned file to its record.
+type PrunedFiles map[string]*PrunedFile
+
+// PrunedFiles returns the records of every shipped file that has been pruned.
+func (s *StateStore) PrunedFiles() (PrunedFiles, error) {
+	pf := PrunedFiles{}
+	if err := s.load(prunedCollection, &pf); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// AddPrunedFiles records that one or more shipped files have been pruned.
+func (s *StateStore) AddPrunedFiles(files ...*PrunedFile) error {
+	pf := PrunedFiles{}
+	return s.update(prunedCollection, &pf, func() error {
+		for _, f := range files {
+			pf[f.Path] = f
+		}
+		return nil
+	})
+}
+
+// prunedFiles returns the records of pruned files, or nil if no state store is configured.
+func prunedFiles() (PrunedFiles, error) {
+	if stateStore == nil {
+		return nil, nil
+	}
+	return stateStore.PrunedFiles()
+}
+
+// Pruner removes shipped files and leftover walk output that are older than the configured retention periods.
+type Pruner struct {
+	ShipPath    string // filesystem ship path holding the shipped files
+	StoragePath string // path that lily writes walk output to
+	Network     string
+
+	ShippedAge time.Duration // age after which shipped files are pruned, zero to keep them
+	WalkAge    time.Duration // age after which walk files are pruned, zero to keep them
+
+	// Confirm, if set, is a copy of the ship path that must hold an identical copy of a shipped file before it is
+	// pruned.
+	Confirm Shipper
+
+	DryRun bool
+}
+
+// PruneStats summarises a single pass of the pruner.
+type PruneStats struct {
+	Shipped     int   // shipped files pruned
+	Unconfirmed int   // shipped files old enough to prune that have no confirmed copy
+	WalkFiles   int   // walk files pruned
+	Bytes       int64 // bytes freed
+}
+
+// pruneCandidate is a file that may be removed by the pruner.
+type pruneCandidate struct {
+	rel     string
+	size    int64
+	modTime time.Time
+}
+
+// selectPruneCandidates returns the candidates last modified before the cutoff, excluding any that are kept. The
+// result is sorted by path so that pruning proceeds in a predictable order.
+func selectPruneCandidates(files []pruneCandidate, cutoff time.Time, keep func(rel string) bool) []pruneCandidate {
+	var selected []pruneCandidate
+	for _, f := range files {
+		if !f.modTime.Before(cutoff) {
+			continue
+		}
+		if keep != nil && keep(f.rel) {
+			continue
+		}
+		selected = append(selected, f)
+	}
+	sort.Slice(selected, func(a, b int) bool { return selected[a].rel < selected[b].rel })
+	return selected
+}
+
+// Prune runs a single pass of the retention policy.
+func (p *Pruner) Prune(ctx context.Context) (*PruneStats, error) {
+	stats := &PruneStats{}
+	if p.ShippedAge > 0 {
+		if err := p.pruneShipped(ctx, stats); err != nil {
+			return stats, fmt.Errorf("prune shipped files: %w", err)
+		}
+	}
+	if p.WalkAge > 0 {
+		if err := p.pruneWalkFiles(ctx, stats); err != nil {
+			return stats, fmt.Errorf("prune walk files: %w", err)
+		}
+	}
+	return stats, nil
+}
+
+// pruneShipped removes shipped files listed in the height index, along with their checksum and seek index files. The
+// height index, table indexes and period manifests are left untouched so they continue to describe the full archive.
+func (p *Pruner) pruneShipped(ctx context.Context, stats *PruneStats) error {
+	if stateStore == nil {
+		return fmt.Errorf("pruning shipped files requires a state store")
+	}
+
+	hi, err := readHeightIndex(ctx, &fileShipper{root: p.ShipPath}, p.Network)
+	if err != nil {
+		return fmt.Errorf("read height index: %w", err)
+	}
+	if hi == nil {
+		return nil
+	}
+
+	// Files part way through shipping are never pruned
+	unfinished, err := unfinishedFiles()
+	if err != nil {
+		return fmt.Errorf("load file states: %w", err)
+	}
+
+	var files []pruneCandidate
+	for rel := range hi.Files {
+		info, err := os.Stat(filepath.Join(p.ShipPath, rel))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // already pruned
+			}
+			return fmt.Errorf("stat: %w", err)
+		}
+		files = append(files, pruneCandidate{rel: rel, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	selected := selectPruneCandidates(files, time.Now().Add(-p.ShippedAge), func(rel string) bool {
+		return unfinished.Unfinished(rel)
+	})
+
+	ll := logger.With("ship_path", p.ShipPath, "dry_run", p.DryRun)
+	for _, f := range selected {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ref := hi.Files[f.rel]
+
+		pf := &PrunedFile{Path: f.rel, Size: ref.Size, SHA256: ref.SHA256}
+		if p.Confirm != nil {
+			ok, err := p.confirmed(ctx, f.rel, ref)
+			if err != nil {
+				ll.Errorw("failed to confirm shipped file", "file", f.rel, "error", err)
+			}
+			if !ok {
+				stats.Unconfirmed++
+				continue
+			}
+			pf.Confirmed = p.Confirm.String()
+		}
+
+		ll.Infow("pruning shipped file", "file", f.rel, "size", f.size, "modified", f.modTime.Format(time.RFC3339))
+		stats.Shipped++
+		stats.Bytes += f.size
+		if p.DryRun {
+			continue
+		}
+
+		// The file is recorded before it is removed so an interrupted prune never leaves a period looking unshipped
+		pf.Pruned = time.Now().UTC()
+		if err := stateStore.AddPrunedFiles(pf); err != nil {
+			return fmt.Errorf("record pruned file: %w", err)
+		}
+		for _, rel := range []string{f.rel, f.rel + ChecksumSuffix, f.rel + ChecksumSuffix + SignatureSuffix, f.rel + SeekIndexSuffix} {
+			if err := os.Remove(filepath.Join(p.ShipPath, rel)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("remove: %w", err)
+			}
+		}
+		auditLog.Record(&AuditRecord{
+			Action:  AuditFileRemoved,
+			Network: p.Network,
+			Path:    f.rel,
+			Size:    ref.Size,
+			SHA256:  ref.SHA256,
+			Reason:  fmt.Sprintf("older than the shipped file retention of %s", p.ShippedAge),
+		})
+	}
+	return nil
+}
+
+// confirmed reports whether the confirmation location holds a copy of a shipped file with the size and checksum
+// recorded in the height index.
+func (p *Pruner) confirmed(ctx context.Context, rel string, ref *HeightIndexFileRef) (bool, error) {
+	if ref.SHA256 == "" {
+		return false, nil
+	}
+
+	info, err := p.Confirm.Stat(ctx, rel)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("stat: %w", err)
+	}
+	if info.Size != ref.Size {
+		return false, nil
+	}
+
+	data, err := p.Confirm.Read(ctx, rel+ChecksumSuffix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("read checksum: %w", err)
+	}
+	sum, _, err := parseChecksumFile(data)
+	if err != nil {
+		return false, fmt.Errorf("parse checksum: %w", err)
+	}
+	return sum == ref.SHA256, nil
+}
+
+// pruneWalkFiles removes files from the storage path that were left behind by walks that failed or were abandoned.
+// Output of completed walks that has not yet been shipped is kept.
+func (p *Pruner) pruneWalkFiles(ctx context.Context, stats *PruneStats) error {
+	var pending []string
+	if stateStore != nil {
+		cw, err := stateStore.CompletedWalks()
+		if err != nil {
+			return fmt.Errorf("read completed walks: %w", err)
+		}
+		for _, w := range cw {
+			pending = append(pending, w.Walk.Name+"-")
+		}
+	}
+
+	files, err := storageFiles(p.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	selected := selectPruneCandidates(files, time.Now().Add(-p.WalkAge), func(rel string) bool {
+		for _, prefix := range pending {
+			if strings.HasPrefix(rel, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+
+	ll := logger.With("storage_path", p.StoragePath, "dry_run", p.DryRun)
+	for _, f := range selected {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ll.Infow("pruning walk file", "file", f.rel, "size", f.size, "modified", f.modTime.Format(time.RFC3339))
+		stats.WalkFiles++
+		stats.Bytes += f.size
+		if p.DryRun {
+			continue
+		}
+		if err := os.Remove(filepath.Join(p.StoragePath, f.rel)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove: %w", err)
+		}
+	}
+	return nil
+}
+
+// storageFiles returns the regular files in a storage path as candidates for removal.
+func storageFiles(storagePath string) ([]pruneCandidate, error) {
+	entries, err := os.ReadDir(storagePath)
+	if err != nil {
+		return nil, fmt.Errorf("read storage path: %w", err)
+	}
+
+	var files []pruneCandidate
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("stat: %w", err)
+		}
+		files = append(files, pruneCandidate{rel: e.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+// Run applies the retention policy at the given interval until the context is cancelled.
+func (p *Pruner) Run(ctx context.Context, interval time.Duration) {
+	prune := func(ctx context.Context) (bool, error) {
+		stats, err := p.Prune(ctx)
+		if err != nil {
+			logger.Errorw("pruning failed", "error", err)
+			return false, nil
+		}
+		if !p.DryRun {
+			prunedFilesCounter.Add(float64(stats.Shipped + stats.WalkFiles))
+		}
+		logger.Infow("pruning complete", "shipped", stats.Shipped, "unconfirmed", stats.Unconfirmed, "walk_files", stats.WalkFiles, "bytes", stats.Bytes, "dry_run", p.DryRun)
+		return false, nil
+	}
+
+	if err := WaitUntil(ctx, prune, 0, interval); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Errorw("pruner stopped", "error", err)
+	}
+}
+
+// newPrunerFromConfig returns a pruner applying the configured retention policy, or nil if no retention period has
+// been set. Pruning shipped files requires a filesystem ship path.
+func newPrunerFromConfig(sh Shipper) (*Pruner, error) {
+	if retentionConfig.shippedDays == 0 && retentionConfig.walkDays == 0 {
+		return nil, nil
+	}
+
+	p := &Pruner{
+		StoragePath: storageConfig.path,
+		Network:     networkConfig.name,
+		ShippedAge:  time.Duration(retentionConfig.shippedDays) * 24 * time.Hour,
+		WalkAge:     time.Duration(retentionConfig.walkDays) * 24 * time.Hour,
+		DryRun:      retentionConfig.dryRun,
+	}
+
+	if p.ShippedAge > 0 {
+		localPath, isLocal := localShipPath(sh)
+		if !isLocal {
+			return nil, fmt.Errorf("pruning shipped files requires a filesystem ship path")
+		}
+		if stateStore == nil {
+			return nil, fmt.Errorf("pruning shipped files requires a state path")
+		}
+		p.ShipPath = localPath
+	}
+
+	if retentionConfig.confirmShippedTo != "" {
+		confirm, err := newShipper(retentionConfig.confirmShippedTo)
+		if err != nil {
+			return nil, fmt.Errorf("confirmation location: %w", err)
+		}
+		if confirmPath, ok := localShipPath(confirm); ok && p.ShipPath != "" && filepath.Clean(confirmPath) == filepath.Clean(p.ShipPath) {
+			return nil, fmt.Errorf("confirmation location must differ from the ship path")
+		}
+		p.Confirm = confirm
+	}
+
+	return p, nil
+}
+
+var pruneCommand = &cli.Command{
+	Name:   "prune",
+	Usage:  "Apply the retention policy once, removing old shipped files and leftover walk files.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		stateFlags,
+		auditFlags,
+		objectStoreFlags,
+		retentionFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path used to write verified exports from lily.",
+				Required: true,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to open ship path: %w", err)
+		}
+
+		p, err := newPrunerFromConfig(sh)
+		if err != nil {
+			return fmt.Errorf("invalid retention policy: %w", err)
+		}
+		if p == nil {
+			return fmt.Errorf("no retention period set, use --prune-shipped-after or --prune-walk-files-after")
+		}
+
+		stats, err := p.Prune(ctx)
+		if err != nil {
+			return err
+		}
+
+		verb := "pruned"
+		if p.DryRun {
+			verb = "would prune"
+		}
+		fmt.Printf("%s %d shipped files and %d walk files, %d bytes\n", verb, stats.Shipped, stats.WalkFiles, stats.Bytes)
+		if stats.Unconfirmed > 0 {
+			fmt.Printf("kept %d shipped files without a confirmed copy at %s\n", stats.Unconfirmed, p.Confirm.String())
+		}
+		return nil
+	},
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectPruneCandidates(t *testing.T) {
+	cutoff := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := cutoff.Add(-time.Hour)
+	recent := cutoff.Add(time.Hour)
+
+	files := []pruneCandidate{
+		{rel: "walk2-messages.csv", modTime: old},
+		{rel: "walk1-messages.csv", modTime: old},
+		{rel: "walk3-messages.csv", modTime: recent},
+		{rel: "walk4-messages.csv", modTime: cutoff},
+	}
+
+	testCases := []struct {
+		name string
+		keep func(string) bool
+		want []string
+	}{
+		{
+			name: "older than cutoff",
+			want: []string{"walk1-messages.csv", "walk2-messages.csv"},
+		},
+		{
+			name: "kept files are excluded",
+			keep: func(rel string) bool { return strings.HasPrefix(rel, "walk1-") },
+			want: []string{"walk2-messages.csv"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, f := range selectPruneCandidates(files, cutoff, tc.keep) {
+				got = append(got, f.rel)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
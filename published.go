@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// publishedIndexTTL is how long the height index of a published archive is used before it is fetched again.
+const publishedIndexTTL = time.Minute
+
+// publishedArchive is the archive published by another archiver that is checked for files before exporting them, nil
+// if none is configured.
+var publishedArchive *PublishedArchive
+
+// configurePublishedArchive creates the published archive named by the published flags.
+func configurePublishedArchive() error {
+	publishedArchive = nil
+	if publishedConfig.url == "" {
+		return nil
+	}
+	u, err := url.Parse(publishedConfig.url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	publishedArchive = NewPublishedArchive(u, &http.Client{Timeout: publishedConfig.timeout})
+	return nil
+}
+
+// PublishedArchive checks for files in an archive that another archiver publishes over HTTP. A file is published once
+// both it and its checksum file can be found, since the checksum file is shipped last. When the published height index
+// lists the file its size must also match, which guards against a mirror serving a stale or partial copy.
+//
+// The ETag of each published file is remembered so that later checks are conditional requests that the server can
+// answer without sending the file's headers again.
+type PublishedArchive struct {
+	Base   *url.URL
+	Client *http.Client
+
+	mu      sync.Mutex
+	files   map[string]string // ETag of each file found to be published, keyed by path
+	indexes map[string]*publishedIndex
+}
+
+// publishedIndex is the height index of a network in the published archive, nil if it does not publish one.
+type publishedIndex struct {
+	index   *HeightIndex
+	etag    string
+	fetched time.Time
+}
+
+func NewPublishedArchive(base *url.URL, client *http.Client) *PublishedArchive {
+	return &PublishedArchive{
+		Base:    base,
+		Client:  client,
+		files:   map[string]string{},
+		indexes: map[string]*publishedIndex{},
+	}
+}
+
+func (p *PublishedArchive) String() string {
+	return p.Base.String()
+}
+
+// url returns the URL of a file given its path relative to the root of the archive.
+func (p *PublishedArchive) url(rel string) string {
+	u := *p.Base
+	u.Path = path.Join(u.Path, filepath.ToSlash(rel))
+	return u.String()
+}
+
+// request makes a request for a file, conditional on its ETag not matching etag when one is given.
+func (p *PublishedArchive) request(ctx context.Context, method, rel, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.url(rel), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, p.url(rel), err)
+	}
+	return resp, nil
+}
+
+// Has reports whether the file at rel, a path relative to the root of the archive, has been published for the network.
+func (p *PublishedArchive) Has(ctx context.Context, network string, rel string) (bool, error) {
+	p.mu.Lock()
+	etag := p.files[rel]
+	p.mu.Unlock()
+
+	resp, err := p.request(ctx, http.MethodHead, rel, etag)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return true, nil
+	case http.StatusOK:
+	case http.StatusNotFound:
+		p.forget(rel)
+		return false, nil
+	default:
+		return false, fmt.Errorf("head %s: unexpected status %s", p.url(rel), resp.Status)
+	}
+	size, etag := resp.ContentLength, resp.Header.Get("ETag")
+
+	sumResp, err := p.request(ctx, http.MethodHead, rel+ChecksumSuffix, "")
+	if err != nil {
+		return false, err
+	}
+	sumResp.Body.Close()
+	switch sumResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// The file is still being published
+		return false, nil
+	default:
+		return false, fmt.Errorf("head %s: unexpected status %s", p.url(rel+ChecksumSuffix), sumResp.Status)
+	}
+
+	hi, err := p.heightIndex(ctx, network)
+	if err != nil {
+		return false, fmt.Errorf("height index: %w", err)
+	}
+	if hi != nil && size >= 0 {
+		if ref, ok := hi.Files[filepath.ToSlash(rel)]; ok && ref.Size != size {
+			logger.Warnw("published file size does not match published height index", "file", rel, "size", size, "indexed_size", ref.Size)
+			return false, nil
+		}
+	}
+
+	if etag != "" {
+		p.mu.Lock()
+		p.files[rel] = etag
+		p.mu.Unlock()
+	}
+	return true, nil
+}
+
+func (p *PublishedArchive) forget(rel string) {
+	p.mu.Lock()
+	delete(p.files, rel)
+	p.mu.Unlock()
+}
+
+// heightIndex returns the published height index of the network, or nil if the archive does not publish one. The index
+// is fetched again once it is older than publishedIndexTTL, using a conditional request if the server gave it an ETag.
+func (p *PublishedArchive) heightIndex(ctx context.Context, network string) (*HeightIndex, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pi := p.indexes[network]
+	if pi != nil && time.Since(pi.fetched) < publishedIndexTTL {
+		return pi.index, nil
+	}
+
+	var etag string
+	if pi != nil {
+		etag = pi.etag
+	}
+	resp, err := p.request(ctx, http.MethodGet, filepath.Join(network, HeightIndexFilename), etag)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		pi.fetched = time.Now()
+		return pi.index, nil
+	case http.StatusNotFound:
+		p.indexes[network] = &publishedIndex{fetched: time.Now()}
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	var hi HeightIndex
+	if err := json.Unmarshal(data, &hi); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if hi.Network != network {
+		return nil, fmt.Errorf("height index is for network %q", hi.Network)
+	}
+	p.indexes[network] = &publishedIndex{index: &hi, etag: resp.Header.Get("ETag"), fetched: time.Now()}
+	return &hi, nil
+}
+
+// markPublishedFiles marks the unshipped files of a manifest that have already been published by another archiver as
+// shipped, so they are not exported again. Sharded tables are published when their shard list is. A file whose status
+// cannot be determined is left unshipped, so an unreachable archive causes files to be exported rather than skipped.
+func markPublishedFiles(ctx context.Context, em *ExportManifest) {
+	if publishedArchive == nil || em.Provisional {
+		return
+	}
+
+	for _, ef := range em.Files {
+		if ef.Shipped {
+			continue
+		}
+		rel := ef.Path()
+		if isShardedTable(ef.TableName) {
+			rel = ef.ShardListPath()
+		}
+
+		ok, err := publishedArchive.Has(ctx, em.Network, rel)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logger.Warnw("failed to check published archive for file", "error", err, "file", rel, "published", publishedArchive.String())
+			}
+			continue
+		}
+		if ok {
+			logger.Debugw("file already published", "file", rel, "published", publishedArchive.String())
+			ef.Shipped = true
+		}
+	}
+}
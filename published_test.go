@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishedArchive(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		files       = map[string][]byte{}
+		notModified int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, ok := files[strings.TrimPrefix(r.URL.Path, "/archive/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		etag := fmt.Sprintf(`"%d"`, len(data))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	base, _ := url.Parse(srv.URL + "/archive")
+	pa := NewPublishedArchive(base, srv.Client())
+	ctx := context.Background()
+
+	ef := &ExportFile{Date: Date{Year: 2021, Month: 8, Day: 2}, Schema: 1, Network: "mainnet", TableName: "messages", Format: "csv", Compression: CompressionByName["gz"]}
+	path := ef.Path()
+
+	if ok, err := pa.Has(ctx, "mainnet", path); err != nil || ok {
+		t.Fatalf("missing file: got %v, %v", ok, err)
+	}
+
+	// The file is not published until its checksum file is
+	mu.Lock()
+	files[path] = []byte("contents")
+	mu.Unlock()
+	if ok, err := pa.Has(ctx, "mainnet", path); err != nil || ok {
+		t.Fatalf("file without checksum: got %v, %v", ok, err)
+	}
+
+	mu.Lock()
+	files[path+ChecksumSuffix] = []byte("checksum")
+	mu.Unlock()
+	if ok, err := pa.Has(ctx, "mainnet", path); err != nil || !ok {
+		t.Fatalf("published file: got %v, %v", ok, err)
+	}
+	if ok, err := pa.Has(ctx, "mainnet", path); err != nil || !ok {
+		t.Fatalf("published file checked again: got %v, %v", ok, err)
+	}
+	if notModified != 1 {
+		t.Errorf("got %d not modified responses, expected the second check to be conditional", notModified)
+	}
+
+	// A file whose size does not match the published height index is not treated as published
+	pa = NewPublishedArchive(base, srv.Client())
+	hi, _ := json.Marshal(&HeightIndex{Network: "mainnet", Files: map[string]*HeightIndexFileRef{path: {Size: 100}}})
+	mu.Lock()
+	files["mainnet/"+HeightIndexFilename] = hi
+	mu.Unlock()
+	if ok, err := pa.Has(ctx, "mainnet", path); err != nil || ok {
+		t.Fatalf("file with mismatched size: got %v, %v", ok, err)
+	}
+}
+
+func TestMarkPublishedFiles(t *testing.T) {
+	defer func(pa *PublishedArchive) { publishedArchive = pa }(publishedArchive)
+
+	published := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !published[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ChecksumSuffix)] {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	base, _ := url.Parse(srv.URL)
+	publishedArchive = NewPublishedArchive(base, srv.Client())
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	for _, table := range []string{"messages", "block_headers", "actors"} {
+		em.Files = append(em.Files, &ExportFile{Date: p.Date, Schema: 1, Network: "mainnet", TableName: table, Format: "csv", Compression: CompressionByName["gz"]})
+	}
+	published[em.Files[0].Path()] = true
+
+	markPublishedFiles(context.Background(), em)
+	if !em.Files[0].Shipped || em.Files[1].Shipped || em.Files[2].Shipped {
+		t.Errorf("expected only the published file to be marked as shipped")
+	}
+
+	// Files are exported when the published archive cannot be reached
+	srv.Close()
+	em.Files[0].Shipped = false
+	markPublishedFiles(context.Background(), em)
+	if em.Files[0].Shipped {
+		t.Errorf("expected files to remain unshipped when the published archive is unreachable")
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const jobsCollection = "jobs"
+
+const (
+	// DefaultRetryBackoff is the time waited before the first retry of a period that failed to export.
+	DefaultRetryBackoff = time.Minute
+
+	// DefaultMaxRetryBackoff is the longest time waited between retries of a period that failed to export.
+	DefaultMaxRetryBackoff = 15 * time.Minute
+)
+
+// Priorities given to export jobs when they are first queued. Jobs with a higher priority are exported first by the
+// backfill workers. Operators may change the priority of a job with the jobs command.
+const (
+	JobPriorityBackfill = 0
+	JobPriorityHead     = 10
+)
+
+// States of an export job.
+const (
+	JobStatePending  = "pending"  // waiting to run, either for the first time or for another instance's claim on the period
+	JobStateRunning  = "running"  // being exported
+	JobStateRetrying = "retrying" // failed and waiting for its backoff to pass before the next attempt
+	JobStateDead     = "dead"     // failed too many times and skipped until retried with the jobs command
+)
+
+// ErrJobDeadLettered is returned when an export job has failed too many times to be attempted again.
+var ErrJobDeadLettered = errors.New("export job has been dead-lettered")
+
+// ExportJob records the state of the export of a period for the export queue. Jobs are removed once the period has
+// been exported, so the queue only holds periods that are waiting, running or failing.
+type ExportJob struct {
+	Network     string    `json:"network"`
+	Date        Date      `json:"date"`
+	Hour        int       `json:"hour,omitempty"`   // hour the period starts at, for hourly periods
+	Ranged      bool      `json:"ranged,omitempty"` // job covers a height range rather than a calendar day
+	From        int64     `json:"from"`
+	To          int64     `json:"to"`
+	Tables      []string  `json:"tables,omitempty"` // tables exported by the most recent attempt
+	Priority    int       `json:"priority"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"` // consecutive failed attempts
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Period returns the export period covered by the job.
+func (j *ExportJob) Period() ExportPeriod {
+	return ExportPeriod{Date: j.Date, Hour: j.Hour, StartHeight: j.From, EndHeight: j.To, Ranged: j.Ranged}
+}
+
+// Key returns the key of the job in the export queue.
+func (j *ExportJob) Key() string {
+	return completedWalkKey(j.Network, j.Period(), "")
+}
+
+// ExportJobs maps a key made up of network and export period to the export job for that period.
+type ExportJobs map[string]*ExportJob
+
+// Sorted returns the jobs in the order they are exported by the backfill workers, highest priority first and then
+// the most recent period first.
+func (js ExportJobs) Sorted() []*ExportJob {
+	jobs := make([]*ExportJob, 0, len(js))
+	for _, j := range js {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		if jobs[a].Priority != jobs[b].Priority {
+			return jobs[a].Priority > jobs[b].Priority
+		}
+		return jobs[a].From > jobs[b].From
+	})
+	return jobs
+}
+
+// ExportJobs returns every job in the export queue.
+func (s *StateStore) ExportJobs() (ExportJobs, error) {
+	js := ExportJobs{}
+	if err := s.load(jobsCollection, &js); err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// SetExportJob records an export job, replacing any previous job for the same network and period.
+func (s *StateStore) SetExportJob(j *ExportJob) error {
+	js := ExportJobs{}
+	return s.update(jobsCollection, &js, func() error {
+		js[j.Key()] = j
+		return nil
+	})
+}
+
+// UpdateExportJob calls fn with the export job held under key, or nil if there is none, and records the job it
+// returns. The job is removed if fn returns nil.
+func (s *StateStore) UpdateExportJob(key string, fn func(j *ExportJob) (*ExportJob, error)) error {
+	js := ExportJobs{}
+	return s.update(jobsCollection, &js, func() error {
+		j, err := fn(js[key])
+		if err != nil {
+			return err
+		}
+		if j == nil {
+			delete(js, key)
+			return nil
+		}
+		js[key] = j
+		return nil
+	})
+}
+
+// RemoveExportJob removes the export job held under key.
+func (s *StateStore) RemoveExportJob(key string) error {
+	js := ExportJobs{}
+	return s.update(jobsCollection, &js, func() error {
+		delete(js, key)
+		return nil
+	})
+}
+
+// exportJobs returns the jobs in the export queue, or an empty queue if no state store is configured.
+func exportJobs() (ExportJobs, error) {
+	if stateStore == nil {
+		return ExportJobs{}, nil
+	}
+	return stateStore.ExportJobs()
+}
+
+// exportJobForPeriod returns the queued job for the period, or a new pending job with the given priority if the
+// period has not been queued before or the queue cannot be read.
+func exportJobForPeriod(network string, p ExportPeriod, priority int) *ExportJob {
+	j := &ExportJob{
+		Network:  network,
+		Date:     p.Date,
+		Hour:     p.Hour,
+		Ranged:   p.Ranged,
+		From:     p.StartHeight,
+		To:       p.EndHeight,
+		Priority: priority,
+		State:    JobStatePending,
+		Created:  time.Now().UTC(),
+	}
+	js, err := exportJobs()
+	if err != nil {
+		logger.Errorw("failed to read export jobs", "error", err, "job", j.Key())
+		return j
+	}
+	if existing, ok := js[j.Key()]; ok {
+		return existing
+	}
+	return j
+}
+
+// saveExportJob records the job in the state store, if one is configured.
+func saveExportJob(j *ExportJob) {
+	j.Updated = time.Now().UTC()
+	if stateStore == nil {
+		return
+	}
+	if err := stateStore.SetExportJob(j); err != nil {
+		logger.Errorw("failed to record export job", "error", err, "job", j.Key())
+	}
+}
+
+// forgetExportJob removes the job from the state store, if one is configured.
+func forgetExportJob(j *ExportJob) {
+	if stateStore == nil {
+		return
+	}
+	if err := stateStore.RemoveExportJob(j.Key()); err != nil {
+		logger.Errorw("failed to remove export job", "error", err, "job", j.Key())
+	}
+}
+
+// retryBackoff returns the time to wait after the given number of consecutive failed attempts, which doubles with
+// each failure up to the configured maximum and is varied by the retry jitter.
+func retryBackoff(attempts int) time.Duration {
+	backoff, max := queueConfig.retryBackoff, queueConfig.maxRetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxRetryBackoff
+	}
+	return RetryPolicy{Initial: backoff, Max: max, Jitter: retryConfig.jitter}.Backoff(attempts)
+}
+
+// runExportJob exports a period as a job of the export queue, retrying failed attempts with exponential backoff until
+// one succeeds or the context is cancelled. A job that fails --max-attempts times in a row is dead-lettered and an
+// error wrapping ErrJobDeadLettered is returned, as it is for a job that was dead-lettered earlier. Waiting for another
+// instance's claim on the period is not counted as a failure. Attempts, backoff and priority are persisted in the
+// state store, if one is configured, so that they survive a restart.
+func runExportJob(ctx context.Context, p ExportPeriod, tables []Table, priority int, attempt func(context.Context) error) error {
+	j := exportJobForPeriod(networkConfig.name, p, priority)
+	if j.State == JobStateDead {
+		return fmt.Errorf("%w after %d attempts: %s", ErrJobDeadLettered, j.Attempts, j.LastError)
+	}
+
+	j.Tables = j.Tables[:0]
+	for _, t := range tables {
+		j.Tables = append(j.Tables, t.Name)
+	}
+
+	ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight)
+	for {
+		if wait := time.Until(j.NextAttempt); wait > 0 {
+			ll.Infow("waiting to retry export", "attempts", j.Attempts, "next_attempt", j.NextAttempt.Format(time.RFC3339))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		j.State = JobStateRunning
+		saveExportJob(j)
+
+		done := activeExportJobs.Start()
+		err := attempt(ctx)
+		done()
+		if err == nil {
+			forgetExportJob(j)
+			return nil
+		}
+		if ctx.Err() != nil {
+			j.State = JobStatePending
+			saveExportJob(j)
+			return ctx.Err()
+		}
+
+		if errors.Is(err, ErrPeriodClaimed) {
+			j.State = JobStatePending
+			j.NextAttempt = time.Now().UTC().Add(retryBackoff(0))
+			saveExportJob(j)
+			continue
+		}
+
+		j.Attempts++
+		j.LastError = err.Error()
+		recentErrors.Record(p, err)
+		if j.Attempts == notifyConfig.failureThreshold {
+			notifyShippingFailed(ctx, networkConfig.name, p, j.Attempts, err)
+		}
+
+		if queueConfig.maxAttempts > 0 && j.Attempts >= queueConfig.maxAttempts {
+			j.State = JobStateDead
+			j.NextAttempt = time.Time{}
+			saveExportJob(j)
+			exportJobsDeadCounter.Inc()
+			ll.Errorw("export failed too many times, dead-lettering period", "error", err, "attempts", j.Attempts)
+			return fmt.Errorf("%w after %d attempts: %v", ErrJobDeadLettered, j.Attempts, err)
+		}
+
+		j.State = JobStateRetrying
+		j.NextAttempt = time.Now().UTC().Add(retryBackoff(j.Attempts))
+		saveExportJob(j)
+	}
+}
+
+// activeExportJobs tracks the export jobs being attempted by this process, so that ad-hoc exports can wait for them.
+var activeExportJobs = &jobActivity{}
+
+// jobActivity counts running jobs and wakes waiters once none are running.
+type jobActivity struct {
+	mu      sync.Mutex
+	running int
+	idle    chan struct{} // closed while no jobs are running, nil until the first job starts
+}
+
+// Start records that a job is running, returning a function to call once it has finished.
+func (a *jobActivity) Start() func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running == 0 {
+		a.idle = make(chan struct{})
+	}
+	a.running++
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.running--
+		if a.running == 0 {
+			close(a.idle)
+		}
+	}
+}
+
+// WaitIdle waits until no jobs are running or the context is cancelled.
+func (a *jobActivity) WaitIdle(ctx context.Context) error {
+	a.mu.Lock()
+	if a.running == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	idle := a.idle
+	a.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prioritizeBackfillQueue orders a backfill queue by the priority of each period's export job, keeping the existing
+// order between periods of equal priority. Periods whose jobs have been dead-lettered are removed from the queue.
+func prioritizeBackfillQueue(queue []*PeriodPlan, js ExportJobs) []*PeriodPlan {
+	priority := func(pp *PeriodPlan) int {
+		if j, ok := js[completedWalkKey(networkConfig.name, pp.Period, "")]; ok {
+			return j.Priority
+		}
+		return JobPriorityBackfill
+	}
+
+	var prioritized []*PeriodPlan
+	for _, pp := range queue {
+		if j, ok := js[completedWalkKey(networkConfig.name, pp.Period, "")]; ok && j.State == JobStateDead {
+			logger.Infow("skipping dead-lettered period", "date", pp.Period.Date.String(), "attempts", j.Attempts)
+			continue
+		}
+		prioritized = append(prioritized, pp)
+	}
+	sort.SliceStable(prioritized, func(a, b int) bool { return priority(prioritized[a]) > priority(prioritized[b]) })
+	return prioritized
+}
+
+// exportJobKey returns the key of the export job named by a command line argument, which is either a key listed by
+// the jobs command or the date of a period.
+func exportJobKey(arg string) (string, *ExportPeriod, error) {
+	d, err := DateFromString(arg)
+	if err != nil {
+		return arg, nil, nil
+	}
+	p, err := exportPeriodForDate(d, networkConfig.genesisTs)
+	if err != nil {
+		return "", nil, err
+	}
+	return completedWalkKey(networkConfig.name, p, ""), &p, nil
+}
+
+var jobsCommand = &cli.Command{
+	Name:  "jobs",
+	Usage: "Inspect and manage the queue of export jobs.",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "list",
+			Usage:  "List export jobs that are waiting, running, retrying or dead-lettered.",
+			Before: configure,
+			Flags: flagSet(
+				loggingFlags,
+				networkFlags,
+				tableRegistryFlags,
+				requiredStateFlags,
+				[]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Write the jobs as JSON.",
+					},
+				},
+			),
+			Action: func(cc *cli.Context) error {
+				js, err := stateStore.ExportJobs()
+				if err != nil {
+					return fmt.Errorf("read export jobs: %w", err)
+				}
+				jobs := js.Sorted()
+
+				if cc.Bool("json") {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(jobs)
+				}
+
+				for _, j := range jobs {
+					next := ""
+					if j.State == JobStateRetrying || j.State == JobStatePending && !j.NextAttempt.IsZero() {
+						next = " next " + j.NextAttempt.Format(time.RFC3339)
+					}
+					fmt.Printf("%s %s priority %d attempts %d%s\n", j.Key(), j.State, j.Priority, j.Attempts, next)
+					if j.LastError != "" {
+						fmt.Printf("  %s\n", j.LastError)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "retry",
+			Usage:     "Reset the attempts of export jobs so they are retried immediately, returning dead-lettered jobs to the queue. Dead-lettered periods are picked up by the next backfill.",
+			ArgsUsage: "<key or date>...",
+			Before:    configure,
+			Flags: flagSet(
+				loggingFlags,
+				networkFlags,
+				tableRegistryFlags,
+				requiredStateFlags,
+			),
+			Action: func(cc *cli.Context) error {
+				if cc.NArg() == 0 {
+					return fmt.Errorf("expected one or more job keys or dates")
+				}
+				for _, arg := range cc.Args().Slice() {
+					key, _, err := exportJobKey(arg)
+					if err != nil {
+						return fmt.Errorf("invalid job %q: %w", arg, err)
+					}
+					if err := stateStore.UpdateExportJob(key, func(j *ExportJob) (*ExportJob, error) {
+						if j == nil {
+							return nil, fmt.Errorf("no export job %q", key)
+						}
+						j.State = JobStatePending
+						j.Attempts = 0
+						j.NextAttempt = time.Time{}
+						j.Updated = time.Now().UTC()
+						return j, nil
+					}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "prioritize",
+			Usage:     "Set the priority of export jobs. Periods that have not been queued yet are queued with the priority so that they are exported first by the next backfill.",
+			ArgsUsage: "<key or date>...",
+			Before:    configure,
+			Flags: flagSet(
+				loggingFlags,
+				networkFlags,
+				tableRegistryFlags,
+				requiredStateFlags,
+				[]cli.Flag{
+					&cli.IntFlag{
+						Name:     "priority",
+						Usage:    "Priority of the jobs. Jobs with a higher priority are exported first.",
+						Required: true,
+					},
+				},
+			),
+			Action: func(cc *cli.Context) error {
+				if cc.NArg() == 0 {
+					return fmt.Errorf("expected one or more job keys or dates")
+				}
+				priority := cc.Int("priority")
+				for _, arg := range cc.Args().Slice() {
+					key, p, err := exportJobKey(arg)
+					if err != nil {
+						return fmt.Errorf("invalid job %q: %w", arg, err)
+					}
+					if err := stateStore.UpdateExportJob(key, func(j *ExportJob) (*ExportJob, error) {
+						if j == nil {
+							if p == nil {
+								return nil, fmt.Errorf("no export job %q", key)
+							}
+							j = &ExportJob{
+								Network: networkConfig.name,
+								Date:    p.Date,
+								Hour:    p.Hour,
+								From:    p.StartHeight,
+								To:      p.EndHeight,
+								State:   JobStatePending,
+								Created: time.Now().UTC(),
+							}
+						}
+						j.Priority = priority
+						j.Updated = time.Now().UTC()
+						return j, nil
+					}); err != nil {
+						return err
+					}
+					fmt.Printf("%s priority %d\n", key, priority)
+				}
+				return nil
+			},
+		},
+	},
+}
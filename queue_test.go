@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(b, m time.Duration) { queueConfig.retryBackoff, queueConfig.maxRetryBackoff = b, m }(queueConfig.retryBackoff, queueConfig.maxRetryBackoff)
+	queueConfig.retryBackoff, queueConfig.maxRetryBackoff = time.Minute, 15*time.Minute
+
+	for attempts, want := range map[int]time.Duration{0: time.Minute, 1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 15 * time.Minute, 40: 15 * time.Minute} {
+		if got := retryBackoff(attempts); got != want {
+			t.Errorf("got backoff %s after %d attempts, wanted %s", got, attempts, want)
+		}
+	}
+}
+
+func TestRunExportJobDeadLetters(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+	defer func(b time.Duration, n int) { queueConfig.retryBackoff, queueConfig.maxAttempts = b, n }(queueConfig.retryBackoff, queueConfig.maxAttempts)
+	exportJobsDeadCounter = metrics.NewCtx(context.Background(), "export_jobs_dead_letter_total", "").Counter()
+
+	var err error
+	stateStore, err = openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueConfig.retryBackoff, queueConfig.maxAttempts = time.Millisecond, 3
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	attempts := 0
+	fail := func(ctx context.Context) error {
+		attempts++
+		return errors.New("walk failed")
+	}
+
+	if err := runExportJob(context.Background(), p, nil, JobPriorityHead, fail); !errors.Is(err, ErrJobDeadLettered) {
+		t.Fatalf("got error %v, wanted the job to be dead-lettered", err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, wanted 3", attempts)
+	}
+
+	js, err := stateStore.ExportJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := js[completedWalkKey(networkConfig.name, p, "")]
+	if j == nil || j.State != JobStateDead || j.Attempts != 3 || j.LastError != "walk failed" || j.Priority != JobPriorityHead {
+		t.Fatalf("unexpected dead-lettered job: %+v", j)
+	}
+
+	// Dead-lettered jobs are not attempted again until they are retried
+	if err := runExportJob(context.Background(), p, nil, JobPriorityHead, fail); !errors.Is(err, ErrJobDeadLettered) || attempts != 3 {
+		t.Errorf("dead-lettered job was attempted again")
+	}
+
+	queue := []*PeriodPlan{{Period: p}, {Period: p.Next()}}
+	if got := prioritizeBackfillQueue(queue, js); len(got) != 1 || got[0].Period != p.Next() {
+		t.Errorf("dead-lettered period should be removed from the backfill queue")
+	}
+
+	// A job that succeeds is removed from the queue
+	j.State, j.Attempts = JobStatePending, 0
+	if err := stateStore.SetExportJob(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := runExportJob(context.Background(), p, nil, JobPriorityHead, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if js, _ := stateStore.ExportJobs(); len(js) != 0 {
+		t.Errorf("succeeded job should be removed, got %v", js)
+	}
+}
+
+func TestPrioritizeBackfillQueue(t *testing.T) {
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	next := p.Next()
+	queue := []*PeriodPlan{{Period: next.Next()}, {Period: next}, {Period: p}}
+	js := ExportJobs{
+		completedWalkKey(networkConfig.name, p, ""): {Date: p.Date, From: p.StartHeight, To: p.EndHeight, Priority: 50, State: JobStatePending},
+	}
+
+	got := prioritizeBackfillQueue(queue, js)
+	if len(got) != 3 || got[0].Period != p || got[1].Period != next.Next() || got[2].Period != next {
+		t.Errorf("unexpected backfill order: %v, %v, %v", got[0].Period.Date, got[1].Period.Date, got[2].Period.Date)
+	}
+}
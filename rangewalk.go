@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// rangeWalk is a walk of a range of heights run for a ranged export. Other ranged exports running in the same process
+// whose heights overlap the range take those heights from its output rather than walking them again.
+type rangeWalk struct {
+	from, to int64
+	tasks    []string
+	done     chan struct{} // closed once the walk has completed or failed
+	wi       WalkInfo
+	err      error
+	users    int // exports that have yet to copy their heights from the walk's output
+}
+
+// rangeWalkPart is a range of heights of a ranged export taken from a range walk.
+type rangeWalkPart struct {
+	walk     *rangeWalk
+	from, to int64
+}
+
+// rangeWalkSet holds the range walks that are running or whose output is still needed by an export. A walk's output is
+// removed once every export using it has copied its heights.
+type rangeWalkSet struct {
+	mu    sync.Mutex
+	walks []*rangeWalk
+}
+
+var rangeWalks = &rangeWalkSet{}
+
+// canShareRangeWalk reports whether the walk for a manifest can be shared with other ranged exports. Sharing relies on
+// splitting the plain csv output of a walk or index job by height, so it is not used when the output is compressed as
+// it is written.
+func canShareRangeWalk(em *ExportManifest) bool {
+	if !em.Period.Ranged || em.Provisional || shippingConfig.streamCompression {
+		return false
+	}
+	return jobConfig.jobType == JobTypeWalk || jobConfig.jobType == JobTypeIndex
+}
+
+// plan divides the heights from and to between the range walks that can provide them and new walks for the heights
+// that no existing walk covers, which are added to the set. The parts are returned in height order along with the new
+// walks, which the caller must run. Walks must have run every task in tasks. When a task writes a table without a
+// height column its rows cannot be divided, so only walks that lie wholly within the range are used.
+func (s *rangeWalkSet) plan(from, to int64, tasks []string) ([]rangeWalkPart, []*rangeWalk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	divisible := true
+	for _, table := range rangeWalkTables(tasks) {
+		if column, err := rangeWalkHeightColumn(table); err != nil || column < 0 {
+			divisible = false
+		}
+	}
+
+	var candidates []*rangeWalk
+	for _, w := range s.walks {
+		if w.to < from || w.from > to || !stringSliceContainsAll(w.tasks, tasks) {
+			continue
+		}
+		if !divisible && (w.from < from || w.to > to) {
+			continue
+		}
+		candidates = append(candidates, w)
+	}
+
+	var parts []rangeWalkPart
+	var created []*rangeWalk
+	for h := from; h <= to; {
+		// Prefer the walk that covers the most heights from h onwards
+		var best *rangeWalk
+		next := to + 1
+		for _, w := range candidates {
+			if w.from <= h && w.to >= h {
+				if best == nil || w.to > best.to {
+					best = w
+				}
+			} else if w.from > h && w.from < next {
+				next = w.from
+			}
+		}
+
+		end := next - 1
+		if best == nil {
+			best = &rangeWalk{from: h, to: end, tasks: tasks, done: make(chan struct{})}
+			s.walks = append(s.walks, best)
+			created = append(created, best)
+		} else if end = best.to; end > to {
+			end = to
+		}
+		best.users++
+		parts = append(parts, rangeWalkPart{walk: best, from: h, to: end})
+		h = end + 1
+	}
+	return parts, created
+}
+
+// finish records the outcome of a range walk. A walk that failed is removed so that later exports do not wait for it.
+func (s *rangeWalkSet) finish(w *rangeWalk, wi WalkInfo, err error) {
+	s.mu.Lock()
+	w.wi, w.err = wi, err
+	close(w.done)
+	remove := err != nil || w.users == 0
+	if remove {
+		s.forget(w)
+	}
+	s.mu.Unlock()
+
+	if remove && err == nil {
+		removeRangeWalk(w)
+	}
+}
+
+// release records that the exports using the parts no longer need their walks' output, removing the output of any
+// completed walk that is no longer needed.
+func (s *rangeWalkSet) release(parts []rangeWalkPart) {
+	var unused []*rangeWalk
+	s.mu.Lock()
+	for _, p := range parts {
+		p.walk.users--
+		if p.walk.users > 0 {
+			continue
+		}
+		select {
+		case <-p.walk.done:
+			if p.walk.err == nil {
+				s.forget(p.walk)
+				unused = append(unused, p.walk)
+			}
+		default:
+			// The walk's output is removed when it finishes
+		}
+	}
+	s.mu.Unlock()
+
+	for _, w := range unused {
+		removeRangeWalk(w)
+	}
+}
+
+// take removes the walk from the set if no other export is using its output, leaving the output in place for the
+// caller to ship. It reports whether the walk was taken.
+func (s *rangeWalkSet) take(w *rangeWalk) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.users != 1 {
+		return false
+	}
+	s.forget(w)
+	return true
+}
+
+// names returns the names of the completed walks in the set, whose output is still needed.
+func (s *rangeWalkSet) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, w := range s.walks {
+		if w.wi.Name != "" {
+			names = append(names, w.wi.Name)
+		}
+	}
+	return names
+}
+
+// forget removes the walk from the set. The caller must hold the lock.
+func (s *rangeWalkSet) forget(w *rangeWalk) {
+	for i := range s.walks {
+		if s.walks[i] == w {
+			s.walks = append(s.walks[:i], s.walks[i+1:]...)
+			return
+		}
+	}
+}
+
+// sharedRangeWalk produces the walk output for a ranged export, walking only the heights that are not already being
+// walked for another overlapping ranged export and copying the rest from the other exports' walks. The output is
+// assembled under a walk of its own so it can be verified and shipped like that of any other walk.
+func sharedRangeWalk(ctx context.Context, em *ExportManifest, ll basicLogger) (WalkInfo, error) {
+	tasks := walkTasksForManifest(em)
+	parts, created := rangeWalks.plan(em.Period.StartHeight, em.Period.EndHeight, tasks)
+	release := parts
+	defer func() { rangeWalks.release(release) }()
+
+	for _, w := range created {
+		go runRangeWalk(ctx, em, w, ll)
+	}
+	for _, p := range parts {
+		if !containsRangeWalk(created, p.walk) {
+			rangeWalksSharedCounter.Inc()
+			ll.Infow("sharing walk of overlapping range export", "from", p.from, "to", p.to, "walk_from", p.walk.from, "walk_to", p.walk.to)
+		}
+	}
+
+	for _, p := range parts {
+		select {
+		case <-p.walk.done:
+		case <-ctx.Done():
+			return WalkInfo{}, ctx.Err()
+		}
+		if p.walk.err != nil {
+			return WalkInfo{}, fmt.Errorf("walk heights %d to %d: %w", p.walk.from, p.walk.to, p.walk.err)
+		}
+	}
+
+	// A walk made for this export alone is used as it is
+	if len(parts) == 1 && containsRangeWalk(created, parts[0].walk) && rangeWalks.take(parts[0].walk) {
+		release = nil
+		return parts[0].walk.wi, nil
+	}
+
+	suffix := em.Period.String()
+	if em.Group != "" {
+		suffix += "-" + em.Group
+	}
+	name, err := unusedWalkName(storageConfig.path, suffix)
+	if err != nil {
+		return WalkInfo{}, fmt.Errorf("walk name: %w", err)
+	}
+	wi := WalkInfo{
+		Name:   name,
+		Path:   storageConfig.path,
+		Format: "csv",
+	}
+	if err := assembleRangeWalk(wi, parts, tasks); err != nil {
+		return WalkInfo{}, fmt.Errorf("assemble walk output: %w", err)
+	}
+	return wi, nil
+}
+
+func containsRangeWalk(walks []*rangeWalk, w *rangeWalk) bool {
+	for i := range walks {
+		if walks[i] == w {
+			return true
+		}
+	}
+	return false
+}
+
+// runRangeWalk runs the lily job for a range walk made by plan, using the configured type of job.
+func runRangeWalk(ctx context.Context, em *ExportManifest, w *rangeWalk, ll basicLogger) {
+	wm := &ExportManifest{
+		Period:  exportPeriodForRange(w.from, w.to, networkConfig.genesisTs),
+		Network: em.Network,
+		Files:   em.Files,
+		Group:   em.Group,
+	}
+
+	var wi WalkInfo
+	err := Retry(ctx, walkRetryPolicy(), attemptCondition(onLilyNode(func(apiAddr, apiToken string) func(context.Context) (bool, error) {
+		return exportJobIsCompleted(apiAddr, apiToken, wm, &wi, ll)
+	}, ll), errWalkFailed))
+	rangeWalks.finish(w, wi, err)
+}
+
+// rangeWalkTables returns the tables written by a walk of the tasks, including the processing reports and the
+// consensus table that every walk produces.
+func rangeWalkTables(tasks []string) []string {
+	run := map[string]bool{}
+	for _, task := range tasks {
+		run[task] = true
+	}
+	tables := []string{ProcessingReportsTable, "chain_consensus"}
+	for _, t := range TableList {
+		if run[t.Task] && t.Name != "chain_consensus" {
+			tables = append(tables, t.Name)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// rangeWalkHeightColumn returns the index of the height column of a table written by a walk, or -1 if it has none.
+func rangeWalkHeightColumn(table string) (int, error) {
+	if table == ProcessingReportsTable {
+		return 0, nil
+	}
+	layout, err := rowLayoutForTable(table)
+	if err != nil {
+		return -1, err
+	}
+	return layout.heightColumn, nil
+}
+
+// assembleRangeWalk writes the output of each table for the heights of each part, in order, to the walk files of wi.
+func assembleRangeWalk(wi WalkInfo, parts []rangeWalkPart, tasks []string) error {
+	for _, table := range rangeWalkTables(tasks) {
+		column, err := rangeWalkHeightColumn(table)
+		if err != nil {
+			return fmt.Errorf("row layout for %s: %w", table, err)
+		}
+		if err := assembleRangeWalkFile(wi.WalkFile(table), table, column, parts); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func assembleRangeWalkFile(path string, table string, column int, parts []rangeWalkPart) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DefaultFilePerms)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, p := range parts {
+		if err := copyRangeWalkRows(bw, p.walk.wi.WalkFile(table), column, p.from, p.to); err != nil {
+			f.Close()
+			os.Remove(path)
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// copyRangeWalkRows copies the csv records of a walk file whose height is between from and to. Every record is copied
+// when the table has no height column. A missing file holds no records.
+func copyRangeWalkRows(dst io.Writer, path string, column int, from, to int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+
+	if column < 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	sc := bufio.NewScanner(src)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	sc.Split(scanCSVRecords)
+	for sc.Scan() {
+		height, err := csvRecordHeight(sc.Bytes(), column)
+		if err != nil {
+			return err
+		}
+		if height < from || height > to {
+			continue
+		}
+		if _, err := dst.Write(sc.Bytes()); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	return nil
+}
+
+// removeRangeWalk removes the output of a range walk once no export needs it.
+func removeRangeWalk(w *rangeWalk) {
+	for _, table := range rangeWalkTables(w.tasks) {
+		if err := os.Remove(w.wi.WalkFile(table)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Errorw("failed to remove range walk file", "error", err, "file", w.wi.WalkFile(table))
+		}
+	}
+}
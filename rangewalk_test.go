@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRangeWalkPlan(t *testing.T) {
+	tasks := []string{"consensus", "block_header"}
+	s := &rangeWalkSet{}
+
+	parts, created := s.plan(0, 500, tasks)
+	if len(parts) != 1 || len(created) != 1 || parts[0].from != 0 || parts[0].to != 500 {
+		t.Fatalf("unexpected plan for the first range: %+v", parts)
+	}
+	first := created[0]
+
+	parts, created = s.plan(200, 700, []string{"consensus"})
+	if len(parts) != 2 || len(created) != 1 {
+		t.Fatalf("got %d parts and %d new walks for an overlapping range, wanted 2 and 1", len(parts), len(created))
+	}
+	if parts[0].walk != first || parts[0].from != 200 || parts[0].to != 500 {
+		t.Errorf("overlapping heights were not taken from the running walk: %+v", parts[0])
+	}
+	if parts[1].walk != created[0] || parts[1].from != 501 || parts[1].to != 700 || created[0].from != 501 || created[0].to != 700 {
+		t.Errorf("unexpected walk for the remaining heights: %+v", parts[1])
+	}
+	if first.users != 2 {
+		t.Errorf("got %d users of the shared walk, wanted 2", first.users)
+	}
+
+	parts, created = s.plan(100, 600, []string{"consensus", "message"})
+	if len(parts) != 1 || len(created) != 1 {
+		t.Errorf("walks that did not run every task were shared: %+v", parts)
+	}
+	s.release(parts)
+	s.finish(created[0], WalkInfo{}, os.ErrNotExist)
+	if len(s.walks) != 2 {
+		t.Errorf("got %d walks, wanted the failed walk to be forgotten", len(s.walks))
+	}
+}
+
+func TestAssembleRangeWalk(t *testing.T) {
+	dir := t.TempDir()
+	first := &rangeWalk{from: 0, to: 2, wi: WalkInfo{Name: "first", Path: dir, Format: "csv"}}
+	second := &rangeWalk{from: 3, to: 4, wi: WalkInfo{Name: "second", Path: dir, Format: "csv"}}
+
+	write := func(w *rangeWalk, table string, rows ...string) {
+		if err := os.WriteFile(w.wi.WalkFile(table), []byte(strings.Join(rows, "")), DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(first, "chain_consensus", "0,a,b,\"{x}\"\n", "1,a,b,\"{x}\"\n", "2,a,b,\"{x,\ny}\"\n")
+	write(second, "chain_consensus", "3,a,b,\"{x}\"\n", "4,a,b,\"{x}\"\n")
+	write(first, ProcessingReportsTable, "1,s,a,consensus,t,t,OK,,\n", "2,s,a,consensus,t,t,OK,,\n")
+
+	wi := WalkInfo{Name: "assembled", Path: dir, Format: "csv"}
+	parts := []rangeWalkPart{{walk: first, from: 1, to: 2}, {walk: second, from: 3, to: 3}}
+	if err := assembleRangeWalk(wi, parts, []string{"consensus"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(wi.WalkFile("chain_consensus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1,a,b,\"{x}\"\n2,a,b,\"{x,\ny}\"\n3,a,b,\"{x}\"\n"; string(data) != want {
+		t.Errorf("got consensus rows %q, wanted %q", data, want)
+	}
+	data, err = os.ReadFile(wi.WalkFile(ProcessingReportsTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1,s,a,consensus,t,t,OK,,\n2,s,a,consensus,t,t,OK,,\n"; string(data) != want {
+		t.Errorf("got processing reports %q, wanted %q", data, want)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// MinShipBurst is the smallest number of bytes a bandwidth limit allows to be sent at once, so that low limits do not
+// break writes into tiny pieces.
+const MinShipBurst = 64 << 10 // 64 KiB
+
+// tokenBucket limits the rate at which bytes are sent. The bucket holds up to one second of tokens so a destination
+// that has been idle may send a short burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens held
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate)
+	if burst < MinShipBurst {
+		burst = MinShipBurst
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent. n must not exceed the burst size of the bucket. Tokens are taken immediately
+// so concurrent callers queue behind each other rather than racing for the same tokens.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// waitN blocks until n bytes may be sent, taking tokens in pieces no larger than the burst size.
+func (b *tokenBucket) waitN(ctx context.Context, n int) error {
+	for n > 0 {
+		chunk := n
+		if chunk > int(b.burst) {
+			chunk = int(b.burst)
+		}
+		if err := b.wait(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// rateLimitedWriter limits the rate that bytes are written to w.
+type rateLimitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	b   *tokenBucket
+}
+
+func (l *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > int(l.b.burst) {
+			chunk = chunk[:int(l.b.burst)]
+		}
+		if err := l.b.wait(l.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := l.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimitedReader limits the rate that bytes are read from r, for request bodies that are read by an http client.
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *tokenBucket
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(l.b.burst) {
+		p = p[:int(l.b.burst)]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.b.wait(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// shipLimits holds the bandwidth limit and concurrency cap of a destination. A nil shipLimits imposes no limits.
+type shipLimits struct {
+	bucket *tokenBucket  // nil if bandwidth is not limited
+	slots  chan struct{} // nil if concurrency is not limited
+}
+
+// destinationLimits holds the limits of each destination, keyed by location, so that every shipper for the same
+// destination shares them.
+var destinationLimits = struct {
+	sync.Mutex
+	limits map[string]*shipLimits
+}{limits: map[string]*shipLimits{}}
+
+// shipLimitsFor returns the limits for a destination using the configured bandwidth and concurrency, or nil if
+// shipping is not limited.
+func shipLimitsFor(location string) *shipLimits {
+	if shippingConfig.bandwidth <= 0 && shippingConfig.concurrency <= 0 {
+		return nil
+	}
+
+	destinationLimits.Lock()
+	defer destinationLimits.Unlock()
+	if l, ok := destinationLimits.limits[location]; ok {
+		return l
+	}
+	l := &shipLimits{}
+	if shippingConfig.bandwidth > 0 {
+		l.bucket = newTokenBucket(shippingConfig.bandwidth)
+	}
+	if shippingConfig.concurrency > 0 {
+		l.slots = make(chan struct{}, shippingConfig.concurrency)
+	}
+	destinationLimits.limits[location] = l
+	return l
+}
+
+// acquire waits for a free shipping slot at the destination. The returned function releases the slot.
+func (l *shipLimits) acquire(ctx context.Context) (func(), error) {
+	if l == nil || l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitN blocks until n bytes may be sent to the destination.
+func (l *shipLimits) waitN(ctx context.Context, n int) error {
+	if l == nil || l.bucket == nil {
+		return nil
+	}
+	return l.bucket.waitN(ctx, n)
+}
+
+// writer returns a writer that limits the rate bytes are written to w.
+func (l *shipLimits) writer(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil || l.bucket == nil {
+		return w
+	}
+	return &rateLimitedWriter{ctx: ctx, w: w, b: l.bucket}
+}
+
+// reader returns a reader that limits the rate bytes are read from r.
+func (l *shipLimits) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.bucket == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, b: l.bucket}
+}
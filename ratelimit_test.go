@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedWriter(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rate    int64
+		size    int
+		minTime time.Duration
+	}{
+		{name: "within burst", rate: 1 << 20, size: 512 << 10, minTime: 0},
+		{name: "beyond burst", rate: 1 << 20, size: 3 << 19, minTime: 400 * time.Millisecond},
+		{name: "below minimum burst", rate: 32 << 10, size: 80 << 10, minTime: 400 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("x"), tc.size)
+			var buf bytes.Buffer
+			w := &rateLimitedWriter{ctx: context.Background(), w: &buf, b: newTokenBucket(tc.rate)}
+
+			start := time.Now()
+			n, err := w.Write(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tc.minTime {
+				t.Errorf("write took %s, wanted at least %s", elapsed, tc.minTime)
+			}
+			if n != tc.size || !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("got %d bytes written, wanted %d", n, tc.size)
+			}
+		})
+	}
+}
+
+func TestShipLimitsAcquire(t *testing.T) {
+	l := &shipLimits{slots: make(chan struct{}, 1)}
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); err == nil {
+		t.Errorf("acquired a second slot, wanted the cap to be enforced")
+	}
+
+	release()
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Errorf("unexpected error after release: %v", err)
+	}
+
+	var unlimited *shipLimits
+	if _, err := unlimited.acquire(context.Background()); err != nil {
+		t.Errorf("unexpected error from unlimited destination: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+var reexportCommand = &cli.Command{
+	Name:   "reexport",
+	Usage:  "Re-walk and replace the shipped files of tables for a date, such as after a lily bug corrupted them.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		lilyFlags,
+		jobFlags,
+		storageFlags,
+		stateFlags,
+		auditFlags,
+		claimFlags,
+		verificationFlags,
+		shippingFlags,
+		destinationsFlags,
+		hooksFlags,
+		objectStoreFlags,
+		ipfsFlags,
+		tableConfigFlags,
+		signingFlags,
+		shipFormatFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path used to write verified exports from lily, or an s3://bucket/prefix or gs://bucket/prefix object store location.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "date",
+				Usage:    "Date of the export to replace, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "tables",
+				Usage:    "Comma separated list of tables whose files are replaced.",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the files that would be replaced without exporting anything.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		d, err := DateFromString(cc.String("date"))
+		if err != nil {
+			return fmt.Errorf("invalid date: %w", err)
+		}
+		p, err := exportPeriodForDate(d, networkConfig.genesisTs)
+		if err != nil {
+			return fmt.Errorf("invalid date: %w", err)
+		}
+		if CurrentHeight(networkConfig.genesisTs) <= p.EndHeight+ExportDelay {
+			return fmt.Errorf("the export for %s is not due yet, so it cannot be replaced", d.String())
+		}
+
+		names, err := parseTableList(cc.String("tables"))
+		if err != nil {
+			return fmt.Errorf("invalid tables: %w", err)
+		}
+		var tables []Table
+		for _, name := range names {
+			tables = append(tables, TablesByName[name])
+		}
+
+		targets, err := shipTargetsFromFlags(cc)
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("unable to ship files: %w", err)
+		}
+		sh = withShipDestinations(sh)
+
+		if err := loadZstdDictionaries(ctx, sh); err != nil {
+			return err
+		}
+
+		if shippingConfig.stagingPath != "" {
+			if err := verifyShipPath(shippingConfig.stagingPath); err != nil {
+				return fmt.Errorf("unable to write to staging path: %w", err)
+			}
+		}
+
+		em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+		if err != nil {
+			return fmt.Errorf("failed to create manifest: %w", err)
+		}
+		if err := markForReexport(em, names); err != nil {
+			return err
+		}
+
+		for _, ef := range em.Files {
+			fmt.Printf("replacing %s\n", ef.Path())
+		}
+		if cc.Bool("dry-run") {
+			return nil
+		}
+		ar := newAuditRecord(AuditReexport, em.Network, em.Period)
+		ar.Tables = names
+		auditLog.Record(ar)
+
+		if lilyNodes.Len() > 1 {
+			go lilyNodes.Run(ctx, lilyConfig.healthInterval)
+		}
+
+		// The existing files are only replaced once the new walk output has passed verification. Each replacement is
+		// compressed to a temporary file that is then renamed over the existing one.
+		if err := WaitUntil(ctx, reexportIsProcessed(em, sh), 0, time.Minute*15); err != nil {
+			if ctx.Err() != nil {
+				logger.Info("shutting down")
+				return nil
+			}
+			return fmt.Errorf("fatal error processing export: %w", err)
+		}
+
+		if err := updateHeightIndex(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, targets); err != nil {
+			logger.Errorw("failed to update height index", "error", err, "date", p.Date.String())
+		}
+
+		logger.Infow("reexport complete", "date", p.Date.String(), "tables", strings.Join(names, ","))
+		return nil
+	},
+}
+
+// markForReexport marks every file of the manifest as needing shipping so that it is replaced. Only files that have
+// already been shipped may be replaced, and files annotated as known bad are never exported.
+func markForReexport(em *ExportManifest, tables []string) error {
+	found := map[string]bool{}
+	for _, ef := range em.Files {
+		found[familyOf(ef.TableName)] = true
+		if ef.Annotation != nil {
+			return fmt.Errorf("%s is annotated as known bad for %s and will not be exported: %s", ef.TableName, em.Period.Date.String(), ef.Annotation.Reason)
+		}
+		if !ef.Shipped {
+			return fmt.Errorf("%s has not been shipped, use the run command to export it", ef.Path())
+		}
+	}
+	for _, table := range tables {
+		// Only one variant of a family is expected to have been exported for the period
+		if !found[familyOf(table)] {
+			return fmt.Errorf("table %s is not exported for %s", table, em.Period.Date.String())
+		}
+	}
+
+	for _, ef := range em.Files {
+		ef.Shipped = false
+	}
+	return nil
+}
+
+// reexportIsProcessed runs the export for a manifest whose files have been marked for replacement, retrying until it
+// succeeds. The manifest is reused between attempts since the replaced files still exist in the ship path.
+func reexportIsProcessed(em *ExportManifest, sh Shipper) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		claim, err := claimPeriod(em.Network, em.Period, false)
+		if err != nil {
+			if errors.Is(err, ErrPeriodClaimed) {
+				logger.Infow("period claimed by another instance, waiting", "date", em.Period.Date.String(), "reason", err)
+				return false, nil
+			}
+			processExportErrorsCounter.Inc()
+			logger.Errorw("failed to claim period", "error", err, "date", em.Period.Date.String())
+			return false, nil // force a retry
+		}
+		defer claim.Release()
+
+		if err := processExport(ctx, em, sh); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err() // shutting down
+			}
+			processExportErrorsCounter.Inc()
+			logger.Errorw("failed to process reexport", "error", err, "date", em.Period.Date.String())
+			return false, nil // force a retry
+		}
+		return true, nil
+	}
+}
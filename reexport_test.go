@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMarkForReexport(t *testing.T) {
+	file := func(table string, shipped bool, annotation *Annotation) *ExportFile {
+		return &ExportFile{TableName: table, Format: "csv", Compression: CompressionByName["gz"], Shipped: shipped, Annotation: annotation}
+	}
+
+	testCases := []struct {
+		name    string
+		files   []*ExportFile
+		tables  []string
+		wantErr bool
+	}{
+		{name: "shipped", files: []*ExportFile{file("messages", true, nil), file("blocks", true, nil)}, tables: []string{"messages", "blocks"}},
+		{name: "not shipped", files: []*ExportFile{file("messages", true, nil), file("blocks", false, nil)}, tables: []string{"messages", "blocks"}, wantErr: true},
+		{name: "annotated", files: []*ExportFile{file("messages", true, &Annotation{Reason: "bad data"})}, tables: []string{"messages"}, wantErr: true},
+		{name: "table not expected", files: []*ExportFile{file("messages", true, nil)}, tables: []string{"messages", "blocks"}, wantErr: true},
+		{name: "active variant", files: []*ExportFile{file("miner_sector_infos_v7", true, nil)}, tables: []string{"miner_sector_infos", "miner_sector_infos_v7"}},
+		{name: "variant not shipped", files: []*ExportFile{file("miner_sector_infos", true, nil), file("miner_sector_infos_v7", false, nil)}, tables: []string{"miner_sector_infos", "miner_sector_infos_v7"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			em := &ExportManifest{Files: tc.files}
+			err := markForReexport(em, tc.tables)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !em.HasUnshippedFiles() || len(em.Files) != len(tc.files) {
+				t.Errorf("files were not marked for shipping")
+			}
+			for _, ef := range em.Files {
+				if ef.Shipped {
+					t.Errorf("%s is still marked as shipped", ef.TableName)
+				}
+			}
+		})
+	}
+}
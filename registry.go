@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// TableRegistryVersion is the newest version of the table registry format that the archiver reads.
+const TableRegistryVersion = 1
+
+// TableRegistry describes the tables lily writes, so that tables added or changed by a lily release can be exported
+// without a new release of the archiver. A registry is read from a descriptor published with lily and from local
+// overrides, and is merged with the tables the archiver is built with.
+type TableRegistry struct {
+	Version     int              `json:"version"`                // format of the registry, see TableRegistryVersion
+	LilyVersion string           `json:"lily_version,omitempty"` // lily release the tables were described from
+	Tables      []*RegistryTable `json:"tables"`
+}
+
+// RegistryTable describes a single table in a table registry. Fields that are empty leave those of a table the
+// archiver already knows unchanged, so an override need only give the fields it changes. A table the archiver does not
+// know must give its task, schema and columns.
+type RegistryTable struct {
+	Name            string               `json:"name"`
+	Task            string               `json:"task,omitempty"`
+	Schema          int                  `json:"schema,omitempty"`
+	NetworkVersions *NetworkVersionRange `json:"network_versions,omitempty"`
+	Family          string               `json:"family,omitempty"`
+	Experimental    *bool                `json:"experimental,omitempty"`
+	PrimaryKey      []string             `json:"primary_key,omitempty"`
+	Columns         []*ColumnDescriptor  `json:"columns,omitempty"` // in the order lily writes them, replacing the built in model
+	Removed         bool                 `json:"removed,omitempty"` // the table is not exported at all
+}
+
+// loadTableRegistry reads a table registry from a file or an http(s) URL.
+func loadTableRegistry(ctx context.Context, location string) (*TableRegistry, error) {
+	var data []byte
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, fmt.Errorf("new request: %w", err)
+		}
+		resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("get: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("get: unexpected status %s", resp.Status)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+	}
+
+	reg := &TableRegistry{}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if reg.Version < 1 || reg.Version > TableRegistryVersion {
+		return nil, fmt.Errorf("unsupported registry version %d, expected at most %d", reg.Version, TableRegistryVersion)
+	}
+	return reg, nil
+}
+
+// mergeTableRegistry returns the tables that result from applying a registry to a list of tables. Tables the registry
+// describes are changed or removed in place and new tables are added at the end in registry order. Tables with
+// columns in the registry use them as their model in place of the lily model the archiver is built with.
+func mergeTableRegistry(tables []Table, reg *TableRegistry) ([]Table, error) {
+	index := map[string]int{}
+	merged := make([]Table, len(tables))
+	copy(merged, tables)
+	for i, t := range merged {
+		index[t.Name] = i
+	}
+
+	seen := map[string]bool{}
+	removed := map[string]bool{}
+	for _, rt := range reg.Tables {
+		if rt.Name == "" {
+			return nil, fmt.Errorf("table with no name")
+		}
+		if seen[rt.Name] {
+			return nil, fmt.Errorf("table %s is described more than once", rt.Name)
+		}
+		seen[rt.Name] = true
+
+		i, known := index[rt.Name]
+		if rt.Removed {
+			if known {
+				removed[rt.Name] = true
+			}
+			continue
+		}
+
+		t := Table{Name: rt.Name, NetworkVersionRange: AllNetWorkVersions}
+		if known {
+			t = merged[i]
+		} else if rt.Task == "" || rt.Schema == 0 || len(rt.Columns) == 0 {
+			return nil, fmt.Errorf("table %s is not known, so its task, schema and columns must be given", rt.Name)
+		}
+
+		if rt.Task != "" {
+			t.Task = rt.Task
+		}
+		if rt.Schema != 0 {
+			t.Schema = rt.Schema
+		}
+		if rt.NetworkVersions != nil {
+			if rt.NetworkVersions.From > rt.NetworkVersions.To {
+				return nil, fmt.Errorf("table %s: network versions run from %d to %d", rt.Name, rt.NetworkVersions.From, rt.NetworkVersions.To)
+			}
+			t.NetworkVersionRange = *rt.NetworkVersions
+		}
+		if rt.Family != "" {
+			t.Family = rt.Family
+		}
+		if rt.Experimental != nil {
+			t.Experimental = *rt.Experimental
+		}
+		if len(rt.Columns) > 0 {
+			td, err := registryTableDescriptor(rt)
+			if err != nil {
+				return nil, fmt.Errorf("table %s: %w", rt.Name, err)
+			}
+			td.Task, td.Schema = t.Task, t.Schema
+			t.Model = td
+		} else if len(rt.PrimaryKey) > 0 {
+			return nil, fmt.Errorf("table %s: a primary key can only be given with the columns", rt.Name)
+		}
+
+		if known {
+			merged[i] = t
+		} else {
+			index[t.Name] = len(merged)
+			merged = append(merged, t)
+		}
+	}
+
+	out := merged[:0]
+	for _, t := range merged {
+		if !removed[t.Name] {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// registryTableDescriptor returns the descriptor used as the model of a table given columns by a registry. The primary
+// key is taken from the columns marked as part of it when the table does not list it.
+func registryTableDescriptor(rt *RegistryTable) (*TableDescriptor, error) {
+	td := &TableDescriptor{Table: rt.Name, Task: rt.Task, Schema: rt.Schema, PrimaryKey: rt.PrimaryKey}
+	names := map[string]bool{}
+	for _, c := range rt.Columns {
+		if c == nil || c.Name == "" || c.Type == "" {
+			return nil, fmt.Errorf("every column must have a name and type")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("column %s is given more than once", c.Name)
+		}
+		names[c.Name] = true
+		if len(rt.PrimaryKey) == 0 && c.PrimaryKey {
+			td.PrimaryKey = append(td.PrimaryKey, c.Name)
+		}
+	}
+
+	isKey := map[string]bool{}
+	for _, name := range td.PrimaryKey {
+		if !names[name] {
+			return nil, fmt.Errorf("primary key column %s is not a column of the table", name)
+		}
+		isKey[name] = true
+	}
+	for _, c := range rt.Columns {
+		col := *c
+		col.PrimaryKey = isKey[c.Name]
+		td.Columns = append(td.Columns, &col)
+	}
+	return td, nil
+}
+
+// tableRegistryFor describes a list of tables as a registry.
+func tableRegistryFor(tables []Table) (*TableRegistry, error) {
+	reg := &TableRegistry{Version: TableRegistryVersion}
+	for _, t := range tables {
+		td, err := TableDescriptorFor(t, t.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("describe %s: %w", t.Name, err)
+		}
+		rt := &RegistryTable{
+			Name:       t.Name,
+			Task:       t.Task,
+			Schema:     t.Schema,
+			Family:     t.Family,
+			PrimaryKey: td.PrimaryKey,
+			Columns:    td.Columns,
+		}
+		if t.NetworkVersionRange != AllNetWorkVersions {
+			nvr := t.NetworkVersionRange
+			rt.NetworkVersions = &nvr
+		}
+		if t.Experimental {
+			experimental := true
+			rt.Experimental = &experimental
+		}
+		reg.Tables = append(reg.Tables, rt)
+	}
+	return reg, nil
+}
+
+// configureTableRegistry applies the table registry and then the local overrides, when given, to the tables the
+// archiver exports.
+func configureTableRegistry(ctx context.Context, location string, overrides string) error {
+	tables := TableList
+	for _, loc := range []string{location, overrides} {
+		if loc == "" {
+			continue
+		}
+		reg, err := loadTableRegistry(ctx, loc)
+		if err != nil {
+			return fmt.Errorf("load %s: %w", loc, err)
+		}
+		if tables, err = mergeTableRegistry(tables, reg); err != nil {
+			return fmt.Errorf("%s: %w", loc, err)
+		}
+		logger.Infow("applied table registry", "registry", loc, "lily_version", reg.LilyVersion, "tables", len(reg.Tables))
+	}
+	if location == "" && overrides == "" {
+		return nil
+	}
+	TableList = tables
+	indexTables()
+	return nil
+}
+
+var tableRegistryCommand = &cli.Command{
+	Name:   "table-registry",
+	Usage:  "Write the table registry the archiver is using as JSON, for publishing with a lily release or editing as overrides.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+	),
+	Action: func(cc *cli.Context) error {
+		reg, err := tableRegistryFor(TableList)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(reg, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
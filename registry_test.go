@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/network"
+)
+
+func TestMergeTableRegistry(t *testing.T) {
+	experimental := true
+	reg := &TableRegistry{
+		Version: 1,
+		Tables: []*RegistryTable{
+			{
+				Name:            "miner_beneficiaries",
+				Task:            "miner_beneficiary",
+				Schema:          1,
+				NetworkVersions: &NetworkVersionRange{From: NetworkVersionFEVM, To: network.VersionMax},
+				Columns: []*ColumnDescriptor{
+					{Name: "height", Type: "bigint", GoType: "int64", PrimaryKey: true},
+					{Name: "miner_id", Type: "text", GoType: "string", PrimaryKey: true},
+					{Name: "quota", Type: "numeric", GoType: "string"},
+					{Name: "expiration", Type: "bigint", GoType: "*int64", Nullable: true},
+				},
+			},
+			{Name: "messages", Experimental: &experimental},
+			{Name: "multisig_approvals", Removed: true},
+		},
+	}
+
+	tables, err := mergeTableRegistry(TableList, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]Table{}
+	for _, table := range tables {
+		byName[table.Name] = table
+	}
+	if _, ok := byName["multisig_approvals"]; ok || len(tables) != len(TableList) {
+		t.Errorf("got %d tables, wanted multisig_approvals removed and one table added to %d", len(tables), len(TableList))
+	}
+	if m := byName["messages"]; !m.Experimental || m.Task != TablesByName["messages"].Task || m.Model != TablesByName["messages"].Model {
+		t.Errorf("got messages %+v, wanted only experimental changed", m)
+	}
+	if TablesByName["messages"].Experimental {
+		t.Errorf("merging changed the existing tables")
+	}
+
+	mb := byName["miner_beneficiaries"]
+	if mb.Task != "miner_beneficiary" || mb.NetworkVersionRange.From != NetworkVersionFEVM || mb.supportedAtVersion(network.Version17) {
+		t.Errorf("got table %+v", mb)
+	}
+	headers, err := TableHeaders(mb.Model)
+	if err != nil || !reflect.DeepEqual(headers, []string{"height", "miner_id", "quota", "expiration"}) {
+		t.Errorf("got headers %v (%v)", headers, err)
+	}
+	keys, err := TableKeyColumns(mb.Model)
+	if err != nil || !reflect.DeepEqual(keys, []string{"height", "miner_id"}) {
+		t.Errorf("got primary key %v (%v)", keys, err)
+	}
+	schema, err := TableSchema(mb.Model)
+	if err != nil || !strings.HasPrefix(schema, "create table miner_beneficiaries (\n  \"height\" bigint,") {
+		t.Errorf("got schema %q (%v)", schema, err)
+	}
+	cols, err := parquetColumnsForModel(mb.Model)
+	if err != nil || cols[0].Type != parquetInt64 || cols[2].ConvertedType != parquetUTF8 || !cols[3].Nullable {
+		t.Errorf("got parquet columns %+v (%v)", cols, err)
+	}
+
+	for _, invalid := range []*RegistryTable{
+		{Name: "unknown_table", Task: "unknown"},
+		{Name: "messages", PrimaryKey: []string{"cid"}},
+		{Name: "messages", Columns: []*ColumnDescriptor{{Name: "cid", Type: "text"}}, PrimaryKey: []string{"height"}},
+		{Name: "messages", Columns: []*ColumnDescriptor{{Name: "cid", Type: "text"}, {Name: "cid", Type: "text"}}},
+		{Name: "messages", NetworkVersions: &NetworkVersionRange{From: NetworkVersionFEVM, To: network.Version17}},
+	} {
+		if _, err := mergeTableRegistry(TableList, &TableRegistry{Version: 1, Tables: []*RegistryTable{invalid}}); err == nil {
+			t.Errorf("expected an error merging %+v", invalid)
+		}
+	}
+}
+
+func TestTableRegistryRoundTrip(t *testing.T) {
+	reg, err := tableRegistryFor(TableList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &TableRegistry{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every table described by a registry is written exactly as it is from its lily model
+	tables, err := mergeTableRegistry(nil, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != len(TableList) {
+		t.Fatalf("got %d tables, wanted %d", len(tables), len(TableList))
+	}
+	for i, table := range tables {
+		builtin := TableList[i]
+		if table.Name != builtin.Name || table.Task != builtin.Task || table.NetworkVersionRange != builtin.NetworkVersionRange || table.Family != builtin.Family || table.Experimental != builtin.Experimental {
+			t.Errorf("got table %+v, wanted %+v", table, builtin)
+		}
+		for name, describe := range map[string]func(interface{}) (interface{}, error){
+			"headers":     func(v interface{}) (interface{}, error) { return TableHeaders(v) },
+			"primary key": func(v interface{}) (interface{}, error) { return TableKeyColumns(v) },
+			"parquet":     func(v interface{}) (interface{}, error) { return parquetColumnsForModel(v) },
+		} {
+			got, err := describe(table.Model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := describe(builtin.Model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: got %s %v, wanted %v", table.Name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestConfigureTableRegistry(t *testing.T) {
+	defer func(tables []Table) {
+		TableList = tables
+		indexTables()
+	}(TableList)
+
+	dir := t.TempDir()
+	write := func(name string, reg *TableRegistry) string {
+		data, err := json.Marshal(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	registry := write("registry.json", &TableRegistry{Version: 1, LilyVersion: "v0.18.0", Tables: []*RegistryTable{
+		{Name: "miner_beneficiaries", Task: "miner_beneficiary", Schema: 1, Columns: []*ColumnDescriptor{{Name: "height", Type: "bigint", GoType: "int64"}}},
+	}})
+	overrides := write("overrides.json", &TableRegistry{Version: 1, Tables: []*RegistryTable{
+		{Name: "miner_beneficiaries", Task: "miner_beneficiary_v2"},
+	}})
+
+	if err := configureTableRegistry(context.Background(), registry, overrides); err != nil {
+		t.Fatal(err)
+	}
+	if TablesByName["miner_beneficiaries"].Task != "miner_beneficiary_v2" {
+		t.Errorf("got table %+v, wanted the task from the overrides", TablesByName["miner_beneficiaries"])
+	}
+	if _, ok := KnownTasks["miner_beneficiary_v2"]; !ok {
+		t.Errorf("task of the registered table is not known")
+	}
+
+	unsupported := write("unsupported.json", &TableRegistry{Version: TableRegistryVersion + 1})
+	if err := configureTableRegistry(context.Background(), unsupported, ""); err == nil {
+		t.Errorf("expected an error for an unsupported registry version")
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// DefaultRemoteSamples is the number of ranges of each file compared with the local copy by verify-remote.
+	DefaultRemoteSamples = 8
+
+	// DefaultRemoteSampleSize is the number of bytes in each range sampled by verify-remote.
+	DefaultRemoteSampleSize = 64 << 10 // 64 KiB
+)
+
+// RemoteFileCheck is the outcome of checking a file in a remote mirror against its entry in a period manifest.
+type RemoteFileCheck string
+
+const (
+	RemoteFileOK               RemoteFileCheck = "ok"
+	RemoteFileMissing          RemoteFileCheck = "file missing"
+	RemoteFileSizeMismatch     RemoteFileCheck = "size mismatch"
+	RemoteFileChecksumMismatch RemoteFileCheck = "checksum mismatch"
+	RemoteFileSampleMismatch   RemoteFileCheck = "sample mismatch"
+	RemoteFileSizeOnly         RemoteFileCheck = "size only" // matched in size but could not be sampled without a local copy
+)
+
+// Methods by which a remote file that matched its manifest entry was checked, from least to most data fetched.
+const (
+	RemoteMethodETag    = "etag"    // the mirror's etag matched the MD5 or multipart etag of the local copy
+	RemoteMethodHashed  = "hashed"  // the whole file was fetched, since it was no larger than the samples
+	RemoteMethodSampled = "sampled" // ranges of the file matched the same ranges of the local copy
+)
+
+// RemoteVerifyOptions controls how the files of a remote mirror are checked.
+type RemoteVerifyOptions struct {
+	Samples    int     // number of ranges compared for each file, including its first and last
+	SampleSize int64   // bytes in each range
+	Seed       int64   // varies the ranges sampled between runs, so that repeated runs cover more of each file
+	LocalRoot  string  // ship path holding the local copies of the files
+	PartSizes  []int64 // candidate part sizes of multipart uploads to the mirror
+}
+
+// RemoteFileResult is the result of checking one file of a remote mirror.
+type RemoteFileResult struct {
+	Path    string
+	Check   RemoteFileCheck
+	Method  string // how a matching file was checked, see RemoteMethodETag
+	Fetched int64  // bytes of file contents fetched from the mirror
+}
+
+// remoteFileInfo describes a file held by a remote mirror.
+type remoteFileInfo struct {
+	Size int64 // -1 if the mirror did not report it
+	ETag string
+}
+
+// Stat returns the size and etag of a file in the archive using a HEAD request. It returns errNotFoundAtSource if
+// there is no such file.
+func (s *HTTPMirrorSource) Stat(ctx context.Context, rel string) (*remoteFileInfo, error) {
+	u := *s.Base
+	u.Path = path.Join(u.Path, filepath.ToSlash(rel))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("head %s: %w", u.String(), err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &remoteFileInfo{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+	case http.StatusNotFound:
+		return nil, errNotFoundAtSource
+	default:
+		return nil, fmt.Errorf("head %s: unexpected status %s", u.String(), resp.Status)
+	}
+}
+
+// ReadRange returns length bytes of a file in the archive starting at offset, using a range request. Servers that
+// ignore the range are only accepted when the range starts at the beginning of the file, since the rest of the file
+// would otherwise be downloaded to reach it.
+func (s *HTTPMirrorSource) ReadRange(ctx context.Context, rel string, offset, length int64) ([]byte, error) {
+	u := *s.Base
+	u.Path = path.Join(u.Path, filepath.ToSlash(rel))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", u.String(), err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+	case resp.StatusCode == http.StatusOK:
+		return nil, fmt.Errorf("get %s: server does not support range requests", u.String())
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errNotFoundAtSource
+	default:
+		return nil, fmt.Errorf("get %s: unexpected status %s", u.String(), resp.Status)
+	}
+
+	buf := make([]byte, length)
+	n, err := io.ReadFull(resp.Body, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("read %s: %w", u.String(), err)
+	}
+	return buf[:n], nil
+}
+
+// retryRemote retries a request to a remote mirror with the request policy. Files that are missing are not retried.
+func retryRemote(ctx context.Context, fn func(context.Context) error) error {
+	return Retry(ctx, requestRetryPolicy(), func(ctx context.Context) error {
+		err := fn(ctx)
+		if errors.Is(err, errNotFoundAtSource) {
+			return Permanent(err)
+		}
+		return err
+	})
+}
+
+// checkRemoteFile checks a file held by a remote mirror against its manifest entry while fetching as little of it as
+// possible. The size reported by the mirror is compared first, then its etag with that of the local copy. Files no
+// larger than the samples are fetched whole and hashed. Ranges of larger files are compared with the same ranges of
+// the local copy, always including the first and last so that truncated and misplaced files are found.
+func checkRemoteFile(ctx context.Context, src *HTTPMirrorSource, f *PeriodManifestFile, opts RemoteVerifyOptions) (*RemoteFileResult, error) {
+	res := &RemoteFileResult{Path: f.Path}
+
+	var info *remoteFileInfo
+	err := retryRemote(ctx, func(ctx context.Context) error {
+		var err error
+		info, err = src.Stat(ctx, f.Path)
+		return err
+	})
+	if errors.Is(err, errNotFoundAtSource) {
+		res.Check = RemoteFileMissing
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Size >= 0 && info.Size != f.Size {
+		res.Check = RemoteFileSizeMismatch
+		return res, nil
+	}
+
+	local := filepath.Join(opts.LocalRoot, filepath.FromSlash(f.Path))
+	hasLocal := false
+	if fi, err := os.Stat(local); err == nil && fi.Size() == f.Size {
+		hasLocal = true
+	}
+	if hasLocal && info.ETag != "" {
+		match, err := etagMatchesFile(info.ETag, local, f.Size, opts.PartSizes)
+		if err != nil {
+			return nil, fmt.Errorf("etag of local copy: %w", err)
+		}
+		if match {
+			res.Check, res.Method = RemoteFileOK, RemoteMethodETag
+			return res, nil
+		}
+	}
+
+	if f.Size <= int64(opts.Samples)*opts.SampleSize {
+		var data []byte
+		if f.Size > 0 {
+			err := retryRemote(ctx, func(ctx context.Context) error {
+				var err error
+				data, err = src.ReadRange(ctx, f.Path, 0, f.Size)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		res.Fetched = int64(len(data))
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			res.Check = RemoteFileChecksumMismatch
+			return res, nil
+		}
+		res.Check, res.Method = RemoteFileOK, RemoteMethodHashed
+		return res, nil
+	}
+
+	if !hasLocal {
+		res.Check = RemoteFileSizeOnly
+		return res, nil
+	}
+
+	lf, err := os.Open(local)
+	if err != nil {
+		return nil, fmt.Errorf("open local copy: %w", err)
+	}
+	defer lf.Close()
+
+	remoteSum, localSum := sha256.New(), sha256.New()
+	for _, offset := range sampleOffsets(f.Path, f.Size, opts) {
+		var data []byte
+		err := retryRemote(ctx, func(ctx context.Context) error {
+			var err error
+			data, err = src.ReadRange(ctx, f.Path, offset, opts.SampleSize)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Fetched += int64(len(data))
+		remoteSum.Write(data)
+
+		want := make([]byte, opts.SampleSize)
+		n, err := lf.ReadAt(want, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("read local copy: %w", err)
+		}
+		localSum.Write(want[:n])
+	}
+	if !bytes.Equal(remoteSum.Sum(nil), localSum.Sum(nil)) {
+		res.Check = RemoteFileSampleMismatch
+		return res, nil
+	}
+	res.Check, res.Method = RemoteFileOK, RemoteMethodSampled
+	return res, nil
+}
+
+// sampleOffsets returns the sorted offsets of the ranges of a file to sample. The first and last ranges of the file
+// are always sampled and the others are chosen pseudo-randomly from the file's path and the seed, so that a run can
+// be repeated exactly.
+func sampleOffsets(rel string, size int64, opts RemoteVerifyOptions) []int64 {
+	last := size - opts.SampleSize
+	if last <= 0 {
+		return []int64{0}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(rel))
+	rng := rand.New(rand.NewSource(int64(h.Sum64()) ^ opts.Seed))
+
+	offsets := []int64{0, last}
+	for i := 2; i < opts.Samples; i++ {
+		offsets = append(offsets, rng.Int63n(last))
+	}
+	sort.Slice(offsets, func(a, b int) bool { return offsets[a] < offsets[b] })
+	return offsets
+}
+
+// etagMatchesFile reports whether an etag reported by a mirror is that of a local file. S3 and compatible stores give
+// a single part upload the MD5 of its contents, and a multipart upload the MD5 of its parts' MD5s followed by the
+// number of parts. The part size of a multipart upload is not recorded, so the etag is compared for each candidate
+// part size that gives the same number of parts. Etags in other forms never match.
+func etagMatchesFile(etag string, file string, size int64, partSizes []int64) (bool, error) {
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	digest, count := etag, int64(0)
+	if i := strings.IndexByte(etag, '-'); i >= 0 {
+		n, err := strconv.ParseInt(etag[i+1:], 10, 64)
+		if err != nil || n < 1 {
+			return false, nil
+		}
+		digest, count = etag[:i], n
+	}
+	if len(digest) != 2*md5.Size {
+		return false, nil
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return false, nil
+	}
+
+	if count == 0 {
+		sums, err := partDigests(file, size+1)
+		return err == nil && hex.EncodeToString(sums) == digest, err
+	}
+	tried := map[int64]bool{}
+	for _, ps := range partSizes {
+		if ps <= 0 || tried[ps] || (size+ps-1)/ps != count {
+			continue
+		}
+		tried[ps] = true
+		sums, err := partDigests(file, ps)
+		if err != nil {
+			return false, err
+		}
+		if sum := md5.Sum(sums); hex.EncodeToString(sum[:]) == digest {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// partDigests returns the concatenated MD5s of the parts of the given size that a file is uploaded in.
+func partDigests(file string, partSize int64) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sums []byte
+	for {
+		h := md5.New()
+		n, err := io.Copy(h, io.LimitReader(f, partSize))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && len(sums) > 0 {
+			break
+		}
+		sums = h.Sum(sums)
+		if n < partSize {
+			break
+		}
+	}
+	return sums, nil
+}
+
+// verifyRemote checks files listed in period manifests against a remote mirror using a number of workers, returning
+// the results in the order of the files.
+func verifyRemote(ctx context.Context, src *HTTPMirrorSource, files []*PeriodManifestFile, workers int, opts RemoteVerifyOptions) ([]*RemoteFileResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]*RemoteFileResult, len(files))
+	work := make(chan int)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		lastErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				res, err := checkRemoteFile(ctx, src, files[i], opts)
+				if err != nil {
+					mu.Lock()
+					lastErr = fmt.Errorf("check %s: %w", files[i].Path, err)
+					mu.Unlock()
+					continue
+				}
+				results[i] = res
+			}
+		}()
+	}
+	for i := range files {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return results, nil
+}
+
+// remoteVerifyFiles returns the files listed in the period manifests of a network in the ship path that are included
+// by the filter. Provisional files are skipped since mirrors only hold final files.
+func remoteVerifyFiles(shipPath, network string, filter MirrorFilter) ([]*PeriodManifestFile, error) {
+	var files []*PeriodManifestFile
+	err := filepath.WalkDir(filepath.Join(shipPath, network, ManifestDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(path, ".json") || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+		pm := &PeriodManifest{}
+		if err := json.Unmarshal(data, pm); err != nil {
+			return fmt.Errorf("decode manifest %s: %w", path, err)
+		}
+		for _, f := range pm.Files {
+			if f.Provisional || !filter.Includes(&HeightIndexFileRef{Table: f.Table, Date: pm.Date}) {
+				continue
+			}
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Path < files[b].Path })
+	return files, nil
+}
+
+var verifyRemoteCommand = &cli.Command{
+	Name:   "verify-remote",
+	Usage:  "Check the files of a published mirror against the local period manifests without downloading them in full.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path holding the period manifests and local copies of the files to check the mirror against.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "mirror",
+				EnvVars:  []string{"ARCHIVER_VERIFY_MIRROR"},
+				Usage:    "Location of the mirror to check, as an http(s):// URL or a public s3://bucket/prefix.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "tables",
+				Usage: "Comma separated list of tables to check. Default is all tables.",
+			},
+			&cli.StringFlag{
+				Name:  "from-date",
+				Usage: "Check only files of periods on or after this date, in YYYY-MM-DD format.",
+			},
+			&cli.StringFlag{
+				Name:  "to-date",
+				Usage: "Check only files of periods on or before this date, in YYYY-MM-DD format.",
+			},
+			&cli.IntFlag{
+				Name:  "samples",
+				Usage: "Number of ranges of each file to compare with the local copy, including the first and last.",
+				Value: DefaultRemoteSamples,
+			},
+			&cli.Int64Flag{
+				Name:  "sample-size",
+				Usage: "Number of bytes in each sampled range.",
+				Value: DefaultRemoteSampleSize,
+			},
+			&cli.Int64Flag{
+				Name:  "seed",
+				Usage: "Seed for choosing the sampled ranges. Defaults to the current time so that repeated runs sample different ranges.",
+			},
+			&cli.Int64SliceFlag{
+				Name:  "part-size",
+				Usage: "Part size, in bytes, of multipart uploads to the mirror, for comparing their etags. The archiver's own part size and those of common S3 clients are always tried.",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Number of files checked at the same time.",
+				Value: 8,
+			},
+			&cli.BoolFlag{
+				Name:  "verbose",
+				Usage: "Report every file checked, not just failures.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		shipPath := cc.String("ship-path")
+		if err := verifyShipPath(shipPath); err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+		if !strings.Contains(cc.String("mirror"), "://") {
+			return fmt.Errorf("invalid mirror: expected an http(s):// or s3:// location, use verify-shipped for local archives")
+		}
+		base, err := mirrorSourceURL(cc.String("mirror"), "")
+		if err != nil {
+			return fmt.Errorf("invalid mirror: %w", err)
+		}
+		src := &HTTPMirrorSource{Base: base, Client: &http.Client{Timeout: 10 * time.Minute}}
+
+		if cc.Int("samples") < 2 || cc.Int64("sample-size") <= 0 {
+			return fmt.Errorf("at least 2 samples of a positive size are needed")
+		}
+		opts := RemoteVerifyOptions{
+			Samples:    cc.Int("samples"),
+			SampleSize: cc.Int64("sample-size"),
+			Seed:       time.Now().UnixNano(),
+			LocalRoot:  shipPath,
+			PartSizes:  append(cc.Int64Slice("part-size"), DefaultObjectStorePartSize, 8<<20, 16<<20, 5<<20),
+		}
+		if cc.IsSet("seed") {
+			opts.Seed = cc.Int64("seed")
+		}
+
+		var filter MirrorFilter
+		if cc.IsSet("tables") {
+			list, err := parseTableList(cc.String("tables"))
+			if err != nil {
+				return fmt.Errorf("invalid tables: %w", err)
+			}
+			filter.Tables = map[string]bool{}
+			for _, t := range list {
+				filter.Tables[t] = true
+			}
+		}
+		if cc.IsSet("from-date") {
+			if filter.FromDate, err = DateFromString(cc.String("from-date")); err != nil {
+				return fmt.Errorf("invalid from-date: %w", err)
+			}
+		}
+		if cc.IsSet("to-date") {
+			if filter.ToDate, err = DateFromString(cc.String("to-date")); err != nil {
+				return fmt.Errorf("invalid to-date: %w", err)
+			}
+		}
+
+		files, err := remoteVerifyFiles(shipPath, networkConfig.name, filter)
+		if err != nil {
+			return fmt.Errorf("read manifests: %w", err)
+		}
+		results, err := verifyRemote(ctx, src, files, cc.Int("concurrency"), opts)
+		if err != nil {
+			return err
+		}
+
+		var failed, sizeOnly int
+		var fetched, total int64
+		for i, res := range results {
+			total += files[i].Size
+			fetched += res.Fetched
+			switch res.Check {
+			case RemoteFileOK:
+				if cc.Bool("verbose") {
+					fmt.Printf("%s: %s (%s)\n", res.Path, res.Check, res.Method)
+				}
+			case RemoteFileSizeOnly:
+				sizeOnly++
+				if cc.Bool("verbose") {
+					fmt.Printf("%s: %s\n", res.Path, res.Check)
+				}
+			default:
+				failed++
+				fmt.Printf("%s: %s\n", res.Path, res.Check)
+			}
+		}
+
+		fmt.Printf("checked %d files, %d failed, %d checked by size only, fetched %d of %d bytes\n", len(results), failed, sizeOnly, fetched, total)
+		if failed > 0 {
+			return fmt.Errorf("one or more mirrored files failed verification")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEtagMatchesFile(t *testing.T) {
+	data := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	whole := md5.Sum(data)
+	var parts []byte
+	for i := 0; i < len(data); i += 40 {
+		end := i + 40
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[i:end])
+		parts = append(parts, sum[:]...)
+	}
+	multipart := md5.Sum(parts)
+
+	testCases := []struct {
+		etag  string
+		match bool
+	}{
+		{etag: `"` + hex.EncodeToString(whole[:]) + `"`, match: true},
+		{etag: `W/"` + hex.EncodeToString(whole[:]) + `"`, match: true},
+		{etag: `"` + hex.EncodeToString(multipart[:]) + `-3"`, match: true},
+		{etag: `"` + hex.EncodeToString(multipart[:]) + `-2"`, match: false},
+		{etag: `"` + hex.EncodeToString(whole[:]) + `-3"`, match: false},
+		{etag: `"5f3a-1234"`, match: false},
+	}
+	for _, tc := range testCases {
+		got, err := etagMatchesFile(tc.etag, path, int64(len(data)), []int64{64, 40})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.match {
+			t.Errorf("got match %v for etag %s, wanted %v", got, tc.etag, tc.match)
+		}
+	}
+}
+
+func TestSampleOffsets(t *testing.T) {
+	opts := RemoteVerifyOptions{Samples: 5, SampleSize: 10, Seed: 7}
+	got := sampleOffsets("mainnet/csv/1/messages/2021/messages-2021-08-02.csv.gz", 1000, opts)
+	if len(got) != 5 || got[0] != 0 || got[4] != 990 {
+		t.Fatalf("got offsets %v, wanted 5 including the first and last range", got)
+	}
+	if again := sampleOffsets("mainnet/csv/1/messages/2021/messages-2021-08-02.csv.gz", 1000, opts); !reflect.DeepEqual(got, again) {
+		t.Errorf("got offsets %v then %v for the same seed", got, again)
+	}
+	if small := sampleOffsets("a", 5, opts); !reflect.DeepEqual(small, []int64{0}) {
+		t.Errorf("got offsets %v for a file smaller than a sample, wanted [0]", small)
+	}
+}
+
+func TestCheckRemoteFile(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	etags := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(filepath.Join(remote, filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		if etag, ok := etags[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "", time.Time{}, f)
+	}))
+	defer srv.Close()
+	base, _ := url.Parse(srv.URL)
+	src := &HTTPMirrorSource{Base: base, Client: srv.Client()}
+	opts := RemoteVerifyOptions{Samples: 4, SampleSize: 1024, LocalRoot: local, PartSizes: []int64{DefaultObjectStorePartSize}}
+
+	rng := rand.New(rand.NewSource(1))
+	add := func(rel string, size int, localCopy bool, change func([]byte) []byte) *PeriodManifestFile {
+		data := make([]byte, size)
+		rng.Read(data)
+		sum := sha256.Sum256(data)
+		if localCopy {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(local, rel)), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(local, rel), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if change != nil {
+			data = change(append([]byte(nil), data...))
+		}
+		if data != nil {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(remote, rel)), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(remote, rel), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &PeriodManifestFile{Path: rel, Size: int64(size), SHA256: hex.EncodeToString(sum[:])}
+	}
+	flip := func(at int) func([]byte) []byte {
+		return func(data []byte) []byte {
+			if at < 0 {
+				at += len(data)
+			}
+			data[at] ^= 0xff
+			return data
+		}
+	}
+
+	testCases := []struct {
+		f       *PeriodManifestFile
+		check   RemoteFileCheck
+		method  string
+		fetched int64
+	}{
+		{f: add("small.gz", 3000, false, nil), check: RemoteFileOK, method: RemoteMethodHashed, fetched: 3000},
+		{f: add("small-changed.gz", 3000, false, flip(10)), check: RemoteFileChecksumMismatch, fetched: 3000},
+		{f: add("large.gz", 100000, true, nil), check: RemoteFileOK, method: RemoteMethodSampled, fetched: 4096},
+		{f: add("large-changed-tail.gz", 100000, true, flip(-1)), check: RemoteFileSampleMismatch, fetched: 4096},
+		{f: add("large-no-local.gz", 100000, false, nil), check: RemoteFileSizeOnly},
+		{f: add("large-short.gz", 100000, true, func(data []byte) []byte { return data[:90000] }), check: RemoteFileSizeMismatch},
+		{f: add("missing.gz", 100000, true, func([]byte) []byte { return nil }), check: RemoteFileMissing},
+		{f: add("etag.gz", 100000, true, nil), check: RemoteFileOK, method: RemoteMethodETag},
+	}
+	etag := md5.Sum(func() []byte { data, _ := os.ReadFile(filepath.Join(local, "etag.gz")); return data }())
+	etags["etag.gz"] = fmt.Sprintf("%q", hex.EncodeToString(etag[:]))
+	etags["large.gz"] = `"not-an-md5"`
+
+	for _, tc := range testCases {
+		res, err := checkRemoteFile(context.Background(), src, tc.f, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.f.Path, err)
+		}
+		if res.Check != tc.check || res.Method != tc.method || res.Fetched != tc.fetched {
+			t.Errorf("%s: got %s by %q fetching %d bytes, wanted %s by %q fetching %d", tc.f.Path, res.Check, res.Method, res.Fetched, tc.check, tc.method, tc.fetched)
+		}
+	}
+
+	var files []*PeriodManifestFile
+	for _, tc := range testCases {
+		files = append(files, tc.f)
+	}
+	results, err := verifyRemote(context.Background(), src, files, 3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range results {
+		if res.Path != files[i].Path || res.Check != testCases[i].check {
+			t.Errorf("got %s for %s from verifyRemote, wanted %s for %s", res.Check, res.Path, testCases[i].check, files[i].Path)
+		}
+	}
+}
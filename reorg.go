@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/lily/lens/lily"
+)
+
+// Defaults of reorg reconciliation.
+const (
+	DefaultReconcileDelay   = 900 // one more finality after the export delay
+	DefaultReconcilePeriods = 2
+)
+
+// chainBlocksFunc returns the cids of the blocks of each tipset of the canonical chain between the heights, inclusive.
+// Null rounds have no entry.
+type chainBlocksFunc func(ctx context.Context, from, to int64) (map[int64][]string, error)
+
+// ReorgReconciler checks recently shipped periods for reorgs deeper than the export delay. Once a period is further
+// behind the head than the reconcile delay, the tipsets in its shipped chain_consensus files are compared with the
+// chain of the lily node. If any differ, the period's files are marked stale in its manifest and the period is
+// re-exported.
+type ReorgReconciler struct {
+	Network string
+	Sh      Shipper
+	Tables  []Table
+	Targets []ShipTarget
+	Delay   int64 // epochs after the export delay before a period is checked
+	Periods int   // number of the most recent periods past the delay that are checked
+
+	chain   chainBlocksFunc
+	checked map[string]bool // periods that have been checked, by name
+}
+
+// NewReorgReconciler creates a reconciler that reads the chain from the configured lily nodes.
+func NewReorgReconciler(network string, sh Shipper, tables []Table, targets []ShipTarget) *ReorgReconciler {
+	return &ReorgReconciler{
+		Network: network,
+		Sh:      sh,
+		Tables:  tables,
+		Targets: targets,
+		Delay:   reorgConfig.delay,
+		Periods: reorgConfig.periods,
+		chain:   lilyChainBlocks,
+		checked: map[string]bool{},
+	}
+}
+
+// Run checks for reorgs at each interval until the context is cancelled.
+func (r *ReorgReconciler) Run(ctx context.Context, interval time.Duration) {
+	for {
+		r.Reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Reconcile checks each of the most recent periods past the reconcile delay that has not been checked before. A period
+// is checked again if its files had not yet been shipped or it could not be read.
+func (r *ReorgReconciler) Reconcile(ctx context.Context) {
+	height := CurrentHeight(networkConfig.genesisTs) - ExportDelay - r.Delay
+	p := exportPeriodForHeight(height, networkConfig.genesisTs)
+	if p.EndHeight > height {
+		p = exportPeriodForHeight(p.StartHeight-1, networkConfig.genesisTs)
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < r.Periods && p.StartHeight >= 0 && ctx.Err() == nil; i++ {
+		name := p.String()
+		seen[name] = true
+		if !r.checked[name] {
+			done, err := r.reconcilePeriod(ctx, p)
+			if err != nil {
+				logger.Errorw("failed to check period for reorgs", "error", err, "period", name)
+			}
+			r.checked[name] = done
+		}
+		if p.StartHeight == 0 {
+			break
+		}
+		p = exportPeriodForHeight(p.StartHeight-1, networkConfig.genesisTs)
+	}
+
+	// Periods that have moved out of the window are never checked again
+	for name := range r.checked {
+		if !seen[name] {
+			delete(r.checked, name)
+		}
+	}
+}
+
+// reconcilePeriod checks a period for reorgs, re-exporting it if any are found. It reports whether the period is done
+// with, which it is not if it has not been shipped yet.
+func (r *ReorgReconciler) reconcilePeriod(ctx context.Context, p ExportPeriod) (bool, error) {
+	ll := logger.With("period", p.String(), "from", p.StartHeight, "to", p.EndHeight)
+
+	pm, err := readPeriodManifest(ctx, periodManifestPath(r.Network, p), r.Sh)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("read manifest: %w", err)
+	}
+
+	shipped, err := readShippedConsensus(ctx, pm, r.Sh)
+	if err != nil {
+		return false, fmt.Errorf("read shipped consensus: %w", err)
+	}
+	if shipped == nil {
+		ll.Debugw("no readable chain_consensus file was shipped, reorgs cannot be detected")
+		return true, nil
+	}
+
+	chain, err := r.chain(ctx, p.StartHeight, p.EndHeight)
+	if err != nil {
+		return false, fmt.Errorf("read chain: %w", err)
+	}
+
+	heights := reorgedHeights(shipped, chain, p.StartHeight, p.EndHeight)
+	if len(heights) == 0 {
+		ll.Debugw("no reorgs found")
+		return true, nil
+	}
+
+	reorgsDetectedCounter.Inc()
+	reorg := &PeriodReorg{
+		Detected:    time.Now().UTC(),
+		StartHeight: heights[0],
+		EndHeight:   heights[len(heights)-1],
+		Heights:     len(heights),
+	}
+	ll.Warnw("reorg changed tipsets of shipped period, re-exporting", "first_height", reorg.StartHeight, "last_height", reorg.EndHeight, "heights", reorg.Heights)
+
+	ar := newAuditRecord(AuditReorg, r.Network, p)
+	ar.Reason = fmt.Sprintf("%d tipsets between heights %d and %d were replaced", reorg.Heights, reorg.StartHeight, reorg.EndHeight)
+	auditLog.Record(ar)
+
+	if err := markPeriodStale(ctx, r.Network, p, reorg, r.Sh); err != nil {
+		ll.Errorw("failed to mark files stale", "error", err)
+	}
+
+	if err := r.reexport(ctx, p); err != nil {
+		return false, err
+	}
+	ll.Infow("re-exported period after reorg")
+	return true, nil
+}
+
+// reexport replaces every shipped file of the period, retrying as a job of the export queue until it succeeds.
+func (r *ReorgReconciler) reexport(ctx context.Context, p ExportPeriod) error {
+	tables := currentTableConfig(r.Network).FilterTables(r.Tables)
+	em, err := manifestForPeriod(ctx, p, r.Network, networkConfig.genesisTs, r.Sh, storageConfig.schemaVersion, tables, r.Targets)
+	if err != nil {
+		return fmt.Errorf("create manifest: %w", err)
+	}
+	for _, ef := range em.Files {
+		if ef.Shipped && ef.Annotation == nil {
+			ef.Shipped = false
+		}
+	}
+
+	err = runExportJob(ctx, p, tables, JobPriorityHead, func(ctx context.Context) error {
+		claim, err := claimPeriod(r.Network, p, false)
+		if err != nil {
+			return err
+		}
+		defer claim.Release()
+		return processExport(ctx, em, r.Sh)
+	})
+	if err != nil {
+		return fmt.Errorf("re-export: %w", err)
+	}
+
+	if err := updateHeightIndex(ctx, p, r.Network, networkConfig.genesisTs, r.Sh, storageConfig.schemaVersion, r.Targets); err != nil {
+		logger.Errorw("failed to update height index", "error", err, "period", p.String())
+	}
+	return nil
+}
+
+// readShippedConsensus reads the tipsets of a period from its shipped chain_consensus files, which may be the parts of
+// a sharded file. It returns nil if there is no unencrypted csv file of the table to read.
+func readShippedConsensus(ctx context.Context, pm *PeriodManifest, sh Shipper) (map[int64][]string, error) {
+	var files []*PeriodManifestFile
+	for _, f := range pm.Files {
+		if f.Table != "chain_consensus" || f.Format != FormatCSV || f.Encryption != "" || f.Provisional {
+			continue
+		}
+		// Each compression holds the same rows, so only the first is read
+		if len(files) > 0 && f.Compression != files[0].Compression {
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Path < files[b].Path })
+
+	heights := map[int64][]string{}
+	for _, f := range files {
+		c, ok := CompressionByName[f.Compression]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown compression %q", f.Path, f.Compression)
+		}
+		data, err := sh.Read(ctx, f.Path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", f.Path, err)
+		}
+		zr, err := c.Decompress(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", f.Path, c.Names[0], err)
+		}
+		hs, err := readConsensusHeights(skipCSVProvenance(zr))
+		zr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		for h, blocks := range hs {
+			heights[h] = blocks
+		}
+	}
+	return heights, nil
+}
+
+// reorgedHeights returns the heights between from and to, in order, whose tipset in the shipped files differs from the
+// one in the chain. A height that was a null round in one but not the other differs.
+func reorgedHeights(shipped, chain map[int64][]string, from, to int64) []int64 {
+	var heights []int64
+	for h := from; h <= to; h++ {
+		if !sameBlocks(shipped[h], chain[h]) {
+			heights = append(heights, h)
+		}
+	}
+	return heights
+}
+
+func sameBlocks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, c := range a {
+		seen[c] = true
+	}
+	for _, c := range b {
+		if !seen[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// markPeriodStale records the reorg in the period's manifest and marks each of its files stale. Entries for files are
+// replaced when they are shipped again, which clears the mark.
+func markPeriodStale(ctx context.Context, network string, p ExportPeriod, reorg *PeriodReorg, sh Shipper) error {
+	return updatePeriodManifest(ctx, periodManifestPath(network, p), sh, func(pm *PeriodManifest) error {
+		pm.Reorgs = append(pm.Reorgs, reorg)
+		for _, f := range pm.Files {
+			if !f.Provisional {
+				f.Stale = true
+			}
+		}
+		return nil
+	})
+}
+
+// lilyChainBlocks reads the tipsets between the heights from a healthy lily node, retrying until one answers.
+func lilyChainBlocks(ctx context.Context, from, to int64) (map[int64][]string, error) {
+	var heights map[int64][]string
+	err := WaitUntil(ctx, onLilyNode(func(apiAddr, apiToken string) func(context.Context) (bool, error) {
+		return func(ctx context.Context) (bool, error) {
+			api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
+			if err != nil {
+				lilyConnectionErrorsCounter.Inc()
+				logger.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
+				return false, nil
+			}
+			defer closer()
+
+			heights, err = chainBlocksForRange(ctx, api, from, to)
+			if err != nil {
+				logger.Errorw("failed to read chain from lily", "error", err, "from", from, "to", to)
+				return false, nil
+			}
+			return true, nil
+		}
+	}, logger), 0, time.Minute)
+	return heights, err
+}
+
+func chainBlocksForRange(ctx context.Context, api lily.LilyAPI, from, to int64) (map[int64][]string, error) {
+	tss, err := tipSetsForRange(ctx, api, from, to)
+	if err != nil {
+		return nil, err
+	}
+	heights := make(map[int64][]string, len(tss))
+	for _, ts := range tss {
+		var blocks []string
+		for _, c := range ts.Cids() {
+			blocks = append(blocks, c.String())
+		}
+		heights[int64(ts.Height())] = blocks
+	}
+	return heights, nil
+}
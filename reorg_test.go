@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReorgedHeights(t *testing.T) {
+	shipped := map[int64][]string{10: {"a", "b"}, 11: {"c"}, 13: {"d"}}
+	chain := map[int64][]string{10: {"b", "a"}, 11: {"e"}, 12: {"f"}, 13: {"d"}}
+
+	if got, want := reorgedHeights(shipped, chain, 10, 14), []int64{11, 12}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got reorged heights %v, wanted %v", got, want)
+	}
+	if got := reorgedHeights(shipped, shipped, 10, 14); len(got) != 0 {
+		t.Errorf("got reorged heights %v for an unchanged chain", got)
+	}
+}
+
+func TestReconcilePeriod(t *testing.T) {
+	ctx := context.Background()
+	sh := &fileShipper{root: t.TempDir()}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 9}, StartHeight: 1005360, EndHeight: 1008239}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	ef := &ExportFile{Date: p.Date, StartHeight: p.StartHeight, EndHeight: p.EndHeight, Schema: 1, Network: "mainnet", TableName: "chain_consensus", Format: FormatCSV, Compression: CompressionByName["gz"]}
+
+	r := &ReorgReconciler{
+		Network: "mainnet",
+		Sh:      sh,
+		chain: func(ctx context.Context, from, to int64) (map[int64][]string, error) {
+			t.Fatalf("chain was read before the period was shipped")
+			return nil, nil
+		},
+	}
+	if done, err := r.reconcilePeriod(ctx, p); err != nil || done {
+		t.Fatalf("got done %v and error %v for an unshipped period, wanted neither", done, err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(CSVProvenancePrefix + "{}\n"))
+	for h := p.StartHeight; h <= p.EndHeight; h++ {
+		blocks := "{" + strconv.FormatInt(h, 10) + "a," + strconv.FormatInt(h, 10) + "b}"
+		if h == p.StartHeight+1 {
+			blocks = "{}" // null round
+		}
+		fmt.Fprintf(zw, "%d,s,p,\"%s\"\n", h, blocks)
+	}
+	zw.Close()
+	if err := sh.Write(ctx, ef.Path(), buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePeriodManifest(ctx, em, []*ExportFile{ef}, sh); err != nil {
+		t.Fatal(err)
+	}
+
+	pm, err := readPeriodManifest(ctx, periodManifestPath("mainnet", p), sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shipped, err := readShippedConsensus(ctx, pm, sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shipped) != int(p.EndHeight-p.StartHeight+1) || len(shipped[p.StartHeight+1]) != 0 || !reflect.DeepEqual(shipped[p.EndHeight], []string{"1008239a", "1008239b"}) {
+		t.Fatalf("unexpected tipsets read from shipped file")
+	}
+
+	// The chain agrees with the shipped file, with its null round omitted
+	r.chain = func(ctx context.Context, from, to int64) (map[int64][]string, error) {
+		chain := map[int64][]string{}
+		for h, blocks := range shipped {
+			if len(blocks) > 0 {
+				chain[h] = blocks
+			}
+		}
+		return chain, nil
+	}
+	if done, err := r.reconcilePeriod(ctx, p); err != nil || !done {
+		t.Fatalf("got done %v and error %v for an unchanged period", done, err)
+	}
+
+	reorg := &PeriodReorg{StartHeight: p.StartHeight + 5, EndHeight: p.StartHeight + 6, Heights: 2}
+	if err := markPeriodStale(ctx, "mainnet", p, reorg, sh); err != nil {
+		t.Fatal(err)
+	}
+	pm, err = readPeriodManifest(ctx, periodManifestPath("mainnet", p), sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pm.Reorgs) != 1 || pm.Reorgs[0].Heights != 2 || len(pm.Files) != 1 || !pm.Files[0].Stale {
+		t.Errorf("reorg was not recorded in the period manifest: %+v", pm)
+	}
+
+	// Shipping the file again replaces its stale entry
+	if err := writePeriodManifest(ctx, em, []*ExportFile{ef}, sh); err != nil {
+		t.Fatal(err)
+	}
+	pm, err = readPeriodManifest(ctx, periodManifestPath("mainnet", p), sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pm.Reorgs) != 1 || pm.Files[0].Stale {
+		t.Errorf("re-shipped file is still marked stale: %+v", pm.Files[0])
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lily/lens/lily"
+	"github.com/filecoin-project/lily/schedule"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/go-pg/pg/v10"
+)
+
+// Types of lily job that may be used to repair the heights of a walk that failed verification
+const (
+	RepairJobIndex   = "index"   // an index request for each tipset with failed heights, written to the archiver's storage
+	RepairJobGapFill = "gapfill" // gap find and gap fill jobs written to the lily database, then copied from it
+)
+
+// RepairWalkSuffix is appended to the names of the walks that hold the output of repair jobs.
+const RepairWalkSuffix = "-repair"
+
+func parseRepairJob(s string) (string, error) {
+	switch s {
+	case "", RepairJobIndex, RepairJobGapFill:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown repair job %q", s)
+	}
+}
+
+// heightsToRepair returns the heights of each task that were missing or reported an error when the walk was verified,
+// for tasks with a file that would otherwise be blocked from shipping. Tasks that also produced unexpected heights are
+// left for another walk since repairing their failed heights would not allow their files to be shipped.
+func heightsToRepair(em *ExportManifest, report *VerificationReport) map[string][]int64 {
+	heights := map[string][]int64{}
+	for task, ts := range report.TaskStatus {
+		if len(ts.Missing)+len(ts.Error) == 0 || len(ts.Unexpected) > 0 {
+			continue
+		}
+
+		blocked := false
+		for _, ef := range em.FilesForTask(task) {
+			if !ef.NeedsShipping() {
+				continue
+			}
+			if level, _ := verificationPolicy.Evaluate(ef.TableName, ts); level == StrictnessBlock {
+				blocked = true
+			}
+		}
+		if !blocked {
+			continue
+		}
+
+		hs := append(append([]int64{}, ts.Missing...), ts.Error...)
+		sort.Slice(hs, func(a, b int) bool { return hs[a] < hs[b] })
+		heights[task] = hs
+	}
+	return heights
+}
+
+// tasksByHeight inverts the heights to repair for each task, returning the heights in ascending order along with the
+// tasks to repair at each one.
+func tasksByHeight(heights map[string][]int64) ([]int64, map[int64][]string) {
+	tasks := map[int64][]string{}
+	for task, hs := range heights {
+		for _, h := range hs {
+			tasks[h] = append(tasks[h], task)
+		}
+	}
+
+	order := make([]int64, 0, len(tasks))
+	for h := range tasks {
+		sort.Strings(tasks[h])
+		order = append(order, h)
+	}
+	sort.Slice(order, func(a, b int) bool { return order[a] < order[b] })
+	return order, tasks
+}
+
+// repairExport runs the configured type of repair job for the heights that failed verification and merges its output
+// into the walk, so that the period can be shipped without walking it again. It reports whether any heights were
+// repaired, in which case the walk must be verified again.
+func repairExport(ctx context.Context, em *ExportManifest, wi WalkInfo, report *VerificationReport, ll basicLogger) (bool, error) {
+	heights := heightsToRepair(em, report)
+	if len(heights) == 0 {
+		return false, nil
+	}
+
+	name, err := unusedWalkName(wi.Path, em.Period.String()+RepairWalkSuffix)
+	if err != nil {
+		return false, fmt.Errorf("walk name: %w", err)
+	}
+	rwi := WalkInfo{
+		Name:   name,
+		Path:   wi.Path,
+		Format: wi.Format,
+	}
+	defer removeRepairWalk(rwi, heights)
+
+	ll.Infow("repairing heights that failed verification", "walk", wi.Name, "repair", rwi.Name, "job", jobConfig.repairJob, "tasks", len(heights))
+	repaired, err := onLilyNode(func(apiAddr, apiToken string) func(context.Context) (bool, error) {
+		if jobConfig.repairJob == RepairJobGapFill {
+			return gapFillRepairIsCompleted(apiAddr, apiToken, rwi, heights, ll)
+		}
+		return indexRepairIsCompleted(apiAddr, apiToken, rwi, heights, ll)
+	}, ll)(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !repaired {
+		return false, fmt.Errorf("%s job did not complete", jobConfig.repairJob)
+	}
+
+	if err := mergeRepairWalk(wi, rwi, heights); err != nil {
+		return false, fmt.Errorf("merge repair: %w", err)
+	}
+	ll.Infow("merged repaired heights into walk", "walk", wi.Name, "repair", rwi.Name)
+	return true, nil
+}
+
+// indexRepairIsCompleted indexes the tipset at each failed height with the tasks that failed at that height, writing
+// the output to the repair walk.
+func indexRepairIsCompleted(apiAddr string, apiToken string, rwi WalkInfo, heights map[string][]int64, ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
+		if err != nil {
+			lilyConnectionErrorsCounter.Inc()
+			ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
+			return false, nil
+		}
+		defer closer()
+
+		order, tasks := tasksByHeight(heights)
+		failed := 0
+		for _, h := range order {
+			ts, err := api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(h), types.EmptyTSK)
+			if err != nil {
+				lilyJobErrorsCounter.Inc()
+				ll.Errorw("failed to get tipset to repair", "error", err, "height", h)
+				failed++
+				continue
+			}
+			if int64(ts.Height()) != h {
+				ll.Errorw("no tipset found at height to repair", "height", h, "found", ts.Height())
+				failed++
+				continue
+			}
+
+			cfg := lily.LilyJobConfig{
+				Name:    rwi.Name,
+				Tasks:   tasks[h],
+				Storage: storageConfig.name,
+			}
+			failed += indexTipSets(ctx, api, cfg, []types.TipSetKey{ts.Key()}, 1, requestRetryPolicy(), ll)
+		}
+		if failed > 0 {
+			ll.Errorw(fmt.Sprintf("failed to repair %d of %d heights", failed, len(order)), "repair", rwi.Name)
+			return false, nil
+		}
+		return true, nil
+	}
+}
+
+// gapFillRepairIsCompleted runs a gap find job followed by a gap fill job over the range of failed heights, writing to
+// the lily database, then copies the rows of the range from the database into the repair walk. Lily only fills the
+// gaps it finds in its database, so this suits archivers that use database jobs.
+func gapFillRepairIsCompleted(apiAddr string, apiToken string, rwi WalkInfo, heights map[string][]int64, ll basicLogger) func(context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		order, tasks := tasksByHeight(heights)
+		from, to := order[0], order[len(order)-1]
+
+		var taskList []string
+		for task := range heights {
+			taskList = append(taskList, task)
+		}
+		sort.Strings(taskList)
+
+		cfg := lily.LilyJobConfig{
+			Name:    rwi.Name,
+			Tasks:   taskList,
+			Storage: jobConfig.repairStorage,
+		}
+		ll.Infow("finding gaps in lily database", "repair", rwi.Name, "from", from, "to", to, "heights", len(tasks))
+		if !repairJobSucceeded(ctx, apiAddr, apiToken, cfg.Name, func(api lily.LilyAPI) (*schedule.JobSubmitResult, error) {
+			return api.LilyGapFind(ctx, &lily.LilyGapFindConfig{JobConfig: cfg, From: from, To: to})
+		}, ll) {
+			return false, nil
+		}
+		ll.Infow("filling gaps in lily database", "repair", rwi.Name, "from", from, "to", to)
+		if !repairJobSucceeded(ctx, apiAddr, apiToken, cfg.Name, func(api lily.LilyAPI) (*schedule.JobSubmitResult, error) {
+			return api.LilyGapFill(ctx, &lily.LilyGapFillConfig{JobConfig: cfg, From: from, To: to})
+		}, ll) {
+			return false, nil
+		}
+
+		opt, err := pg.ParseURL(jobConfig.databaseURL)
+		if err != nil {
+			return false, fmt.Errorf("parse database url: %w", err)
+		}
+		db := pg.Connect(opt).WithContext(ctx)
+		defer db.Close()
+
+		if err := copyTableFromDatabase(ctx, db, ProcessingReportsTable, from, to, rwi.WalkFile(ProcessingReportsTable)); err != nil {
+			walkErrorsCounter.Inc()
+			ll.Errorw("failed to copy processing reports from database", "error", err, "repair", rwi.Name)
+			return false, nil
+		}
+		for _, table := range repairedTables(heights) {
+			if err := copyTableFromDatabase(ctx, db, table, from, to, rwi.WalkFile(table)); err != nil {
+				walkErrorsCounter.Inc()
+				ll.Errorw("failed to copy table from database", "error", err, "table", table, "repair", rwi.Name)
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// repairJobSucceeded submits a lily job using the supplied function and waits for it to end, reporting whether it
+// completed without error.
+func repairJobSucceeded(ctx context.Context, apiAddr string, apiToken string, name string, submit func(lily.LilyAPI) (*schedule.JobSubmitResult, error), ll basicLogger) bool {
+	api, closer, err := getLilyAPI(ctx, apiAddr, apiToken)
+	if err != nil {
+		lilyConnectionErrorsCounter.Inc()
+		ll.Errorf("failed to connect to lily api at %s: %v", apiAddr, err)
+		return false
+	}
+	res, err := submit(api)
+	closer()
+	if err != nil {
+		lilyJobErrorsCounter.Inc()
+		ll.Errorw("failed to start repair job", "error", err, "repair", name)
+		return false
+	}
+
+	if err := Poll(ctx, requestRetryPolicy(), DefaultPollInterval, jobHasEnded(apiAddr, apiToken, res.ID, ll)); err != nil {
+		ll.Errorw("failed waiting for repair job to finish", "error", err, "repair", name, "job_id", res.ID)
+		return false
+	}
+	var jr schedule.JobListResult
+	if err := Poll(ctx, requestRetryPolicy(), 0, jobGetResult(apiAddr, apiToken, name, res.ID, &jr, ll)); err != nil {
+		ll.Errorw("failed reading repair job result", "error", err, "repair", name, "job_id", res.ID)
+		return false
+	}
+	if jr.Error != "" {
+		lilyJobErrorsCounter.Inc()
+		ll.Errorw(fmt.Sprintf("repair job failed: %s", jr.Error), "repair", name, "job_id", res.ID)
+		return false
+	}
+	return true
+}
+
+// repairedTables returns the names of the tables produced by the tasks being repaired.
+func repairedTables(heights map[string][]int64) []string {
+	var tables []string
+	for _, t := range TableList {
+		if _, ok := heights[t.Task]; ok {
+			tables = append(tables, t.Name)
+		}
+	}
+	return tables
+}
+
+// mergeRepairWalk merges the output of a repair walk into the walk it repairs. Rows of each repaired table are merged
+// by key, with rows from the repair replacing those of the walk, in the same canonical form used by --normalize-rows.
+// The processing reports of the repaired heights are replaced by those of the repair so that the walk is verified using
+// their final outcome.
+func mergeRepairWalk(wi, rwi WalkInfo, heights map[string][]int64) error {
+	for _, table := range repairedTables(heights) {
+		if _, err := os.Stat(rwi.WalkFile(table)); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		layout, err := rowLayoutForTable(table)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+		if err := rewriteWalkFile(wi.WalkFile(table), func(dst io.Writer, src io.Reader) error {
+			rf, err := os.Open(rwi.WalkFile(table))
+			if err != nil {
+				return err
+			}
+			defer rf.Close()
+			// The newline ends the walk's last record in case it was written without one
+			_, err = mergeCSVRows(io.MultiReader(src, strings.NewReader("\n"), rf), dst, layout)
+			return err
+		}); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+
+	repaired := map[string]map[int64]bool{}
+	for task, hs := range heights {
+		repaired[task] = map[int64]bool{}
+		for _, h := range hs {
+			repaired[task][h] = true
+		}
+	}
+	if err := rewriteWalkFile(wi.WalkFile(ProcessingReportsTable), func(dst io.Writer, src io.Reader) error {
+		if err := copyProcessingReports(dst, src, repaired, false); err != nil {
+			return err
+		}
+		rf, err := os.Open(rwi.WalkFile(ProcessingReportsTable))
+		if err != nil {
+			return err
+		}
+		defer rf.Close()
+		return copyProcessingReports(dst, rf, repaired, true)
+	}); err != nil {
+		return fmt.Errorf("%s: %w", ProcessingReportsTable, err)
+	}
+	return nil
+}
+
+// copyProcessingReports copies the processing reports that are for a repaired height of their task when repaired is
+// true, or those that are not when it is false.
+func copyProcessingReports(dst io.Writer, src io.Reader, heights map[string]map[int64]bool, repaired bool) error {
+	sc := bufio.NewScanner(src)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	sc.Split(scanCSVRecords)
+	for sc.Scan() {
+		fields, _, err := splitCSVRecord(sc.Bytes())
+		if err != nil {
+			return fmt.Errorf("parse row: %w", err)
+		}
+		if len(fields) < 4 {
+			return fmt.Errorf("row has too few columns")
+		}
+		height, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed height %q: %w", fields[0], err)
+		}
+		if heights[fields[3]][height] != repaired {
+			continue
+		}
+		if _, err := dst.Write(sc.Bytes()); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	return sc.Err()
+}
+
+// rewriteWalkFile replaces a walk file with the output of fn, which is given the current contents of the file.
+func rewriteWalkFile(path string, fn func(dst io.Writer, src io.Reader) error) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DefaultFilePerms)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(dst)
+	if err := fn(bw, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeRepairWalk removes the files written by a repair walk.
+func removeRepairWalk(rwi WalkInfo, heights map[string][]int64) {
+	for _, table := range append(repairedTables(heights), ProcessingReportsTable) {
+		if err := os.Remove(rwi.WalkFile(table)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Errorw("failed to remove repair walk file", "error", err, "file", rwi.WalkFile(table))
+		}
+	}
+}
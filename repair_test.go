@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHeightsToRepair(t *testing.T) {
+	task := TablesByName["block_headers"].Task
+	em := &ExportManifest{
+		Files: []*ExportFile{
+			{TableName: "block_headers"},
+			{TableName: "messages", Shipped: true},
+			{TableName: "chain_consensus"},
+		},
+	}
+	report := &VerificationReport{
+		TaskStatus: map[string]TaskStatus{
+			task:                                 {Missing: []int64{12}, Error: []int64{10}},
+			TablesByName["messages"].Task:        {Missing: []int64{11}},
+			TablesByName["chain_consensus"].Task: {Missing: []int64{11}, Unexpected: []int64{20}},
+			TablesByName["actor_states"].Task:    {},
+			TablesByName["block_messages"].Task:  {Error: []int64{9}},
+		},
+	}
+
+	got := heightsToRepair(em, report)
+	want := map[string][]int64{task: {10, 12}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	order, tasks := tasksByHeight(map[string][]int64{"b": {12, 10}, "a": {10}})
+	if !reflect.DeepEqual(order, []int64{10, 12}) || !reflect.DeepEqual(tasks[10], []string{"a", "b"}) {
+		t.Errorf("unexpected tasks by height: %v %v", order, tasks)
+	}
+}
+
+func TestMergeRepairWalk(t *testing.T) {
+	dir := t.TempDir()
+	wi := WalkInfo{Name: "arch0802-2021-08-02", Path: dir, Format: "csv"}
+	rwi := WalkInfo{Name: "arch0802-2021-08-02-repair", Path: dir, Format: "csv"}
+	task := TablesByName["chain_consensus"].Task
+
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(wi.WalkFile("chain_consensus"), "10,r10,p10,t10\n12,r12,p12,t12\n")
+	write(wi.WalkFile(ProcessingReportsTable), ""+
+		"10,root,reporter,"+task+",s,e,ok,,\n"+
+		"11,root,reporter,"+task+",s,e,error,,failed\n"+
+		"11,root,reporter,other,s,e,error,,failed\n"+
+		"12,root,reporter,"+task+",s,e,ok,,\n")
+	write(rwi.WalkFile("chain_consensus"), "11,r11,p11,t11\n")
+	write(rwi.WalkFile(ProcessingReportsTable), "11,root,reporter,"+task+",s,e,ok,,\n")
+
+	if err := mergeRepairWalk(wi, rwi, map[string][]int64{task: {11}}); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+
+	data, err := os.ReadFile(wi.WalkFile("chain_consensus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10,r10,p10,t10\n11,r11,p11,t11\n12,r12,p12,t12\n"; string(data) != want {
+		t.Errorf("got consensus %q, wanted %q", data, want)
+	}
+
+	data, err = os.ReadFile(wi.WalkFile(ProcessingReportsTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"10,root,reporter," + task + ",s,e,ok,,\n" +
+		"11,root,reporter,other,s,e,error,,failed\n" +
+		"12,root,reporter," + task + ",s,e,ok,,\n" +
+		"11,root,reporter," + task + ",s,e,ok,,\n"
+	if string(data) != want {
+		t.Errorf("got processing reports %q, wanted %q", data, want)
+	}
+}
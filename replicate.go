@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ReplicaReconciler keeps a second destination consistent with the ship path. Each pass compares every file listed in
+// the ship path's height index with the replica, copying any file that is missing from the replica or whose size or
+// checksum differs.
+type ReplicaReconciler struct {
+	ShipPath    string
+	ReplicaPath string
+	Network     string
+
+	// verified records the size, modification time and expected checksum of replica files whose checksum has been
+	// confirmed, so that unchanged files are not rehashed on every pass
+	verified map[string]replicaFileState
+}
+
+type replicaFileState struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string // checksum the file was confirmed to have, so a changed index entry causes the file to be rehashed
+}
+
+// ReconcileStats summarises a single reconciliation pass.
+type ReconcileStats struct {
+	Checked    int
+	Missing    int
+	Divergent  int
+	Replicated int
+	Failed     int
+	Lag        time.Duration // age of the oldest file that could not be replicated
+}
+
+func NewReplicaReconciler(shipPath, replicaPath, network string) *ReplicaReconciler {
+	return &ReplicaReconciler{
+		ShipPath:    shipPath,
+		ReplicaPath: replicaPath,
+		Network:     network,
+		verified:    map[string]replicaFileState{},
+	}
+}
+
+// Reconcile performs a single pass, re-replicating missing or divergent files.
+func (r *ReplicaReconciler) Reconcile(ctx context.Context) (*ReconcileStats, error) {
+	ll := logger.With("network", r.Network, "replica", r.ReplicaPath)
+	stats := &ReconcileStats{}
+
+	hi, err := readHeightIndex(ctx, &fileShipper{root: r.ShipPath}, r.Network)
+	if err != nil {
+		return nil, fmt.Errorf("read height index: %w", err)
+	}
+	if hi == nil {
+		ll.Info("no height index found in ship path, nothing to reconcile")
+		return stats, nil
+	}
+
+	paths := make([]string, 0, len(hi.Files))
+	for p := range hi.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var oldestPending time.Time
+	tables := map[string]string{} // table name to table directory
+	var ancillary []string        // files that are not listed in the index but must also be present on the replica
+	shardLists := map[string]bool{}
+	for _, rel := range paths {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+
+		ref := hi.Files[rel]
+		tables[ref.Table] = filepath.Dir(filepath.Dir(rel))
+		ancillary = append(ancillary, rel+SeekIndexSuffix, rel+ChecksumSuffix, rel+ChecksumSuffix+SignatureSuffix)
+		if ref.ShardList != "" && !shardLists[ref.ShardList] {
+			shardLists[ref.ShardList] = true
+			ancillary = append(ancillary, ref.ShardList)
+		}
+		stats.Checked++
+
+		state, err := r.check(rel, ref)
+		if err != nil {
+			ll.Errorw("failed to check replica file", "file", rel, "error", err)
+		}
+		switch state {
+		case replicaConsistent:
+			continue
+		case replicaMissing:
+			stats.Missing++
+		case replicaDivergent:
+			stats.Divergent++
+		}
+
+		ll.Infow("replicating file", "file", rel, "state", state)
+		if err := copyFile(filepath.Join(r.ShipPath, rel), filepath.Join(r.ReplicaPath, rel)); err != nil {
+			replicaErrorsCounter.Inc()
+			ll.Errorw("failed to replicate file", "file", rel, "error", err)
+			stats.Failed++
+			if info, err := os.Stat(filepath.Join(r.ShipPath, rel)); err == nil {
+				if oldestPending.IsZero() || info.ModTime().Before(oldestPending) {
+					oldestPending = info.ModTime()
+				}
+			}
+			continue
+		}
+		delete(r.verified, rel)
+		replicaFilesCounter.Inc()
+		stats.Replicated++
+	}
+
+	// Seek indexes, checksum, shard list, header, schema, schema descriptor and manifest files are not listed in the index
+	for table, dir := range tables {
+		ancillary = append(ancillary, filepath.Join(dir, table+".header"), filepath.Join(dir, table+".schema"), filepath.Join(dir, table+SchemaDescriptorSuffix))
+	}
+	for _, p := range hi.Periods {
+		ep := ExportPeriod{Date: p.Date, Hour: p.Hour, StartHeight: p.StartHeight, EndHeight: p.EndHeight}
+		report := processingReportPath(r.Network, ep)
+		ancillary = append(ancillary, periodManifestPath(r.Network, ep), report, report+ChecksumSuffix, report+ChecksumSuffix+SignatureSuffix)
+	}
+	for _, rel := range ancillary {
+		if err := r.replicateIfChanged(rel); err != nil {
+			ll.Errorw("failed to replicate ancillary file", "file", rel, "error", err)
+		}
+	}
+
+	// Indexes are replicated last so consumers of the replica never see files listed that are still being copied
+	if stats.Failed == 0 {
+		for table, dir := range tables {
+			if err := r.replicateIfChanged(tableIndexPath(dir, table)); err != nil {
+				return stats, fmt.Errorf("replicate table index for %s: %w", table, err)
+			}
+		}
+		if err := r.replicateIfChanged(filepath.Join(r.Network, HeightIndexFilename)); err != nil {
+			return stats, fmt.Errorf("replicate height index: %w", err)
+		}
+		for _, rel := range []string{ArchiveIndexFilename, ArchiveIndexHTMLFilename} {
+			if err := r.replicateIfChanged(rel); err != nil {
+				ll.Errorw("failed to replicate archive index", "file", rel, "error", err)
+			}
+		}
+	}
+
+	if !oldestPending.IsZero() {
+		stats.Lag = time.Since(oldestPending)
+	}
+
+	return stats, nil
+}
+
+type replicaState string
+
+const (
+	replicaConsistent replicaState = "consistent"
+	replicaMissing    replicaState = "missing"
+	replicaDivergent  replicaState = "divergent"
+)
+
+// check compares a replica file with the size and checksum recorded in the primary's height index. Files that cannot
+// be read are treated as divergent.
+func (r *ReplicaReconciler) check(rel string, ref *HeightIndexFileRef) (replicaState, error) {
+	info, err := os.Stat(filepath.Join(r.ReplicaPath, rel))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return replicaMissing, nil
+		}
+		return replicaDivergent, err
+	}
+
+	if info.Size() != ref.Size {
+		return replicaDivergent, nil
+	}
+
+	fs := replicaFileState{Size: info.Size(), ModTime: info.ModTime(), SHA256: ref.SHA256}
+	if v, ok := r.verified[rel]; ok && v == fs {
+		return replicaConsistent, nil
+	}
+
+	if ref.SHA256 != "" {
+		sum, _, err := sha256File(filepath.Join(r.ReplicaPath, rel))
+		if err != nil {
+			return replicaDivergent, err
+		}
+		if sum != ref.SHA256 {
+			return replicaDivergent, nil
+		}
+	}
+
+	r.verified[rel] = fs
+	return replicaConsistent, nil
+}
+
+// replicateIfChanged copies a file that is not covered by the height index to the replica if it is missing from the
+// replica or differs in size. Files that are not present in the ship path are ignored.
+func (r *ReplicaReconciler) replicateIfChanged(rel string) error {
+	src, err := os.Stat(filepath.Join(r.ShipPath, rel))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if dst, err := os.Stat(filepath.Join(r.ReplicaPath, rel)); err == nil && dst.Size() == src.Size() && !dst.ModTime().Before(src.ModTime()) {
+		return nil
+	}
+
+	return copyFile(filepath.Join(r.ShipPath, rel), filepath.Join(r.ReplicaPath, rel))
+}
+
+// Run reconciles the replica at the given interval until the context is cancelled.
+func (r *ReplicaReconciler) Run(ctx context.Context, interval time.Duration) {
+	reconcile := func(ctx context.Context) (bool, error) {
+		start := time.Now()
+		stats, err := r.Reconcile(ctx)
+		if err != nil {
+			replicaErrorsCounter.Inc()
+			logger.Errorw("replica reconciliation failed", "error", err, "replica", r.ReplicaPath)
+			return false, nil
+		}
+
+		replicaLagGauge.Set(stats.Lag.Seconds())
+		replicaPendingGauge.Set(float64(stats.Failed))
+		logger.Infow("replica reconciliation complete", "replica", r.ReplicaPath, "checked", stats.Checked, "missing", stats.Missing, "divergent", stats.Divergent, "replicated", stats.Replicated, "failed", stats.Failed, "duration", time.Since(start).String())
+		return false, nil
+	}
+
+	if err := WaitUntil(ctx, reconcile, 0, interval); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Errorw("replica reconciler stopped", "error", err)
+	}
+}
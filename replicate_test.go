@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func writeReplicaTestFile(t *testing.T, root, rel, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, rel), []byte(data), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func replicaTestRef(data string) *HeightIndexFileRef {
+	sum := sha256.Sum256([]byte(data))
+	return &HeightIndexFileRef{Table: "messages", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+func TestReplicaCheck(t *testing.T) {
+	r := NewReplicaReconciler(t.TempDir(), t.TempDir(), "mainnet")
+	rel := filepath.Join("mainnet", "csv", "1", "messages", "2021", "messages-2021-08-02.csv.gz")
+
+	check := func(ref *HeightIndexFileRef, want replicaState) {
+		t.Helper()
+		got, err := r.check(rel, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %s, wanted %s", got, want)
+		}
+	}
+
+	check(replicaTestRef("messages"), replicaMissing)
+
+	writeReplicaTestFile(t, r.ReplicaPath, rel, "messages")
+	check(replicaTestRef("more messages"), replicaDivergent)
+	check(replicaTestRef("MESSAGES"), replicaDivergent)
+	check(replicaTestRef("messages"), replicaConsistent)
+	if _, ok := r.verified[rel]; !ok {
+		t.Fatalf("consistent file was not recorded as verified")
+	}
+
+	// A file verified against one checksum is rehashed when the index lists another, even if the file is unchanged
+	check(replicaTestRef("massages"), replicaDivergent)
+	check(replicaTestRef("messages"), replicaConsistent)
+}
+
+func TestReplicaReconcile(t *testing.T) {
+	replicaFilesCounter = metrics.NewCtx(context.Background(), "replica_files_total", "").Counter()
+	replicaErrorsCounter = metrics.NewCtx(context.Background(), "replica_errors_total", "").Counter()
+
+	r := NewReplicaReconciler(t.TempDir(), t.TempDir(), "mainnet")
+	dir := filepath.Join("mainnet", "csv", "1", "messages")
+	messages := filepath.Join(dir, "2021", "messages-2021-08-02.csv.gz")
+	later := filepath.Join(dir, "2021", "messages-2021-08-03.csv.gz")
+	header := filepath.Join(dir, "messages.header")
+
+	writeReplicaTestFile(t, r.ShipPath, messages, "messages")
+	writeReplicaTestFile(t, r.ShipPath, later, "later messages")
+	writeReplicaTestFile(t, r.ShipPath, header, "cid,height")
+	writeReplicaTestFile(t, r.ReplicaPath, messages, "MESSAGES")
+
+	hi := &HeightIndex{
+		Network: "mainnet",
+		Periods: []*HeightIndexPeriod{{Date: Date{Year: 2021, Month: 8, Day: 2}, Files: []string{messages, later}}},
+		Files:   map[string]*HeightIndexFileRef{messages: replicaTestRef("messages"), later: replicaTestRef("later messages")},
+	}
+	if err := writeHeightIndex(context.Background(), &fileShipper{root: r.ShipPath}, hi); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 2 || stats.Missing != 1 || stats.Divergent != 1 || stats.Replicated != 2 || stats.Failed != 0 {
+		t.Errorf("got stats %+v, wanted one missing and one divergent file replicated", stats)
+	}
+	for _, rel := range []string{messages, later, header, filepath.Join("mainnet", HeightIndexFilename)} {
+		want, err := os.ReadFile(filepath.Join(r.ShipPath, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(r.ReplicaPath, rel)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s was not replicated: %v", rel, err)
+		}
+	}
+
+	stats, err = r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 2 || stats.Replicated != 0 {
+		t.Errorf("got stats %+v from a second pass, wanted nothing replicated", stats)
+	}
+}
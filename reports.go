@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ReportsPrefix is the directory beneath the ship path that processing reports are shipped to.
+const ReportsPrefix = "reports"
+
+// processingReportPath returns the path of the processing report shipped for a period, relative to the ship path.
+// Reports of daily periods are written to reports/<network>/<year>/visor_processing_reports-<period>.csv.gz.
+func processingReportPath(network string, p ExportPeriod) string {
+	return filepath.Join(ReportsPrefix, network, periodDir(p.Length(), p.Date), fmt.Sprintf("%s-%s.csv.gz", ProcessingReportsTable, p.String()))
+}
+
+// processingReportMu serialises updates to shipped processing reports, which are read, merged and written back by the
+// concurrent walks of a split period.
+var processingReportMu sync.Mutex
+
+// shipProcessingReport ships the processing reports written by a walk for the tasks of the shipped files, so consumers can
+// see the status of each task at every height of the period, including known gaps. Reports for other tasks that were
+// shipped by an earlier walk, such as one run by an archiver responsible for different tasks, are retained. It returns
+// the path the report was shipped to.
+func shipProcessingReport(ctx context.Context, em *ExportManifest, wi WalkInfo, shipped []*ExportFile, sh Shipper) (string, error) {
+	tasks := map[string]bool{}
+	for _, ef := range shipped {
+		tasks[TablesByName[ef.TableName].Task] = true
+	}
+
+	f, err := os.Open(wi.WalkFile(ProcessingReportsTable))
+	if err != nil {
+		return "", fmt.Errorf("open processing reports: %w", err)
+	}
+	defer f.Close()
+	rows, err := readProcessingReportRows(f, func(task string) bool { return tasks[task] })
+	if err != nil {
+		return "", fmt.Errorf("walk processing reports: %w", err)
+	}
+
+	processingReportMu.Lock()
+	defer processingReportMu.Unlock()
+
+	gz := CompressionByName["gz"]
+	path := processingReportPath(em.Network, em.Period)
+	existing, err := sh.Read(ctx, path)
+	if err == nil {
+		r, err := gz.Decompress(bytes.NewReader(existing))
+		if err != nil {
+			return "", fmt.Errorf("decompress shipped report: %w", err)
+		}
+		kept, err := readProcessingReportRows(r, func(task string) bool { return !tasks[task] })
+		r.Close()
+		if err != nil {
+			return "", fmt.Errorf("shipped report: %w", err)
+		}
+		rows = append(rows, kept...)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("read shipped report: %w", err)
+	}
+	sortProcessingReportRows(rows)
+
+	var report bytes.Buffer
+	w := csv.NewWriter(&report)
+	if err := w.WriteAll(rows); err != nil {
+		return "", fmt.Errorf("write report: %w", err)
+	}
+
+	var data bytes.Buffer
+	if _, err := gz.Compress(nil, &report, &data); err != nil {
+		return "", fmt.Errorf("compress report: %w", err)
+	}
+	if err := sh.Write(ctx, path, data.Bytes()); err != nil {
+		return "", fmt.Errorf("write report: %w", err)
+	}
+
+	sum := sha256.Sum256(data.Bytes())
+	if err := writeChecksumFile(ctx, sh, path, hex.EncodeToString(sum[:]), filepath.Base(path)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// readProcessingReportRows reads the rows of a processing reports csv whose task is accepted by keep.
+func readProcessingReportRows(r io.Reader, keep func(task string) bool) ([][]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var rows [][]string
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		if len(row) < 9 {
+			return nil, fmt.Errorf("row has too few columns")
+		}
+		if keep(row[3]) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// sortProcessingReportRows orders processing report rows by height and then task, keeping the order of rows for the
+// same height and task.
+func sortProcessingReportRows(rows [][]string) {
+	sort.SliceStable(rows, func(a, b int) bool {
+		ha, _ := strconv.ParseInt(rows[a][0], 10, 64)
+		hb, _ := strconv.ParseInt(rows[b][0], 10, 64)
+		if ha != hb {
+			return ha < hb
+		}
+		return rows[a][3] < rows[b][3]
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShipProcessingReport(t *testing.T) {
+	dir := t.TempDir()
+	sh, err := newShipper(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	walk := func(name string, rows ...string) (*ExportManifest, WalkInfo) {
+		wi := WalkInfo{Name: name, Path: t.TempDir(), Format: "csv"}
+		if err := os.WriteFile(wi.WalkFile(ProcessingReportsTable), []byte(strings.Join(rows, "")), 0o644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return &ExportManifest{Network: "mainnet", Period: ExportPeriod{Date: Date{Year: 2021, Month: 9, Day: 1}}}, wi
+	}
+	row := func(height, task string) string {
+		return height + ",abc,lily," + task + ",t,t,OK,,\n"
+	}
+
+	ctx := context.Background()
+	em, wi := walk("first", row("11", "block_header"), row("10", "block_header"), row("10", "message"))
+	if _, err := shipProcessingReport(ctx, em, wi, []*ExportFile{{TableName: "block_headers"}, {TableName: "messages"}}, sh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A later walk of only the message task replaces its rows and keeps the block_header rows
+	em, wi = walk("second", row("11", "message"))
+	path, err := shipProcessingReport(ctx, em, wi, []*ExportFile{{TableName: "messages"}}, sh)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r, err := CompressionByName["gz"].Decompress(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+	rows, err := readProcessingReportRows(r, func(string) bool { return true })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, row := range rows {
+		got = append(got, row[0]+" "+row[3])
+	}
+	want := "10 block_header,11 block_header,11 message"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got rows %s, wanted %s", strings.Join(got, ","), want)
+	}
+}
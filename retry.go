@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultRequestRetryBackoff is the time waited before retrying a failed request to lily or upload to a shipper.
+	DefaultRequestRetryBackoff = 5 * time.Second
+
+	// DefaultMaxRequestRetryBackoff is the longest time waited between retries of a failed request or upload.
+	DefaultMaxRequestRetryBackoff = 2 * time.Minute
+
+	// DefaultRequestMaxAttempts is the number of consecutive failures of a request or upload after which it is
+	// abandoned.
+	DefaultRequestMaxAttempts = 10
+
+	// DefaultWalkMaxAttempts is the number of failed walks of a period after which the export attempt fails and is
+	// left to the export queue to retry.
+	DefaultWalkMaxAttempts = 3
+
+	// DefaultRetryJitter is the fraction by which retry delays are randomly shortened or lengthened so that archivers
+	// and workers that failed together do not retry together.
+	DefaultRetryJitter = 0.2
+
+	// DefaultPollInterval is the time waited between checks of a lily job that is still running.
+	DefaultPollInterval = 30 * time.Second
+)
+
+// errWalkFailed is returned for a walk attempt that failed and was logged by the walk itself.
+var errWalkFailed = errors.New("walk failed")
+
+// RetryPolicy describes how an operation that can fail transiently is retried. The delay before each retry starts at
+// Initial and doubles with each consecutive failure up to Max, and is then varied by up to Jitter of itself.
+type RetryPolicy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Jitter      float64 // fraction of the delay, between 0 and 1
+	MaxAttempts int     // consecutive failures after which the operation is abandoned, 0 for no limit
+	Interval    time.Duration
+}
+
+// requestRetryPolicy returns the policy for requests to lily and uploads to shippers.
+func requestRetryPolicy() RetryPolicy {
+	p := RetryPolicy{
+		Initial:     retryConfig.requestBackoff,
+		Max:         retryConfig.maxRequestBackoff,
+		Jitter:      retryConfig.jitter,
+		MaxAttempts: retryConfig.requestAttempts,
+		Interval:    DefaultPollInterval,
+	}
+	if p.Initial <= 0 {
+		p.Initial = DefaultRequestRetryBackoff
+	}
+	if p.Max <= 0 {
+		p.Max = DefaultMaxRequestRetryBackoff
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRequestMaxAttempts
+	}
+	return p
+}
+
+// walkRetryPolicy returns the policy for walks and other lily jobs that export a period, which are retried with the
+// same delays as the export queue.
+func walkRetryPolicy() RetryPolicy {
+	p := requestRetryPolicy()
+	p.Initial, p.Max = DefaultPollInterval, DefaultRetryBackoff
+	p.MaxAttempts = retryConfig.walkAttempts
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultWalkMaxAttempts
+	}
+	return p
+}
+
+// Backoff returns the time to wait after the given number of consecutive failures.
+func (p RetryPolicy) Backoff(failures int) time.Duration {
+	backoff := p.Initial
+	for i := 1; i < failures && (p.Max <= 0 || backoff < p.Max); i++ {
+		backoff *= 2
+	}
+	if p.Max > 0 && backoff > p.Max {
+		backoff = p.Max
+	}
+	return jitter(backoff, p.Jitter)
+}
+
+// jitter varies d randomly by up to the fraction f of itself.
+func jitter(d time.Duration, f float64) time.Duration {
+	if f <= 0 || d <= 0 {
+		return d
+	}
+	if f > 1 {
+		f = 1
+	}
+	return d + time.Duration((rand.Float64()*2-1)*f*float64(d))
+}
+
+// PermanentError wraps an error that retrying cannot resolve.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent marks err as an error that should not be retried. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err should not be retried. Errors marked with Permanent, context errors and the errors
+// that move work to another lily node or report a missing job are permanent; all others are transient.
+func IsPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errLilyNodeUnavailable) ||
+		errors.Is(err, ErrJobNotFound)
+}
+
+// Retry calls fn until it succeeds, returns a permanent error or has failed the policy's maximum number of attempts
+// in a row, waiting the policy's backoff between failures. The last error is returned, wrapped with the number of
+// attempts if they were exhausted.
+func Retry(ctx context.Context, p RetryPolicy, fn func(context.Context) error) error {
+	for failures := 1; ; failures++ {
+		err := fn(ctx)
+		if err == nil || IsPermanent(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p.MaxAttempts > 0 && failures >= p.MaxAttempts {
+			retryExhaustedCounter.Inc()
+			return fmt.Errorf("gave up after %d attempts: %w", failures, err)
+		}
+		retryAttemptsCounter.Inc()
+		if err := sleep(ctx, p.Backoff(failures)); err != nil {
+			return err
+		}
+	}
+}
+
+// Poll waits for condition to report that it is done, checking it again after the policy's interval while it
+// reports that it is not. Errors returned by condition are retried as failures by Retry's rules, and a success resets
+// the count of consecutive failures. Polling starts after delay.
+func Poll(ctx context.Context, p RetryPolicy, delay time.Duration, condition func(context.Context) (bool, error)) error {
+	if err := sleep(ctx, delay); err != nil {
+		return err
+	}
+	failures := 0
+	for {
+		done, err := condition(ctx)
+		wait := jitter(p.Interval, p.Jitter)
+		switch {
+		case err == nil && done:
+			return nil
+		case err == nil:
+			failures = 0
+		case IsPermanent(err):
+			return err
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			failures++
+			if p.MaxAttempts > 0 && failures >= p.MaxAttempts {
+				retryExhaustedCounter.Inc()
+				return fmt.Errorf("gave up after %d attempts: %w", failures, err)
+			}
+			retryAttemptsCounter.Inc()
+			wait = p.Backoff(failures)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// attemptCondition adapts a condition that performs a whole attempt at some work, reporting false when the attempt
+// failed, into a function for Retry. A failed attempt is reported as failure and errors from the condition are
+// permanent.
+func attemptCondition(condition func(context.Context) (bool, error), failure error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		done, err := condition(ctx)
+		if err != nil {
+			return Permanent(err)
+		}
+		if !done {
+			return failure
+		}
+		return nil
+	}
+}
+
+// retryUpload retries an upload of a local file with the request policy. The upload is not retried once the file is
+// missing, since a shipper may have consumed it before failing.
+func retryUpload(ctx context.Context, file string, upload func(context.Context) error) error {
+	return Retry(ctx, requestRetryPolicy(), func(ctx context.Context) error {
+		err := upload(ctx)
+		if err != nil {
+			if _, serr := os.Stat(file); serr != nil {
+				return Permanent(err)
+			}
+		}
+		return err
+	})
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Initial: time.Second, Max: 10 * time.Second}
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 60: 10 * time.Second} {
+		if got := p.Backoff(failures); got != want {
+			t.Errorf("got backoff %s after %d failures, wanted %s", got, failures, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(2); got < time.Second || got > 3*time.Second {
+			t.Fatalf("got backoff %s with jitter, wanted between 1s and 3s", got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retryAttemptsCounter = metrics.NewCtx(context.Background(), "retry_attempts_total", "").Counter()
+	retryExhaustedCounter = metrics.NewCtx(context.Background(), "retry_exhausted_total", "").Counter()
+	ctx := context.Background()
+	p := RetryPolicy{Initial: time.Millisecond, Max: time.Millisecond, MaxAttempts: 3}
+
+	calls := 0
+	err := Retry(ctx, p, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("got error %v after %d calls, wanted success after 3", err, calls)
+	}
+
+	calls = 0
+	transient := errors.New("unavailable")
+	err = Retry(ctx, p, func(context.Context) error {
+		calls++
+		return transient
+	})
+	if !errors.Is(err, transient) || calls != 3 {
+		t.Errorf("got error %v after %d calls, wanted to give up after 3", err, calls)
+	}
+
+	// Permanent errors, including those that move work to another lily node, are not retried
+	for _, perm := range []error{Permanent(errors.New("invalid")), fmt.Errorf("wait: %w", errLilyNodeUnavailable), context.Canceled} {
+		calls = 0
+		err = Retry(ctx, p, func(context.Context) error {
+			calls++
+			return perm
+		})
+		if err != perm || calls != 1 {
+			t.Errorf("got error %v after %d calls for %v, wanted it returned after 1", err, calls, perm)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	retryAttemptsCounter = metrics.NewCtx(context.Background(), "retry_attempts_total", "").Counter()
+	retryExhaustedCounter = metrics.NewCtx(context.Background(), "retry_exhausted_total", "").Counter()
+	ctx := context.Background()
+	p := RetryPolicy{Initial: time.Millisecond, Max: time.Millisecond, MaxAttempts: 2, Interval: time.Millisecond}
+
+	// Checks that find the job still running do not count towards the attempts, and a successful check resets them
+	results := []error{errors.New("unavailable"), nil, errors.New("unavailable"), nil, nil}
+	calls := 0
+	err := Poll(ctx, p, 0, func(context.Context) (bool, error) {
+		err := results[calls]
+		calls++
+		return calls == len(results), err
+	})
+	if err != nil || calls != len(results) {
+		t.Errorf("got error %v after %d checks, wanted success after %d", err, calls, len(results))
+	}
+
+	calls = 0
+	err = Poll(ctx, p, 0, func(context.Context) (bool, error) {
+		calls++
+		return false, errors.New("unavailable")
+	})
+	if err == nil || calls != 2 {
+		t.Errorf("got error %v after %d checks, wanted to give up after 2", err, calls)
+	}
+
+	err = Poll(ctx, p, 0, func(context.Context) (bool, error) {
+		return false, ErrJobNotFound
+	})
+	if !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("got error %v, wanted %v", err, ErrJobNotFound)
+	}
+}
+
+func TestAttemptCondition(t *testing.T) {
+	failed := errors.New("walk failed")
+	ctx := context.Background()
+
+	if err := attemptCondition(func(context.Context) (bool, error) { return false, nil }, failed)(ctx); err != failed {
+		t.Errorf("got error %v for a failed attempt, wanted %v", err, failed)
+	}
+	if err := attemptCondition(func(context.Context) (bool, error) { return false, errors.New("stop") }, failed)(ctx); !IsPermanent(err) {
+		t.Errorf("got transient error %v, wanted a permanent error", err)
+	}
+	if err := attemptCondition(func(context.Context) (bool, error) { return true, nil }, failed)(ctx); err != nil {
+		t.Errorf("got error %v for a successful attempt", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+)
+
+// RowValidationError reports a row of a table's walk output that could not be parsed, had the wrong number of columns
+// for its table or a height outside the heights of the file it was to be shipped in.
+type RowValidationError struct {
+	Table  string
+	Row    int64 // number of the row within the walk output, counting from 1
+	Reason string
+}
+
+func (e *RowValidationError) Error() string {
+	return fmt.Sprintf("row %d of %s is invalid: %s", e.Row, e.Table, e.Reason)
+}
+
+// rowValidator checks the csv rows of a table's walk output.
+type rowValidator struct {
+	table        string
+	columns      int // number of columns of the table, 0 if unknown
+	heightColumn int // -1 if the table has no height column
+	from, to     int64
+}
+
+func newRowValidator(ef *ExportFile) (*rowValidator, error) {
+	v := &rowValidator{table: ef.TableName, heightColumn: -1, from: ef.StartHeight, to: ef.EndHeight}
+
+	// Delta files hold rows of the table they are taken from
+	t, ok := TablesByName[deltaBaseTable(ef.TableName)]
+	if !ok {
+		return v, nil
+	}
+	headers, err := TableHeaders(t.Model)
+	if err != nil {
+		return nil, fmt.Errorf("table headers: %w", err)
+	}
+	v.columns = len(headers)
+	for i, h := range headers {
+		if h == "height" {
+			v.heightColumn = i
+		}
+	}
+	return v, nil
+}
+
+// check returns the reason a row is invalid, or an empty string if it is valid.
+func (v *rowValidator) check(rec []string) string {
+	if v.columns > 0 && len(rec) != v.columns {
+		return fmt.Sprintf("has %d columns, wanted %d", len(rec), v.columns)
+	}
+	if v.heightColumn < 0 || v.heightColumn >= len(rec) {
+		return ""
+	}
+	height, err := strconv.ParseInt(rec[v.heightColumn], 10, 64)
+	if err != nil {
+		return fmt.Sprintf("malformed height %q", rec[v.heightColumn])
+	}
+	if height < v.from || height > v.to {
+		return fmt.Sprintf("height %d is outside %d-%d", height, v.from, v.to)
+	}
+	return ""
+}
+
+// validateCSVRows copies the csv rows read from r to w unchanged, checking each row as it passes. It stops at the first
+// invalid row, returning a *RowValidationError. A final row that is not terminated by a newline is treated as invalid
+// since lily ends every row it writes with one, so it is most likely the remains of an interrupted write.
+func validateCSVRows(r io.Reader, w io.Writer, v *rowValidator) error {
+	lw := &lastByteWriter{w: w}
+	cr := csv.NewReader(io.TeeReader(r, lw))
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	var rows int64
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		rows++
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return err
+			}
+			return &RowValidationError{Table: v.table, Row: rows, Reason: pe.Err.Error()}
+		}
+		if reason := v.check(rec); reason != "" {
+			return &RowValidationError{Table: v.table, Row: rows, Reason: reason}
+		}
+	}
+	if lw.n > 0 && lw.last != '\n' {
+		return &RowValidationError{Table: v.table, Row: rows, Reason: "row is not terminated by a newline"}
+	}
+	return nil
+}
+
+// lastByteWriter records the last byte written through it.
+type lastByteWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (l *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n > 0 {
+		l.n += int64(n)
+		l.last = p[n-1]
+	}
+	return n, err
+}
+
+// validatingReader passes on the walk output read from src once validateCSVRows has checked it. Reads fail once an
+// invalid row is found.
+type validatingReader struct {
+	*io.PipeReader
+	done chan error
+}
+
+func newValidatingReader(src io.Reader, v *rowValidator) *validatingReader {
+	pr, pw := io.Pipe()
+	vr := &validatingReader{PipeReader: pr, done: make(chan error, 1)}
+	go func() {
+		err := validateCSVRows(src, pw, v)
+		pw.CloseWithError(err)
+		vr.done <- err
+	}()
+	return vr
+}
+
+// Invalid stops validation and returns the *RowValidationError describing the first invalid row found, or nil if no
+// invalid row was found. It must be called at most once.
+func (r *validatingReader) Invalid() error {
+	r.PipeReader.Close()
+	var rve *RowValidationError
+	if err := <-r.done; errors.As(err, &rve) {
+		return rve
+	}
+	return nil
+}
+
+// quarantinePath returns the directory that walk output failing row validation is moved to.
+func quarantinePath() string {
+	if shippingConfig.quarantinePath != "" {
+		return shippingConfig.quarantinePath
+	}
+	return filepath.Join(storageConfig.path, "quarantine")
+}
+
+// quarantineWalkFile moves walk output that failed row validation out of the storage path so that it is not shipped or
+// collected, keeping it for inspection. It returns the path the file was moved to.
+func quarantineWalkFile(walkFile string) (string, error) {
+	dst := filepath.Join(quarantinePath(), filepath.Base(walkFile))
+	if err := moveFile(walkFile, dst); err != nil {
+		return "", fmt.Errorf("quarantine %q: %w", walkFile, err)
+	}
+	return dst, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateCSVRows(t *testing.T) {
+	ef := &ExportFile{TableName: "chain_consensus", StartHeight: 100, EndHeight: 199}
+	v, err := newRowValidator(ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		in   string
+		row  int64 // row reported as invalid, 0 if the rows are valid
+	}{
+		{name: "valid", in: "100,root,parent,tipset\n199,root,parent,\"tip,set\"\n"},
+		{name: "empty", in: ""},
+		{name: "too few columns", in: "100,root,parent,tipset\n101,root\n", row: 2},
+		{name: "too many columns", in: "100,root,parent,tipset,extra\n", row: 1},
+		{name: "malformed height", in: "1o0,root,parent,tipset\n", row: 1},
+		{name: "height before period", in: "99,root,parent,tipset\n", row: 1},
+		{name: "height after period", in: "100,root,parent,tipset\n200,root,parent,tipset\n", row: 2},
+		{name: "unterminated quote", in: "100,root,parent,tipset\n101,root,\"parent,tipset\n", row: 2},
+		{name: "truncated final row", in: "100,root,parent,tipset\n101,root,parent,tip", row: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := validateCSVRows(strings.NewReader(tc.in), &out, v)
+			if tc.row == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if out.String() != tc.in {
+					t.Errorf("got output %q, wanted the input unchanged", out.String())
+				}
+				return
+			}
+			var rve *RowValidationError
+			if !errors.As(err, &rve) {
+				t.Fatalf("got error %v, wanted a row validation error", err)
+			}
+			if rve.Row != tc.row || rve.Table != "chain_consensus" {
+				t.Errorf("got invalid row %d of %s, wanted row %d", rve.Row, rve.Table, tc.row)
+			}
+		})
+	}
+}
+
+func TestShipExportFileQuarantinesInvalidRows(t *testing.T) {
+	defer func(n string, v int, validate bool, storage, quarantine string) {
+		networkConfig.name, storageConfig.schemaVersion = n, v
+		shippingConfig.validateRows, storageConfig.path, shippingConfig.quarantinePath = validate, storage, quarantine
+	}(networkConfig.name, storageConfig.schemaVersion, shippingConfig.validateRows, storageConfig.path, shippingConfig.quarantinePath)
+	networkConfig.name, storageConfig.schemaVersion = "mainnet", 1
+	storageConfig.path, shippingConfig.quarantinePath = t.TempDir(), ""
+	shippingConfig.validateRows = true
+
+	ctx := context.Background()
+	shipPath := t.TempDir()
+	sh := &fileShipper{root: shipPath}
+	ef := &ExportFile{Date: Date{Year: 2021, Month: 8, Day: 9}, StartHeight: 1005360, EndHeight: 1008239, Schema: 1, Network: "mainnet", TableName: "chain_consensus", Format: FormatCSV, Compression: CompressionByName["gz"]}
+	wi := WalkInfo{Name: "arch0809-2021-08-09", Path: storageConfig.path, Format: "csv"}
+
+	walkFile := wi.WalkFile(ef.TableName)
+	if err := os.WriteFile(walkFile, []byte("1005360,root,parent,tipset\n1005361,root,par"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	var rve *RowValidationError
+	if err := shipExportFile(ctx, ef, wi, sh); !errors.As(err, &rve) {
+		t.Fatalf("got error %v, wanted a row validation error", err)
+	}
+	if _, err := os.Stat(walkFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("invalid walk output was left in the storage path")
+	}
+	if _, err := os.Stat(filepath.Join(storageConfig.path, "quarantine", filepath.Base(walkFile))); err != nil {
+		t.Errorf("invalid walk output was not quarantined: %v", err)
+	}
+	if _, err := sh.Stat(ctx, ef.Path()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("invalid walk output was shipped")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ShardListSuffix is appended to the path of a sharded file to give the path of the list of its parts. The list is
+// written once every part has been shipped, so its presence implies the file is complete.
+const ShardListSuffix = ".parts.json"
+
+// ShardRange is the range of heights held by a single part of a sharded file.
+type ShardRange struct {
+	Part        int   `json:"part"`
+	StartHeight int64 `json:"start_height"`
+	EndHeight   int64 `json:"end_height"`
+}
+
+// ShardList lists the parts that a table's file for a period was split into, in height order.
+type ShardList struct {
+	Table string           `json:"table"`
+	Parts []*ShardListPart `json:"parts"`
+}
+
+// ShardListPart describes a single shipped part of a sharded file.
+type ShardListPart struct {
+	ShardRange
+	Path   string `json:"path"` // path relative to the ship path
+	Rows   int64  `json:"rows"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	CID    string `json:"cid"` // CIDv1 of the raw file contents
+}
+
+// configureSharding parses the list of sharded tables and checks that each can be split by height.
+func configureSharding() error {
+	shippingConfig.shardedTables = map[string]bool{}
+	for _, name := range strings.Split(shippingConfig.shardTables, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := TablesByName[name]; !ok {
+			return fmt.Errorf("unknown table %q", name)
+		}
+		layout, err := rowLayoutForTable(name)
+		if err != nil {
+			return fmt.Errorf("row layout for %s: %w", name, err)
+		}
+		if layout.heightColumn < 0 {
+			return fmt.Errorf("table %s has no height column", name)
+		}
+		shippingConfig.shardedTables[name] = true
+	}
+
+	if shippingConfig.shardRows < 0 || shippingConfig.shardSize < 0 {
+		return fmt.Errorf("shard limits must not be negative")
+	}
+	if len(shippingConfig.shardedTables) == 0 {
+		return nil
+	}
+	if (shippingConfig.shardRows == 0) == (shippingConfig.shardSize == 0) {
+		return fmt.Errorf("sharding tables requires exactly one of --shard-rows or --shard-size")
+	}
+	return nil
+}
+
+// isShardedTable reports whether the files of a table are split into parts.
+func isShardedTable(name string) bool {
+	return shippingConfig.shardedTables[name]
+}
+
+// PartFile returns the export file for a single part of the file.
+func (e *ExportFile) PartFile(r ShardRange) *ExportFile {
+	pf := &ExportFile{
+		Date:        e.Date,
+		Hour:        e.Hour,
+		Length:      e.Length,
+		StartHeight: e.StartHeight,
+		EndHeight:   e.EndHeight,
+		Ranged:      e.Ranged,
+		Schema:      e.Schema,
+		Network:     e.Network,
+		TableName:   e.TableName,
+		Format:      e.Format,
+		Compression: e.Compression,
+		Encryption:  e.Encryption,
+		Provisional: e.Provisional,
+		Cid:         cid.Undef,
+		IPFSCid:     cid.Undef,
+		Shard:       &r,
+	}
+	return pf
+}
+
+// ShardListPath returns the path of the list of parts the file is shipped as when its table is sharded.
+func (e *ExportFile) ShardListPath() string {
+	return e.Path() + ShardListSuffix
+}
+
+// ShippedFiles returns the files that were shipped for the export file, which are its parts if it was sharded.
+func (e *ExportFile) ShippedFiles() []*ExportFile {
+	if len(e.Parts) > 0 {
+		return e.Parts
+	}
+	return []*ExportFile{e}
+}
+
+// heightRows is the number of rows and bytes of csv held at a single height.
+type heightRows struct {
+	height int64
+	rows   int64
+	size   int64
+}
+
+// countRowsByHeight reads csv records from r and returns the number of rows and bytes at each height, ordered by height.
+func countRowsByHeight(r io.Reader, column int) ([]heightRows, error) {
+	counts := map[int64]*heightRows{}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	sc.Split(scanCSVRecords)
+	for sc.Scan() {
+		height, err := csvRecordHeight(sc.Bytes(), column)
+		if err != nil {
+			return nil, err
+		}
+		hr, ok := counts[height]
+		if !ok {
+			hr = &heightRows{height: height}
+			counts[height] = hr
+		}
+		hr.rows++
+		hr.size += int64(len(sc.Bytes()))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	out := make([]heightRows, 0, len(counts))
+	for _, hr := range counts {
+		out = append(out, *hr)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].height < out[b].height })
+	return out, nil
+}
+
+// shardRanges divides the heights from start to end into consecutive parts holding at most maxRows rows or maxSize
+// bytes, whichever is non-zero. Parts always end between heights so a height holding more than the limit forms a part
+// on its own. The boundaries depend only on the rows at each height, so the same rows are always split in the same way.
+// The first part starts at start and the last part ends at end, and at least one part is always returned.
+func shardRanges(counts []heightRows, start, end int64, maxRows, maxSize int64) []ShardRange {
+	ranges := []ShardRange{{Part: 0, StartHeight: start, EndHeight: end}}
+
+	var rows, size int64
+	for _, hr := range counts {
+		over := (maxRows > 0 && rows+hr.rows > maxRows) || (maxSize > 0 && size+hr.size > maxSize)
+		if over && rows > 0 && hr.height > ranges[len(ranges)-1].StartHeight {
+			ranges[len(ranges)-1].EndHeight = hr.height - 1
+			ranges = append(ranges, ShardRange{Part: len(ranges), StartHeight: hr.height, EndHeight: end})
+			rows, size = 0, 0
+		}
+		rows += hr.rows
+		size += hr.size
+	}
+	return ranges
+}
+
+// splitRowsByHeight writes each csv record read from r to the file in dir for the part holding its height, returning
+// the path of each part's file. Records are written exactly as they were read.
+func splitRowsByHeight(r io.Reader, column int, ranges []ShardRange, dir string) ([]string, error) {
+	paths := make([]string, len(ranges))
+	files := make([]*os.File, len(ranges))
+	writers := make([]*bufio.Writer, len(ranges))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i := range ranges {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("part-%03d.csv", i))
+		f, err := os.Create(paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("create part file: %w", err)
+		}
+		files[i] = f
+		writers[i] = bufio.NewWriter(f)
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	sc.Split(scanCSVRecords)
+	for sc.Scan() {
+		height, err := csvRecordHeight(sc.Bytes(), column)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(ranges), func(i int) bool { return ranges[i].EndHeight >= height })
+		if i == len(ranges) || height < ranges[i].StartHeight {
+			return nil, fmt.Errorf("height %d is outside of the range being sharded", height)
+		}
+		if _, err := writers[i].Write(sc.Bytes()); err != nil {
+			return nil, fmt.Errorf("write part file: %w", err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	for i, w := range writers {
+		if err := w.Flush(); err != nil {
+			return nil, fmt.Errorf("write part file: %w", err)
+		}
+		if err := files[i].Close(); err != nil {
+			return nil, fmt.Errorf("close part file: %w", err)
+		}
+		files[i] = nil
+	}
+	return paths, nil
+}
+
+// shipShardedExportFile splits the walk output for an export file into parts by height and ships each part. The list
+// of parts is written once every part has been shipped. The walk output is read twice, once to choose the part
+// boundaries and once to split it, and the uncompressed parts are held in the staging path while they are shipped.
+func shipShardedExportFile(ctx context.Context, ef *ExportFile, walkFile string, stagingPath string, sh Shipper) error {
+	ll := logger.With("table", ef.TableName, "date", ef.Date.String())
+
+	layout, err := rowLayoutForTable(ef.TableName)
+	if err != nil {
+		return fmt.Errorf("row layout: %w", err)
+	}
+	if layout.heightColumn < 0 {
+		return fmt.Errorf("table %s has no height column", ef.TableName)
+	}
+
+	src, err := os.Open(walkFile)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	counts, err := countRowsByHeight(&contextReader{ctx: ctx, r: src}, layout.heightColumn)
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("count rows: %w", err)
+	}
+	ranges := shardRanges(counts, ef.StartHeight, ef.EndHeight, shippingConfig.shardRows, shippingConfig.shardSize)
+	ll.Infow("sharding export file", "parts", len(ranges))
+
+	dir := filepath.Join(stagingPath, filepath.Dir(ef.Path()))
+	if err := os.MkdirAll(dir, DefaultDirPerms); err != nil {
+		return fmt.Errorf("mkdir %q: %w", dir, err)
+	}
+	tmpDir, err := os.MkdirTemp(dir, "."+ef.String()+".parts.*")
+	if err != nil {
+		return fmt.Errorf("create part directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	src, err = os.Open(walkFile)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	partFiles, err := splitRowsByHeight(&contextReader{ctx: ctx, r: src}, layout.heightColumn, ranges, tmpDir)
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("split rows: %w", err)
+	}
+
+	sl := &ShardList{Table: ef.TableName}
+	ef.Parts = nil
+	ef.Rows, ef.Size, ef.UncompressedSize = 0, 0, 0
+	for i, r := range ranges {
+		pf := ef.PartFile(r)
+		if err := shipPartFile(ctx, pf, partFiles[i], filepath.Join(stagingPath, pf.Path()), sh); err != nil {
+			return fmt.Errorf("ship part %d: %w", r.Part, err)
+		}
+		os.Remove(partFiles[i])
+
+		ef.Parts = append(ef.Parts, pf)
+		ef.Rows += pf.Rows
+		ef.Size += pf.Size
+		ef.UncompressedSize += pf.UncompressedSize
+		sl.Parts = append(sl.Parts, &ShardListPart{
+			ShardRange: r,
+			Path:       filepath.ToSlash(pf.Path()),
+			Rows:       pf.Rows,
+			Size:       pf.Size,
+			SHA256:     pf.SHA256,
+			CID:        pf.Cid.String(),
+		})
+	}
+
+	data, err := json.MarshalIndent(sl, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal shard list: %w", err)
+	}
+	if err := sh.Write(ctx, ef.ShardListPath(), data); err != nil {
+		return fmt.Errorf("write shard list: %w", err)
+	}
+
+	if err := forgetFileState(ef); err != nil {
+		ll.Errorw("failed to remove file state", "error", err)
+	}
+	return nil
+}
+
+// shipPartFile compresses and ships a single part of a sharded file, followed by its seek index and checksum files.
+func shipPartFile(ctx context.Context, pf *ExportFile, partFile string, outFile string, sh Shipper) error {
+	seekIndex, err := compressExportFile(ctx, pf, partFile, outFile)
+	if err != nil {
+		return err
+	}
+
+	pf.Cid, err = rawCidFromSHA256(pf.SHA256)
+	if err != nil {
+		return fmt.Errorf("cid: %w", err)
+	}
+
+	if ipfsConfig.apiURL != "" {
+		pf.IPFSCid, err = ipfsAddFile(ctx, ipfsConfig.client, ipfsConfig.apiURL, outFile, ipfsConfig.pin)
+		if err != nil {
+			os.Remove(outFile)
+			return fmt.Errorf("ipfs add: %w", err)
+		}
+	}
+
+	if err := retryUpload(ctx, outFile, func(ctx context.Context) error { return sh.Put(ctx, pf.Path(), outFile) }); err != nil {
+		os.Remove(outFile)
+		return fmt.Errorf("ship to %s: %w", sh, err)
+	}
+
+	if seekIndex != nil {
+		data, err := json.MarshalIndent(seekIndex, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal seek index: %w", err)
+		}
+		if err := sh.Write(ctx, pf.Path()+SeekIndexSuffix, data); err != nil {
+			return fmt.Errorf("write seek index: %w", err)
+		}
+	}
+
+	if err := writeChecksumFile(ctx, sh, pf.Path(), pf.SHA256, pf.Filename()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readShardList reads the list of parts that an export file was shipped as. It returns an error satisfying
+// errors.Is(err, os.ErrNotExist) if the file was not sharded.
+func readShardList(ctx context.Context, ef *ExportFile, sh Shipper) (*ShardList, error) {
+	data, err := sh.Read(ctx, ef.ShardListPath())
+	if err != nil {
+		return nil, err
+	}
+	sl := &ShardList{}
+	if err := json.Unmarshal(data, sl); err != nil {
+		return nil, fmt.Errorf("decode shard list: %w", err)
+	}
+	if len(sl.Parts) == 0 {
+		return nil, fmt.Errorf("shard list %s has no parts", ef.ShardListPath())
+	}
+	return sl, nil
+}
+
+// readLocalShardList reads the list of parts that an export file was shipped as from a local ship path. It returns an
+// error satisfying errors.Is(err, os.ErrNotExist) if the file was not sharded.
+func readLocalShardList(shipPath string, ef *ExportFile) (*ShardList, error) {
+	return readShardList(context.Background(), ef, &fileShipper{root: shipPath})
+}
+
+// shardListExists reports whether an export file was shipped as parts.
+func shardListExists(ctx context.Context, ef *ExportFile, sh Shipper) (bool, error) {
+	_, err := sh.Stat(ctx, ef.ShardListPath())
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, fmt.Errorf("stat shard list: %w", err)
+}
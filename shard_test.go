@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShardRanges(t *testing.T) {
+	counts := []heightRows{
+		{height: 101, rows: 4, size: 400},
+		{height: 102, rows: 3, size: 300},
+		{height: 105, rows: 10, size: 1000},
+		{height: 107, rows: 2, size: 200},
+	}
+
+	testCases := []struct {
+		name    string
+		counts  []heightRows
+		maxRows int64
+		maxSize int64
+		want    []ShardRange
+	}{
+		{
+			name: "no rows",
+			want: []ShardRange{{Part: 0, StartHeight: 100, EndHeight: 109}},
+		},
+		{
+			name:    "under limit",
+			counts:  counts,
+			maxRows: 100,
+			want:    []ShardRange{{Part: 0, StartHeight: 100, EndHeight: 109}},
+		},
+		{
+			name:    "by rows",
+			counts:  counts,
+			maxRows: 7,
+			want: []ShardRange{
+				{Part: 0, StartHeight: 100, EndHeight: 104},
+				{Part: 1, StartHeight: 105, EndHeight: 106},
+				{Part: 2, StartHeight: 107, EndHeight: 109},
+			},
+		},
+		{
+			name:    "by size",
+			counts:  counts,
+			maxSize: 500,
+			want: []ShardRange{
+				{Part: 0, StartHeight: 100, EndHeight: 101},
+				{Part: 1, StartHeight: 102, EndHeight: 104},
+				{Part: 2, StartHeight: 105, EndHeight: 106},
+				{Part: 3, StartHeight: 107, EndHeight: 109},
+			},
+		},
+		{
+			name:    "height larger than limit",
+			counts:  []heightRows{{height: 100, rows: 10}},
+			maxRows: 2,
+			want:    []ShardRange{{Part: 0, StartHeight: 100, EndHeight: 109}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := shardRanges(tc.counts, 100, 109, tc.maxRows, tc.maxSize)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, wanted %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCountRowsByHeight(t *testing.T) {
+	data := "101,a\n102,\"b\nc\"\n101,d\n"
+	got, err := countRowsByHeight(strings.NewReader(data), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []heightRows{
+		{height: 101, rows: 2, size: 12},
+		{height: 102, rows: 1, size: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+}
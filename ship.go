@@ -1,53 +1,154 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	FormatCSV     = "csv" // format written by lily and the default format of shipped files
+	FormatParquet = "parquet"
+	FormatJSONL   = "jsonl" // newline delimited json
 )
 
-type Compression struct {
-	Names      []string
-	Extension  string
-	Executable string
-	CommandFn  func(source string, destination string) string
+// Format is a format that export files may be shipped in.
+type Format struct {
+	Name string
+
+	// Convert converts the csv output of lily read from r to the format, writing it to w. It is nil for formats that
+	// are shipped as written by lily.
+	Convert func(ef *ExportFile, r io.Reader, w io.Writer) error
+
+	// Compressions lists the compression schemes that may be applied to the format, or nil if any may be used. The
+	// first is used when a ship format does not name a compression.
+	Compressions []string
 }
 
-var CompressionList = []Compression{
+var FormatList = []Format{
 	{
-		Names:      []string{"gzip", "gz"},
-		Extension:  "gz",
-		Executable: "gzip",
-		CommandFn: func(source string, destination string) string {
-			return fmt.Sprintf("gzip --no-name --rsyncable --stdout %s > %s", source, destination)
-		},
+		Name: FormatCSV,
 	},
+	{
+		Name:         FormatParquet,
+		Convert:      convertCSVToParquet,
+		Compressions: []string{"none"}, // parquet pages are compressed within the file
+	},
+	{
+		Name:         FormatJSONL,
+		Convert:      convertCSVToJSONL,
+		Compressions: []string{"gz", "zstd", "lz4", "none"}, // seekable frames are split on csv rows
+	},
+}
+
+// Allows reports whether the compression may be applied to the format.
+func (f Format) Allows(c Compression) bool {
+	if len(f.Compressions) == 0 {
+		return true
+	}
+	for _, name := range f.Compressions {
+		if CompressionByName[name].Names[0] == c.Names[0] {
+			return true
+		}
+	}
+	return false
 }
 
-// CompressionByName maps a compression name to the compression scheme.
-var CompressionByName = map[string]Compression{}
+// FormatsByName maps a format name to the format.
+var FormatsByName = map[string]Format{}
 
 func init() {
-	for _, c := range CompressionList {
-		for _, name := range c.Names {
-			CompressionByName[name] = c
+	for _, f := range FormatList {
+		FormatsByName[f.Name] = f
+	}
+}
+
+// ShipTarget is a combination of format and compression that export files are shipped in. Each table may be shipped
+// to several targets at once, with the shipped state of each target tracked independently.
+type ShipTarget struct {
+	Format      string
+	Compression Compression
+}
+
+func (t ShipTarget) String() string {
+	return t.Format + "." + t.Compression.Names[0]
+}
+
+// parseShipTargets parses a comma separated list of format.compression entries, such as csv.gz,csv.zstd-seekable. The
+// compression may be omitted for formats that are compressed internally, such as parquet.
+func parseShipTargets(s string) ([]ShipTarget, error) {
+	var targets []ShipTarget
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ".", 2)
+		f, ok := FormatsByName[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown format %q", parts[0])
+		}
+
+		if len(parts) == 1 {
+			if len(f.Compressions) == 0 {
+				return nil, fmt.Errorf("invalid ship format %q, expected it to be in format \"{format}.{compression}\"", entry)
+			}
+			parts = append(parts, f.Compressions[0])
+		}
+
+		c, ok := CompressionByName[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression %q", parts[1])
+		}
+		if !f.Allows(c) {
+			return nil, fmt.Errorf("compression %q cannot be used with format %s", parts[1], f.Name)
 		}
+		// The frame offsets of a seek index refer to the compressed file, which encryption changes
+		if c.Names[0] == "zstd-seekable" && shipEncryptionRecipients != nil {
+			return nil, fmt.Errorf("seekable compression cannot be used with encryption")
+		}
+
+		t := ShipTarget{Format: parts[0], Compression: c}
+		key := t.Format + "." + c.Extension
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate ship format %q", entry)
+		}
+		seen[key] = true
+
+		targets = append(targets, t)
 	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no ship formats specified")
+	}
+	return targets, nil
 }
 
-func verifyShipDependencies(shipPath string, c Compression) error {
-	// Check compression executable is available
-	_, err := exec.LookPath(c.Executable)
-	if err != nil {
-		return fmt.Errorf("missing %s executable: %w", c.Executable, err)
+// shipTargetsFromFlags returns the ship targets given by the ship-formats flag, or a single csv target using the
+// compression flag if no ship formats are given.
+func shipTargetsFromFlags(cc *cli.Context) ([]ShipTarget, error) {
+	if s := cc.String("ship-formats"); s != "" {
+		return parseShipTargets(s)
+	}
+
+	c, ok := CompressionByName[cc.String("compression")]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", cc.String("compression"))
 	}
+	return []ShipTarget{{Format: FormatCSV, Compression: c}}, nil
+}
 
+func verifyShipPath(shipPath string) error {
 	// Check ship path exists and is a directory
 	info, err := os.Stat(shipPath)
 	if err != nil {
@@ -61,7 +162,7 @@ func verifyShipDependencies(shipPath string, c Compression) error {
 	return nil
 }
 
-func shipExportFile(ctx context.Context, ef *ExportFile, wi WalkInfo, shipPath string) error {
+func shipExportFile(ctx context.Context, ef *ExportFile, wi WalkInfo, sh Shipper) error {
 	ll := logger.With("table", ef.TableName, "date", ef.Date.String())
 	ll.Info("shipping export file")
 
@@ -84,62 +185,321 @@ func shipExportFile(ctx context.Context, ef *ExportFile, wi WalkInfo, shipPath s
 	}
 	ll.Debugf("found export file %s", walkFile)
 
-	shipFile := filepath.Join(shipPath, ef.Path())
+	// When a staging path is configured the file is compressed there and then placed in the ship path, which avoids
+	// a second full write when both paths share a filesystem. Files shipped to an object store are compressed to a
+	// temporary directory if there is no staging path and uploaded once complete.
+	stagingPath := shippingConfig.stagingPath
+	if stagingPath == "" {
+		if root, ok := localShipPath(sh); ok {
+			stagingPath = root
+		} else {
+			stagingPath = os.TempDir()
+		}
+	}
+	if isShardedTable(ef.TableName) {
+		return quarantineInvalidWalkFile(shipShardedExportFile(ctx, ef, walkFile, stagingPath, sh), walkFile, ll)
+	}
+	outFile := filepath.Join(stagingPath, ef.Path())
 
-	filePath := filepath.Dir(shipFile)
-	if err := os.MkdirAll(filePath, DefaultDirPerms); err != nil {
-		return fmt.Errorf("mkdir %q: %w", filePath, err)
+	// A file that was compressed before a crash is shipped from where it was staged rather than compressed again
+	st, err := resumableFile(ctx, ef, wi, sh)
+	if err != nil {
+		ll.Errorw("failed to check for previously compressed file", "error", err)
 	}
 
-	ll.Debugf("compressing to %s", shipFile)
-	bashcmd := ef.Compression.CommandFn(walkFile, shipFile)
+	var seekIndex *SeekIndex
+	if st != nil {
+		ll.Infow("resuming shipping of previously compressed file", "stage", st.Stage, "file", st.Staged)
+		outFile = st.Staged
+		seekIndex = st.Seek
+		ef.Rows = st.Rows
+		ef.Size = st.Size
+		ef.SHA256 = st.SHA256
+		ef.Provenance = st.Provenance
+	} else if sf := takeStreamedFile(ef, wi); sf != nil {
+		// A file compressed while the walk was running is shipped without reading the walk output again
+		ll.Infow("shipping file compressed during walk", "file", sf.staged)
+		outFile = sf.staged
+		seekIndex = sf.seek
+		ef.Rows = sf.rows
+		ef.UncompressedSize = sf.uncompressedSize
+		ef.Provenance = sf.provenance
+		ef.Size = sf.size
+		ef.SHA256 = sf.sha256
+
+		st = &FileState{
+			Path:       ef.Path(),
+			Walk:       wi.Name,
+			Stage:      FileStageCompressed,
+			Staged:     outFile,
+			Rows:       ef.Rows,
+			Size:       ef.Size,
+			SHA256:     ef.SHA256,
+			Provenance: ef.Provenance,
+			Seek:       seekIndex,
+		}
+		if err := recordFileState(st); err != nil {
+			ll.Errorw("failed to record file state", "error", err, "stage", st.Stage)
+		}
+	} else {
+		seekIndex, err = compressExportFile(ctx, ef, walkFile, outFile)
+		if err != nil {
+			return quarantineInvalidWalkFile(err, walkFile, ll)
+		}
 
-	cmd := exec.Command("bash", "-c", bashcmd)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+		st = &FileState{
+			Path:       ef.Path(),
+			Walk:       wi.Name,
+			Stage:      FileStageCompressed,
+			Staged:     outFile,
+			Rows:       ef.Rows,
+			Size:       ef.Size,
+			SHA256:     ef.SHA256,
+			Provenance: ef.Provenance,
+			Seek:       seekIndex,
+		}
+		if err := recordFileState(st); err != nil {
+			ll.Errorw("failed to record file state", "error", err, "stage", st.Stage)
+		}
+	}
 
-	if err := cmd.Run(); err != nil {
-		ll.Errorf("compression failed: %v", err)
-		ll.Errorf("command used: %s", bashcmd)
-		ll.Errorf("stderr: %s", stderr.String())
-		return fmt.Errorf("compression: %w", err)
+	ef.Cid, err = rawCidFromSHA256(ef.SHA256)
+	if err != nil {
+		return fmt.Errorf("cid: %w", err)
 	}
 
-	if _, err := os.Stat(shipFile); err != nil {
-		return fmt.Errorf("file %q stat error: %w", shipFile, err)
+	// Files are added to IPFS before being shipped since the compressed file may be consumed by the shipper
+	ef.IPFSCid = cid.Undef
+	if st.Stage.Reached(FileStagePinned) {
+		ef.IPFSCid, _ = cid.Decode(st.IPFSCid)
+	} else if ipfsConfig.apiURL != "" {
+		ll.Debugf("adding %s to ipfs", outFile)
+		ef.IPFSCid, err = ipfsAddFile(ctx, ipfsConfig.client, ipfsConfig.apiURL, outFile, ipfsConfig.pin)
+		if err != nil {
+			discardStagedFile(outFile)
+			return fmt.Errorf("ipfs add: %w", err)
+		}
+		ll.Infow("added export file to ipfs", "cid", ef.IPFSCid.String(), "pinned", ipfsConfig.pin)
+
+		st.Stage = FileStagePinned
+		st.IPFSCid = ef.IPFSCid.String()
+		if err := recordFileState(st); err != nil {
+			ll.Errorw("failed to record file state", "error", err, "stage", st.Stage)
+		}
+	}
+
+	if !st.Stage.Reached(FileStageShipped) {
+		if err := retryUpload(ctx, outFile, func(ctx context.Context) error { return sh.Put(ctx, ef.Path(), outFile) }); err != nil {
+			discardStagedFile(outFile)
+			return fmt.Errorf("ship to %s: %w", sh, err)
+		}
+
+		st.Stage = FileStageShipped
+		if err := recordFileState(st); err != nil {
+			ll.Errorw("failed to record file state", "error", err, "stage", st.Stage)
+		}
+	}
+
+	if seekIndex != nil {
+		data, err := json.MarshalIndent(seekIndex, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal seek index: %w", err)
+		}
+		if err := sh.Write(ctx, ef.Path()+SeekIndexSuffix, data); err != nil {
+			return fmt.Errorf("write seek index: %w", err)
+		}
+	}
+
+	// The checksum file is written last so that its presence implies the file is complete
+	if err := writeChecksumFile(ctx, sh, ef.Path(), ef.SHA256, ef.Filename()); err != nil {
+		return err
+	}
+
+	if err := forgetFileState(ef); err != nil {
+		ll.Errorw("failed to remove file state", "error", err)
 	}
 
 	return nil
 }
 
-func ensureAncillaryFiles(shipPath string, tables []Table) error {
-	// Ensure header files are present for tables being exported
-	if err := ensureHeaderFiles(shipPath, tables); err != nil {
-		return fmt.Errorf("ensure header files: %w", err)
+// quarantineInvalidWalkFile moves the walk output of a table to the quarantine path when err reports that it failed row
+// validation. The error is returned unchanged.
+func quarantineInvalidWalkFile(err error, walkFile string, ll basicLogger) error {
+	var rve *RowValidationError
+	if !errors.As(err, &rve) {
+		return err
+	}
+	dst, qerr := quarantineWalkFile(walkFile)
+	if qerr != nil {
+		ll.Errorw("failed to quarantine invalid walk output", "error", qerr, "file", walkFile)
+		return err
 	}
+	ll.Errorw("quarantined invalid walk output", "reason", rve.Error(), "file", dst)
+	return err
+}
 
-	if err := ensureSchemaFiles(shipPath, tables); err != nil {
-		return fmt.Errorf("ensure schema files: %w", err)
+// discardStagedFile removes a compressed file that could not be shipped. When a state store is configured the file is
+// kept so that shipping can be retried without compressing it again.
+func discardStagedFile(path string) {
+	if stateStore != nil {
+		return
 	}
-	return nil
+	os.Remove(path)
 }
 
-func ensureHeaderFiles(shipPath string, tables []Table) error {
-	for _, table := range tables {
-		headerBasePath := filepath.Join(shipPath, networkConfig.name, "csv", strconv.Itoa(storageConfig.schemaVersion), table.Name)
-		if _, err := os.Stat(headerBasePath); err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				return fmt.Errorf("stat header base path (%q): %w", headerBasePath, err)
+// compressExportFile compresses the walk output for an export file to outFile using compressExportReader. The file is compressed to a temporary file and only moved
+// into place once compression has succeeded.
+func compressExportFile(ctx context.Context, ef *ExportFile, walkFile string, outFile string) (*SeekIndex, error) {
+	filePath := filepath.Dir(outFile)
+	if err := os.MkdirAll(filePath, DefaultDirPerms); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", filePath, err)
+	}
+
+	logger.Debugf("compressing to %s", outFile)
+
+	tmp, err := os.CreateTemp(filePath, "."+filepath.Base(outFile)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	src, err := os.Open(walkFile)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer src.Close()
+
+	seekIndex, err := compressExportReader(ctx, ef, src, tmp)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	// The file is flushed to disk before being renamed into place so that a crash cannot leave a truncated file at
+	// the final path
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		return nil, fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), outFile); err != nil {
+		return nil, fmt.Errorf("rename: %w", err)
+	}
+	if err := syncDir(filePath); err != nil {
+		return nil, err
+	}
+
+	return seekIndex, nil
+}
+
+// compressExportReader compresses walk output read from src to w, converting it to the file's format, and sets the
+// row count, size and checksum of the file.
+func compressExportReader(ctx context.Context, ef *ExportFile, src io.Reader, w io.Writer) (*SeekIndex, error) {
+	// Rows are validated as they are read so that the remains of an interrupted lily write are not shipped
+	var vr *validatingReader
+	if shippingConfig.validateRows {
+		v, err := newRowValidator(ef)
+		if err != nil {
+			return nil, fmt.Errorf("row validator: %w", err)
+		}
+		vr = newValidatingReader(src, v)
+		defer vr.Close()
+		src = vr
+	}
+
+	var in io.Reader = src
+	if shippingConfig.normalizeRows {
+		layout, err := rowLayoutForTable(ef.TableName)
+		if err != nil {
+			return nil, fmt.Errorf("row layout: %w", err)
+		}
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			dropped, err := mergeCSVRows(src, pw, layout)
+			if err == nil && dropped > 0 {
+				logger.Infow("dropped duplicate rows", "table", ef.TableName, "rows", dropped)
 			}
+			pw.CloseWithError(err)
+		}()
+		in = pr
+	}
+
+	// Formats other than csv are converted from the walk output as it is compressed
+	rc := &csvRowCounter{r: in}
+	var r io.Reader = &contextReader{ctx: ctx, r: rc}
+	if f := FormatsByName[ef.Format]; f.Convert != nil {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(r io.Reader) {
+			pw.CloseWithError(f.Convert(ef, r, pw))
+		}(r)
+		r = pr
+	}
 
-			if err := os.MkdirAll(headerBasePath, DefaultDirPerms); err != nil {
-				return fmt.Errorf("mkdir %q: %w", headerBasePath, err)
+	if ef.Format == FormatCSV && shippingConfig.csvProvenance {
+		r = io.MultiReader(strings.NewReader(provenanceForFile(ef).csvLine()), r)
+		ef.Provenance = true
+	}
+
+	// The checksum of the compressed, and possibly encrypted, output is computed as it is written
+	cw := NewChecksumWriter(w)
+	ew, err := encryptFile(ef, cw)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	seekIndex, err := ef.Compression.Compress(ef, r, ew)
+	if err != nil {
+		if vr != nil {
+			if verr := vr.Invalid(); verr != nil {
+				return nil, verr
 			}
 		}
+		logger.Errorw("compression failed", "error", err, "table", ef.TableName)
+		return nil, fmt.Errorf("compression: %w", err)
+	}
+	if err := ew.Close(); err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+
+	ef.Rows = rc.Rows()
+	ef.UncompressedSize = rc.size
+	ef.Size = cw.Size()
+	ef.SHA256 = cw.SHA256()
+	return seekIndex, nil
+}
 
-		headerPath := filepath.Join(headerBasePath, table.Name+".header")
+func ensureAncillaryFiles(ctx context.Context, sh Shipper, tables []Table) error {
+	// Ensure header files are present for tables being exported
+	if err := ensureHeaderFiles(ctx, sh, tables); err != nil {
+		return fmt.Errorf("ensure header files: %w", err)
+	}
+
+	if err := ensureSchemaFiles(ctx, sh, tables); err != nil {
+		return fmt.Errorf("ensure schema files: %w", err)
+	}
+
+	if err := ensureSchemaDescriptorFiles(ctx, sh, tables); err != nil {
+		return fmt.Errorf("ensure schema descriptor files: %w", err)
+	}
+
+	if err := ensureDictionaryFiles(ctx, sh, tables); err != nil {
+		return fmt.Errorf("ensure dictionary files: %w", err)
+	}
+	return nil
+}
 
-		_, err := os.Stat(headerPath)
+func ensureHeaderFiles(ctx context.Context, sh Shipper, tables []Table) error {
+	for _, table := range tables {
+		headerPath := filepath.Join(table.ShipDir(networkConfig.name, "csv", storageConfig.schemaVersion), table.Name+".header")
+
+		_, err := sh.Stat(ctx, headerPath)
 		if err == nil {
 			continue
 		}
@@ -154,7 +514,7 @@ func ensureHeaderFiles(shipPath string, tables []Table) error {
 			return fmt.Errorf("generate table headers for %s: %w", table.Name, err)
 		}
 
-		if err := os.WriteFile(headerPath, []byte(strings.Join(headers, ",")), DefaultFilePerms); err != nil {
+		if err := sh.Write(ctx, headerPath, []byte(strings.Join(headers, ","))); err != nil {
 			return fmt.Errorf("write table headers for %s: %w", table.Name, err)
 		}
 	}
@@ -162,22 +522,11 @@ func ensureHeaderFiles(shipPath string, tables []Table) error {
 	return nil
 }
 
-func ensureSchemaFiles(shipPath string, tables []Table) error {
+func ensureSchemaFiles(ctx context.Context, sh Shipper, tables []Table) error {
 	for _, table := range tables {
-		schemaBasePath := filepath.Join(shipPath, networkConfig.name, "csv", strconv.Itoa(storageConfig.schemaVersion), table.Name)
-		if _, err := os.Stat(schemaBasePath); err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				return fmt.Errorf("stat schema base path (%q): %w", schemaBasePath, err)
-			}
+		schemaPath := filepath.Join(table.ShipDir(networkConfig.name, "csv", storageConfig.schemaVersion), table.Name+".schema")
 
-			if err := os.MkdirAll(schemaBasePath, DefaultDirPerms); err != nil {
-				return fmt.Errorf("mkdir %q: %w", schemaBasePath, err)
-			}
-		}
-
-		schemaPath := filepath.Join(schemaBasePath, table.Name+".schema")
-
-		_, err := os.Stat(schemaPath)
+		_, err := sh.Stat(ctx, schemaPath)
 		if err == nil {
 			continue
 		}
@@ -192,10 +541,41 @@ func ensureSchemaFiles(shipPath string, tables []Table) error {
 			return fmt.Errorf("generate table schema for %s: %w", table.Name, err)
 		}
 
-		if err := os.WriteFile(schemaPath, []byte(schema), DefaultFilePerms); err != nil {
+		if err := sh.Write(ctx, schemaPath, []byte(schema)); err != nil {
 			return fmt.Errorf("write table schema for %s: %w", table.Name, err)
 		}
 	}
 
 	return nil
 }
+
+func ensureSchemaDescriptorFiles(ctx context.Context, sh Shipper, tables []Table) error {
+	for _, table := range tables {
+		descriptorPath := filepath.Join(table.ShipDir(networkConfig.name, "csv", storageConfig.schemaVersion), table.Name+SchemaDescriptorSuffix)
+
+		_, err := sh.Stat(ctx, descriptorPath)
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("stat schema descriptor path (%q): %w", descriptorPath, err)
+		}
+
+		logger.Debugf("writing schema descriptor file for %s", table.Name)
+		td, err := TableDescriptorFor(table, storageConfig.schemaVersion)
+		if err != nil {
+			return fmt.Errorf("generate table schema descriptor for %s: %w", table.Name, err)
+		}
+		data, err := json.MarshalIndent(td, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode table schema descriptor for %s: %w", table.Name, err)
+		}
+
+		if err := sh.Write(ctx, descriptorPath, data); err != nil {
+			return fmt.Errorf("write table schema descriptor for %s: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}
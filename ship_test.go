@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseShipTargets(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "csv.gz", want: []string{"csv.gzip"}},
+		{in: "csv.gz, csv.zstd-seekable", want: []string{"csv.gzip", "csv.zstd-seekable"}},
+		{in: "csv.gz,csv.gzip", wantErr: true},
+		{in: "csv", wantErr: true},
+		{in: "xml.gz", wantErr: true},
+		{in: "csv.bz2", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			targets, err := parseShipTargets(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(targets) != len(tc.want) {
+				t.Fatalf("got %d targets, wanted %d", len(targets), len(tc.want))
+			}
+			for i := range targets {
+				if targets[i].String() != tc.want[i] {
+					t.Errorf("target %d: got %s, wanted %s", i, targets[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureSchemaDescriptorFiles(t *testing.T) {
+	shipPath := t.TempDir()
+	sh, err := newShipper(shipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := TablesByName["messages"]
+	if err := ensureSchemaDescriptorFiles(context.Background(), sh, []Table{table}); err != nil {
+		t.Fatalf("ensure schema descriptor files: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(shipPath, table.ShipDir(networkConfig.name, "csv", storageConfig.schemaVersion), "messages"+SchemaDescriptorSuffix))
+	if err != nil {
+		t.Fatalf("read descriptor: %v", err)
+	}
+	var td TableDescriptor
+	if err := json.Unmarshal(data, &td); err != nil {
+		t.Fatalf("decode descriptor: %v", err)
+	}
+
+	headers, err := TableHeaders(table.Model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if td.Table != "messages" || td.Task != table.Task || len(td.Columns) != len(headers) {
+		t.Fatalf("unexpected descriptor: %+v", td)
+	}
+	for i, c := range td.Columns {
+		if c.Name != headers[i] {
+			t.Errorf("column %d is %q, wanted %q to match the csv header", i, c.Name, headers[i])
+		}
+		if c.Name == "cid" && (!c.PrimaryKey || c.Nullable || c.Type == "") {
+			t.Errorf("unexpected cid column %+v", c)
+		}
+	}
+}
+
+func TestCompressExportFileLeavesNoTempFiles(t *testing.T) {
+	defer func(n string, v int) { networkConfig.name, storageConfig.schemaVersion = n, v }(networkConfig.name, storageConfig.schemaVersion)
+	networkConfig.name, storageConfig.schemaVersion = "mainnet", 1
+
+	shipPath := t.TempDir()
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	tables := []Table{TablesByName["chain_consensus"]}
+	targets := []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}}
+	sh := &fileShipper{root: shipPath}
+
+	em, err := manifestForPeriod(context.Background(), p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := em.Files[0]
+	outFile := filepath.Join(shipPath, ef.Path())
+
+	// A temporary file left by a crash part way through compressing is not a shipped file
+	if err := os.MkdirAll(filepath.Dir(outFile), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(filepath.Dir(outFile), "."+filepath.Base(outFile)+".123.tmp")
+	if err := os.WriteFile(stale, []byte("truncated"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sh.Stat(context.Background(), filepath.ToSlash(mustRel(t, shipPath, stale))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat of temporary file: got %v, wanted not exist", err)
+	}
+	em, err = manifestForPeriod(context.Background(), p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if em.Files[0].Shipped {
+		t.Errorf("file with only a temporary file should not be shipped")
+	}
+
+	walkFile := filepath.Join(t.TempDir(), "chain_consensus.csv")
+	if err := os.WriteFile(walkFile, []byte("1005360,root,parent,tipset\n"), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressExportFile(context.Background(), ef, walkFile, outFile); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(outFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isTempFile(e.Name()) && filepath.Join(filepath.Dir(outFile), e.Name()) != stale {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+	if ef.Rows != 1 || ef.Size == 0 {
+		t.Errorf("unexpected compressed file %+v", ef)
+	}
+	em, err = manifestForPeriod(context.Background(), p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !em.Files[0].Shipped {
+		t.Errorf("file renamed into place should be shipped")
+	}
+}
+
+func mustRel(t *testing.T, base, path string) string {
+	t.Helper()
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
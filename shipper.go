@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ObjectInfo describes a file held by a shipper.
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Shipper is a destination that export files are shipped to. Paths are relative to the root of the destination and
+// always use forward slashes.
+type Shipper interface {
+	// Stat returns information about the file at path. It returns an error satisfying errors.Is(err, os.ErrNotExist)
+	// if there is no such file.
+	Stat(ctx context.Context, path string) (*ObjectInfo, error)
+
+	// Put ships the local file src to path, replacing any existing file. The local file is consumed: it is either
+	// removed or becomes the shipped file.
+	Put(ctx context.Context, path string, src string) error
+
+	// Write ships a small file, such as a header or index, held in memory.
+	Write(ctx context.Context, path string, data []byte) error
+
+	// Read returns the contents of a small shipped file. It returns an error satisfying errors.Is(err, os.ErrNotExist)
+	// if there is no such file.
+	Read(ctx context.Context, path string) ([]byte, error)
+
+	// String returns the location of the destination, for use in log messages.
+	String() string
+}
+
+// newShipper returns the shipper for a ship path. Paths of the form s3://bucket/prefix or gs://bucket/prefix ship to
+// an object store, any other path is a directory on a local or shared filesystem.
+func newShipper(shipPath string) (Shipper, error) {
+	u, err := url.Parse(shipPath)
+	if err == nil {
+		switch u.Scheme {
+		case "s3", "gs":
+			return newObjectStoreShipper(u)
+		}
+	}
+
+	if err := verifyShipPath(shipPath); err != nil {
+		return nil, err
+	}
+	return &fileShipper{root: shipPath, limits: shipLimitsFor(shipPath)}, nil
+}
+
+// localShipPath returns the directory a shipper writes to when shipping to a filesystem, or false for object stores.
+// The catalog's view of file modification times, replication and storage deals all require direct access to the
+// shipped files.
+func localShipPath(sh Shipper) (string, bool) {
+	if ms, ok := sh.(*multiShipper); ok {
+		sh = ms.Shipper
+	}
+	fs, ok := sh.(*fileShipper)
+	if !ok {
+		return "", false
+	}
+	return fs.root, true
+}
+
+// fileShipper ships files to a directory on a local or shared filesystem.
+type fileShipper struct {
+	root   string
+	limits *shipLimits // bandwidth and concurrency limits of the destination, nil if unlimited
+}
+
+var _ Shipper = (*fileShipper)(nil)
+
+// Stat never reports a temporary file, so that a file part way through being written is not mistaken for one that has
+// been shipped.
+func (s *fileShipper) Stat(ctx context.Context, path string) (*ObjectInfo, error) {
+	if isTempFile(path) {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	info, err := os.Stat(filepath.Join(s.root, filepath.FromSlash(path)))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Put places the file in the ship path. Files that were compressed directly into the ship path are already in place,
+// staged files are linked in using the configured link mode.
+func (s *fileShipper) Put(ctx context.Context, path string, src string) error {
+	dst := filepath.Join(s.root, filepath.FromSlash(path))
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return nil
+	}
+
+	release, err := s.limits.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	logger.Debugf("placing %s in ship path using %s", src, shippingConfig.linkMode)
+	wrap := func(w io.Writer) io.Writer { return s.limits.writer(ctx, w) }
+	if err := linkFile(src, dst, shippingConfig.linkMode, wrap); err != nil {
+		return fmt.Errorf("place staged file: %w", err)
+	}
+	if err := os.Remove(src); err != nil {
+		logger.Errorw("failed to remove staged file", "error", err, "file", src)
+	}
+	return nil
+}
+
+func (s *fileShipper) Write(ctx context.Context, path string, data []byte) error {
+	dst := filepath.Join(s.root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(dst), DefaultDirPerms); err != nil {
+		return fmt.Errorf("mkdir %q: %w", filepath.Dir(dst), err)
+	}
+
+	release, err := s.limits.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := s.limits.waitN(ctx, len(data)); err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, data)
+}
+
+func (s *fileShipper) Read(ctx context.Context, path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.root, filepath.FromSlash(path)))
+}
+
+func (s *fileShipper) String() string {
+	return s.root
+}
+
+// joinObjectKey joins a key prefix and a path relative to it.
+func joinObjectKey(prefix, path string) string {
+	prefix = strings.Trim(prefix, "/")
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if prefix == "" {
+		return path
+	}
+	return prefix + "/" + path
+}
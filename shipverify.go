@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ShippedFileCheck is the outcome of checking a shipped file against its checksum file.
+type ShippedFileCheck string
+
+const (
+	ShippedFileOK           ShippedFileCheck = "ok"
+	ShippedFileMismatch     ShippedFileCheck = "checksum mismatch"
+	ShippedFileMissing      ShippedFileCheck = "file missing"
+	ShippedFileNoChecksum   ShippedFileCheck = "no checksum file"
+	ShippedFileBadChecksum  ShippedFileCheck = "invalid checksum file"
+	ShippedFileBadSignature ShippedFileCheck = "invalid signature"
+)
+
+// isShippedDataFile reports whether a path relative to the ship path is an export file rather than an ancillary
+// file such as a header, index or checksum. Export files are always held in a year directory.
+func isShippedDataFile(rel string) bool {
+	name := filepath.Base(rel)
+	if strings.HasPrefix(name, ".") {
+		return false // temporary file
+	}
+	for _, suffix := range []string{ChecksumSuffix, SignatureSuffix, ".json", ".header", ".schema"} {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	// Files shipped with a layout may be in any directory beneath the network's
+	if fileLayout != nil {
+		return true
+	}
+	year := filepath.Base(filepath.Dir(rel))
+	if _, err := strconv.Atoi(year); err != nil || len(year) != 4 {
+		return false
+	}
+	return true
+}
+
+// checkShippedFile compares a shipped file with the checksum recorded in its checksum file.
+func checkShippedFile(shipPath, rel string) (ShippedFileCheck, error) {
+	full := filepath.Join(shipPath, rel)
+	data, err := os.ReadFile(full + ChecksumSuffix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ShippedFileNoChecksum, nil
+		}
+		return "", fmt.Errorf("read checksum file: %w", err)
+	}
+
+	want, name, err := parseChecksumFile(data)
+	if err != nil || name != filepath.Base(rel) {
+		return ShippedFileBadChecksum, nil
+	}
+
+	got, _, err := sha256File(full)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ShippedFileMissing, nil
+		}
+		return "", fmt.Errorf("checksum: %w", err)
+	}
+	if got != want {
+		return ShippedFileMismatch, nil
+	}
+	return ShippedFileOK, nil
+}
+
+// checkShippedFileSignature checks that the checksum file of a shipped file was signed by the given signer.
+func checkShippedFileSignature(shipPath, rel, signer string) error {
+	full := filepath.Join(shipPath, rel)
+	data, err := os.ReadFile(full + ChecksumSuffix)
+	if err != nil {
+		return fmt.Errorf("read checksum file: %w", err)
+	}
+	sd, err := os.ReadFile(full + ChecksumSuffix + SignatureSuffix)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("not signed")
+		}
+		return fmt.Errorf("read signature file: %w", err)
+	}
+	sig := &Signature{}
+	if err := json.Unmarshal(sd, sig); err != nil {
+		return fmt.Errorf("decode signature file: %w", err)
+	}
+	return verifySignature(sig, signer, data)
+}
+
+// checkPeriodManifestSignature checks that a period manifest was signed by the given signer.
+func checkPeriodManifestSignature(path, signer string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	signed, err := signedManifestData(pm)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return verifySignature(pm.Signature, signer, signed)
+}
+
+var verifyShippedCommand = &cli.Command{
+	Name:   "verify-shipped",
+	Usage:  "Check shipped files against their checksum files to detect corruption.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path used to write verified exports from lily.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "tables",
+				Usage: "Comma separated list of tables to check. Default is all tables.",
+			},
+			&cli.BoolFlag{
+				Name:  "require-checksums",
+				Usage: "Report shipped files that have no checksum file as failures.",
+			},
+			&cli.StringFlag{
+				Name:  "signer",
+				Usage: "Also check that every checksum file and period manifest was signed by this signer, given as the hex encoded ed25519 public key or the Filecoin wallet address that the archiver signs with. BLS wallet signatures cannot be checked.",
+			},
+			&cli.BoolFlag{
+				Name:  "verbose",
+				Usage: "Report every file checked, not just failures.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := cc.Context
+		shipPath := cc.String("ship-path")
+		signer := cc.String("signer")
+		if err := verifyShipPath(shipPath); err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+
+		var tables map[string]bool
+		if cc.IsSet("tables") {
+			list, err := parseTableList(cc.String("tables"))
+			if err != nil {
+				return fmt.Errorf("invalid tables: %w", err)
+			}
+			tables = map[string]bool{}
+			for _, t := range list {
+				tables[t] = true
+			}
+		}
+
+		// Experimental tables are shipped beneath a separate prefix
+		var files []string
+		for _, root := range []string{networkConfig.name, filepath.Join("experimental", networkConfig.name)} {
+			err := filepath.WalkDir(filepath.Join(shipPath, root), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if errors.Is(err, os.ErrNotExist) {
+						return nil
+					}
+					return err
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if !d.Type().IsRegular() {
+					return nil
+				}
+
+				rel, err := filepath.Rel(shipPath, path)
+				if err != nil {
+					return err
+				}
+				if strings.HasSuffix(rel, ChecksumSuffix) {
+					// Export files that have gone missing are found through their checksum file
+					dataRel := strings.TrimSuffix(rel, ChecksumSuffix)
+					if _, err := os.Stat(filepath.Join(shipPath, dataRel)); errors.Is(err, os.ErrNotExist) && isShippedDataFile(dataRel) {
+						files = append(files, dataRel)
+					}
+					return nil
+				}
+				if isShippedDataFile(rel) {
+					files = append(files, rel)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("scan ship path: %w", err)
+			}
+		}
+		sort.Strings(files)
+
+		var checked, failed, unchecked int
+		for _, rel := range files {
+			// Files are written to <table dir>/<year>/<file> and table directories are named after the table
+			if tables != nil && !tables[filepath.Base(filepath.Dir(filepath.Dir(rel)))] {
+				continue
+			}
+
+			result, err := checkShippedFile(shipPath, rel)
+			if err != nil {
+				return fmt.Errorf("check %s: %w", rel, err)
+			}
+			if result == ShippedFileOK && signer != "" {
+				if err := checkShippedFileSignature(shipPath, rel, signer); err != nil {
+					checked++
+					failed++
+					fmt.Printf("%s: %s: %v\n", rel, ShippedFileBadSignature, err)
+					continue
+				}
+			}
+
+			switch result {
+			case ShippedFileOK:
+				checked++
+				if cc.Bool("verbose") {
+					fmt.Printf("%s: %s\n", rel, result)
+				}
+				continue
+			case ShippedFileNoChecksum:
+				if !cc.Bool("require-checksums") {
+					unchecked++
+					if cc.Bool("verbose") {
+						fmt.Printf("%s: %s\n", rel, result)
+					}
+					continue
+				}
+			}
+
+			checked++
+			failed++
+			fmt.Printf("%s: %s\n", rel, result)
+		}
+
+		if signer != "" {
+			var manifests []string
+			err := filepath.WalkDir(filepath.Join(shipPath, networkConfig.name, ManifestDir), func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if errors.Is(err, os.ErrNotExist) {
+						return nil
+					}
+					return err
+				}
+				if d.Type().IsRegular() && strings.HasSuffix(path, ".json") && !strings.HasPrefix(d.Name(), ".") {
+					manifests = append(manifests, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("scan manifests: %w", err)
+			}
+			sort.Strings(manifests)
+
+			for _, path := range manifests {
+				rel, _ := filepath.Rel(shipPath, path)
+				checked++
+				if err := checkPeriodManifestSignature(path, signer); err != nil {
+					failed++
+					fmt.Printf("%s: %s: %v\n", rel, ShippedFileBadSignature, err)
+					continue
+				}
+				if cc.Bool("verbose") {
+					fmt.Printf("%s: %s\n", rel, ShippedFileOK)
+				}
+			}
+		}
+
+		fmt.Printf("checked %d files, %d failed, %d without checksums\n", checked, failed, unchecked)
+		if failed > 0 {
+			return fmt.Errorf("one or more shipped files failed verification")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp" // register secp256k1 signature verification
+)
+
+// SignatureSuffix is appended to the path of a checksum file to give the path of its detached signature.
+const SignatureSuffix = ".sig"
+
+// Signature types
+const (
+	SignatureEd25519   = "ed25519"
+	SignatureSecp256k1 = "secp256k1"
+	SignatureBLS       = "bls"
+)
+
+// Signature is a signature made by the archiver over a manifest or checksum file. The signer is the hex encoded public
+// key of an ed25519 key or the address of a Filecoin wallet.
+type Signature struct {
+	Type   string `json:"type"`
+	Signer string `json:"signer"`
+	Data   string `json:"data"` // base64 encoded signature
+}
+
+// Signer signs the manifests and checksum files shipped by the archiver.
+type Signer interface {
+	Sign(ctx context.Context, data []byte) (*Signature, error)
+}
+
+// archiveSigner signs shipped manifests and checksum files, nil if signing is not configured.
+var archiveSigner Signer
+
+// configureSigning creates the signer named by the signing flags.
+func configureSigning() error {
+	archiveSigner = nil
+	switch {
+	case signingConfig.keyFile != "" && signingConfig.wallet != "":
+		return fmt.Errorf("only one of a signing key or a signing wallet may be given")
+	case signingConfig.keyFile != "":
+		key, err := loadEd25519Key(signingConfig.keyFile)
+		if err != nil {
+			return fmt.Errorf("signing key: %w", err)
+		}
+		archiveSigner = &ed25519Signer{key: key}
+	case signingConfig.wallet != "":
+		addr, err := address.NewFromString(signingConfig.wallet)
+		if err != nil {
+			return fmt.Errorf("invalid signing wallet: %w", err)
+		}
+		if signingConfig.lotusAddr == "" {
+			return fmt.Errorf("signing with a wallet requires a lotus api address")
+		}
+		archiveSigner = &walletSigner{addr: addr, apiAddr: signingConfig.lotusAddr, apiToken: signingConfig.lotusToken}
+	}
+	return nil
+}
+
+// loadEd25519Key reads a PEM encoded PKCS #8 ed25519 private key, as written by openssl genpkey -algorithm ed25519.
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	ek, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not an ed25519 key")
+	}
+	return ek, nil
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func (s *ed25519Signer) Sign(ctx context.Context, data []byte) (*Signature, error) {
+	return &Signature{
+		Type:   SignatureEd25519,
+		Signer: hex.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+		Data:   base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data)),
+	}, nil
+}
+
+// walletSigner signs using a key held in the wallet of a lotus node.
+type walletSigner struct {
+	addr     address.Address
+	apiAddr  string
+	apiToken string
+}
+
+func (s *walletSigner) Sign(ctx context.Context, data []byte) (*Signature, error) {
+	api, closer, err := getLotusAPI(ctx, s.apiAddr, s.apiToken)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	sig, err := api.WalletSign(ctx, s.addr, data)
+	if err != nil {
+		return nil, fmt.Errorf("wallet sign: %w", err)
+	}
+
+	var typ string
+	switch sig.Type {
+	case crypto.SigTypeSecp256k1:
+		typ = SignatureSecp256k1
+	case crypto.SigTypeBLS:
+		typ = SignatureBLS
+	default:
+		return nil, fmt.Errorf("unsupported wallet signature type %d", sig.Type)
+	}
+	return &Signature{
+		Type:   typ,
+		Signer: s.addr.String(),
+		Data:   base64.StdEncoding.EncodeToString(sig.Data),
+	}, nil
+}
+
+// verifySignature checks that sig is a signature over data made by the expected signer. BLS signatures cannot be
+// verified without the native Filecoin libraries and are reported as unverifiable.
+func verifySignature(sig *Signature, signer string, data []byte) error {
+	if sig == nil {
+		return fmt.Errorf("not signed")
+	}
+	if !strings.EqualFold(sig.Signer, signer) {
+		return fmt.Errorf("signed by %s, not %s", sig.Signer, signer)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig.Data)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	switch sig.Type {
+	case SignatureEd25519:
+		pub, err := hex.DecodeString(sig.Signer)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid ed25519 public key %q", sig.Signer)
+		}
+		if !ed25519.Verify(ed25519.PublicKey(pub), data, raw) {
+			return fmt.Errorf("signature did not match")
+		}
+		return nil
+	case SignatureSecp256k1:
+		addr, err := address.NewFromString(sig.Signer)
+		if err != nil {
+			return fmt.Errorf("invalid signer address: %w", err)
+		}
+		return sigs.Verify(&crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: raw}, addr, data)
+	case SignatureBLS:
+		return fmt.Errorf("bls signatures cannot be verified by the archiver")
+	default:
+		return fmt.Errorf("unknown signature type %q", sig.Type)
+	}
+}
+
+// signedManifestData returns the data covered by a manifest's signature, which is the compact JSON encoding of the
+// manifest without its signature.
+func signedManifestData(pm *PeriodManifest) ([]byte, error) {
+	unsigned := *pm
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// signPeriodManifest replaces the signature of the manifest with one made by the archive signer. Manifests are left
+// unsigned when no signer is configured.
+func signPeriodManifest(ctx context.Context, pm *PeriodManifest) error {
+	pm.Signature = nil
+	if archiveSigner == nil {
+		return nil
+	}
+	data, err := signedManifestData(pm)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	pm.Signature, err = archiveSigner.Sign(ctx, data)
+	if err != nil {
+		return fmt.Errorf("sign manifest: %w", err)
+	}
+	return nil
+}
+
+// writeChecksumFile writes the checksum file of a shipped file. When a signer is configured the detached signature of
+// the checksum file is written first, so that a checksum file is never present without its signature.
+func writeChecksumFile(ctx context.Context, sh Shipper, path string, sum string, name string) error {
+	data := checksumFileContents(sum, name)
+	if archiveSigner != nil {
+		sig, err := archiveSigner.Sign(ctx, data)
+		if err != nil {
+			return fmt.Errorf("sign checksum file: %w", err)
+		}
+		sd, err := json.Marshal(sig)
+		if err != nil {
+			return fmt.Errorf("encode signature: %w", err)
+		}
+		if err := sh.Write(ctx, path+ChecksumSuffix+SignatureSuffix, sd); err != nil {
+			return fmt.Errorf("write signature file: %w", err)
+		}
+	}
+	if err := sh.Write(ctx, path+ChecksumSuffix, data); err != nil {
+		return fmt.Errorf("write checksum file: %w", err)
+	}
+	return nil
+}
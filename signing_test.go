@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSignPeriodManifest(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer := hex.EncodeToString(key.Public().(ed25519.PublicKey))
+
+	archiveSigner = &ed25519Signer{key: key}
+	defer func() { archiveSigner = nil }()
+
+	pm := &PeriodManifest{Network: "mainnet", StartHeight: 1000, EndHeight: 1999}
+	if err := signPeriodManifest(context.Background(), pm); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		modify  func(pm *PeriodManifest)
+		signer  string
+		wantErr bool
+	}{
+		{name: "signed", modify: func(pm *PeriodManifest) {}, signer: signer},
+		{name: "modified", modify: func(pm *PeriodManifest) { pm.EndHeight = 2000 }, signer: signer, wantErr: true},
+		{name: "other signer", modify: func(pm *PeriodManifest) {}, signer: hex.EncodeToString(make([]byte, ed25519.PublicKeySize)), wantErr: true},
+		{name: "unsigned", modify: func(pm *PeriodManifest) { pm.Signature = nil }, signer: signer, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := *pm
+			tc.modify(&m)
+			data, err := signedManifestData(&m)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			err = verifySignature(m.Signature, tc.signer, data)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+)
+
+const (
+	ChainSnapshotTable = "chain_snapshot" // name that chain snapshots are shipped under, alongside the table files
+	FormatCAR          = "car"
+)
+
+// chainSnapshotFile returns the export file that the chain snapshot of a period is shipped as. Snapshots are named
+// in the same way as the table files of the period.
+func chainSnapshotFile(p ExportPeriod, network string, schemaVersion int, c Compression) *ExportFile {
+	return &ExportFile{
+		Date:        p.Date,
+		Hour:        p.Hour,
+		Length:      p.Length(),
+		StartHeight: p.StartHeight,
+		EndHeight:   p.EndHeight,
+		Ranged:      p.Ranged || storageConfig.fileNaming == FileNamingHeightRange,
+		Schema:      schemaVersion,
+		Network:     network,
+		TableName:   ChainSnapshotTable,
+		Format:      FormatCAR,
+		Compression: c,
+		Encryption:  shipEncryption(),
+		Cid:         cid.Undef,
+	}
+}
+
+// shipChainSnapshot exports a CAR file of the chain covering the period using the ChainExport method of a lotus node
+// and ships it alongside the table files. The snapshot holds the headers, messages and state trees of the tipsets in
+// the period only, see boundChainExport. Periods whose snapshot has already been shipped are skipped.
+func shipChainSnapshot(ctx context.Context, p ExportPeriod, network string, sh Shipper) error {
+	c, ok := CompressionByName[snapshotConfig.compression]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", snapshotConfig.compression)
+	}
+	ef := chainSnapshotFile(p, network, storageConfig.schemaVersion, c)
+	ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight, "file", ef.Path())
+
+	if _, err := sh.Stat(ctx, ef.Path()); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	// The snapshot is taken from the same final chain as the tables
+	earliestStartTs := HeightToUnix(p.EndHeight+ExportDelay, networkConfig.genesisTs)
+	if err := WaitUntil(ctx, timeIsAfter(earliestStartTs), 0, time.Second*30); err != nil {
+		return fmt.Errorf("failed waiting for earliest export time: %w", err)
+	}
+
+	stagingPath := shippingConfig.stagingPath
+	if stagingPath == "" {
+		if root, ok := localShipPath(sh); ok {
+			stagingPath = root
+		} else {
+			stagingPath = os.TempDir()
+		}
+	}
+	outFile := filepath.Join(stagingPath, ef.Path())
+
+	ll.Info("exporting chain snapshot")
+	start := time.Now()
+	if err := exportChainSnapshot(ctx, ef, outFile); err != nil {
+		return fmt.Errorf("export chain snapshot: %w", err)
+	}
+	ll.Infow("exported chain snapshot", "size", ef.Size, "duration", time.Since(start).String())
+
+	if err := sh.Put(ctx, ef.Path(), outFile); err != nil {
+		os.Remove(outFile)
+		return fmt.Errorf("ship to %s: %w", sh, err)
+	}
+
+	// The checksum file is written last so that its presence implies the snapshot is complete
+	if err := writeChecksumFile(ctx, sh, ef.Path(), ef.SHA256, ef.Filename()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// exportChainSnapshot streams the CAR export of the tipset at the end of the period from lotus, compressing it to
+// outFile, and sets the size and checksum of the export file.
+func exportChainSnapshot(ctx context.Context, ef *ExportFile, outFile string) error {
+	api, closer, err := getLotusAPI(ctx, snapshotConfig.lotusAddr, snapshotConfig.lotusToken)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	ts, err := api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(ef.EndHeight), types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("get tipset at height %d: %w", ef.EndHeight, err)
+	}
+
+	// Messages and state trees older than the period are skipped
+	nroots := abi.ChainEpoch(ef.EndHeight - ef.StartHeight + 1)
+	stream, err := api.ChainExport(ctx, nroots, true, ts.Key())
+	if err != nil {
+		return fmt.Errorf("chain export: %w", err)
+	}
+
+	// Lotus sends an empty chunk once the export is complete and closes the stream without one if the export fails
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	br, bw := io.Pipe()
+	defer br.Close()
+	go func() {
+		err := boundChainExport(pr, bw, ef.StartHeight)
+		pr.CloseWithError(err)
+		bw.CloseWithError(err)
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				pw.CloseWithError(ctx.Err())
+				return
+			case b, ok := <-stream:
+				if !ok {
+					pw.CloseWithError(fmt.Errorf("chain export ended before completion"))
+					return
+				}
+				if len(b) == 0 {
+					pw.Close()
+					return
+				}
+				if _, err := pw.Write(b); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	dir := filepath.Dir(outFile)
+	if err := os.MkdirAll(dir, DefaultDirPerms); err != nil {
+		return fmt.Errorf("mkdir %q: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(outFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	cw := NewChecksumWriter(tmp)
+	ew, err := encryptFile(ef, cw)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("encryption: %w", err)
+	}
+	if _, err := ef.Compression.Compress(ef, br, ew); err != nil {
+		tmp.Close()
+		return fmt.Errorf("compression: %w", err)
+	}
+	if err := ew.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encryption: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), outFile); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	logger.Debugw("chain snapshot written", "tipset", ts.Key().String(), "file", outFile)
+	ef.Size = cw.Size()
+	ef.SHA256 = cw.SHA256()
+	return nil
+}
+
+// boundChainExport copies a CAR produced by ChainExport from r to w, leaving out the blocks that do not belong to the
+// period starting at height from. ChainExport always includes the block headers back to genesis and the genesis state,
+// since lotus requires them to import a snapshot, so the snapshot of every period would otherwise repeat the whole
+// header chain. Headers are found by following the parents of the CAR's roots, and headers below the period are
+// dropped. ChainExport walks the headers from the root to genesis and never writes a block twice, so every block
+// written after the genesis header belongs only to the genesis state and is dropped too.
+func boundChainExport(r io.Reader, w io.Writer, from int64) error {
+	rd := bufio.NewReader(r)
+	h, err := car.ReadHeader(rd)
+	if err != nil {
+		return fmt.Errorf("read car header: %w", err)
+	}
+	if err := car.WriteHeader(h, w); err != nil {
+		return fmt.Errorf("write car header: %w", err)
+	}
+
+	headers := cid.NewSet()
+	for _, c := range h.Roots {
+		headers.Add(c)
+	}
+	genesis := false
+	for {
+		c, data, err := carutil.ReadNode(rd)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read car block: %w", err)
+		}
+		if genesis {
+			continue
+		}
+
+		if headers.Has(c) {
+			var b types.BlockHeader
+			if err := b.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+				return fmt.Errorf("unmarshal block header %s: %w", c, err)
+			}
+			if b.Height > 0 {
+				for _, p := range b.Parents {
+					headers.Add(p)
+				}
+			}
+			if int64(b.Height) < from {
+				genesis = b.Height == 0
+				continue
+			}
+		}
+
+		if err := carutil.LdWrite(w, c.Bytes(), data); err != nil {
+			return fmt.Errorf("write car block: %w", err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multihash"
+)
+
+// testChainExport is a CAR written in the order used by ChainExport for a chain of one block per height: each header
+// followed by its messages and state if they are within the exported roots, and the genesis header followed by the
+// genesis state.
+type testChainExport struct {
+	car    []byte
+	names  map[cid.Cid]string // description of each block, such as "header 3" or "state 3"
+	data   map[cid.Cid][]byte
+	byName map[string]cid.Cid
+}
+
+func newTestChainExport(t *testing.T, head, nroots int64) *testChainExport {
+	t.Helper()
+	miner, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := func(data string) blocks.Block {
+		t.Helper()
+		mh, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := blocks.NewBlockWithCid([]byte(data), cid.NewCidV1(cid.DagCBOR, mh))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	ce := &testChainExport{names: map[cid.Cid]string{}, data: map[cid.Cid][]byte{}, byName: map[string]cid.Cid{}}
+	type entry struct {
+		name string
+		blk  blocks.Block
+	}
+
+	// Headers are built from genesis so that each can link to its parent
+	var chain [][]entry
+	var parent cid.Cid
+	for height := int64(0); height <= head; height++ {
+		h := strconv.FormatInt(height, 10)
+		state := raw("state " + h)
+		msgs := raw("messages " + h)
+		bh := &types.BlockHeader{
+			Miner:                 miner,
+			Height:                abi.ChainEpoch(height),
+			ParentWeight:          types.NewInt(uint64(height)),
+			ParentStateRoot:       state.Cid(),
+			ParentMessageReceipts: msgs.Cid(),
+			Messages:              msgs.Cid(),
+			ParentBaseFee:         types.NewInt(100),
+		}
+		var entries []entry
+		if height == 0 {
+			genesisObj := raw("genesis")
+			bh.Parents = []cid.Cid{genesisObj.Cid()}
+			entries = append(entries, entry{"genesis", genesisObj})
+		} else {
+			bh.Parents = []cid.Cid{parent}
+		}
+		hb, err := bh.ToStorageBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = hb.Cid()
+
+		entries = append([]entry{{"header " + h, hb}}, entries...)
+		if height > head-nroots {
+			entries = append(entries, entry{"messages " + h, msgs}, entry{"state " + h, state})
+		} else if height == 0 {
+			entries = append(entries, entry{"state 0", state})
+		}
+		chain = append(chain, entries)
+	}
+
+	var buf bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{parent}, Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, e := range chain[i] {
+			if err := carutil.LdWrite(&buf, e.blk.Cid().Bytes(), e.blk.RawData()); err != nil {
+				t.Fatal(err)
+			}
+			ce.names[e.blk.Cid()] = e.name
+			ce.data[e.blk.Cid()] = e.blk.RawData()
+			ce.byName[e.name] = e.blk.Cid()
+		}
+	}
+	ce.car = buf.Bytes()
+	return ce
+}
+
+func TestBoundChainExport(t *testing.T) {
+	ce := newTestChainExport(t, 5, 3)
+
+	testCases := []struct {
+		name string
+		from int64
+		want []string
+	}{
+		{
+			name: "period",
+			from: 3,
+			want: []string{"header 5", "messages 5", "state 5", "header 4", "messages 4", "state 4", "header 3", "messages 3", "state 3"},
+		},
+		{
+			name: "from genesis",
+			from: 0,
+			want: []string{
+				"header 5", "messages 5", "state 5", "header 4", "messages 4", "state 4", "header 3", "messages 3", "state 3",
+				"header 2", "header 1", "header 0", "genesis", "state 0",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := boundChainExport(bytes.NewReader(ce.car), &out, tc.from); err != nil {
+				t.Fatal(err)
+			}
+
+			cr, err := car.NewCarReader(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cr.Header.Roots) != 1 || cr.Header.Roots[0] != ce.byName["header 5"] {
+				t.Errorf("got roots %v, wanted the head of the chain", cr.Header.Roots)
+			}
+			var got []string
+			for {
+				b, err := cr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b.RawData(), ce.data[b.Cid()]) {
+					t.Errorf("block %s was altered", ce.names[b.Cid()])
+				}
+				got = append(got, ce.names[b.Cid()])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got blocks %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBoundChainExportErrors(t *testing.T) {
+	ce := newTestChainExport(t, 2, 1)
+
+	// A truncated export is reported rather than shipped as a complete snapshot
+	var out bytes.Buffer
+	if err := boundChainExport(bytes.NewReader(ce.car[:len(ce.car)-3]), &out, 1); err == nil {
+		t.Errorf("expected an error for a truncated export")
+	}
+	if err := boundChainExport(bytes.NewReader([]byte("not a car")), &out, 1); err == nil {
+		t.Errorf("expected an error for an invalid export")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// walkTaskGroups lists the groups of tasks that are run together in one walk when walks are split. Tasks that are not
+// in a group are run in a walk of their own.
+var walkTaskGroups [][]string
+
+// parseWalkGroups parses a comma separated list of task groups, each made up of tasks joined by a plus sign such as
+// block_header+block_message. A task may only belong to one group.
+func parseWalkGroups(str string) ([][]string, error) {
+	if str == "" {
+		return nil, nil
+	}
+
+	seen := map[string]bool{}
+	var groups [][]string
+	for _, entry := range strings.Split(str, ",") {
+		tasks := strings.Split(entry, "+")
+		for _, task := range tasks {
+			if _, ok := KnownTasks[task]; !ok {
+				return nil, fmt.Errorf("unknown task: %q", task)
+			}
+			if seen[task] {
+				return nil, fmt.Errorf("task %q is in more than one group", task)
+			}
+			seen[task] = true
+		}
+		groups = append(groups, tasks)
+	}
+	return groups, nil
+}
+
+// splitManifest splits the manifest into one manifest for each group of tasks with files still to be shipped, so that
+// each group can be produced by its own walk. Groups are named after their tasks so that walks recorded for a group
+// can be found again after a restart, even when only some of the group's tasks are still needed.
+func splitManifest(em *ExportManifest, groups [][]string) []*ExportManifest {
+	groupOf := map[string]string{}
+	for _, tasks := range groups {
+		name := strings.Join(tasks, "+")
+		for _, task := range tasks {
+			groupOf[task] = name
+		}
+	}
+
+	pending := map[string]bool{}
+	for _, task := range tasksForManifest(em) {
+		name, ok := groupOf[task]
+		if !ok {
+			name = task
+		}
+		pending[name] = true
+	}
+
+	var split []*ExportManifest
+	byGroup := map[string]*ExportManifest{}
+	for _, ef := range em.Files {
+		task := TablesByName[ef.TableName].Task
+		name, ok := groupOf[task]
+		if !ok {
+			name = task
+		}
+		if !pending[name] {
+			continue
+		}
+
+		gm, ok := byGroup[name]
+		if !ok {
+			gm = &ExportManifest{
+				Period:      em.Period,
+				Network:     em.Network,
+				Provisional: em.Provisional,
+				Group:       name,
+			}
+			byGroup[name] = gm
+			split = append(split, gm)
+		}
+		gm.Files = append(gm.Files, ef)
+	}
+	return split
+}
+
+// processExportGroups processes the manifest of each group concurrently, so each group's tables are shipped as soon as
+// its own walk has been verified rather than waiting for the slowest task of the period.
+func processExportGroups(ctx context.Context, groups []*ExportManifest, sh Shipper) error {
+	var (
+		mu     sync.Mutex
+		failed []string
+		wg     sync.WaitGroup
+	)
+
+	for _, gm := range groups {
+		wg.Add(1)
+		go func(gm *ExportManifest) {
+			defer wg.Done()
+			if err := processExport(ctx, gm, sh); err != nil {
+				logger.Errorw("failed to process export for task group", "error", err, "date", gm.Period.Date.String(), "group", gm.Group)
+				mu.Lock()
+				failed = append(failed, gm.Group)
+				mu.Unlock()
+			}
+		}(gm)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to process export for task groups %s", strings.Join(failed, ","))
+	}
+	return nil
+}
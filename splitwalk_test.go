@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWalkGroups(t *testing.T) {
+	groups, err := parseWalkGroups("block_header+block_message,message")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]string{{"block_header", "block_message"}, {"message"}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %v, wanted %v", groups, want)
+	}
+
+	if _, err := parseWalkGroups("block_header+unknown"); err == nil {
+		t.Errorf("expected error for unknown task")
+	}
+	if _, err := parseWalkGroups("block_header,block_header+message"); err == nil {
+		t.Errorf("expected error for task in more than one group")
+	}
+}
+
+func TestSplitManifest(t *testing.T) {
+	em := &ExportManifest{
+		Period:  ExportPeriod{Date: Date{2021, 8, 2}, StartHeight: 1005360, EndHeight: 1008239},
+		Network: "mainnet",
+		Files: []*ExportFile{
+			{TableName: "block_headers"},
+			{TableName: "block_messages"},
+			{TableName: "messages"},
+			{TableName: "chain_consensus", Shipped: true},
+		},
+	}
+
+	split := splitManifest(em, [][]string{{"block_header", "block_message"}})
+
+	got := map[string][]string{}
+	for _, gm := range split {
+		if gm.Period != em.Period || gm.Network != em.Network {
+			t.Errorf("group %s has period %+v on %s, wanted %+v on %s", gm.Group, gm.Period, gm.Network, em.Period, em.Network)
+		}
+		for _, ef := range gm.Files {
+			got[gm.Group] = append(got[gm.Group], ef.TableName)
+		}
+	}
+
+	want := map[string][]string{
+		"block_header+block_message": {"block_headers", "block_messages"},
+		"message":                    {"messages"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, wanted %v", got, want)
+	}
+}
+
+func TestCompletedWalkKeyGroups(t *testing.T) {
+	p := ExportPeriod{Date: Date{2021, 8, 2}, StartHeight: 1005360, EndHeight: 1008239}
+	whole := completedWalkKey("mainnet", p, "")
+	if whole != "mainnet/2021-08-02" {
+		t.Errorf("got key %q for whole period", whole)
+	}
+	if group := completedWalkKey("mainnet", p, "message"); group == whole {
+		t.Errorf("group key %q should differ from whole period key", group)
+	}
+}
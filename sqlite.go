@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // register the sqlite3 database/sql driver
+)
+
+// DatabasesPrefix is the directory beneath the ship path that period databases are shipped to.
+const DatabasesPrefix = "databases"
+
+// PeriodDatabase describes the SQLite database built from the csv files of a period.
+type PeriodDatabase struct {
+	Path   string    `json:"path"` // path relative to the ship path
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Tables []string  `json:"tables"`
+	Rows   int64     `json:"rows"`
+	Source string    `json:"source"` // merkle root of the period's files when the database was built
+	Built  time.Time `json:"built"`
+}
+
+// periodDatabasePath returns the path of the database shipped for a period, relative to the ship path. Databases of
+// daily periods are written to databases/<network>/<year>/<network>-<period>.sqlite.
+func periodDatabasePath(network string, p ExportPeriod) string {
+	return filepath.Join(DatabasesPrefix, network, periodDir(p.Length(), p.Date), fmt.Sprintf("%s-%s.sqlite", network, p.String()))
+}
+
+// periodNeedsDatabase reports whether the database of a period is missing or was built from files that have since
+// changed.
+func periodNeedsDatabase(pm *PeriodManifest) bool {
+	return pm.MerkleRoot != "" && (pm.Database == nil || pm.Database.Source != pm.MerkleRoot)
+}
+
+// databaseSourceFiles returns the csv files of a period that its database is built from, grouped by table. Each table
+// is read from the files of a single compression, and the parts of a sharded table are taken in height order. Stale
+// and encrypted files are left out.
+func databaseSourceFiles(pm *PeriodManifest) map[string][]*PeriodManifestFile {
+	files := append([]*PeriodManifestFile(nil), pm.Files...)
+	sort.Slice(files, func(a, b int) bool { return files[a].Path < files[b].Path })
+
+	compressions := map[string]string{}
+	tables := map[string][]*PeriodManifestFile{}
+	for _, f := range files {
+		if f.Format != FormatCSV || f.Stale || f.Encryption != "" {
+			continue
+		}
+		if _, ok := TablesByName[f.Table]; !ok {
+			continue
+		}
+		if c, ok := compressions[f.Table]; ok && c != f.Compression {
+			continue
+		}
+		compressions[f.Table] = f.Compression
+		tables[f.Table] = append(tables[f.Table], f)
+	}
+	for _, fs := range tables {
+		sort.SliceStable(fs, func(a, b int) bool {
+			return fs[a].Shard != nil && fs[b].Shard != nil && fs[a].Shard.StartHeight < fs[b].Shard.StartHeight
+		})
+	}
+	return tables
+}
+
+// buildPeriodDatabase builds a SQLite database holding every table shipped as csv for a period, ships it and records
+// it in the period's manifest. Periods whose database was built from their current files are left alone.
+func buildPeriodDatabase(ctx context.Context, network string, p ExportPeriod, sh Shipper) error {
+	path := periodManifestPath(network, p)
+	data, err := sh.Read(ctx, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // nothing has been shipped for the period
+		}
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	var pm PeriodManifest
+	if err := json.Unmarshal(data, &pm); err != nil {
+		return fmt.Errorf("decode manifest: %w", err)
+	}
+	if !periodNeedsDatabase(&pm) {
+		return nil
+	}
+	sources := databaseSourceFiles(&pm)
+	if len(sources) == 0 {
+		return nil
+	}
+
+	stagingPath := shippingConfig.stagingPath
+	if stagingPath == "" {
+		if root, ok := localShipPath(sh); ok {
+			stagingPath = root
+		} else {
+			stagingPath = os.TempDir()
+		}
+	}
+	pd := &PeriodDatabase{
+		Path:   filepath.ToSlash(periodDatabasePath(network, p)),
+		Source: pm.MerkleRoot,
+	}
+	outFile := filepath.Join(stagingPath, pd.Path+".building")
+	if err := os.MkdirAll(filepath.Dir(outFile), DefaultDirPerms); err != nil {
+		return fmt.Errorf("create staging directory: %w", err)
+	}
+
+	ll := logger.With("date", p.Date.String(), "database", pd.Path)
+	ll.Infow("building period database", "tables", len(sources))
+	if err := writePeriodDatabase(ctx, outFile, sources, sh, pd); err != nil {
+		os.Remove(outFile)
+		return err
+	}
+	if pd.SHA256, pd.Size, err = sha256File(outFile); err != nil {
+		os.Remove(outFile)
+		return fmt.Errorf("checksum database: %w", err)
+	}
+	if err := retryUpload(ctx, outFile, func(ctx context.Context) error { return sh.Put(ctx, pd.Path, outFile) }); err != nil {
+		discardStagedFile(outFile)
+		return fmt.Errorf("ship to %s: %w", sh, err)
+	}
+	if err := writeChecksumFile(ctx, sh, pd.Path, pd.SHA256, filepath.Base(pd.Path)); err != nil {
+		return err
+	}
+	pd.Built = time.Now().UTC()
+	ll.Infow("shipped period database", "rows", pd.Rows, "size", pd.Size)
+
+	return updatePeriodManifest(ctx, path, sh, func(pm *PeriodManifest) error {
+		pm.Database = pd
+		return nil
+	})
+}
+
+// writePeriodDatabase writes the rows of the source files of each table to a new database at path, recording the tables
+// and the number of rows written in pd.
+func writePeriodDatabase(ctx context.Context, path string, sources map[string][]*PeriodManifestFile, sh Shipper, pd *PeriodDatabase) error {
+	sw, err := createSQLiteWriter(path)
+	if err != nil {
+		return err
+	}
+	defer sw.Abort()
+
+	var tables []string
+	for table := range sources {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		cols, err := parquetColumnsForModel(TablesByName[table].Model)
+		if err != nil {
+			return fmt.Errorf("schema of %s: %w", table, err)
+		}
+		st, err := sw.CreateTable(table, cols)
+		if err != nil {
+			return fmt.Errorf("create table %s: %w", table, err)
+		}
+		for _, f := range sources[table] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			r, err := openManifestFile(ctx, sh, f)
+			if err != nil {
+				return fmt.Errorf("open %s: %w", f.Path, err)
+			}
+			err = st.InsertCSV(r)
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("read %s: %w", f.Path, err)
+			}
+		}
+		if err := st.Close(); err != nil {
+			return fmt.Errorf("write table %s: %w", table, err)
+		}
+		pd.Tables = append(pd.Tables, table)
+		pd.Rows += st.rows
+	}
+	return sw.Close()
+}
+
+// openManifestFile opens a shipped file listed in a period manifest for reading, decompressing it as it is read.
+// Files in a filesystem ship path are streamed and files in an object store are read into memory.
+func openManifestFile(ctx context.Context, sh Shipper, f *PeriodManifestFile) (io.ReadCloser, error) {
+	c, ok := CompressionByName[f.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", f.Compression)
+	}
+	if root, ok := localShipPath(sh); ok {
+		return openShippedFile(filepath.Join(root, filepath.FromSlash(f.Path)), c, nil)
+	}
+	data, err := sh.Read(ctx, f.Path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := c.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.Names[0], err)
+	}
+	return &decompressingReader{Reader: skipCSVProvenance(zr), closers: []io.Closer{zr}}, nil
+}
+
+// sqliteWriter writes a SQLite database file.
+type sqliteWriter struct {
+	db     *sql.DB
+	table  *sqliteTable // table being written
+	closed bool
+}
+
+// createSQLiteWriter creates a database at path, replacing any file there. The database is written without a journal
+// since a file left incomplete is built again.
+func createSQLiteWriter(path string) (*sqliteWriter, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove database: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=OFF&_sync=OFF")
+	if err != nil {
+		return nil, fmt.Errorf("create database: %w", err)
+	}
+	// A single connection writes the tables in turn
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create database: %w", err)
+	}
+	return &sqliteWriter{db: db}, nil
+}
+
+// CreateTable starts a table with the columns, whose rows must all be inserted before another table is created.
+func (sw *sqliteWriter) CreateTable(name string, cols []parquetColumn) (*sqliteTable, error) {
+	var defs, params []string
+	for _, col := range cols {
+		defs = append(defs, sqliteQuote(col.Name)+" "+sqliteColumnType(col))
+		params = append(params, "?")
+	}
+	tx, err := sw.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", sqliteQuote(name), strings.Join(defs, ", "))); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", sqliteQuote(name), strings.Join(params, ", ")))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	sw.table = &sqliteTable{tx: tx, stmt: stmt, cols: cols}
+	return sw.table, nil
+}
+
+// Close closes the database.
+func (sw *sqliteWriter) Close() error {
+	sw.closed = true
+	if err := sw.db.Close(); err != nil {
+		return fmt.Errorf("close database: %w", err)
+	}
+	return nil
+}
+
+// Abort closes the database without completing it if it has not been closed.
+func (sw *sqliteWriter) Abort() {
+	if !sw.closed {
+		sw.closed = true
+		if sw.table != nil {
+			sw.table.tx.Rollback() // releases the connection if the table was not finished
+		}
+		sw.db.Close()
+	}
+}
+
+// sqliteTable writes the rows of a table, in a single transaction that is committed when it is closed.
+type sqliteTable struct {
+	tx   *sql.Tx
+	stmt *sql.Stmt
+	cols []parquetColumn
+	rows int64
+}
+
+// Insert appends a row to the table.
+func (st *sqliteTable) Insert(values []interface{}) error {
+	if _, err := st.stmt.Exec(values...); err != nil {
+		return err
+	}
+	st.rows++
+	return nil
+}
+
+// InsertCSV appends the rows of lily csv output read from r, converting each value to the type of its column. Values
+// that cannot be converted are kept as text.
+func (st *sqliteTable) InsertCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(st.cols)
+	cr.ReuseRecord = true
+	values := make([]interface{}, len(st.cols))
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read csv: %w", err)
+		}
+		for i, s := range row {
+			values[i] = sqliteValue(st.cols[i], s)
+		}
+		if err := st.Insert(values); err != nil {
+			return err
+		}
+	}
+}
+
+// Close commits the rows of the table.
+func (st *sqliteTable) Close() error {
+	if err := st.stmt.Close(); err != nil {
+		st.tx.Rollback()
+		return err
+	}
+	return st.tx.Commit()
+}
+
+// sqliteColumnType returns the declared type of a column, which gives it the affinity of its values.
+func sqliteColumnType(col parquetColumn) string {
+	switch {
+	case col.Type == parquetBoolean, col.Type == parquetInt64 && col.ConvertedType != parquetTimestampMicros:
+		return "INTEGER"
+	case col.Type == parquetDouble:
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqliteValue converts a csv value written by lily to the type of its column.
+func sqliteValue(col parquetColumn, s string) interface{} {
+	if col.Nullable && s == parquetNullCSVValue {
+		return nil
+	}
+	switch sqliteColumnType(col) {
+	case "INTEGER":
+		if col.Type == parquetBoolean {
+			if v, err := strconv.ParseBool(s); err == nil {
+				if v {
+					return int64(1)
+				}
+				return int64(0)
+			}
+		} else if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v
+		}
+	case "REAL":
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+// sqliteQuote quotes an identifier.
+func sqliteQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readSQLiteTable returns the rows of a table of a database, after checking the integrity of the database.
+func readSQLiteTable(t *testing.T, path string, table string) [][]interface{} {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var check string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&check); err != nil || check != "ok" {
+		t.Fatalf("got integrity check %q (%v), wanted ok", check, err)
+	}
+
+	rows, err := db.Query("SELECT * FROM " + sqliteQuote(table) + " ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]interface{}
+	for rows.Next() {
+		row := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSQLiteWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sqlite")
+	sw, err := createSQLiteWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols := []parquetColumn{
+		{Name: "height", Type: parquetInt64, ConvertedType: parquetNoConvertedType},
+		{Name: "value", Type: parquetByteArray, ConvertedType: parquetUTF8, Nullable: true},
+		{Name: "ratio", Type: parquetDouble, ConvertedType: parquetNoConvertedType},
+	}
+
+	// Rows large enough to overflow their page, and enough tables that the schema does not fit on the first page
+	var want [][]interface{}
+	for i := 0; i < 40000; i++ {
+		row := []interface{}{int64(i*1000003 - 5), strings.Repeat("x", i%50), float64(i) / 4}
+		switch i % 1000 {
+		case 0:
+			row[1] = nil
+		case 1:
+			row[1] = strings.Repeat("y", 10000+i)
+		}
+		want = append(want, row)
+	}
+	tables := []string{"big"}
+	for i := 0; i < 60; i++ {
+		tables = append(tables, "table_"+strings.Repeat("t", i))
+	}
+	for i, table := range tables {
+		st, err := sw.CreateTable(table, cols)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			for _, row := range want {
+				if err := st.Insert(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := st.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	schema := readSQLiteTable(t, path, "sqlite_master")
+	if len(schema) != len(tables) {
+		t.Fatalf("got %d tables in the schema, wanted %d", len(schema), len(tables))
+	}
+	if wantSQL := `CREATE TABLE "big" ("height" INTEGER, "value" TEXT, "ratio" REAL)`; schema[0][4] != wantSQL {
+		t.Errorf("got schema %q, wanted %q", schema[0][4], wantSQL)
+	}
+	if got := readSQLiteTable(t, path, "big"); !reflect.DeepEqual(got, want) {
+		t.Errorf("rows read back differ from those written")
+	}
+	if got := readSQLiteTable(t, path, tables[1]); len(got) != 0 {
+		t.Errorf("got %d rows in an empty table", len(got))
+	}
+
+	// An existing file is replaced rather than added to
+	sw, err = createSQLiteWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.CreateTable("big", cols); err != nil {
+		t.Fatal(err)
+	}
+	sw.Abort()
+}
+
+func TestSQLiteValue(t *testing.T) {
+	testCases := []struct {
+		col   parquetColumn
+		value string
+		want  interface{}
+	}{
+		{col: parquetColumn{Type: parquetInt64, ConvertedType: parquetNoConvertedType}, value: "-1024", want: int64(-1024)},
+		{col: parquetColumn{Type: parquetInt64, ConvertedType: parquetUint64}, value: "18446744073709551615", want: "18446744073709551615"},
+		{col: parquetColumn{Type: parquetBoolean, ConvertedType: parquetNoConvertedType}, value: "true", want: int64(1)},
+		{col: parquetColumn{Type: parquetDouble, ConvertedType: parquetNoConvertedType}, value: "0.25", want: 0.25},
+		{col: parquetColumn{Type: parquetInt64, ConvertedType: parquetTimestampMicros}, value: "2021-08-02T00:00:30Z", want: "2021-08-02T00:00:30Z"},
+		{col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetUTF8, Nullable: true}, value: "NULL", want: nil},
+		{col: parquetColumn{Type: parquetByteArray, ConvertedType: parquetUTF8}, value: "NULL", want: "NULL"},
+	}
+	for _, tc := range testCases {
+		if got := sqliteValue(tc.col, tc.value); got != tc.want {
+			t.Errorf("got %#v for %q, wanted %#v", got, tc.value, tc.want)
+		}
+	}
+}
+
+func TestBuildPeriodDatabase(t *testing.T) {
+	ctx := context.Background()
+	sh := &fileShipper{root: t.TempDir()}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	em := &ExportManifest{Period: p, Network: "mainnet"}
+	ef := &ExportFile{Date: p.Date, Network: "mainnet", TableName: "chain_economics", Schema: 1, Format: "csv", Compression: CompressionByName["gz"]}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for h := int64(0); h < 20; h++ {
+		fmt.Fprintf(zw, "%d,bafy2bzacedrgw2kwjzqkutfjsv3eme6wxeg7wtqnvwcoj3eu3hgsnyvpqt,195840886284345218000000,0,3329685737164709000000,58734112548124000000,0,0\n", p.StartHeight+h*144)
+	}
+	zw.Close()
+	if err := sh.Write(ctx, ef.Path(), buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	ef.SHA256 = "aaaa"
+	if err := writePeriodManifest(ctx, em, []*ExportFile{ef}, sh); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := buildPeriodDatabase(ctx, "mainnet", p, sh); err != nil {
+		t.Fatal(err)
+	}
+	data, err := sh.Read(ctx, periodManifestPath("mainnet", p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		t.Fatal(err)
+	}
+	pd := pm.Database
+	if pd == nil || pd.Rows != 20 || !reflect.DeepEqual(pd.Tables, []string{"chain_economics"}) || pd.Source != pm.MerkleRoot || periodNeedsDatabase(pm) {
+		t.Fatalf("got database %+v, wanted 20 rows of chain_economics", pd)
+	}
+
+	rows := readSQLiteTable(t, filepath.Join(sh.root, filepath.FromSlash(pd.Path)), "chain_economics")
+	if len(rows) != 20 || rows[0][0] != int64(1005360) {
+		t.Errorf("got %d rows starting %v, wanted 20 starting at height 1005360", len(rows), rows[0])
+	}
+}
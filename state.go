@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// StateStore persists archiver state that cannot be derived from the files in the ship path. State is held as a
+// set of named collections, each stored as a JSON document in the state directory. Collections are locked while being
+// updated so the store may be shared between a running archiver and command line tools.
+type StateStore struct {
+	path string
+}
+
+// stateStore is the state store in use by the process, nil if none has been configured.
+var stateStore *StateStore
+
+func openStateStore(path string) (*StateStore, error) {
+	if err := os.MkdirAll(path, DefaultDirPerms); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat state path: %w", err)
+	}
+	if !info.Mode().IsDir() {
+		return nil, fmt.Errorf("state path is not a directory")
+	}
+
+	return &StateStore{path: path}, nil
+}
+
+func (s *StateStore) collectionPath(name string) string {
+	return filepath.Join(s.path, name+".json")
+}
+
+// load reads the named collection into v. A collection that has never been written leaves v untouched.
+func (s *StateStore) load(name string, v interface{}) error {
+	data, err := os.ReadFile(s.collectionPath(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decode %s: %w", name, err)
+	}
+	return nil
+}
+
+// update loads the named collection into v, calls fn to modify it and then writes v back. The collection is locked
+// for the duration of the update. No changes are written if fn returns an error.
+func (s *StateStore) update(name string, v interface{}, fn func() error) error {
+	lockPath := filepath.Join(s.path, name+".lock")
+	lf, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, DefaultFilePerms)
+	if err != nil {
+		return fmt.Errorf("open lock: %w", err)
+	}
+	defer lf.Close()
+
+	if err := syscall.Flock(int(lf.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("lock %s: %w", name, err)
+	}
+	defer syscall.Flock(int(lf.Fd()), syscall.LOCK_UN)
+
+	if err := s.load(name, v); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", name, err)
+	}
+
+	return writeFileAtomic(s.collectionPath(name), data)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStateStoreUpdate(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A collection that has never been written loads as empty
+	counts := map[string]int{"untouched": 1}
+	if err := s.load("counts", &counts); err != nil {
+		t.Fatalf("load missing collection: %v", err)
+	}
+	if counts["untouched"] != 1 {
+		t.Errorf("loading a missing collection changed the value: %v", counts)
+	}
+
+	// Updates from separate stores sharing a path are serialized by the collection lock
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, err := openStateStore(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < increments; j++ {
+				var c map[string]int
+				if err := ws.update("counts", &c, func() error {
+					if c == nil {
+						c = map[string]int{}
+					}
+					c["n"]++
+					return nil
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent update: %v", err)
+	}
+
+	var c map[string]int
+	if err := s.load("counts", &c); err != nil {
+		t.Fatal(err)
+	}
+	if c["n"] != workers*increments {
+		t.Errorf("got count %d after concurrent updates, wanted %d", c["n"], workers*increments)
+	}
+}
+
+func TestStateStoreCorruptCollection(t *testing.T) {
+	s, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := []byte(`[{"id": 1, "network": "mainnet"`)
+	if err := os.WriteFile(s.collectionPath(annotationsCollection), corrupt, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Annotations(); err == nil {
+		t.Errorf("expected an error reading a corrupt collection")
+	}
+
+	// An update must fail rather than replace the corrupt collection with only the new entry
+	from, _ := DateFromString("2021-08-01")
+	if err := s.AddAnnotation(&Annotation{Network: "mainnet", From: from, To: from, Reason: "bad"}); err == nil {
+		t.Errorf("expected an error updating a corrupt collection")
+	}
+	data, err := os.ReadFile(s.collectionPath(annotationsCollection))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(corrupt) {
+		t.Errorf("corrupt collection was overwritten with %q", data)
+	}
+}
+
+func TestOpenStateStoreNotDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(path, nil, DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openStateStore(path); err == nil {
+		t.Errorf("expected an error opening a state store on a file")
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	s, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := func(s string) Date {
+		d, err := DateFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	as, err := s.Annotations()
+	if err != nil || len(as) != 0 {
+		t.Fatalf("got annotations %v (%v) from an empty store", as, err)
+	}
+
+	for _, invalid := range []*Annotation{
+		{Network: "mainnet", From: date("2021-08-01"), Reason: "no end"},
+		{Network: "mainnet", From: date("2021-08-02"), To: date("2021-08-01"), Reason: "reversed"},
+		{Network: "mainnet", From: date("2021-08-01"), To: date("2021-08-01")},
+	} {
+		if err := s.AddAnnotation(invalid); err == nil {
+			t.Errorf("expected an error adding %+v", invalid)
+		}
+	}
+
+	all := &Annotation{Network: "mainnet", From: date("2021-08-01"), To: date("2021-08-03"), Reason: "lily bug"}
+	messages := &Annotation{Network: "mainnet", Tables: []string{"messages"}, From: date("2021-09-01"), To: date("2021-09-01"), Reason: "bad messages"}
+	for _, a := range []*Annotation{all, messages} {
+		if err := s.AddAnnotation(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if all.ID != 1 || messages.ID != 2 {
+		t.Errorf("got ids %d and %d, wanted 1 and 2", all.ID, messages.ID)
+	}
+
+	as, err = s.Annotations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		network string
+		table   string
+		date    string
+		want    int
+	}{
+		{network: "mainnet", table: "receipts", date: "2021-08-01", want: 1},
+		{network: "mainnet", table: "receipts", date: "2021-08-03", want: 1},
+		{network: "mainnet", table: "receipts", date: "2021-08-04", want: 0},
+		{network: "calibnet", table: "receipts", date: "2021-08-02", want: 0},
+		{network: "mainnet", table: "messages", date: "2021-09-01", want: 2},
+		{network: "mainnet", table: "receipts", date: "2021-09-01", want: 0},
+	}
+	for _, tc := range testCases {
+		got := 0
+		if a := as.Find(tc.network, tc.table, date(tc.date)); a != nil {
+			got = a.ID
+		}
+		if got != tc.want {
+			t.Errorf("%s %s %s: got annotation %d, wanted %d", tc.network, tc.table, tc.date, got, tc.want)
+		}
+	}
+
+	if err := s.RemoveAnnotation(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveAnnotation(1); err == nil {
+		t.Errorf("expected an error removing a missing annotation")
+	}
+
+	// New annotations are numbered after the highest remaining id
+	again := &Annotation{Network: "mainnet", From: date("2021-10-01"), To: date("2021-10-01"), Reason: "again"}
+	if err := s.AddAnnotation(again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != 3 {
+		t.Errorf("got id %d, wanted 3", again.ID)
+	}
+}
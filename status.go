@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// StatusReport is returned by the status API.
+type StatusReport struct {
+	Build   BuildInfo         `json:"build"`
+	Command string            `json:"command"`
+	Started time.Time         `json:"started"`
+	Uptime  string            `json:"uptime"`
+	Config  map[string]string `json:"config"`           // effective configuration with secrets redacted
+	Walks   []WalkProgress    `json:"walks,omitempty"`  // progress of the walks currently running
+	Jobs    []*ExportJob      `json:"jobs,omitempty"`   // export jobs that are waiting, running, retrying or dead-lettered
+	Lag     *LagStatus        `json:"lag,omitempty"`    // lag of the export loop, if it is running
+	Errors  []RecentError     `json:"errors,omitempty"` // most recent failed attempts to export a period, newest first
+}
+
+func writeHealthReport(w http.ResponseWriter, hr *HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !hr.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(hr); err != nil {
+		logger.Errorw("failed to write health report", "error", err)
+	}
+}
+
+// statusHandler serves the status report of a process running the command since started with the given configuration.
+func statusHandler(command string, started time.Time, cfg map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := StatusReport{
+			Build:   currentBuildInfo(),
+			Command: command,
+			Started: started,
+			Uptime:  time.Since(started).Truncate(time.Second).String(),
+			Config:  cfg,
+			Walks:   currentWalkProgress(),
+			Lag:     exportLag.Status(),
+			Errors:  recentErrors.List(),
+		}
+		if js, err := exportJobs(); err != nil {
+			logger.Errorw("failed to read export jobs", "error", err)
+		} else {
+			report.Jobs = js.Sorted()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logger.Errorw("failed to write status report", "error", err)
+		}
+	}
+}
+
+func startStatusServer(cc *cli.Context) error {
+	started := time.Now().UTC()
+	cfg := effectiveConfig(cc)
+	command := ""
+	if cc.Command != nil {
+		command = cc.Command.Name
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler(command, started, cfg))
+
+	// The dashboard shows the status report alongside the coverage of the most recent periods
+	mux.HandleFunc("/", handleDashboard)
+	mux.HandleFunc("/coverage", handleCoverage)
+
+	// The health probe fails while the export loop is wedged, so that an orchestrator can restart the archiver, and the
+	// readiness probe while it cannot reach lily or write its files
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, newHealthReport(livenessChecks()))
+	})
+	paths := writablePaths(cc)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, newHealthReport(readinessChecks(r.Context(), paths)))
+	})
+
+	go func() {
+		if err := http.ListenAndServe(diagnosticsConfig.statusAddr, mux); err != nil {
+			logger.Errorw("status server failed", "error", err)
+		}
+	}()
+	return nil
+}
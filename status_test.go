@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatusHandler(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+	defer func(h *errorHistory) { recentErrors = h }(recentErrors)
+
+	var err error
+	if stateStore, err = openStateStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}}
+	if err := stateStore.SetExportJob(exportJobForPeriod("mainnet", p, 0)); err != nil {
+		t.Fatal(err)
+	}
+	recentErrors = &errorHistory{max: DefaultRecentErrors}
+	recentErrors.Record(p, errors.New("walk failed"))
+
+	started := time.Now().UTC().Add(-90 * time.Second)
+	cfg := map[string]string{"lily-token": redacted, "ship-path": "/data/ship"}
+	rec := httptest.NewRecorder()
+	statusHandler("run", started, cfg)(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q", ct)
+	}
+	var report StatusReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Command != "run" || !report.Started.Equal(started) || report.Uptime != "1m30s" {
+		t.Errorf("got command %q started %s uptime %s", report.Command, report.Started, report.Uptime)
+	}
+	if report.Build != currentBuildInfo() {
+		t.Errorf("got build %+v, wanted %+v", report.Build, currentBuildInfo())
+	}
+	if report.Config["lily-token"] != redacted || report.Config["ship-path"] != "/data/ship" {
+		t.Errorf("got config %v", report.Config)
+	}
+	if len(report.Jobs) != 1 || report.Jobs[0].Date != p.Date {
+		t.Errorf("got jobs %+v, wanted the queued job", report.Jobs)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Period != "2021-08-02" {
+		t.Errorf("got errors %+v, wanted the recorded error", report.Errors)
+	}
+}
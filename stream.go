@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTailInterval is how long a stream waits before checking a walk output file for newly written data
+const DefaultTailInterval = time.Second * 5
+
+// tailReader reads a file that is still being appended to. Reaching the end of the file waits for more data to be
+// written until done is closed, after which the remainder of the file is read and io.EOF returned. A file that does
+// not exist yet is waited for in the same way.
+type tailReader struct {
+	ctx      context.Context
+	path     string
+	done     <-chan struct{}
+	interval time.Duration
+
+	f        *os.File
+	finished bool
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		if t.f == nil {
+			f, err := os.Open(t.path)
+			if err == nil {
+				t.f = f
+				continue
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return 0, err
+			}
+		} else {
+			n, err := t.f.Read(p)
+			if n > 0 {
+				return n, nil
+			}
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+
+		if t.finished {
+			return 0, io.EOF
+		}
+
+		// Once done is closed the file is read one final time to pick up anything written since the last read
+		select {
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		case <-t.done:
+			t.finished = true
+		case <-time.After(t.interval):
+		}
+	}
+}
+
+func (t *tailReader) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+// streamedFile is an export file that was compressed while its walk was running and is staged ready to be shipped.
+type streamedFile struct {
+	walk             string
+	staged           string
+	rows             int64
+	uncompressedSize int64
+	size             int64
+	sha256           string
+	provenance       bool
+	seek             *SeekIndex
+}
+
+// streamedFiles holds the files compressed by walk streams, keyed by path relative to the ship path, until they are
+// shipped or discarded.
+var streamedFiles = struct {
+	sync.Mutex
+	files map[string]*streamedFile
+}{files: map[string]*streamedFile{}}
+
+// takeStreamedFile returns the staged file compressed for ef while the walk was running, removing it from the set of
+// streamed files, or nil if the file was not streamed.
+func takeStreamedFile(ef *ExportFile, wi WalkInfo) *streamedFile {
+	streamedFiles.Lock()
+	defer streamedFiles.Unlock()
+	sf := streamedFiles.files[ef.Path()]
+	if sf == nil || sf.walk != wi.Name {
+		return nil
+	}
+	delete(streamedFiles.files, ef.Path())
+	return sf
+}
+
+// discardStreamedFiles removes every staged file compressed during the walk that was not shipped, such as files that
+// failed verification.
+func discardStreamedFiles(wi WalkInfo) {
+	streamedFiles.Lock()
+	defer streamedFiles.Unlock()
+	for path, sf := range streamedFiles.files {
+		if sf.walk != wi.Name {
+			continue
+		}
+		os.Remove(sf.staged)
+		delete(streamedFiles.files, path)
+	}
+}
+
+// WalkStreams compresses the output of a running walk as lily writes it, so that the walk output does not need to be
+// read a second time once the walk completes.
+type WalkStreams struct {
+	wi          WalkInfo
+	stagingPath string
+	cancel      context.CancelFunc
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	mu      sync.Mutex
+	results []*streamedFile
+	paths   []string
+}
+
+// startWalkStreams starts compressing the walk output of every unshipped file in the manifest. It returns nil when
+// streaming compression is not enabled. Sharded tables are split once the walk has completed and are not streamed.
+func startWalkStreams(ctx context.Context, em *ExportManifest, wi WalkInfo) *WalkStreams {
+	if !shippingConfig.streamCompression {
+		return nil
+	}
+
+	stagingPath := shippingConfig.stagingPath
+	if stagingPath == "" {
+		stagingPath = wi.Path
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &WalkStreams{
+		wi:          wi,
+		stagingPath: stagingPath,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	for _, ef := range em.Files {
+		if !ef.NeedsShipping() || isShardedTable(ef.TableName) {
+			continue
+		}
+		s.wg.Add(1)
+		go func(ef *ExportFile) {
+			defer s.wg.Done()
+			sf, err := s.stream(ctx, ef)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Errorw("failed to stream export file, it will be compressed once the walk completes", "error", err, "table", ef.TableName, "walk", wi.Name)
+				}
+				return
+			}
+			s.mu.Lock()
+			s.results = append(s.results, sf)
+			s.paths = append(s.paths, ef.Path())
+			s.mu.Unlock()
+		}(ef)
+	}
+	return s
+}
+
+// stream compresses the walk output for a single export file to a temporary file in the staging path.
+func (s *WalkStreams) stream(ctx context.Context, ef *ExportFile) (*streamedFile, error) {
+	tr := &tailReader{
+		ctx:      ctx,
+		path:     s.wi.WalkFile(ef.TableName),
+		done:     s.done,
+		interval: DefaultTailInterval,
+	}
+	defer tr.Close()
+
+	if err := os.MkdirAll(s.stagingPath, DefaultDirPerms); err != nil {
+		return nil, fmt.Errorf("mkdir %q: %w", s.stagingPath, err)
+	}
+	tmp, err := os.CreateTemp(s.stagingPath, "."+ef.Filename()+".*.stream")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+
+	// The manifest's file is only updated from the result once the walk has passed verification
+	sef := *ef
+	seekIndex, err := compressExportReader(ctx, &sef, tr, tmp)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), DefaultFilePerms); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("chmod temp file: %w", err)
+	}
+
+	return &streamedFile{
+		walk:             s.wi.Name,
+		staged:           tmp.Name(),
+		rows:             sef.Rows,
+		uncompressedSize: sef.UncompressedSize,
+		size:             sef.Size,
+		sha256:           sef.SHA256,
+		provenance:       sef.Provenance,
+		seek:             seekIndex,
+	}, nil
+}
+
+// Finish is called once the walk has completed. It waits for every stream to compress the remainder of its walk
+// output and makes the compressed files available for shipping.
+func (s *WalkStreams) Finish() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streamedFiles.Lock()
+	defer streamedFiles.Unlock()
+	for i, sf := range s.results {
+		if old := streamedFiles.files[s.paths[i]]; old != nil {
+			os.Remove(old.staged)
+		}
+		streamedFiles.files[s.paths[i]] = sf
+	}
+}
+
+// Abort is called when the walk fails. It stops every stream and removes any files they compressed.
+func (s *WalkStreams) Abort() {
+	if s == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sf := range s.results {
+		os.Remove(sf.staged)
+	}
+	s.results = nil
+	s.paths = nil
+}
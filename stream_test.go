@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTailReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "walk-messages.csv")
+	done := make(chan struct{})
+	tr := &tailReader{
+		ctx:      context.Background(),
+		path:     path,
+		done:     done,
+		interval: time.Millisecond * 10,
+	}
+	defer tr.Close()
+
+	read := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		data, err := io.ReadAll(tr)
+		errs <- err
+		read <- data
+	}()
+
+	// The file is created and appended to after reading has started
+	time.Sleep(time.Millisecond * 30)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := f.WriteString("101,a\n"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond * 30)
+	if _, err := f.WriteString("102,b\n"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	close(done)
+
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := string(<-read), "101,a\n102,b\n"; got != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestTailReaderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := &tailReader{
+		ctx:      ctx,
+		path:     filepath.Join(t.TempDir(), "missing.csv"),
+		done:     make(chan struct{}),
+		interval: time.Millisecond * 10,
+	}
+	cancel()
+	if _, err := io.ReadAll(tr); err != context.Canceled {
+		t.Errorf("got error %v, wanted %v", err, context.Canceled)
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/filecoin-project/go-state-types/network"
@@ -35,13 +39,57 @@ type Table struct {
 	// NetworkVersionRange is the range filecoin network versions for which the table is supported.
 	NetworkVersionRange NetworkVersionRange
 
-	// An empty instance of the lily model
+	// An empty instance of the lily model, or the *TableDescriptor of a table described by a table registry that the
+	// archiver has no model for
 	Model interface{}
+
+	// Family is the name of the logical table that the table is a variant of, when lily has renamed or evolved its
+	// model between network versions. The variants of a family have network version ranges that do not overlap so
+	// that each period is exported to the variant active at its heights. Empty for tables that have a single variant.
+	Family string
+
+	// Experimental marks a table that is not yet part of the main dataset. Experimental tables are only exported when
+	// enabled, are shipped beneath the experimental prefix and are excluded from gap reports and indexes.
+	Experimental bool
+}
+
+// ExperimentalPrefix is the directory beneath the ship path that experimental tables are shipped to.
+const ExperimentalPrefix = "experimental"
+
+// ShipDir returns the directory, relative to the ship path, that files for the table are written to.
+func (t Table) ShipDir(network string, format string, schema int) string {
+	dir := filepath.Join(network, format, strconv.Itoa(schema), t.Name)
+	if t.Experimental {
+		return filepath.Join(ExperimentalPrefix, dir)
+	}
+	return dir
+}
+
+// FamilyName returns the name of the logical table the table is a variant of, or its own name if it has no variants.
+func (t Table) FamilyName() string {
+	if t.Family != "" {
+		return t.Family
+	}
+	return t.Name
+}
+
+// familyOf returns the name of the logical table the named table is a variant of, or the name itself if the table has
+// no variants.
+func familyOf(name string) string {
+	if t, ok := TablesByName[name]; ok {
+		return t.FamilyName()
+	}
+	return name
+}
+
+// supportedAtVersion reports whether the table is written by lily at the network version.
+func (t Table) supportedAtVersion(v network.Version) bool {
+	return v >= t.NetworkVersionRange.From && v <= t.NetworkVersionRange.To
 }
 
 type NetworkVersionRange struct {
-	From network.Version
-	To   network.Version
+	From network.Version `json:"from"`
+	To   network.Version `json:"to"`
 }
 
 var AllNetWorkVersions = NetworkVersionRange{From: network.Version0, To: network.VersionMax}
@@ -89,12 +137,22 @@ var TableList = []Table{
 		Model:               &chain.ChainConsensus{},
 		NetworkVersionRange: AllNetWorkVersions,
 	},
+	// replaced by chain_economics_v2 in network v20
 	{
 		Name:                "chain_economics",
 		Schema:              1,
 		Task:                tasktype.ChainEconomics,
 		Model:               &chain.ChainEconomics{},
-		NetworkVersionRange: AllNetWorkVersions,
+		NetworkVersionRange: NetworkVersionRange{From: network.Version0, To: NetworkVersionChainEconomicsV2 - 1},
+		Family:              "chain_economics",
+	},
+	{
+		Name:                "chain_economics_v2",
+		Schema:              1,
+		Task:                TaskChainEconomicsV2,
+		Model:               &ChainEconomicsV2{},
+		NetworkVersionRange: NetworkVersionRange{From: NetworkVersionChainEconomicsV2, To: network.VersionMax},
+		Family:              "chain_economics",
 	},
 	{
 		Name:                "chain_powers",
@@ -110,6 +168,14 @@ var TableList = []Table{
 		Model:               &reward.ChainReward{},
 		NetworkVersionRange: AllNetWorkVersions,
 	},
+	// added for actors v9 in network v17
+	{
+		Name:                "data_cap_balances",
+		Schema:              1,
+		Task:                TaskDataCapBalance,
+		Model:               &DataCapBalance{},
+		NetworkVersionRange: NetworkVersionRange{From: NetworkVersionDataCap, To: network.VersionMax},
+	},
 	{
 		Name:                "derived_gas_outputs",
 		Schema:              1,
@@ -124,6 +190,16 @@ var TableList = []Table{
 		Model:               &blocks.DrandBlockEntrie{},
 		NetworkVersionRange: AllNetWorkVersions,
 	},
+	// added for actors v10 in network v18, experimental while lily's fevm models settle. Lily's other fevm tables are
+	// not archived until the archiver is built against a lily release that provides their models.
+	{
+		Name:                "fevm_actor_stats",
+		Schema:              1,
+		Task:                TaskFEVMActorStats,
+		Model:               &FEVMActorStats{},
+		NetworkVersionRange: NetworkVersionRange{From: NetworkVersionFEVM, To: network.VersionMax},
+		Experimental:        true,
+	},
 	{
 		Name:                "id_addresses",
 		Schema:              1,
@@ -230,6 +306,7 @@ var TableList = []Table{
 		Task:                tasktype.MinerSectorInfoV7,
 		Model:               &miner.MinerSectorInfoV7{},
 		NetworkVersionRange: NetworkVersionRange{From: network.Version15, To: network.VersionMax},
+		Family:              "miner_sector_infos",
 	},
 
 	// used for actors v6 and below, up to network v14
@@ -239,6 +316,7 @@ var TableList = []Table{
 		Task:                tasktype.MinerSectorInfoV1_6,
 		Model:               &miner.MinerSectorInfoV1_6{},
 		NetworkVersionRange: NetworkVersionRange{From: network.Version0, To: network.Version14},
+		Family:              "miner_sector_infos",
 	},
 	{
 		Name:                "miner_sector_posts",
@@ -289,12 +367,22 @@ var TableList = []Table{
 		Model:               &verifreg.VerifiedRegistryVerifier{},
 		NetworkVersionRange: AllNetWorkVersions,
 	},
+	// added for actors v9 in network v17
+	{
+		Name:                "verified_registry_claims",
+		Schema:              1,
+		Task:                TaskVerifiedRegistryClaim,
+		Model:               &VerifiedRegistryClaim{},
+		NetworkVersionRange: NetworkVersionRange{From: NetworkVersionDataCap, To: network.VersionMax},
+	},
+
+	// datacap moved from the verified registry to the datacap actor in network v17, see data_cap_balances
 	{
 		Name:                "verified_registry_verified_clients",
 		Schema:              1,
 		Task:                tasktype.VerifiedRegistryVerifiedClient,
 		Model:               &verifreg.VerifiedRegistryVerifiedClient{},
-		NetworkVersionRange: AllNetWorkVersions,
+		NetworkVersionRange: NetworkVersionRange{From: network.Version0, To: NetworkVersionDataCap - 1},
 	},
 }
 
@@ -307,14 +395,68 @@ var (
 
 	// TablesBySchema maps a schema version to a list of tables present in that schema.
 	TablesBySchema = map[int][]Table{}
+
+	// StableTables is the list of tables that are not experimental.
+	StableTables = []Table{}
+
+	// TableFamilies maps the name of a logical table to the variants of it written by lily at different network
+	// versions, in network version order.
+	TableFamilies = map[string][]Table{}
 )
 
 func init() {
+	indexTables()
+}
+
+// indexTables rebuilds the lookups of tables from TableList.
+func indexTables() {
+	TablesByName = map[string]Table{}
+	KnownTasks = map[string]struct{}{}
+	TablesBySchema = map[int][]Table{}
+	StableTables = []Table{}
+	TableFamilies = map[string][]Table{}
+
 	for _, table := range TableList {
 		TablesByName[table.Name] = table
 		KnownTasks[table.Task] = struct{}{}
 		TablesBySchema[table.Schema] = append(TablesBySchema[table.Schema], table)
+		if !table.Experimental {
+			StableTables = append(StableTables, table)
+		}
+		if table.Family != "" {
+			TableFamilies[table.Family] = append(TableFamilies[table.Family], table)
+		}
+	}
+	for _, variants := range TableFamilies {
+		sort.Slice(variants, func(a, b int) bool {
+			return variants[a].NetworkVersionRange.From < variants[b].NetworkVersionRange.From
+		})
+	}
+}
+
+// TableVariants returns the tables named by a table or family name. A family name selects every variant of the
+// family, leaving the choice of variant for each period to the network versions active at its heights.
+func TableVariants(name string) ([]Table, bool) {
+	if variants, ok := TableFamilies[name]; ok {
+		return variants, true
+	}
+	t, ok := TablesByName[name]
+	if !ok {
+		return nil, false
+	}
+	return []Table{t}, true
+}
+
+// filterExperimentalTables removes experimental tables from the list unless they have been enabled.
+func filterExperimentalTables(tables []Table, enabled map[string]bool) []Table {
+	out := make([]Table, 0, len(tables))
+	for _, t := range tables {
+		if t.Experimental && !enabled[t.Name] && !enabled["all"] {
+			continue
+		}
+		out = append(out, t)
 	}
+	return out
 }
 
 func TablesByTask(task string, schemaVersion int) []Table {
@@ -328,6 +470,14 @@ func TablesByTask(task string, schemaVersion int) []Table {
 }
 
 func TableHeaders(v interface{}) ([]string, error) {
+	if td, ok := v.(*TableDescriptor); ok {
+		var columns []string
+		for _, c := range td.Columns {
+			columns = append(columns, c.Name)
+		}
+		return columns, nil
+	}
+
 	q := orm.NewQuery(nil, v)
 	tm := q.TableModel()
 	m := tm.Table()
@@ -344,26 +494,117 @@ func TableHeaders(v interface{}) ([]string, error) {
 	return columns, nil
 }
 
-func TableSchema(v interface{}) (string, error) {
+// TableKeyColumns returns the names of the primary key columns of a table model.
+func TableKeyColumns(v interface{}) ([]string, error) {
+	if td, ok := v.(*TableDescriptor); ok {
+		return td.PrimaryKey, nil
+	}
+
 	q := orm.NewQuery(nil, v)
 	tm := q.TableModel()
 	m := tm.Table()
 
 	if len(m.Fields) == 0 {
-		return "", fmt.Errorf("invalid table model: no fields found")
+		return nil, fmt.Errorf("invalid table model: no fields found")
 	}
 
-	name := strings.Trim(string(m.SQLNameForSelects), `"`)
-
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("create table %s (\n", name))
+	var columns []string
+	for _, fld := range m.PKs {
+		columns = append(columns, fld.SQLName)
+	}
+	return columns, nil
+}
 
+func TableSchema(v interface{}) (string, error) {
+	var name string
 	var fieldDefs []string
-	for _, fld := range m.Fields {
-		fieldDefs = append(fieldDefs, fmt.Sprintf("  %s %s", fld.Column, fld.SQLType))
+	if td, ok := v.(*TableDescriptor); ok {
+		name = td.Table
+		for _, c := range td.Columns {
+			fieldDefs = append(fieldDefs, fmt.Sprintf("  \"%s\" %s", c.Name, c.Type))
+		}
+	} else {
+		q := orm.NewQuery(nil, v)
+		m := q.TableModel().Table()
+		if len(m.Fields) == 0 {
+			return "", fmt.Errorf("invalid table model: no fields found")
+		}
+
+		name = strings.Trim(string(m.SQLNameForSelects), `"`)
+		for _, fld := range m.Fields {
+			fieldDefs = append(fieldDefs, fmt.Sprintf("  %s %s", fld.Column, fld.SQLType))
+		}
 	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("create table %s (\n", name))
 	sb.WriteString(strings.Join(fieldDefs, ",\n"))
 	sb.WriteString("\n);\n")
 
 	return sb.String(), nil
 }
+
+// SchemaDescriptorSuffix is appended to a table's name to give the name of the schema descriptor file written to the
+// table's directory.
+const SchemaDescriptorSuffix = ".schema.json"
+
+// TableDescriptor is a machine readable description of the columns of a table, in the order they appear in its csv
+// files.
+type TableDescriptor struct {
+	Table      string              `json:"table"`
+	Task       string              `json:"task"`
+	Schema     int                 `json:"schema"` // storage schema version the description applies to
+	PrimaryKey []string            `json:"primary_key,omitempty"`
+	Columns    []*ColumnDescriptor `json:"columns"`
+}
+
+// ColumnDescriptor describes a single column of a table.
+type ColumnDescriptor struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`    // type of the column in lily's database
+	GoType     string `json:"go_type"` // type of the field in lily's model
+	Nullable   bool   `json:"nullable"`
+	PrimaryKey bool   `json:"primary_key,omitempty"`
+}
+
+// modelFieldIsNullable reports whether lily writes nil values of a model field as NULL.
+func modelFieldIsNullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	}
+	return false
+}
+
+// TableDescriptorFor describes the columns of a table from its lily model, or from the registry that described it.
+func TableDescriptorFor(t Table, schema int) (*TableDescriptor, error) {
+	if td, ok := t.Model.(*TableDescriptor); ok {
+		described := *td
+		described.Table, described.Task, described.Schema = t.Name, t.Task, schema
+		return &described, nil
+	}
+
+	q := orm.NewQuery(nil, t.Model)
+	m := q.TableModel().Table()
+
+	if len(m.Fields) == 0 {
+		return nil, fmt.Errorf("invalid table model: no fields found")
+	}
+
+	isKey := map[string]bool{}
+	td := &TableDescriptor{Table: t.Name, Task: t.Task, Schema: schema}
+	for _, fld := range m.PKs {
+		td.PrimaryKey = append(td.PrimaryKey, fld.SQLName)
+		isKey[fld.SQLName] = true
+	}
+	for _, fld := range m.Fields {
+		td.Columns = append(td.Columns, &ColumnDescriptor{
+			Name:       fld.SQLName,
+			Type:       fld.SQLType,
+			GoType:     fld.Type.String(),
+			Nullable:   modelFieldIsNullable(fld.Type),
+			PrimaryKey: isKey[fld.SQLName],
+		})
+	}
+	return td, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/urfave/cli/v2"
+)
+
+func TestModernActorTables(t *testing.T) {
+	for name, from := range map[string]network.Version{
+		"verified_registry_claims": NetworkVersionDataCap,
+		"data_cap_balances":        NetworkVersionDataCap,
+		"fevm_actor_stats":         NetworkVersionFEVM,
+	} {
+		tbl, ok := TablesByName[name]
+		if !ok {
+			t.Errorf("table %s is missing", name)
+			continue
+		}
+		if tbl.NetworkVersionRange.From != from {
+			t.Errorf("table %s should be written from network version %d, got %+v", name, from, tbl)
+		}
+		if experimental := strings.HasPrefix(name, "fevm_"); tbl.Experimental != experimental {
+			t.Errorf("table %s should have experimental %v, got %+v", name, experimental, tbl)
+		}
+		if tables := TablesByTask(tbl.Task, 1); len(tables) != 1 || tables[0].Name != name {
+			t.Errorf("task %s should write only table %s, got %v", tbl.Task, name, tables)
+		}
+
+		// The table name of the model must match so that schema files and warehouse tables are named correctly
+		schema, err := TableSchema(tbl.Model)
+		if err != nil {
+			t.Errorf("schema of %s: %v", name, err)
+			continue
+		}
+		if want := "create table " + name + " ("; schema[:len(want)] != want {
+			t.Errorf("got schema %q for table %s", schema[:len(want)], name)
+		}
+		headers, err := TableHeaders(tbl.Model)
+		if err != nil || len(headers) == 0 || headers[0] != "height" {
+			t.Errorf("got headers %v for table %s, wanted height first: %v", headers, name, err)
+		}
+	}
+
+	if r := TablesByName["verified_registry_verified_clients"].NetworkVersionRange; r.To >= NetworkVersionDataCap {
+		t.Errorf("verified clients should not be expected once datacap moved to its own actor, got %+v", r)
+	}
+}
+
+// lilyCSVHeaders are the csv headers written by lily for tables whose models are declared by the archiver, keyed by the
+// lily release the model was copied from.
+var lilyCSVHeaders = map[string]map[string]string{
+	"v0.16.0": {
+		"verified_registry_claims": "height,state_root,claim_id,provider,client,data,size,term_min,term_max,term_start,sector,event",
+		"data_cap_balances":        "height,state_root,address,event,data_cap",
+		"fevm_actor_stats":         "height,contract_balance,eth_account_balance,placeholder_balance,contract_count,unique_contract_count,eth_account_count,placeholder_count",
+	},
+}
+
+func TestLilyCSVHeaders(t *testing.T) {
+	for release, headers := range lilyCSVHeaders {
+		for name, want := range headers {
+			tbl, ok := TablesByName[name]
+			if !ok {
+				t.Errorf("table %s is missing", name)
+				continue
+			}
+			got, err := TableHeaders(tbl.Model)
+			if err != nil {
+				t.Errorf("headers of %s: %v", name, err)
+				continue
+			}
+			if strings.Join(got, ",") != want {
+				t.Errorf("got headers %s for table %s, wanted %s as written by lily %s", strings.Join(got, ","), name, want, release)
+			}
+		}
+	}
+}
+
+func TestTableFamilies(t *testing.T) {
+	for family, want := range map[string][]string{
+		"miner_sector_infos": {"miner_sector_infos", "miner_sector_infos_v7"},
+		"chain_economics":    {"chain_economics", "chain_economics_v2"},
+	} {
+		variants, ok := TableVariants(family)
+		if !ok || len(variants) != len(want) {
+			t.Errorf("got variants %v for family %s, wanted %v", variants, family, want)
+			continue
+		}
+		for i, v := range variants {
+			if v.Name != want[i] || v.FamilyName() != family {
+				t.Errorf("got variant %s of family %s at %d, wanted %s", v.Name, v.FamilyName(), i, want[i])
+			}
+			if i > 0 && variants[i-1].NetworkVersionRange.To >= v.NetworkVersionRange.From {
+				t.Errorf("network versions of %s overlap those of %s", v.Name, variants[i-1].Name)
+			}
+		}
+	}
+
+	if variants, ok := TableVariants("miner_sector_infos_v7"); !ok || len(variants) != 1 {
+		t.Errorf("a variant name should select only that variant, got %v", variants)
+	}
+	if got := familyOf("messages"); got != "messages" {
+		t.Errorf("got family %s for a table without variants", got)
+	}
+
+	names, err := parseTableList("messages,chain_economics,chain_economics_v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"messages", "chain_economics", "chain_economics_v2"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("got tables %v, wanted %v", names, want)
+	}
+
+	schema, err := TableSchema(TablesByName["chain_economics_v2"].Model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "create table chain_economics_v2 ("; schema[:len(want)] != want {
+		t.Errorf("got schema %q", schema[:len(want)])
+	}
+}
+
+func TestTableVariantsForPeriod(t *testing.T) {
+	oldSchedule := UpgradeSchedule
+	defer func() {
+		UpgradeSchedule = oldSchedule
+	}()
+	UpgradeSchedule = []NetworkHeight{{Version: network.Version14, Height: 100}, {Version: network.Version15, Height: 200}}
+
+	task := TablesByName["miner_sector_infos_v7"].Task
+	if taskActiveAtHeight(task, 199) || !taskActiveAtHeight(task, 200) {
+		t.Errorf("task %s should only be active from the upgrade to network version 15", task)
+	}
+	if task := TablesByName["miner_sector_infos"].Task; !taskActiveAtHeight(task, 199) || taskActiveAtHeight(task, 200) {
+		t.Errorf("task %s should only be active before the upgrade to network version 15", task)
+	}
+
+	variants, _ := TableVariants("miner_sector_infos")
+	targets := []ShipTarget{{Format: FormatCSV, Compression: CompressionByName["gz"]}}
+	sh := &fileShipper{root: t.TempDir()}
+	for _, tc := range []struct {
+		start, end int64
+		want       []string
+	}{
+		{start: 100, end: 199, want: []string{"miner_sector_infos"}},
+		{start: 150, end: 249, want: []string{"miner_sector_infos", "miner_sector_infos_v7"}},
+		{start: 200, end: 299, want: []string{"miner_sector_infos_v7"}},
+	} {
+		p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: tc.start, EndHeight: tc.end}
+		em, err := manifestForPeriod(context.Background(), p, "mainnet", 0, sh, 1, variants, targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ef := range em.Files {
+			got = append(got, ef.TableName)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("got tables %v for heights %d-%d, wanted %v", got, tc.start, tc.end, tc.want)
+		}
+	}
+}
+
+func TestExperimentalTables(t *testing.T) {
+	var experimental []string
+	for _, table := range TableList {
+		if table.Experimental {
+			experimental = append(experimental, table.Name)
+		}
+	}
+	want := []string{"fevm_actor_stats"}
+	if !reflect.DeepEqual(experimental, want) {
+		t.Errorf("got experimental tables %v, wanted %v", experimental, want)
+	}
+	for _, table := range StableTables {
+		if table.Experimental {
+			t.Errorf("experimental table %s is listed as stable", table.Name)
+		}
+	}
+
+	allowed := func(tasks, enabled string) (map[string]bool, error) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("tasks", tasks, "")
+		fs.String("experimental-tables", enabled, "")
+		tables, err := allowedTablesFromFlags(cli.NewContext(cli.NewApp(), fs, nil))
+		if err != nil {
+			return nil, err
+		}
+		names := map[string]bool{}
+		for _, table := range tables {
+			names[table.Name] = true
+		}
+		return names, nil
+	}
+
+	testCases := []struct {
+		tasks   string
+		enabled string
+		want    map[string]bool // whether each table is exported
+		wantErr bool
+	}{
+		{enabled: "", want: map[string]bool{"messages": true, "fevm_actor_stats": false}},
+		{enabled: "fevm_actor_stats", want: map[string]bool{"messages": true, "fevm_actor_stats": true}},
+		{enabled: "all", want: map[string]bool{"messages": true, "fevm_actor_stats": true}},
+		{tasks: TaskFEVMActorStats, want: map[string]bool{"messages": false, "fevm_actor_stats": false}},
+		{tasks: TaskFEVMActorStats, enabled: "fevm_actor_stats", want: map[string]bool{"messages": false, "fevm_actor_stats": true}},
+		{enabled: "messages", wantErr: true},
+		{enabled: "no_such_table", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := allowed(tc.tasks, tc.enabled)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("tasks %q experimental %q: expected an error", tc.tasks, tc.enabled)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tasks %q experimental %q: %v", tc.tasks, tc.enabled, err)
+		}
+		for table, want := range tc.want {
+			if got[table] != want {
+				t.Errorf("tasks %q experimental %q: got %s exported %v, wanted %v", tc.tasks, tc.enabled, table, got[table], want)
+			}
+		}
+	}
+}
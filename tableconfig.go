@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// TableConfig is the table selection read from the file given by --table-config, keyed by network name. It refines
+// the tables selected by the --tasks and --experimental-tables flags and may be reloaded without a restart.
+type TableConfig struct {
+	Networks map[string]*NetworkTableConfig `yaml:"networks" toml:"networks"`
+}
+
+// NetworkTableConfig is the table selection for a single network.
+type NetworkTableConfig struct {
+	Include            []string          `yaml:"include" toml:"include"`                         // tables to export, all selected tables if empty
+	Exclude            []string          `yaml:"exclude" toml:"exclude"`                         // tables never to export
+	Compression        map[string]string `yaml:"compression" toml:"compression"`                 // compression of each table's files, by table name
+	CompressionLevel   map[string]int    `yaml:"compression_level" toml:"compression_level"`     // compression level of each table's files, by table name
+	CompressionWorkers map[string]int    `yaml:"compression_workers" toml:"compression_workers"` // parallel compression workers for each table's files, by table name
+	Formats            map[string]string `yaml:"formats" toml:"formats"`                         // ship formats of each table's files, by table name
+	Schema             int               `yaml:"schema" toml:"schema"`                           // storage schema version the network is pinned to
+}
+
+// loadTableConfig reads a table configuration file, decoding it as toml if its name ends in .toml and yaml otherwise.
+func loadTableConfig(path string) (*TableConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var tc TableConfig
+	switch filepath.Ext(path) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &tc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	default:
+		if err := yaml.Unmarshal(data, &tc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if err := tc.Validate(); err != nil {
+		return nil, err
+	}
+	return &tc, nil
+}
+
+// Validate checks that every table, compression, ship format and schema named in the configuration is known, and that
+// compression levels are accepted by the table's compression, or by some compression if the table has none configured.
+func (tc *TableConfig) Validate() error {
+	for network, nc := range tc.Networks {
+		if nc == nil {
+			continue
+		}
+		for _, name := range append(append([]string{}, nc.Include...), nc.Exclude...) {
+			if _, ok := TablesByName[name]; !ok {
+				return fmt.Errorf("network %s: unknown table %q", network, name)
+			}
+		}
+		for name, compression := range nc.Compression {
+			if _, ok := TablesByName[name]; !ok {
+				return fmt.Errorf("network %s: unknown table %q", network, name)
+			}
+			if _, ok := CompressionByName[compression]; !ok {
+				return fmt.Errorf("network %s: unknown compression %q for table %s", network, compression, name)
+			}
+		}
+		for name, level := range nc.CompressionLevel {
+			if _, ok := TablesByName[name]; !ok {
+				return fmt.Errorf("network %s: unknown table %q", network, name)
+			}
+			if c, ok := CompressionByName[nc.Compression[name]]; ok {
+				if !c.AcceptsLevel(level) {
+					return fmt.Errorf("network %s: compression level %d is not accepted by %s compression for table %s", network, level, c.Names[0], name)
+				}
+			} else if !acceptedCompressionLevel(level) {
+				return fmt.Errorf("network %s: compression level %d for table %s is not accepted by any compression", network, level, name)
+			}
+		}
+		for name, workers := range nc.CompressionWorkers {
+			if _, ok := TablesByName[name]; !ok {
+				return fmt.Errorf("network %s: unknown table %q", network, name)
+			}
+			if workers < 0 {
+				return fmt.Errorf("network %s: compression workers for table %s must not be negative", network, name)
+			}
+		}
+		for name, formats := range nc.Formats {
+			if _, ok := TablesByName[name]; !ok {
+				return fmt.Errorf("network %s: unknown table %q", network, name)
+			}
+			if _, err := parseShipTargets(formats); err != nil {
+				return fmt.Errorf("network %s: invalid ship formats for table %s: %w", network, name, err)
+			}
+		}
+		if nc.Schema != 0 {
+			if _, ok := TablesBySchema[nc.Schema]; !ok {
+				return fmt.Errorf("network %s: unknown schema version %d", network, nc.Schema)
+			}
+		}
+	}
+	return nil
+}
+
+// Network returns the configuration for the named network, or nil if the network has none.
+func (tc *TableConfig) Network(name string) *NetworkTableConfig {
+	if tc == nil {
+		return nil
+	}
+	return tc.Networks[name]
+}
+
+// FilterTables returns the tables that are included and not excluded by the configuration. A nil configuration
+// returns the tables unchanged.
+func (nc *NetworkTableConfig) FilterTables(tables []Table) []Table {
+	if nc == nil {
+		return tables
+	}
+
+	include := map[string]bool{}
+	for _, name := range nc.Include {
+		include[name] = true
+	}
+	exclude := map[string]bool{}
+	for _, name := range nc.Exclude {
+		exclude[name] = true
+	}
+
+	var filtered []Table
+	for _, t := range tables {
+		if len(include) > 0 && !include[t.Name] {
+			continue
+		}
+		if exclude[t.Name] {
+			continue
+		}
+		filtered = append(filtered, t)
+	}
+	return filtered
+}
+
+// TargetsForTable returns the ship targets for a table. The table's configured ship formats replace the targets, and
+// the table's configured compression then replaces the compression of each target whose format allows it, leaving
+// formats that are compressed internally, such as parquet, unchanged.
+func (nc *NetworkTableConfig) TargetsForTable(table string, targets []ShipTarget) []ShipTarget {
+	if nc == nil {
+		return targets
+	}
+	if formats, ok := nc.Formats[table]; ok {
+		// Formats were checked when the configuration was validated
+		if ts, err := parseShipTargets(formats); err == nil {
+			targets = ts
+		}
+	}
+	c, ok := CompressionByName[nc.Compression[table]]
+	if !ok {
+		return targets
+	}
+
+	var out []ShipTarget
+	seen := map[string]bool{}
+	for _, t := range targets {
+		if FormatsByName[t.Format].Allows(c) {
+			t.Compression = c
+		}
+		// Overriding may leave several targets writing the same file
+		key := t.Format + "." + t.Compression.Extension
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+var (
+	tableConfigMu sync.RWMutex
+	tableConfig   *TableConfig // table configuration in use by the process, nil if none has been configured
+)
+
+// currentTableConfig returns the table configuration for the network, or nil if there is none.
+func currentTableConfig(network string) *NetworkTableConfig {
+	tableConfigMu.RLock()
+	defer tableConfigMu.RUnlock()
+	return tableConfig.Network(network)
+}
+
+func setTableConfig(tc *TableConfig) {
+	tableConfigMu.Lock()
+	defer tableConfigMu.Unlock()
+	tableConfig = tc
+}
+
+// configureTableConfig loads the table configuration file and pins the storage schema version if the configuration
+// of the network names one.
+func configureTableConfig(path string, schemaFlagSet bool) error {
+	tc, err := loadTableConfig(path)
+	if err != nil {
+		return err
+	}
+
+	if nc := tc.Network(networkConfig.name); nc != nil && nc.Schema != 0 {
+		if schemaFlagSet && nc.Schema != storageConfig.schemaVersion {
+			return fmt.Errorf("schema version %d pinned for network %s conflicts with --storage-schema %d", nc.Schema, networkConfig.name, storageConfig.schemaVersion)
+		}
+		storageConfig.schemaVersion = nc.Schema
+	}
+
+	setTableConfig(tc)
+	return nil
+}
+
+// reloadTableConfigOnHangup reloads the table configuration file each time the process receives SIGHUP, until the
+// context is cancelled. The accept function is called with a new configuration before it is applied and may reject
+// it by returning an error. A configuration that cannot be loaded, or that changes the pinned schema version, is
+// rejected and the previous configuration is kept.
+func reloadTableConfigOnHangup(ctx context.Context, path string, accept func(*NetworkTableConfig) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ll := logger.With("table_config", path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		tc, err := loadTableConfig(path)
+		if err != nil {
+			ll.Errorw("failed to reload table config, keeping previous config", "error", err)
+			continue
+		}
+
+		nc := tc.Network(networkConfig.name)
+		if nc != nil && nc.Schema != 0 && nc.Schema != storageConfig.schemaVersion {
+			ll.Errorw("schema version cannot be changed without a restart, keeping previous config", "schema", nc.Schema, "current_schema", storageConfig.schemaVersion)
+			continue
+		}
+
+		if accept != nil {
+			if err := accept(nc); err != nil {
+				ll.Errorw("failed to apply table config, keeping previous config", "error", err)
+				continue
+			}
+		}
+
+		setTableConfig(tc)
+		ll.Info("reloaded table config")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTableConfig(t *testing.T) {
+	want := &NetworkTableConfig{
+		Exclude:     []string{"messages"},
+		Compression: map[string]string{"block_headers": "zstd"},
+		Schema:      1,
+	}
+
+	testCases := []struct {
+		name    string
+		file    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			file: "tables.yaml",
+			data: "networks:\n  mainnet:\n    exclude: [messages]\n    compression:\n      block_headers: zstd\n    schema: 1\n",
+		},
+		{
+			name: "toml",
+			file: "tables.toml",
+			data: "[networks.mainnet]\nexclude = [\"messages\"]\nschema = 1\n\n[networks.mainnet.compression]\nblock_headers = \"zstd\"\n",
+		},
+		{
+			name:    "unknown table",
+			file:    "tables.yaml",
+			data:    "networks:\n  mainnet:\n    include: [blocks]\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown compression",
+			file:    "tables.yaml",
+			data:    "networks:\n  mainnet:\n    compression:\n      messages: brotli\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.data), 0o644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := loadTableConfig(path)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Network("mainnet"), want) {
+				t.Errorf("got %+v, wanted %+v", got.Network("mainnet"), want)
+			}
+		})
+	}
+}
+
+func TestNetworkTableConfigFilterTables(t *testing.T) {
+	tables := []Table{TablesByName["block_headers"], TablesByName["messages"], TablesByName["receipts"]}
+
+	testCases := []struct {
+		name string
+		nc   *NetworkTableConfig
+		want []string
+	}{
+		{name: "no config", nc: nil, want: []string{"block_headers", "messages", "receipts"}},
+		{name: "include", nc: &NetworkTableConfig{Include: []string{"messages", "receipts"}}, want: []string{"messages", "receipts"}},
+		{name: "exclude", nc: &NetworkTableConfig{Exclude: []string{"messages"}}, want: []string{"block_headers", "receipts"}},
+		{name: "include and exclude", nc: &NetworkTableConfig{Include: []string{"messages", "receipts"}, Exclude: []string{"messages"}}, want: []string{"receipts"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, table := range tc.nc.FilterTables(tables) {
+				got = append(got, table.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNetworkTableConfigTargetsForTable(t *testing.T) {
+	targets, err := parseShipTargets("csv.gz,csv.zstd-seekable,parquet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nc := &NetworkTableConfig{Compression: map[string]string{"messages": "zstd"}}
+
+	var got []string
+	for _, target := range nc.TargetsForTable("messages", targets) {
+		got = append(got, target.String())
+	}
+	if want := []string{"csv.zstd", "parquet.none"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	if got := nc.TargetsForTable("receipts", targets); !reflect.DeepEqual(got, targets) {
+		t.Errorf("got %v for table without override, wanted %v", got, targets)
+	}
+
+	nc = &NetworkTableConfig{
+		Formats:     map[string]string{"messages": "csv.gz,jsonl"},
+		Compression: map[string]string{"messages": "zstd-seekable"},
+	}
+	got = nil
+	for _, target := range nc.TargetsForTable("messages", targets) {
+		got = append(got, target.String())
+	}
+	if want := []string{"csv.zstd-seekable", "jsonl.gzip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+)
+
+// transcodeWalkName is the name given to the walk output that shipped files are decompressed to while being transcoded.
+const transcodeWalkName = "transcode"
+
+// decompressShippedFile writes the rows of a shipped csv file, or of all the parts of a sharded file, to out in the
+// form of walk output.
+func decompressShippedFile(shipPath string, ef *ExportFile, out string) error {
+	var rc io.ReadCloser
+	if sl, err := readLocalShardList(shipPath, ef); err == nil {
+		rc, err = openShardedFile(shipPath, sl, ef.Compression, nil, false, -1, -1)
+		if err != nil {
+			return err
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		rc, err = openShippedFile(filepath.Join(shipPath, ef.Path()), ef.Compression, nil)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", ef.Path(), err)
+		}
+	} else {
+		return fmt.Errorf("read shard list: %w", err)
+	}
+	defer rc.Close()
+
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DefaultFilePerms)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return fmt.Errorf("decompress %s: %w", ef.Path(), err)
+	}
+	return f.Close()
+}
+
+// transcodePeriod ships the tables of a period in each of the targets that they have not yet been shipped in, by
+// converting the files already shipped in the source target rather than walking the chain again. The source files are
+// read from a filesystem ship path and decompressed to workPath, from where they are shipped as if they were the output
+// of a walk. It returns the files that were shipped.
+func transcodePeriod(ctx context.Context, p ExportPeriod, srcPath string, source ShipTarget, sh Shipper, tables []Table, targets []ShipTarget, workPath string, dryRun bool) ([]*ExportFile, error) {
+	ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight)
+
+	srcEm, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, &fileShipper{root: srcPath}, storageConfig.schemaVersion, tables, []ShipTarget{source})
+	if err != nil {
+		return nil, fmt.Errorf("build source manifest: %w", err)
+	}
+	sources := map[string]*ExportFile{}
+	for _, ef := range srcEm.Files {
+		if ef.Shipped {
+			sources[ef.TableName] = ef
+		}
+	}
+
+	em, err := manifestForPeriod(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, tables, targets)
+	if err != nil {
+		return nil, fmt.Errorf("build manifest: %w", err)
+	}
+
+	wi := WalkInfo{Name: transcodeWalkName, Path: workPath, Format: FormatCSV}
+	var shipped []*ExportFile
+	for _, ef := range em.Files {
+		src, ok := sources[ef.TableName]
+		if !ef.NeedsShipping() || !ok {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("%s -> %s\n", src.Path(), ef.Path())
+			continue
+		}
+
+		walkFile := wi.WalkFile(ef.TableName)
+		if err := decompressShippedFile(srcPath, src, walkFile); err != nil {
+			os.Remove(walkFile)
+			return shipped, fmt.Errorf("read %s: %w", src.Path(), err)
+		}
+		err := shipExportFile(ctx, ef, wi, sh)
+		os.Remove(walkFile)
+		if err != nil {
+			shipTableErrorsCounter.Inc()
+			return shipped, fmt.Errorf("ship %s: %w", ef.Path(), err)
+		}
+		ll.Infow("transcoded file", "from", src.Path(), "to", ef.Path())
+
+		ef.Shipped = true
+		shipped = append(shipped, ef)
+		recordShippedFileMetrics(ctx, ef)
+		if err := recordShippedFile(ctx, ef, sh); err != nil {
+			ll.Errorw("failed to record shipped file in catalog", "error", err, "file", ef.Path())
+		}
+	}
+
+	if len(shipped) > 0 {
+		if err := writePeriodManifest(ctx, em, shipped, sh); err != nil {
+			ll.Errorw("failed to write period manifest", "error", err)
+		}
+	}
+	return shipped, nil
+}
+
+var transcodeCommand = &cli.Command{
+	Name:   "transcode",
+	Usage:  "Convert shipped csv files to other formats or compressions without walking the chain again.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		stateFlags,
+		auditFlags,
+		shippingFlags,
+		objectStoreFlags,
+		signingFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path to the shipped files that are read.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "dest-path",
+				Usage: "Path that transcoded files are shipped to, or an s3://bucket/prefix or gs://bucket/prefix object store location. Defaults to the ship path.",
+			},
+			&cli.StringFlag{
+				Name:  "source-format",
+				Usage: "Format and compression of the shipped files that are read, as a csv.compression entry such as csv.gz.",
+				Value: "csv.gz",
+			},
+			&cli.StringFlag{
+				Name:  "ship-formats",
+				Usage: "Comma separated list of format.compression entries that files are transcoded to, such as parquet or jsonl.zstd.",
+				Value: FormatParquet,
+			},
+			&cli.StringFlag{
+				Name:  "tables",
+				Usage: "Comma separated list of tables to transcode. Default is every stable table.",
+			},
+			&cli.StringFlag{
+				Name:  "from-date",
+				Usage: "First date to transcode, in YYYY-MM-DD format. Defaults to genesis.",
+			},
+			&cli.StringFlag{
+				Name:  "to-date",
+				Usage: "Last date to transcode, in YYYY-MM-DD format. Defaults to the most recent period that can be exported.",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "List the files that would be transcoded without transcoding them.",
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		sources, err := parseShipTargets(cc.String("source-format"))
+		if err != nil {
+			return fmt.Errorf("invalid source format: %w", err)
+		}
+		if len(sources) != 1 || sources[0].Format != FormatCSV {
+			return fmt.Errorf("source format must be a single csv entry")
+		}
+		source := sources[0]
+
+		targets, err := parseShipTargets(cc.String("ship-formats"))
+		if err != nil {
+			return fmt.Errorf("invalid ship formats: %w", err)
+		}
+		for _, t := range targets {
+			if t.String() == source.String() {
+				return fmt.Errorf("cannot transcode %s to itself", t)
+			}
+		}
+
+		tables := StableTables
+		if cc.IsSet("tables") {
+			names, err := parseTableList(cc.String("tables"))
+			if err != nil {
+				return fmt.Errorf("invalid tables: %w", err)
+			}
+			tables = nil
+			for _, name := range names {
+				tables = append(tables, TablesByName[name])
+			}
+		}
+
+		srcPath := cc.String("ship-path")
+		if err := verifyShipPath(srcPath); err != nil {
+			return fmt.Errorf("unable to read shipped files: %w", err)
+		}
+		destPath := cc.String("dest-path")
+		if destPath == "" {
+			destPath = srcPath
+		}
+		sh, err := newShipper(destPath)
+		if err != nil {
+			return fmt.Errorf("unable to ship files: %w", err)
+		}
+
+		first := firstExportPeriod(networkConfig.genesisTs)
+		if cc.IsSet("from-date") {
+			d, err := DateFromString(cc.String("from-date"))
+			if err != nil {
+				return fmt.Errorf("invalid from date: %w", err)
+			}
+			if first, err = exportPeriodForDate(d, networkConfig.genesisTs); err != nil {
+				return fmt.Errorf("invalid from date: %w", err)
+			}
+		}
+		last := latestFinalPeriod(networkConfig.genesisTs)
+		if cc.IsSet("to-date") {
+			d, err := DateFromString(cc.String("to-date"))
+			if err != nil {
+				return fmt.Errorf("invalid to date: %w", err)
+			}
+			if last, err = exportPeriodForDate(d, networkConfig.genesisTs); err != nil {
+				return fmt.Errorf("invalid to date: %w", err)
+			}
+		}
+
+		dryRun := cc.Bool("dry-run")
+		if !dryRun {
+			if err := ensureAncillaryFiles(ctx, sh, tables); err != nil {
+				return fmt.Errorf("unable to ensure ancillary files exist: %w", err)
+			}
+		}
+
+		base := shippingConfig.stagingPath
+		if base == "" {
+			base = os.TempDir()
+		}
+		workPath, err := os.MkdirTemp(base, transcodeWalkName+"-")
+		if err != nil {
+			return fmt.Errorf("create work directory: %w", err)
+		}
+		defer os.RemoveAll(workPath)
+
+		// The height index lists every format shipped for a period, so it is updated for the source format too when
+		// transcoding within the same ship path
+		indexTargets := targets
+		if root, ok := localShipPath(sh); ok && filepath.Clean(root) == filepath.Clean(srcPath) {
+			indexTargets = append([]ShipTarget{source}, targets...)
+		}
+
+		var files int
+		for p := first; p.StartHeight <= last.StartHeight; p = p.Next() {
+			shipped, err := transcodePeriod(ctx, p, srcPath, source, sh, tables, targets, workPath, dryRun)
+			files += len(shipped)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("transcode %s: %w", p.String(), err)
+			}
+			if len(shipped) > 0 {
+				if err := updateHeightIndex(ctx, p, networkConfig.name, networkConfig.genesisTs, sh, storageConfig.schemaVersion, indexTargets); err != nil {
+					logger.Errorw("failed to update height index", "error", err, "date", p.Date.String())
+				}
+			}
+		}
+
+		if !dryRun {
+			logger.Infow("transcode complete", "files", files)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTranscodePeriod(t *testing.T) {
+	defer func(n string, v int) { networkConfig.name, storageConfig.schemaVersion = n, v }(networkConfig.name, storageConfig.schemaVersion)
+	networkConfig.name, storageConfig.schemaVersion = "mainnet", 1
+
+	srcRoot, dstRoot := t.TempDir(), t.TempDir()
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	source := ShipTarget{Format: FormatCSV, Compression: CompressionByName["gz"]}
+	target := ShipTarget{Format: FormatParquet, Compression: CompressionByName["none"]}
+	tables := []Table{TablesByName["chain_consensus"]}
+
+	em, err := manifestForPeriod(context.Background(), p, networkConfig.name, networkConfig.genesisTs, &fileShipper{root: srcRoot}, storageConfig.schemaVersion, tables, []ShipTarget{source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := em.Files[0]
+	rows := "1005360,root,parent,tipset\n1005361,root,parent,tipset\n"
+	var buf bytes.Buffer
+	if _, err := compressExportReader(context.Background(), ef, strings.NewReader(rows), &buf); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(srcRoot, filepath.Dir(ef.Path())), DefaultDirPerms); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcRoot, ef.Path()), buf.Bytes(), DefaultFilePerms); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := &fileShipper{root: dstRoot}
+	shipped, err := transcodePeriod(context.Background(), p, srcRoot, source, sh, tables, []ShipTarget{target}, t.TempDir(), true)
+	if err != nil || len(shipped) != 0 {
+		t.Fatalf("dry run should not ship files, got %d files and error %v", len(shipped), err)
+	}
+
+	shipped, err = transcodePeriod(context.Background(), p, srcRoot, source, sh, tables, []ShipTarget{target}, t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("transcode: %v", err)
+	}
+	if len(shipped) != 1 || shipped[0].Format != FormatParquet || shipped[0].Rows != 2 {
+		t.Fatalf("unexpected transcoded files: %+v", shipped)
+	}
+	if _, err := os.Stat(filepath.Join(dstRoot, shipped[0].Path())); err != nil {
+		t.Errorf("transcoded file is missing: %v", err)
+	}
+
+	// Files that have already been transcoded are skipped
+	shipped, err = transcodePeriod(context.Background(), p, srcRoot, source, sh, tables, []ShipTarget{target}, t.TempDir(), false)
+	if err != nil || len(shipped) != 0 {
+		t.Errorf("got %d files and error %v transcoding again, wanted none", len(shipped), err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/lily/model/visor"
 )
 
@@ -29,10 +31,30 @@ func verifyExport(ctx context.Context, em *ExportManifest, wi WalkInfo, shipPath
 		tasklist = append(tasklist, task)
 	}
 
-	return verifyTasks(ctx, wi, tasklist)
+	return verifyTasks(ctx, wi, em.Period.StartHeight, em.Period.EndHeight, tasklist)
 }
 
-func verifyTasks(ctx context.Context, wi WalkInfo, tasks []string) (*VerificationReport, error) {
+// taskActiveAtHeight reports whether any table written by the task is supported at the network version of the height.
+// Heights at which a task's tables are not supported, such as those outside the network versions of a variant of a
+// table family, are not expected to have been processed by the task.
+func taskActiveAtHeight(task string, height int64) bool {
+	tables := TablesByTask(task, storageConfig.schemaVersion)
+	if len(tables) == 0 {
+		return true
+	}
+	nv := NetworkVersionAtHeight(abi.ChainEpoch(height))
+	for _, t := range tables {
+		if t.supportedAtVersion(nv) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTasks checks the processing reports of a walk of the heights from and to, inclusive, for each task, and the row
+// counts of the tables the tasks produce. Heights of the range missing from the chain consensus export are reported as
+// missing for every task since the walk gives no account of them.
+func verifyTasks(ctx context.Context, wi WalkInfo, from, to int64, tasks []string) (*VerificationReport, error) {
 	consensusPath := wi.WalkFile("chain_consensus")
 	logger.Debugw("reading chain_consensus export", "export_file", consensusPath)
 
@@ -42,33 +64,15 @@ func verifyTasks(ctx context.Context, wi WalkInfo, tasks []string) (*Verificatio
 	}
 	defer consensusFile.Close()
 
-	heights := map[int64][]string{}
-	r := csv.NewReader(bufio.NewReader(consensusFile))
-	for {
-		row, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("consensus export: read: %w", err)
-		}
-
-		if len(row) < 4 {
-			return nil, fmt.Errorf("consensus export: row has too few columns") // TODO: line number
-		}
-
-		height, err := strconv.ParseInt(row[0], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("consensus export: malformed height: %w", err)
-		}
-
-		var blocks []string
-		if len(row[3]) > 2 {
-			blocks = strings.Split(row[3][1:len(row[3])-1], ",")
-		}
-		heights[height] = blocks
+	heights, err := readConsensusHeights(bufio.NewReader(consensusFile))
+	if err != nil {
+		return nil, fmt.Errorf("consensus export: %w", err)
 	}
 	logger.Debugf("found %d heights in chain consensus export", len(heights))
+	summary := summarizeConsensus(heights, from, to)
+	if len(summary.uncovered) > 0 {
+		logger.Infow("chain consensus export does not cover the walked range", "from", from, "to", to, "missing", len(summary.uncovered))
+	}
 
 	type taskInfo struct {
 		status TaskStatus
@@ -81,7 +85,16 @@ func verifyTasks(ctx context.Context, wi WalkInfo, tasks []string) (*Verificatio
 			seen: map[int64]bool{},
 		}
 		for height, blocks := range heights {
-			if blocks != nil {
+			// The genesis tipset has no parent, so tasks that only process a tipset's parent do not report it
+			if height == 0 && !taskProcessesGenesis(task) {
+				continue
+			}
+			if blocks != nil && taskActiveAtHeight(task, height) {
+				info.seen[height] = false
+			}
+		}
+		for _, height := range summary.uncovered {
+			if (height != 0 || taskProcessesGenesis(task)) && taskActiveAtHeight(task, height) {
 				info.seen[height] = false
 			}
 		}
@@ -96,7 +109,7 @@ func verifyTasks(ctx context.Context, wi WalkInfo, tasks []string) (*Verificatio
 	}
 	defer reportsFile.Close()
 
-	r = csv.NewReader(bufio.NewReader(reportsFile))
+	r := csv.NewReader(bufio.NewReader(reportsFile))
 	for {
 		row, err := r.Read()
 		if err == io.EOF {
@@ -128,6 +141,13 @@ func verifyTasks(ctx context.Context, wi WalkInfo, tasks []string) (*Verificatio
 			if task == "consensus" {
 				continue
 			}
+			// Lily may report tasks whose tables are not written at the network version of the height
+			if !taskActiveAtHeight(task, height) {
+				continue
+			}
+			if height == 0 && !taskProcessesGenesis(task) {
+				continue
+			}
 			ll.Infof("unexpected data found for height %d", height)
 			info.status.Unexpected = append(info.status.Unexpected, height)
 		} else {
@@ -173,25 +193,176 @@ func verifyTasks(ctx context.Context, wi WalkInfo, tasks []string) (*Verificatio
 		sort.Slice(info.status.Missing, func(a, b int) bool { return info.status.Missing[a] < info.status.Missing[b] })
 		sort.Slice(info.status.Error, func(a, b int) bool { return info.status.Error[a] < info.status.Error[b] })
 		sort.Slice(info.status.Unexpected, func(a, b int) bool { return info.status.Unexpected[a] < info.status.Unexpected[b] })
+
+		implausible, err := implausibleRowCounts(ctx, wi, task, summary)
+		if err != nil {
+			return nil, fmt.Errorf("check row counts: %w", err)
+		}
+		info.status.Implausible = implausible
+
 		report.TaskStatus[task] = info.status
 	}
 
 	return &report, nil
 }
 
+// readConsensusHeights reads the rows of the chain_consensus table, returning the cids of the blocks of the tipset at
+// each height. The cids are nil for null rounds.
+func readConsensusHeights(r io.Reader) (map[int64][]string, error) {
+	heights := map[int64][]string{}
+	cr := csv.NewReader(r)
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+
+		if len(row) < 4 {
+			return nil, fmt.Errorf("row has too few columns") // TODO: line number
+		}
+
+		height, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed height: %w", err)
+		}
+
+		var blocks []string
+		if len(row[3]) > 2 {
+			blocks = strings.Split(row[3][1:len(row[3])-1], ",")
+		}
+		heights[height] = blocks
+	}
+	return heights, nil
+}
+
 type VerificationReport struct {
 	TaskStatus map[string]TaskStatus
 }
 
 type TaskStatus struct {
-	Missing    []int64 // heights that were missing or skipped
-	Error      []int64 // heights that reported an error
-	Unexpected []int64 // heights that should not have been present
+	Missing     []int64           // heights that were missing or skipped
+	Error       []int64           // heights that reported an error
+	Unexpected  []int64           // heights that should not have been present
+	Implausible map[string]string // tables produced by the task with implausible row counts, with the reason
 }
 
-// IsOK reports true if no errors, skips or additional data was present
+// IsOK reports true if no errors, skips or additional data was present and all row counts were plausible
 func (ts *TaskStatus) IsOK() bool {
-	return len(ts.Missing) == 0 && len(ts.Error) == 0 && len(ts.Unexpected) == 0
+	return len(ts.Missing) == 0 && len(ts.Error) == 0 && len(ts.Unexpected) == 0 && len(ts.Implausible) == 0
+}
+
+// consensusSummary describes the tipsets found in a chain consensus export of a range of heights.
+type consensusSummary struct {
+	span      int64   // number of heights in the walked range, inclusive
+	tipsets   int64   // number of heights that were not null rounds
+	blocks    int64   // number of blocks in all tipsets
+	genesis   bool    // the range includes the genesis tipset
+	uncovered []int64 // heights of the range with no row in the export
+}
+
+// summarizeConsensus summarizes the heights of a chain consensus export of the heights from and to, inclusive. The
+// span is that of the range rather than of the heights found, so an export that stops short of either end of the
+// range does not have a row for every height of its span.
+func summarizeConsensus(heights map[int64][]string, from, to int64) consensusSummary {
+	cs := consensusSummary{span: to - from + 1, genesis: from == 0}
+	for height, blocks := range heights {
+		if height < from || height > to {
+			continue
+		}
+		if blocks != nil {
+			cs.tipsets++
+			cs.blocks += int64(len(blocks))
+		}
+	}
+	for h := from; h <= to; h++ {
+		if _, ok := heights[h]; !ok {
+			cs.uncovered = append(cs.uncovered, h)
+		}
+	}
+	return cs
+}
+
+// rowCountExpectation checks the number of rows exported for a table against the chain consensus export, returning a
+// description of the problem if the count is implausible.
+type rowCountExpectation func(rows int64, cs consensusSummary) string
+
+// rowCountExpectations holds the expectations for tables whose row counts can be predicted from the chain. A walk that
+// silently produced a truncated table would otherwise pass verification.
+var rowCountExpectations = map[string]rowCountExpectation{
+	"block_headers": func(rows int64, cs consensusSummary) string {
+		if rows != cs.blocks {
+			return fmt.Sprintf("found %d rows, expected one for each of %d blocks", rows, cs.blocks)
+		}
+		return ""
+	},
+	"chain_consensus": func(rows int64, cs consensusSummary) string {
+		if rows != cs.span {
+			return fmt.Sprintf("found %d rows, expected one for each of %d heights", rows, cs.span)
+		}
+		return ""
+	},
+	"block_messages": expectRowsForTipsets,
+	"messages":       expectRowsForTipsets,
+	"receipts":       expectRowsForTipsets,
+}
+
+// expectRowsForTipsets expects a table to have at least one row when there were tipsets that were not null rounds.
+func expectRowsForTipsets(rows int64, cs consensusSummary) string {
+	if rows == 0 && cs.tipsets > 0 {
+		return fmt.Sprintf("found no rows for %d tipsets", cs.tipsets)
+	}
+	return ""
+}
+
+// implausibleRowCounts counts the rows exported for each table produced by the task that has a row count expectation
+// and returns the tables whose counts are implausible, with the reason. Tables that may be empty in the first period of
+// a network, see genesisExpectations, are allowed no rows when the heights include genesis.
+func implausibleRowCounts(ctx context.Context, wi WalkInfo, task string, cs consensusSummary) (map[string]string, error) {
+	var implausible map[string]string
+	for _, t := range TableList {
+		expect, ok := rowCountExpectations[t.Name]
+		if t.Task != task || !ok {
+			continue
+		}
+
+		rows, err := countWalkFileRows(ctx, wi.WalkFile(t.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Name, err)
+		}
+		if rows == 0 && cs.genesis && genesisExpectations[t.Name].MayBeEmpty {
+			continue
+		}
+		if reason := expect(rows, cs); reason != "" {
+			logger.With("task", task, "table", t.Name).Infof("implausible row count: %s", reason)
+			if implausible == nil {
+				implausible = map[string]string{}
+			}
+			implausible[t.Name] = reason
+		}
+	}
+	return implausible, nil
+}
+
+// countWalkFileRows counts the rows in a file written by a walk. Lily does not write a file for a table with no rows,
+// so a missing file has no rows.
+func countWalkFileRows(ctx context.Context, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	rc := &csvRowCounter{r: f}
+	if _, err := io.Copy(io.Discard, &contextReader{ctx: ctx, r: rc}); err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+	return rc.Rows(), nil
 }
 
 type Range struct {
@@ -218,3 +389,271 @@ func ranges(hs []int64) []Range {
 
 	return rs
 }
+
+// Names of the checks performed during verification.
+const (
+	CheckMissing    = "missing"    // heights that were missing or skipped
+	CheckError      = "error"      // heights that reported an error
+	CheckUnexpected = "unexpected" // heights that should not have been present
+	CheckRowCount   = "row-count"  // tables whose row counts are implausible for the chain
+)
+
+// KnownChecks is a lookup of known verification check names
+var KnownChecks = map[string]struct{}{
+	CheckMissing:    {},
+	CheckError:      {},
+	CheckUnexpected: {},
+	CheckRowCount:   {},
+}
+
+// Strictness controls how the failure of a verification check affects shipping of a table.
+type Strictness int
+
+const (
+	StrictnessOff   Strictness = iota // failures are ignored
+	StrictnessWarn                    // failures are logged but the table is still shipped
+	StrictnessBlock                   // failures prevent the table from being shipped
+)
+
+var strictnessNames = map[string]Strictness{
+	"off":   StrictnessOff,
+	"warn":  StrictnessWarn,
+	"block": StrictnessBlock,
+}
+
+func (s Strictness) String() string {
+	for name, v := range strictnessNames {
+		if v == s {
+			return name
+		}
+	}
+	return fmt.Sprintf("strictness(%d)", int(s))
+}
+
+func parseStrictness(s string) (Strictness, error) {
+	v, ok := strictnessNames[s]
+	if !ok {
+		return StrictnessBlock, fmt.Errorf("unknown strictness %q, expected one of off, warn or block", s)
+	}
+	return v, nil
+}
+
+// VerificationPolicy determines the strictness applied to each verification check for each table. Tables exempted
+// from a check by the skip list are never subject to it, otherwise the most specific setting wins: table and check,
+// then table, then check and finally the default.
+type VerificationPolicy struct {
+	Default     Strictness
+	Checks      map[string]Strictness            // strictness by check name
+	Tables      map[string]Strictness            // strictness by table name
+	TableChecks map[string]map[string]Strictness // strictness by table and check name
+	Skips       map[string]map[string]bool       // checks that tables are exempt from
+}
+
+// DefaultVerificationPolicy blocks shipping of a table on any verification failure.
+var DefaultVerificationPolicy = VerificationPolicy{Default: StrictnessBlock}
+
+// verificationPolicy is the policy in effect for the process
+var verificationPolicy = DefaultVerificationPolicy
+
+// parseVerificationPolicy parses a comma separated list of strictness settings. Each entry is either a bare level, which
+// sets the default, or one of check=level, table=level or table:check=level.
+func parseVerificationPolicy(s string) (VerificationPolicy, error) {
+	p := VerificationPolicy{
+		Default:     StrictnessBlock,
+		Checks:      map[string]Strictness{},
+		Tables:      map[string]Strictness{},
+		TableChecks: map[string]map[string]Strictness{},
+		Skips:       map[string]map[string]bool{},
+	}
+
+	if s == "" {
+		return p, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, "=")
+		if len(parts) == 1 {
+			level, err := parseStrictness(parts[0])
+			if err != nil {
+				return p, fmt.Errorf("invalid strictness entry %q: %w", entry, err)
+			}
+			p.Default = level
+			continue
+		}
+		if len(parts) != 2 {
+			return p, fmt.Errorf("invalid strictness entry %q, expected it to be in format \"[table:]check=level\" or \"table=level\"", entry)
+		}
+
+		level, err := parseStrictness(parts[1])
+		if err != nil {
+			return p, fmt.Errorf("invalid strictness entry %q: %w", entry, err)
+		}
+
+		target := parts[0]
+		if idx := strings.Index(target, ":"); idx > -1 {
+			table, check := target[:idx], target[idx+1:]
+			if _, ok := TablesByName[table]; !ok {
+				return p, fmt.Errorf("invalid strictness entry %q: unknown table %q", entry, table)
+			}
+			if _, ok := KnownChecks[check]; !ok {
+				return p, fmt.Errorf("invalid strictness entry %q: unknown check %q", entry, check)
+			}
+			if p.TableChecks[table] == nil {
+				p.TableChecks[table] = map[string]Strictness{}
+			}
+			p.TableChecks[table][check] = level
+			continue
+		}
+
+		if _, ok := KnownChecks[target]; ok {
+			p.Checks[target] = level
+			continue
+		}
+
+		if _, ok := TablesByName[target]; ok {
+			p.Tables[target] = level
+			continue
+		}
+
+		return p, fmt.Errorf("invalid strictness entry %q: unknown table or check %q", entry, target)
+	}
+
+	return p, nil
+}
+
+// parseVerificationSkipList parses a comma separated list of table:check entries naming the checks that a table is
+// exempt from. An entry consisting of just a table name exempts the table from all checks.
+func parseVerificationSkipList(s string) (map[string][]string, error) {
+	skips := map[string][]string{}
+	if s == "" {
+		return skips, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		table, check := entry, ""
+		if idx := strings.Index(entry, ":"); idx > -1 {
+			table, check = entry[:idx], entry[idx+1:]
+		}
+
+		if _, ok := TablesByName[table]; !ok {
+			return nil, fmt.Errorf("invalid skip entry %q: unknown table %q", entry, table)
+		}
+
+		if check == "" {
+			for c := range KnownChecks {
+				skips[table] = append(skips[table], c)
+			}
+			continue
+		}
+
+		if _, ok := KnownChecks[check]; !ok {
+			return nil, fmt.Errorf("invalid skip entry %q: unknown check %q", entry, check)
+		}
+		skips[table] = append(skips[table], check)
+	}
+
+	return skips, nil
+}
+
+func setVerificationPolicy(strictness string, skipList string) error {
+	p, err := parseVerificationPolicy(strictness)
+	if err != nil {
+		return fmt.Errorf("invalid strictness: %w", err)
+	}
+
+	skips, err := parseVerificationSkipList(skipList)
+	if err != nil {
+		return fmt.Errorf("invalid skip list: %w", err)
+	}
+	for table, checks := range skips {
+		p.Skip(table, checks...)
+	}
+
+	verificationPolicy = p
+	return nil
+}
+
+// Skip exempts a table from the given checks.
+func (p *VerificationPolicy) Skip(table string, checks ...string) {
+	if p.Skips == nil {
+		p.Skips = map[string]map[string]bool{}
+	}
+	if p.Skips[table] == nil {
+		p.Skips[table] = map[string]bool{}
+	}
+	for _, check := range checks {
+		p.Skips[table][check] = true
+	}
+}
+
+// IsSkipped reports whether a table is exempt from a check.
+func (p *VerificationPolicy) IsSkipped(table, check string) bool {
+	return p.Skips[table][check]
+}
+
+// Strictness returns the strictness that applies to a check for the given table.
+func (p *VerificationPolicy) Strictness(table, check string) Strictness {
+	if p.IsSkipped(table, check) {
+		return StrictnessOff
+	}
+	if level, ok := p.TableChecks[table][check]; ok {
+		return level
+	}
+	if level, ok := p.Tables[table]; ok {
+		return level
+	}
+	if level, ok := p.Checks[check]; ok {
+		return level
+	}
+	return p.Default
+}
+
+// Evaluate applies the policy to the verification status of the task that produces a table. It returns the highest
+// strictness of any failed check along with the names of the checks that failed.
+func (p *VerificationPolicy) Evaluate(table string, ts TaskStatus) (Strictness, []string) {
+	result := StrictnessOff
+	var failed []string
+
+	checks := ts.FailedChecks()
+	if _, ok := ts.Implausible[table]; ok {
+		checks = append(checks, CheckRowCount)
+	}
+	for _, check := range checks {
+		level := p.Strictness(table, check)
+		if level == StrictnessOff {
+			continue
+		}
+		failed = append(failed, check)
+		if level > result {
+			result = level
+		}
+	}
+
+	return result, failed
+}
+
+// FailedChecks returns the names of the checks that did not pass for every table produced by the task. Row count
+// checks apply to individual tables and are not included.
+func (ts *TaskStatus) FailedChecks() []string {
+	var failed []string
+	if len(ts.Missing) > 0 {
+		failed = append(failed, CheckMissing)
+	}
+	if len(ts.Error) > 0 {
+		failed = append(failed, CheckError)
+	}
+	if len(ts.Unexpected) > 0 {
+		failed = append(failed, CheckUnexpected)
+	}
+	return failed
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestVerificationPolicyStrictness(t *testing.T) {
+	p, err := parseVerificationPolicy("warn,missing=off,chain_consensus=block,messages:error=off")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		table string
+		check string
+		want  Strictness
+	}{
+		{table: "actors", check: CheckError, want: StrictnessWarn},
+		{table: "actors", check: CheckMissing, want: StrictnessOff},
+		{table: "chain_consensus", check: CheckMissing, want: StrictnessBlock},
+		{table: "messages", check: CheckError, want: StrictnessOff},
+		{table: "messages", check: CheckUnexpected, want: StrictnessWarn},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.table+":"+tc.check, func(t *testing.T) {
+			got := p.Strictness(tc.table, tc.check)
+			if got != tc.want {
+				t.Errorf("got %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerificationPolicyEvaluate(t *testing.T) {
+	p, err := parseVerificationPolicy("error=warn,unexpected=off")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		status TaskStatus
+		want   Strictness
+	}{
+		{name: "ok", status: TaskStatus{}, want: StrictnessOff},
+		{name: "unexpected", status: TaskStatus{Unexpected: []int64{1}}, want: StrictnessOff},
+		{name: "error", status: TaskStatus{Error: []int64{1}}, want: StrictnessWarn},
+		{name: "missing", status: TaskStatus{Missing: []int64{1}, Error: []int64{2}}, want: StrictnessBlock},
+		{name: "row count", status: TaskStatus{Implausible: map[string]string{"actors": "no rows"}}, want: StrictnessBlock},
+		{name: "row count other table", status: TaskStatus{Implausible: map[string]string{"actor_states": "no rows"}}, want: StrictnessOff},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := p.Evaluate("actors", tc.status)
+			if got != tc.want {
+				t.Errorf("got %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseVerificationPolicyInvalid(t *testing.T) {
+	for _, s := range []string{"strict", "missing=maybe", "no_such_table=warn", "actors:no_such_check=warn", "a=b=c"} {
+		if _, err := parseVerificationPolicy(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestVerificationPolicySkip(t *testing.T) {
+	p, err := parseVerificationPolicy("block,actors=block")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	skips, err := parseVerificationSkipList("actors:missing,messages")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for table, checks := range skips {
+		p.Skip(table, checks...)
+	}
+
+	if got := p.Strictness("actors", CheckMissing); got != StrictnessOff {
+		t.Errorf("actors:missing got %s, wanted %s", got, StrictnessOff)
+	}
+	if got := p.Strictness("actors", CheckError); got != StrictnessBlock {
+		t.Errorf("actors:error got %s, wanted %s", got, StrictnessBlock)
+	}
+	for check := range KnownChecks {
+		if got := p.Strictness("messages", check); got != StrictnessOff {
+			t.Errorf("messages:%s got %s, wanted %s", check, got, StrictnessOff)
+		}
+	}
+}
+
+func TestRowCountExpectations(t *testing.T) {
+	heights := map[int64][]string{
+		10: {"b1", "b2"},
+		11: nil, // null round
+		12: {"b3"},
+	}
+	cs := summarizeConsensus(heights, 10, 12)
+	if cs.span != 3 || cs.tipsets != 2 || cs.blocks != 3 || len(cs.uncovered) != 0 {
+		t.Fatalf("unexpected summary: %+v", cs)
+	}
+
+	// The span is taken from the walked range, so an export that stops short of the range is found to be truncated
+	short := summarizeConsensus(heights, 9, 14)
+	if short.span != 6 || !reflect.DeepEqual(short.uncovered, []int64{9, 13, 14}) {
+		t.Errorf("unexpected summary of a truncated export: %+v", short)
+	}
+	if reason := rowCountExpectations["chain_consensus"](3, short); reason == "" {
+		t.Errorf("expected an export missing heights of the range to be implausible")
+	}
+
+	testCases := []struct {
+		table     string
+		rows      int64
+		plausible bool
+	}{
+		{table: "block_headers", rows: 3, plausible: true},
+		{table: "block_headers", rows: 2, plausible: false},
+		{table: "chain_consensus", rows: 3, plausible: true},
+		{table: "chain_consensus", rows: 2, plausible: false},
+		{table: "messages", rows: 1, plausible: true},
+		{table: "messages", rows: 0, plausible: false},
+	}
+
+	for _, tc := range testCases {
+		reason := rowCountExpectations[tc.table](tc.rows, cs)
+		if (reason == "") != tc.plausible {
+			t.Errorf("%s with %d rows: got reason %q, wanted plausible=%v", tc.table, tc.rows, reason, tc.plausible)
+		}
+	}
+
+	if reason := expectRowsForTipsets(0, summarizeConsensus(map[int64][]string{10: nil}, 10, 10)); reason != "" {
+		t.Errorf("expected no rows to be plausible for null rounds, got %q", reason)
+	}
+}
+
+func TestVerifyTasksUncoveredHeights(t *testing.T) {
+	wi := WalkInfo{Name: "walk-2021-08-02", Path: t.TempDir(), Format: "csv"}
+	headers := TablesByName["block_headers"].Task
+
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(wi.WalkFile("chain_consensus"), "1005360,r0,p0,{b0}\n1005361,r1,p1,{b1}\n")
+	write(wi.WalkFile("block_headers"), "b0\nb1\n")
+	write(wi.WalkFile(ProcessingReportsTable), ""+
+		"1005360,root,reporter,"+headers+",s,e,OK,,\n"+
+		"1005361,root,reporter,"+headers+",s,e,OK,,\n")
+
+	report, err := verifyTasks(context.Background(), wi, 1005360, 1005361, []string{headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := report.TaskStatus[headers]; !ts.IsOK() {
+		t.Errorf("got status %+v for a walk covering its range, wanted ok", ts)
+	}
+
+	// Heights of the range that the consensus export stops short of are missing rather than silently unexpected
+	report, err = verifyTasks(context.Background(), wi, 1005360, 1005363, []string{headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := report.TaskStatus[headers]; !reflect.DeepEqual(ts.Missing, []int64{1005362, 1005363}) {
+		t.Errorf("got missing heights %v, wanted the heights beyond the consensus export", ts.Missing)
+	}
+}
@@ -5,9 +5,16 @@ import (
 	"time"
 )
 
+// WaitUntil checks condition after delay and then every interval until it reports that it is done or returns an error.
+// It suits periodic work and waits for a time to pass; lily requests and other operations that can fail transiently are
+// retried with Retry or Poll instead.
 func WaitUntil(ctx context.Context, condition func(context.Context) (bool, error), delay time.Duration, interval time.Duration) error {
 	if delay > 0 {
-		time.Sleep(delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	done, err := condition(ctx)
 	if err != nil {
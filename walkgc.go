@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lily/schedule"
+)
+
+// walkRefs counts the exports in this process that are using the output of each walk.
+type walkRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+// activeWalks holds the walks whose output is being verified or shipped by this process.
+var activeWalks = &walkRefs{refs: map[string]int{}}
+
+// hold records that an export is using the walk's output, returning a function that releases it.
+func (r *walkRefs) hold(name string) func() {
+	r.mu.Lock()
+	r.refs[name]++
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.refs[name]--; r.refs[name] <= 0 {
+			delete(r.refs, name)
+		}
+	}
+}
+
+// names returns the walks in use.
+func (r *walkRefs) names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.refs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// WalkCollector removes walk files from the storage path that no export will read again, such as the output of walks
+// that failed or were abandoned. A file is only removed once it has not been written to for the grace period and its
+// walk is not referenced by the state store, by a running job on any lily node or by an export running in this process.
+type WalkCollector struct {
+	StoragePath string
+	Grace       time.Duration
+
+	// jobs lists the jobs of every lily node, failing if any node cannot be reached.
+	jobs func(ctx context.Context) ([]schedule.JobListResult, error)
+}
+
+// WalkGCStats summarises a single pass of the walk collector.
+type WalkGCStats struct {
+	Files int   // walk files removed
+	Kept  int   // walk files older than the grace period that are still referenced
+	Bytes int64 // bytes reclaimed
+}
+
+// NewWalkCollector creates a collector for the configured storage path that lists jobs on the configured lily nodes.
+func NewWalkCollector() *WalkCollector {
+	return &WalkCollector{
+		StoragePath: storageConfig.path,
+		Grace:       walkGCConfig.grace,
+		jobs:        lilyJobLists,
+	}
+}
+
+// Collect runs a single pass of the collector. Nothing is removed if any of the references to walks cannot be read.
+func (c *WalkCollector) Collect(ctx context.Context) (*WalkGCStats, error) {
+	stats := &WalkGCStats{}
+
+	referenced, err := c.referencedWalks(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	files, err := storageFiles(c.StoragePath)
+	if err != nil {
+		return stats, err
+	}
+
+	// Only files named by the archiver's walks are considered, see unusedWalkName
+	var walkFiles []pruneCandidate
+	for _, f := range files {
+		if strings.HasPrefix(f.rel, "arch") {
+			walkFiles = append(walkFiles, f)
+		}
+	}
+
+	selected := selectPruneCandidates(walkFiles, time.Now().Add(-c.Grace), func(rel string) bool {
+		for _, name := range referenced {
+			if strings.HasPrefix(rel, name+"-") {
+				stats.Kept++
+				return true
+			}
+		}
+		return false
+	})
+
+	ll := logger.With("storage_path", c.StoragePath)
+	for _, f := range selected {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		ll.Infow("removing orphaned walk file", "file", f.rel, "size", f.size, "modified", f.modTime.Format(time.RFC3339))
+		if err := os.Remove(filepath.Join(c.StoragePath, f.rel)); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return stats, fmt.Errorf("remove: %w", err)
+		}
+		stats.Files++
+		stats.Bytes += f.size
+	}
+	return stats, nil
+}
+
+// referencedWalks returns the names of every walk whose output may still be read.
+func (c *WalkCollector) referencedWalks(ctx context.Context) ([]string, error) {
+	var names []string
+	if stateStore != nil {
+		cw, err := stateStore.CompletedWalks()
+		if err != nil {
+			return nil, fmt.Errorf("read completed walks: %w", err)
+		}
+		for _, w := range cw {
+			names = append(names, w.Walk.Name)
+		}
+
+		hw, err := stateStore.HandedOffWalks()
+		if err != nil {
+			return nil, fmt.Errorf("read handed off walks: %w", err)
+		}
+		for _, w := range hw {
+			names = append(names, w.Walk)
+		}
+	}
+
+	jobs, err := c.jobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list lily jobs: %w", err)
+	}
+	for _, jr := range jobs {
+		if jr.Running {
+			names = append(names, jr.Name)
+		}
+	}
+
+	names = append(names, activeWalks.names()...)
+	names = append(names, rangeWalks.names()...)
+	return names, nil
+}
+
+// lilyJobLists lists the jobs of every configured lily node.
+func lilyJobLists(ctx context.Context) ([]schedule.JobListResult, error) {
+	var jobs []schedule.JobListResult
+	for _, n := range lilyNodes.Nodes() {
+		api, closer, err := getLilyAPI(ctx, n.Addr, n.Token)
+		if err != nil {
+			return nil, fmt.Errorf("connect to lily api at %s: %w", n.Addr, err)
+		}
+		jrs, err := api.LilyJobList(ctx)
+		closer()
+		if err != nil {
+			return nil, fmt.Errorf("list jobs on %s: %w", n.Addr, err)
+		}
+		jobs = append(jobs, jrs...)
+	}
+	return jobs, nil
+}
+
+// Run collects orphaned walk files at the given interval until the context is cancelled.
+func (c *WalkCollector) Run(ctx context.Context, interval time.Duration) {
+	collect := func(ctx context.Context) (bool, error) {
+		stats, err := c.Collect(ctx)
+		walkGCFilesCounter.Add(float64(stats.Files))
+		walkGCBytesCounter.Add(float64(stats.Bytes))
+		if err != nil {
+			logger.Errorw("walk file collection failed", "error", err)
+			return false, nil
+		}
+		logger.Infow("walk file collection complete", "files", stats.Files, "kept", stats.Kept, "bytes", stats.Bytes)
+		return false, nil
+	}
+
+	if err := WaitUntil(ctx, collect, 0, interval); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Errorw("walk file collector stopped", "error", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lily/schedule"
+)
+
+func TestWalkCollector(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+
+	var err error
+	stateStore, err = openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{
+		"arch0801-2021-08-01-messages.csv",      // orphaned
+		"arch0802-2021-08-02-messages.csv",      // completed walk not yet shipped
+		"arch0803-2021-08-03-messages.csv",      // handed off walk
+		"arch0804-2021-08-04-messages.csv",      // running lily job
+		"arch0805-2021-08-05-messages.csv",      // being shipped by this process
+		"arch0806-2021-08-06-messages.csv",      // within the grace period
+		"arch0801-7-2021-08-01-repair-receipts", // orphaned
+		"lily.log",                              // not a walk file
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("data"), DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+		if name != "arch0806-2021-08-06-messages.csv" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1002480, EndHeight: 1005359}
+	if err := stateStore.AddCompletedWalk(&CompletedWalk{Network: "mainnet", Date: p.Date, From: p.StartHeight, To: p.EndHeight, Walk: WalkInfo{Name: "arch0802-2021-08-02", Path: dir, Format: "csv"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stateStore.AddHandedOffWalk(&HandedOffWalk{Network: "mainnet", Date: Date{Year: 2021, Month: 8, Day: 3}, Walk: "arch0803-2021-08-03"}); err != nil {
+		t.Fatal(err)
+	}
+	defer activeWalks.hold("arch0805-2021-08-05")()
+
+	c := &WalkCollector{StoragePath: dir, Grace: time.Hour}
+
+	// Nothing is removed when a lily node cannot be asked which walks are running
+	c.jobs = func(ctx context.Context) ([]schedule.JobListResult, error) {
+		return nil, errors.New("unavailable")
+	}
+	if _, err := c.Collect(ctx); err == nil {
+		t.Fatalf("expected an error when lily jobs cannot be listed")
+	}
+
+	c.jobs = func(ctx context.Context) ([]schedule.JobListResult, error) {
+		return []schedule.JobListResult{
+			{Name: "arch0804-2021-08-04", Type: "walk", Running: true},
+			{Name: "arch0801-2021-08-01", Type: "walk", Running: false},
+		}, nil
+	}
+	stats, err := c.Collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 2 || stats.Bytes != 8 || stats.Kept != 4 {
+		t.Errorf("got stats %+v, wanted 2 files and 8 bytes removed and 4 files kept", stats)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+	sort.Strings(remaining)
+	want := []string{
+		"arch0802-2021-08-02-messages.csv",
+		"arch0803-2021-08-03-messages.csv",
+		"arch0804-2021-08-04-messages.csv",
+		"arch0805-2021-08-05-messages.csv",
+		"arch0806-2021-08-06-messages.csv",
+		"lily.log",
+	}
+	if !reflect.DeepEqual(remaining, want) {
+		t.Errorf("got remaining files %v, wanted %v", remaining, want)
+	}
+}
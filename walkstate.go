@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const walksCollection = "walks"
+
+// CompletedWalk records a lily job whose output has been written but not yet fully shipped, so that the output can be
+// shipped after a restart instead of running the job again.
+type CompletedWalk struct {
+	Network   string    `json:"network"`
+	Date      Date      `json:"date"`
+	Hour      int       `json:"hour,omitempty"`   // hour the walk's period starts at, for hourly periods
+	Ranged    bool      `json:"ranged,omitempty"` // walk covered a height range rather than a calendar day
+	From      int64     `json:"from,omitempty"`
+	To        int64     `json:"to,omitempty"`
+	Group     string    `json:"group,omitempty"` // task group run by the walk when the period's walk is split
+	Walk      WalkInfo  `json:"walk"`
+	Tasks     []string  `json:"tasks"`
+	Completed time.Time `json:"completed"`
+}
+
+// Period returns the export period covered by the walk.
+func (w *CompletedWalk) Period() ExportPeriod {
+	return ExportPeriod{Date: w.Date, Hour: w.Hour, StartHeight: w.From, EndHeight: w.To, Ranged: w.Ranged}
+}
+
+// CompletedWalks maps a key made up of network, export period and task group to the completed walk for that export
+// period.
+type CompletedWalks map[string]*CompletedWalk
+
+// completedWalkKey keys periods by their name and ranged periods by their height range. Walks of a task group are keyed
+// separately from each other and from a walk covering the whole period.
+func completedWalkKey(network string, p ExportPeriod, group string) string {
+	key := network + "/" + p.String()
+	if p.Ranged {
+		key = network + "/range/" + p.String()
+	}
+	if group != "" {
+		key += "/" + group
+	}
+	return key
+}
+
+// CompletedWalk returns the completed walk recorded for the network, period and task group, or nil if there is none.
+func (s *StateStore) CompletedWalk(network string, p ExportPeriod, group string) (*CompletedWalk, error) {
+	cw := CompletedWalks{}
+	if err := s.load(walksCollection, &cw); err != nil {
+		return nil, err
+	}
+	return cw[completedWalkKey(network, p, group)], nil
+}
+
+// CompletedWalks returns every completed walk whose output has not yet been fully shipped.
+func (s *StateStore) CompletedWalks() (CompletedWalks, error) {
+	cw := CompletedWalks{}
+	if err := s.load(walksCollection, &cw); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// AddCompletedWalk records a completed walk, replacing any previous walk for the same network, period and task group.
+func (s *StateStore) AddCompletedWalk(w *CompletedWalk) error {
+	cw := CompletedWalks{}
+	return s.update(walksCollection, &cw, func() error {
+		cw[completedWalkKey(w.Network, w.Period(), w.Group)] = w
+		return nil
+	})
+}
+
+// RemoveCompletedWalk removes the completed walk recorded for the network, period and task group.
+func (s *StateStore) RemoveCompletedWalk(network string, p ExportPeriod, group string) error {
+	cw := CompletedWalks{}
+	return s.update(walksCollection, &cw, func() error {
+		delete(cw, completedWalkKey(network, p, group))
+		return nil
+	})
+}
+
+// resumableWalk returns the walk info of a completed walk for the manifest that can be shipped without running
+// another job. The walk must have run every task needed by the manifest and its output must still be present.
+// Provisional walks are not recorded, so are repeated after a restart.
+func resumableWalk(em *ExportManifest) (*WalkInfo, error) {
+	if stateStore == nil || em.Provisional {
+		return nil, nil
+	}
+
+	cw, err := stateStore.CompletedWalk(em.Network, em.Period, em.Group)
+	if err != nil {
+		return nil, fmt.Errorf("read completed walk: %w", err)
+	}
+	if cw == nil {
+		return nil, nil
+	}
+
+	if !stringSliceContainsAll(cw.Tasks, tasksForManifest(em)) {
+		return nil, nil
+	}
+
+	// Verification relies on the consensus and processing reports output
+	for _, table := range []string{"chain_consensus", "visor_processing_reports"} {
+		if _, err := os.Stat(cw.Walk.WalkFile(table)); err != nil {
+			return nil, nil
+		}
+	}
+
+	return &cw.Walk, nil
+}
+
+// recordCompletedWalk records the walk info for the manifest in the state store, if one is configured.
+func recordCompletedWalk(em *ExportManifest, wi WalkInfo, tasks []string) error {
+	if stateStore == nil || em.Provisional {
+		return nil
+	}
+
+	return stateStore.AddCompletedWalk(&CompletedWalk{
+		Network:   em.Network,
+		Date:      em.Period.Date,
+		Hour:      em.Period.Hour,
+		Ranged:    em.Period.Ranged,
+		From:      em.Period.StartHeight,
+		To:        em.Period.EndHeight,
+		Group:     em.Group,
+		Walk:      wi,
+		Tasks:     tasks,
+		Completed: time.Now().UTC(),
+	})
+}
+
+// forgetCompletedWalk removes the walk info for the manifest from the state store, if one is configured.
+func forgetCompletedWalk(em *ExportManifest) error {
+	if stateStore == nil || em.Provisional {
+		return nil
+	}
+
+	return stateStore.RemoveCompletedWalk(em.Network, em.Period, em.Group)
+}
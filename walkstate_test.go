@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/filecoin-project/lily/chain/indexer/tasktype"
+)
+
+// writeWalkFiles creates the walk output that resumableWalk requires to be present.
+func writeWalkFiles(t *testing.T, wi WalkInfo) {
+	t.Helper()
+	for _, table := range []string{"chain_consensus", "visor_processing_reports"} {
+		if err := os.WriteFile(wi.WalkFile(table), nil, DefaultFilePerms); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumableWalk(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+
+	dir := t.TempDir()
+	d, _ := DateFromString("2021-08-02")
+	em := &ExportManifest{
+		Period:  ExportPeriod{Date: d, StartHeight: 1005360, EndHeight: 1008239},
+		Network: "mainnet",
+		Files: []*ExportFile{
+			{TableName: "messages"},
+			{TableName: "block_headers"},
+			{TableName: "chain_consensus", Shipped: true},
+		},
+	}
+	wi := WalkInfo{Name: "walk-2021-08-02", Path: t.TempDir(), Format: "csv"}
+	tasks := []string{tasktype.Message, tasktype.BlockHeader}
+
+	// Without a state store walks are neither recorded nor resumed
+	stateStore = nil
+	if err := recordCompletedWalk(em, wi, tasks); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resumableWalk(em); err != nil || got != nil {
+		t.Fatalf("got resumable walk %v (%v) without a state store", got, err)
+	}
+
+	var err error
+	if stateStore, err = openStateStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordCompletedWalk(em, wi, tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	// The walk's output must still be present to resume it
+	if got, err := resumableWalk(em); err != nil || got != nil {
+		t.Errorf("got resumable walk %v (%v) without its output", got, err)
+	}
+	writeWalkFiles(t, wi)
+
+	// Completed walks persist across a restart
+	if stateStore, err = openStateStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := resumableWalk(em)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || *got != wi {
+		t.Fatalf("got resumable walk %v, wanted %v", got, wi)
+	}
+
+	// A walk that did not run every task still needed by the manifest is run again
+	em.Files = append(em.Files, &ExportFile{TableName: "block_parents"})
+	if got, err := resumableWalk(em); err != nil || got != nil {
+		t.Errorf("got resumable walk %v (%v) missing a needed task", got, err)
+	}
+	em.Files[len(em.Files)-1].Shipped = true
+	if got, err := resumableWalk(em); err != nil || got == nil {
+		t.Errorf("got no resumable walk (%v) once the extra table was shipped", err)
+	}
+
+	if err := forgetCompletedWalk(em); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resumableWalk(em); err != nil || got != nil {
+		t.Errorf("got resumable walk %v (%v) after it was forgotten", got, err)
+	}
+}
+
+func TestProvisionalWalkNotRecorded(t *testing.T) {
+	defer func(s *StateStore) { stateStore = s }(stateStore)
+
+	var err error
+	if stateStore, err = openStateStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := DateFromString("2021-08-02")
+	em := &ExportManifest{
+		Period:      ExportPeriod{Date: d},
+		Network:     "mainnet",
+		Files:       []*ExportFile{{TableName: "messages"}},
+		Provisional: true,
+	}
+	wi := WalkInfo{Name: "walk-2021-08-02", Path: t.TempDir(), Format: "csv"}
+	writeWalkFiles(t, wi)
+
+	if err := recordCompletedWalk(em, wi, []string{tasktype.Message}); err != nil {
+		t.Fatal(err)
+	}
+	cw, err := stateStore.CompletedWalks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cw) != 0 {
+		t.Errorf("provisional walk was recorded: %v", cw)
+	}
+}
+
+func TestCompletedWalkKeys(t *testing.T) {
+	s, err := openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := DateFromString("2021-08-02")
+	day := ExportPeriod{Date: d, StartHeight: 1005360, EndHeight: 1008239}
+	ranged := ExportPeriod{StartHeight: 1005360, EndHeight: 1008239, Ranged: true}
+
+	walks := []*CompletedWalk{
+		{Network: "mainnet", Date: day.Date, From: day.StartHeight, To: day.EndHeight, Walk: WalkInfo{Name: "day"}},
+		{Network: "mainnet", Date: day.Date, From: day.StartHeight, To: day.EndHeight, Group: "actors", Walk: WalkInfo{Name: "group"}},
+		{Network: "mainnet", Ranged: true, From: ranged.StartHeight, To: ranged.EndHeight, Walk: WalkInfo{Name: "range"}},
+		{Network: "calibnet", Date: day.Date, From: day.StartHeight, To: day.EndHeight, Walk: WalkInfo{Name: "calibnet"}},
+	}
+	for _, w := range walks {
+		if err := s.AddCompletedWalk(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		network string
+		period  ExportPeriod
+		group   string
+		want    string
+	}{
+		{network: "mainnet", period: day, want: "day"},
+		{network: "mainnet", period: day, group: "actors", want: "group"},
+		{network: "mainnet", period: day, group: "messages", want: ""},
+		{network: "mainnet", period: ranged, want: "range"},
+		{network: "calibnet", period: day, want: "calibnet"},
+		{network: "calibnet", period: ranged, want: ""},
+	}
+	for _, tc := range testCases {
+		cw, err := s.CompletedWalk(tc.network, tc.period, tc.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if cw != nil {
+			got = cw.Walk.Name
+		}
+		if got != tc.want {
+			t.Errorf("%s %s %q: got walk %q, wanted %q", tc.network, tc.period.String(), tc.group, got, tc.want)
+		}
+	}
+
+	// Replacing a walk keeps a single entry for the period
+	if err := s.AddCompletedWalk(&CompletedWalk{Network: "mainnet", Date: day.Date, From: day.StartHeight, To: day.EndHeight, Walk: WalkInfo{Name: "again"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveCompletedWalk("mainnet", ranged, ""); err != nil {
+		t.Fatal(err)
+	}
+	cw, err := s.CompletedWalks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cw) != 3 {
+		t.Errorf("got %d completed walks, wanted 3", len(cw))
+	}
+	if w, _ := s.CompletedWalk("mainnet", day, ""); w == nil || w.Walk.Name != "again" {
+		t.Errorf("got walk %v, wanted the replacement", w)
+	}
+}
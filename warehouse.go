@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	metrics "github.com/ipfs/go-metrics-interface"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Warehouse types that shipped files may be loaded into
+const (
+	WarehouseBigQuery   = "bigquery"
+	WarehouseClickHouse = "clickhouse"
+)
+
+// WarehouseConfig is read from the file given by --warehouse-config. It names the warehouses that shipped files are
+// loaded into and the tables loaded into each.
+type WarehouseConfig struct {
+	Warehouses map[string]*WarehouseSpec `yaml:"warehouses" toml:"warehouses"`
+	Tables     map[string][]string       `yaml:"tables" toml:"tables"` // names of the warehouses each table is loaded into, with * matching every table not listed
+}
+
+// WarehouseSpec describes a single warehouse.
+type WarehouseSpec struct {
+	Type        string `yaml:"type" toml:"type"`                 // one of bigquery or clickhouse
+	TablePrefix string `yaml:"table_prefix" toml:"table_prefix"` // prepended to the table name to give the warehouse table
+
+	// BigQuery
+	Project     string `yaml:"project" toml:"project"`
+	Dataset     string `yaml:"dataset" toml:"dataset"`
+	Location    string `yaml:"location" toml:"location"`       // location of the dataset, such as US
+	Credentials string `yaml:"credentials" toml:"credentials"` // path to a service account key, the application default credentials are used if empty
+
+	// ClickHouse
+	URL      string `yaml:"url" toml:"url"` // url of the http interface, such as http://localhost:8123
+	Database string `yaml:"database" toml:"database"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+}
+
+// loadWarehouseConfig reads a warehouse configuration file, decoding it as toml if its name ends in .toml and yaml
+// otherwise.
+func loadWarehouseConfig(path string) (*WarehouseConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var wc WarehouseConfig
+	switch filepath.Ext(path) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &wc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	default:
+		if err := yaml.Unmarshal(data, &wc); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	if err := wc.Validate(); err != nil {
+		return nil, err
+	}
+	return &wc, nil
+}
+
+// Validate checks that every warehouse is fully described and that every table and warehouse named is known.
+func (wc *WarehouseConfig) Validate() error {
+	for name, ws := range wc.Warehouses {
+		if ws == nil {
+			return fmt.Errorf("warehouse %s: missing description", name)
+		}
+		switch ws.Type {
+		case WarehouseBigQuery:
+			if ws.Project == "" || ws.Dataset == "" {
+				return fmt.Errorf("warehouse %s: bigquery requires a project and dataset", name)
+			}
+		case WarehouseClickHouse:
+			if ws.URL == "" {
+				return fmt.Errorf("warehouse %s: clickhouse requires a url", name)
+			}
+		default:
+			return fmt.Errorf("warehouse %s: unknown type %q", name, ws.Type)
+		}
+	}
+	for table, names := range wc.Tables {
+		if _, ok := TablesByName[deltaBaseTable(table)]; !ok && table != "*" {
+			return fmt.Errorf("unknown table %q", table)
+		}
+		for _, name := range names {
+			if _, ok := wc.Warehouses[name]; !ok {
+				return fmt.Errorf("table %s: unknown warehouse %q", table, name)
+			}
+		}
+	}
+	return nil
+}
+
+// WarehousesForTable returns the names of the warehouses a table is loaded into.
+func (wc *WarehouseConfig) WarehousesForTable(table string) []string {
+	if names, ok := wc.Tables[table]; ok {
+		return names
+	}
+	// Delta files repeat rows of their table's files, so are only loaded when named
+	if deltaBaseTable(table) != table {
+		return nil
+	}
+	return wc.Tables["*"]
+}
+
+// WarehouseSource is a shipped file to be loaded into a warehouse.
+type WarehouseSource struct {
+	File  *PeriodManifestFile
+	Local string // path of the file on the local filesystem, empty if the ship path is an object store
+	URI   string // gs:// location of the file, empty unless the ship path is in Google Cloud Storage
+}
+
+// Warehouse loads shipped files into an analytics warehouse.
+type Warehouse interface {
+	// Load loads the file into the named table, returning a reference to the load for the operator, such as a job
+	// id. The key is unique to this version of the file and is passed to the warehouse where it supports
+	// deduplicating loads, so that a load retried after an uncertain failure is not applied twice.
+	Load(ctx context.Context, src *WarehouseSource, table string, key string) (string, error)
+
+	// String returns the location of the warehouse, for use in log messages.
+	String() string
+}
+
+func newWarehouse(ws *WarehouseSpec) (Warehouse, error) {
+	switch ws.Type {
+	case WarehouseBigQuery:
+		return newBigQueryWarehouse(ws)
+	case WarehouseClickHouse:
+		return newClickHouseWarehouse(ws)
+	default:
+		return nil, fmt.Errorf("unknown warehouse type %q", ws.Type)
+	}
+}
+
+var (
+	// currentWarehouseConfig is the warehouse configuration in use by the process, nil if files are not loaded into
+	// warehouses
+	currentWarehouseConfig *WarehouseConfig
+
+	// warehouses are the configured warehouses, keyed by name
+	warehouses map[string]Warehouse
+)
+
+// configureWarehouses reads the warehouse configuration file and creates its warehouses. Loads are tracked in the
+// state store, so one must be configured.
+func configureWarehouses(path string) error {
+	currentWarehouseConfig, warehouses = nil, nil
+	if path == "" {
+		return nil
+	}
+	if stateStore == nil {
+		return fmt.Errorf("loading files into warehouses requires a state path")
+	}
+	if shipEncryption() != "" {
+		return fmt.Errorf("encrypted files cannot be loaded into warehouses")
+	}
+
+	wc, err := loadWarehouseConfig(path)
+	if err != nil {
+		return err
+	}
+	whs := map[string]Warehouse{}
+	for name, ws := range wc.Warehouses {
+		wh, err := newWarehouse(ws)
+		if err != nil {
+			return fmt.Errorf("warehouse %s: %w", name, err)
+		}
+		whs[name] = wh
+	}
+	currentWarehouseConfig, warehouses = wc, whs
+	return nil
+}
+
+const warehouseLoadsCollection = "warehouse_loads"
+
+// WarehouseLoad records a shipped file that has been loaded into a warehouse.
+type WarehouseLoad struct {
+	Warehouse string    `json:"warehouse"`
+	Path      string    `json:"path"`   // path of the file relative to the ship path
+	SHA256    string    `json:"sha256"` // checksum of the version of the file that was loaded
+	Table     string    `json:"table"`  // warehouse table the file was loaded into
+	Ref       string    `json:"ref,omitempty"`
+	Loaded    time.Time `json:"loaded"`
+}
+
+// WarehouseLoads maps a key made up of the warehouse name and file path to the most recent load of that file.
+type WarehouseLoads map[string]*WarehouseLoad
+
+func warehouseLoadKey(warehouse, path string) string {
+	return warehouse + "/" + path
+}
+
+// WarehouseLoad returns the most recent load of the file into the warehouse, or nil if it has not been loaded.
+func (s *StateStore) WarehouseLoad(warehouse, path string) (*WarehouseLoad, error) {
+	wl := WarehouseLoads{}
+	if err := s.load(warehouseLoadsCollection, &wl); err != nil {
+		return nil, err
+	}
+	return wl[warehouseLoadKey(warehouse, path)], nil
+}
+
+// AddWarehouseLoad records a load, replacing any previous load of the same file into the same warehouse.
+func (s *StateStore) AddWarehouseLoad(l *WarehouseLoad) error {
+	wl := WarehouseLoads{}
+	return s.update(warehouseLoadsCollection, &wl, func() error {
+		wl[warehouseLoadKey(l.Warehouse, l.Path)] = l
+		return nil
+	})
+}
+
+// warehouseSource returns the source of a shipped file for loading into a warehouse.
+func warehouseSource(f *PeriodManifestFile, sh Shipper) *WarehouseSource {
+	src := &WarehouseSource{File: f}
+	if root, ok := localShipPath(sh); ok {
+		src.Local = filepath.Join(root, filepath.FromSlash(f.Path))
+	} else if loc := sh.String(); strings.HasPrefix(loc, "gs://") {
+		src.URI = strings.TrimSuffix(loc, "/") + "/" + f.Path
+	}
+	return src
+}
+
+// loadPeriodIntoWarehouses loads each file listed in the period's manifest into the warehouses configured for its
+// table. A file is loaded once for each version shipped, so a file that is replaced by a re-export is loaded again.
+// Files are loaded in order of path and loading stops at the first failure so that it can be retried.
+func loadPeriodIntoWarehouses(ctx context.Context, p ExportPeriod, network string, sh Shipper) error {
+	wc := currentWarehouseConfig
+	if wc == nil {
+		return nil
+	}
+	ll := logger.With("date", p.Date.String(), "from", p.StartHeight, "to", p.EndHeight)
+
+	data, err := sh.Read(ctx, periodManifestPath(network, p))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	pm := &PeriodManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		return fmt.Errorf("decode manifest: %w", err)
+	}
+
+	for _, f := range pm.Files {
+		if f.Provisional {
+			continue
+		}
+		names := append([]string{}, wc.WarehousesForTable(f.Table)...)
+		sort.Strings(names)
+		for _, name := range names {
+			prev, err := stateStore.WarehouseLoad(name, f.Path)
+			if err != nil {
+				return fmt.Errorf("read warehouse load: %w", err)
+			}
+			if prev != nil && prev.SHA256 == f.SHA256 {
+				continue
+			}
+
+			wh := warehouses[name]
+			table := wc.Warehouses[name].TablePrefix + f.Table
+			start := time.Now()
+			ref, err := wh.Load(ctx, warehouseSource(f, sh), table, f.SHA256)
+			if err != nil {
+				return fmt.Errorf("load %s into warehouse %s: %w", f.Path, name, err)
+			}
+			warehouseLoadsCounter.Inc()
+			ll.Infow("loaded file into warehouse", "file", f.Path, "warehouse", name, "table", table, "ref", ref, "took", time.Since(start).String())
+
+			if err := stateStore.AddWarehouseLoad(&WarehouseLoad{
+				Warehouse: name,
+				Path:      f.Path,
+				SHA256:    f.SHA256,
+				Table:     table,
+				Ref:       ref,
+				Loaded:    time.Now().UTC(),
+			}); err != nil {
+				return fmt.Errorf("record warehouse load: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+var warehouseLoadCommand = &cli.Command{
+	Name:   "warehouse-load",
+	Usage:  "Load the files already shipped for a range of dates into the configured warehouses.",
+	Before: configure,
+	Flags: flagSet(
+		loggingFlags,
+		networkFlags,
+		tableRegistryFlags,
+		storageFlags,
+		requiredStateFlags,
+		objectStoreFlags,
+		warehouseFlags,
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:     "ship-path",
+				EnvVars:  []string{"ARCHIVER_SHIP_PATH"},
+				Usage:    "Path used to write verified exports from lily, or an s3://bucket/prefix or gs://bucket/prefix object store location.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "from-date",
+				Usage:    "First date to load, in YYYY-MM-DD format.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "to-date",
+				Usage:    "Last date to load, in YYYY-MM-DD format.",
+				Required: true,
+			},
+		},
+	),
+	Action: func(cc *cli.Context) error {
+		ctx := metrics.CtxScope(cc.Context, appName)
+		setupMetrics(ctx)
+
+		if currentWarehouseConfig == nil {
+			return fmt.Errorf("no warehouses configured, use --warehouse-config")
+		}
+
+		fromDate, err := DateFromString(cc.String("from-date"))
+		if err != nil {
+			return fmt.Errorf("invalid from date: %w", err)
+		}
+		toDate, err := DateFromString(cc.String("to-date"))
+		if err != nil {
+			return fmt.Errorf("invalid to date: %w", err)
+		}
+		if fromDate.After(toDate) {
+			return fmt.Errorf("from date must not be after to date")
+		}
+
+		sh, err := newShipper(cc.String("ship-path"))
+		if err != nil {
+			return fmt.Errorf("invalid ship path: %w", err)
+		}
+
+		p, err := exportPeriodForDate(fromDate, networkConfig.genesisTs)
+		if err != nil {
+			return fmt.Errorf("invalid from date: %w", err)
+		}
+		for ; !p.Date.After(toDate); p = p.Next() {
+			if err := loadPeriodIntoWarehouses(ctx, p, networkConfig.name, sh); err != nil {
+				return fmt.Errorf("period %s: %w", p.String(), err)
+			}
+		}
+		return nil
+	},
+}
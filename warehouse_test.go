@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	metrics "github.com/ipfs/go-metrics-interface"
+	bigqueryapi "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+)
+
+func TestWarehouseConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name string
+		wc   WarehouseConfig
+		ok   bool
+	}{
+		{
+			name: "valid",
+			wc: WarehouseConfig{
+				Warehouses: map[string]*WarehouseSpec{
+					"bq": {Type: WarehouseBigQuery, Project: "p", Dataset: "d"},
+					"ch": {Type: WarehouseClickHouse, URL: "http://localhost:8123"},
+				},
+				Tables: map[string][]string{"messages": {"bq", "ch"}, "*": {"ch"}},
+			},
+			ok: true,
+		},
+		{
+			name: "unknown type",
+			wc:   WarehouseConfig{Warehouses: map[string]*WarehouseSpec{"x": {Type: "redshift"}}},
+		},
+		{
+			name: "bigquery without dataset",
+			wc:   WarehouseConfig{Warehouses: map[string]*WarehouseSpec{"bq": {Type: WarehouseBigQuery, Project: "p"}}},
+		},
+		{
+			name: "unknown table",
+			wc: WarehouseConfig{
+				Warehouses: map[string]*WarehouseSpec{"ch": {Type: WarehouseClickHouse, URL: "http://localhost:8123"}},
+				Tables:     map[string][]string{"nonsense": {"ch"}},
+			},
+		},
+		{
+			name: "unknown warehouse",
+			wc:   WarehouseConfig{Tables: map[string][]string{"messages": {"ch"}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.wc.Validate()
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !tc.ok && err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+
+	wc := testCases[0].wc
+	if got := wc.WarehousesForTable("block_headers"); len(got) != 1 || got[0] != "ch" {
+		t.Errorf("unexpected warehouses for unlisted table: %v", got)
+	}
+}
+
+func TestClickHouseWarehouseLoad(t *testing.T) {
+	var query, encoding, token, user, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, token = r.URL.Query().Get("query"), r.URL.Query().Get("insert_deduplication_token")
+		encoding, user = r.Header.Get("Content-Encoding"), r.Header.Get("X-ClickHouse-User")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.Header().Set("X-ClickHouse-Query-Id", "q1")
+	}))
+	defer srv.Close()
+
+	local := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(local, []byte("compressed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := newClickHouseWarehouse(&WarehouseSpec{Type: WarehouseClickHouse, URL: srv.URL, Database: "filecoin", User: "archiver"})
+	if err != nil {
+		t.Fatalf("new warehouse: %v", err)
+	}
+	src := &WarehouseSource{File: &PeriodManifestFile{Format: FormatCSV, Compression: "gzip"}, Local: local}
+	ref, err := ch.Load(context.Background(), src, "messages", "abc")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if query != "INSERT INTO `filecoin`.`messages` FORMAT CSV" {
+		t.Errorf("unexpected query %q", query)
+	}
+	if ref != "q1" || token != "abc" || encoding != "gzip" || user != "archiver" || body != "compressed" {
+		t.Errorf("unexpected request: ref=%q token=%q encoding=%q user=%q body=%q", ref, token, encoding, user, body)
+	}
+
+	src.Local = ""
+	if _, err := ch.Load(context.Background(), src, "messages", "abc"); err == nil {
+		t.Errorf("expected an error loading from an object store ship path")
+	}
+}
+
+func TestBigQueryWarehouseLoad(t *testing.T) {
+	ctx := context.Background()
+
+	var submitted []*bigqueryapi.Job
+	var uploaded string
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const jobs = "/bigquery/v2/projects/proj/jobs/"
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/bigquery/v2/projects/proj/jobs":
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				t.Errorf("content type: %v", err)
+				return
+			}
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			part, _ := mr.NextPart()
+			var job bigqueryapi.Job
+			if err := json.NewDecoder(part).Decode(&job); err != nil {
+				t.Errorf("decode job: %v", err)
+			}
+			part, _ = mr.NextPart()
+			data, _ := io.ReadAll(part)
+			uploaded = string(data)
+
+			// The job is rejected as a duplicate if it was submitted before
+			for _, prev := range submitted {
+				if prev.JobReference.JobId == job.JobReference.JobId {
+					w.WriteHeader(http.StatusConflict)
+					_, _ = w.Write([]byte(`{"error":{"code":409,"message":"Already Exists"}}`))
+					return
+				}
+			}
+			submitted = append(submitted, &job)
+			job.Status = &bigqueryapi.JobStatus{State: "RUNNING"}
+			_ = json.NewEncoder(w).Encode(&job)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, jobs):
+			polls++
+			job := &bigqueryapi.Job{
+				JobReference:  &bigqueryapi.JobReference{ProjectId: "proj", JobId: strings.TrimPrefix(r.URL.Path, jobs)},
+				Configuration: &bigqueryapi.JobConfiguration{Load: &bigqueryapi.JobConfigurationLoad{}},
+				Status:        &bigqueryapi.JobStatus{State: "DONE"},
+			}
+			_ = json.NewEncoder(w).Encode(job)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	local := filepath.Join(t.TempDir(), "messages.csv.gz")
+	if err := os.WriteFile(local, []byte("compressed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := bigquery.NewClient(ctx, "proj", option.WithEndpoint(srv.URL+"/bigquery/v2/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bq := &bigQueryWarehouse{project: "proj", dataset: "filecoin", client: client}
+
+	src := &WarehouseSource{File: &PeriodManifestFile{Path: "mainnet/csv/1/messages/2021/messages-2021-08-02.csv.gz", Format: FormatCSV, Compression: "gzip"}, Local: local}
+	ref, err := bq.Load(ctx, src, "messages", "abc")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if len(submitted) != 1 || ref != bigQueryJobID("filecoin", "messages", src.File.Path, "abc") || submitted[0].JobReference.JobId != ref {
+		t.Fatalf("unexpected job id %q, submitted %v", ref, submitted)
+	}
+	load := submitted[0].Configuration.Load
+	if load == nil || load.SourceFormat != "CSV" || !load.AllowQuotedNewlines || load.DestinationTable.DatasetId != "filecoin" || load.DestinationTable.TableId != "messages" || load.WriteDisposition != "WRITE_APPEND" {
+		t.Errorf("unexpected load configuration: %+v", load)
+	}
+	if uploaded != "compressed" {
+		t.Errorf("unexpected upload %q", uploaded)
+	}
+	if polls != 1 {
+		t.Errorf("got %d polls, expected the job to be polled until done", polls)
+	}
+
+	// Loading the same version of the file again waits on the job that was submitted first
+	if ref2, err := bq.Load(ctx, src, "messages", "abc"); err != nil || ref2 != ref {
+		t.Errorf("got job %q (%v) loading the file again, wanted the original job %q", ref2, err, ref)
+	}
+	if len(submitted) != 1 {
+		t.Errorf("got %d jobs submitted, wanted the duplicate to be rejected", len(submitted))
+	}
+
+	src.File.Compression = "zstd"
+	if _, err := bq.Load(ctx, src, "messages", "abc"); err == nil {
+		t.Errorf("expected an error loading zstd compressed csv")
+	}
+}
+
+type testWarehouse struct {
+	loads []string
+}
+
+func (w *testWarehouse) Load(ctx context.Context, src *WarehouseSource, table string, key string) (string, error) {
+	w.loads = append(w.loads, table+":"+key)
+	return "", nil
+}
+
+func (w *testWarehouse) String() string { return "test" }
+
+func TestLoadPeriodIntoWarehouses(t *testing.T) {
+	defer func(ss *StateStore, wc *WarehouseConfig, whs map[string]Warehouse) {
+		stateStore, currentWarehouseConfig, warehouses = ss, wc, whs
+	}(stateStore, currentWarehouseConfig, warehouses)
+	warehouseLoadsCounter = metrics.NewCtx(context.Background(), "warehouse_loads_total", "").Counter()
+
+	var err error
+	stateStore, err = openStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh := &testWarehouse{}
+	currentWarehouseConfig = &WarehouseConfig{
+		Warehouses: map[string]*WarehouseSpec{"test": {Type: WarehouseClickHouse, TablePrefix: "archive_"}},
+		Tables:     map[string][]string{"messages": {"test"}},
+	}
+	warehouses = map[string]Warehouse{"test": wh}
+
+	shipPath := t.TempDir()
+	sh, err := newShipper(shipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ExportPeriod{Date: Date{Year: 2021, Month: 8, Day: 2}, StartHeight: 1005360, EndHeight: 1008239}
+	writeManifest := func(sha string) {
+		pm := &PeriodManifest{
+			Network: "mainnet",
+			Date:    p.Date,
+			Files: []*PeriodManifestFile{
+				{Path: "a/messages.csv.gz", Table: "messages", SHA256: sha},
+				{Path: "a/block_headers.csv.gz", Table: "block_headers", SHA256: "bh"},
+				{Path: "a/provisional/messages.csv.gz", Table: "messages", SHA256: "p", Provisional: true},
+			},
+		}
+		data, _ := json.Marshal(pm)
+		if err := sh.Write(context.Background(), periodManifestPath("mainnet", p), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeManifest("v1")
+	for i := 0; i < 2; i++ {
+		if err := loadPeriodIntoWarehouses(context.Background(), p, "mainnet", sh); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+	}
+	if len(wh.loads) != 1 || wh.loads[0] != "archive_messages:v1" {
+		t.Errorf("expected a single load of the final messages file, got %v", wh.loads)
+	}
+
+	// A re-exported file is loaded again
+	writeManifest("v2")
+	if err := loadPeriodIntoWarehouses(context.Background(), p, "mainnet", sh); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(wh.loads) != 2 || wh.loads[1] != "archive_messages:v2" {
+		t.Errorf("expected the replaced file to be loaded, got %v", wh.loads)
+	}
+}
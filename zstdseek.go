@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The zstd seekable format writes a file as a sequence of independently compressed frames followed by a skippable
+// frame holding a seek table of frame sizes. Standard zstd decoders read the file as a normal zstd stream while
+// seekable-aware readers can decompress individual frames. See
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+const (
+	seekTableMagic     = 0x184D2A5E // skippable frame magic number used for the seek table
+	seekableMagic      = 0x8F92EAB1 // magic number at the end of the seek table footer
+	seekTableFooterLen = 9
+
+	// SeekIndexSuffix is appended to the path of a seekable file to give the path of its frame index.
+	SeekIndexSuffix = ".seek.json"
+
+	// DefaultSeekFrameSize is the default amount of uncompressed data held in each frame of a seekable file.
+	DefaultSeekFrameSize = 4 << 20
+)
+
+// SeekIndex is written alongside a seekable file and describes each of its frames so that consumers can fetch the
+// byte ranges holding a range of heights without reading the whole file.
+type SeekIndex struct {
+	Frames []SeekFrame `json:"frames"`
+}
+
+// SeekFrame describes a single frame of a seekable file. MinHeight and MaxHeight are -1 for tables without a height
+// column.
+type SeekFrame struct {
+	Offset           int64 `json:"offset"`            // offset of the compressed frame in the file
+	CompressedSize   int64 `json:"compressed_size"`   // size of the compressed frame
+	DecompressedSize int64 `json:"decompressed_size"` // size of the frame's data once decompressed
+	MinHeight        int64 `json:"min_height"`        // lowest height of a row in the frame
+	MaxHeight        int64 `json:"max_height"`        // highest height of a row in the frame
+}
+
+// Overlaps reports whether the frame may hold rows between min and max inclusive. A negative bound is ignored.
+func (f SeekFrame) Overlaps(min, max int64) bool {
+	if f.MinHeight < 0 {
+		return true
+	}
+	return (min < 0 || f.MaxHeight >= min) && (max < 0 || f.MinHeight <= max)
+}
+
+// writeSeekableZstd compresses csv data from r into w using the zstd seekable format. Frames hold roughly frameSize
+// bytes of uncompressed data and always end on a row boundary. heightColumn is the index of the height column used
+// to record each frame's height range, or -1 if the table has none. Options are passed to the zstd encoder.
+func writeSeekableZstd(r io.Reader, w io.Writer, frameSize int, heightColumn int, opts ...zstd.EOption) (*SeekIndex, error) {
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("new encoder: %w", err)
+	}
+	defer enc.Close()
+
+	idx := &SeekIndex{Frames: []SeekFrame{}}
+	var offset int64
+	var buf, compressed []byte
+	minHeight, maxHeight := int64(-1), int64(-1)
+
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		compressed = enc.EncodeAll(buf, compressed[:0])
+		if _, err := w.Write(compressed); err != nil {
+			return err
+		}
+		idx.Frames = append(idx.Frames, SeekFrame{
+			Offset:           offset,
+			CompressedSize:   int64(len(compressed)),
+			DecompressedSize: int64(len(buf)),
+			MinHeight:        minHeight,
+			MaxHeight:        maxHeight,
+		})
+		offset += int64(len(compressed))
+		buf = buf[:0]
+		minHeight, maxHeight = -1, -1
+		return nil
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	sc.Split(scanCSVRecords)
+	for sc.Scan() {
+		rec := sc.Bytes()
+		if heightColumn >= 0 {
+			height, err := csvRecordHeight(rec, heightColumn)
+			if err != nil {
+				return nil, err
+			}
+			if minHeight < 0 || height < minHeight {
+				minHeight = height
+			}
+			if height > maxHeight {
+				maxHeight = height
+			}
+		}
+
+		buf = append(buf, rec...)
+		if len(buf) >= frameSize {
+			if err := flush(); err != nil {
+				return nil, fmt.Errorf("write frame: %w", err)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("write frame: %w", err)
+	}
+
+	if _, err := w.Write(seekTable(idx)); err != nil {
+		return nil, fmt.Errorf("write seek table: %w", err)
+	}
+
+	return idx, nil
+}
+
+// seekTable encodes the frames of the index as a seek table in a skippable frame.
+func seekTable(idx *SeekIndex) []byte {
+	entries := len(idx.Frames) * 8
+	b := make([]byte, 8+entries+seekTableFooterLen)
+	binary.LittleEndian.PutUint32(b[0:], seekTableMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(entries+seekTableFooterLen))
+	p := 8
+	for _, f := range idx.Frames {
+		binary.LittleEndian.PutUint32(b[p:], uint32(f.CompressedSize))
+		binary.LittleEndian.PutUint32(b[p+4:], uint32(f.DecompressedSize))
+		p += 8
+	}
+	binary.LittleEndian.PutUint32(b[p:], uint32(len(idx.Frames)))
+	b[p+4] = 0 // descriptor: no checksums
+	binary.LittleEndian.PutUint32(b[p+5:], seekableMagic)
+	return b
+}
+
+// scanCSVRecords is a bufio.SplitFunc that returns whole csv records, including the terminating newline. Newlines
+// within quoted fields do not end a record.
+func scanCSVRecords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	quoted := false
+	for i, c := range data {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\n':
+			if !quoted {
+				return i + 1, data[:i+1], nil
+			}
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func csvRecordHeight(rec []byte, column int) (int64, error) {
+	cr := csv.NewReader(bytes.NewReader(rec))
+	cr.FieldsPerRecord = -1
+	row, err := cr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("parse row: %w", err)
+	}
+	if column >= len(row) {
+		return 0, fmt.Errorf("row has too few columns")
+	}
+	height, err := strconv.ParseInt(row[column], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed height %q: %w", row[column], err)
+	}
+	return height, nil
+}
+
+func readSeekIndex(path string) (*SeekIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var idx SeekIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &idx, nil
+}
+
+// seekableRangeReader decompresses only the frames of a seekable file that may hold rows in a height range.
+type seekableRangeReader struct {
+	f      *os.File
+	dec    *zstd.Decoder
+	frames []SeekFrame
+	cur    io.Reader
+}
+
+func newSeekableRangeReader(path string, idx *SeekIndex, min, max int64) (*seekableRangeReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("new decoder: %w", err)
+	}
+
+	r := &seekableRangeReader{f: f, dec: dec}
+	for _, fr := range idx.Frames {
+		if fr.Overlaps(min, max) {
+			r.frames = append(r.frames, fr)
+		}
+	}
+	return r, nil
+}
+
+func (r *seekableRangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if len(r.frames) == 0 {
+			return 0, io.EOF
+		}
+
+		fr := r.frames[0]
+		r.frames = r.frames[1:]
+		if err := r.dec.Reset(io.NewSectionReader(r.f, fr.Offset, fr.CompressedSize)); err != nil {
+			return 0, fmt.Errorf("reset decoder: %w", err)
+		}
+		r.cur = r.dec
+	}
+}
+
+func (r *seekableRangeReader) Close() error {
+	r.dec.Close()
+	return r.f.Close()
+}
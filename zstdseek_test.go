@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWriteSeekableZstd(t *testing.T) {
+	input := "a,10,x\nb,10,\"multi\nline\"\nc,11,y\nd,12,z\ne,13,w\n"
+
+	var out bytes.Buffer
+	idx, err := writeSeekableZstd(strings.NewReader(input), &out, 16, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantRanges := [][2]int64{{10, 10}, {11, 13}}
+	if len(idx.Frames) != len(wantRanges) {
+		t.Fatalf("got %d frames, wanted %d", len(idx.Frames), len(wantRanges))
+	}
+	var offset int64
+	for i, f := range idx.Frames {
+		if f.MinHeight != wantRanges[i][0] || f.MaxHeight != wantRanges[i][1] {
+			t.Errorf("frame %d: got heights %d-%d, wanted %d-%d", i, f.MinHeight, f.MaxHeight, wantRanges[i][0], wantRanges[i][1])
+		}
+		if f.Offset != offset {
+			t.Errorf("frame %d: got offset %d, wanted %d", i, f.Offset, offset)
+		}
+		offset += f.CompressedSize
+	}
+
+	// The whole file must be readable by a standard decoder
+	dec, err := zstd.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+	got, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	if string(got) != input {
+		t.Errorf("got %q, wanted %q", got, input)
+	}
+
+	// The seek table footer must list every frame
+	b := out.Bytes()
+	footer := b[len(b)-seekTableFooterLen:]
+	if n := binary.LittleEndian.Uint32(footer); n != uint32(len(idx.Frames)) {
+		t.Errorf("got %d frames in seek table, wanted %d", n, len(idx.Frames))
+	}
+	if m := binary.LittleEndian.Uint32(footer[5:]); m != seekableMagic {
+		t.Errorf("got seekable magic %x, wanted %x", m, seekableMagic)
+	}
+}
+
+func TestSeekFrameOverlaps(t *testing.T) {
+	testCases := []struct {
+		name     string
+		frame    SeekFrame
+		min, max int64
+		want     bool
+	}{
+		{name: "within", frame: SeekFrame{MinHeight: 10, MaxHeight: 20}, min: 12, max: 15, want: true},
+		{name: "before", frame: SeekFrame{MinHeight: 10, MaxHeight: 20}, min: 21, max: 30, want: false},
+		{name: "after", frame: SeekFrame{MinHeight: 10, MaxHeight: 20}, min: 0, max: 9, want: false},
+		{name: "edge", frame: SeekFrame{MinHeight: 10, MaxHeight: 20}, min: 20, max: -1, want: true},
+		{name: "no heights", frame: SeekFrame{MinHeight: -1, MaxHeight: -1}, min: 5, max: 6, want: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.frame.Overlaps(tc.min, tc.max); got != tc.want {
+				t.Errorf("got %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}